@@ -125,6 +125,12 @@ func GuestAccessForbidden(msg string) *MatrixError {
 	return &MatrixError{"M_GUEST_ACCESS_FORBIDDEN", msg}
 }
 
+// TooLarge is an error which is returned when the client uploads a file which
+// is larger than the server allows.
+func TooLarge(msg string) *MatrixError {
+	return &MatrixError{"M_TOO_LARGE", msg}
+}
+
 type IncompatibleRoomVersionError struct {
 	RoomVersion string `json:"room_version"`
 	Error       string `json:"error"`
@@ -169,3 +175,63 @@ func NotTrusted(serverName string) *MatrixError {
 		Err:     fmt.Sprintf("Untrusted server '%s'", serverName),
 	}
 }
+
+// NotYetUploaded is an error which is returned when the client tries to download
+// media which has been reserved with /create but has not been uploaded yet.
+func NotYetUploaded(msg string) *MatrixError {
+	return &MatrixError{"M_NOT_YET_UPLOADED", msg}
+}
+
+// CannotOverwriteMedia is an error which is returned when the client tries to
+// upload to a reserved media ID which already has content.
+func CannotOverwriteMedia(msg string) *MatrixError {
+	return &MatrixError{"M_CANNOT_OVERWRITE_MEDIA", msg}
+}
+
+// UnsupportedMediaType is an error which is returned when the client uploads a file
+// whose type the server doesn't accept, or which isn't a valid file of its type.
+func UnsupportedMediaType(msg string) *MatrixError {
+	return &MatrixError{"M_UNSUPPORTED_MEDIA_TYPE", msg}
+}
+
+// QuotaExceeded is an error which is returned when storing what the client sent
+// would go over a limit on how much may be stored.
+func QuotaExceeded(msg string) *MatrixError {
+	return &MatrixError{"M_QUOTA_EXCEEDED", msg}
+}
+
+// UpstreamFailed is an error which is returned when the server couldn't get what
+// the client asked for from another server, which may work if tried again later.
+func UpstreamFailed(msg string) *MatrixError {
+	return &MatrixError{"M_UPSTREAM_FAILED", msg}
+}
+
+// Unavailable is an error which is returned when the server can't handle the request
+// at the moment, e.g. because it is shutting down, which may work if tried again later.
+func Unavailable(msg string) *MatrixError {
+	return &MatrixError{"M_UNAVAILABLE", msg}
+}
+
+// InsufficientStorage is an error which is returned when the server has no room left
+// to store what the client sent.
+func InsufficientStorage(msg string) *MatrixError {
+	return &MatrixError{"M_INSUFFICIENT_STORAGE", msg}
+}
+
+// UploadTimedOut is an error which is returned when the client took too long to send
+// the file it is uploading.
+func UploadTimedOut(msg string) *MatrixError {
+	return &MatrixError{"M_UPLOAD_TIMED_OUT", msg}
+}
+
+// UploadInProgress is an error which is returned when the client tries to add to an
+// upload while another part of it is still being received.
+func UploadInProgress(msg string) *MatrixError {
+	return &MatrixError{"M_UPLOAD_IN_PROGRESS", msg}
+}
+
+// Unrecognized is an error which is returned when the server does not
+// recognise the request, e.g. a known endpoint was called with the wrong method.
+func Unrecognized(msg string) *MatrixError {
+	return &MatrixError{"M_UNRECOGNIZED", msg}
+}
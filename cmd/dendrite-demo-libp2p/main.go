@@ -192,6 +192,7 @@ func main() {
 		base.Base.PublicKeyAPIMux,
 		base.Base.PublicMediaAPIMux,
 	)
+	base.Base.OnShutdown(monolith.Drain)
 
 	httpRouter := mux.NewRouter().SkipClean(true).UseEncodedPath()
 	httpRouter.PathPrefix(httputil.InternalPathPrefix).Handler(base.Base.InternalAPIMux)
@@ -225,6 +226,6 @@ func main() {
 		}()
 	}
 
-	// We want to block forever to let the HTTP and HTTPS handler serve the APIs
-	select {}
+	// We want to block until we are asked to stop to let the HTTP and HTTPS handler serve the APIs
+	base.Base.WaitForShutdown()
 }
@@ -153,6 +153,7 @@ func main() {
 		base.PublicKeyAPIMux,
 		base.PublicMediaAPIMux,
 	)
+	base.OnShutdown(monolith.Drain)
 
 	httpRouter := mux.NewRouter().SkipClean(true).UseEncodedPath()
 	httpRouter.PathPrefix(httputil.InternalPathPrefix).Handler(base.InternalAPIMux)
@@ -195,5 +196,5 @@ func main() {
 		}
 	}()
 
-	select {}
+	base.WaitForShutdown()
 }
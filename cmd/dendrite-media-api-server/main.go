@@ -25,9 +25,14 @@ func main() {
 	defer base.Close() // nolint: errcheck
 
 	userAPI := base.UserAPIClient()
-	client := base.CreateClient()
+	client := base.CreateMediaClient()
+	keyRing := base.ServerKeyAPIClient().KeyRing()
 
-	mediaapi.AddPublicRoutes(base.PublicMediaAPIMux, &base.Cfg.MediaAPI, userAPI, client)
+	mediaAPI := mediaapi.AddPublicRoutes(
+		base.PublicMediaAPIMux, base.PublicClientAPIMux, base.PublicFederationAPIMux,
+		&base.Cfg.MediaAPI, userAPI, client, keyRing,
+	)
+	base.OnShutdown(mediaAPI.Drain)
 
 	base.SetupAndServeHTTP(
 		base.Cfg.MediaAPI.InternalAPI.Listen,
@@ -124,7 +124,7 @@ func main() {
 	monolith := setup.Monolith{
 		Config:        base.Cfg,
 		AccountDB:     accountDB,
-		Client:        base.CreateClient(),
+		Client:        base.CreateMediaClient(),
 		FedClient:     federation,
 		KeyRing:       keyRing,
 		KafkaConsumer: base.KafkaConsumer,
@@ -144,6 +144,7 @@ func main() {
 		base.PublicKeyAPIMux,
 		base.PublicMediaAPIMux,
 	)
+	base.OnShutdown(monolith.Drain)
 
 	// Expose the matrix APIs directly rather than putting them under a /api path.
 	go func() {
@@ -35,6 +35,7 @@ var (
 	tlsCertFile    = flag.String("tls-cert", "", "An X509 certificate file to generate for use for TLS")
 	tlsKeyFile     = flag.String("tls-key", "", "An RSA private key file to generate for use for TLS")
 	privateKeyFile = flag.String("private-key", "", "An Ed25519 private key to generate for use for object signing")
+	mediaKeyFile   = flag.String("media-encryption-key", "", "An AES-256 key to generate for use for encrypting media at rest")
 )
 
 func main() {
@@ -45,7 +46,7 @@ func main() {
 
 	flag.Parse()
 
-	if *tlsCertFile == "" && *tlsKeyFile == "" && *privateKeyFile == "" {
+	if *tlsCertFile == "" && *tlsKeyFile == "" && *privateKeyFile == "" && *mediaKeyFile == "" {
 		flag.Usage()
 		return
 	}
@@ -67,4 +68,11 @@ func main() {
 		}
 		fmt.Printf("Created private key file: %s\n", *privateKeyFile)
 	}
+
+	if *mediaKeyFile != "" {
+		if err := test.NewMediaEncryptionKey(*mediaKeyFile); err != nil {
+			panic(err)
+		}
+		fmt.Printf("Created media key file:   %s\n", *mediaKeyFile)
+	}
 }
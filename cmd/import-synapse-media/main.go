@@ -0,0 +1,118 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/matrix-org/dendrite/internal/config"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/mediaapi/fileutils"
+	"github.com/matrix-org/dendrite/mediaapi/routing"
+	"github.com/matrix-org/dendrite/mediaapi/storage"
+)
+
+const usage = `Usage: %s
+
+Import the media of a Synapse server into the media store of the media API, keeping
+its media IDs, content types and upload names. Media which has been imported already
+is skipped, so an import which was stopped can be run again to carry on.
+
+Arguments:
+
+`
+
+var (
+	configPath      = flag.String("config", "dendrite.yaml", "The path to the config file, whose media_api section says where to import the media to.")
+	mediaStorePath  = flag.String("synapse-media-store", "", "The media_store_path of the Synapse server.")
+	synapseDatabase = flag.String("synapse-database", "", "The connection string of the Synapse database, e.g. file:homeserver.db or postgres://user@localhost/synapse.")
+)
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, usage, os.Args[0])
+		flag.PrintDefaults()
+	}
+
+	flag.Parse()
+
+	if *mediaStorePath == "" {
+		flag.Usage()
+		fmt.Println("Missing --synapse-media-store")
+		os.Exit(1)
+	}
+
+	if *synapseDatabase == "" {
+		flag.Usage()
+		fmt.Println("Missing --synapse-database")
+		os.Exit(1)
+	}
+
+	dendriteCfg, err := config.Load(*configPath, true)
+	if err != nil {
+		fmt.Println(err.Error())
+		os.Exit(1)
+	}
+	cfg := &dendriteCfg.MediaAPI
+	if err = cfg.Validate(); err != nil {
+		fmt.Println(err.Error())
+		os.Exit(1)
+	}
+
+	mediaDB, err := storage.Open(&cfg.Database)
+	if err != nil {
+		fmt.Println(err.Error())
+		os.Exit(1)
+	}
+
+	var encryptionKey *fileutils.EncryptionKey
+	if cfg.EncryptionKey != nil {
+		encryptionKey, err = fileutils.NewEncryptionKey(cfg.EncryptionKeyID, cfg.EncryptionKey)
+		if err != nil {
+			fmt.Println(err.Error())
+			os.Exit(1)
+		}
+	}
+
+	synapseDB, err := sqlutil.Open(&config.DatabaseOptions{
+		ConnectionString: config.DataSource(*synapseDatabase),
+	})
+	if err != nil {
+		fmt.Println(err.Error())
+		os.Exit(1)
+	}
+
+	res, err := routing.ImportSynapseMedia(
+		context.Background(), cfg, mediaDB, encryptionKey, synapseDB, *mediaStorePath, printProgress,
+	)
+	if err != nil {
+		fmt.Println(err.Error())
+		os.Exit(1)
+	}
+
+	fmt.Println("Import finished:")
+	printProgress(res)
+	if res.Failed > 0 {
+		os.Exit(1)
+	}
+}
+
+func printProgress(p *routing.SynapseImportProgress) {
+	fmt.Printf("imported = %d (%d bytes), skipped = %d, missing = %d, failed = %d\n",
+		p.Imported, p.Bytes, p.Skipped, p.Missing, p.Failed)
+}
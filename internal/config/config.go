@@ -16,6 +16,7 @@ package config
 
 import (
 	"bytes"
+	"encoding/hex"
 	"encoding/pem"
 	"fmt"
 	"io"
@@ -163,10 +164,38 @@ type ThumbnailSize struct {
 	Width int `yaml:"width"`
 	// Maximum height of the thumbnail image
 	Height int `yaml:"height"`
-	// ResizeMethod is one of crop or scale.
+	// ResizeMethod is one of crop, scale or pad.
 	// crop scales to fill the requested dimensions and crops the excess.
 	// scale scales to fit the requested dimensions and one dimension may be smaller than requested.
+	// pad scales to fit the requested dimensions and fills the rest with Background.
 	ResizeMethod string `yaml:"method,omitempty"`
+	// Background is the colour that pad fills the thumbnail with, see
+	// ParseThumbnailBackground. It is ignored for crop and scale. default: transparent
+	Background string `yaml:"background,omitempty"`
+}
+
+// TransparentThumbnailBackground is the background of padded thumbnails which don't give one.
+const TransparentThumbnailBackground = "00000000"
+
+// ParseThumbnailBackground parses the background colour of a padded thumbnail, which is
+// "transparent" or a hex colour "rrggbb" or "rrggbbaa", optionally starting with "#".
+// It returns the colour as lower case "rrggbbaa", which is how padded thumbnails are
+// stored, so that the same colour written differently is only generated once. An empty
+// background is transparent.
+func ParseThumbnailBackground(background string) (string, error) {
+	background = strings.ToLower(strings.TrimPrefix(background, "#"))
+	switch {
+	case background == "" || background == "transparent":
+		return TransparentThumbnailBackground, nil
+	case len(background) == 6:
+		background += "ff"
+	case len(background) != 8:
+		return "", fmt.Errorf("%q is not transparent or a colour in the form rrggbb or rrggbbaa", background)
+	}
+	if _, err := hex.DecodeString(background); err != nil {
+		return "", fmt.Errorf("%q is not transparent or a colour in the form rrggbb or rrggbbaa", background)
+	}
+	return background, nil
 }
 
 // LogrusHook represents a single logrus hook. At this point, only parsing and
@@ -253,6 +282,19 @@ func loadConfig(
 
 	c.MediaAPI.AbsBasePath = Path(absPath(basePath, c.MediaAPI.BasePath))
 
+	if c.MediaAPI.EncryptionKeyPath != "" {
+		var encryptionKeyData []byte
+
+		encryptionKeyPath := absPath(basePath, c.MediaAPI.EncryptionKeyPath)
+		encryptionKeyData, err = readFile(encryptionKeyPath)
+		if err != nil {
+			return nil, err
+		}
+		if c.MediaAPI.EncryptionKeyID, c.MediaAPI.EncryptionKey, err = readMediaEncryptionKeyPEM(encryptionKeyPath, encryptionKeyData); err != nil {
+			return nil, err
+		}
+	}
+
 	// Generate data from config options
 	err = c.Derive()
 	if err != nil {
@@ -479,6 +521,29 @@ func readKeyPEM(path string, data []byte, enforceKeyIDFormat bool) (gomatrixserv
 	}
 }
 
+func readMediaEncryptionKeyPEM(path string, data []byte) (string, []byte, error) {
+	for {
+		var keyBlock *pem.Block
+		keyBlock, data = pem.Decode(data)
+		if keyBlock == nil {
+			return "", nil, fmt.Errorf("no media encryption key PEM data in %q", path)
+		}
+		if keyBlock.Type == "MEDIA ENCRYPTION KEY" {
+			keyID := keyBlock.Headers["Key-ID"]
+			if keyID == "" {
+				return "", nil, fmt.Errorf("missing key ID in PEM data in %q", path)
+			}
+			if len(keyID) > 255 {
+				return "", nil, fmt.Errorf("key ID in %q is longer than 255 characters", path)
+			}
+			if len(keyBlock.Bytes) != 32 {
+				return "", nil, fmt.Errorf("media encryption key in %q must be 32 bytes long", path)
+			}
+			return keyID, keyBlock.Bytes, nil
+		}
+	}
+}
+
 // AppServiceURL returns a HTTP URL for where the appservice component is listening.
 func (config *Dendrite) AppServiceURL() string {
 	// Hard code the appservice server to talk HTTP for now.
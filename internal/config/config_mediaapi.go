@@ -2,6 +2,77 @@ package config
 
 import (
 	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// The responses which can be given when a thumbnail can't be generated.
+const (
+	// ThumbnailFailureError responds with an error describing the failure.
+	ThumbnailFailureError = "error"
+	// ThumbnailFailurePlaceholder responds with a generic placeholder image.
+	ThumbnailFailurePlaceholder = "placeholder"
+	// ThumbnailFailureNotFound responds with a 404 as if there were no thumbnail.
+	ThumbnailFailureNotFound = "not_found"
+)
+
+// The thumbnails which can be served instead when generating the requested one
+// would go over the limit on thumbnails for the media.
+const (
+	// ThumbnailOverflowNearest serves the existing thumbnail closest to the request.
+	ThumbnailOverflowNearest = "nearest"
+	// ThumbnailOverflowLargest serves the largest existing thumbnail.
+	ThumbnailOverflowLargest = "largest"
+	// ThumbnailOverflowOriginal serves the original file.
+	ThumbnailOverflowOriginal = "original"
+)
+
+// What happens when an upload chooses a media ID which is already in use.
+const (
+	// ClientMediaIDReject refuses the upload, leaving the existing media alone.
+	ClientMediaIDReject = "reject"
+	// ClientMediaIDOverwrite replaces the existing media with the upload.
+	ClientMediaIDOverwrite = "overwrite"
+)
+
+// How media IDs are made up for uploads which don't choose their own.
+const (
+	// MediaIDFormatRandom makes media IDs out of 64 random hex digits.
+	MediaIDFormatRandom = "random"
+	// MediaIDFormatSortable starts media IDs with the time they were made up, so that
+	// they sort in the order they were uploaded.
+	MediaIDFormatSortable = "sortable"
+)
+
+// The scanners which uploads can be scanned with.
+const (
+	// UploadScannerClamAV sends uploads to clamd with its INSTREAM command.
+	UploadScannerClamAV = "clamav"
+)
+
+// What happens to an upload which couldn't be scanned, e.g. because the scanner is down.
+const (
+	// UploadScanFailureReject refuses the upload, so that nothing unscanned is stored.
+	UploadScanFailureReject = "reject"
+	// UploadScanFailureAllow stores the upload without it having been scanned.
+	UploadScanFailureAllow = "allow"
+)
+
+// What happens to an upload whose contents are of a different type than its content
+// type or the extension of its file name say.
+const (
+	// UploadTypeCheckIgnore stores the upload with the content type and name it was given.
+	UploadTypeCheckIgnore = "ignore"
+	// UploadTypeCheckCorrect stores the upload with the content type of its contents,
+	// and changes the extension of its name to match.
+	UploadTypeCheckCorrect = "correct"
+	// UploadTypeCheckReject refuses the upload.
+	UploadTypeCheckReject = "reject"
 )
 
 type MediaAPI struct {
@@ -25,14 +96,373 @@ type MediaAPI struct {
 	// Note: if max_file_size_bytes is not set, it will default to 10485760 (10MB)
 	MaxFileSizeBytes *FileSizeBytes `yaml:"max_file_size_bytes,omitempty"`
 
+	// The maximum total size in bytes of the files stored for media, not counting
+	// thumbnails. Uploads which would go over it are refused, while remote media is
+	// still fetched and everything stored can still be downloaded. 0 means that there
+	// is no limit. default: 0
+	MaxTotalStorageBytes FileSizeBytes `yaml:"max_total_storage_bytes"`
+
+	// The fastest that each download is sent, in bytes per second, so that one large
+	// download can't use all of the server's bandwidth. 0 means that there is no
+	// limit. default: 0
+	MaxDownloadBytesPerSecond FileSizeBytes `yaml:"max_download_bytes_per_second"`
+
+	// The fastest that all of a user's downloads together are sent, in bytes per
+	// second. Only downloads through the authenticated media endpoints are known to be
+	// the user's. 0 means that there is no limit. default: 0
+	MaxUserDownloadBytesPerSecond FileSizeBytes `yaml:"max_user_download_bytes_per_second"`
+
+	// The base URL of a CDN which serves this server's media, such as
+	// https://cdn.example.com. If set, clients are told it in GET /config, and the
+	// responses to uploads say where the media can be downloaded from through it, in
+	// addition to its standard mxc content URI. default: ""
+	CDNBaseURL string `yaml:"cdn_base_url"`
+
+	// The content type to assume for uploads which don't have a Content-Type header.
+	// If empty, such uploads are rejected.
+	DefaultContentType string `yaml:"default_content_type"`
+
 	// Whether to dynamically generate thumbnails on-the-fly if the requested resolution is not already generated
 	DynamicThumbnails bool `yaml:"dynamic_thumbnails"`
 
+	// Path to a PEM key file which, if set, is used to encrypt media files and thumbnails
+	// at rest. A key can be generated with "generate-keys --media-encryption-key".
+	EncryptionKeyPath Path `yaml:"encryption_key_path"`
+
+	// The ID and AES-256 key read from the encryption_key_path, if any.
+	EncryptionKeyID string `yaml:"-"`
+	EncryptionKey   []byte `yaml:"-"`
+
 	// The maximum number of simultaneous thumbnail generators. default: 10
 	MaxThumbnailGenerators int `yaml:"max_thumbnail_generators"`
 
+	// The maximum number of pixels, width times height, of images which thumbnails are
+	// generated from. Larger images are refused before they are decoded, as a small
+	// file can decode to a huge bitmap. default: 32000000
+	MaxImagePixels int64 `yaml:"max_image_pixels"`
+
+	// The largest size of thumbnail which can be asked for, as generating a huge one
+	// would use up a lot of memory. Larger requests are refused. 0 allows any size.
+	// default: 2048
+	MaxThumbnailWidth  int `yaml:"max_thumbnail_width"`
+	MaxThumbnailHeight int `yaml:"max_thumbnail_height"`
+
+	// The quality, from 1 to 100, which JPEG thumbnails are encoded with. Lower values
+	// give smaller thumbnails which don't look as good. default: 85
+	ThumbnailJPEGQuality int `yaml:"thumbnail_jpeg_quality"`
+
+	// How long a media ID reserved with /create remains valid if nothing is uploaded
+	// to it. default: 24h
+	UnusedMediaIDLifetime time.Duration `yaml:"unused_media_id_lifetime"`
+
+	// How media IDs are made up for uploads and reservations which don't choose their
+	// own. One of "random" or "sortable". Media which already exists keeps its media
+	// ID whichever is used. default: random
+	MediaIDFormat string `yaml:"media_id_format"`
+
+	// Whether the media IDs of this server's own media are case-insensitive. If so,
+	// media IDs which admins and application services choose are stored lowercased,
+	// and this server's media is looked up by its media ID lowercased. Media IDs
+	// which are made up are always lowercase, and other servers' media IDs are always
+	// case-sensitive. Media already stored under a media ID with capitals in can't be
+	// downloaded once this is enabled. default: false
+	CaseInsensitiveMediaIDs bool `yaml:"case_insensitive_media_ids"`
+
+	// What to do when an admin or application service uploads to a media ID of its
+	// choosing which already has content. One of "reject" or "overwrite". Media IDs
+	// which are reserved but not uploaded to yet are never overwritten. default: reject
+	ClientMediaIDCollision string `yaml:"client_media_id_collision"`
+
 	// A list of thumbnail sizes to be pre-generated for downloaded remote / uploaded content
 	ThumbnailSizes []ThumbnailSize `yaml:"thumbnail_sizes"`
+
+	// The maximum number of distinct thumbnail sizes which are generated dynamically
+	// and stored for each file, including any pre-generated ones. default: 16
+	MaxThumbnailsPerMedia int `yaml:"max_thumbnails_per_media"`
+
+	// The resize method, "crop", "scale" or "pad", for thumbnail requests which don't
+	// give one. Padded thumbnails have a transparent background. default: scale
+	DefaultThumbnailMethod string `yaml:"default_thumbnail_method"`
+
+	// Overrides default_thumbnail_method for media with particular content types.
+	// The keys are content types such as "image/png", or "image/*" for any image.
+	ThumbnailMethodsByContentType map[string]string `yaml:"thumbnail_methods_by_content_type"`
+
+	// What to serve instead of generating a thumbnail once a file has the maximum
+	// number of thumbnails. One of "nearest", "largest" or "original". default: nearest
+	ThumbnailOverflowResponse string `yaml:"thumbnail_overflow_response"`
+
+	// How to respond to a thumbnail request when the thumbnail can't be generated,
+	// e.g. because the image is corrupt or in an unsupported format. One of "error",
+	// "placeholder" or "not_found". default: error
+	ThumbnailFailureResponse string `yaml:"thumbnail_failure_response"`
+
+	// Thumbnailing of the first page of PDFs, which needs an external renderer.
+	PDFThumbnails PDFThumbnails `yaml:"pdf_thumbnails"`
+
+	// Whether to sanitize SVG images when they are uploaded or fetched from a remote
+	// server, removing scripts, event handlers and external references. If disabled,
+	// SVG images are always served as attachments instead. default: true
+	SanitizeSVGs bool `yaml:"sanitize_svgs"`
+
+	// Whether to strip EXIF, XMP and other metadata from uploaded JPEG and PNG images,
+	// other than their orientation. The image data itself is left as it is.
+	// default: false
+	StripImageMetadata bool `yaml:"strip_image_metadata"`
+
+	// Whether to decode the whole of uploaded JPEG, PNG and GIF images, refusing those
+	// which can't be decoded, such as images which were cut short, rather than failing
+	// when thumbnails are generated from them. Other types of image aren't checked.
+	// default: false
+	ValidateImageUploads bool `yaml:"validate_image_uploads"`
+
+	// What to do with uploads whose contents are of a different type than their
+	// content type or the extension of their name say, e.g. a JPEG uploaded as
+	// "cat.png". Only types which can be told reliably from the start of a file, such
+	// as images, are checked. One of "ignore", "correct" or "reject". default: ignore
+	UploadTypeCheck string `yaml:"upload_type_check"`
+
+	// The types of file which may never be uploaded, whatever content type they are
+	// uploaded as, such as "application/x-executable" or "text/*". Uploads are refused
+	// if their contents are found to be one of them. An empty list allows everything.
+	// default: executables, shell scripts and HTML
+	BlockedUploadTypes []string `yaml:"blocked_upload_types"`
+
+	// The content types of media which browsers are allowed to display, such as
+	// "image/png", or "image/*" for any image. Everything else is served as an
+	// attachment, which browsers download rather than open. default: common image,
+	// audio and video types
+	InlineContentTypes []string `yaml:"inline_content_types"`
+
+	// The content types of media which are always served as an attachment, even if
+	// they are in InlineContentTypes or were uploaded asking to be shown inline, as
+	// browsers can run scripts in them. They take the same form as InlineContentTypes.
+	// default: HTML, XHTML, SVG and JavaScript
+	AttachmentContentTypes []string `yaml:"attachment_content_types"`
+
+	// Whether a Content-Disposition header sent with an upload is kept, so that the
+	// media is downloaded inline or as an attachment as the uploader asked, with the
+	// name from the header rather than the filename query parameter. Otherwise the
+	// header only names media uploaded without a filename, and whether media is shown
+	// inline is only decided by InlineContentTypes. This lets uploaders have any media
+	// shown inline, such as HTML pages that run scripts in browsers. default: false
+	PreferClientContentDisposition bool `yaml:"prefer_client_content_disposition"`
+
+	// Whether media uploaded without a file name is named after its media ID, with an
+	// extension for its content type (e.g. "abcd1234.png"), when it is stored and
+	// downloaded. Otherwise downloads of it aren't given a file name. default: false
+	DefaultUploadNames bool `yaml:"default_upload_names"`
+
+	// Compression of downloads of text-like media for clients which accept it.
+	GzipDownloads GzipDownloads `yaml:"gzip_downloads"`
+
+	// Whether media can still be downloaded and thumbnailed without an access token,
+	// using the legacy /_matrix/media endpoints rather than the authenticated ones
+	// under /_matrix/client/v1/media. default: true
+	UnauthenticatedDownloads bool `yaml:"unauthenticated_downloads"`
+
+	// The only remote servers which media is fetched from. If empty, media can be
+	// fetched from any server.
+	AllowedRemoteOrigins []gomatrixserverlib.ServerName `yaml:"allowed_remote_origins"`
+
+	// The networks, in CIDR notation, which media is never fetched from. These are
+	// checked against the addresses which remote server names resolve to, so that the
+	// media API can't be used to reach services on internal networks. default: loopback,
+	// private and link-local networks
+	BlockedRemoteNetworks []string `yaml:"blocked_remote_networks"`
+
+	// Temporary files older than this which were left behind by a previous run (e.g.
+	// after a crash part way through an upload) are removed on startup. Set to 0 to
+	// disable. default: 24h
+	TempFileMaxAge time.Duration `yaml:"temp_file_max_age"`
+
+	// When shutting down, new uploads are refused and those in progress are given this
+	// long to finish before their temporary files are removed. default: 30s
+	UploadShutdownGracePeriod time.Duration `yaml:"upload_shutdown_grace_period"`
+
+	// How long an upload may take to send the first byte of the file, from when the
+	// request starts, before it is abandoned. This is only the wait for the start of
+	// the file, so doesn't limit how long a large upload takes. Set to 0 to disable.
+	// default: 30s
+	FirstByteTimeout time.Duration `yaml:"first_byte_timeout"`
+
+	// The longest an upload may take, from when the request starts, however steadily
+	// the file is arriving, after which it is abandoned. Unlike first_byte_timeout this
+	// limits how long a large upload ties up the server. 0 means that there is no
+	// limit. default: 0
+	MaxUploadDuration time.Duration `yaml:"max_upload_duration"`
+
+	// The networks, in CIDR notation, of reverse proxies in front of the media API
+	// which are trusted to give the real client IP address in X-Forwarded-For.
+	TrustedProxies []string `yaml:"trusted_proxies"`
+
+	// Timeouts for fetching media from remote servers.
+	RemoteTimeouts RemoteMediaTimeouts `yaml:"remote_timeouts"`
+
+	// Retries for fetching media from remote servers which failed in a way which may not
+	// happen again, such as a timeout or a server error.
+	RemoteRetries RemoteMediaRetries `yaml:"remote_retries"`
+
+	// How long to remember that a remote server doesn't have some media, rather than
+	// asking it again for every request. Set to 0 to disable. default: 5m
+	RemoteNotFoundTTL time.Duration `yaml:"remote_not_found_ttl"`
+
+	// Generating the configured thumbnail sizes of remote media as soon as it has been
+	// fetched, as is done for uploads.
+	RemoteThumbnailPregeneration RemoteThumbnailPregeneration `yaml:"remote_thumbnail_pregeneration"`
+
+	// Limits on uploads which compress extremely well, such as files of nothing but
+	// zeros, which cost little to send but take up their full size once stored.
+	CompressibleUploads CompressibleUploads `yaml:"compressible_uploads"`
+
+	// Scanning of uploads for viruses before they are stored.
+	UploadScanning UploadScanning `yaml:"upload_scanning"`
+
+	// Uploads which are sent in parts using the tus protocol, so that they can be
+	// carried on with after the connection drops.
+	ResumableUploads ResumableUploads `yaml:"resumable_uploads"`
+
+	// How files are written to disk as they are uploaded or fetched from remote servers.
+	FileWrites FileWrites `yaml:"file_writes"`
+
+	// Keeping media deleted with the admin API for a while, so that deleting it can
+	// be undone.
+	SoftDelete SoftDelete `yaml:"soft_delete"`
+
+	// A list of local user IDs which are allowed to use the media admin API.
+	AdminUsers []string `yaml:"admin_users"`
+}
+
+// PDFThumbnails controls rendering the first page of PDFs to generate thumbnails from.
+type PDFThumbnails struct {
+	// Whether thumbnails of PDFs are images of their first page. default: false
+	Enabled bool `yaml:"enabled"`
+	// The renderer to run, which must take the same arguments as pdftoppm from poppler.
+	// default: pdftoppm
+	Command string `yaml:"command"`
+	// How long rendering a page may take before the renderer is killed. default: 10s
+	Timeout time.Duration `yaml:"timeout"`
+	// The size in pixels of the longest side of the rendered page, which limits the
+	// memory needed to render and thumbnail it. Thumbnails this large or larger can't
+	// be generated from the page. default: 1024
+	MaxSize int `yaml:"max_size"`
+}
+
+// CompressibleUploads sets a stricter size limit for uploads which compress extremely
+// well. How well each upload compresses is measured as it is read, but it is still
+// stored as it was uploaded.
+type CompressibleUploads struct {
+	// Whether to measure how well uploads compress and apply the limit. default: false
+	Enabled bool `yaml:"enabled"`
+	// Uploads whose size divided by their compressed size is at least this are
+	// limited to max_file_size_bytes. default: 100
+	MinRatio float64 `yaml:"min_ratio"`
+	// The maximum size of uploads which compress at least as well as min_ratio.
+	// default: 1048576 (1MB)
+	MaxFileSizeBytes FileSizeBytes `yaml:"max_file_size_bytes"`
+}
+
+// GzipDownloads gzips downloads of media with compressible content types, for clients
+// which send Accept-Encoding: gzip, as the response is written. Requests for a range
+// of the media are always served uncompressed.
+type GzipDownloads struct {
+	// Whether to gzip downloads. default: false
+	Enabled bool `yaml:"enabled"`
+	// The content types of media which are gzipped, in the same form as
+	// inline_content_types. Images other than SVGs, audio and video are never
+	// gzipped, as they are already compressed. default: text, JSON, XML and SVG types
+	ContentTypes []string `yaml:"content_types"`
+}
+
+// UploadScanning sends uploads to a virus scanner as they are received, and refuses
+// those which are infected so that they are never stored.
+type UploadScanning struct {
+	// Whether to scan uploads. default: false
+	Enabled bool `yaml:"enabled"`
+	// The scanner to use. Only "clamav" is supported. default: clamav
+	Scanner string `yaml:"scanner"`
+	// The address of clamd, as tcp://host:port or unix:///path/to/socket.
+	// default: tcp://localhost:3310
+	ClamAVAddress string `yaml:"clamav_address"`
+	// How long to wait for the scanner to accept each part of an upload, and for the
+	// verdict once the whole upload has been sent to it. default: 30s
+	Timeout time.Duration `yaml:"timeout"`
+	// What happens to uploads which couldn't be scanned. One of "reject" or "allow".
+	// default: reject
+	OnFailure string `yaml:"on_failure"`
+}
+
+// ResumableUploads allows uploads to be sent in parts with the tus protocol, which
+// are added to a temporary file until the whole upload has been received.
+// https://tus.io/protocols/resumable-upload
+type ResumableUploads struct {
+	// Whether to allow resumable uploads. default: false
+	Enabled bool `yaml:"enabled"`
+	// How long after its last part an unfinished upload is removed. default: 24h
+	Expiry time.Duration `yaml:"expiry"`
+	// The most unfinished uploads each user may have at once, or 0 for no limit.
+	// default: 10
+	MaxPerUser int `yaml:"max_per_user"`
+}
+
+// SoftDelete makes deleting media with the admin API only mark it deleted, so that it
+// is no longer served but can still be undeleted. Its files are removed once it has
+// been deleted for the grace period.
+type SoftDelete struct {
+	// Whether deleted media is kept for the grace period. default: false
+	Enabled bool `yaml:"enabled"`
+	// How long deleted media is kept before its files are removed. This still
+	// applies to media deleted while soft delete was enabled if it is later
+	// disabled. default: 168h (7 days)
+	GracePeriod time.Duration `yaml:"grace_period"`
+}
+
+// FileWrites controls how files are written to their temporary directory before they
+// are moved into the media store. They are always synced to disk before they are moved.
+type FileWrites struct {
+	// How much of a file is buffered in memory before it is written out. default: 65536
+	BufferSize FileSizeBytes `yaml:"buffer_size"`
+	// How much of a file is written between each sync to disk, so that a large file
+	// isn't all left to be written back at the end. 0 only syncs once the whole file
+	// has been written. default: 33554432
+	SyncInterval FileSizeBytes `yaml:"sync_interval"`
+}
+
+// RemoteMediaTimeouts limits how long each stage of fetching media from a remote
+// server may take.
+type RemoteMediaTimeouts struct {
+	// How long to wait for a connection to the remote server. default: 10s
+	Dial time.Duration `yaml:"dial"`
+	// How long to wait for the TLS handshake once connected. default: 10s
+	TLSHandshake time.Duration `yaml:"tls_handshake"`
+	// How long to wait for the response headers once the request is sent. default: 30s
+	ResponseHeader time.Duration `yaml:"response_header"`
+	// How long the whole fetch may take, including transferring the file. default: 5m
+	Transfer time.Duration `yaml:"transfer"`
+}
+
+// RemoteMediaRetries controls how failed fetches of media from remote servers are
+// retried.
+type RemoteMediaRetries struct {
+	// How many times to retry a failed fetch. Set to 0 to disable. default: 2
+	Count int `yaml:"count"`
+	// How long to wait before the first retry, which doubles for each retry after
+	// that. default: 1s
+	Backoff time.Duration `yaml:"backoff"`
+}
+
+// RemoteThumbnailPregeneration controls generating thumbnails of remote media once it
+// has been fetched, so that the first request for a thumbnail of it doesn't have to
+// wait for one to be generated. Pre-generation is skipped for media fetched while the
+// limits are reached, so that a burst of fetches doesn't hold up other thumbnails.
+type RemoteThumbnailPregeneration struct {
+	// Whether to pre-generate thumbnails of remote media. default: false
+	Enabled bool `yaml:"enabled"`
+	// The most remote media which thumbnails are pre-generated for at once. default: 2
+	MaxConcurrent int `yaml:"max_concurrent"`
+	// The most remote media which thumbnails are pre-generated for each minute, or 0
+	// for no limit. default: 60
+	MaxPerMinute int `yaml:"max_per_minute"`
 }
 
 func (c *MediaAPI) Defaults() {
@@ -45,7 +475,65 @@ func (c *MediaAPI) Defaults() {
 	defaultMaxFileSizeBytes := FileSizeBytes(10485760)
 	c.MaxFileSizeBytes = &defaultMaxFileSizeBytes
 	c.MaxThumbnailGenerators = 10
+	c.MaxImagePixels = 32000000
+	c.MaxThumbnailWidth = 2048
+	c.MaxThumbnailHeight = 2048
+	c.ThumbnailJPEGQuality = 85
+	c.MaxThumbnailsPerMedia = 16
+	c.ThumbnailOverflowResponse = ThumbnailOverflowNearest
+	c.DefaultThumbnailMethod = "scale"
+	c.UnusedMediaIDLifetime = time.Hour * 24
+	c.MediaIDFormat = MediaIDFormatRandom
+	c.ClientMediaIDCollision = ClientMediaIDReject
+	c.ThumbnailFailureResponse = ThumbnailFailureError
+	c.UploadTypeCheck = UploadTypeCheckIgnore
+	c.BlockedUploadTypes = []string{
+		"application/x-executable", "application/x-msdownload", "application/x-mach-binary",
+		"application/x-sh", "text/html",
+	}
 	c.BasePath = "./media_store"
+	c.SanitizeSVGs = true
+	c.InlineContentTypes = []string{
+		"image/jpeg", "image/png", "image/gif", "image/webp", "audio/*", "video/*",
+	}
+	c.AttachmentContentTypes = []string{
+		"text/html", "application/xhtml+xml", "image/svg+xml",
+		"text/javascript", "application/javascript", "application/ecmascript",
+	}
+	c.UnauthenticatedDownloads = true
+	c.BlockedRemoteNetworks = []string{
+		"0.0.0.0/8", "10.0.0.0/8", "100.64.0.0/10", "127.0.0.0/8", "169.254.0.0/16",
+		"172.16.0.0/12", "192.168.0.0/16", "::/128", "::1/128", "fc00::/7", "fe80::/10",
+	}
+	c.TempFileMaxAge = time.Hour * 24
+	c.UploadShutdownGracePeriod = time.Second * 30
+	c.FirstByteTimeout = time.Second * 30
+	c.RemoteTimeouts.Dial = time.Second * 10
+	c.RemoteTimeouts.TLSHandshake = time.Second * 10
+	c.RemoteTimeouts.ResponseHeader = time.Second * 30
+	c.RemoteTimeouts.Transfer = time.Minute * 5
+	c.RemoteRetries.Count = 2
+	c.RemoteRetries.Backoff = time.Second
+	c.RemoteNotFoundTTL = time.Minute * 5
+	c.RemoteThumbnailPregeneration.MaxConcurrent = 2
+	c.RemoteThumbnailPregeneration.MaxPerMinute = 60
+	c.PDFThumbnails.Command = "pdftoppm"
+	c.PDFThumbnails.Timeout = time.Second * 10
+	c.PDFThumbnails.MaxSize = 1024
+	c.GzipDownloads.ContentTypes = []string{
+		"text/*", "application/json", "application/xml", "application/javascript", "image/svg+xml",
+	}
+	c.UploadScanning.Scanner = UploadScannerClamAV
+	c.UploadScanning.ClamAVAddress = "tcp://localhost:3310"
+	c.UploadScanning.Timeout = time.Second * 30
+	c.UploadScanning.OnFailure = UploadScanFailureReject
+	c.ResumableUploads.Expiry = time.Hour * 24
+	c.ResumableUploads.MaxPerUser = 10
+	c.SoftDelete.GracePeriod = time.Hour * 24 * 7
+	c.FileWrites.BufferSize = 64 * 1024
+	c.FileWrites.SyncInterval = 32 * 1024 * 1024
+	c.CompressibleUploads.MinRatio = 100
+	c.CompressibleUploads.MaxFileSizeBytes = 1048576
 }
 
 func (c *MediaAPI) Verify(configErrs *ConfigErrors, isMonolith bool) {
@@ -58,10 +546,365 @@ func (c *MediaAPI) Verify(configErrs *ConfigErrors, isMonolith bool) {
 
 	checkNotEmpty(configErrs, "media_api.base_path", string(c.BasePath))
 	checkPositive(configErrs, "media_api.max_file_size_bytes", int64(*c.MaxFileSizeBytes))
+	checkPositive(configErrs, "media_api.max_total_storage_bytes", int64(c.MaxTotalStorageBytes))
 	checkPositive(configErrs, "media_api.max_thumbnail_generators", int64(c.MaxThumbnailGenerators))
+	checkPositive(configErrs, "media_api.max_image_pixels", c.MaxImagePixels)
+	checkPositive(configErrs, "media_api.max_thumbnail_width", int64(c.MaxThumbnailWidth))
+	checkPositive(configErrs, "media_api.max_thumbnail_height", int64(c.MaxThumbnailHeight))
+	if c.ThumbnailJPEGQuality < 1 || c.ThumbnailJPEGQuality > 100 {
+		configErrs.Add(fmt.Sprintf("invalid value for config key %q: %d", "media_api.thumbnail_jpeg_quality", c.ThumbnailJPEGQuality))
+	}
+	checkPositive(configErrs, "media_api.max_thumbnails_per_media", int64(c.MaxThumbnailsPerMedia))
+	checkPositive(configErrs, "media_api.unused_media_id_lifetime", int64(c.UnusedMediaIDLifetime))
+	checkPositive(configErrs, "media_api.upload_shutdown_grace_period", int64(c.UploadShutdownGracePeriod))
+	checkPositive(configErrs, "media_api.first_byte_timeout", int64(c.FirstByteTimeout))
+	checkPositive(configErrs, "media_api.max_upload_duration", int64(c.MaxUploadDuration))
+	checkPositive(configErrs, "media_api.max_download_bytes_per_second", int64(c.MaxDownloadBytesPerSecond))
+	checkPositive(configErrs, "media_api.max_user_download_bytes_per_second", int64(c.MaxUserDownloadBytesPerSecond))
+	if c.CDNBaseURL != "" {
+		checkURL(configErrs, "media_api.cdn_base_url", c.CDNBaseURL)
+		c.CDNBaseURL = strings.TrimRight(c.CDNBaseURL, "/")
+	}
+	checkPositive(configErrs, "media_api.remote_timeouts.dial", int64(c.RemoteTimeouts.Dial))
+	checkPositive(configErrs, "media_api.remote_timeouts.tls_handshake", int64(c.RemoteTimeouts.TLSHandshake))
+	checkPositive(configErrs, "media_api.remote_timeouts.response_header", int64(c.RemoteTimeouts.ResponseHeader))
+	checkPositive(configErrs, "media_api.remote_timeouts.transfer", int64(c.RemoteTimeouts.Transfer))
+	if c.RemoteRetries.Count < 0 {
+		configErrs.Add(fmt.Sprintf("invalid value for config key %q: %d", "media_api.remote_retries.count", c.RemoteRetries.Count))
+	}
+	if c.RemoteRetries.Count > 0 {
+		checkPositive(configErrs, "media_api.remote_retries.backoff", int64(c.RemoteRetries.Backoff))
+	}
+	if c.RemoteNotFoundTTL < 0 {
+		configErrs.Add(fmt.Sprintf("invalid value for config key %q: %s", "media_api.remote_not_found_ttl", c.RemoteNotFoundTTL))
+	}
+	if c.RemoteThumbnailPregeneration.Enabled {
+		if c.RemoteThumbnailPregeneration.MaxConcurrent <= 0 {
+			configErrs.Add(fmt.Sprintf("invalid value for config key %q: %d", "media_api.remote_thumbnail_pregeneration.max_concurrent", c.RemoteThumbnailPregeneration.MaxConcurrent))
+		}
+		checkPositive(configErrs, "media_api.remote_thumbnail_pregeneration.max_per_minute", int64(c.RemoteThumbnailPregeneration.MaxPerMinute))
+	}
+	if c.PDFThumbnails.Enabled {
+		checkNotEmpty(configErrs, "media_api.pdf_thumbnails.command", c.PDFThumbnails.Command)
+		checkPositive(configErrs, "media_api.pdf_thumbnails.timeout", int64(c.PDFThumbnails.Timeout))
+		checkPositive(configErrs, "media_api.pdf_thumbnails.max_size", int64(c.PDFThumbnails.MaxSize))
+	}
+	if c.UploadScanning.Enabled {
+		switch c.UploadScanning.Scanner {
+		case UploadScannerClamAV:
+			checkNotEmpty(configErrs, "media_api.upload_scanning.clamav_address", c.UploadScanning.ClamAVAddress)
+		default:
+			configErrs.Add(fmt.Sprintf("invalid value for config key %q: %s", "media_api.upload_scanning.scanner", c.UploadScanning.Scanner))
+		}
+		checkPositive(configErrs, "media_api.upload_scanning.timeout", int64(c.UploadScanning.Timeout))
+		switch c.UploadScanning.OnFailure {
+		case UploadScanFailureReject, UploadScanFailureAllow:
+		default:
+			configErrs.Add(fmt.Sprintf("invalid value for config key %q: %s", "media_api.upload_scanning.on_failure", c.UploadScanning.OnFailure))
+		}
+	}
+	if c.ResumableUploads.Enabled {
+		if c.ResumableUploads.Expiry <= 0 {
+			configErrs.Add(fmt.Sprintf("invalid value for config key %q: %s", "media_api.resumable_uploads.expiry", c.ResumableUploads.Expiry))
+		}
+		checkPositive(configErrs, "media_api.resumable_uploads.max_per_user", int64(c.ResumableUploads.MaxPerUser))
+	}
+	if c.SoftDelete.Enabled && c.SoftDelete.GracePeriod <= 0 {
+		configErrs.Add(fmt.Sprintf("invalid value for config key %q: %s", "media_api.soft_delete.grace_period", c.SoftDelete.GracePeriod))
+	}
+	if c.CompressibleUploads.Enabled {
+		if c.CompressibleUploads.MinRatio <= 1 {
+			configErrs.Add(fmt.Sprintf("invalid value for config key %q: %v", "media_api.compressible_uploads.min_ratio", c.CompressibleUploads.MinRatio))
+		}
+		checkPositive(configErrs, "media_api.compressible_uploads.max_file_size_bytes", int64(c.CompressibleUploads.MaxFileSizeBytes))
+	}
+	if c.FileWrites.BufferSize <= 0 {
+		configErrs.Add(fmt.Sprintf("invalid value for config key %q: %d", "media_api.file_writes.buffer_size", c.FileWrites.BufferSize))
+	}
+	checkPositive(configErrs, "media_api.file_writes.sync_interval", int64(c.FileWrites.SyncInterval))
 
 	for i, size := range c.ThumbnailSizes {
 		checkPositive(configErrs, fmt.Sprintf("media_api.thumbnail_sizes[%d].width", i), int64(size.Width))
 		checkPositive(configErrs, fmt.Sprintf("media_api.thumbnail_sizes[%d].height", i), int64(size.Height))
+		if !c.IsAllowedThumbnailSize(size.Width, size.Height) {
+			configErrs.Add(fmt.Sprintf(
+				"invalid value for config key %q: %dx%d is larger than media_api.max_thumbnail_width and max_thumbnail_height",
+				fmt.Sprintf("media_api.thumbnail_sizes[%d]", i), size.Width, size.Height,
+			))
+		}
+		if size.ResizeMethod != "pad" {
+			if size.Background != "" {
+				configErrs.Add(fmt.Sprintf(
+					"invalid value for config key %q: only padded thumbnails have a background",
+					fmt.Sprintf("media_api.thumbnail_sizes[%d].background", i),
+				))
+			}
+			continue
+		}
+		// The background is stored in the form that padded thumbnails are cached under,
+		// so that a pre-generated size is found however its colour was written.
+		background, err := ParseThumbnailBackground(size.Background)
+		if err != nil {
+			configErrs.Add(fmt.Sprintf("invalid value for config key %q: %s", fmt.Sprintf("media_api.thumbnail_sizes[%d].background", i), size.Background))
+			continue
+		}
+		c.ThumbnailSizes[i].Background = background
+	}
+
+	switch c.ThumbnailFailureResponse {
+	case ThumbnailFailureError, ThumbnailFailurePlaceholder, ThumbnailFailureNotFound:
+	default:
+		configErrs.Add(fmt.Sprintf("invalid value for config key %q: %s", "media_api.thumbnail_failure_response", c.ThumbnailFailureResponse))
+	}
+
+	checkThumbnailMethod(configErrs, "media_api.default_thumbnail_method", c.DefaultThumbnailMethod)
+	for contentType, method := range c.ThumbnailMethodsByContentType {
+		checkThumbnailMethod(configErrs, fmt.Sprintf("media_api.thumbnail_methods_by_content_type[%s]", contentType), method)
+	}
+
+	switch c.ClientMediaIDCollision {
+	case ClientMediaIDReject, ClientMediaIDOverwrite:
+	default:
+		configErrs.Add(fmt.Sprintf("invalid value for config key %q: %s", "media_api.client_media_id_collision", c.ClientMediaIDCollision))
+	}
+
+	switch c.MediaIDFormat {
+	case MediaIDFormatRandom, MediaIDFormatSortable:
+	default:
+		configErrs.Add(fmt.Sprintf("invalid value for config key %q: %s", "media_api.media_id_format", c.MediaIDFormat))
+	}
+
+	switch c.UploadTypeCheck {
+	case UploadTypeCheckIgnore, UploadTypeCheckCorrect, UploadTypeCheckReject:
+	default:
+		configErrs.Add(fmt.Sprintf("invalid value for config key %q: %s", "media_api.upload_type_check", c.UploadTypeCheck))
+	}
+
+	switch c.ThumbnailOverflowResponse {
+	case ThumbnailOverflowNearest, ThumbnailOverflowLargest, ThumbnailOverflowOriginal:
+	default:
+		configErrs.Add(fmt.Sprintf("invalid value for config key %q: %s", "media_api.thumbnail_overflow_response", c.ThumbnailOverflowResponse))
+	}
+
+	checkContentTypePatterns(configErrs, "media_api.blocked_upload_types", c.BlockedUploadTypes)
+	checkContentTypePatterns(configErrs, "media_api.inline_content_types", c.InlineContentTypes)
+	checkContentTypePatterns(configErrs, "media_api.attachment_content_types", c.AttachmentContentTypes)
+	checkContentTypePatterns(configErrs, "media_api.gzip_downloads.content_types", c.GzipDownloads.ContentTypes)
+
+	for i, origin := range c.AllowedRemoteOrigins {
+		checkNotEmpty(configErrs, fmt.Sprintf("media_api.allowed_remote_origins[%d]", i), string(origin))
+	}
+
+	for i, cidr := range c.TrustedProxies {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			configErrs.Add(fmt.Sprintf("invalid value for config key %q: %s", fmt.Sprintf("media_api.trusted_proxies[%d]", i), cidr))
+		}
+	}
+
+	for i, cidr := range c.BlockedRemoteNetworks {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			configErrs.Add(fmt.Sprintf("invalid value for config key %q: %s", fmt.Sprintf("media_api.blocked_remote_networks[%d]", i), cidr))
+		}
+	}
+
+	for i, userID := range c.AdminUsers {
+		checkNotEmpty(configErrs, fmt.Sprintf("media_api.admin_users[%d]", i), userID)
+	}
+}
+
+// Validate checks that the media API can run with the config. Unlike Verify it also
+// creates the media store if it doesn't exist yet, and checks that it can be written
+// to, so is only run when the media API starts. This is so that it fails straight
+// away rather than on the first request.
+func (c *MediaAPI) Validate() error {
+	var errs ConfigErrors
+	// The server name is used to build the mxc:// URIs of uploads.
+	if c.Matrix == nil || !IsValidServerName(c.Matrix.ServerName) {
+		var serverName gomatrixserverlib.ServerName
+		if c.Matrix != nil {
+			serverName = c.Matrix.ServerName
+		}
+		errs.Add(fmt.Sprintf("invalid value for config key %q: %q is not a valid host name", "global.server_name", serverName))
+	}
+
+	if err := checkWritableDir(c.AbsBasePath); err != nil {
+		errs.Add(fmt.Sprintf("invalid value for config key %q: %s", "media_api.base_path", err))
+	}
+
+	if c.MaxFileSizeBytes == nil || *c.MaxFileSizeBytes < 0 {
+		errs.Add(fmt.Sprintf("invalid value for config key %q: must be 0 or more", "media_api.max_file_size_bytes"))
+	} else if c.CompressibleUploads.Enabled && *c.MaxFileSizeBytes > 0 && c.CompressibleUploads.MaxFileSizeBytes > *c.MaxFileSizeBytes {
+		errs.Add(fmt.Sprintf(
+			"invalid value for config key %q: %d is larger than media_api.max_file_size_bytes",
+			"media_api.compressible_uploads.max_file_size_bytes", c.CompressibleUploads.MaxFileSizeBytes,
+		))
+	}
+	if c.MaxThumbnailGenerators <= 0 && (len(c.ThumbnailSizes) > 0 || c.DynamicThumbnails) {
+		errs.Add(fmt.Sprintf("invalid value for config key %q: must be more than 0 to generate thumbnails", "media_api.max_thumbnail_generators"))
+	}
+	for i, size := range c.ThumbnailSizes {
+		if size.Width <= 0 || size.Height <= 0 {
+			errs.Add(fmt.Sprintf(
+				"invalid value for config key %q: %dx%d is not a valid size",
+				fmt.Sprintf("media_api.thumbnail_sizes[%d]", i), size.Width, size.Height,
+			))
+		}
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// checkWritableDir creates the directory if it doesn't exist, and checks that files
+// can be created in it.
+func checkWritableDir(dir Path) error {
+	if dir == "" {
+		return fmt.Errorf("missing path")
+	}
+	if err := os.MkdirAll(string(dir), 0770); err != nil {
+		return err
+	}
+	file, err := ioutil.TempFile(string(dir), ".writable-")
+	if err != nil {
+		return fmt.Errorf("%s is not writable: %w", dir, err)
+	}
+	file.Close() // nolint: errcheck
+	return os.Remove(file.Name())
+}
+
+// IsValidServerName returns whether the server name is valid according to the spec.
+// Unlike gomatrixserverlib.ParseAndValidateServerName this also rejects DNS names
+// with empty labels, such as "..", which are never valid host names.
+func IsValidServerName(serverName gomatrixserverlib.ServerName) bool {
+	if strings.HasPrefix(string(serverName), ":") {
+		// No host at all, which ParseAndValidateServerName doesn't cope with
+		return false
+	}
+	host, _, valid := gomatrixserverlib.ParseAndValidateServerName(serverName)
+	if !valid {
+		return false
+	}
+	if strings.HasPrefix(host, "[") {
+		// An IPv6 address, which has already been parsed
+		return true
+	}
+	for _, label := range strings.Split(host, ".") {
+		if label == "" {
+			return false
+		}
+	}
+	return true
+}
+
+// IsAllowedThumbnailSize returns whether thumbnails of the given size may be asked for.
+func (c *MediaAPI) IsAllowedThumbnailSize(width, height int) bool {
+	return (c.MaxThumbnailWidth == 0 || width <= c.MaxThumbnailWidth) &&
+		(c.MaxThumbnailHeight == 0 || height <= c.MaxThumbnailHeight)
+}
+
+// IsAdmin returns whether the given user is allowed to use the media admin API.
+func (c *MediaAPI) IsAdmin(userID string) bool {
+	for _, admin := range c.AdminUsers {
+		if admin == userID {
+			return true
+		}
+	}
+	return false
+}
+
+// IsAllowedRemoteOrigin returns whether media may be fetched from the remote server.
+func (c *MediaAPI) IsAllowedRemoteOrigin(origin gomatrixserverlib.ServerName) bool {
+	if len(c.AllowedRemoteOrigins) == 0 {
+		return true
+	}
+	for _, allowed := range c.AllowedRemoteOrigins {
+		if allowed == origin {
+			return true
+		}
+	}
+	return false
+}
+
+// ThumbnailMethod returns the resize method to use for thumbnails of media with the
+// content type when the request doesn't give one.
+func (c *MediaAPI) ThumbnailMethod(contentType string) string {
+	contentType = mediaType(contentType)
+	if method, ok := c.ThumbnailMethodsByContentType[contentType]; ok {
+		return method
+	}
+	if i := strings.Index(contentType, "/"); i >= 0 {
+		if method, ok := c.ThumbnailMethodsByContentType[contentType[:i]+"/*"]; ok {
+			return method
+		}
+	}
+	return c.DefaultThumbnailMethod
+}
+
+// IsInlineContentType returns whether media with the content type can be displayed by
+// browsers, rather than being served as an attachment.
+func (c *MediaAPI) IsInlineContentType(contentType string) bool {
+	return matchesContentType(c.InlineContentTypes, contentType)
+}
+
+// IsAttachmentContentType returns whether media with the content type must always be
+// served as an attachment, whatever else would have it displayed by browsers.
+func (c *MediaAPI) IsAttachmentContentType(contentType string) bool {
+	return matchesContentType(c.AttachmentContentTypes, contentType)
+}
+
+// IsBlockedUploadType returns whether files of the type may not be uploaded.
+func (c *MediaAPI) IsBlockedUploadType(contentType string) bool {
+	return matchesContentType(c.BlockedUploadTypes, contentType)
+}
+
+// IsGzipContentType returns whether downloads of media with the content type are
+// gzipped for clients which accept it.
+func (c *MediaAPI) IsGzipContentType(contentType string) bool {
+	if !c.GzipDownloads.Enabled {
+		return false
+	}
+	switch contentType = mediaType(contentType); {
+	case contentType == "image/svg+xml":
+	case strings.HasPrefix(contentType, "image/"), strings.HasPrefix(contentType, "audio/"), strings.HasPrefix(contentType, "video/"):
+		return false
+	}
+	return matchesContentType(c.GzipDownloads.ContentTypes, contentType)
+}
+
+// matchesContentType returns whether the content type is one of the patterns, which
+// are content types or "type/*" for any subtype.
+func matchesContentType(patterns []string, contentType string) bool {
+	contentType = mediaType(contentType)
+	for _, pattern := range patterns {
+		pattern = strings.ToLower(pattern)
+		if pattern == contentType {
+			return true
+		}
+		if strings.HasSuffix(pattern, "/*") && strings.HasPrefix(contentType, pattern[:len(pattern)-1]) {
+			return true
+		}
+	}
+	return false
+}
+
+// mediaType returns the content type without any parameters, in lower case.
+func mediaType(contentType string) string {
+	return strings.ToLower(strings.TrimSpace(strings.Split(contentType, ";")[0]))
+}
+
+func checkContentTypePatterns(configErrs *ConfigErrors, key string, patterns []string) {
+	for i, pattern := range patterns {
+		parts := strings.Split(pattern, "/")
+		if len(parts) != 2 || parts[0] == "" || parts[0] == "*" || parts[1] == "" {
+			configErrs.Add(fmt.Sprintf("invalid value for config key %q: %s", fmt.Sprintf("%s[%d]", key, i), pattern))
+		}
+	}
+}
+
+func checkThumbnailMethod(configErrs *ConfigErrors, key, method string) {
+	if method != "crop" && method != "scale" && method != "pad" {
+		configErrs.Add(fmt.Sprintf("invalid value for config key %q: %s", key, method))
 	}
 }
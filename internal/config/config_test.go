@@ -16,7 +16,13 @@ package config
 
 import (
 	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+
+	"github.com/matrix-org/gomatrixserverlib"
 )
 
 func TestLoadConfigRelative(t *testing.T) {
@@ -244,6 +250,31 @@ func TestReadKey(t *testing.T) {
 	}
 }
 
+func TestReadMediaEncryptionKey(t *testing.T) {
+	keyID, key, err := readMediaEncryptionKeyPEM("path/to/key", []byte(testMediaKey))
+	if err != nil {
+		t.Fatal("failed to load media encryption key:", err)
+	}
+	if keyID != testMediaKeyID {
+		t.Errorf("wanted key ID to be %q, got %q", testMediaKeyID, keyID)
+	}
+	if len(key) != 32 {
+		t.Errorf("wanted a 32 byte key, got %d bytes", len(key))
+	}
+	if _, _, err = readMediaEncryptionKeyPEM("path/to/key", []byte(testKey)); err == nil {
+		t.Error("expected an error reading a matrix private key as a media encryption key")
+	}
+}
+
+const testMediaKeyID = "aes256:Jd3PO4nR"
+
+const testMediaKey = `
+-----BEGIN MEDIA ENCRYPTION KEY-----
+Key-ID: ` + testMediaKeyID + `
+q2sQed4YfH1BDpSyOhIXZCtjHqHrTfEv9fOGSSbVYNw=
+-----END MEDIA ENCRYPTION KEY-----
+`
+
 const testKeyID = "ed25519:c8NsuQ"
 
 const testKey = `
@@ -283,3 +314,337 @@ n0Xq64k7fc42HXJpF8CGBkSaIhtlzcruO+vqR80B9r62+D0V7VmHOnP135MT6noU
 ANAf5kxmMsM0zlN2hkxl0H6o7wKlBSw3RI3cjfilXiMWRPJrzlc4
 -----END CERTIFICATE-----
 `
+
+func TestMediaAPIThumbnailMethod(t *testing.T) {
+	c := &MediaAPI{
+		DefaultThumbnailMethod: "scale",
+		ThumbnailMethodsByContentType: map[string]string{
+			"image/gif": "crop",
+			"video/*":   "crop",
+		},
+	}
+	tests := []struct {
+		contentType string
+		want        string
+	}{
+		{"image/gif", "crop"},
+		{"Image/GIF; charset=binary", "crop"},
+		{"video/mp4", "crop"},
+		{"image/png", "scale"},
+		{"", "scale"},
+	}
+	for _, tt := range tests {
+		if got := c.ThumbnailMethod(tt.contentType); got != tt.want {
+			t.Errorf("%q: got method %q, want %q", tt.contentType, got, tt.want)
+		}
+	}
+}
+
+func TestMediaAPIIsInlineContentType(t *testing.T) {
+	c := &MediaAPI{InlineContentTypes: []string{"image/png", "Video/*"}}
+	tests := []struct {
+		contentType string
+		want        bool
+	}{
+		{"image/png", true},
+		{"IMAGE/PNG; charset=binary", true},
+		{"video/mp4", true},
+		{"image/svg+xml", false},
+		{"text/html", false},
+		{"videoclip/mp4", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if got := c.IsInlineContentType(tt.contentType); got != tt.want {
+			t.Errorf("%q: got %v, want %v", tt.contentType, got, tt.want)
+		}
+	}
+}
+
+func TestMediaAPIIsAttachmentContentType(t *testing.T) {
+	c := &MediaAPI{}
+	c.Defaults()
+	tests := []struct {
+		contentType string
+		want        bool
+	}{
+		{"text/html; charset=utf-8", true},
+		{"application/xhtml+xml", true},
+		{"Image/SVG+XML", true},
+		{"application/javascript", true},
+		{"text/plain", false},
+		{"image/png", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if got := c.IsAttachmentContentType(tt.contentType); got != tt.want {
+			t.Errorf("%q: got %v, want %v", tt.contentType, got, tt.want)
+		}
+	}
+}
+
+func TestMediaAPIIsGzipContentType(t *testing.T) {
+	c := &MediaAPI{GzipDownloads: GzipDownloads{
+		Enabled:      true,
+		ContentTypes: []string{"text/*", "application/json", "image/*", "video/*"},
+	}}
+	tests := []struct {
+		contentType string
+		want        bool
+	}{
+		{"text/plain; charset=utf-8", true},
+		{"application/json", true},
+		{"image/svg+xml", true},
+		{"image/png", false},
+		{"video/mp4", false},
+		{"application/octet-stream", false},
+	}
+	for _, tt := range tests {
+		if got := c.IsGzipContentType(tt.contentType); got != tt.want {
+			t.Errorf("%q: got %v, want %v", tt.contentType, got, tt.want)
+		}
+	}
+	c.GzipDownloads.Enabled = false
+	if c.IsGzipContentType("text/plain") {
+		t.Error("got true with gzip_downloads disabled")
+	}
+}
+
+func TestMediaAPIIsAllowedRemoteOrigin(t *testing.T) {
+	c := &MediaAPI{}
+	if !c.IsAllowedRemoteOrigin("any.example") {
+		t.Error("got false with no allowed origins, want true")
+	}
+	c.AllowedRemoteOrigins = []gomatrixserverlib.ServerName{"trusted.example"}
+	if !c.IsAllowedRemoteOrigin("trusted.example") {
+		t.Error("got false for an allowed origin, want true")
+	}
+	if c.IsAllowedRemoteOrigin("other.example") {
+		t.Error("got true for an origin which isn't allowed, want false")
+	}
+}
+
+func TestMediaAPIValidate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mediaapi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir) // nolint: errcheck
+	notDir := filepath.Join(dir, "file")
+	if err = ioutil.WriteFile(notDir, []byte("file"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	valid := func() *MediaAPI {
+		c := &MediaAPI{Matrix: &Global{ServerName: "example.com:8448"}}
+		c.Defaults()
+		c.AbsBasePath = Path(filepath.Join(dir, "media_store"))
+		c.ThumbnailSizes = []ThumbnailSize{{Width: 32, Height: 32, ResizeMethod: "crop"}}
+		return c
+	}
+	if err = valid().Validate(); err != nil {
+		t.Fatalf("valid config: unexpected error %v", err)
+	}
+	if info, statErr := os.Stat(filepath.Join(dir, "media_store")); statErr != nil || !info.IsDir() {
+		t.Errorf("the media store was not created: %v", statErr)
+	}
+
+	tests := []struct {
+		name    string
+		modify  func(c *MediaAPI)
+		wantKey string
+	}{
+		{"no global config", func(c *MediaAPI) { c.Matrix = nil }, "global.server_name"},
+		{"empty server name", func(c *MediaAPI) { c.Matrix.ServerName = "" }, "global.server_name"},
+		{"server name with a path", func(c *MediaAPI) { c.Matrix.ServerName = "example.com/matrix" }, "global.server_name"},
+		{"server name with an empty label", func(c *MediaAPI) { c.Matrix.ServerName = "example..com" }, "global.server_name"},
+		{"server name with a bad port", func(c *MediaAPI) { c.Matrix.ServerName = "example.com:port" }, "global.server_name"},
+		{"no base path", func(c *MediaAPI) { c.AbsBasePath = "" }, "media_api.base_path"},
+		{"base path is a file", func(c *MediaAPI) { c.AbsBasePath = Path(notDir) }, "media_api.base_path"},
+		{"base path under a file", func(c *MediaAPI) { c.AbsBasePath = Path(filepath.Join(notDir, "media_store")) }, "media_api.base_path"},
+		{"no max file size", func(c *MediaAPI) { c.MaxFileSizeBytes = nil }, "media_api.max_file_size_bytes"},
+		{"negative max file size", func(c *MediaAPI) {
+			size := FileSizeBytes(-1)
+			c.MaxFileSizeBytes = &size
+		}, "media_api.max_file_size_bytes"},
+		{"compressible uploads larger than any upload", func(c *MediaAPI) {
+			c.CompressibleUploads.Enabled = true
+			c.CompressibleUploads.MaxFileSizeBytes = *c.MaxFileSizeBytes + 1
+		}, "media_api.compressible_uploads.max_file_size_bytes"},
+		{"no thumbnail generators", func(c *MediaAPI) { c.MaxThumbnailGenerators = 0 }, "media_api.max_thumbnail_generators"},
+		{"empty thumbnail size", func(c *MediaAPI) { c.ThumbnailSizes[0].Width = 0 }, "media_api.thumbnail_sizes[0]"},
+	}
+	for _, tt := range tests {
+		c := valid()
+		tt.modify(c)
+		err := c.Validate()
+		if err == nil {
+			t.Errorf("%s: expected an error", tt.name)
+			continue
+		}
+		if !strings.Contains(err.Error(), fmt.Sprintf("%q", tt.wantKey)) {
+			t.Errorf("%s: got error %q, want one about %s", tt.name, err, tt.wantKey)
+		}
+	}
+
+	// Limits which only look odd are fine.
+	c := valid()
+	noLimit := FileSizeBytes(0)
+	c.MaxFileSizeBytes = &noLimit
+	c.CompressibleUploads.Enabled = true
+	c.MaxImagePixels = 0
+	if err = c.Validate(); err != nil {
+		t.Errorf("config without limits: unexpected error %v", err)
+	}
+	c = valid()
+	c.MaxThumbnailGenerators = 0
+	c.ThumbnailSizes = nil
+	if err = c.Validate(); err != nil {
+		t.Errorf("config without thumbnails: unexpected error %v", err)
+	}
+
+	if os.Geteuid() != 0 {
+		readOnly := filepath.Join(dir, "read_only")
+		if err = os.Mkdir(readOnly, 0500); err != nil {
+			t.Fatal(err)
+		}
+		c = valid()
+		c.AbsBasePath = Path(readOnly)
+		if err = c.Validate(); err == nil {
+			t.Error("read-only base path: expected an error")
+		}
+	}
+}
+
+func TestMediaAPIThumbnailSizeLimits(t *testing.T) {
+	c := &MediaAPI{Matrix: &Global{ServerName: "localhost"}}
+	c.Defaults()
+	c.MaxThumbnailWidth = 800
+	c.MaxThumbnailHeight = 600
+	for _, tt := range []struct {
+		width, height int
+		want          bool
+	}{
+		{800, 600, true},
+		{801, 600, false},
+		{800, 601, false},
+	} {
+		if got := c.IsAllowedThumbnailSize(tt.width, tt.height); got != tt.want {
+			t.Errorf("%dx%d: got %v, want %v", tt.width, tt.height, got, tt.want)
+		}
+	}
+
+	c.ThumbnailSizes = []ThumbnailSize{{Width: 800, Height: 600, ResizeMethod: "scale"}}
+	var configErrs ConfigErrors
+	c.Verify(&configErrs, true)
+	if len(configErrs) != 0 {
+		t.Errorf("thumbnail size within the limits: unexpected errors %v", configErrs)
+	}
+	c.ThumbnailSizes = append(c.ThumbnailSizes, ThumbnailSize{Width: 1024, Height: 768, ResizeMethod: "scale"})
+	configErrs = nil
+	c.Verify(&configErrs, true)
+	if len(configErrs) != 1 || !strings.Contains(configErrs[0], `"media_api.thumbnail_sizes[1]"`) {
+		t.Errorf("thumbnail size over the limits: got errors %v, want one about thumbnail_sizes[1]", configErrs)
+	}
+}
+
+func TestParseThumbnailBackground(t *testing.T) {
+	for _, tt := range []struct {
+		background string
+		want       string
+		valid      bool
+	}{
+		{"", "00000000", true},
+		{"transparent", "00000000", true},
+		{"Transparent", "00000000", true},
+		{"ffffff", "ffffffff", true},
+		{"#FF8000", "ff8000ff", true},
+		{"#00000080", "00000080", true},
+		{"white", "", false},
+		{"#fff", "", false},
+		{"fffffff", "", false},
+		{"zzzzzz", "", false},
+		{"##ffffff", "", false},
+	} {
+		got, err := ParseThumbnailBackground(tt.background)
+		if !tt.valid {
+			if err == nil {
+				t.Errorf("%q: expected an error, got %q", tt.background, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("%q: got %q, %v, want %q", tt.background, got, err, tt.want)
+		}
+	}
+}
+
+func TestMediaAPIThumbnailBackground(t *testing.T) {
+	c := &MediaAPI{Matrix: &Global{ServerName: "localhost"}}
+	c.Defaults()
+	c.ThumbnailSizes = []ThumbnailSize{
+		{Width: 64, Height: 64, ResizeMethod: "pad"},
+		{Width: 96, Height: 96, ResizeMethod: "pad", Background: "#FFFFFF"},
+	}
+	var configErrs ConfigErrors
+	c.Verify(&configErrs, true)
+	if len(configErrs) != 0 {
+		t.Fatalf("padded thumbnail sizes: unexpected errors %v", configErrs)
+	}
+	// The backgrounds are stored in the form that thumbnails are requested with.
+	if c.ThumbnailSizes[0].Background != "00000000" || c.ThumbnailSizes[1].Background != "ffffffff" {
+		t.Errorf("got backgrounds %q and %q, want 00000000 and ffffffff", c.ThumbnailSizes[0].Background, c.ThumbnailSizes[1].Background)
+	}
+
+	c.ThumbnailSizes = []ThumbnailSize{
+		{Width: 64, Height: 64, ResizeMethod: "pad", Background: "white"},
+		{Width: 96, Height: 96, ResizeMethod: "crop", Background: "ffffff"},
+	}
+	configErrs = nil
+	c.Verify(&configErrs, true)
+	if len(configErrs) != 2 ||
+		!strings.Contains(configErrs[0], `"media_api.thumbnail_sizes[0].background"`) ||
+		!strings.Contains(configErrs[1], `"media_api.thumbnail_sizes[1].background"`) {
+		t.Errorf("invalid backgrounds: got errors %v, want one about each background", configErrs)
+	}
+
+	c.ThumbnailSizes = nil
+	c.DefaultThumbnailMethod = "pad"
+	configErrs = nil
+	c.Verify(&configErrs, true)
+	if len(configErrs) != 0 {
+		t.Errorf("pad as the default method: unexpected errors %v", configErrs)
+	}
+}
+
+func TestMediaAPICDNBaseURL(t *testing.T) {
+	for _, tt := range []struct {
+		value   string
+		want    string
+		wantErr bool
+	}{
+		{"", "", false},
+		{"https://cdn.example.com", "https://cdn.example.com", false},
+		{"https://cdn.example.com/media/", "https://cdn.example.com/media", false},
+		{"cdn.example.com", "", true},
+		{"ftp://cdn.example.com", "", true},
+	} {
+		c := &MediaAPI{Matrix: &Global{ServerName: "localhost"}}
+		c.Defaults()
+		c.CDNBaseURL = tt.value
+		var configErrs ConfigErrors
+		c.Verify(&configErrs, true)
+		if tt.wantErr {
+			if len(configErrs) != 1 || !strings.Contains(configErrs[0], `"media_api.cdn_base_url"`) {
+				t.Errorf("%q: got errors %v, want one about cdn_base_url", tt.value, configErrs)
+			}
+			continue
+		}
+		if len(configErrs) != 0 {
+			t.Errorf("%q: unexpected errors %v", tt.value, configErrs)
+		}
+		if c.CDNBaseURL != tt.want {
+			t.Errorf("%q: got %q, want %q", tt.value, c.CDNBaseURL, tt.want)
+		}
+	}
+}
@@ -0,0 +1,35 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httputil
+
+import (
+	"context"
+	"net"
+)
+
+type connContextKey struct{}
+
+// ConnContext records the connection which requests are received on in their context,
+// so that handlers can set deadlines on it. It is used as the ConnContext of servers.
+func ConnContext(ctx context.Context, conn net.Conn) context.Context {
+	return context.WithValue(ctx, connContextKey{}, conn)
+}
+
+// ConnFromContext returns the connection which the request with the given context was
+// received on, or nil if the server didn't record it with ConnContext.
+func ConnFromContext(ctx context.Context) net.Conn {
+	conn, _ := ctx.Value(connContextKey{}).(net.Conn)
+	return conn
+}
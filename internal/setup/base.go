@@ -44,6 +44,7 @@ import (
 	"github.com/matrix-org/dendrite/internal/config"
 	keyserverAPI "github.com/matrix-org/dendrite/keyserver/api"
 	keyinthttp "github.com/matrix-org/dendrite/keyserver/inthttp"
+	"github.com/matrix-org/dendrite/mediaapi"
 	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
 	rsinthttp "github.com/matrix-org/dendrite/roomserver/inthttp"
 	serverKeyAPI "github.com/matrix-org/dendrite/serverkeyapi/api"
@@ -75,6 +76,7 @@ type BaseDendrite struct {
 	Caches                 *caching.Caches
 	KafkaConsumer          sarama.Consumer
 	KafkaProducer          sarama.SyncProducer
+	shutdown               *shutdownHooks
 }
 
 const HTTPServerTimeout = time.Minute * 5
@@ -154,6 +156,7 @@ func NewBaseDendrite(cfg *config.Dendrite, componentName string, useHTTPAPIs boo
 		httpClient:             &client,
 		KafkaConsumer:          kafkaConsumer,
 		KafkaProducer:          kafkaProducer,
+		shutdown:               &shutdownHooks{},
 	}
 }
 
@@ -251,6 +254,16 @@ func (b *BaseDendrite) CreateClient() *gomatrixserverlib.Client {
 	return client
 }
 
+// CreateMediaClient creates a new client for fetching media from remote servers,
+// using the remote timeouts from the MediaAPI config.
+func (b *BaseDendrite) CreateMediaClient() *gomatrixserverlib.Client {
+	client := mediaapi.NewClient(
+		&b.Cfg.MediaAPI, b.Cfg.FederationSender.DisableTLSValidation,
+	)
+	client.SetUserAgent(fmt.Sprintf("Dendrite/%s", internal.VersionString()))
+	return client
+}
+
 // CreateFederationClient creates a new federation client. Should only be called
 // once per component.
 func (b *BaseDendrite) CreateFederationClient() *gomatrixserverlib.FederationClient {
@@ -279,6 +292,7 @@ func (b *BaseDendrite) SetupAndServeHTTP(
 		Addr:         string(internalAddr),
 		WriteTimeout: HTTPServerTimeout,
 		Handler:      internalRouter,
+		ConnContext:  httputil.ConnContext,
 	}
 	externalServ := internalServ
 
@@ -288,6 +302,7 @@ func (b *BaseDendrite) SetupAndServeHTTP(
 			Addr:         string(externalAddr),
 			WriteTimeout: HTTPServerTimeout,
 			Handler:      externalRouter,
+			ConnContext:  httputil.ConnContext,
 		}
 	}
 
@@ -331,7 +346,7 @@ func (b *BaseDendrite) SetupAndServeHTTP(
 		}()
 	}
 
-	select {}
+	b.WaitForShutdown()
 }
 
 // setupKafka creates kafka consumer/producer pair from the config.
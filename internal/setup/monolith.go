@@ -15,6 +15,8 @@
 package setup
 
 import (
+	"context"
+
 	"github.com/Shopify/sarama"
 	"github.com/gorilla/mux"
 	appserviceAPI "github.com/matrix-org/dendrite/appservice/api"
@@ -56,6 +58,8 @@ type Monolith struct {
 
 	// Optional
 	ExtPublicRoomsProvider api.ExtraPublicRoomsProvider
+
+	mediaAPI *mediaapi.MediaAPI
 }
 
 // AddAllPublicRoutes attaches all public paths to the given router
@@ -71,9 +75,17 @@ func (m *Monolith) AddAllPublicRoutes(csMux, ssMux, keyMux, mediaMux *mux.Router
 		m.KeyRing, m.RoomserverAPI, m.FederationSenderAPI,
 		m.EDUInternalAPI, m.KeyAPI,
 	)
-	mediaapi.AddPublicRoutes(mediaMux, &m.Config.MediaAPI, m.UserAPI, m.Client)
+	m.mediaAPI = mediaapi.AddPublicRoutes(mediaMux, csMux, ssMux, &m.Config.MediaAPI, m.UserAPI, m.Client, m.KeyRing)
 	syncapi.AddPublicRoutes(
 		csMux, m.KafkaConsumer, m.UserAPI, m.RoomserverAPI,
 		m.KeyAPI, m.FedClient, &m.Config.SyncAPI,
 	)
 }
+
+// Drain lets the components finish what they are doing before the server shuts down.
+// It should be registered with OnShutdown once the public routes have been added.
+func (m *Monolith) Drain(ctx context.Context) {
+	if m.mediaAPI != nil {
+		m.mediaAPI.Drain(ctx)
+	}
+}
@@ -0,0 +1,84 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package setup
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+
+	"github.com/sirupsen/logrus"
+)
+
+// shutdownHooks are called, in the order in which they were registered, once the
+// process is asked to stop.
+type shutdownHooks struct {
+	sync.Mutex
+	hooks []func(ctx context.Context)
+	once  sync.Once
+}
+
+// OnShutdown registers f to be called once the process is asked to stop with SIGINT
+// or SIGTERM, before it stops. The context given to f is done if the process is asked
+// to stop again, in which case f should return as soon as it can.
+func (b *BaseDendrite) OnShutdown(f func(ctx context.Context)) {
+	b.shutdown.Lock()
+	defer b.shutdown.Unlock()
+	b.shutdown.hooks = append(b.shutdown.hooks, f)
+}
+
+// WaitForShutdown blocks until the process is asked to stop with SIGINT or SIGTERM,
+// calls the shutdown hooks and then stops the process in the same way as the signal
+// would have without them. It may be called from more than one goroutine, in which
+// case the hooks are still only called once.
+func (b *BaseDendrite) WaitForShutdown() {
+	b.shutdown.once.Do(b.shutDownOnSignal)
+	select {}
+}
+
+func (b *BaseDendrite) shutDownOnSignal() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	sig := <-signals
+
+	logrus.WithField("signal", sig).Infof("Shutting down %s", b.componentName)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		if _, ok := <-signals; ok {
+			cancel()
+		}
+	}()
+	b.shutdown.Lock()
+	hooks := b.shutdown.hooks
+	b.shutdown.Unlock()
+	for _, hook := range hooks {
+		hook(ctx)
+	}
+	signal.Stop(signals)
+	close(signals)
+
+	// Deliver the signal again now that it is no longer being caught, so that the
+	// process stops in the same way as it would have without the hooks.
+	process, err := os.FindProcess(os.Getpid())
+	if err == nil {
+		err = process.Signal(sig)
+	}
+	if err != nil {
+		os.Exit(1)
+	}
+}
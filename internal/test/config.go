@@ -161,6 +161,37 @@ func NewMatrixKey(matrixKeyPath string) (err error) {
 	return err
 }
 
+// NewMediaEncryptionKey generates a new AES-256 key for encrypting media at rest and
+// writes it to a file.
+func NewMediaEncryptionKey(keyPath string) (err error) {
+	var data [38]byte
+	_, err = rand.Read(data[:])
+	if err != nil {
+		return err
+	}
+	keyOut, err := os.OpenFile(keyPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	defer (func() {
+		err = keyOut.Close()
+	})()
+
+	keyID := base64.RawURLEncoding.EncodeToString(data[:6])
+	keyID = strings.ReplaceAll(keyID, "-", "")
+	keyID = strings.ReplaceAll(keyID, "_", "")
+
+	err = pem.Encode(keyOut, &pem.Block{
+		Type: "MEDIA ENCRYPTION KEY",
+		Headers: map[string]string{
+			"Key-ID": fmt.Sprintf("aes256:%s", keyID),
+		},
+		Bytes: data[6:],
+	})
+	return err
+}
+
 const certificateDuration = time.Hour * 24 * 365 * 10
 
 // NewTLSKey generates a new RSA TLS key and certificate and writes it to a file.
@@ -0,0 +1,330 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fileutils
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/matrix-org/dendrite/mediaapi/types"
+)
+
+// Media files which are encrypted at rest start with encryptedFileMagic, followed by a
+// byte giving the length of the ID of the key used to encrypt the file, the key ID and
+// a random nonce prefix. The rest of the file is the plaintext split into chunks of
+// encryptedChunkSize bytes, each of which is sealed separately with AES-GCM so that
+// files can be streamed rather than held in memory. The nonce of each chunk is the
+// nonce prefix followed by the chunk number. The last chunk is always shorter than
+// encryptedChunkSize (and may be empty) and is marked as such in its additional data,
+// so that a truncated file can't be mistaken for a complete one.
+const (
+	encryptedFileMagic = "DMEDIAE1"
+	encryptedChunkSize = 64 * 1024
+	noncePrefixSize    = 8
+)
+
+var (
+	chunkAdditionalData = []byte{0}
+	finalAdditionalData = []byte{1}
+)
+
+var errTruncatedFile = errors.New("encrypted media file is truncated")
+
+// EncryptionKey is a key used to encrypt media files at rest.
+type EncryptionKey struct {
+	// ID identifies the key, and is recorded in every file encrypted with it.
+	ID   string
+	aead cipher.AEAD
+}
+
+// NewEncryptionKey creates an AES-GCM encryption key with the given ID. The key must
+// be 16, 24 or 32 bytes long, for AES-128, AES-192 or AES-256 respectively.
+func NewEncryptionKey(id string, key []byte) (*EncryptionKey, error) {
+	if id == "" || len(id) > 255 {
+		return nil, fmt.Errorf("encryption key ID must be between 1 and 255 bytes long")
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("aes.NewCipher: %w", err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("cipher.NewGCM: %w", err)
+	}
+	return &EncryptionKey{ID: id, aead: aead}, nil
+}
+
+// NewWriter returns a writer which encrypts everything written to it and writes it to
+// dst. The writer must be closed to write out the final chunk, which does not close dst.
+func (k *EncryptionKey) NewWriter(dst io.Writer) (io.WriteCloser, error) {
+	header := make([]byte, 0, len(encryptedFileMagic)+1+len(k.ID)+noncePrefixSize)
+	header = append(header, encryptedFileMagic...)
+	header = append(header, byte(len(k.ID)))
+	header = append(header, k.ID...)
+	nonce := make([]byte, k.aead.NonceSize())
+	if _, err := rand.Read(nonce[:noncePrefixSize]); err != nil {
+		return nil, fmt.Errorf("rand.Read: %w", err)
+	}
+	header = append(header, nonce[:noncePrefixSize]...)
+	if _, err := dst.Write(header); err != nil {
+		return nil, err
+	}
+	return &encryptingWriter{
+		dst:   dst,
+		aead:  k.aead,
+		nonce: nonce,
+		buf:   make([]byte, 0, encryptedChunkSize+k.aead.Overhead()),
+	}, nil
+}
+
+// CreateFile creates a media file at path and returns a writer for it. If key is not
+// nil then the file is encrypted with it. The writer must be closed once done.
+func CreateFile(path types.Path, key *EncryptionKey) (io.WriteCloser, error) {
+	file, err := os.Create(string(path))
+	if err != nil {
+		return nil, err
+	}
+	if key == nil {
+		return file, nil
+	}
+	writer, err := key.NewWriter(file)
+	if err != nil {
+		file.Close() // nolint: errcheck
+		return nil, err
+	}
+	return &encryptedFile{WriteCloser: writer, file: file}, nil
+}
+
+// OpenFile opens a media file for reading. The encryption is what was recorded for the
+// file when it was stored. If the file was encrypted at rest then it is decrypted with
+// key, which must be the key that the file was encrypted with. Files which were stored
+// unencrypted are read as they are, whatever they start with. Only files stored before
+// the encryption was recorded are told apart by their header. Returns the file contents
+// and the size of the plaintext. The returned reader must be closed once done.
+func OpenFile(path types.Path, encryption types.Encryption, key *EncryptionKey) (io.ReadCloser, types.FileSizeBytes, error) {
+	file, err := os.Open(string(path))
+	if err != nil {
+		return nil, 0, err
+	}
+	header, size, err := readHeader(file, encryption)
+	if err != nil {
+		file.Close() // nolint: errcheck
+		return nil, 0, err
+	}
+	if header == nil {
+		return file, size, nil
+	}
+	if key == nil || key.ID != header.keyID {
+		file.Close() // nolint: errcheck
+		return nil, 0, fmt.Errorf("media file %q is encrypted with unknown key %q", path, header.keyID)
+	}
+	nonce := make([]byte, key.aead.NonceSize())
+	copy(nonce, header.noncePrefix)
+	return &decryptingReader{
+		file:  file,
+		aead:  key.aead,
+		nonce: nonce,
+		buf:   make([]byte, encryptedChunkSize+key.aead.Overhead()),
+	}, size, nil
+}
+
+// FileSize returns the size of the plaintext of a media file, whether or not it is
+// encrypted at rest, given the encryption recorded for the file.
+func FileSize(path types.Path, encryption types.Encryption) (types.FileSizeBytes, error) {
+	file, err := os.Open(string(path))
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close() // nolint: errcheck
+	_, size, err := readHeader(file, encryption)
+	return size, err
+}
+
+type encryptionHeader struct {
+	keyID       string
+	noncePrefix []byte
+}
+
+// readHeader reads the encryption header from the start of file if the file is
+// encrypted. If it is not then a nil header is returned and the file is left at its
+// start. If the encryption is unknown then the file is taken to be encrypted if it
+// starts with encryptedFileMagic. Returns the header and the size of the plaintext.
+func readHeader(file *os.File, encryption types.Encryption) (*encryptionHeader, types.FileSizeBytes, error) {
+	stat, err := file.Stat()
+	if err != nil {
+		return nil, 0, err
+	}
+	if encryption == types.NotEncrypted {
+		return nil, types.FileSizeBytes(stat.Size()), nil
+	}
+	magic := make([]byte, len(encryptedFileMagic))
+	if _, err = io.ReadFull(file, magic); err != nil || !bytes.Equal(magic, []byte(encryptedFileMagic)) {
+		if encryption == types.Encrypted {
+			return nil, 0, fmt.Errorf("media file %q is not encrypted", file.Name())
+		}
+		if _, err = file.Seek(0, io.SeekStart); err != nil {
+			return nil, 0, err
+		}
+		return nil, types.FileSizeBytes(stat.Size()), nil
+	}
+	keyIDLength := make([]byte, 1)
+	if _, err = io.ReadFull(file, keyIDLength); err != nil {
+		return nil, 0, errTruncatedFile
+	}
+	rest := make([]byte, int(keyIDLength[0])+noncePrefixSize)
+	if _, err = io.ReadFull(file, rest); err != nil {
+		return nil, 0, errTruncatedFile
+	}
+	header := &encryptionHeader{
+		keyID:       string(rest[:keyIDLength[0]]),
+		noncePrefix: rest[keyIDLength[0]:],
+	}
+
+	// Every chunk is followed by an authentication tag, and the last chunk is always
+	// shorter than the others, so the plaintext size can be worked out from the file size.
+	// The tag size is the same for all keys.
+	const overhead = 16
+	body := stat.Size() - int64(len(encryptedFileMagic)+len(keyIDLength)+len(rest))
+	fullChunks := body / (encryptedChunkSize + overhead)
+	last := body - fullChunks*(encryptedChunkSize+overhead)
+	if last < overhead {
+		return nil, 0, errTruncatedFile
+	}
+	return header, types.FileSizeBytes(fullChunks*encryptedChunkSize + last - overhead), nil
+}
+
+type encryptingWriter struct {
+	dst     io.Writer
+	aead    cipher.AEAD
+	nonce   []byte
+	counter uint32
+	buf     []byte
+}
+
+func (w *encryptingWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		// A full chunk is only sealed once there is more data to follow it, as the
+		// last chunk must never be a full one.
+		if len(w.buf) == encryptedChunkSize {
+			if err := w.seal(false); err != nil {
+				return written, err
+			}
+		}
+		n := copy(w.buf[len(w.buf):encryptedChunkSize], p)
+		w.buf = w.buf[:len(w.buf)+n]
+		p = p[n:]
+		written += n
+	}
+	return written, nil
+}
+
+func (w *encryptingWriter) Close() error {
+	if len(w.buf) == encryptedChunkSize {
+		if err := w.seal(false); err != nil {
+			return err
+		}
+	}
+	return w.seal(true)
+}
+
+func (w *encryptingWriter) seal(final bool) error {
+	additionalData := chunkAdditionalData
+	if final {
+		additionalData = finalAdditionalData
+	}
+	binary.BigEndian.PutUint32(w.nonce[noncePrefixSize:], w.counter)
+	sealed := w.aead.Seal(w.buf[:0], w.nonce, w.buf, additionalData)
+	if _, err := w.dst.Write(sealed); err != nil {
+		return err
+	}
+	w.buf = w.buf[:0]
+	w.counter++
+	if w.counter == 0 {
+		return errors.New("media file is too large to encrypt")
+	}
+	return nil
+}
+
+// encryptedFile closes the underlying file once the encrypted stream has been finished.
+type encryptedFile struct {
+	io.WriteCloser
+	file *os.File
+}
+
+func (f *encryptedFile) Close() error {
+	err := f.WriteCloser.Close()
+	if err2 := f.file.Close(); err == nil {
+		err = err2
+	}
+	return err
+}
+
+type decryptingReader struct {
+	file    *os.File
+	aead    cipher.AEAD
+	nonce   []byte
+	counter uint32
+	buf     []byte
+	plain   []byte
+	done    bool
+}
+
+func (r *decryptingReader) Read(p []byte) (int, error) {
+	for len(r.plain) == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+		if err := r.open(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.plain)
+	r.plain = r.plain[n:]
+	return n, nil
+}
+
+func (r *decryptingReader) open() error {
+	n, err := io.ReadFull(r.file, r.buf)
+	additionalData := chunkAdditionalData
+	switch err {
+	case nil:
+	case io.ErrUnexpectedEOF:
+		additionalData = finalAdditionalData
+		r.done = true
+	case io.EOF:
+		return errTruncatedFile
+	default:
+		return err
+	}
+	binary.BigEndian.PutUint32(r.nonce[noncePrefixSize:], r.counter)
+	r.plain, err = r.aead.Open(r.buf[:0], r.nonce, r.buf[:n], additionalData)
+	if err != nil {
+		return fmt.Errorf("failed to decrypt media file: %w", err)
+	}
+	r.counter++
+	return nil
+}
+
+func (r *decryptingReader) Close() error {
+	return r.file.Close()
+}
@@ -0,0 +1,162 @@
+package fileutils
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/matrix-org/dendrite/mediaapi/types"
+)
+
+func mustNewEncryptionKey(t *testing.T, id string) *EncryptionKey {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		t.Fatal(err)
+	}
+	key, err := NewEncryptionKey(id, secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func writeTestFile(t *testing.T, path types.Path, key *EncryptionKey, data []byte) {
+	file, err := CreateFile(path, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = file.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err = file.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readTestFile(path types.Path, encryption types.Encryption, key *EncryptionKey) ([]byte, types.FileSizeBytes, error) {
+	file, size, err := OpenFile(path, encryption, key)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer file.Close() // nolint: errcheck
+	data, err := ioutil.ReadAll(file)
+	return data, size, err
+}
+
+func TestEncryptedFileRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mediaapi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir) // nolint: errcheck
+	key := mustNewEncryptionKey(t, "aes256:test")
+
+	for _, size := range []int{0, 1, encryptedChunkSize - 1, encryptedChunkSize, encryptedChunkSize + 1, 3 * encryptedChunkSize} {
+		plaintext := make([]byte, size)
+		if _, err = rand.Read(plaintext); err != nil {
+			t.Fatal(err)
+		}
+		path := types.Path(filepath.Join(dir, "content"))
+		writeTestFile(t, path, key, plaintext)
+
+		stored, err := ioutil.ReadFile(string(path))
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Very short plaintexts are likely to turn up in the ciphertext by chance.
+		if size >= 16 && bytes.Contains(stored, plaintext) {
+			t.Errorf("size %d: stored file contains the plaintext", size)
+		}
+		if fileSize, err := FileSize(path, types.Encrypted); err != nil || fileSize != types.FileSizeBytes(size) {
+			t.Errorf("size %d: FileSize returned %d, %v", size, fileSize, err)
+		}
+
+		data, fileSize, err := readTestFile(path, types.Encrypted, key)
+		if err != nil {
+			t.Fatalf("size %d: failed to read file: %s", size, err)
+		}
+		if fileSize != types.FileSizeBytes(size) {
+			t.Errorf("size %d: OpenFile returned size %d", size, fileSize)
+		}
+		if !bytes.Equal(data, plaintext) {
+			t.Errorf("size %d: decrypted data does not match plaintext", size)
+		}
+
+		// Dropping the last chunk or part of it must be detected.
+		for _, cut := range []int{1, 16 + size%encryptedChunkSize} {
+			if err = ioutil.WriteFile(string(path), stored[:len(stored)-cut], 0600); err != nil {
+				t.Fatal(err)
+			}
+			if _, _, err = readTestFile(path, types.Encrypted, key); err == nil {
+				t.Errorf("size %d: expected error reading file truncated by %d bytes", size, cut)
+			}
+		}
+	}
+}
+
+func TestOpenFileKeys(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mediaapi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir) // nolint: errcheck
+	key := mustNewEncryptionKey(t, "aes256:one")
+	plaintext := []byte("hello world")
+
+	// Files stored before encryption was enabled can still be read.
+	path := types.Path(filepath.Join(dir, "plain"))
+	writeTestFile(t, path, nil, plaintext)
+	if data, _, err := readTestFile(path, types.NotEncrypted, key); err != nil || !bytes.Equal(data, plaintext) {
+		t.Errorf("failed to read unencrypted file: %q, %v", data, err)
+	}
+
+	path = types.Path(filepath.Join(dir, "encrypted"))
+	writeTestFile(t, path, key, plaintext)
+	if _, _, err = readTestFile(path, types.Encrypted, nil); err == nil {
+		t.Error("expected error reading encrypted file without a key")
+	}
+	if _, _, err = readTestFile(path, types.Encrypted, mustNewEncryptionKey(t, "aes256:two")); err == nil {
+		t.Error("expected error reading encrypted file with a different key")
+	}
+	if _, _, err = readTestFile(path, types.Encrypted, mustNewEncryptionKey(t, "aes256:one")); err == nil {
+		t.Error("expected error reading encrypted file with a different key with the same ID")
+	}
+}
+
+func TestOpenFileEncryption(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mediaapi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir) // nolint: errcheck
+	key := mustNewEncryptionKey(t, "aes256:test")
+
+	// An unencrypted file which happens to start like an encrypted one is read as it is.
+	plaintext := []byte(encryptedFileMagic + "\x0bnot a header")
+	path := types.Path(filepath.Join(dir, "plain"))
+	writeTestFile(t, path, nil, plaintext)
+	if data, size, err := readTestFile(path, types.NotEncrypted, key); err != nil || !bytes.Equal(data, plaintext) || size != types.FileSizeBytes(len(plaintext)) {
+		t.Errorf("failed to read unencrypted file: %q, %d, %v", data, size, err)
+	}
+	if size, err := FileSize(path, types.NotEncrypted); err != nil || size != types.FileSizeBytes(len(plaintext)) {
+		t.Errorf("FileSize returned %d, %v", size, err)
+	}
+	if _, _, err = readTestFile(path, types.Encrypted, key); err == nil {
+		t.Error("expected error reading unencrypted file recorded as encrypted")
+	}
+
+	// Files whose encryption wasn't recorded are told apart by their header.
+	plaintext = []byte("hello world")
+	writeTestFile(t, path, nil, plaintext)
+	if data, _, err := readTestFile(path, types.EncryptionUnknown, key); err != nil || !bytes.Equal(data, plaintext) {
+		t.Errorf("failed to read unencrypted file: %q, %v", data, err)
+	}
+	path = types.Path(filepath.Join(dir, "encrypted"))
+	writeTestFile(t, path, key, plaintext)
+	if data, _, err := readTestFile(path, types.EncryptionUnknown, key); err != nil || !bytes.Equal(data, plaintext) {
+		t.Errorf("failed to read encrypted file: %q, %v", data, err)
+	}
+}
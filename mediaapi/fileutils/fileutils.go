@@ -19,12 +19,15 @@ import (
 	"context"
 	"crypto/sha256"
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/matrix-org/dendrite/internal/config"
 	"github.com/matrix-org/dendrite/mediaapi/types"
@@ -32,9 +35,18 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
+// tempDirPrefix is prepended to the names of all temporary directories created by this
+// process, so that cleaning up orphaned temporary files never touches in-progress uploads.
+var tempDirPrefix = fmt.Sprintf("%d-%d-", os.Getpid(), time.Now().UnixNano())
+
 // GetPathFromBase64Hash evaluates the path to a media file from its Base64Hash
 // 3 subdirectories are created for more manageable browsing and use the remainder as the file name.
 // For example, if Base64Hash is 'qwerty', the path will be 'q/w/erty/file'.
+// Files are shared by any media with the same content, whichever server it came from, so
+// what is served for a media ID is always decided by the metadata for that ID and origin.
+// The path deliberately doesn't include the origin: a file can only ever be served for
+// media whose own metadata has its hash, i.e. the same content, and media which share a
+// file (see CountMediaByHash) keep it until the last of them is removed.
 func GetPathFromBase64Hash(base64Hash types.Base64Hash, absBasePath config.Path) (string, error) {
 	if len(base64Hash) < 3 {
 		return "", fmt.Errorf("Invalid filePath (Base64Hash too short - min 3 characters): %q", base64Hash)
@@ -67,9 +79,14 @@ func GetPathFromBase64Hash(base64Hash types.Base64Hash, absBasePath config.Path)
 // MoveFileWithHashCheck checks for hash collisions when moving a temporary file to its final path based on metadata
 // The final path is based on the hash of the file.
 // If the final path exists and the file size matches, the file does not need to be moved.
+// The same is true if the final path comes to exist while the file is being moved, as an
+// existing file is never replaced, so concurrent moves of the same content are safe.
+// If encryptionKey is not nil then the file is encrypted with it as it is moved.
+// mediaMetadata.Encryption must be what was recorded for the file already at the final
+// path, if there is one. Otherwise it is set to whether the moved file was encrypted.
 // In error cases where the file is not a duplicate, the caller may decide to remove the final path.
 // Returns the final path of the file, whether it is a duplicate and an error.
-func MoveFileWithHashCheck(tmpDir types.Path, mediaMetadata *types.MediaMetadata, absBasePath config.Path, logger *log.Entry) (types.Path, bool, error) {
+func MoveFileWithHashCheck(tmpDir types.Path, mediaMetadata *types.MediaMetadata, absBasePath config.Path, encryptionKey *EncryptionKey, logger *log.Entry) (types.Path, bool, error) {
 	// Note: in all error and success cases, we need to remove the temporary directory
 	defer RemoveDir(tmpDir, logger)
 	duplicate := false
@@ -78,26 +95,78 @@ func MoveFileWithHashCheck(tmpDir types.Path, mediaMetadata *types.MediaMetadata
 		return "", duplicate, fmt.Errorf("failed to get file path from metadata: %w", err)
 	}
 
-	var stat os.FileInfo
+	// The existing file may be encrypted, so compare the size of the plaintext.
+	checkDuplicate := func(encryption types.Encryption) (types.Path, bool, error) {
+		if size, serr := FileSize(types.Path(finalPath), encryption); serr == nil && size == mediaMetadata.FileSizeBytes {
+			return types.Path(finalPath), true, nil
+		}
+		return "", true, fmt.Errorf("downloaded file with hash collision but different file size (%v)", finalPath)
+	}
+
 	// Note: The double-negative is intentional as os.IsExist(err) != !os.IsNotExist(err).
 	// The functions are error checkers to be used in different cases.
-	if stat, err = os.Stat(finalPath); !os.IsNotExist(err) {
-		duplicate = true
-		if stat.Size() == int64(mediaMetadata.FileSizeBytes) {
-			return types.Path(finalPath), duplicate, nil
+	if _, err = os.Stat(finalPath); !os.IsNotExist(err) {
+		return checkDuplicate(mediaMetadata.Encryption)
+	}
+	src := types.Path(filepath.Join(string(tmpDir), "content"))
+	if encryptionKey != nil {
+		if src, err = encryptTempFile(tmpDir, encryptionKey); err != nil {
+			return "", duplicate, fmt.Errorf("failed to encrypt file: %w", err)
 		}
-		return "", duplicate, fmt.Errorf("downloaded file with hash collision but different file size (%v)", finalPath)
 	}
-	err = moveFile(
-		types.Path(filepath.Join(string(tmpDir), "content")),
-		types.Path(finalPath),
-	)
+	err = moveFile(src, types.Path(finalPath))
+	if errors.Is(err, os.ErrExist) {
+		// The same content was stored at the final path since it was checked for, by
+		// something which stored it in the same way as it would have been here. As the
+		// path is the hash of the content, the file that is there is as good as this one.
+		mediaMetadata.Encryption = types.EncryptionFor(encryptionKey != nil)
+		return checkDuplicate(mediaMetadata.Encryption)
+	}
 	if err != nil {
 		return "", duplicate, fmt.Errorf("failed to move file to final destination (%v): %w", finalPath, err)
 	}
+	mediaMetadata.Encryption = types.EncryptionFor(encryptionKey != nil)
 	return types.Path(finalPath), duplicate, nil
 }
 
+// encryptTempFile encrypts the content of the temporary directory tmpDir into a new
+// file in the same directory, returning the path of the encrypted file. The encrypted
+// file is synced to disk, like the content was, before it is moved into the media store.
+func encryptTempFile(tmpDir types.Path, encryptionKey *EncryptionKey) (path types.Path, err error) {
+	src, err := os.Open(filepath.Join(string(tmpDir), "content"))
+	if err != nil {
+		return "", err
+	}
+	defer src.Close() // nolint: errcheck
+	path = types.Path(filepath.Join(string(tmpDir), "content.enc"))
+	dst, err := CreateFile(path, encryptionKey)
+	if err != nil {
+		return "", err
+	}
+	if _, err = io.Copy(dst, src); err != nil {
+		dst.Close() // nolint: errcheck
+		return "", err
+	}
+	if err = dst.Close(); err != nil {
+		return "", err
+	}
+	return path, syncFile(path)
+}
+
+// syncFile syncs the file at path to disk. Any handle on a file syncs all of its
+// writes, including those made through a handle which has since been closed.
+func syncFile(path types.Path) error {
+	file, err := os.OpenFile(string(path), os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	err = file.Sync()
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
 // RemoveDir removes a directory and logs a warning in case of errors
 func RemoveDir(dir types.Path, logger *log.Entry) {
 	dirErr := os.RemoveAll(string(dir))
@@ -106,20 +175,26 @@ func RemoveDir(dir types.Path, logger *log.Entry) {
 	}
 }
 
-// WriteTempFile writes to a new temporary file.
+// WriteTempFile writes to a new temporary file, a buffer of writes.BufferSize at a time.
+// The file is synced to disk every writes.SyncInterval and once it has been written,
+// so that it is complete when it is moved into the media store. A crash part way
+// through leaves an incomplete temporary file, which RemoveOrphanedTempDirs cleans up.
 // The file is deleted if there was an error while writing.
 func WriteTempFile(
 	ctx context.Context, reqReader io.Reader, maxFileSizeBytes config.FileSizeBytes, absBasePath config.Path,
+	writes config.FileWrites,
 ) (hash types.Base64Hash, size types.FileSizeBytes, path types.Path, err error) {
 	size = -1
 	logger := util.GetLogger(ctx)
-	tmpFileWriter, tmpFile, tmpDir, err := createTempFileWriter(absBasePath)
+	tmpFileWriter, tmpFile, tmpDir, err := createTempFileWriter(absBasePath, writes)
 	if err != nil {
 		return
 	}
 	defer func() {
 		err2 := tmpFile.Close()
-		if err == nil {
+		if err == nil && err2 != nil {
+			// The file may be incomplete if it couldn't be closed, so don't leave it behind.
+			RemoveDir(tmpDir, logger)
 			err = err2
 		}
 	}()
@@ -147,6 +222,10 @@ func WriteTempFile(
 		RemoveDir(tmpDir, logger)
 		return
 	}
+	if err = tmpFile.Sync(); err != nil {
+		RemoveDir(tmpDir, logger)
+		return
+	}
 
 	hash = types.Base64Hash(base64.RawURLEncoding.EncodeToString(hasher.Sum(nil)[:]))
 	size = types.FileSizeBytes(bytesWritten)
@@ -154,7 +233,178 @@ func WriteTempFile(
 	return
 }
 
-// moveFile attempts to move the file src to dst
+// ReplaceTempFile passes the contents of the temporary file in tmpDir through transform
+// and writes the output to a new temporary file. The original temporary directory is
+// removed in all cases. Returns the hash, size and path of the new temporary directory,
+// as if WriteTempFile had been called with the transformed data.
+func ReplaceTempFile(
+	ctx context.Context, tmpDir types.Path, transform func(io.Reader, io.Writer) error,
+	maxFileSizeBytes config.FileSizeBytes, absBasePath config.Path, writes config.FileWrites,
+) (hash types.Base64Hash, size types.FileSizeBytes, path types.Path, err error) {
+	logger := util.GetLogger(ctx)
+	defer RemoveDir(tmpDir, logger)
+
+	file, err := os.Open(filepath.Join(string(tmpDir), "content"))
+	if err != nil {
+		return "", -1, "", fmt.Errorf("os.Open: %w", err)
+	}
+	defer file.Close() // nolint: errcheck
+
+	reader, writer := io.Pipe()
+	go func() {
+		// Closing the pipe with the transform error propagates it to
+		// WriteTempFile, which will clean up the new temporary file.
+		writer.CloseWithError(transform(file, writer))
+	}()
+	hash, size, path, err = WriteTempFile(ctx, reader, maxFileSizeBytes, absBasePath, writes)
+	// Make sure the transform goroutine doesn't block forever if WriteTempFile
+	// bailed out early.
+	reader.Close() // nolint: errcheck
+	return
+}
+
+// CreateEmptyTempFile creates a new temporary directory with an empty file in it, for
+// uploads which are received a part at a time and added to it with AppendTempFile.
+// The directory must be removed with RemoveDir once it is no longer needed.
+func CreateEmptyTempFile(absBasePath config.Path) (types.Path, error) {
+	tmpDir, err := createTempDir(absBasePath)
+	if err != nil {
+		return "", err
+	}
+	file, err := os.Create(filepath.Join(string(tmpDir), "content"))
+	if err == nil {
+		err = file.Close()
+	}
+	if err != nil {
+		_ = os.RemoveAll(string(tmpDir))
+		return "", fmt.Errorf("Failed to create file: %w", err)
+	}
+	return tmpDir, nil
+}
+
+// AppendTempFile appends everything read from reader to the file in tmpDir. Returns
+// the number of bytes appended, which are kept even if reading or writing failed part
+// way through, so that they only need to be sent again if the caller wants them to be.
+func AppendTempFile(tmpDir types.Path, reader io.Reader) (int64, error) {
+	file, err := os.OpenFile(filepath.Join(string(tmpDir), "content"), os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		return 0, err
+	}
+	written, err := io.Copy(file, reader)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return written, err
+}
+
+// TruncateTempFile cuts the file in tmpDir down to size bytes, e.g. to drop a part
+// which was appended with AppendTempFile but then turned out to be invalid.
+func TruncateTempFile(tmpDir types.Path, size int64) error {
+	return os.Truncate(filepath.Join(string(tmpDir), "content"), size)
+}
+
+// OpenTempFile opens the file in tmpDir for reading.
+func OpenTempFile(tmpDir types.Path) (*os.File, error) {
+	return os.Open(filepath.Join(string(tmpDir), "content"))
+}
+
+// storageProbe is what ProbeStorage writes to the media store and reads back.
+var storageProbe = []byte("dendrite media store probe")
+
+// ProbeStorage checks that files can be written to absBasePath and read back again,
+// by writing a small file in a new temporary directory, which is then removed.
+func ProbeStorage(absBasePath config.Path) error {
+	tmpDir, err := createTempDir(absBasePath)
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(string(tmpDir)) // nolint: errcheck
+	filePath := filepath.Join(string(tmpDir), "content")
+	if err = ioutil.WriteFile(filePath, storageProbe, 0600); err != nil {
+		return fmt.Errorf("Failed to write file: %w", err)
+	}
+	data, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		return fmt.Errorf("Failed to read file: %w", err)
+	}
+	if string(data) != string(storageProbe) {
+		return fmt.Errorf("Read %q back from file, want %q", data, storageProbe)
+	}
+	if err = os.Remove(filePath); err != nil {
+		return fmt.Errorf("Failed to remove file: %w", err)
+	}
+	return nil
+}
+
+// RemoveOrphanedTempDirs removes temporary directories within absBasePath which were
+// not created by this process and have not been modified for at least maxAge. These are
+// left behind if the server is stopped part way through an upload or remote fetch.
+// Returns the number of directories that were removed.
+func RemoveOrphanedTempDirs(absBasePath config.Path, maxAge time.Duration, logger *log.Entry) (int, error) {
+	return removeTempDirs(absBasePath, func(entry os.FileInfo) bool {
+		return !strings.HasPrefix(entry.Name(), tempDirPrefix) && time.Since(entry.ModTime()) >= maxAge
+	}, logger)
+}
+
+// RemoveOwnTempDirs removes all temporary directories within absBasePath which were
+// created by this process, e.g. for uploads which didn't finish before shutting down.
+// Returns the number of directories that were removed.
+func RemoveOwnTempDirs(absBasePath config.Path, logger *log.Entry) (int, error) {
+	return removeTempDirs(absBasePath, func(entry os.FileInfo) bool {
+		return strings.HasPrefix(entry.Name(), tempDirPrefix)
+	}, logger)
+}
+
+func removeTempDirs(absBasePath config.Path, shouldRemove func(os.FileInfo) bool, logger *log.Entry) (int, error) {
+	baseTmpDir := filepath.Join(string(absBasePath), "tmp")
+	entries, err := ioutil.ReadDir(baseTmpDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, fmt.Errorf("ioutil.ReadDir: %w", err)
+	}
+	removed := 0
+	for _, entry := range entries {
+		if !shouldRemove(entry) {
+			continue
+		}
+		dir := filepath.Join(baseTmpDir, entry.Name())
+		if err = os.RemoveAll(dir); err != nil {
+			logger.WithError(err).WithField("dir", dir).Warn("Failed to remove temporary directory")
+			continue
+		}
+		removed++
+	}
+	return removed, nil
+}
+
+// Reasons returned by StorageErrorReason.
+const (
+	StorageErrorNoSpace          = "no_space"
+	StorageErrorReadOnly         = "read_only"
+	StorageErrorPermissionDenied = "permission_denied"
+)
+
+// StorageErrorReason returns the reason that err was caused by the media store not being
+// writable, i.e. because the disk or quota is full, the filesystem is read-only or the
+// server does not have permission to write to it. Returns an empty string for other errors.
+func StorageErrorReason(err error) string {
+	switch {
+	case errors.Is(err, syscall.ENOSPC), errors.Is(err, syscall.EDQUOT):
+		return StorageErrorNoSpace
+	case errors.Is(err, syscall.EROFS):
+		return StorageErrorReadOnly
+	case errors.Is(err, os.ErrPermission):
+		return StorageErrorPermissionDenied
+	}
+	return ""
+}
+
+// moveFile attempts to move the file src to dst, without replacing a file already at
+// dst, in which case the error is os.ErrExist. The file is linked into place and then
+// unlinked from src, so that it appears at dst whole and only if nothing else is there,
+// falling back to renaming it on filesystems which don't support hard links.
 func moveFile(src types.Path, dst types.Path) error {
 	dstDir := filepath.Dir(string(dst))
 
@@ -162,6 +412,16 @@ func moveFile(src types.Path, dst types.Path) error {
 	if err != nil {
 		return fmt.Errorf("Failed to make directory: %w", err)
 	}
+	err = os.Link(string(src), string(dst))
+	switch {
+	case err == nil:
+		return os.Remove(string(src))
+	case errors.Is(err, os.ErrExist):
+		return err
+	}
+	if _, err = os.Lstat(string(dst)); err == nil {
+		return os.ErrExist
+	}
 	err = os.Rename(string(src), string(dst))
 	if err != nil {
 		return fmt.Errorf("Failed to move directory: %w", err)
@@ -169,13 +429,14 @@ func moveFile(src types.Path, dst types.Path) error {
 	return nil
 }
 
-func createTempFileWriter(absBasePath config.Path) (*bufio.Writer, *os.File, types.Path, error) {
+func createTempFileWriter(absBasePath config.Path, writes config.FileWrites) (*bufio.Writer, *os.File, types.Path, error) {
 	tmpDir, err := createTempDir(absBasePath)
 	if err != nil {
 		return nil, nil, "", fmt.Errorf("Failed to create temp dir: %w", err)
 	}
-	writer, tmpFile, err := createFileWriter(tmpDir)
+	writer, tmpFile, err := createFileWriter(tmpDir, writes)
 	if err != nil {
+		_ = os.RemoveAll(string(tmpDir))
 		return nil, nil, "", fmt.Errorf("Failed to create file writer: %w", err)
 	}
 	return writer, tmpFile, tmpDir, nil
@@ -187,22 +448,46 @@ func createTempDir(baseDirectory config.Path) (types.Path, error) {
 	if err := os.MkdirAll(baseTmpDir, 0770); err != nil {
 		return "", fmt.Errorf("Failed to create base temp dir: %w", err)
 	}
-	tmpDir, err := ioutil.TempDir(baseTmpDir, "")
+	tmpDir, err := ioutil.TempDir(baseTmpDir, tempDirPrefix)
 	if err != nil {
 		return "", fmt.Errorf("Failed to create temp dir: %w", err)
 	}
 	return types.Path(tmpDir), nil
 }
 
-// createFileWriter creates a buffered file writer with a new file
+// createFileWriter creates a buffered file writer with a new file, which syncs the
+// file every writes.SyncInterval.
 // The caller should flush the writer before closing the file.
 // Returns the file handle as it needs to be closed when writing is complete
-func createFileWriter(directory types.Path) (*bufio.Writer, *os.File, error) {
+func createFileWriter(directory types.Path, writes config.FileWrites) (*bufio.Writer, *os.File, error) {
 	filePath := filepath.Join(string(directory), "content")
 	file, err := os.Create(filePath)
 	if err != nil {
 		return nil, nil, fmt.Errorf("Failed to create file: %w", err)
 	}
 
-	return bufio.NewWriter(file), file, nil
+	var w io.Writer = file
+	if writes.SyncInterval > 0 {
+		w = &syncingWriter{file: file, interval: int64(writes.SyncInterval)}
+	}
+	return bufio.NewWriterSize(w, int(writes.BufferSize)), file, nil
+}
+
+// syncingWriter writes to a file, syncing it to disk each time another interval bytes
+// have been written. It deliberately doesn't implement io.ReaderFrom, so that a
+// bufio.Writer in front of it always writes to it in chunks of its buffer size.
+type syncingWriter struct {
+	file     *os.File
+	interval int64
+	unsynced int64
+}
+
+func (w *syncingWriter) Write(p []byte) (int, error) {
+	n, err := w.file.Write(p)
+	w.unsynced += int64(n)
+	if err == nil && w.unsynced >= w.interval {
+		err = w.file.Sync()
+		w.unsynced = 0
+	}
+	return n, err
 }
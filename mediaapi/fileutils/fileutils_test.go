@@ -0,0 +1,302 @@
+package fileutils
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/internal/config"
+	"github.com/matrix-org/dendrite/mediaapi/types"
+	log "github.com/sirupsen/logrus"
+)
+
+func TestStorageErrorReason(t *testing.T) {
+	tests := []struct {
+		err  error
+		want string
+	}{
+		{&os.PathError{Op: "write", Path: "content", Err: syscall.ENOSPC}, StorageErrorNoSpace},
+		{fmt.Errorf("Failed to move file: %w", &os.LinkError{Op: "rename", Err: syscall.EDQUOT}), StorageErrorNoSpace},
+		{&os.PathError{Op: "open", Path: "content", Err: syscall.EROFS}, StorageErrorReadOnly},
+		{&os.PathError{Op: "mkdir", Path: "tmp", Err: syscall.EACCES}, StorageErrorPermissionDenied},
+		{errors.New("unexpected EOF"), ""},
+		{nil, ""},
+	}
+	for _, tt := range tests {
+		if got := StorageErrorReason(tt.err); got != tt.want {
+			t.Errorf("StorageErrorReason(%v) = %q, want %q", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestGetPathFromBase64Hash(t *testing.T) {
+	basePath := config.Path("/var/dendrite/media")
+	tests := []struct {
+		hash types.Base64Hash
+		want string
+	}{
+		// Files are spread over two levels of directories named after the first two
+		// characters of their hash, so no directory has more than 64 entries but the
+		// last, which has one per file.
+		{"qwerty", "/var/dendrite/media/q/w/erty/file"},
+		{"abc", "/var/dendrite/media/a/b/c/file"},
+		{"ab", ""},
+		{types.Base64Hash(strings.Repeat("a", 256)), ""},
+		{"../../etc", ""},
+	}
+	for _, tt := range tests {
+		got, err := GetPathFromBase64Hash(tt.hash, basePath)
+		if tt.want == "" {
+			if err == nil {
+				t.Errorf("%q: expected an error, got %q", tt.hash, got)
+			}
+			continue
+		}
+		if err != nil || got != filepath.FromSlash(tt.want) {
+			t.Errorf("%q: got %q and error %v, want %q", tt.hash, got, err, tt.want)
+		}
+	}
+}
+
+func TestRemoveTempDirs(t *testing.T) {
+	basePath, err := ioutil.TempDir("", "mediaapi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(basePath) // nolint: errcheck
+	absBasePath := config.Path(basePath)
+	logger := log.NewEntry(log.New())
+
+	// One directory left behind by another process, and one of our own.
+	orphaned := filepath.Join(basePath, "tmp", "1-2-orphaned")
+	if err = os.MkdirAll(orphaned, 0770); err != nil {
+		t.Fatal(err)
+	}
+	own, err := createTempDir(absBasePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var removed int
+	if removed, err = RemoveOrphanedTempDirs(absBasePath, time.Hour, logger); err != nil || removed != 0 {
+		t.Errorf("RemoveOrphanedTempDirs removed %d recent directories, %v", removed, err)
+	}
+	if removed, err = RemoveOrphanedTempDirs(absBasePath, 0, logger); err != nil || removed != 1 {
+		t.Errorf("RemoveOrphanedTempDirs removed %d directories, want 1, %v", removed, err)
+	}
+	if _, err = os.Stat(string(own)); err != nil {
+		t.Errorf("RemoveOrphanedTempDirs removed our own directory")
+	}
+
+	if removed, err = RemoveOwnTempDirs(absBasePath, logger); err != nil || removed != 1 {
+		t.Errorf("RemoveOwnTempDirs removed %d directories, want 1, %v", removed, err)
+	}
+	if _, err = os.Stat(string(own)); !os.IsNotExist(err) {
+		t.Errorf("RemoveOwnTempDirs didn't remove our own directory")
+	}
+}
+
+func TestWriteTempFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mediaapi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir) // nolint: errcheck
+	absBasePath := config.Path(dir)
+	content := strings.Repeat("0123456789", 1000)
+
+	for _, writes := range []config.FileWrites{
+		{BufferSize: 64 * 1024, SyncInterval: 32 * 1024 * 1024},
+		// Smaller than the file, so that it is written in many chunks and synced
+		// part way through.
+		{BufferSize: 100, SyncInterval: 1000},
+		{BufferSize: 100, SyncInterval: 0},
+	} {
+		_, size, tmpDir, err := WriteTempFile(
+			context.Background(), strings.NewReader(content), 0, absBasePath, writes,
+		)
+		if err != nil {
+			t.Fatalf("%+v: %v", writes, err)
+		}
+		written, err := ioutil.ReadFile(filepath.Join(string(tmpDir), "content"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if size != types.FileSizeBytes(len(content)) || string(written) != content {
+			t.Errorf("%+v: wrote %d bytes (size %d), want the %d byte content", writes, len(written), size, len(content))
+		}
+	}
+}
+
+func TestMoveFileWithHashCheckConcurrent(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mediaapi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir) // nolint: errcheck
+	absBasePath := config.Path(dir)
+	content := strings.Repeat("0123456789", 10000)
+	logger := log.WithField("test", "TestMoveFileWithHashCheckConcurrent")
+
+	// Nothing stops the moves from racing, as if uploads of the same content were
+	// being stored by different processes sharing the media store.
+	const moves = 20
+	tmpDirs := make([]types.Path, moves)
+	var hash types.Base64Hash
+	for i := range tmpDirs {
+		hash, _, tmpDirs[i], err = WriteTempFile(
+			context.Background(), strings.NewReader(content), 0, absBasePath, config.FileWrites{BufferSize: 1024},
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	type result struct {
+		path      types.Path
+		duplicate bool
+		err       error
+	}
+	results := make(chan result, moves)
+	for _, tmpDir := range tmpDirs {
+		go func(tmpDir types.Path) {
+			mediaMetadata := &types.MediaMetadata{Base64Hash: hash, FileSizeBytes: types.FileSizeBytes(len(content))}
+			path, duplicate, err := MoveFileWithHashCheck(tmpDir, mediaMetadata, absBasePath, nil, logger)
+			results <- result{path, duplicate, err}
+		}(tmpDir)
+	}
+	moved := 0
+	for i := 0; i < moves; i++ {
+		r := <-results
+		if r.err != nil {
+			t.Fatal(r.err)
+		}
+		if !r.duplicate {
+			moved++
+		}
+		stored, err := ioutil.ReadFile(string(r.path))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(stored) != content {
+			t.Errorf("got a file of %d bytes, want the %d bytes of content", len(stored), len(content))
+		}
+	}
+	if moved != 1 {
+		t.Errorf("%d moves weren't duplicates, want exactly one", moved)
+	}
+	entries, err := ioutil.ReadDir(filepath.Join(dir, "tmp"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("found %d temporary directories left behind", len(entries))
+	}
+}
+
+func TestSyncingWriter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mediaapi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir) // nolint: errcheck
+	file, err := os.Create(filepath.Join(dir, "content"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close() // nolint: errcheck
+
+	w := &syncingWriter{file: file, interval: 10}
+	for _, tt := range []struct {
+		write        string
+		wantUnsynced int64
+	}{
+		{"1234", 4},
+		{"56789", 9},
+		{"0", 0},
+		{"12345678901234", 0},
+		{"1", 1},
+	} {
+		if _, err = w.Write([]byte(tt.write)); err != nil {
+			t.Fatal(err)
+		}
+		if w.unsynced != tt.wantUnsynced {
+			t.Errorf("after writing %q: got %d bytes unsynced, want %d", tt.write, w.unsynced, tt.wantUnsynced)
+		}
+	}
+
+	// A closed file can't be synced.
+	file.Close() // nolint: errcheck
+	if _, err = w.Write([]byte("123456789")); err == nil {
+		t.Error("expected an error writing to a closed file")
+	}
+}
+
+// BenchmarkWriteTempFile compares writing a large upload with and without syncing the
+// file part way through.
+func BenchmarkWriteTempFile(b *testing.B) {
+	dir, err := ioutil.TempDir("", "mediaapi")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(dir) // nolint: errcheck
+	content := make([]byte, 256*1024*1024)
+	logger := log.WithField("test", "BenchmarkWriteTempFile")
+
+	for _, bm := range []struct {
+		name   string
+		writes config.FileWrites
+	}{
+		{"final sync only", config.FileWrites{BufferSize: 64 * 1024}},
+		{"sync every 32MiB", config.FileWrites{BufferSize: 64 * 1024, SyncInterval: 32 * 1024 * 1024}},
+		{"sync every 4MiB", config.FileWrites{BufferSize: 64 * 1024, SyncInterval: 4 * 1024 * 1024}},
+		{"4KiB buffer", config.FileWrites{BufferSize: 4 * 1024, SyncInterval: 32 * 1024 * 1024}},
+	} {
+		b.Run(bm.name, func(b *testing.B) {
+			b.SetBytes(int64(len(content)))
+			for i := 0; i < b.N; i++ {
+				_, _, tmpDir, err := WriteTempFile(
+					context.Background(), bytes.NewReader(content), 0, config.Path(dir), bm.writes,
+				)
+				if err != nil {
+					b.Fatal(err)
+				}
+				RemoveDir(tmpDir, logger)
+			}
+		})
+	}
+}
+
+func TestProbeStorage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fileutils")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir) // nolint: errcheck
+
+	if err = ProbeStorage(config.Path(dir)); err != nil {
+		t.Fatalf("ProbeStorage: %v", err)
+	}
+	entries, err := ioutil.ReadDir(filepath.Join(dir, "tmp"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("got %d entries left in tmp, want none", len(entries))
+	}
+
+	notADir := filepath.Join(dir, "file")
+	if err = ioutil.WriteFile(notADir, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = ProbeStorage(config.Path(notADir)); err == nil {
+		t.Errorf("ProbeStorage of a file: got no error")
+	}
+}
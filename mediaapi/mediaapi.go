@@ -15,27 +15,149 @@
 package mediaapi
 
 import (
+	"context"
+	"os/exec"
+	"time"
+
 	"github.com/gorilla/mux"
 	"github.com/matrix-org/dendrite/internal/config"
+	"github.com/matrix-org/dendrite/mediaapi/fileutils"
 	"github.com/matrix-org/dendrite/mediaapi/routing"
+	"github.com/matrix-org/dendrite/mediaapi/scanner"
 	"github.com/matrix-org/dendrite/mediaapi/storage"
+	"github.com/matrix-org/dendrite/mediaapi/types"
 	userapi "github.com/matrix-org/dendrite/userapi/api"
 	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/sirupsen/logrus"
 )
 
+// MediaAPI is the MediaAPI component once its routes have been added.
+type MediaAPI struct {
+	cfg            *config.MediaAPI
+	db             storage.Database
+	activeUploads  *routing.ActiveUploads
+	trafficTracker *routing.UserTrafficTracker
+}
+
 // AddPublicRoutes sets up and registers HTTP handlers for the MediaAPI component.
+// The authenticated download endpoints are registered on the client API router.
+// Downloads for other homeservers are registered on the federation API router.
+// The returned MediaAPI must be drained when the server shuts down.
 func AddPublicRoutes(
-	router *mux.Router, cfg *config.MediaAPI,
+	router, clientRouter, federationRouter *mux.Router, cfg *config.MediaAPI,
 	userAPI userapi.UserInternalAPI,
 	client *gomatrixserverlib.Client,
-) {
+	keyRing gomatrixserverlib.JSONVerifier,
+) *MediaAPI {
+	if err := cfg.Validate(); err != nil {
+		logrus.WithError(err).Panicf("invalid media API config")
+	}
+
 	mediaDB, err := storage.Open(&cfg.Database)
 	if err != nil {
 		logrus.WithError(err).Panicf("failed to connect to media db")
 	}
 
+	if cfg.TempFileMaxAge > 0 {
+		go func() {
+			logger := logrus.WithField("base_path", cfg.AbsBasePath)
+			removed, err := fileutils.RemoveOrphanedTempDirs(cfg.AbsBasePath, cfg.TempFileMaxAge, logger)
+			if err != nil {
+				logger.WithError(err).Error("Failed to clean up orphaned temporary files")
+				return
+			}
+			logger.Infof("Removed %d orphaned temporary upload(s)", removed)
+		}()
+	}
+
+	go removeExpiredReservations(mediaDB)
+	go removeDeletedMedia(cfg, mediaDB)
+
+	if cfg.PDFThumbnails.Enabled {
+		if _, err = exec.LookPath(cfg.PDFThumbnails.Command); err != nil {
+			logrus.WithError(err).Warn("PDF renderer not found, so PDFs won't be thumbnailed")
+		}
+	}
+
+	var encryptionKey *fileutils.EncryptionKey
+	if cfg.EncryptionKey != nil {
+		encryptionKey, err = fileutils.NewEncryptionKey(cfg.EncryptionKeyID, cfg.EncryptionKey)
+		if err != nil {
+			logrus.WithError(err).Panicf("failed to load media encryption key")
+		}
+	}
+
+	var uploadScanner scanner.Scanner
+	if cfg.UploadScanning.Enabled {
+		uploadScanner, err = scanner.New(&cfg.UploadScanning)
+		if err != nil {
+			logrus.WithError(err).Panicf("failed to set up upload scanning")
+		}
+	}
+
+	activeUploads := &routing.ActiveUploads{}
+	trafficTracker := routing.NewUserTrafficTracker()
 	routing.Setup(
-		router, cfg, mediaDB, userAPI, client,
+		router, clientRouter.PathPrefix("/v1/media").Subrouter(), federationRouter.PathPrefix("/v1/media").Subrouter(),
+		cfg, mediaDB, userAPI, client, keyRing, encryptionKey, uploadScanner, activeUploads, trafficTracker,
 	)
+	return &MediaAPI{cfg: cfg, db: mediaDB, activeUploads: activeUploads, trafficTracker: trafficTracker}
+}
+
+// NewClient creates a client for fetching media from remote servers, which applies
+// the remote timeouts from the MediaAPI config.
+func NewClient(cfg *config.MediaAPI, skipVerify bool) *gomatrixserverlib.Client {
+	return routing.NewRemoteClient(cfg, skipVerify)
+}
+
+// Drain refuses any new uploads and gives those in progress the upload shutdown grace
+// period, or until ctx is done if that is sooner, to finish. The temporary files of
+// any which didn't are then removed, so that they aren't left behind, and the traffic
+// of downloads which hasn't been stored yet is stored. It is called when the server is
+// shutting down.
+func (m *MediaAPI) Drain(ctx context.Context) {
+	uploadsCtx, cancel := context.WithTimeout(ctx, m.cfg.UploadShutdownGracePeriod)
+	defer cancel()
+	logger := logrus.WithField("base_path", m.cfg.AbsBasePath)
+	logger.Infof("Waiting up to %s for uploads in progress to finish", m.cfg.UploadShutdownGracePeriod)
+	if !m.activeUploads.Drain(uploadsCtx) {
+		logger.Warn("Uploads were still in progress when the shutdown grace period ended")
+	}
+	removed, err := fileutils.RemoveOwnTempDirs(m.cfg.AbsBasePath, logger)
+	if err != nil {
+		logger.WithError(err).Error("Failed to clean up temporary files")
+	} else if removed > 0 {
+		logger.Infof("Removed %d temporary upload(s)", removed)
+	}
+	m.trafficTracker.Flush(ctx, m.db)
+}
+
+// removeExpiredReservations periodically removes media IDs which were reserved
+// with /create but never had anything uploaded to them.
+func removeExpiredReservations(db storage.Database) {
+	for range time.Tick(time.Hour) {
+		now := types.UnixMs(time.Now().UnixNano() / 1000000)
+		removed, err := db.DeleteExpiredMediaReservations(context.Background(), now)
+		if err != nil {
+			logrus.WithError(err).Error("Failed to remove expired media reservations")
+			continue
+		}
+		if removed > 0 {
+			logrus.Infof("Removed %d expired media reservation(s)", removed)
+		}
+	}
+}
+
+// removeDeletedMedia periodically removes media which was soft deleted longer ago than
+// the grace period, along with its files.
+func removeDeletedMedia(cfg *config.MediaAPI, db storage.Database) {
+	for range time.Tick(time.Hour) {
+		removed, err := routing.RemoveDeletedMedia(context.Background(), cfg, db, time.Now())
+		if err != nil {
+			logrus.WithError(err).Error("Failed to remove deleted media")
+		}
+		if removed > 0 {
+			logrus.Infof("Removed %d deleted media", removed)
+		}
+	}
 }
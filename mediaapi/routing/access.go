@@ -0,0 +1,122 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/dendrite/mediaapi/storage"
+	"github.com/matrix-org/dendrite/mediaapi/types"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/sirupsen/logrus"
+)
+
+// mediaAccessFlushInterval is how often access times and download counts recorded
+// by downloads are written to the database. Downloads of the same media in between
+// only cost a map update rather than a database write each.
+const mediaAccessFlushInterval = time.Minute
+
+type mediaAccessKey struct {
+	mediaID types.MediaID
+	origin  gomatrixserverlib.ServerName
+}
+
+// mediaAccessTracker is a lockable map of the latest access times, and the number
+// of downloads, of media which have not yet been written to the database.
+type mediaAccessTracker struct {
+	sync.Mutex
+	pending map[mediaAccessKey]types.MediaAccess
+}
+
+func newMediaAccessTracker() *mediaAccessTracker {
+	return &mediaAccessTracker{
+		pending: map[mediaAccessKey]types.MediaAccess{},
+	}
+}
+
+// record notes that the media was accessed at the given time, counting it as a
+// download unless only a thumbnail of it was. It never blocks on the database, so
+// can be called while serving a request.
+func (t *mediaAccessTracker) record(
+	mediaID types.MediaID, origin gomatrixserverlib.ServerName, ts types.UnixMs, download bool,
+) {
+	var downloads int64
+	if download {
+		downloads = 1
+	}
+	t.add(mediaAccessKey{mediaID, origin}, types.MediaAccess{LastAccess: ts, DownloadCount: downloads})
+}
+
+func (t *mediaAccessTracker) add(key mediaAccessKey, access types.MediaAccess) {
+	t.Lock()
+	defer t.Unlock()
+	pending := t.pending[key]
+	if access.LastAccess > pending.LastAccess {
+		pending.LastAccess = access.LastAccess
+	}
+	pending.DownloadCount += access.DownloadCount
+	t.pending[key] = pending
+}
+
+// access returns the latest access time and the number of downloads recorded for
+// the media since the last flush, which are 0 if there aren't any.
+func (t *mediaAccessTracker) access(mediaID types.MediaID, origin gomatrixserverlib.ServerName) types.MediaAccess {
+	t.Lock()
+	defer t.Unlock()
+	return t.pending[mediaAccessKey{mediaID, origin}]
+}
+
+// withPending adds what was recorded for the media since the last flush to what is
+// stored in the database.
+func (t *mediaAccessTracker) withPending(
+	mediaID types.MediaID, origin gomatrixserverlib.ServerName, stored *types.MediaAccess,
+) types.MediaAccess {
+	access := *stored
+	pending := t.access(mediaID, origin)
+	if pending.LastAccess > access.LastAccess {
+		access.LastAccess = pending.LastAccess
+	}
+	access.DownloadCount += pending.DownloadCount
+	return access
+}
+
+// flush writes all pending access times and download counts to the database. Those
+// which fail to be written are kept so that they are retried on the next flush.
+func (t *mediaAccessTracker) flush(ctx context.Context, db storage.Database) {
+	t.Lock()
+	pending := t.pending
+	t.pending = map[mediaAccessKey]types.MediaAccess{}
+	t.Unlock()
+
+	for key, access := range pending {
+		if err := db.UpdateMediaAccess(ctx, key.mediaID, key.origin, access.LastAccess, access.DownloadCount); err != nil {
+			logrus.WithError(err).WithFields(logrus.Fields{
+				"MediaID": key.mediaID,
+				"Origin":  key.origin,
+			}).Warn("Failed to store media last access time and download count")
+			t.add(key, access)
+		}
+	}
+}
+
+// run flushes pending access times and download counts to the database every
+// interval, forever.
+func (t *mediaAccessTracker) run(db storage.Database, interval time.Duration) {
+	for range time.Tick(interval) {
+		t.flush(context.Background(), db)
+	}
+}
@@ -0,0 +1,219 @@
+package routing
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/matrix-org/dendrite/internal/config"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/mediaapi/storage"
+	"github.com/matrix-org/dendrite/mediaapi/types"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// accessTestDatabase stores the last access times and download counts written to
+// it, failing once for any media in failOnce.
+type accessTestDatabase struct {
+	storage.Database
+	lastAccess map[mediaAccessKey]types.UnixMs
+	downloads  map[mediaAccessKey]int64
+	failOnce   map[mediaAccessKey]bool
+}
+
+func (d *accessTestDatabase) UpdateMediaAccess(
+	ctx context.Context, mediaID types.MediaID, mediaOrigin gomatrixserverlib.ServerName,
+	lastAccess types.UnixMs, downloads int64,
+) error {
+	key := mediaAccessKey{mediaID, mediaOrigin}
+	if d.failOnce[key] {
+		delete(d.failOnce, key)
+		return errors.New("database is unavailable")
+	}
+	d.lastAccess[key] = lastAccess
+	d.downloads[key] += downloads
+	return nil
+}
+
+func TestMediaAccessTrackerFlush(t *testing.T) {
+	db := &accessTestDatabase{
+		lastAccess: map[mediaAccessKey]types.UnixMs{},
+		downloads:  map[mediaAccessKey]int64{},
+		failOnce:   map[mediaAccessKey]bool{{"b", "example.com"}: true},
+	}
+	tracker := newMediaAccessTracker()
+
+	tracker.record("a", "localhost", 200, true)
+	tracker.record("a", "localhost", 100, true)
+	tracker.record("a", "localhost", 150, false)
+	tracker.record("b", "example.com", 300, true)
+	if got := tracker.access("a", "localhost"); got.LastAccess != 200 || got.DownloadCount != 2 {
+		t.Errorf("got pending access %+v, want last access 200 and 2 downloads", got)
+	}
+
+	tracker.flush(context.Background(), db)
+	if got := db.lastAccess[mediaAccessKey{"a", "localhost"}]; got != 200 {
+		t.Errorf("got stored last access %d, want 200", got)
+	}
+	if got := db.downloads[mediaAccessKey{"a", "localhost"}]; got != 2 {
+		t.Errorf("got %d stored downloads, want 2", got)
+	}
+	if got := tracker.access("a", "localhost"); got != (types.MediaAccess{}) {
+		t.Errorf("got pending access %+v after flush, want none", got)
+	}
+	// The failed write should be kept and retried on the next flush, along with
+	// anything recorded in between.
+	if got := tracker.access("b", "example.com"); got.LastAccess != 300 || got.DownloadCount != 1 {
+		t.Errorf("got pending access %+v after failed flush, want last access 300 and 1 download", got)
+	}
+	tracker.record("b", "example.com", 250, true)
+
+	tracker.flush(context.Background(), db)
+	if got := db.lastAccess[mediaAccessKey{"b", "example.com"}]; got != 300 {
+		t.Errorf("got stored last access %d, want 300", got)
+	}
+	if got := db.downloads[mediaAccessKey{"b", "example.com"}]; got != 2 {
+		t.Errorf("got %d stored downloads, want 2", got)
+	}
+	if len(tracker.pending) != 0 {
+		t.Errorf("expected nothing pending, found %d entries", len(tracker.pending))
+	}
+}
+
+func TestDownloadCount(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mediaapi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir) // nolint: errcheck
+	dbOptions := &config.DatabaseOptions{
+		ConnectionString: config.DataSource("file:" + filepath.Join(dir, "mediaapi.db")),
+	}
+	db, err := storage.Open(dbOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &config.MediaAPI{
+		Matrix:      &config.Global{ServerName: "localhost"},
+		AbsBasePath: config.Path(filepath.Join(dir, "media_store")),
+	}
+	storeTestContent(t, db, cfg.AbsBasePath, "localhost", "abc", "text/plain", "some text")
+	tracker := newMediaAccessTracker()
+
+	download := func() {
+		w := httptest.NewRecorder()
+		Download(
+			w, httptest.NewRequest(http.MethodGet, "/download/localhost/abc", nil),
+			"localhost", "abc", cfg, db, nil,
+			&types.ActiveRemoteRequests{MXCToResult: map[string]*types.RemoteRequestResult{}},
+			&types.ActiveThumbnailGeneration{PathToResult: map[string]*types.ThumbnailGenerationResult{}},
+			nil, nil, tracker, NewUserTrafficTracker(), false, "",
+		)
+		if w.Code != http.StatusOK {
+			t.Fatalf("download: got status %d, want %d", w.Code, http.StatusOK)
+		}
+	}
+	stats := func() mediaStatsResponse {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodGet, "/admin/stats/localhost/abc", nil)
+		res := GetMediaStats(req, db, tracker, "localhost", "abc")
+		if res.Code != http.StatusOK {
+			t.Fatalf("stats: got status %d, want %d", res.Code, http.StatusOK)
+		}
+		return res.JSON.(mediaStatsResponse)
+	}
+
+	if got := stats().DownloadCount; got != 0 {
+		t.Errorf("got %d downloads before any, want 0", got)
+	}
+	download()
+	download()
+	// Downloads which haven't been written to the database yet are still counted.
+	if got := stats().DownloadCount; got != 2 {
+		t.Errorf("got %d downloads before flushing, want 2", got)
+	}
+	tracker.flush(context.Background(), db)
+	download()
+	if got := stats().DownloadCount; got != 3 {
+		t.Errorf("got %d downloads after flushing, want 3", got)
+	}
+
+	// Downloads at the same time are all counted.
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			tracker.record("abc", "localhost", 1, true)
+		}()
+	}
+	wg.Wait()
+	tracker.flush(context.Background(), db)
+
+	// The count is still there once the database has been opened again, as it would
+	// be after a restart.
+	db, err = storage.Open(dbOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	access, err := db.GetMediaAccess(context.Background(), "abc", "localhost")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if access.DownloadCount != 23 {
+		t.Errorf("got %d stored downloads, want 23", access.DownloadCount)
+	}
+	if access.LastAccess <= 1 {
+		t.Errorf("got stored last access %d, want the time of the last download", access.LastAccess)
+	}
+}
+
+func TestDownloadCountAddedToExistingTable(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mediaapi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir) // nolint: errcheck
+	dbOptions := &config.DatabaseOptions{
+		ConnectionString: config.DataSource("file:" + filepath.Join(dir, "mediaapi.db")),
+	}
+
+	// The table as it was before downloads were counted.
+	oldDB, err := sqlutil.Open(dbOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = oldDB.Exec(`
+		CREATE TABLE mediaapi_media_access (
+			media_id TEXT NOT NULL, media_origin TEXT NOT NULL, last_access_ts INTEGER NOT NULL
+		);
+		CREATE UNIQUE INDEX mediaapi_media_access_index ON mediaapi_media_access (media_id, media_origin);
+		INSERT INTO mediaapi_media_access VALUES ('abc', 'localhost', 100);
+	`)
+	oldDB.Close() // nolint: errcheck
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := storage.Open(dbOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if err = db.UpdateMediaAccess(ctx, "abc", "localhost", 200, 4); err != nil {
+		t.Fatal(err)
+	}
+	access, err := db.GetMediaAccess(ctx, "abc", "localhost")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *access != (types.MediaAccess{LastAccess: 200, DownloadCount: 4}) {
+		t.Errorf("got %+v, want last access 200 and 4 downloads", *access)
+	}
+}
@@ -0,0 +1,373 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/internal/config"
+	"github.com/matrix-org/dendrite/internal/httputil"
+	"github.com/matrix-org/dendrite/mediaapi/fileutils"
+	"github.com/matrix-org/dendrite/mediaapi/storage"
+	"github.com/matrix-org/dendrite/mediaapi/types"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+	log "github.com/sirupsen/logrus"
+)
+
+// purgeBatchSize is how many media are fetched from the database at a time when
+// purging all of a user's media.
+const purgeBatchSize = 100
+
+// makeAdminAPI wraps an authenticated handler so that it is only available to the
+// users listed in media_api.admin_users.
+func makeAdminAPI(
+	metricsName string, cfg *config.MediaAPI, userAPI userapi.UserInternalAPI,
+	f func(*http.Request, *userapi.Device) util.JSONResponse,
+) http.Handler {
+	return httputil.MakeAuthAPI(metricsName, userAPI, func(req *http.Request, dev *userapi.Device) util.JSONResponse {
+		if !cfg.IsAdmin(dev.UserID) {
+			return util.JSONResponse{
+				Code: http.StatusForbidden,
+				JSON: jsonerror.Forbidden("You are not a media admin"),
+			}
+		}
+		return f(req, dev)
+	})
+}
+
+// mediaStatsResponse defines the format of the JSON response to GET /admin/stats
+type mediaStatsResponse struct {
+	MediaID       types.MediaID                `json:"media_id"`
+	Origin        gomatrixserverlib.ServerName `json:"media_origin"`
+	ContentType   types.ContentType            `json:"content_type"`
+	FileSizeBytes types.FileSizeBytes          `json:"file_size_bytes"`
+	CreationTs    types.UnixMs                 `json:"creation_ts"`
+	// LastAccessTs is omitted if the media has never been downloaded.
+	LastAccessTs  types.UnixMs `json:"last_access_ts,omitempty"`
+	DownloadCount int64        `json:"download_count"`
+}
+
+// GetMediaStats implements GET /admin/stats/{serverName}/{mediaId}
+// This returns information about a media item which is held by this server,
+// including when it was last downloaded and how many times it was.
+func GetMediaStats(
+	req *http.Request, db storage.Database, accessTracker *mediaAccessTracker,
+	origin gomatrixserverlib.ServerName, mediaID types.MediaID,
+) util.JSONResponse {
+	logger := util.GetLogger(req.Context())
+	mediaMetadata, err := db.GetMediaMetadata(req.Context(), mediaID, origin)
+	if err != nil {
+		logger.WithError(err).Error("Failed to query media metadata")
+		return jsonerror.InternalServerError()
+	}
+	if mediaMetadata == nil {
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: jsonerror.NotFound("File not found"),
+		}
+	}
+
+	stored, err := db.GetMediaAccess(req.Context(), mediaID, origin)
+	if err != nil {
+		logger.WithError(err).Error("Failed to query media last access time")
+		return jsonerror.InternalServerError()
+	}
+	// Recent downloads may not have been written to the database yet.
+	access := accessTracker.withPending(mediaID, origin, stored)
+
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: mediaStatsResponse{
+			MediaID:       mediaMetadata.MediaID,
+			Origin:        mediaMetadata.Origin,
+			ContentType:   mediaMetadata.ContentType,
+			FileSizeBytes: mediaMetadata.FileSizeBytes,
+			CreationTs:    mediaMetadata.CreationTimestamp,
+			LastAccessTs:  access.LastAccess,
+			DownloadCount: access.DownloadCount,
+		},
+	}
+}
+
+// userTrafficResponse defines the format of the JSON response to GET /admin/traffic
+type userTrafficResponse struct {
+	UserID string       `json:"user_id"`
+	FromTs types.UnixMs `json:"from_ts"`
+	ToTs   types.UnixMs `json:"to_ts"`
+	// The total size of the files the user uploaded, and of the responses to
+	// downloads of the media they uploaded.
+	BytesUploaded int64 `json:"bytes_uploaded"`
+	BytesServed   int64 `json:"bytes_served"`
+}
+
+// GetUserTraffic implements GET /admin/traffic/{userId}
+// This returns how much a local user uploaded, and how much of the media they
+// uploaded was served, between the from_ts and to_ts query parameters in UNIX epoch
+// ms. These default to the beginning of time and now. Traffic is counted by the
+// hour, so all of it in any hour which overlaps that time is included.
+func GetUserTraffic(
+	req *http.Request, cfg *config.MediaAPI, db storage.Database, trafficTracker *UserTrafficTracker, userID string,
+) util.JSONResponse {
+	_, domain, err := gomatrixserverlib.SplitID('@', userID)
+	if err != nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue("userId must be a valid user ID"),
+		}
+	}
+	if domain != cfg.Matrix.ServerName {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue("userId must be a local user"),
+		}
+	}
+	fromTs, toTs := types.UnixMs(0), types.UnixMs(time.Now().UnixNano()/1000000)
+	for _, p := range []struct {
+		param string
+		ts    *types.UnixMs
+	}{{"from_ts", &fromTs}, {"to_ts", &toTs}} {
+		param, ts := p.param, p.ts
+		value := req.URL.Query().Get(param)
+		if value == "" {
+			continue
+		}
+		parsed, parseErr := strconv.ParseInt(value, 10, 64)
+		if parseErr != nil || parsed < 0 {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.InvalidArgumentValue(param + " must be a time in UNIX epoch ms"),
+			}
+		}
+		*ts = types.UnixMs(parsed)
+	}
+	if fromTs > toTs {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue("from_ts must not be after to_ts"),
+		}
+	}
+
+	traffic, err := db.GetUserTraffic(req.Context(), types.MatrixUserID(userID), fromTs, toTs)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).WithField("UserID", userID).Error("Failed to query user traffic")
+		return jsonerror.InternalServerError()
+	}
+	*traffic = trafficTracker.withPending(types.MatrixUserID(userID), fromTs, toTs, traffic)
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: userTrafficResponse{
+			UserID:        userID,
+			FromTs:        fromTs,
+			ToTs:          toTs,
+			BytesUploaded: traffic.BytesUploaded,
+			BytesServed:   traffic.BytesServed,
+		},
+	}
+}
+
+// purgeUserMediaResponse defines the format of the JSON response to POST /admin/purge_user
+type purgeUserMediaResponse struct {
+	UserID string `json:"user_id"`
+	DryRun bool   `json:"dry_run"`
+	// Whether the media was only marked deleted, in which case no files are removed
+	// until the soft delete grace period is over.
+	SoftDeleted bool `json:"soft_deleted"`
+	// The number of media and thumbnails whose metadata was removed.
+	MediaDeleted      int `json:"media_deleted"`
+	ThumbnailsDeleted int `json:"thumbnails_deleted"`
+	// The number of stored files, along with their thumbnails, which were removed
+	// and the space that freed up. Files which other media still use are kept.
+	FilesDeleted int   `json:"files_deleted"`
+	BytesFreed   int64 `json:"bytes_freed"`
+}
+
+// PurgeUserMedia implements POST /admin/purge_user/{userId}
+// This removes all media uploaded by a local user, e.g. when they have asked for
+// their data to be erased. If the dry_run query parameter is "true", nothing is
+// removed and the response says what would have been. Running it again once it has
+// succeeded does nothing, so it can safely be retried if it fails part way through.
+// If soft delete is enabled the media is only marked deleted, and can be undeleted
+// with POST /admin/undelete until the grace period is over.
+func PurgeUserMedia(
+	req *http.Request, cfg *config.MediaAPI, db storage.Database, userID string,
+) util.JSONResponse {
+	_, domain, err := gomatrixserverlib.SplitID('@', userID)
+	if err != nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue("userId must be a valid user ID"),
+		}
+	}
+	if domain != cfg.Matrix.ServerName {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue("userId must be a local user"),
+		}
+	}
+	dryRun := req.URL.Query().Get("dry_run") == "true"
+
+	logger := util.GetLogger(req.Context()).WithFields(log.Fields{
+		"UserID": userID,
+		"DryRun": dryRun,
+	})
+	res, err := purgeUserMedia(req.Context(), cfg, db, types.MatrixUserID(userID), dryRun)
+	if err != nil {
+		logger.WithError(err).Error("Failed to purge user media")
+		return jsonerror.InternalServerError()
+	}
+	logger.WithFields(log.Fields{
+		"MediaDeleted": res.MediaDeleted,
+		"FilesDeleted": res.FilesDeleted,
+		"BytesFreed":   res.BytesFreed,
+	}).Info("Purged user media")
+
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: res,
+	}
+}
+
+// purgeUserMedia removes the files and metadata of all media uploaded by the user, in
+// batches. Files are removed before their metadata, so that if anything fails the
+// media can still be found to try again.
+func purgeUserMedia(
+	ctx context.Context, cfg *config.MediaAPI, db storage.Database, userID types.MatrixUserID, dryRun bool,
+) (*purgeUserMediaResponse, error) {
+	res := &purgeUserMediaResponse{
+		UserID:      string(userID),
+		DryRun:      dryRun,
+		SoftDeleted: cfg.SoftDelete.Enabled,
+	}
+	// The user may have uploaded the same file more than once, which is only stored once.
+	handledHashes := map[types.Base64Hash]bool{}
+	var after types.MediaID
+	for {
+		batch, err := db.GetMediaByUser(ctx, userID, cfg.Matrix.ServerName, after, purgeBatchSize)
+		if err != nil {
+			return nil, err
+		}
+		for _, mediaMetadata := range batch {
+			after = mediaMetadata.MediaID
+			if err = purgeMedia(ctx, cfg, db, mediaMetadata, dryRun, handledHashes, res); err != nil {
+				return nil, err
+			}
+		}
+		if len(batch) < purgeBatchSize {
+			return res, nil
+		}
+	}
+}
+
+// purgeMedia removes the metadata of one of the user's media, and the file with its
+// thumbnails if nothing else uses it, or marks it deleted if res is of a soft delete,
+// adding what was removed to res.
+func purgeMedia(
+	ctx context.Context, cfg *config.MediaAPI, db storage.Database, mediaMetadata *types.MediaMetadata,
+	dryRun bool, handledHashes map[types.Base64Hash]bool, res *purgeUserMediaResponse,
+) error {
+	thumbnails, err := db.GetThumbnails(ctx, mediaMetadata.MediaID, mediaMetadata.Origin)
+	if err != nil {
+		return err
+	}
+
+	if res.SoftDeleted {
+		// The files are removed with the media once the grace period is over.
+		if !dryRun {
+			now := types.UnixMs(time.Now().UnixNano() / 1000000)
+			if err = db.SoftDeleteMedia(ctx, mediaMetadata.MediaID, mediaMetadata.Origin, now); err != nil {
+				return err
+			}
+		}
+		res.MediaDeleted++
+		res.ThumbnailsDeleted += len(thumbnails)
+		return nil
+	}
+
+	if !handledHashes[mediaMetadata.Base64Hash] {
+		handledHashes[mediaMetadata.Base64Hash] = true
+		defer fileLocks.lock(mediaMetadata.Base64Hash)()
+		// Files are stored by hash, so the same file may belong to media uploaded
+		// by someone else or fetched from another server.
+		var others int64
+		others, err = db.CountMediaByHashExcludingUser(ctx, mediaMetadata.Base64Hash, mediaMetadata.UserID)
+		if err != nil {
+			return err
+		}
+		if others == 0 {
+			var removed bool
+			var size int64
+			removed, size, err = removeMediaFiles(mediaMetadata.Base64Hash, cfg.AbsBasePath, dryRun)
+			if err != nil {
+				return err
+			}
+			if removed {
+				res.FilesDeleted++
+				res.BytesFreed += size
+				if !dryRun {
+					addStoredBytes(ctx, db, util.GetLogger(ctx), -int64(mediaMetadata.FileSizeBytes))
+				}
+			}
+		}
+	}
+
+	if !dryRun {
+		if err = db.DeleteMedia(ctx, mediaMetadata.MediaID, mediaMetadata.Origin); err != nil {
+			return err
+		}
+	}
+	res.MediaDeleted++
+	res.ThumbnailsDeleted += len(thumbnails)
+	return nil
+}
+
+// removeMediaFiles removes the directory holding the file with the given hash, along
+// with any thumbnails of it, unless dryRun is set. Returns whether there was anything
+// to remove and the total size of the files in it.
+func removeMediaFiles(
+	base64Hash types.Base64Hash, absBasePath config.Path, dryRun bool,
+) (bool, int64, error) {
+	filePath, err := fileutils.GetPathFromBase64Hash(base64Hash, absBasePath)
+	if err != nil {
+		return false, 0, err
+	}
+	dir := filepath.Dir(filePath)
+	files, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		// Already removed, e.g. by an earlier purge which didn't finish
+		return false, 0, nil
+	}
+	if err != nil {
+		return false, 0, err
+	}
+	var size int64
+	for _, file := range files {
+		size += file.Size()
+	}
+	if !dryRun {
+		if err = os.RemoveAll(dir); err != nil {
+			return false, 0, err
+		}
+	}
+	return true, size, nil
+}
@@ -0,0 +1,179 @@
+package routing
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/internal/config"
+	"github.com/matrix-org/dendrite/mediaapi/fileutils"
+	"github.com/matrix-org/dendrite/mediaapi/storage"
+	"github.com/matrix-org/dendrite/mediaapi/types"
+)
+
+// storeTestMedia stores the metadata for some media along with a file and one
+// thumbnail for it, unless the file with that hash has already been stored.
+func storeTestMedia(
+	t *testing.T, db storage.Database, basePath config.Path,
+	mediaID types.MediaID, userID types.MatrixUserID, hash types.Base64Hash,
+) {
+	ctx := context.Background()
+	mediaMetadata := &types.MediaMetadata{
+		MediaID:       mediaID,
+		Origin:        "localhost",
+		ContentType:   "image/png",
+		FileSizeBytes: 4,
+		Base64Hash:    hash,
+		UserID:        userID,
+	}
+	if err := db.StoreMediaMetadata(ctx, mediaMetadata); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.StoreThumbnail(ctx, &types.ThumbnailMetadata{
+		MediaMetadata: &types.MediaMetadata{
+			MediaID: mediaID, Origin: "localhost", ContentType: "image/jpeg", FileSizeBytes: 2,
+		},
+		ThumbnailSize: types.ThumbnailSize{Width: 32, Height: 32, ResizeMethod: types.Crop},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	filePath, err := fileutils.GetPathFromBase64Hash(hash, basePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.MkdirAll(filepath.Dir(filePath), 0770); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(filePath, []byte("file"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(filepath.Join(filepath.Dir(filePath), "thumbnail-32x32-crop"), []byte("th"), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func fileExists(t *testing.T, hash types.Base64Hash, basePath config.Path) bool {
+	filePath, err := fileutils.GetPathFromBase64Hash(hash, basePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = os.Stat(filePath)
+	return err == nil
+}
+
+func TestPurgeUserMedia(t *testing.T) {
+	db, basePath, cleanup := newTestDatabase(t)
+	defer cleanup()
+	cfg := &config.MediaAPI{
+		Matrix:      &config.Global{ServerName: "localhost"},
+		AbsBasePath: basePath,
+	}
+
+	// Alice uploaded one file twice, and another which Bob also uploaded.
+	storeTestMedia(t, db, basePath, "alice1", "@alice:localhost", "aliceonlyhash")
+	storeTestMedia(t, db, basePath, "alice2", "@alice:localhost", "aliceonlyhash")
+	storeTestMedia(t, db, basePath, "alice3", "@alice:localhost", "sharedhash")
+	storeTestMedia(t, db, basePath, "bob1", "@bob:localhost", "sharedhash")
+
+	ctx := context.Background()
+	check := func(name string, res *purgeUserMediaResponse, media, files int, bytes int64) {
+		if res.MediaDeleted != media || res.ThumbnailsDeleted != media {
+			t.Errorf("%s: got %d media and %d thumbnails, want %d", name, res.MediaDeleted, res.ThumbnailsDeleted, media)
+		}
+		if res.FilesDeleted != files || res.BytesFreed != bytes {
+			t.Errorf("%s: got %d files and %d bytes, want %d and %d", name, res.FilesDeleted, res.BytesFreed, files, bytes)
+		}
+	}
+
+	res, err := purgeUserMedia(ctx, cfg, db, "@alice:localhost", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check("dry run", res, 3, 1, 6)
+	if !fileExists(t, "aliceonlyhash", basePath) {
+		t.Error("dry run removed a file")
+	}
+	if m, _ := db.GetMediaMetadata(ctx, "alice1", "localhost"); m == nil {
+		t.Error("dry run removed media metadata")
+	}
+
+	res, err = purgeUserMedia(ctx, cfg, db, "@alice:localhost", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check("purge", res, 3, 1, 6)
+	if fileExists(t, "aliceonlyhash", basePath) {
+		t.Error("file only used by alice was not removed")
+	}
+	if !fileExists(t, "sharedhash", basePath) {
+		t.Error("file also used by bob was removed")
+	}
+	for _, mediaID := range []types.MediaID{"alice1", "alice2", "alice3"} {
+		if m, _ := db.GetMediaMetadata(ctx, mediaID, "localhost"); m != nil {
+			t.Errorf("metadata for %s was not removed", mediaID)
+		}
+		if thumbnails, _ := db.GetThumbnails(ctx, mediaID, "localhost"); len(thumbnails) != 0 {
+			t.Errorf("thumbnails for %s were not removed", mediaID)
+		}
+	}
+	if m, _ := db.GetMediaMetadata(ctx, "bob1", "localhost"); m == nil {
+		t.Error("bob's media was removed")
+	}
+
+	res, err = purgeUserMedia(ctx, cfg, db, "@alice:localhost", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check("second purge", res, 0, 0, 0)
+}
+
+func TestPurgeUserMediaSoftDelete(t *testing.T) {
+	db, basePath, cleanup := newTestDatabase(t)
+	defer cleanup()
+	cfg := &config.MediaAPI{
+		Matrix:      &config.Global{ServerName: "localhost"},
+		AbsBasePath: basePath,
+		SoftDelete:  config.SoftDelete{Enabled: true, GracePeriod: time.Hour},
+	}
+	storeTestMedia(t, db, basePath, "alice1", "@alice:localhost", "aliceonlyhash")
+	storeTestMedia(t, db, basePath, "alice2", "@alice:localhost", "sharedhash")
+	storeTestMedia(t, db, basePath, "bob1", "@bob:localhost", "sharedhash")
+
+	ctx := context.Background()
+	res, err := purgeUserMedia(ctx, cfg, db, "@alice:localhost", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !res.SoftDeleted || res.MediaDeleted != 2 || res.FilesDeleted != 0 || res.BytesFreed != 0 {
+		t.Errorf("got %+v, want 2 media soft deleted and no files removed", res)
+	}
+	for _, mediaID := range []types.MediaID{"alice1", "alice2"} {
+		if m, _ := db.GetMediaMetadata(ctx, mediaID, "localhost"); m != nil {
+			t.Errorf("%s is still served", mediaID)
+		}
+	}
+	if !fileExists(t, "aliceonlyhash", basePath) {
+		t.Error("the file only used by alice was removed during the grace period")
+	}
+	if res, err = purgeUserMedia(ctx, cfg, db, "@alice:localhost", false); err != nil || res.MediaDeleted != 0 {
+		t.Errorf("second purge: got %+v (%v), want nothing deleted", res, err)
+	}
+
+	if undeleted, _ := db.UndeleteMedia(ctx, "alice2", "localhost"); !undeleted {
+		t.Fatal("alice2 couldn't be undeleted")
+	}
+	removed, err := RemoveDeletedMedia(ctx, cfg, db, time.Now().Add(cfg.SoftDelete.GracePeriod+time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed != 1 || fileExists(t, "aliceonlyhash", basePath) {
+		t.Errorf("got %d removed, want only alice1 with its file", removed)
+	}
+	if m, _ := db.GetMediaMetadata(ctx, "alice2", "localhost"); m == nil || !fileExists(t, "sharedhash", basePath) {
+		t.Error("undeleted media was removed")
+	}
+}
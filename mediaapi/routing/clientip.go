@@ -0,0 +1,99 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strings"
+)
+
+type clientIPContextKey struct{}
+
+// trustedProxies are the networks of the reverse proxies which are trusted to say
+// where the requests they pass on came from in the X-Forwarded-For header.
+type trustedProxies []*net.IPNet
+
+// newTrustedProxies parses the CIDRs of the trusted proxies.
+func newTrustedProxies(cidrs []string) (trustedProxies, error) {
+	proxies := make(trustedProxies, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		proxies = append(proxies, network)
+	}
+	return proxies, nil
+}
+
+func (p trustedProxies) contains(ip net.IP) bool {
+	for _, network := range p {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns the IP address of the client which made the request. If the
+// request came through trusted proxies then the X-Forwarded-For header is followed
+// back from the nearest proxy until an address which isn't a trusted proxy is found.
+// Anything before that in the header could have been made up by the client, and the
+// header is ignored entirely if the request didn't come from a trusted proxy.
+func (p trustedProxies) clientIP(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return host
+	}
+
+	var hops []string
+	for _, header := range req.Header["X-Forwarded-For"] {
+		hops = append(hops, strings.Split(header, ",")...)
+	}
+	for i := len(hops) - 1; i >= 0 && p.contains(ip); i-- {
+		hop := net.ParseIP(strings.TrimSpace(hops[i]))
+		if hop == nil {
+			// The proxy sent something we can't make sense of, so the proxy itself
+			// is the last hop that can be trusted.
+			break
+		}
+		ip = hop
+	}
+	return ip.String()
+}
+
+// withClientIP is a middleware which works out the client IP address for each
+// request, so that it can be retrieved with requestClientIP.
+func (p trustedProxies) withClientIP(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		ctx := context.WithValue(req.Context(), clientIPContextKey{}, p.clientIP(req))
+		next.ServeHTTP(w, req.WithContext(ctx))
+	})
+}
+
+// requestClientIP returns the client IP address worked out by withClientIP, or
+// the address the request came from if it wasn't used.
+func requestClientIP(req *http.Request) string {
+	if ip, ok := req.Context().Value(clientIPContextKey{}).(string); ok {
+		return ip
+	}
+	return trustedProxies(nil).clientIP(req)
+}
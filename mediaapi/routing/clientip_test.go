@@ -0,0 +1,76 @@
+package routing
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	proxies, err := newTrustedProxies([]string{"10.0.0.0/8", "::1/128"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name           string
+		remoteAddr     string
+		forwardedFor   []string
+		wantClientIP   string
+		trustNoProxies bool
+	}{
+		{"no proxy", "1.2.3.4:5678", nil, "1.2.3.4", false},
+		{"untrusted source is ignored", "1.2.3.4:5678", []string{"5.6.7.8"}, "1.2.3.4", false},
+		{"trusted proxy", "10.0.0.1:5678", []string{"5.6.7.8"}, "5.6.7.8", false},
+		{"trusted proxy without header", "10.0.0.1:5678", nil, "10.0.0.1", false},
+		{"trusted IPv6 proxy", "[::1]:5678", []string{"2001:db8::1"}, "2001:db8::1", false},
+		{"chain of trusted proxies", "10.0.0.1:5678", []string{"5.6.7.8, 10.0.0.3, 10.0.0.2"}, "5.6.7.8", false},
+		{"spoofed entries before the real client", "10.0.0.1:5678", []string{"9.9.9.9, 10.0.0.9, 5.6.7.8"}, "5.6.7.8", false},
+		{"spoofed header lines", "10.0.0.1:5678", []string{"9.9.9.9", "5.6.7.8"}, "5.6.7.8", false},
+		{"all trusted", "10.0.0.1:5678", []string{"10.0.0.3, 10.0.0.2"}, "10.0.0.3", false},
+		{"invalid entry", "10.0.0.1:5678", []string{"5.6.7.8, not-an-ip, 10.0.0.2"}, "10.0.0.2", false},
+		{"no trusted proxies", "10.0.0.1:5678", []string{"5.6.7.8"}, "10.0.0.1", true},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/download", nil)
+		req.RemoteAddr = tt.remoteAddr
+		for _, header := range tt.forwardedFor {
+			req.Header.Add("X-Forwarded-For", header)
+		}
+		p := proxies
+		if tt.trustNoProxies {
+			p = nil
+		}
+		if got := p.clientIP(req); got != tt.wantClientIP {
+			t.Errorf("%s: got client IP %q, want %q", tt.name, got, tt.wantClientIP)
+		}
+	}
+}
+
+func TestWithClientIP(t *testing.T) {
+	proxies, err := newTrustedProxies([]string{"10.0.0.0/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got string
+	handler := proxies.withClientIP(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		got = requestClientIP(req)
+	}))
+
+	req := httptest.NewRequest(http.MethodGet, "/download", nil)
+	req.RemoteAddr = "10.0.0.1:5678"
+	req.Header.Set("X-Forwarded-For", "5.6.7.8")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	if got != "5.6.7.8" {
+		t.Errorf("got client IP %q, want %q", got, "5.6.7.8")
+	}
+
+	// Without the middleware the header is never trusted.
+	if ip := requestClientIP(req); ip != "10.0.0.1" {
+		t.Errorf("got client IP %q without the middleware, want %q", ip, "10.0.0.1")
+	}
+
+	if _, err = newTrustedProxies([]string{"10.0.0.1"}); err == nil {
+		t.Error("expected an error for an address which isn't in CIDR notation")
+	}
+}
@@ -0,0 +1,158 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/internal/config"
+	"github.com/matrix-org/dendrite/mediaapi/fileutils"
+	"github.com/matrix-org/dendrite/mediaapi/storage"
+	"github.com/matrix-org/dendrite/mediaapi/types"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+	log "github.com/sirupsen/logrus"
+)
+
+// CloneMedia implements POST /clone/{serverName}/{mediaId}
+// This gives media which this server already has a new content URI belonging to the
+// user, so that it can be sent again, e.g. by a bridge, without uploading it again.
+// No file is copied: the new media refers to the same stored file, and its
+// thumbnails, which are only removed once no media refers to them any more. Remote
+// media which hasn't been fetched yet is not found, as this never fetches media
+// from other servers.
+// Any user can download any media this server has, so any user can clone it too.
+// As nothing is stored but the metadata, the clone isn't counted against the maximum
+// total storage. Files of blocked types are refused as they would be for an upload,
+// which matters for media fetched from other servers, whose files were never checked.
+func CloneMedia(
+	req *http.Request, cfg *config.MediaAPI, dev *userapi.Device, db storage.Database,
+	encryptionKey *fileutils.EncryptionKey, origin gomatrixserverlib.ServerName, mediaID types.MediaID,
+) util.JSONResponse {
+	if !mediaIDRegex.MatchString(string(mediaID)) || origin == "" {
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: jsonerror.NotFound("File not found"),
+		}
+	}
+
+	ctx := req.Context()
+	logger := util.GetLogger(ctx).WithFields(log.Fields{
+		"Origin":   origin,
+		"MediaID":  mediaID,
+		"ClientIP": requestClientIP(req),
+	})
+	mediaMetadata, err := db.GetMediaMetadata(ctx, mediaID, origin)
+	if err != nil {
+		logger.WithError(err).Error("Failed to query media metadata")
+		return jsonerror.InternalServerError()
+	}
+	if mediaMetadata == nil {
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: jsonerror.NotFound("File not found"),
+		}
+	}
+
+	// The file mustn't be removed before the clone refers to it, as it would be if the
+	// original were overwritten or purged in the meantime (see fileLocks).
+	defer fileLocks.lock(mediaMetadata.Base64Hash)()
+	count, err := db.CountMediaByHash(ctx, mediaMetadata.Base64Hash)
+	if err != nil {
+		logger.WithError(err).Error("Failed to count media using the file")
+		return jsonerror.InternalServerError()
+	}
+	if count == 0 {
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: jsonerror.NotFound("File not found"),
+		}
+	}
+
+	if len(cfg.BlockedUploadTypes) > 0 {
+		head, headErr := readStoredHead(mediaMetadata, cfg.AbsBasePath, encryptionKey)
+		if headErr != nil {
+			logger.WithError(headErr).Error("Failed to read stored file to check its type")
+			return jsonerror.InternalServerError()
+		}
+		if dangerousType := sniffDangerousType(head); dangerousType != "" && cfg.IsBlockedUploadType(dangerousType) {
+			logger.WithField("SniffedType", dangerousType).Warn("Rejecting clone of a blocked type")
+			return util.JSONResponse{
+				Code: http.StatusUnsupportedMediaType,
+				JSON: jsonerror.UnsupportedMediaType(fmt.Sprintf("Failed to clone: files of type %s may not be uploaded", dangerousType)),
+			}
+		}
+	}
+
+	thumbnails, err := db.GetThumbnails(ctx, mediaID, origin)
+	if err != nil {
+		logger.WithError(err).Error("Failed to query thumbnails")
+		return jsonerror.InternalServerError()
+	}
+
+	r := &uploadRequest{
+		MediaMetadata: &types.MediaMetadata{
+			Origin:            cfg.Matrix.ServerName,
+			ContentType:       mediaMetadata.ContentType,
+			FileSizeBytes:     mediaMetadata.FileSizeBytes,
+			CreationTimestamp: types.UnixMs(time.Now().UnixNano() / 1000000),
+			UploadName:        mediaMetadata.UploadName,
+			Base64Hash:        mediaMetadata.Base64Hash,
+			UserID:            types.MatrixUserID(dev.UserID),
+			Encryption:        mediaMetadata.Encryption,
+			Disposition:       mediaMetadata.Disposition,
+		},
+		Logger: logger,
+	}
+	if r.MediaMetadata.MediaID, err = r.generateMediaID(ctx, cfg, db); err != nil {
+		logger.WithError(err).Error("Failed to generate media ID for clone")
+		return jsonerror.InternalServerError()
+	}
+	if err = db.StoreMediaMetadata(ctx, r.MediaMetadata); err != nil {
+		logger.WithError(err).Error("Failed to store metadata for clone")
+		return jsonerror.InternalServerError()
+	}
+	// The thumbnails are stored alongside the file, so they can be served for the clone
+	// without being generated again.
+	for _, thumbnail := range thumbnails {
+		thumbnailMetadata := *thumbnail.MediaMetadata
+		thumbnailMetadata.MediaID = r.MediaMetadata.MediaID
+		thumbnailMetadata.Origin = r.MediaMetadata.Origin
+		if err = db.StoreThumbnail(ctx, &types.ThumbnailMetadata{
+			MediaMetadata: &thumbnailMetadata,
+			ThumbnailSize: thumbnail.ThumbnailSize,
+		}); err != nil {
+			// The thumbnail is generated again if it's asked for.
+			logger.WithError(err).Warn("Failed to store thumbnail metadata for clone")
+		}
+	}
+	logger.WithFields(log.Fields{
+		"CloneMediaID": r.MediaMetadata.MediaID,
+		"UserID":       dev.UserID,
+	}).Info("Cloned media")
+
+	contentURI := fmt.Sprintf("mxc://%s/%s", cfg.Matrix.ServerName, r.MediaMetadata.MediaID)
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: uploadResponse{
+			ContentURI:  contentURI,
+			DownloadURL: cdnDownloadURL(cfg, contentURI),
+		},
+	}
+}
@@ -0,0 +1,131 @@
+package routing
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/dendrite/internal/config"
+	"github.com/matrix-org/dendrite/mediaapi/types"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+)
+
+func TestCloneMedia(t *testing.T) {
+	db, basePath, cleanup := newTestDatabase(t)
+	defer cleanup()
+	maxFileSizeBytes := config.FileSizeBytes(1024)
+	cfg := &config.MediaAPI{
+		Matrix:           &config.Global{ServerName: "localhost"},
+		AbsBasePath:      basePath,
+		MaxFileSizeBytes: &maxFileSizeBytes,
+	}
+	ctx := context.Background()
+
+	req := httptest.NewRequest(http.MethodPost, "/upload?filename=cat.txt", strings.NewReader("attachment"))
+	req.Header.Set("Content-Type", "text/plain")
+	res := Upload(req, cfg, &userapi.Device{UserID: "@alice:localhost"}, db, &types.ActiveThumbnailGeneration{
+		PathToResult: map[string]*types.ThumbnailGenerationResult{},
+	}, nil, nil)
+	if res.Code != http.StatusOK {
+		t.Fatalf("upload: got status %d, want %d", res.Code, http.StatusOK)
+	}
+	mediaID := types.MediaID(strings.TrimPrefix(res.JSON.(uploadResponse).ContentURI, "mxc://localhost/"))
+	original, err := db.GetMediaMetadata(ctx, mediaID, "localhost")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = db.StoreThumbnail(ctx, &types.ThumbnailMetadata{
+		MediaMetadata: &types.MediaMetadata{MediaID: mediaID, Origin: "localhost", ContentType: "image/png", FileSizeBytes: 5},
+		ThumbnailSize: types.ThumbnailSize{Width: 32, Height: 32, ResizeMethod: types.Crop},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	clone := func(mediaID types.MediaID) (int, types.MediaID) {
+		req := httptest.NewRequest(http.MethodPost, "/clone/localhost/"+string(mediaID), nil)
+		res := CloneMedia(req, cfg, &userapi.Device{UserID: "@bob:localhost"}, db, nil, "localhost", mediaID)
+		if res.Code != http.StatusOK {
+			return res.Code, ""
+		}
+		return res.Code, types.MediaID(strings.TrimPrefix(res.JSON.(uploadResponse).ContentURI, "mxc://localhost/"))
+	}
+	code, cloneID := clone(mediaID)
+	if code != http.StatusOK {
+		t.Fatalf("clone: got status %d, want %d", code, http.StatusOK)
+	}
+	if cloneID == mediaID {
+		t.Fatal("the clone has the same media ID as the original")
+	}
+	cloned, err := db.GetMediaMetadata(ctx, cloneID, "localhost")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cloned == nil || cloned.Base64Hash != original.Base64Hash || cloned.UserID != "@bob:localhost" ||
+		cloned.UploadName != original.UploadName || cloned.FileSizeBytes != original.FileSizeBytes {
+		t.Fatalf("got clone %+v of %+v, want the same file belonging to @bob:localhost", cloned, original)
+	}
+	thumbnails, err := db.GetThumbnails(ctx, cloneID, "localhost")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(thumbnails) != 1 {
+		t.Errorf("the clone has %d thumbnails, want 1", len(thumbnails))
+	}
+	if code, _ = clone("missing"); code != http.StatusNotFound {
+		t.Errorf("clone of unknown media: got status %d, want %d", code, http.StatusNotFound)
+	}
+
+	// Removing the original leaves the file for the clone, until that is removed too.
+	if _, err = purgeUserMedia(ctx, cfg, db, "@alice:localhost", false); err != nil {
+		t.Fatal(err)
+	}
+	if !fileExists(t, original.Base64Hash, basePath) {
+		t.Fatal("removing the original removed the file the clone refers to")
+	}
+	w := httptest.NewRecorder()
+	Download(
+		w, httptest.NewRequest(http.MethodGet, "/download/localhost/"+string(cloneID), nil),
+		"localhost", cloneID, cfg, db, nil,
+		&types.ActiveRemoteRequests{MXCToResult: map[string]*types.RemoteRequestResult{}},
+		&types.ActiveThumbnailGeneration{PathToResult: map[string]*types.ThumbnailGenerationResult{}},
+		nil, nil, newMediaAccessTracker(), NewUserTrafficTracker(), false, "",
+	)
+	if w.Code != http.StatusOK || w.Body.String() != "attachment" {
+		t.Errorf("download of the clone: got status %d and %q, want %d and the original's content", w.Code, w.Body.String(), http.StatusOK)
+	}
+	if _, err = purgeUserMedia(ctx, cfg, db, "@bob:localhost", false); err != nil {
+		t.Fatal(err)
+	}
+	if fileExists(t, original.Base64Hash, basePath) {
+		t.Error("the file is still there after the original and the clone were removed")
+	}
+}
+
+func TestCloneBlockedMedia(t *testing.T) {
+	db, basePath, cleanup := newTestDatabase(t)
+	defer cleanup()
+	cfg := &config.MediaAPI{
+		Matrix:             &config.Global{ServerName: "localhost"},
+		AbsBasePath:        basePath,
+		BlockedUploadTypes: []string{"text/html"},
+	}
+	// Media from other servers was never checked when it was fetched.
+	storeTestContent(t, db, basePath, "remote.example", "page", "text/plain", "<html><script>alert(1)</script>")
+	storeTestContent(t, db, basePath, "remote.example", "text", "text/plain", "just text")
+
+	for _, tt := range []struct {
+		mediaID  types.MediaID
+		wantCode int
+	}{
+		{"page", http.StatusUnsupportedMediaType},
+		{"text", http.StatusOK},
+	} {
+		req := httptest.NewRequest(http.MethodPost, "/clone/remote.example/"+string(tt.mediaID), nil)
+		res := CloneMedia(req, cfg, &userapi.Device{UserID: "@bob:localhost"}, db, nil, "remote.example", tt.mediaID)
+		if res.Code != tt.wantCode {
+			t.Errorf("clone of %s: got status %d, want %d", tt.mediaID, res.Code, tt.wantCode)
+		}
+	}
+}
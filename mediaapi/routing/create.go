@@ -0,0 +1,82 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/internal/config"
+	"github.com/matrix-org/dendrite/mediaapi/storage"
+	"github.com/matrix-org/dendrite/mediaapi/types"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/util"
+	log "github.com/sirupsen/logrus"
+)
+
+// createResponse defines the format of the JSON response
+// https://github.com/matrix-org/matrix-doc/pull/2246
+type createResponse struct {
+	ContentURI      string       `json:"content_uri"`
+	UnusedExpiresAt types.UnixMs `json:"unused_expires_at"`
+	// DownloadURL is where the media will be downloadable from through the CDN once it
+	// is uploaded, see uploadResponse.
+	DownloadURL string `json:"download_url,omitempty"`
+}
+
+// CreateMedia implements POST /create
+// This reserves a media ID which the user can refer to, e.g. in events, before the
+// content is uploaded with PUT /upload/{serverName}/{mediaId}.
+func CreateMedia(req *http.Request, cfg *config.MediaAPI, dev *userapi.Device, db storage.Database) util.JSONResponse {
+	r := &uploadRequest{
+		MediaMetadata: &types.MediaMetadata{
+			Origin: cfg.Matrix.ServerName,
+			UserID: types.MatrixUserID(dev.UserID),
+		},
+		Logger: util.GetLogger(req.Context()).WithFields(log.Fields{
+			"Origin":   cfg.Matrix.ServerName,
+			"ClientIP": requestClientIP(req),
+		}),
+	}
+	mediaID, err := r.generateMediaID(req.Context(), cfg, db)
+	if err != nil {
+		r.Logger.WithError(err).Error("Failed to generate media ID for reservation")
+		return jsonerror.InternalServerError()
+	}
+
+	reservation := &types.MediaReservation{
+		MediaID:          mediaID,
+		Origin:           cfg.Matrix.ServerName,
+		UserID:           types.MatrixUserID(dev.UserID),
+		ExpiresTimestamp: types.UnixMs(time.Now().Add(cfg.UnusedMediaIDLifetime).UnixNano() / 1000000),
+	}
+	if err = db.StoreMediaReservation(req.Context(), reservation); err != nil {
+		r.Logger.WithError(err).Error("Failed to store media reservation")
+		return jsonerror.InternalServerError()
+	}
+
+	r.Logger.WithField("media_id", mediaID).Info("Reserved media ID")
+	contentURI := fmt.Sprintf("mxc://%s/%s", cfg.Matrix.ServerName, mediaID)
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: createResponse{
+			ContentURI:      contentURI,
+			UnusedExpiresAt: reservation.ExpiresTimestamp,
+			DownloadURL:     cdnDownloadURL(cfg, contentURI),
+		},
+	}
+}
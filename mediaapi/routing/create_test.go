@@ -0,0 +1,73 @@
+package routing
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/internal/config"
+	"github.com/matrix-org/dendrite/mediaapi/types"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+)
+
+func TestCreateAndUploadReserved(t *testing.T) {
+	db, basePath, cleanup := newTestDatabase(t)
+	defer cleanup()
+	maxFileSizeBytes := config.FileSizeBytes(1024)
+	cfg := &config.MediaAPI{
+		Matrix:                &config.Global{ServerName: "localhost"},
+		AbsBasePath:           basePath,
+		MaxFileSizeBytes:      &maxFileSizeBytes,
+		UnusedMediaIDLifetime: time.Hour,
+	}
+	alice := &userapi.Device{UserID: "@alice:localhost"}
+	bob := &userapi.Device{UserID: "@bob:localhost"}
+	activeThumbnailGeneration := &types.ActiveThumbnailGeneration{
+		PathToResult: map[string]*types.ThumbnailGenerationResult{},
+	}
+
+	before := types.UnixMs(time.Now().Add(cfg.UnusedMediaIDLifetime).UnixNano() / 1000000)
+	res := CreateMedia(httptest.NewRequest(http.MethodPost, "/create", nil), cfg, alice, db)
+	if res.Code != http.StatusOK {
+		t.Fatalf("create: got status %d, want %d", res.Code, http.StatusOK)
+	}
+	created := res.JSON.(createResponse)
+	if after := types.UnixMs(time.Now().Add(cfg.UnusedMediaIDLifetime).UnixNano() / 1000000); created.UnusedExpiresAt < before || created.UnusedExpiresAt > after {
+		t.Errorf("reservation expires at %d, want between %d and %d", created.UnusedExpiresAt, before, after)
+	}
+	mediaID := types.MediaID(strings.TrimPrefix(created.ContentURI, "mxc://localhost/"))
+
+	upload := func(dev *userapi.Device, mediaID types.MediaID) int {
+		req := httptest.NewRequest(http.MethodPut, "/upload", strings.NewReader("data"))
+		req.Header.Set("Content-Type", "text/plain")
+		return UploadReserved(req, cfg, dev, db, activeThumbnailGeneration, nil, nil, "localhost", mediaID).Code
+	}
+	if code := upload(alice, "notreserved"); code != http.StatusNotFound {
+		t.Errorf("upload to an unreserved media ID: got status %d, want %d", code, http.StatusNotFound)
+	}
+	if code := upload(bob, mediaID); code != http.StatusForbidden {
+		t.Errorf("upload to another user's media ID: got status %d, want %d", code, http.StatusForbidden)
+	}
+	if code := upload(alice, mediaID); code != http.StatusOK {
+		t.Fatalf("upload to a reserved media ID: got status %d, want %d", code, http.StatusOK)
+	}
+	if code := upload(alice, mediaID); code != http.StatusConflict {
+		t.Errorf("upload to a media ID which already has content: got status %d, want %d", code, http.StatusConflict)
+	}
+
+	// Reservations which have expired can't be uploaded to.
+	if err := db.StoreMediaReservation(context.Background(), &types.MediaReservation{
+		MediaID:          "expired",
+		Origin:           "localhost",
+		UserID:           types.MatrixUserID(alice.UserID),
+		ExpiresTimestamp: types.UnixMs(time.Now().Add(-time.Minute).UnixNano() / 1000000),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if code := upload(alice, "expired"); code != http.StatusNotFound {
+		t.Errorf("upload to an expired reservation: got status %d, want %d", code, http.StatusNotFound)
+	}
+}
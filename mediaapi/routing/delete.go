@@ -0,0 +1,204 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/internal/config"
+	"github.com/matrix-org/dendrite/mediaapi/storage"
+	"github.com/matrix-org/dendrite/mediaapi/types"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+	log "github.com/sirupsen/logrus"
+)
+
+// deleteMediaResponse defines the format of the JSON response to POST /admin/delete
+type deleteMediaResponse struct {
+	// Whether the media was only marked deleted, so that it can be undeleted until
+	// its files are removed at RemoveTs in UNIX epoch ms.
+	SoftDeleted bool         `json:"soft_deleted"`
+	RemoveTs    types.UnixMs `json:"remove_ts,omitempty"`
+}
+
+// DeleteMedia implements POST /admin/delete/{serverName}/{mediaId}
+// This stops the media being served. If soft delete is enabled, local media is only
+// marked deleted, and its files are kept until the grace period is over so that it
+// can be restored with POST /admin/undelete. Otherwise, and for remote media which
+// can be fetched again, it is removed straight away along with its file unless other
+// media uses the same file.
+func DeleteMedia(
+	req *http.Request, cfg *config.MediaAPI, db storage.Database,
+	origin gomatrixserverlib.ServerName, mediaID types.MediaID,
+) util.JSONResponse {
+	ctx := req.Context()
+	logger := util.GetLogger(ctx).WithFields(log.Fields{
+		"Origin":  origin,
+		"MediaID": mediaID,
+	})
+	mediaMetadata, err := db.GetMediaMetadata(ctx, mediaID, origin)
+	if err != nil {
+		logger.WithError(err).Error("Failed to query media metadata")
+		return jsonerror.InternalServerError()
+	}
+	if mediaMetadata == nil {
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: jsonerror.NotFound("File not found"),
+		}
+	}
+
+	if cfg.SoftDelete.Enabled && origin == cfg.Matrix.ServerName {
+		now := time.Now()
+		if err = db.SoftDeleteMedia(ctx, mediaID, origin, types.UnixMs(now.UnixNano()/1000000)); err != nil {
+			logger.WithError(err).Error("Failed to mark media deleted")
+			return jsonerror.InternalServerError()
+		}
+		logger.Info("Soft deleted media")
+		return util.JSONResponse{
+			Code: http.StatusOK,
+			JSON: deleteMediaResponse{
+				SoftDeleted: true,
+				RemoveTs:    types.UnixMs(now.Add(cfg.SoftDelete.GracePeriod).UnixNano() / 1000000),
+			},
+		}
+	}
+
+	if err = deleteMediaNow(ctx, cfg, db, mediaMetadata); err != nil {
+		logger.WithError(err).Error("Failed to delete media")
+		return jsonerror.InternalServerError()
+	}
+	logger.Info("Deleted media")
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: deleteMediaResponse{},
+	}
+}
+
+// UndeleteMedia implements POST /admin/undelete/{serverName}/{mediaId}
+// This restores media which was soft deleted, so that it is served again. Media whose
+// grace period is over may already have been removed, in which case it is not found.
+func UndeleteMedia(
+	req *http.Request, db storage.Database,
+	origin gomatrixserverlib.ServerName, mediaID types.MediaID,
+) util.JSONResponse {
+	ctx := req.Context()
+	logger := util.GetLogger(ctx).WithFields(log.Fields{
+		"Origin":  origin,
+		"MediaID": mediaID,
+	})
+	undeleted, err := db.UndeleteMedia(ctx, mediaID, origin)
+	if err != nil {
+		logger.WithError(err).Error("Failed to undelete media")
+		return jsonerror.InternalServerError()
+	}
+	if !undeleted {
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: jsonerror.NotFound("No deleted media with this ID"),
+		}
+	}
+	logger.Info("Undeleted media")
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: struct{}{},
+	}
+}
+
+// deleteMediaNow removes the metadata of the media, and its file with its thumbnails
+// if no other media uses it. The file is removed first, so that if that fails the
+// media can still be found to try again.
+func deleteMediaNow(
+	ctx context.Context, cfg *config.MediaAPI, db storage.Database, mediaMetadata *types.MediaMetadata,
+) error {
+	defer fileLocks.lock(mediaMetadata.Base64Hash)()
+	count, err := db.CountMediaByHash(ctx, mediaMetadata.Base64Hash)
+	if err != nil {
+		return err
+	}
+	if count <= 1 {
+		var removed bool
+		removed, _, err = removeMediaFiles(mediaMetadata.Base64Hash, cfg.AbsBasePath, false)
+		if err != nil {
+			return err
+		}
+		if removed {
+			addStoredBytes(ctx, db, util.GetLogger(ctx), -int64(mediaMetadata.FileSizeBytes))
+		}
+	}
+	return db.DeleteMedia(ctx, mediaMetadata.MediaID, mediaMetadata.Origin)
+}
+
+// RemoveDeletedMedia removes the media which was soft deleted longer than the grace
+// period before now, along with its files unless other media uses them, in batches.
+// Returns how many media were removed.
+func RemoveDeletedMedia(
+	ctx context.Context, cfg *config.MediaAPI, db storage.Database, now time.Time,
+) (int, error) {
+	deletedBefore := types.UnixMs(now.Add(-cfg.SoftDelete.GracePeriod).UnixNano() / 1000000)
+	count := 0
+	for {
+		batch, err := db.GetMediaDeletedBefore(ctx, deletedBefore, purgeBatchSize)
+		if err != nil {
+			return count, err
+		}
+		for _, mediaMetadata := range batch {
+			var removed bool
+			removed, err = removeDeletedMedia(ctx, cfg, db, mediaMetadata, deletedBefore)
+			if err != nil {
+				return count, err
+			}
+			if removed {
+				count++
+			}
+		}
+		if len(batch) < purgeBatchSize {
+			return count, nil
+		}
+	}
+}
+
+// removeDeletedMedia removes the metadata of media which was soft deleted before
+// deletedBefore, and then its file if no other media uses it. Nothing is removed if
+// the media was undeleted in the meantime. If removing the file fails it is left for
+// reconciling to clean up, as the media is already gone.
+func removeDeletedMedia(
+	ctx context.Context, cfg *config.MediaAPI, db storage.Database,
+	mediaMetadata *types.MediaMetadata, deletedBefore types.UnixMs,
+) (bool, error) {
+	defer fileLocks.lock(mediaMetadata.Base64Hash)()
+	deleted, err := db.DeleteDeletedMedia(ctx, mediaMetadata.MediaID, mediaMetadata.Origin, deletedBefore)
+	if err != nil || !deleted {
+		return false, err
+	}
+	count, err := db.CountMediaByHash(ctx, mediaMetadata.Base64Hash)
+	if err != nil {
+		return true, err
+	}
+	if count == 0 {
+		var removed bool
+		removed, _, err = removeMediaFiles(mediaMetadata.Base64Hash, cfg.AbsBasePath, false)
+		if err != nil {
+			return true, err
+		}
+		if removed {
+			addStoredBytes(ctx, db, util.GetLogger(ctx), -int64(mediaMetadata.FileSizeBytes))
+		}
+	}
+	return true, nil
+}
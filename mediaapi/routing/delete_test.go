@@ -0,0 +1,172 @@
+package routing
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/internal/config"
+	"github.com/matrix-org/dendrite/mediaapi/types"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+func TestSoftDeleteMedia(t *testing.T) {
+	db, basePath, cleanup := newTestDatabase(t)
+	defer cleanup()
+	cfg := &config.MediaAPI{
+		Matrix:      &config.Global{ServerName: "localhost"},
+		AbsBasePath: basePath,
+		SoftDelete:  config.SoftDelete{Enabled: true, GracePeriod: time.Hour},
+	}
+	storeTestMedia(t, db, basePath, "alice1", "@alice:localhost", "aliceonlyhash")
+	storeTestMedia(t, db, basePath, "alice2", "@alice:localhost", "sharedhash")
+	storeTestMedia(t, db, basePath, "bob1", "@bob:localhost", "sharedhash")
+
+	ctx := context.Background()
+	deleteMedia := func(mediaID types.MediaID) util.JSONResponse {
+		req := httptest.NewRequest(http.MethodPost, "/_matrix/media/unstable/admin/delete/localhost/"+string(mediaID), nil)
+		return DeleteMedia(req, cfg, db, "localhost", mediaID)
+	}
+	undeleteMedia := func(mediaID types.MediaID) util.JSONResponse {
+		req := httptest.NewRequest(http.MethodPost, "/_matrix/media/unstable/admin/undelete/localhost/"+string(mediaID), nil)
+		return UndeleteMedia(req, db, "localhost", mediaID)
+	}
+	served := func(mediaID types.MediaID) bool {
+		m, err := db.GetMediaMetadata(ctx, mediaID, "localhost")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return m != nil
+	}
+
+	before := types.UnixMs(time.Now().Add(cfg.SoftDelete.GracePeriod).UnixNano() / 1000000)
+	res := deleteMedia("alice1")
+	if res.Code != http.StatusOK {
+		t.Fatalf("delete: got status %d, want %d", res.Code, http.StatusOK)
+	}
+	if r := res.JSON.(deleteMediaResponse); !r.SoftDeleted || r.RemoveTs < before {
+		t.Errorf("delete: got %+v, want it soft deleted until after %d", r, before)
+	}
+	if served("alice1") {
+		t.Error("soft deleted media is still served")
+	}
+	if !fileExists(t, "aliceonlyhash", basePath) {
+		t.Error("the file of soft deleted media was removed")
+	}
+	if media, _ := db.GetMediaByUser(ctx, "@alice:localhost", "localhost", "", 10); len(media) != 1 || media[0].MediaID != "alice2" {
+		t.Errorf("got alice's media %+v, want only alice2", media)
+	}
+	if res = deleteMedia("alice1"); res.Code != http.StatusNotFound {
+		t.Errorf("deleting again: got status %d, want %d", res.Code, http.StatusNotFound)
+	}
+
+	if res = undeleteMedia("alice1"); res.Code != http.StatusOK {
+		t.Fatalf("undelete: got status %d, want %d", res.Code, http.StatusOK)
+	}
+	if !served("alice1") {
+		t.Error("undeleted media isn't served")
+	}
+	if res = undeleteMedia("alice1"); res.Code != http.StatusNotFound {
+		t.Errorf("undeleting media which isn't deleted: got status %d, want %d", res.Code, http.StatusNotFound)
+	}
+
+	deleteMedia("alice1")
+	deleteMedia("alice2")
+	// Nothing is removed until the grace period is over.
+	removed, err := RemoveDeletedMedia(ctx, cfg, db, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed != 0 || !fileExists(t, "aliceonlyhash", basePath) {
+		t.Errorf("during the grace period: got %d removed, want 0", removed)
+	}
+
+	removed, err = RemoveDeletedMedia(ctx, cfg, db, time.Now().Add(cfg.SoftDelete.GracePeriod+time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed != 2 {
+		t.Errorf("after the grace period: got %d removed, want 2", removed)
+	}
+	if fileExists(t, "aliceonlyhash", basePath) {
+		t.Error("the file of deleted media was not removed")
+	}
+	if !fileExists(t, "sharedhash", basePath) {
+		t.Error("the file of deleted media which bob also uses was removed")
+	}
+	if thumbnails, _ := db.GetThumbnails(ctx, "alice1", "localhost"); len(thumbnails) != 0 {
+		t.Error("the thumbnails of deleted media were not removed")
+	}
+	if res = undeleteMedia("alice1"); res.Code != http.StatusNotFound {
+		t.Errorf("undeleting removed media: got status %d, want %d", res.Code, http.StatusNotFound)
+	}
+	if !served("bob1") {
+		t.Error("bob's media was removed")
+	}
+}
+
+func TestDeleteMediaWithoutSoftDelete(t *testing.T) {
+	db, basePath, cleanup := newTestDatabase(t)
+	defer cleanup()
+	cfg := &config.MediaAPI{
+		Matrix:      &config.Global{ServerName: "localhost"},
+		AbsBasePath: basePath,
+	}
+	storeTestMedia(t, db, basePath, "alice1", "@alice:localhost", "aliceonlyhash")
+	storeTestMedia(t, db, basePath, "alice2", "@alice:localhost", "sharedhash")
+	storeTestMedia(t, db, basePath, "bob1", "@bob:localhost", "sharedhash")
+
+	ctx := context.Background()
+	for _, tt := range []struct {
+		mediaID       types.MediaID
+		hash          types.Base64Hash
+		wantFileAfter bool
+	}{
+		{"alice1", "aliceonlyhash", false},
+		{"alice2", "sharedhash", true},
+	} {
+		req := httptest.NewRequest(http.MethodPost, "/_matrix/media/unstable/admin/delete/localhost/"+string(tt.mediaID), nil)
+		res := DeleteMedia(req, cfg, db, "localhost", tt.mediaID)
+		if res.Code != http.StatusOK || res.JSON.(deleteMediaResponse).SoftDeleted {
+			t.Errorf("delete %s: got status %d %+v, want %d and not soft deleted", tt.mediaID, res.Code, res.JSON, http.StatusOK)
+		}
+		if m, _ := db.GetMediaMetadata(ctx, tt.mediaID, "localhost"); m != nil {
+			t.Errorf("metadata for %s was not removed", tt.mediaID)
+		}
+		if fileExists(t, tt.hash, basePath) != tt.wantFileAfter {
+			t.Errorf("delete %s: got file kept %v, want %v", tt.mediaID, !tt.wantFileAfter, tt.wantFileAfter)
+		}
+		req = httptest.NewRequest(http.MethodPost, "/_matrix/media/unstable/admin/undelete/localhost/"+string(tt.mediaID), nil)
+		if res = UndeleteMedia(req, db, "localhost", tt.mediaID); res.Code != http.StatusNotFound {
+			t.Errorf("undelete %s: got status %d, want %d", tt.mediaID, res.Code, http.StatusNotFound)
+		}
+	}
+}
+
+func TestSoftDeleteRemoteMedia(t *testing.T) {
+	db, basePath, cleanup := newTestDatabase(t)
+	defer cleanup()
+	cfg := &config.MediaAPI{
+		Matrix:      &config.Global{ServerName: "localhost"},
+		AbsBasePath: basePath,
+		SoftDelete:  config.SoftDelete{Enabled: true, GracePeriod: time.Hour},
+	}
+	storeTestContent(t, db, basePath, "remote.example.com", "remote1", "text/plain", "cached")
+
+	// Remote media can be fetched again, so it is removed straight away.
+	var origin gomatrixserverlib.ServerName = "remote.example.com"
+	req := httptest.NewRequest(http.MethodPost, "/_matrix/media/unstable/admin/delete/remote.example.com/remote1", nil)
+	res := DeleteMedia(req, cfg, db, origin, "remote1")
+	if res.Code != http.StatusOK || res.JSON.(deleteMediaResponse).SoftDeleted {
+		t.Errorf("got status %d %+v, want %d and not soft deleted", res.Code, res.JSON, http.StatusOK)
+	}
+	if fileExists(t, "remote.example.comremote1", basePath) {
+		t.Error("the file of deleted remote media was not removed")
+	}
+	if removed, err := RemoveDeletedMedia(context.Background(), cfg, db, time.Now().Add(time.Hour*2)); err != nil || removed != 0 {
+		t.Errorf("got %d deleted media removed later (%v), want 0", removed, err)
+	}
+}
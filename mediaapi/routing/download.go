@@ -15,24 +15,26 @@
 package routing
 
 import (
+	"bytes"
+	"compress/gzip"
 	"context"
 	"encoding/json"
 	"fmt"
 	"io"
-	"mime"
 	"net/http"
 	"net/url"
-	"os"
 	"path/filepath"
 	"regexp"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 	"unicode"
 
 	"github.com/matrix-org/dendrite/clientapi/jsonerror"
 	"github.com/matrix-org/dendrite/internal/config"
 	"github.com/matrix-org/dendrite/mediaapi/fileutils"
+	"github.com/matrix-org/dendrite/mediaapi/sanitizer"
 	"github.com/matrix-org/dendrite/mediaapi/storage"
 	"github.com/matrix-org/dendrite/mediaapi/thumbnailer"
 	"github.com/matrix-org/dendrite/mediaapi/types"
@@ -51,6 +53,47 @@ var mediaIDRegex = regexp.MustCompile("^[" + mediaIDCharacters + "]+$")
 var rfc2183 = regexp.MustCompile(`filename\=utf-8\"(.*)\"`)
 var rfc6266 = regexp.MustCompile(`filename\*\=utf-8\'\'(.*)`)
 
+// errNotYetUploaded is returned when the requested media ID was reserved with /create
+// but the content has not been uploaded yet.
+var errNotYetUploaded = errors.New("media has not been uploaded yet")
+
+// errThumbnailNotFound is returned when a thumbnail couldn't be generated and the
+// server is configured to respond as if there were no thumbnail.
+var errThumbnailNotFound = errors.New("thumbnail could not be generated")
+
+// errRemoteOriginNotAllowed is returned when remote media isn't cached and the server
+// isn't configured to fetch media from its origin, or its origin resolves to a blocked
+// address.
+var errRemoteOriginNotAllowed = errors.New("media is not fetched from this server")
+
+// errRemoteNotFound is returned when the remote server says it doesn't have the media.
+var errRemoteNotFound = errors.New("remote server does not have the media")
+
+// retryableError is returned when fetching remote media failed in a way which may not
+// happen again, e.g. a timeout or a server error, so that the fetch can be retried.
+type retryableError struct {
+	err error
+}
+
+func (e *retryableError) Error() string {
+	return e.err.Error()
+}
+
+func isRetryable(err error) bool {
+	var retryable *retryableError
+	return errors.As(err, &retryable)
+}
+
+// thumbnailGenerationError is returned when generating a thumbnail failed, as opposed
+// to failing to look up or read a thumbnail which already exists.
+type thumbnailGenerationError struct {
+	err error
+}
+
+func (e *thumbnailGenerationError) Error() string {
+	return "error creating thumbnail: " + e.err.Error()
+}
+
 // downloadRequest metadata included in or derivable from a download or thumbnail request
 // https://matrix.org/docs/spec/client_server/r0.2.0.html#get-matrix-media-r0-download-servername-mediaid
 // http://matrix.org/docs/spec/client_server/r0.2.0.html#get-matrix-media-r0-thumbnail-servername-mediaid
@@ -60,14 +103,36 @@ type downloadRequest struct {
 	ThumbnailSize      types.ThumbnailSize
 	Logger             *log.Entry
 	DownloadFilename   string
+	// The time from the If-Modified-Since request header, if any
+	IfModifiedSince time.Time
+	// The entity tags from the If-None-Match request header, if any
+	IfNoneMatch string
+	// Whether remote media which isn't cached may be fetched from its origin
+	AllowRemote bool
+	// Whether the response may be gzipped, from the Accept-Encoding request header
+	AcceptsGzip bool
+	// Whether the media must be served as an attachment, from the download query
+	// parameter, so that browsers save it instead of displaying it
+	ForceAttachment bool
+	// Whether only the headers are sent, for a HEAD request
+	HeadOnly bool
 }
 
-// Download implements GET /download and GET /thumbnail
+// Download implements GET /download and GET /thumbnail, and HEAD for each of them,
+// which responds with the same headers but no body. A HEAD request for a thumbnail
+// never generates one, so is answered with the best which already exists.
 // Files from this server (i.e. origin == cfg.ServerName) are served directly
 // Files from remote servers (i.e. origin != cfg.ServerName) are cached locally.
 // If they are present in the cache, they are served directly.
 // If they are not present in the cache, they are obtained from the remote server and
-// simultaneously served back to the client and written into the cache.
+// simultaneously served back to the client and written into the cache, unless the
+// allow_remote query parameter is "false", in which case they are not found.
+// If the download query parameter is "true" then downloads are always served as
+// attachments, even if browsers would otherwise be allowed to display them.
+// Media is only ever stored on local disk, so there is nowhere to redirect to: the
+// allow_redirect query parameter is accepted, but the media is always served directly.
+// The origin and media ID are normalized first, so media is found however the server
+// name is capitalised, see normalizeOrigin.
 func Download(
 	w http.ResponseWriter,
 	req *http.Request,
@@ -78,6 +143,10 @@ func Download(
 	client *gomatrixserverlib.Client,
 	activeRemoteRequests *types.ActiveRemoteRequests,
 	activeThumbnailGeneration *types.ActiveThumbnailGeneration,
+	thumbnailPregenerator *thumbnailPregenerator,
+	encryptionKey *fileutils.EncryptionKey,
+	accessTracker *mediaAccessTracker,
+	trafficTracker *UserTrafficTracker,
 	isThumbnailRequest bool,
 	customFilename string,
 ) {
@@ -88,10 +157,27 @@ func Download(
 		},
 		IsThumbnailRequest: isThumbnailRequest,
 		Logger: util.GetLogger(req.Context()).WithFields(log.Fields{
-			"Origin":  origin,
-			"MediaID": mediaID,
+			"Origin":   origin,
+			"MediaID":  mediaID,
+			"ClientIP": requestClientIP(req),
 		}),
 		DownloadFilename: customFilename,
+		AllowRemote:      strings.ToLower(req.URL.Query().Get("allow_remote")) != "false",
+		ForceAttachment:  !isThumbnailRequest && strings.ToLower(req.URL.Query().Get("download")) == "true",
+		HeadOnly:         req.Method == http.MethodHead,
+	}
+
+	// If-Modified-Since is ignored when there is an If-None-Match, as the entity tag
+	// says more precisely whether the client has what would be sent.
+	// https://tools.ietf.org/html/rfc7232#section-3.3
+	dReq.IfNoneMatch = req.Header.Get("If-None-Match")
+	if ifModifiedSince, err := http.ParseTime(req.Header.Get("If-Modified-Since")); err == nil && dReq.IfNoneMatch == "" {
+		dReq.IfModifiedSince = ifModifiedSince
+	}
+	// A range of the media would have to be a range of the gzipped response, so the
+	// media is sent as it is instead.
+	if req.Header.Get("Range") == "" {
+		dReq.AcceptsGzip = acceptsGzip(req.Header.Get("Accept-Encoding"))
 	}
 
 	if dReq.IsThumbnailRequest {
@@ -107,24 +193,64 @@ func Download(
 			Width:        width,
 			Height:       height,
 			ResizeMethod: strings.ToLower(req.FormValue("method")),
+			Background:   req.FormValue("background"),
 		}
 		dReq.Logger.WithFields(log.Fields{
 			"RequestedWidth":        dReq.ThumbnailSize.Width,
 			"RequestedHeight":       dReq.ThumbnailSize.Height,
 			"RequestedResizeMethod": dReq.ThumbnailSize.ResizeMethod,
+			"RequestedBackground":   dReq.ThumbnailSize.Background,
 		})
 	}
 
 	// request validation
-	if resErr := dReq.Validate(); resErr != nil {
+	if resErr := dReq.Validate(cfg); resErr != nil {
 		dReq.jsonErrorResponse(w, *resErr)
 		return
 	}
+	origin = normalizeOrigin(cfg, origin)
+	mediaID = normalizeMediaID(cfg, origin, mediaID)
+	dReq.MediaMetadata.Origin, dReq.MediaMetadata.MediaID = origin, mediaID
 
+	counter := &countingResponseWriter{ResponseWriter: w}
 	metadata, err := dReq.doDownload(
-		req.Context(), w, cfg, db, client,
-		activeRemoteRequests, activeThumbnailGeneration,
+		req.Context(), counter, cfg, db, client,
+		activeRemoteRequests, activeThumbnailGeneration, thumbnailPregenerator, encryptionKey,
 	)
+	// Whatever was sent counts, even if the download failed part way through.
+	if counter.written > 0 {
+		trafficTracker.record(dReq.MediaMetadata.UserID, types.UnixMs(time.Now().UnixNano()/1000000), counter.written)
+	}
+	if err == errNotYetUploaded {
+		// The client can retry later once the content has been uploaded
+		dReq.jsonErrorResponse(w, util.JSONResponse{
+			Code: http.StatusGatewayTimeout,
+			JSON: jsonerror.NotYetUploaded("Media has not been uploaded yet"),
+		})
+		return
+	}
+	if errors.Is(err, errRemoteOriginNotAllowed) {
+		dReq.jsonErrorResponse(w, util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden("Media is not fetched from " + string(origin)),
+		})
+		return
+	}
+	if err == errThumbnailNotFound {
+		dReq.jsonErrorResponse(w, util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: jsonerror.NotFound("Thumbnail could not be generated"),
+		})
+		return
+	}
+	if isRetryable(err) {
+		// The remote server couldn't be reached or failed, so may have the media.
+		dReq.jsonErrorResponse(w, util.JSONResponse{
+			Code: http.StatusBadGateway,
+			JSON: jsonerror.UpstreamFailed("Failed to fetch the media from " + string(origin)),
+		})
+		return
+	}
 	if err != nil {
 		// TODO: Handle the fact we might have started writing the response
 		dReq.jsonErrorResponse(w, util.JSONResponse{
@@ -142,6 +268,10 @@ func Download(
 		return
 	}
 
+	// Record the access against the media that was asked for, so that requests for
+	// thumbnails also keep the original media from looking unused. Only downloads of
+	// the media itself are counted, and a HEAD request doesn't download anything.
+	accessTracker.record(mediaID, origin, types.UnixMs(time.Now().UnixNano()/1000000), !isThumbnailRequest && !dReq.HeadOnly)
 }
 
 func (r *downloadRequest) jsonErrorResponse(w http.ResponseWriter, res util.JSONResponse) {
@@ -163,19 +293,21 @@ func (r *downloadRequest) jsonErrorResponse(w http.ResponseWriter, res util.JSON
 }
 
 // Validate validates the downloadRequest fields
-func (r *downloadRequest) Validate() *util.JSONResponse {
+func (r *downloadRequest) Validate(cfg *config.MediaAPI) *util.JSONResponse {
+	// Both of these come from the URL path, so must be checked strictly before they
+	// are used for anything which could end up touching the filesystem.
 	if !mediaIDRegex.MatchString(string(r.MediaMetadata.MediaID)) {
 		return &util.JSONResponse{
-			Code: http.StatusNotFound,
-			JSON: jsonerror.NotFound(fmt.Sprintf("mediaId must be a non-empty string using only characters in %v", mediaIDCharacters)),
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue(fmt.Sprintf("mediaId must be a non-empty string using only characters in %v", mediaIDCharacters)),
 		}
 	}
-	// Note: the origin will be validated either by comparison to the configured server name of this homeserver
-	// or by a DNS SRV record lookup when creating a request for remote files
-	if r.MediaMetadata.Origin == "" {
+	// Note: a valid origin is then checked either by comparison to the configured server name of this
+	// homeserver or by a DNS SRV record lookup when creating a request for remote files
+	if !config.IsValidServerName(r.MediaMetadata.Origin) {
 		return &util.JSONResponse{
-			Code: http.StatusNotFound,
-			JSON: jsonerror.NotFound("serverName must be a non-empty string"),
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue("serverName must be a valid server name"),
 		}
 	}
 
@@ -183,19 +315,47 @@ func (r *downloadRequest) Validate() *util.JSONResponse {
 		if r.ThumbnailSize.Width <= 0 || r.ThumbnailSize.Height <= 0 {
 			return &util.JSONResponse{
 				Code: http.StatusBadRequest,
-				JSON: jsonerror.Unknown("width and height must be greater than 0"),
+				JSON: jsonerror.InvalidArgumentValue("width and height must be greater than 0"),
 			}
 		}
-		// Default method to scale if not set
-		if r.ThumbnailSize.ResizeMethod == "" {
-			r.ThumbnailSize.ResizeMethod = types.Scale
+		if !cfg.IsAllowedThumbnailSize(r.ThumbnailSize.Width, r.ThumbnailSize.Height) {
+			return &util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.InvalidArgumentValue(fmt.Sprintf(
+					"width and height must be at most %d and %d", cfg.MaxThumbnailWidth, cfg.MaxThumbnailHeight,
+				)),
+			}
 		}
-		if r.ThumbnailSize.ResizeMethod != types.Crop && r.ThumbnailSize.ResizeMethod != types.Scale {
+		// If no method is given then the default for the content type is used once
+		// the media has been found, see respondFromLocalFile.
+		switch r.ThumbnailSize.ResizeMethod {
+		case "", types.Crop, types.Scale, types.Pad:
+		default:
 			return &util.JSONResponse{
 				Code: http.StatusBadRequest,
-				JSON: jsonerror.Unknown("method must be one of crop or scale"),
+				JSON: jsonerror.InvalidArgumentValue("method must be one of crop, scale or pad"),
 			}
 		}
+		if r.ThumbnailSize.Background != "" {
+			// A background is only asked for with padded thumbnails, so it implies pad.
+			if r.ThumbnailSize.ResizeMethod != "" && r.ThumbnailSize.ResizeMethod != types.Pad {
+				return &util.JSONResponse{
+					Code: http.StatusBadRequest,
+					JSON: jsonerror.InvalidArgumentValue("background is only valid with method pad"),
+				}
+			}
+			r.ThumbnailSize.ResizeMethod = types.Pad
+		}
+		if r.ThumbnailSize.ResizeMethod == types.Pad {
+			background, err := config.ParseThumbnailBackground(r.ThumbnailSize.Background)
+			if err != nil {
+				return &util.JSONResponse{
+					Code: http.StatusBadRequest,
+					JSON: jsonerror.InvalidArgumentValue("background must be transparent or a colour in the form rrggbb or rrggbbaa"),
+				}
+			}
+			r.ThumbnailSize.Background = background
+		}
 	}
 	return nil
 }
@@ -208,6 +368,8 @@ func (r *downloadRequest) doDownload(
 	client *gomatrixserverlib.Client,
 	activeRemoteRequests *types.ActiveRemoteRequests,
 	activeThumbnailGeneration *types.ActiveThumbnailGeneration,
+	thumbnailPregenerator *thumbnailPregenerator,
+	encryptionKey *fileutils.EncryptionKey,
 ) (*types.MediaMetadata, error) {
 	// check if we have a record of the media in our database
 	mediaMetadata, err := db.GetMediaMetadata(
@@ -218,13 +380,33 @@ func (r *downloadRequest) doDownload(
 	}
 	if mediaMetadata == nil {
 		if r.MediaMetadata.Origin == cfg.Matrix.ServerName {
-			// If we do not have a record and the origin is local, the file is not found
+			// If we do not have a record and the origin is local, the file is not found,
+			// unless the media ID has been reserved and the upload hasn't happened yet
+			reservation, err := db.GetMediaReservation(ctx, r.MediaMetadata.MediaID, r.MediaMetadata.Origin)
+			if err != nil {
+				return nil, errors.Wrap(err, "error querying the database")
+			}
+			if reservation != nil && reservation.ExpiresTimestamp > types.UnixMs(time.Now().UnixNano()/1000000) {
+				return nil, errNotYetUploaded
+			}
 			return nil, nil
 		}
+		if !r.AllowRemote {
+			// The requester only wants media that we already have, e.g. to avoid loops
+			// between servers fetching from each other.
+			// https://github.com/matrix-org/matrix-doc/pull/1265
+			return nil, nil
+		}
+		if !cfg.IsAllowedRemoteOrigin(r.MediaMetadata.Origin) {
+			return nil, errRemoteOriginNotAllowed
+		}
 		// If we do not have a record and the origin is remote, we need to fetch it and respond with that file
 		resErr := r.getRemoteFile(
-			ctx, client, cfg, db, activeRemoteRequests, activeThumbnailGeneration,
+			ctx, client, cfg, db, activeRemoteRequests, activeThumbnailGeneration, thumbnailPregenerator, encryptionKey,
 		)
+		if errors.Is(resErr, errRemoteNotFound) {
+			return nil, nil
+		}
 		if resErr != nil {
 			return nil, resErr
 		}
@@ -232,11 +414,7 @@ func (r *downloadRequest) doDownload(
 		// If we have a record, we can respond from the local file
 		r.MediaMetadata = mediaMetadata
 	}
-	return r.respondFromLocalFile(
-		ctx, w, cfg.AbsBasePath, activeThumbnailGeneration,
-		cfg.MaxThumbnailGenerators, db,
-		cfg.DynamicThumbnails, cfg.ThumbnailSizes,
-	)
+	return r.respondFromLocalFile(ctx, w, cfg, activeThumbnailGeneration, db, encryptionKey)
 }
 
 // respondFromLocalFile reads a file from local storage and writes it to the http.ResponseWriter
@@ -244,49 +422,93 @@ func (r *downloadRequest) doDownload(
 func (r *downloadRequest) respondFromLocalFile(
 	ctx context.Context,
 	w http.ResponseWriter,
-	absBasePath config.Path,
+	cfg *config.MediaAPI,
 	activeThumbnailGeneration *types.ActiveThumbnailGeneration,
-	maxThumbnailGenerators int,
 	db storage.Database,
-	dynamicThumbnails bool,
-	thumbnailSizes []config.ThumbnailSize,
+	encryptionKey *fileutils.EncryptionKey,
 ) (*types.MediaMetadata, error) {
-	filePath, err := fileutils.GetPathFromBase64Hash(r.MediaMetadata.Base64Hash, absBasePath)
+	// Media never changes once it has been stored, so the time it was stored is
+	// when it, and any thumbnails of it, were last modified.
+	if r.MediaMetadata.CreationTimestamp > 0 {
+		lastModified := time.Unix(0, int64(r.MediaMetadata.CreationTimestamp)*int64(time.Millisecond)).UTC()
+		w.Header().Set("Last-Modified", lastModified.Format(http.TimeFormat))
+		// HTTP dates only have a resolution of whole seconds
+		if !r.IfModifiedSince.IsZero() && !lastModified.Truncate(time.Second).After(r.IfModifiedSince) {
+			r.Logger.Info("Responding that the file has not been modified")
+			w.WriteHeader(http.StatusNotModified)
+			return r.MediaMetadata, nil
+		}
+	}
+
+	filePath, err := fileutils.GetPathFromBase64Hash(r.MediaMetadata.Base64Hash, cfg.AbsBasePath)
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to get file path from metadata")
 	}
-	file, err := os.Open(filePath)
-	defer file.Close() // nolint: errcheck, staticcheck, megacheck
+	file, fileSize, err := fileutils.OpenFile(types.Path(filePath), r.MediaMetadata.Encryption, encryptionKey)
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to open file")
 	}
-	stat, err := file.Stat()
-	if err != nil {
-		return nil, errors.Wrap(err, "failed to stat file")
-	}
+	defer file.Close() // nolint: errcheck
 
-	if r.MediaMetadata.FileSizeBytes > 0 && int64(r.MediaMetadata.FileSizeBytes) != stat.Size() {
+	if r.MediaMetadata.FileSizeBytes > 0 && r.MediaMetadata.FileSizeBytes != fileSize {
 		r.Logger.WithFields(log.Fields{
 			"fileSizeDatabase": r.MediaMetadata.FileSizeBytes,
-			"fileSizeDisk":     stat.Size(),
+			"fileSizeDisk":     fileSize,
 		}).Warn("File size in database and on-disk differ.")
 		return nil, errors.New("file size in database and on-disk differ")
 	}
 
-	var responseFile *os.File
+	var responseFile io.Reader
 	var responseMetadata *types.MediaMetadata
+	// Neither the media nor its thumbnails ever change, so they can be told apart by
+	// the hash of the media and the size of the thumbnail.
+	etag := fmt.Sprintf("%q", r.MediaMetadata.Base64Hash)
 	if r.IsThumbnailRequest {
+		if r.ThumbnailSize.ResizeMethod == "" {
+			r.ThumbnailSize.ResizeMethod = cfg.ThumbnailMethod(string(r.MediaMetadata.ContentType))
+			r.Logger = r.Logger.WithField("DefaultResizeMethod", r.ThumbnailSize.ResizeMethod)
+			if r.ThumbnailSize.ResizeMethod == types.Pad {
+				r.ThumbnailSize.Background = config.TransparentThumbnailBackground
+			}
+		}
 		thumbFile, thumbMetadata, resErr := r.getThumbnailFile(
-			ctx, types.Path(filePath), activeThumbnailGeneration, maxThumbnailGenerators,
-			db, dynamicThumbnails, thumbnailSizes,
+			ctx, types.Path(filePath), activeThumbnailGeneration, cfg.MaxThumbnailGenerators, cfg.MaxImagePixels,
+			cfg.ThumbnailJPEGQuality, db, cfg.DynamicThumbnails, cfg.ThumbnailSizes, cfg.MaxThumbnailsPerMedia,
+			cfg.ThumbnailOverflowResponse, cfg.PDFThumbnails, encryptionKey,
 		)
 		if thumbFile != nil {
 			defer thumbFile.Close() // nolint: errcheck
 		}
+		usePlaceholder := false
 		if resErr != nil {
-			return nil, resErr
+			genErr, ok := resErr.(*thumbnailGenerationError)
+			if !ok {
+				return nil, resErr
+			}
+			r.Logger.WithError(genErr.err).WithField(
+				"ThumbnailFailureResponse", cfg.ThumbnailFailureResponse,
+			).Warn("Failed to generate thumbnail")
+			switch cfg.ThumbnailFailureResponse {
+			case config.ThumbnailFailurePlaceholder:
+				usePlaceholder = true
+			case config.ThumbnailFailureNotFound:
+				return nil, errThumbnailNotFound
+			default:
+				return nil, resErr
+			}
 		}
-		if thumbFile == nil {
+		switch {
+		case usePlaceholder:
+			placeholder := thumbnailer.Placeholder()
+			r.Logger.Info("Responding with placeholder thumbnail")
+			responseFile = bytes.NewReader(placeholder)
+			responseMetadata = &types.MediaMetadata{
+				ContentType:   thumbnailer.PlaceholderContentType,
+				FileSizeBytes: types.FileSizeBytes(len(placeholder)),
+			}
+			// The thumbnail may be generated successfully next time.
+			etag = ""
+		case thumbFile == nil:
 			r.Logger.WithFields(log.Fields{
 				"UploadName":    r.MediaMetadata.UploadName,
 				"Base64Hash":    r.MediaMetadata.Base64Hash,
@@ -295,10 +517,15 @@ func (r *downloadRequest) respondFromLocalFile(
 			}).Info("No good thumbnail found. Responding with original file.")
 			responseFile = file
 			responseMetadata = r.MediaMetadata
-		} else {
+		default:
 			r.Logger.Info("Responding with thumbnail")
 			responseFile = thumbFile
 			responseMetadata = thumbMetadata.MediaMetadata
+			etag = fmt.Sprintf(
+				"%q", fmt.Sprintf("%s-%dx%d-%s%s", r.MediaMetadata.Base64Hash, thumbMetadata.ThumbnailSize.Width,
+					thumbMetadata.ThumbnailSize.Height, thumbMetadata.ThumbnailSize.ResizeMethod,
+					thumbMetadata.ThumbnailSize.Background),
+			)
 		}
 	} else {
 		r.Logger.WithFields(log.Fields{
@@ -309,29 +536,132 @@ func (r *downloadRequest) respondFromLocalFile(
 		}).Info("Responding with file")
 		responseFile = file
 		responseMetadata = r.MediaMetadata
-		if err := r.addDownloadFilenameToHeaders(w, responseMetadata); err != nil {
+	}
+
+	contentType := string(responseMetadata.ContentType)
+	disposition := "attachment"
+	if cfg.IsInlineContentType(contentType) {
+		disposition = "inline"
+	}
+	if cfg.PreferClientContentDisposition && responseMetadata.Disposition != "" {
+		// The uploader's choice is kept, even to show types which aren't usually
+		// shown inline, see prefer_client_content_disposition.
+		disposition = responseMetadata.Disposition
+	}
+	if cfg.IsAttachmentContentType(contentType) {
+		// Browsers could run scripts in the media, whatever its name or whoever
+		// asked for it to be shown inline.
+		disposition = "attachment"
+	}
+	if !cfg.SanitizeSVGs && sanitizer.IsSVG(contentType) {
+		// The SVG image could contain scripts, so make sure that browsers
+		// do not try to render it.
+		contentType = "application/octet-stream"
+		disposition = "attachment"
+	}
+	if r.ForceAttachment {
+		disposition = "attachment"
+	}
+	gzipped := false
+	if cfg.IsGzipContentType(contentType) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		gzipped = r.AcceptsGzip
+	}
+	if etag != "" {
+		if gzipped {
+			// The gzipped response is a different sequence of bytes.
+			etag = etag[:len(etag)-1] + `-gzip"`
+		}
+		w.Header().Set("ETag", etag)
+		if etagMatches(r.IfNoneMatch, etag) {
+			r.Logger.Info("Responding that the file has not been modified")
+			w.WriteHeader(http.StatusNotModified)
+			return responseMetadata, nil
+		}
+	}
+	if !r.IsThumbnailRequest || disposition != "inline" {
+		if err := r.addDownloadFilenameToHeaders(w, responseMetadata, disposition, cfg.DefaultUploadNames); err != nil {
 			return nil, err
 		}
 	}
 
-	w.Header().Set("Content-Type", string(responseMetadata.ContentType))
-	w.Header().Set("Content-Length", strconv.FormatInt(int64(responseMetadata.FileSizeBytes), 10))
+	w.Header().Set("Content-Type", contentType)
+	if gzipped {
+		// The compressed length isn't known until it has all been written.
+		w.Header().Set("Content-Encoding", "gzip")
+	} else {
+		w.Header().Set("Content-Length", strconv.FormatInt(int64(responseMetadata.FileSizeBytes), 10))
+	}
 	contentSecurityPolicy := "default-src 'none';" +
 		" script-src 'none';" +
 		" plugin-types application/pdf;" +
 		" style-src 'unsafe-inline';" +
 		" object-src 'self';"
 	w.Header().Set("Content-Security-Policy", contentSecurityPolicy)
+	if r.HeadOnly {
+		return responseMetadata, nil
+	}
 
-	if _, err := io.Copy(w, responseFile); err != nil {
+	responseFile, release := throttleDownload(ctx, cfg, responseFile)
+	defer release()
+	if gzipped {
+		gzipWriter := gzip.NewWriter(w)
+		if _, err := io.Copy(gzipWriter, responseFile); err != nil {
+			return nil, errors.Wrap(err, "failed to copy from cache")
+		}
+		if err := gzipWriter.Close(); err != nil {
+			return nil, errors.Wrap(err, "failed to compress response")
+		}
+	} else if _, err := io.Copy(w, responseFile); err != nil {
 		return nil, errors.Wrap(err, "failed to copy from cache")
 	}
 	return responseMetadata, nil
 }
 
+// etagMatches returns whether an If-None-Match header lists the entity tag, or is
+// "*". Tags are compared weakly, i.e. ignoring any W/ prefix, as the RFC requires.
+func etagMatches(header, etag string) bool {
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" || strings.TrimPrefix(tag, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// acceptsGzip returns whether an Accept-Encoding header allows a gzipped response,
+// either by naming gzip or with "*", and not with a quality of 0.
+func acceptsGzip(header string) bool {
+	accepted := false
+	for _, coding := range strings.Split(header, ",") {
+		params := strings.Split(coding, ";")
+		name := strings.ToLower(strings.TrimSpace(params[0]))
+		if name != "gzip" && name != "*" {
+			continue
+		}
+		refused := false
+		for _, param := range params[1:] {
+			param = strings.Replace(param, " ", "", -1)
+			if q := strings.TrimPrefix(strings.ToLower(param), "q="); q != param {
+				quality, err := strconv.ParseFloat(q, 64)
+				refused = err != nil || quality <= 0
+			}
+		}
+		if name == "gzip" {
+			// An explicit gzip takes precedence over "*".
+			return !refused
+		}
+		accepted = !refused
+	}
+	return accepted
+}
+
 func (r *downloadRequest) addDownloadFilenameToHeaders(
 	w http.ResponseWriter,
 	responseMetadata *types.MediaMetadata,
+	disposition string,
+	defaultUploadNames bool,
 ) error {
 	// If the requestor supplied a filename to name the download then
 	// use that, otherwise use the filename from the response metadata.
@@ -339,8 +669,19 @@ func (r *downloadRequest) addDownloadFilenameToHeaders(
 	if r.DownloadFilename != "" {
 		filename = r.DownloadFilename
 	}
+	if r.ForceAttachment {
+		filename = r.attachmentFilename(responseMetadata)
+	}
+	// Media which was uploaded without a name, before default names were enabled or
+	// by another server, is named in the same way as it would have been on upload.
+	if filename == "" && defaultUploadNames {
+		filename = string(defaultUploadName(r.MediaMetadata.MediaID, responseMetadata.ContentType))
+	}
 
 	if len(filename) == 0 {
+		if disposition != "inline" {
+			w.Header().Set("Content-Disposition", disposition)
+		}
 		return nil
 	}
 
@@ -349,47 +690,99 @@ func (r *downloadRequest) addDownloadFilenameToHeaders(
 		return fmt.Errorf("url.PathUnescape: %w", err)
 	}
 
-	isASCII := true // Is the string ASCII or UTF-8?
-	quote := ``     // Encloses the string (ASCII only)
-	for i := 0; i < len(unescaped); i++ {
-		if unescaped[i] > unicode.MaxASCII {
-			isASCII = false
-		}
-		if unescaped[i] == 0x20 || unescaped[i] == 0x3B {
-			// If the filename contains a space or a semicolon, which
-			// are special characters in Content-Disposition
-			quote = `"`
-		}
-	}
-
-	// We don't necessarily want a full escape as the Content-Disposition
-	// can take many of the characters that PathEscape would otherwise and
-	// browser support for encoding is a bit wild, so we'll escape only
-	// the characters that we know will mess up the parsing of the
-	// Content-Disposition header elements themselves
-	unescaped = strings.ReplaceAll(unescaped, `\`, `\\"`)
-	unescaped = strings.ReplaceAll(unescaped, `"`, `\"`)
-
-	if isASCII {
-		// For ASCII filenames, we should only quote the filename if
-		// it needs to be done, e.g. it contains a space or a character
-		// that would otherwise be parsed as a control character in the
-		// Content-Disposition header
-		w.Header().Set("Content-Disposition", fmt.Sprintf(
-			`inline; filename=%s%s%s`,
-			quote, unescaped, quote,
-		))
-	} else {
-		// For UTF-8 filenames, we quote always, as that's the standard
-		w.Header().Set("Content-Disposition", fmt.Sprintf(
-			`inline; filename*=utf-8''%s`,
-			url.QueryEscape(unescaped),
-		))
+	// Every client understands the filename parameter, but it can only hold ASCII.
+	// Names with anything else also get the RFC 5987 encoded filename* parameter,
+	// which clients that understand it use instead.
+	// https://tools.ietf.org/html/rfc6266#appendix-D
+	header := fmt.Sprintf(`%s; filename=%s`, disposition, quoteFilename(asciiFilename(unescaped)))
+	if !isPrintableASCII(unescaped) {
+		header += `; filename*=utf-8''` + encodeRFC5987(unescaped)
 	}
-
+	w.Header().Set("Content-Disposition", header)
 	return nil
 }
 
+// attachmentFilename returns the name to save a forced attachment as, which is the
+// first of the name in the request path, the upload name, or a name made up from the
+// media ID, which is a valid file name. Any path in the name is stripped.
+func (r *downloadRequest) attachmentFilename(responseMetadata *types.MediaMetadata) string {
+	for _, name := range []string{r.DownloadFilename, string(responseMetadata.UploadName)} {
+		unescaped, err := url.PathUnescape(name)
+		if err != nil {
+			continue
+		}
+		if filename := sanitizeUploadName(unescaped); filename != "" {
+			return string(filename)
+		}
+	}
+	return string(defaultUploadName(r.MediaMetadata.MediaID, responseMetadata.ContentType))
+}
+
+func isPrintableASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] < 0x20 || s[i] >= unicode.MaxASCII {
+			return false
+		}
+	}
+	return true
+}
+
+// asciiFilename replaces any characters in the filename which can't be given in the
+// plain filename parameter of a Content-Disposition header with underscores.
+func asciiFilename(filename string) string {
+	return strings.Map(func(r rune) rune {
+		if r < 0x20 || r >= unicode.MaxASCII {
+			return '_'
+		}
+		return r
+	}, filename)
+}
+
+// isTokenChar returns whether c can be used in a token without quoting, as defined by
+// https://tools.ietf.org/html/rfc7230#section-3.2.6
+func isTokenChar(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' ||
+		strings.IndexByte("!#$%&'*+-.^_`|~", c) >= 0
+}
+
+// quoteFilename returns the ASCII filename as it should be given in the filename
+// parameter of a Content-Disposition header, which is quoted unless it is a token.
+func quoteFilename(filename string) string {
+	needsQuoting := filename == ""
+	for i := 0; i < len(filename); i++ {
+		if !isTokenChar(filename[i]) {
+			needsQuoting = true
+			break
+		}
+	}
+	if !needsQuoting {
+		return filename
+	}
+	filename = strings.ReplaceAll(filename, `\`, `\\`)
+	filename = strings.ReplaceAll(filename, `"`, `\"`)
+	return `"` + filename + `"`
+}
+
+// encodeRFC5987 percent-encodes the UTF-8 bytes of s which aren't attr-chars, for use
+// in an ext-value such as the filename* parameter of a Content-Disposition header.
+// This is stricter than url.PathEscape, which leaves characters such as commas and
+// semicolons alone. https://tools.ietf.org/html/rfc5987#section-3.2.1
+func encodeRFC5987(s string) string {
+	const hex = "0123456789ABCDEF"
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if isTokenChar(c) && c != '*' && c != '\'' && c != '%' {
+			b.WriteByte(c)
+			continue
+		}
+		b.WriteByte('%')
+		b.WriteByte(hex[c>>4])
+		b.WriteByte(hex[c&0x0f])
+	}
+	return b.String()
+}
+
 // Note: Thumbnail generation may be ongoing asynchronously.
 // If no thumbnail was found then returns nil, nil, nil
 func (r *downloadRequest) getThumbnailFile(
@@ -397,21 +790,41 @@ func (r *downloadRequest) getThumbnailFile(
 	filePath types.Path,
 	activeThumbnailGeneration *types.ActiveThumbnailGeneration,
 	maxThumbnailGenerators int,
+	maxImagePixels int64,
+	jpegQuality int,
 	db storage.Database,
 	dynamicThumbnails bool,
 	thumbnailSizes []config.ThumbnailSize,
-) (*os.File, *types.ThumbnailMetadata, error) {
+	maxThumbnailsPerMedia int,
+	thumbnailOverflowResponse string,
+	pdfThumbnails config.PDFThumbnails,
+	encryptionKey *fileutils.EncryptionKey,
+) (io.ReadCloser, *types.ThumbnailMetadata, error) {
 	var thumbnail *types.ThumbnailMetadata
 	var err error
 
-	if dynamicThumbnails {
-		thumbnail, err = r.generateThumbnail(
-			ctx, filePath, r.ThumbnailSize, activeThumbnailGeneration,
-			maxThumbnailGenerators, db,
+	// A HEAD request is answered from the thumbnails which already exist, rather than
+	// spending the time generating one which isn't going to be sent.
+	if dynamicThumbnails && !r.HeadOnly {
+		var overLimit bool
+		overLimit, thumbnail, err = r.thumbnailOverLimit(
+			ctx, db, thumbnailSizes, maxThumbnailsPerMedia, thumbnailOverflowResponse,
 		)
 		if err != nil {
 			return nil, nil, err
 		}
+		if overLimit && thumbnail == nil {
+			return nil, nil, nil
+		}
+		if !overLimit {
+			thumbnail, err = r.generateThumbnail(
+				ctx, filePath, r.ThumbnailSize, activeThumbnailGeneration,
+				maxThumbnailGenerators, maxImagePixels, jpegQuality, db, pdfThumbnails, encryptionKey,
+			)
+			if err != nil {
+				return nil, nil, err
+			}
+		}
 	}
 	// If dynamicThumbnails is true but there are too many thumbnails being actively generated, we can fall back
 	// to trying to use a pre-generated thumbnail
@@ -430,7 +843,7 @@ func (r *downloadRequest) getThumbnailFile(
 		thumbnail, thumbnailSize = thumbnailer.SelectThumbnail(r.ThumbnailSize, thumbnails, thumbnailSizes)
 		// If dynamicThumbnails is true and we are not over-loaded then we would have generated what was requested above.
 		// So we don't try to generate a pre-generated thumbnail here.
-		if thumbnailSize != nil && !dynamicThumbnails {
+		if thumbnailSize != nil && !dynamicThumbnails && !r.HeadOnly {
 			r.Logger.WithFields(log.Fields{
 				"Width":        thumbnailSize.Width,
 				"Height":       thumbnailSize.Height,
@@ -438,7 +851,7 @@ func (r *downloadRequest) getThumbnailFile(
 			}).Info("Pre-generating thumbnail for immediate response.")
 			thumbnail, err = r.generateThumbnail(
 				ctx, filePath, *thumbnailSize, activeThumbnailGeneration,
-				maxThumbnailGenerators, db,
+				maxThumbnailGenerators, maxImagePixels, jpegQuality, db, pdfThumbnails, encryptionKey,
 			)
 			if err != nil {
 				return nil, nil, err
@@ -456,42 +869,98 @@ func (r *downloadRequest) getThumbnailFile(
 		"ContentType":   thumbnail.MediaMetadata.ContentType,
 	})
 	thumbPath := string(thumbnailer.GetThumbnailPath(types.Path(filePath), thumbnail.ThumbnailSize))
-	thumbFile, err := os.Open(string(thumbPath))
+	thumbFile, thumbSize, err := fileutils.OpenFile(types.Path(thumbPath), thumbnail.MediaMetadata.Encryption, encryptionKey)
 	if err != nil {
-		thumbFile.Close() // nolint: errcheck
 		return nil, nil, errors.Wrap(err, "failed to open file")
 	}
-	thumbStat, err := thumbFile.Stat()
-	if err != nil {
-		thumbFile.Close() // nolint: errcheck
-		return nil, nil, errors.Wrap(err, "failed to stat file")
-	}
-	if types.FileSizeBytes(thumbStat.Size()) != thumbnail.MediaMetadata.FileSizeBytes {
+	if thumbSize != thumbnail.MediaMetadata.FileSizeBytes {
 		thumbFile.Close() // nolint: errcheck
 		return nil, nil, errors.New("thumbnail file sizes on disk and in database differ")
 	}
 	return thumbFile, thumbnail, nil
 }
 
+// thumbnailOverLimit returns whether generating the requested thumbnail would take the
+// file over the maximum number of thumbnails. If so, nothing is generated and the
+// returned existing thumbnail is served instead, or the original if it is nil.
+// Requests for different sizes at the same time can all pass the check before any
+// of them have been stored, so the limit can be exceeded by up to the number of
+// simultaneous thumbnail generators.
+func (r *downloadRequest) thumbnailOverLimit(
+	ctx context.Context,
+	db storage.Database,
+	thumbnailSizes []config.ThumbnailSize,
+	maxThumbnailsPerMedia int,
+	thumbnailOverflowResponse string,
+) (bool, *types.ThumbnailMetadata, error) {
+	// The pre-generated sizes are always allowed, as there is a fixed number of them.
+	for _, size := range thumbnailSizes {
+		if types.ThumbnailSize(size) == r.ThumbnailSize {
+			return false, nil, nil
+		}
+	}
+	thumbnails, err := db.GetThumbnails(ctx, r.MediaMetadata.MediaID, r.MediaMetadata.Origin)
+	if err != nil {
+		return false, nil, errors.Wrap(err, "error looking up thumbnails")
+	}
+	if len(thumbnails) < maxThumbnailsPerMedia {
+		return false, nil, nil
+	}
+	for _, thumbnail := range thumbnails {
+		if thumbnail.ThumbnailSize == r.ThumbnailSize {
+			return false, nil, nil
+		}
+	}
+	r.Logger.WithFields(log.Fields{
+		"Thumbnails":                len(thumbnails),
+		"ThumbnailOverflowResponse": thumbnailOverflowResponse,
+	}).Info("Media has the maximum number of thumbnails, not generating another size")
+	return true, thumbnailer.SelectExistingThumbnail(r.ThumbnailSize, thumbnails, thumbnailOverflowResponse), nil
+}
+
 func (r *downloadRequest) generateThumbnail(
 	ctx context.Context,
 	filePath types.Path,
 	thumbnailSize types.ThumbnailSize,
 	activeThumbnailGeneration *types.ActiveThumbnailGeneration,
 	maxThumbnailGenerators int,
+	maxImagePixels int64,
+	jpegQuality int,
 	db storage.Database,
+	pdfThumbnails config.PDFThumbnails,
+	encryptionKey *fileutils.EncryptionKey,
 ) (*types.ThumbnailMetadata, error) {
 	r.Logger.WithFields(log.Fields{
 		"Width":        thumbnailSize.Width,
 		"Height":       thumbnailSize.Height,
 		"ResizeMethod": thumbnailSize.ResizeMethod,
 	})
+	// Thumbnails of PDFs are generated from an image of the first page, which is kept
+	// in the same directory so the thumbnails end up where they would be for the PDF.
+	src := filePath
+	if pdfThumbnails.Enabled && thumbnailer.IsPDF(r.MediaMetadata.ContentType) {
+		page, busy, err := thumbnailer.RenderPDFPage(
+			ctx, filePath, pdfThumbnails, r.MediaMetadata,
+			activeThumbnailGeneration, maxThumbnailGenerators, encryptionKey, r.Logger,
+		)
+		switch {
+		case err == thumbnailer.ErrPDFRendererUnavailable:
+			// Carry on with the PDF itself, which fails like any other file that isn't an image.
+			r.Logger.WithField("Command", pdfThumbnails.Command).Debug("PDF renderer is not available")
+		case err != nil:
+			return nil, &thumbnailGenerationError{err}
+		case busy:
+			return nil, nil
+		default:
+			src = page
+		}
+	}
 	busy, err := thumbnailer.GenerateThumbnail(
-		ctx, filePath, thumbnailSize, r.MediaMetadata,
-		activeThumbnailGeneration, maxThumbnailGenerators, db, r.Logger,
+		ctx, src, thumbnailSize, r.MediaMetadata,
+		activeThumbnailGeneration, maxThumbnailGenerators, maxImagePixels, jpegQuality, db, encryptionKey, r.Logger,
 	)
 	if err != nil {
-		return nil, errors.Wrap(err, "error creating thumbnail")
+		return nil, &thumbnailGenerationError{err}
 	}
 	if busy {
 		return nil, nil
@@ -499,7 +968,7 @@ func (r *downloadRequest) generateThumbnail(
 	var thumbnail *types.ThumbnailMetadata
 	thumbnail, err = db.GetThumbnail(
 		ctx, r.MediaMetadata.MediaID, r.MediaMetadata.Origin,
-		thumbnailSize.Width, thumbnailSize.Height, thumbnailSize.ResizeMethod,
+		thumbnailSize.Width, thumbnailSize.Height, thumbnailSize.ResizeMethod, thumbnailSize.Background,
 	)
 	if err != nil {
 		return nil, errors.Wrap(err, "error looking up thumbnail")
@@ -518,6 +987,8 @@ func (r *downloadRequest) getRemoteFile(
 	db storage.Database,
 	activeRemoteRequests *types.ActiveRemoteRequests,
 	activeThumbnailGeneration *types.ActiveThumbnailGeneration,
+	thumbnailPregenerator *thumbnailPregenerator,
+	encryptionKey *fileutils.EncryptionKey,
 ) (errorResponse error) {
 	// Note: getMediaMetadataFromActiveRequest uses mutexes and conditions from activeRemoteRequests
 	mediaMetadata, resErr := r.getMediaMetadataFromActiveRequest(activeRemoteRequests)
@@ -532,10 +1003,10 @@ func (r *downloadRequest) getRemoteFile(
 		defer func() {
 			// Note: errorResponse is the named return variable so we wrap this in a closure to re-evaluate the arguments at defer-time
 			if err := recover(); err != nil {
-				r.broadcastMediaMetadata(activeRemoteRequests, errors.New("paniced"))
+				r.broadcastMediaMetadata(activeRemoteRequests, errors.New("paniced"), 0)
 				panic(err)
 			}
-			r.broadcastMediaMetadata(activeRemoteRequests, errorResponse)
+			r.broadcastMediaMetadata(activeRemoteRequests, errorResponse, cfg.RemoteNotFoundTTL)
 		}()
 
 		// check if we have a record of the media in our database
@@ -549,10 +1020,7 @@ func (r *downloadRequest) getRemoteFile(
 		if mediaMetadata == nil {
 			// If we do not have a record, we need to fetch the remote file first and then respond from the local file
 			err := r.fetchRemoteFileAndStoreMetadata(
-				ctx, client,
-				cfg.AbsBasePath, *cfg.MaxFileSizeBytes, db,
-				cfg.ThumbnailSizes, activeThumbnailGeneration,
-				cfg.MaxThumbnailGenerators,
+				ctx, client, cfg, db, activeThumbnailGeneration, thumbnailPregenerator, encryptionKey,
 			)
 			if err != nil {
 				return errors.Wrap(err, "error querying the database.")
@@ -572,6 +1040,14 @@ func (r *downloadRequest) getMediaMetadataFromActiveRequest(activeRemoteRequests
 	activeRemoteRequests.Lock()
 	defer activeRemoteRequests.Unlock()
 
+	if expiry, ok := activeRemoteRequests.MXCToNotFoundExpiry[mxcURL]; ok {
+		if time.Now().Before(expiry) {
+			r.Logger.Info("Remote server recently said it does not have the file.")
+			return nil, errRemoteNotFound
+		}
+		delete(activeRemoteRequests.MXCToNotFoundExpiry, mxcURL)
+	}
+
 	if activeRemoteRequestResult, ok := activeRemoteRequests.MXCToResult[mxcURL]; ok {
 		r.Logger.Info("Waiting for another goroutine to fetch the remote file.")
 
@@ -598,10 +1074,19 @@ func (r *downloadRequest) getMediaMetadataFromActiveRequest(activeRemoteRequests
 
 // broadcastMediaMetadata broadcasts the media metadata and error response to waiting goroutines
 // Only the owner of the activeRemoteRequestResult for this origin and media ID should call this function.
-func (r *downloadRequest) broadcastMediaMetadata(activeRemoteRequests *types.ActiveRemoteRequests, err error) {
+// If the remote server didn't have the media then that is remembered for notFoundTTL.
+func (r *downloadRequest) broadcastMediaMetadata(
+	activeRemoteRequests *types.ActiveRemoteRequests, err error, notFoundTTL time.Duration,
+) {
 	activeRemoteRequests.Lock()
 	defer activeRemoteRequests.Unlock()
 	mxcURL := "mxc://" + string(r.MediaMetadata.Origin) + "/" + string(r.MediaMetadata.MediaID)
+	if notFoundTTL > 0 && errors.Is(err, errRemoteNotFound) {
+		if activeRemoteRequests.MXCToNotFoundExpiry == nil {
+			activeRemoteRequests.MXCToNotFoundExpiry = map[string]time.Time{}
+		}
+		activeRemoteRequests.MXCToNotFoundExpiry[mxcURL] = time.Now().Add(notFoundTTL)
+	}
 	if activeRemoteRequestResult, ok := activeRemoteRequests.MXCToResult[mxcURL]; ok {
 		r.Logger.Info("Signalling other goroutines waiting for this goroutine to fetch the file.")
 		activeRemoteRequestResult.MediaMetadata = r.MediaMetadata
@@ -615,19 +1100,80 @@ func (r *downloadRequest) broadcastMediaMetadata(activeRemoteRequests *types.Act
 func (r *downloadRequest) fetchRemoteFileAndStoreMetadata(
 	ctx context.Context,
 	client *gomatrixserverlib.Client,
-	absBasePath config.Path,
-	maxFileSizeBytes config.FileSizeBytes,
+	cfg *config.MediaAPI,
 	db storage.Database,
-	thumbnailSizes []config.ThumbnailSize,
 	activeThumbnailGeneration *types.ActiveThumbnailGeneration,
-	maxThumbnailGenerators int,
+	thumbnailPregenerator *thumbnailPregenerator,
+	encryptionKey *fileutils.EncryptionKey,
 ) error {
-	finalPath, duplicate, err := r.fetchRemoteFile(
-		ctx, client, absBasePath, maxFileSizeBytes,
-	)
+	tmpDir, err := r.fetchRemoteFileWithRetries(ctx, client, cfg)
 	if err != nil {
 		return err
 	}
+	finalPath, err := r.storeRemoteFileAndMetadataLocked(ctx, tmpDir, cfg.AbsBasePath, db, encryptionKey)
+	if err != nil {
+		return err
+	}
+
+	if thumbnailPregenerator.tryStart(time.Now()) {
+		go func() {
+			defer thumbnailPregenerator.done()
+			busy, err := thumbnailer.GenerateThumbnails(
+				context.Background(), finalPath, cfg.ThumbnailSizes, r.MediaMetadata,
+				activeThumbnailGeneration, cfg.MaxThumbnailGenerators, cfg.MaxImagePixels, cfg.ThumbnailJPEGQuality,
+				db, encryptionKey, r.Logger,
+			)
+			if err != nil {
+				r.Logger.WithError(err).Warn("Error generating thumbnails")
+			}
+			if busy {
+				r.Logger.Warn("Maximum number of active thumbnail generators reached. Skipping pre-generation.")
+			}
+		}()
+	} else if thumbnailPregenerator != nil {
+		r.Logger.Debug("Remote thumbnail pre-generation limit reached. Skipping pre-generation.")
+	}
+
+	r.Logger.WithFields(log.Fields{
+		"UploadName":    r.MediaMetadata.UploadName,
+		"Base64Hash":    r.MediaMetadata.Base64Hash,
+		"FileSizeBytes": r.MediaMetadata.FileSizeBytes,
+		"ContentType":   r.MediaMetadata.ContentType,
+	}).Infof("Remote file cached")
+
+	return nil
+}
+
+// storeRemoteFileAndMetadataLocked moves the fetched file into place and stores its
+// metadata while holding the lock for the file's hash (see fileLocks), in the same
+// way as uploads are stored, so that the same file being fetched or uploaded at the
+// same time is only stored and counted once.
+func (r *downloadRequest) storeRemoteFileAndMetadataLocked(
+	ctx context.Context,
+	tmpDir types.Path,
+	absBasePath config.Path,
+	db storage.Database,
+	encryptionKey *fileutils.EncryptionKey,
+) (types.Path, error) {
+	defer fileLocks.lock(r.MediaMetadata.Base64Hash)()
+
+	// The file may already be stored for other media, in which case how it is stored
+	// was recorded for them.
+	var err error
+	if r.MediaMetadata.Encryption, err = db.GetFileEncryption(ctx, r.MediaMetadata.Base64Hash); err != nil {
+		fileutils.RemoveDir(tmpDir, r.Logger)
+		return "", errors.Wrap(err, "failed to look up stored file")
+	}
+
+	// The database is the source of truth so we need to have moved the file first
+	finalPath, duplicate, err := fileutils.MoveFileWithHashCheck(tmpDir, r.MediaMetadata, absBasePath, encryptionKey, r.Logger)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to move file")
+	}
+	if duplicate {
+		r.Logger.WithField("dst", finalPath).Info("File was stored previously - discarding duplicate")
+		// Continue on to store the metadata in the database
+	}
 
 	r.Logger.WithFields(log.Fields{
 		"Base64Hash":    r.MediaMetadata.Base64Hash,
@@ -647,48 +1193,56 @@ func (r *downloadRequest) fetchRemoteFileAndStoreMetadata(
 		}
 		// NOTE: It should really not be possible to fail the uniqueness test here so
 		// there is no need to handle that separately
-		return errors.New("failed to store file metadata in DB")
+		return "", errors.New("failed to store file metadata in DB")
+	}
+	// Remote media is always fetched, even if it takes the stored media over the
+	// maximum total size, as it is needed to show what other servers sent.
+	if !duplicate {
+		addStoredBytes(ctx, db, r.Logger, int64(r.MediaMetadata.FileSizeBytes))
 	}
+	return finalPath, nil
+}
 
-	go func() {
-		busy, err := thumbnailer.GenerateThumbnails(
-			context.Background(), finalPath, thumbnailSizes, r.MediaMetadata,
-			activeThumbnailGeneration, maxThumbnailGenerators, db, r.Logger,
-		)
-		if err != nil {
-			r.Logger.WithError(err).Warn("Error generating thumbnails")
+// fetchRemoteFileWithRetries fetches the file from the remote server, trying again with
+// exponential backoff if that failed in a way which may not happen again.
+func (r *downloadRequest) fetchRemoteFileWithRetries(
+	ctx context.Context,
+	client *gomatrixserverlib.Client,
+	cfg *config.MediaAPI,
+) (types.Path, error) {
+	backoff := cfg.RemoteRetries.Backoff
+	for retry := 1; ; retry++ {
+		tmpDir, err := r.fetchRemoteFile(ctx, client, cfg)
+		if err == nil || !isRetryable(err) || retry > cfg.RemoteRetries.Count {
+			return tmpDir, err
 		}
-		if busy {
-			r.Logger.Warn("Maximum number of active thumbnail generators reached. Skipping pre-generation.")
+		r.Logger.WithError(err).WithFields(log.Fields{
+			"Retry":   retry,
+			"Backoff": backoff,
+		}).Warn("Failed to fetch remote file, retrying")
+		select {
+		case <-ctx.Done():
+			return "", ctx.Err()
+		case <-time.After(backoff):
 		}
-	}()
-
-	r.Logger.WithFields(log.Fields{
-		"UploadName":    r.MediaMetadata.UploadName,
-		"Base64Hash":    r.MediaMetadata.Base64Hash,
-		"FileSizeBytes": r.MediaMetadata.FileSizeBytes,
-		"ContentType":   r.MediaMetadata.ContentType,
-	}).Infof("Remote file cached")
-
-	return nil
+		backoff *= 2
+	}
 }
 
+// fetchRemoteFile fetches the file from the remote server into a new temporary
+// directory, which is returned, setting the metadata from the response and the hash.
 func (r *downloadRequest) fetchRemoteFile(
 	ctx context.Context,
 	client *gomatrixserverlib.Client,
-	absBasePath config.Path,
-	maxFileSizeBytes config.FileSizeBytes,
-) (types.Path, bool, error) {
+	cfg *config.MediaAPI,
+) (types.Path, error) {
 	r.Logger.Info("Fetching remote file")
+	absBasePath, maxFileSizeBytes := cfg.AbsBasePath, *cfg.MaxFileSizeBytes
 
 	// create request for remote file
 	resp, err := r.createRemoteRequest(ctx, client)
 	if err != nil {
-		return "", false, err
-	}
-	if resp == nil {
-		// Remote file not found
-		return "", false, nil
+		return "", err
 	}
 	defer resp.Body.Close() // nolint: errcheck
 
@@ -696,31 +1250,14 @@ func (r *downloadRequest) fetchRemoteFile(
 	contentLength, err := strconv.ParseInt(resp.Header.Get("Content-Length"), 10, 64)
 	if err != nil {
 		r.Logger.WithError(err).Warn("Failed to parse content length")
-		return "", false, errors.Wrap(err, "invalid response from remote server")
+		return "", errors.Wrap(err, "invalid response from remote server")
 	}
 	if contentLength > int64(maxFileSizeBytes) {
 		// TODO: Bubble up this as a 413
-		return "", false, fmt.Errorf("remote file is too large (%v > %v bytes)", contentLength, maxFileSizeBytes)
+		return "", fmt.Errorf("remote file is too large (%v > %v bytes)", contentLength, maxFileSizeBytes)
 	}
 	r.MediaMetadata.FileSizeBytes = types.FileSizeBytes(contentLength)
-	r.MediaMetadata.ContentType = types.ContentType(resp.Header.Get("Content-Type"))
-
-	dispositionHeader := resp.Header.Get("Content-Disposition")
-	if _, params, e := mime.ParseMediaType(dispositionHeader); e == nil {
-		if params["filename"] != "" {
-			r.MediaMetadata.UploadName = types.Filename(params["filename"])
-		} else if params["filename*"] != "" {
-			r.MediaMetadata.UploadName = types.Filename(params["filename*"])
-		}
-	} else {
-		if matches := rfc6266.FindStringSubmatch(dispositionHeader); len(matches) > 1 {
-			// Always prefer the RFC6266 UTF-8 name if possible
-			r.MediaMetadata.UploadName = types.Filename(matches[1])
-		} else if matches := rfc2183.FindStringSubmatch(dispositionHeader); len(matches) > 1 {
-			// Otherwise, see if an RFC2183 name was provided (ASCII only)
-			r.MediaMetadata.UploadName = types.Filename(matches[1])
-		}
-	}
+	r.setRemoteMetadata(cfg, resp.Header)
 
 	r.Logger.Info("Transferring remote file")
 
@@ -728,51 +1265,108 @@ func (r *downloadRequest) fetchRemoteFile(
 	// method of deduplicating files to save storage, as well as a way to conduct
 	// integrity checks on the file data in the repository.
 	// Data is truncated to maxFileSizeBytes. Content-Length was reported as 0 < Content-Length <= maxFileSizeBytes so this is OK.
-	hash, bytesWritten, tmpDir, err := fileutils.WriteTempFile(ctx, resp.Body, maxFileSizeBytes, absBasePath)
+	hash, bytesWritten, tmpDir, err := fileutils.WriteTempFile(ctx, resp.Body, maxFileSizeBytes, absBasePath, cfg.FileWrites)
 	if err != nil {
-		r.Logger.WithError(err).WithFields(log.Fields{
+		fields := log.Fields{
 			"MaxFileSizeBytes": maxFileSizeBytes,
-		}).Warn("Error while downloading file from remote server")
-		return "", false, errors.New("file could not be downloaded from remote server")
+		}
+		if timeout := remoteTimeout(err); timeout != "" {
+			fields["timeout"] = timeout
+		}
+		r.Logger.WithError(err).WithFields(fields).Warn("Error while downloading file from remote server")
+		return "", &retryableError{errors.New("file could not be downloaded from remote server")}
 	}
 
 	r.Logger.Info("Remote file transferred")
 
+	// Remote SVG images are sanitized in the same way as local uploads
+	if cfg.SanitizeSVGs && sanitizer.IsSVG(string(r.MediaMetadata.ContentType)) {
+		hash, bytesWritten, tmpDir, err = fileutils.ReplaceTempFile(
+			ctx, tmpDir, sanitizer.SanitizeSVG, maxFileSizeBytes, absBasePath, cfg.FileWrites,
+		)
+		if err != nil {
+			r.Logger.WithError(err).Warn("Failed to sanitize remote SVG image")
+			return "", errors.New("remote file is not a valid SVG image")
+		}
+	}
+
 	// It's possible the bytesWritten to the temporary file is different to the reported Content-Length from the remote
 	// request's response. bytesWritten is therefore used as it is what would be sent to clients when reading from the local
 	// file.
 	r.MediaMetadata.FileSizeBytes = types.FileSizeBytes(bytesWritten)
 	r.MediaMetadata.Base64Hash = hash
+	return tmpDir, nil
+}
 
-	// The database is the source of truth so we need to have moved the file first
-	finalPath, duplicate, err := fileutils.MoveFileWithHashCheck(tmpDir, r.MediaMetadata, absBasePath, r.Logger)
-	if err != nil {
-		return "", false, errors.Wrap(err, "failed to move file")
-	}
-	if duplicate {
-		r.Logger.WithField("dst", finalPath).Info("File was stored previously - discarding duplicate")
-		// Continue on to store the metadata in the database
+// setRemoteMetadata sets the content type, upload name and disposition of remote
+// media from the headers the remote server sent it with. They are checked in the
+// same way as the headers of local uploads, except that media with an invalid content
+// type is stored with the default one rather than refused. Media sent without a name
+// is named in the same way as uploads are if default_upload_names is enabled.
+func (r *downloadRequest) setRemoteMetadata(cfg *config.MediaAPI, header http.Header) {
+	r.MediaMetadata.ContentType = types.ContentType(cfg.DefaultContentType)
+	if value := header.Get("Content-Type"); value != "" {
+		contentType, err := normalizeContentType(value)
+		if err != nil {
+			r.Logger.WithError(err).WithField("ContentType", value).Warn("Remote server sent an invalid Content-Type")
+		} else {
+			r.MediaMetadata.ContentType = contentType
+		}
 	}
 
-	return types.Path(finalPath), duplicate, nil
+	dispositionHeader := header.Get("Content-Disposition")
+	r.MediaMetadata.Disposition = contentDispositionType(dispositionHeader)
+	r.MediaMetadata.UploadName = uploadNameFromContentDisposition(dispositionHeader)
+	if r.MediaMetadata.UploadName == "" {
+		// Some servers send headers which can't be parsed, such as with a filename*
+		// that isn't quoted properly, which the name may still be found in.
+		if matches := rfc6266.FindStringSubmatch(dispositionHeader); len(matches) > 1 {
+			// Always prefer the RFC6266 UTF-8 name if possible
+			if name, err := url.PathUnescape(matches[1]); err == nil {
+				r.MediaMetadata.UploadName = sanitizeUploadName(name)
+			}
+		} else if matches := rfc2183.FindStringSubmatch(dispositionHeader); len(matches) > 1 {
+			// Otherwise, see if an RFC2183 name was provided (ASCII only)
+			r.MediaMetadata.UploadName = sanitizeUploadName(matches[1])
+		}
+	}
+	if cfg.DefaultUploadNames && r.MediaMetadata.UploadName == "" {
+		r.MediaMetadata.UploadName = defaultUploadName(r.MediaMetadata.MediaID, r.MediaMetadata.ContentType)
+	}
 }
 
+// createRemoteRequest requests the file from the remote server. Errors which could be
+// down to the remote server or the network having problems, rather than the request
+// itself, are retryableErrors, and errRemoteNotFound is returned if the remote server
+// doesn't have the file.
 func (r *downloadRequest) createRemoteRequest(
 	ctx context.Context, matrixClient *gomatrixserverlib.Client,
 ) (*http.Response, error) {
 	resp, err := matrixClient.CreateMediaDownloadRequest(ctx, r.MediaMetadata.Origin, string(r.MediaMetadata.MediaID))
 	if err != nil {
-		return nil, fmt.Errorf("file with media ID %q could not be downloaded from %q", r.MediaMetadata.MediaID, r.MediaMetadata.Origin)
+		if errors.Is(err, errRemoteAddressBlocked) {
+			r.Logger.WithError(err).Warn("Refusing to fetch file from a blocked address")
+			return nil, errRemoteOriginNotAllowed
+		}
+		if timeout := remoteTimeout(err); timeout != "" {
+			r.Logger.WithError(err).WithField("timeout", timeout).Warn("Timed out requesting file from remote server")
+		}
+		return nil, &retryableError{fmt.Errorf("file with media ID %q could not be downloaded from %q", r.MediaMetadata.MediaID, r.MediaMetadata.Origin)}
 	}
 
 	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close() // nolint: errcheck
 		if resp.StatusCode == http.StatusNotFound {
-			return nil, nil
+			return nil, errRemoteNotFound
 		}
 		r.Logger.WithFields(log.Fields{
 			"StatusCode": resp.StatusCode,
 		}).Warn("Received error response")
-		return nil, fmt.Errorf("file with media ID %q could not be downloaded from %q", r.MediaMetadata.MediaID, r.MediaMetadata.Origin)
+		err = fmt.Errorf("file with media ID %q could not be downloaded from %q", r.MediaMetadata.MediaID, r.MediaMetadata.Origin)
+		if resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests {
+			return nil, &retryableError{err}
+		}
+		return nil, err
 	}
 
 	return resp, nil
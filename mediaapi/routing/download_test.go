@@ -0,0 +1,1753 @@
+package routing
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/png"
+	"io/ioutil"
+	"mime"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/internal/config"
+	"github.com/matrix-org/dendrite/mediaapi/fileutils"
+	"github.com/matrix-org/dendrite/mediaapi/storage"
+	"github.com/matrix-org/dendrite/mediaapi/thumbnailer"
+	"github.com/matrix-org/dendrite/mediaapi/types"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+// noThumbnailsDatabase has no thumbnails stored in it.
+type noThumbnailsDatabase struct {
+	storage.Database
+}
+
+func (d noThumbnailsDatabase) GetThumbnail(
+	ctx context.Context, mediaID types.MediaID, mediaOrigin gomatrixserverlib.ServerName,
+	width, height int, resizeMethod, background string,
+) (*types.ThumbnailMetadata, error) {
+	return nil, nil
+}
+
+func (d noThumbnailsDatabase) GetThumbnails(
+	ctx context.Context, mediaID types.MediaID, mediaOrigin gomatrixserverlib.ServerName,
+) ([]*types.ThumbnailMetadata, error) {
+	return nil, nil
+}
+
+// storedThumbnailsDatabase has the given thumbnails stored in it.
+type storedThumbnailsDatabase struct {
+	storage.Database
+	thumbnails []*types.ThumbnailMetadata
+}
+
+func (d storedThumbnailsDatabase) GetThumbnails(
+	ctx context.Context, mediaID types.MediaID, mediaOrigin gomatrixserverlib.ServerName,
+) ([]*types.ThumbnailMetadata, error) {
+	return d.thumbnails, nil
+}
+
+func TestThumbnailFailureResponse(t *testing.T) {
+	basePath, err := ioutil.TempDir("", "mediaapi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(basePath) // nolint: errcheck
+
+	// Store a file which claims to be an image but isn't one.
+	corrupt := []byte("this is not a png")
+	base64Hash := types.Base64Hash("corruptimagehash")
+	filePath, err := fileutils.GetPathFromBase64Hash(base64Hash, config.Path(basePath))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.MkdirAll(filepath.Dir(filePath), 0770); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(filePath, corrupt, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, response := range []string{
+		config.ThumbnailFailureError, config.ThumbnailFailurePlaceholder, config.ThumbnailFailureNotFound,
+	} {
+		cfg := &config.MediaAPI{
+			Matrix:                   &config.Global{ServerName: "localhost"},
+			AbsBasePath:              config.Path(basePath),
+			DynamicThumbnails:        true,
+			MaxThumbnailGenerators:   1,
+			MaxThumbnailsPerMedia:    16,
+			ThumbnailFailureResponse: response,
+		}
+		r := &downloadRequest{
+			MediaMetadata: &types.MediaMetadata{
+				MediaID:       "corrupt",
+				Origin:        "localhost",
+				ContentType:   "image/png",
+				FileSizeBytes: types.FileSizeBytes(len(corrupt)),
+				Base64Hash:    base64Hash,
+			},
+			IsThumbnailRequest: true,
+			ThumbnailSize:      types.ThumbnailSize{Width: 32, Height: 32, ResizeMethod: types.Crop},
+			Logger:             util.GetLogger(context.Background()),
+		}
+		activeThumbnailGeneration := &types.ActiveThumbnailGeneration{
+			PathToResult: map[string]*types.ThumbnailGenerationResult{},
+		}
+		w := httptest.NewRecorder()
+		metadata, err := r.respondFromLocalFile(context.Background(), w, cfg, activeThumbnailGeneration, noThumbnailsDatabase{}, nil)
+
+		switch response {
+		case config.ThumbnailFailureError:
+			if _, ok := err.(*thumbnailGenerationError); !ok {
+				t.Errorf("%s: expected thumbnail generation error, got %v", response, err)
+			}
+		case config.ThumbnailFailureNotFound:
+			if err != errThumbnailNotFound {
+				t.Errorf("%s: expected errThumbnailNotFound, got %v", response, err)
+			}
+		case config.ThumbnailFailurePlaceholder:
+			if err != nil || metadata == nil {
+				t.Fatalf("%s: expected placeholder response, got %v", response, err)
+			}
+			if contentType := w.Header().Get("Content-Type"); contentType != thumbnailer.PlaceholderContentType {
+				t.Errorf("%s: got Content-Type %q, want %q", response, contentType, thumbnailer.PlaceholderContentType)
+			}
+			if !bytes.Equal(w.Body.Bytes(), thumbnailer.Placeholder()) {
+				t.Errorf("%s: response body is not the placeholder image", response)
+			}
+		}
+	}
+}
+
+func TestDownloadRequestValidate(t *testing.T) {
+	tests := []struct {
+		origin  gomatrixserverlib.ServerName
+		mediaID types.MediaID
+		valid   bool
+	}{
+		{"example.com", "abcDEF123_=-", true},
+		{"example.com:8448", "abc", true},
+		{"1.2.3.4:8448", "abc", true},
+		{"[::1]:8448", "abc", true},
+		{"example.com", "../../etc/passwd", false},
+		{"example.com", "abc/def", false},
+		{"example.com", "abc%2F..%2F..", false},
+		{"example.com", "abc%2fdef", false},
+		{"example.com", "..%5C..%5Cabc", false},
+		{"example.com", `..\abc`, false},
+		{"example.com", "abc\x00", false},
+		{"example.com", "", false},
+		{"..", "abc", false},
+		{".", "abc", false},
+		{"../example.com", "abc", false},
+		{"example.com/..", "abc", false},
+		{"example.com%2F..", "abc", false},
+		{"example..com", "abc", false},
+		{".example.com", "abc", false},
+		{":8448", "abc", false},
+		{"", "abc", false},
+	}
+	for _, tt := range tests {
+		r := &downloadRequest{
+			MediaMetadata: &types.MediaMetadata{
+				MediaID: tt.mediaID,
+				Origin:  tt.origin,
+			},
+		}
+		resErr := r.Validate(&config.MediaAPI{})
+		if tt.valid {
+			if resErr != nil {
+				t.Errorf("%q/%q: expected to be valid, got %+v", tt.origin, tt.mediaID, resErr.JSON)
+			}
+			continue
+		}
+		if resErr == nil {
+			t.Errorf("%q/%q: expected to be rejected", tt.origin, tt.mediaID)
+		} else if resErr.Code != http.StatusBadRequest {
+			t.Errorf("%q/%q: got status %d, want %d", tt.origin, tt.mediaID, resErr.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestThumbnailSizeLimits(t *testing.T) {
+	cfg := &config.MediaAPI{MaxThumbnailWidth: 800, MaxThumbnailHeight: 600}
+	for _, tt := range []struct {
+		width, height int
+		valid         bool
+	}{
+		{800, 600, true},
+		{1, 1, true},
+		{801, 600, false},
+		{800, 601, false},
+		{100000, 100000, false},
+	} {
+		r := &downloadRequest{
+			MediaMetadata:      &types.MediaMetadata{MediaID: "abc", Origin: "localhost"},
+			IsThumbnailRequest: true,
+			ThumbnailSize:      types.ThumbnailSize{Width: tt.width, Height: tt.height},
+		}
+		resErr := r.Validate(cfg)
+		if tt.valid && resErr != nil {
+			t.Errorf("%dx%d: expected to be valid, got %+v", tt.width, tt.height, resErr.JSON)
+		}
+		if !tt.valid && (resErr == nil || resErr.Code != http.StatusBadRequest) {
+			t.Errorf("%dx%d: expected to be rejected with %d, got %+v", tt.width, tt.height, http.StatusBadRequest, resErr)
+		}
+	}
+
+	// Without a limit any size may be asked for.
+	r := &downloadRequest{
+		MediaMetadata:      &types.MediaMetadata{MediaID: "abc", Origin: "localhost"},
+		IsThumbnailRequest: true,
+		ThumbnailSize:      types.ThumbnailSize{Width: 100000, Height: 100000},
+	}
+	if resErr := r.Validate(&config.MediaAPI{}); resErr != nil {
+		t.Errorf("no limit: expected to be valid, got %+v", resErr.JSON)
+	}
+
+	// Requests which are rejected before anything is looked up.
+	for _, query := range []string{
+		"width=100000&height=100000",
+		"width=801&height=32",
+		"width=abc&height=32",
+		"width=32&height=1.5",
+		"width=0&height=32",
+		"width=32&height=-32",
+		"width=32",
+		"",
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/thumbnail/localhost/abc?"+query, nil)
+		w := httptest.NewRecorder()
+		Download(w, req, "localhost", "abc", cfg, nil, nil, nil, nil, nil, nil, newMediaAccessTracker(), NewUserTrafficTracker(), true, "")
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%q: got status %d, want %d", query, w.Code, http.StatusBadRequest)
+			continue
+		}
+		var body jsonerror.MatrixError
+		if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil || body.ErrCode != "M_INVALID_ARGUMENT_VALUE" {
+			t.Errorf("%q: got body %q, want an M_INVALID_ARGUMENT_VALUE error", query, w.Body.String())
+		}
+	}
+}
+
+func TestThumbnailBackground(t *testing.T) {
+	for _, tt := range []struct {
+		method, background string
+		wantMethod         string
+		wantBackground     string
+		valid              bool
+	}{
+		{types.Pad, "", types.Pad, "00000000", true},
+		{types.Pad, "transparent", types.Pad, "00000000", true},
+		{types.Pad, "#FFFFFF", types.Pad, "ffffffff", true},
+		{types.Pad, "00000080", types.Pad, "00000080", true},
+		{"", "ff0000", types.Pad, "ff0000ff", true},
+		{types.Crop, "", types.Crop, "", true},
+		{types.Pad, "white", "", "", false},
+		{types.Pad, "#fff", "", "", false},
+		{types.Pad, "gggggg", "", "", false},
+		{types.Pad, "ff0000ff00", "", "", false},
+		{types.Crop, "ffffff", "", "", false},
+		{types.Scale, "transparent", "", "", false},
+		{"letterbox", "", "", "", false},
+	} {
+		r := &downloadRequest{
+			MediaMetadata:      &types.MediaMetadata{MediaID: "abc", Origin: "localhost"},
+			IsThumbnailRequest: true,
+			ThumbnailSize:      types.ThumbnailSize{Width: 32, Height: 32, ResizeMethod: tt.method, Background: tt.background},
+		}
+		resErr := r.Validate(&config.MediaAPI{})
+		if !tt.valid {
+			if resErr == nil || resErr.Code != http.StatusBadRequest {
+				t.Errorf("%q %q: expected to be rejected with %d, got %+v", tt.method, tt.background, http.StatusBadRequest, resErr)
+			}
+			continue
+		}
+		if resErr != nil {
+			t.Errorf("%q %q: expected to be valid, got %+v", tt.method, tt.background, resErr.JSON)
+			continue
+		}
+		if r.ThumbnailSize.ResizeMethod != tt.wantMethod || r.ThumbnailSize.Background != tt.wantBackground {
+			t.Errorf("%q %q: got method %q background %q, want %q %q", tt.method, tt.background,
+				r.ThumbnailSize.ResizeMethod, r.ThumbnailSize.Background, tt.wantMethod, tt.wantBackground)
+		}
+	}
+}
+
+func TestPaddedThumbnailSelection(t *testing.T) {
+	basePath, err := ioutil.TempDir("", "mediaapi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(basePath) // nolint: errcheck
+
+	original := []byte("the original image")
+	base64Hash := types.Base64Hash("paddedhash")
+	filePath, err := fileutils.GetPathFromBase64Hash(base64Hash, config.Path(basePath))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.MkdirAll(filepath.Dir(filePath), 0770); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(filePath, original, 0600); err != nil {
+		t.Fatal(err)
+	}
+	var thumbnails []*types.ThumbnailMetadata
+	for _, size := range []types.ThumbnailSize{
+		{Width: 32, Height: 32, ResizeMethod: types.Crop},
+		{Width: 32, Height: 32, ResizeMethod: types.Pad, Background: "00000000"},
+		{Width: 64, Height: 64, ResizeMethod: types.Pad, Background: "ffffffff"},
+	} {
+		content := []byte(fmt.Sprintf("%dx%d %s %s", size.Width, size.Height, size.ResizeMethod, size.Background))
+		thumbPath := thumbnailer.GetThumbnailPath(types.Path(filePath), size)
+		if err = ioutil.WriteFile(string(thumbPath), content, 0600); err != nil {
+			t.Fatal(err)
+		}
+		thumbnails = append(thumbnails, &types.ThumbnailMetadata{
+			MediaMetadata: &types.MediaMetadata{ContentType: "image/png", FileSizeBytes: types.FileSizeBytes(len(content))},
+			ThumbnailSize: size,
+		})
+	}
+	db := storedThumbnailsDatabase{thumbnails: thumbnails}
+
+	tests := []struct {
+		method, background string
+		want               string
+	}{
+		// Padded thumbnails are only served for the same background, even if another is closer in size.
+		{types.Pad, "", "32x32 pad 00000000"},
+		{types.Pad, "#ffffff", "64x64 pad ffffffff"},
+		{types.Pad, "ff0000", string(original)},
+		// Nor are they served for other methods.
+		{types.Crop, "", "32x32 crop "},
+		{types.Scale, "", string(original)},
+	}
+	for _, tt := range tests {
+		cfg := &config.MediaAPI{
+			Matrix:      &config.Global{ServerName: "localhost"},
+			AbsBasePath: config.Path(basePath),
+		}
+		r := &downloadRequest{
+			MediaMetadata: &types.MediaMetadata{
+				MediaID:       "abc",
+				Origin:        "localhost",
+				ContentType:   "image/png",
+				FileSizeBytes: types.FileSizeBytes(len(original)),
+				Base64Hash:    base64Hash,
+			},
+			IsThumbnailRequest: true,
+			ThumbnailSize:      types.ThumbnailSize{Width: 32, Height: 32, ResizeMethod: tt.method, Background: tt.background},
+			Logger:             util.GetLogger(context.Background()),
+		}
+		if resErr := r.Validate(cfg); resErr != nil {
+			t.Fatalf("%s %q: unexpected error response %+v", tt.method, tt.background, resErr)
+		}
+		w := httptest.NewRecorder()
+		if _, err = r.respondFromLocalFile(context.Background(), w, cfg, nil, db, nil); err != nil {
+			t.Fatalf("%s %q: unexpected error %v", tt.method, tt.background, err)
+		}
+		if got := w.Body.String(); got != tt.want {
+			t.Errorf("%s %q: got %q, want %q", tt.method, tt.background, got, tt.want)
+		}
+	}
+}
+
+func TestIfModifiedSince(t *testing.T) {
+	basePath, err := ioutil.TempDir("", "mediaapi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(basePath) // nolint: errcheck
+
+	content := []byte("some file content")
+	base64Hash := types.Base64Hash("ifmodifiedsincehash")
+	filePath, err := fileutils.GetPathFromBase64Hash(base64Hash, config.Path(basePath))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.MkdirAll(filepath.Dir(filePath), 0770); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(filePath, content, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := &config.MediaAPI{
+		Matrix:      &config.Global{ServerName: "localhost"},
+		AbsBasePath: config.Path(basePath),
+	}
+	// Stored part way through a second, which HTTP dates can't represent.
+	stored := time.Date(2020, 10, 1, 12, 0, 0, 500*int(time.Millisecond), time.UTC)
+	tests := []struct {
+		ifModifiedSince time.Time
+		wantCode        int
+	}{
+		{time.Time{}, http.StatusOK},
+		{stored.Add(-time.Hour), http.StatusOK},
+		{stored.Add(-time.Second), http.StatusOK},
+		{stored.Truncate(time.Second), http.StatusNotModified},
+		{stored.Add(time.Hour), http.StatusNotModified},
+	}
+	for _, tt := range tests {
+		r := &downloadRequest{
+			MediaMetadata: &types.MediaMetadata{
+				MediaID:           "abc",
+				Origin:            "localhost",
+				ContentType:       "text/plain",
+				FileSizeBytes:     types.FileSizeBytes(len(content)),
+				Base64Hash:        base64Hash,
+				CreationTimestamp: types.UnixMs(stored.UnixNano() / 1000000),
+			},
+			Logger:          util.GetLogger(context.Background()),
+			IfModifiedSince: tt.ifModifiedSince,
+		}
+		w := httptest.NewRecorder()
+		if _, err = r.respondFromLocalFile(context.Background(), w, cfg, nil, nil, nil); err != nil {
+			t.Fatalf("If-Modified-Since %v: unexpected error %v", tt.ifModifiedSince, err)
+		}
+		if w.Code != tt.wantCode {
+			t.Errorf("If-Modified-Since %v: got status %d, want %d", tt.ifModifiedSince, w.Code, tt.wantCode)
+		}
+		if got, want := w.Header().Get("Last-Modified"), "Thu, 01 Oct 2020 12:00:00 GMT"; got != want {
+			t.Errorf("If-Modified-Since %v: got Last-Modified %q, want %q", tt.ifModifiedSince, got, want)
+		}
+		if tt.wantCode == http.StatusNotModified && w.Body.Len() != 0 {
+			t.Errorf("If-Modified-Since %v: expected no body with 304", tt.ifModifiedSince)
+		}
+	}
+}
+
+func TestThumbnailOverflowResponse(t *testing.T) {
+	basePath, err := ioutil.TempDir("", "mediaapi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(basePath) // nolint: errcheck
+
+	original := []byte("the original image")
+	base64Hash := types.Base64Hash("thumbnaillimithash")
+	filePath, err := fileutils.GetPathFromBase64Hash(base64Hash, config.Path(basePath))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.MkdirAll(filepath.Dir(filePath), 0770); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(filePath, original, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// Store thumbnails whose contents say which size they are.
+	var thumbnails []*types.ThumbnailMetadata
+	for _, size := range []types.ThumbnailSize{
+		{Width: 32, Height: 32, ResizeMethod: types.Crop},
+		{Width: 128, Height: 128, ResizeMethod: types.Crop},
+		{Width: 800, Height: 600, ResizeMethod: types.Scale},
+	} {
+		content := []byte(fmt.Sprintf("%dx%d %s", size.Width, size.Height, size.ResizeMethod))
+		thumbPath := thumbnailer.GetThumbnailPath(types.Path(filePath), size)
+		if err = ioutil.WriteFile(string(thumbPath), content, 0600); err != nil {
+			t.Fatal(err)
+		}
+		thumbnails = append(thumbnails, &types.ThumbnailMetadata{
+			MediaMetadata: &types.MediaMetadata{
+				ContentType:   "image/png",
+				FileSizeBytes: types.FileSizeBytes(len(content)),
+			},
+			ThumbnailSize: size,
+		})
+	}
+	db := storedThumbnailsDatabase{thumbnails: thumbnails}
+
+	tests := []struct {
+		response string
+		want     string
+	}{
+		{config.ThumbnailOverflowNearest, "128x128 crop"},
+		{config.ThumbnailOverflowLargest, "800x600 scale"},
+		{config.ThumbnailOverflowOriginal, string(original)},
+	}
+	for _, tt := range tests {
+		cfg := &config.MediaAPI{
+			Matrix:                    &config.Global{ServerName: "localhost"},
+			AbsBasePath:               config.Path(basePath),
+			DynamicThumbnails:         true,
+			MaxThumbnailGenerators:    1,
+			MaxThumbnailsPerMedia:     len(thumbnails),
+			ThumbnailOverflowResponse: tt.response,
+			ThumbnailFailureResponse:  config.ThumbnailFailureError,
+		}
+		r := &downloadRequest{
+			MediaMetadata: &types.MediaMetadata{
+				MediaID:       "abc",
+				Origin:        "localhost",
+				ContentType:   "image/png",
+				FileSizeBytes: types.FileSizeBytes(len(original)),
+				Base64Hash:    base64Hash,
+			},
+			IsThumbnailRequest: true,
+			ThumbnailSize:      types.ThumbnailSize{Width: 100, Height: 100, ResizeMethod: types.Crop},
+			Logger:             util.GetLogger(context.Background()),
+		}
+		activeThumbnailGeneration := &types.ActiveThumbnailGeneration{
+			PathToResult: map[string]*types.ThumbnailGenerationResult{},
+		}
+		w := httptest.NewRecorder()
+		if _, err = r.respondFromLocalFile(context.Background(), w, cfg, activeThumbnailGeneration, db, nil); err != nil {
+			t.Fatalf("%s: unexpected error %v", tt.response, err)
+		}
+		if got := w.Body.String(); got != tt.want {
+			t.Errorf("%s: got response %q, want %q", tt.response, got, tt.want)
+		}
+		thumbPath := thumbnailer.GetThumbnailPath(types.Path(filePath), r.ThumbnailSize)
+		if _, err = os.Stat(string(thumbPath)); !os.IsNotExist(err) {
+			t.Errorf("%s: expected no thumbnail to be generated for the requested size", tt.response)
+		}
+	}
+
+	// Sizes which are already stored, and the pre-generated sizes, can still be generated.
+	r := &downloadRequest{
+		MediaMetadata: &types.MediaMetadata{MediaID: "abc", Origin: "localhost"},
+		Logger:        util.GetLogger(context.Background()),
+	}
+	for _, size := range []types.ThumbnailSize{
+		{Width: 128, Height: 128, ResizeMethod: types.Crop},
+		{Width: 96, Height: 96, ResizeMethod: types.Crop},
+	} {
+		r.ThumbnailSize = size
+		var overLimit bool
+		overLimit, _, err = r.thumbnailOverLimit(
+			context.Background(), db, []config.ThumbnailSize{{Width: 96, Height: 96, ResizeMethod: types.Crop}},
+			len(thumbnails), config.ThumbnailOverflowNearest,
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if overLimit {
+			t.Errorf("%dx%d %s: expected not to be over the limit", size.Width, size.Height, size.ResizeMethod)
+		}
+	}
+}
+
+func TestAddDownloadFilenameToHeaders(t *testing.T) {
+	tests := []struct {
+		filename string
+		want     string
+	}{
+		{"cat.png", `attachment; filename=cat.png`},
+		{"my cat.png", `attachment; filename="my cat.png"`},
+		{"cats, dogs.png", `attachment; filename="cats, dogs.png"`},
+		{`"quoted" \ name.txt`, `attachment; filename="\"quoted\" \\ name.txt"`},
+		{"€ rates.txt", `attachment; filename="_ rates.txt"; filename*=utf-8''%E2%82%AC%20rates.txt`},
+		{"кошка, 猫.png", `attachment; filename="_____, _.png"; filename*=utf-8''%D0%BA%D0%BE%D1%88%D0%BA%D0%B0%2C%20%E7%8C%AB.png`},
+	}
+	for _, tt := range tests {
+		r := &downloadRequest{}
+		w := httptest.NewRecorder()
+		metadata := &types.MediaMetadata{UploadName: types.Filename(url.PathEscape(tt.filename))}
+		if err := r.addDownloadFilenameToHeaders(w, metadata, "attachment", false); err != nil {
+			t.Fatalf("%q: unexpected error %v", tt.filename, err)
+		}
+		header := w.Header().Get("Content-Disposition")
+		if header != tt.want {
+			t.Errorf("%q: got Content-Disposition %q, want %q", tt.filename, header, tt.want)
+		}
+		// A client which understands filename* gets the original name back.
+		_, params, err := mime.ParseMediaType(header)
+		if err != nil {
+			t.Errorf("%q: failed to parse Content-Disposition %q: %v", tt.filename, header, err)
+			continue
+		}
+		if params["filename"] != tt.filename {
+			t.Errorf("%q: Content-Disposition %q gives filename %q", tt.filename, header, params["filename"])
+		}
+	}
+}
+
+func TestAddDownloadFilenameToHeadersDefault(t *testing.T) {
+	r := &downloadRequest{MediaMetadata: &types.MediaMetadata{MediaID: "abcd1234"}}
+	metadata := &types.MediaMetadata{ContentType: "image/png"}
+	for _, tt := range []struct {
+		defaultUploadNames bool
+		downloadFilename   string
+		want               string
+	}{
+		{false, "", "attachment"},
+		{true, "", "attachment; filename=abcd1234.png"},
+		{true, "cat.png", "attachment; filename=cat.png"},
+	} {
+		r.DownloadFilename = tt.downloadFilename
+		w := httptest.NewRecorder()
+		if err := r.addDownloadFilenameToHeaders(w, metadata, "attachment", tt.defaultUploadNames); err != nil {
+			t.Fatal(err)
+		}
+		if header := w.Header().Get("Content-Disposition"); header != tt.want {
+			t.Errorf("default names %v, download name %q: got Content-Disposition %q, want %q", tt.defaultUploadNames, tt.downloadFilename, header, tt.want)
+		}
+	}
+}
+
+func TestDefaultThumbnailMethod(t *testing.T) {
+	basePath, err := ioutil.TempDir("", "mediaapi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(basePath) // nolint: errcheck
+
+	original := []byte("the original image")
+	base64Hash := types.Base64Hash("defaultmethodhash")
+	filePath, err := fileutils.GetPathFromBase64Hash(base64Hash, config.Path(basePath))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.MkdirAll(filepath.Dir(filePath), 0770); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(filePath, original, 0600); err != nil {
+		t.Fatal(err)
+	}
+	var thumbnails []*types.ThumbnailMetadata
+	for _, method := range []string{types.Crop, types.Scale} {
+		size := types.ThumbnailSize{Width: 32, Height: 32, ResizeMethod: method}
+		thumbPath := thumbnailer.GetThumbnailPath(types.Path(filePath), size)
+		if err = ioutil.WriteFile(string(thumbPath), []byte(method), 0600); err != nil {
+			t.Fatal(err)
+		}
+		thumbnails = append(thumbnails, &types.ThumbnailMetadata{
+			MediaMetadata: &types.MediaMetadata{ContentType: "image/png", FileSizeBytes: types.FileSizeBytes(len(method))},
+			ThumbnailSize: size,
+		})
+	}
+	db := storedThumbnailsDatabase{thumbnails: thumbnails}
+
+	tests := []struct {
+		contentType types.ContentType
+		method      string
+		want        string
+	}{
+		{"image/png", "", types.Scale},
+		{"image/gif", "", types.Crop},
+		{"image/gif", types.Scale, types.Scale},
+	}
+	for _, tt := range tests {
+		// Without dynamic thumbnails, the stored thumbnail with the method is served.
+		cfg := &config.MediaAPI{
+			Matrix:                        &config.Global{ServerName: "localhost"},
+			AbsBasePath:                   config.Path(basePath),
+			DefaultThumbnailMethod:        types.Scale,
+			ThumbnailMethodsByContentType: map[string]string{"image/gif": types.Crop},
+		}
+		r := &downloadRequest{
+			MediaMetadata: &types.MediaMetadata{
+				MediaID:       "abc",
+				Origin:        "localhost",
+				ContentType:   tt.contentType,
+				FileSizeBytes: types.FileSizeBytes(len(original)),
+				Base64Hash:    base64Hash,
+			},
+			IsThumbnailRequest: true,
+			ThumbnailSize:      types.ThumbnailSize{Width: 32, Height: 32, ResizeMethod: tt.method},
+			Logger:             util.GetLogger(context.Background()),
+		}
+		if resErr := r.Validate(cfg); resErr != nil {
+			t.Fatalf("%s %q: unexpected error response %+v", tt.contentType, tt.method, resErr)
+		}
+		w := httptest.NewRecorder()
+		if _, err = r.respondFromLocalFile(context.Background(), w, cfg, nil, db, nil); err != nil {
+			t.Fatalf("%s %q: unexpected error %v", tt.contentType, tt.method, err)
+		}
+		if got := w.Body.String(); got != tt.want {
+			t.Errorf("%s %q: got %s thumbnail, want %s", tt.contentType, tt.method, got, tt.want)
+		}
+	}
+}
+
+func TestDownloadScopedToOrigin(t *testing.T) {
+	db, basePath, cleanup := newTestDatabase(t)
+	defer cleanup()
+	cfg := &config.MediaAPI{
+		Matrix:      &config.Global{ServerName: "a.example"},
+		AbsBasePath: basePath,
+	}
+	ctx := context.Background()
+
+	// Each server has different media with the same media ID, and only the media
+	// from a.example has a thumbnail.
+	for _, origin := range []gomatrixserverlib.ServerName{"a.example", "b.example"} {
+		storeTestContent(t, db, basePath, origin, "abc", "text/plain", "media from "+string(origin))
+	}
+	thumbnail := []byte("thumbnail from a.example")
+	thumbnailSize := types.ThumbnailSize{Width: 32, Height: 32, ResizeMethod: types.Crop}
+	if err := db.StoreThumbnail(ctx, &types.ThumbnailMetadata{
+		MediaMetadata: &types.MediaMetadata{
+			MediaID: "abc", Origin: "a.example", ContentType: "image/png", FileSizeBytes: types.FileSizeBytes(len(thumbnail)),
+		},
+		ThumbnailSize: thumbnailSize,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	filePath, err := fileutils.GetPathFromBase64Hash("a.exampleabc", basePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(string(thumbnailer.GetThumbnailPath(types.Path(filePath), thumbnailSize)), thumbnail, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		origin      gomatrixserverlib.ServerName
+		isThumbnail bool
+		want        string
+	}{
+		{"a.example", false, "media from a.example"},
+		{"b.example", false, "media from b.example"},
+		{"a.example", true, "thumbnail from a.example"},
+		{"b.example", true, "media from b.example"},
+	}
+	for _, tt := range tests {
+		target := "/download/" + string(tt.origin) + "/abc"
+		if tt.isThumbnail {
+			target = "/thumbnail/" + string(tt.origin) + "/abc?width=32&height=32&method=crop"
+		}
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		w := httptest.NewRecorder()
+		Download(
+			w, req, tt.origin, "abc", cfg, db, nil,
+			&types.ActiveRemoteRequests{MXCToResult: map[string]*types.RemoteRequestResult{}},
+			&types.ActiveThumbnailGeneration{PathToResult: map[string]*types.ThumbnailGenerationResult{}},
+			nil, nil, newMediaAccessTracker(), NewUserTrafficTracker(), tt.isThumbnail, "",
+		)
+		if w.Code != http.StatusOK {
+			t.Errorf("%s: got status %d, want %d", target, w.Code, http.StatusOK)
+			continue
+		}
+		if got := w.Body.String(); got != tt.want {
+			t.Errorf("%s: got %q, want %q", target, got, tt.want)
+		}
+	}
+}
+
+// newTestDatabase opens a database in a new temporary directory, which also has the
+// returned path to use as the media store in. The returned function removes the
+// directory once the test is done with them.
+func newTestDatabase(t *testing.T) (storage.Database, config.Path, func()) {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "mediaapi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := storage.Open(&config.DatabaseOptions{
+		ConnectionString: config.DataSource("file:" + filepath.Join(dir, "mediaapi.db")),
+	})
+	if err != nil {
+		os.RemoveAll(dir) // nolint: errcheck
+		t.Fatal(err)
+	}
+	return db, config.Path(filepath.Join(dir, "media_store")), func() {
+		os.RemoveAll(dir) // nolint: errcheck
+	}
+}
+
+// storeTestContent stores media with the given content, using the origin and media ID
+// as its hash.
+func storeTestContent(
+	t *testing.T, db storage.Database, basePath config.Path,
+	origin gomatrixserverlib.ServerName, mediaID types.MediaID, contentType types.ContentType, content string,
+) {
+	t.Helper()
+	hash := types.Base64Hash(string(origin) + string(mediaID))
+	if err := db.StoreMediaMetadata(context.Background(), &types.MediaMetadata{
+		MediaID:       mediaID,
+		Origin:        origin,
+		ContentType:   contentType,
+		FileSizeBytes: types.FileSizeBytes(len(content)),
+		Base64Hash:    hash,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	filePath, err := fileutils.GetPathFromBase64Hash(hash, basePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.MkdirAll(filepath.Dir(filePath), 0770); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(filePath, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestInlineContentTypes(t *testing.T) {
+	db, basePath, cleanup := newTestDatabase(t)
+	defer cleanup()
+	cfg := &config.MediaAPI{
+		Matrix:             &config.Global{ServerName: "localhost"},
+		AbsBasePath:        basePath,
+		SanitizeSVGs:       true,
+		InlineContentTypes: []string{"image/png", "video/*"},
+	}
+
+	tests := []struct {
+		mediaID     types.MediaID
+		contentType types.ContentType
+		want        string
+	}{
+		{"png", "image/png", "inline; filename=name.txt"},
+		{"mp4", "video/mp4", "inline; filename=name.txt"},
+		{"html", "text/html", "attachment; filename=name.txt"},
+		{"svg", "image/svg+xml", "attachment; filename=name.txt"},
+	}
+	for _, tt := range tests {
+		storeTestContent(t, db, basePath, "localhost", tt.mediaID, tt.contentType, "content")
+		req := httptest.NewRequest(http.MethodGet, "/download/localhost/"+string(tt.mediaID)+"/name.txt", nil)
+		w := httptest.NewRecorder()
+		Download(
+			w, req, "localhost", tt.mediaID, cfg, db, nil,
+			&types.ActiveRemoteRequests{MXCToResult: map[string]*types.RemoteRequestResult{}},
+			&types.ActiveThumbnailGeneration{PathToResult: map[string]*types.ThumbnailGenerationResult{}},
+			nil, nil, newMediaAccessTracker(), NewUserTrafficTracker(), false, "name.txt",
+		)
+		if w.Code != http.StatusOK {
+			t.Errorf("%s: got status %d, want %d", tt.contentType, w.Code, http.StatusOK)
+			continue
+		}
+		if got := w.Header().Get("Content-Disposition"); got != tt.want {
+			t.Errorf("%s: got Content-Disposition %q, want %q", tt.contentType, got, tt.want)
+		}
+	}
+}
+
+func TestAttachmentContentTypes(t *testing.T) {
+	db, basePath, cleanup := newTestDatabase(t)
+	defer cleanup()
+	maxFileSizeBytes := config.FileSizeBytes(1024)
+	cfg := &config.MediaAPI{
+		Matrix:                         &config.Global{ServerName: "localhost"},
+		AbsBasePath:                    basePath,
+		MaxFileSizeBytes:               &maxFileSizeBytes,
+		SanitizeSVGs:                   true,
+		InlineContentTypes:             []string{"image/*", "text/*"},
+		AttachmentContentTypes:         []string{"text/html", "image/svg+xml"},
+		PreferClientContentDisposition: true,
+	}
+
+	tests := []struct {
+		contentType string
+		content     string
+		want        string
+	}{
+		{"image/png", "png", "inline; filename=name"},
+		{"text/plain", "text", "inline; filename=name"},
+		{"text/html; charset=utf-8", "<p>html</p>", "attachment; filename=name"},
+		{"image/svg+xml", `<svg xmlns="http://www.w3.org/2000/svg"/>`, "attachment; filename=name"},
+	}
+	for _, tt := range tests {
+		// The uploader asking for the media to be shown inline makes no difference.
+		req := httptest.NewRequest(http.MethodPost, "/upload", strings.NewReader(tt.content))
+		req.Header.Set("Content-Type", tt.contentType)
+		req.Header.Set("Content-Disposition", `inline; filename="name"`)
+		res := Upload(req, cfg, &userapi.Device{UserID: "@alice:localhost"}, db, &types.ActiveThumbnailGeneration{
+			PathToResult: map[string]*types.ThumbnailGenerationResult{},
+		}, nil, nil)
+		if res.Code != http.StatusOK {
+			t.Fatalf("%s: upload got status %d, want %d", tt.contentType, res.Code, http.StatusOK)
+		}
+		mediaID := types.MediaID(strings.TrimPrefix(res.JSON.(uploadResponse).ContentURI, "mxc://localhost/"))
+
+		w := httptest.NewRecorder()
+		Download(
+			w, httptest.NewRequest(http.MethodGet, "/download/localhost/"+string(mediaID), nil),
+			"localhost", mediaID, cfg, db, nil,
+			&types.ActiveRemoteRequests{MXCToResult: map[string]*types.RemoteRequestResult{}},
+			&types.ActiveThumbnailGeneration{PathToResult: map[string]*types.ThumbnailGenerationResult{}},
+			nil, nil, newMediaAccessTracker(), NewUserTrafficTracker(), false, "",
+		)
+		if w.Code != http.StatusOK {
+			t.Errorf("%s: download got status %d, want %d", tt.contentType, w.Code, http.StatusOK)
+			continue
+		}
+		if got := w.Header().Get("Content-Disposition"); got != tt.want {
+			t.Errorf("%s: got Content-Disposition %q, want %q", tt.contentType, got, tt.want)
+		}
+	}
+}
+
+func TestPreferClientContentDisposition(t *testing.T) {
+	db, basePath, cleanup := newTestDatabase(t)
+	defer cleanup()
+	maxFileSizeBytes := config.FileSizeBytes(1024)
+	for _, prefer := range []bool{false, true} {
+		cfg := &config.MediaAPI{
+			Matrix:                         &config.Global{ServerName: "localhost"},
+			AbsBasePath:                    basePath,
+			MaxFileSizeBytes:               &maxFileSizeBytes,
+			InlineContentTypes:             []string{"image/png"},
+			PreferClientContentDisposition: prefer,
+		}
+		tests := []struct {
+			query       string
+			contentType string
+			disposition string
+			want        string
+			wantPrefer  string
+		}{
+			{"?filename=query.txt", "text/plain", `inline; filename="notes.txt"`, "attachment; filename=query.txt", "inline; filename=notes.txt"},
+			{"?filename=query.txt", "text/plain", "inline", "attachment; filename=query.txt", "inline; filename=query.txt"},
+			{"", "image/png", "attachment", "", "attachment"},
+			{"", "image/png", `attachment; filename="cat.png"`, "inline; filename=cat.png", "attachment; filename=cat.png"},
+			{"", "image/png", "", "", ""},
+			{"", "image/png", "not a disposition", "", ""},
+		}
+		for i, tt := range tests {
+			req := httptest.NewRequest(http.MethodPost, "/upload"+tt.query, strings.NewReader(fmt.Sprintf("content %t %d", prefer, i)))
+			req.Header.Set("Content-Type", tt.contentType)
+			req.Header.Set("Content-Disposition", tt.disposition)
+			res := Upload(req, cfg, &userapi.Device{UserID: "@alice:localhost"}, db, &types.ActiveThumbnailGeneration{
+				PathToResult: map[string]*types.ThumbnailGenerationResult{},
+			}, nil, nil)
+			if res.Code != http.StatusOK {
+				t.Fatalf("upload: got status %d, want %d", res.Code, http.StatusOK)
+			}
+			mediaID := types.MediaID(strings.TrimPrefix(res.JSON.(uploadResponse).ContentURI, "mxc://localhost/"))
+
+			w := httptest.NewRecorder()
+			Download(
+				w, httptest.NewRequest(http.MethodGet, "/download/localhost/"+string(mediaID), nil),
+				"localhost", mediaID, cfg, db, nil,
+				&types.ActiveRemoteRequests{MXCToResult: map[string]*types.RemoteRequestResult{}},
+				&types.ActiveThumbnailGeneration{PathToResult: map[string]*types.ThumbnailGenerationResult{}},
+				nil, nil, newMediaAccessTracker(), NewUserTrafficTracker(), false, "",
+			)
+			want := tt.want
+			if prefer {
+				want = tt.wantPrefer
+			}
+			if got := w.Header().Get("Content-Disposition"); got != want {
+				t.Errorf("prefer %t, %s %q: got Content-Disposition %q, want %q", prefer, tt.query, tt.disposition, got, want)
+			}
+		}
+	}
+}
+
+func TestForceAttachment(t *testing.T) {
+	db, basePath, cleanup := newTestDatabase(t)
+	defer cleanup()
+	cfg := &config.MediaAPI{
+		Matrix:             &config.Global{ServerName: "localhost"},
+		AbsBasePath:        basePath,
+		InlineContentTypes: []string{"image/png"},
+	}
+	storeTestContent(t, db, basePath, "localhost", "abcd1234", "image/png", "content")
+
+	tests := []struct {
+		query        string
+		downloadName string
+		want         string
+	}{
+		{"", "", ""},
+		{"", "cat.png", "inline; filename=cat.png"},
+		{"?download=false", "cat.png", "inline; filename=cat.png"},
+		{"?download=true", "cat.png", "attachment; filename=cat.png"},
+		{"?download=TRUE", "my cat.png", `attachment; filename="my cat.png"`},
+		{"?download=true", "кошка.png", `attachment; filename=_____.png; filename*=utf-8''%D0%BA%D0%BE%D1%88%D0%BA%D0%B0.png`},
+		{"?download=true", "../../secrets/cat.png", "attachment; filename=cat.png"},
+		{"?download=true", "cat\x00.png", "attachment; filename=abcd1234.png"},
+		{"?download=true", "", "attachment; filename=abcd1234.png"},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/download/localhost/abcd1234"+tt.query, nil)
+		w := httptest.NewRecorder()
+		Download(
+			w, req, "localhost", "abcd1234", cfg, db, nil,
+			&types.ActiveRemoteRequests{MXCToResult: map[string]*types.RemoteRequestResult{}},
+			&types.ActiveThumbnailGeneration{PathToResult: map[string]*types.ThumbnailGenerationResult{}},
+			nil, nil, newMediaAccessTracker(), NewUserTrafficTracker(), false, tt.downloadName,
+		)
+		if w.Code != http.StatusOK {
+			t.Errorf("%s %q: got status %d, want %d", tt.query, tt.downloadName, w.Code, http.StatusOK)
+			continue
+		}
+		if got := w.Header().Get("Content-Disposition"); got != tt.want {
+			t.Errorf("%s %q: got Content-Disposition %q, want %q", tt.query, tt.downloadName, got, tt.want)
+		}
+	}
+}
+
+func TestHeadDownload(t *testing.T) {
+	db, basePath, cleanup := newTestDatabase(t)
+	defer cleanup()
+	cfg := &config.MediaAPI{
+		Matrix:                 &config.Global{ServerName: "localhost"},
+		AbsBasePath:            basePath,
+		DynamicThumbnails:      true,
+		MaxThumbnailGenerators: 10,
+		MaxThumbnailsPerMedia:  16,
+	}
+	storeTestContent(t, db, basePath, "localhost", "abcd1234", "text/plain", "content")
+	var original bytes.Buffer
+	if err := png.Encode(&original, image.NewRGBA(image.Rect(0, 0, 200, 100))); err != nil {
+		t.Fatal(err)
+	}
+	storeTestContent(t, db, basePath, "localhost", "image", "image/png", original.String())
+	activeThumbnailGeneration := &types.ActiveThumbnailGeneration{
+		PathToResult: map[string]*types.ThumbnailGenerationResult{},
+	}
+
+	download := func(method string, mediaID types.MediaID, isThumbnailRequest bool, ifNoneMatch string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/download/localhost/"+string(mediaID)+"?width=32&height=32&method=scale", nil)
+		if ifNoneMatch != "" {
+			req.Header.Set("If-None-Match", ifNoneMatch)
+		}
+		w := httptest.NewRecorder()
+		Download(
+			w, req, "localhost", mediaID, cfg, db, nil,
+			&types.ActiveRemoteRequests{MXCToResult: map[string]*types.RemoteRequestResult{}},
+			activeThumbnailGeneration, nil, nil, newMediaAccessTracker(), NewUserTrafficTracker(), isThumbnailRequest, "cat.txt",
+		)
+		return w
+	}
+	compare := func(name string, get, head *httptest.ResponseRecorder) {
+		if get.Code != http.StatusOK || head.Code != http.StatusOK {
+			t.Fatalf("%s: got status %d for GET and %d for HEAD, want %d", name, get.Code, head.Code, http.StatusOK)
+		}
+		if head.Body.Len() != 0 {
+			t.Errorf("%s: HEAD got a %d byte body, want none", name, head.Body.Len())
+		}
+		for _, header := range []string{"Content-Type", "Content-Length", "ETag", "Last-Modified"} {
+			if got, want := head.Header().Get(header), get.Header().Get(header); got != want || got == "" {
+				t.Errorf("%s: HEAD got %s %q, want %q as for GET", name, header, got, want)
+			}
+		}
+	}
+
+	get := download(http.MethodGet, "abcd1234", false, "")
+	compare("download", get, download(http.MethodHead, "abcd1234", false, ""))
+	if got := get.Header().Get("Content-Disposition"); got == "" {
+		t.Error("download: missing Content-Disposition")
+	}
+	for _, ifNoneMatch := range []string{get.Header().Get("ETag"), `"other", W/` + get.Header().Get("ETag"), "*"} {
+		if w := download(http.MethodGet, "abcd1234", false, ifNoneMatch); w.Code != http.StatusNotModified || w.Body.Len() != 0 {
+			t.Errorf("If-None-Match %s: got status %d and a %d byte body, want %d and none", ifNoneMatch, w.Code, w.Body.Len(), http.StatusNotModified)
+		}
+	}
+	if w := download(http.MethodGet, "abcd1234", false, `"other"`); w.Code != http.StatusOK {
+		t.Errorf("If-None-Match with another tag: got status %d, want %d", w.Code, http.StatusOK)
+	}
+	if w := download(http.MethodHead, "missing", false, ""); w.Code != http.StatusNotFound {
+		t.Errorf("HEAD for unknown media: got status %d, want %d", w.Code, http.StatusNotFound)
+	}
+
+	// Asking about a thumbnail doesn't generate it, so there's only the original to
+	// answer with until a GET has.
+	head := download(http.MethodHead, "image", true, "")
+	if head.Code != http.StatusOK || head.Header().Get("Content-Length") != strconv.Itoa(original.Len()) {
+		t.Errorf("HEAD for a thumbnail which doesn't exist: got status %d and Content-Length %q, want %d and the original's %d",
+			head.Code, head.Header().Get("Content-Length"), http.StatusOK, original.Len())
+	}
+	thumbnails, err := db.GetThumbnails(context.Background(), "image", "localhost")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(thumbnails) != 0 {
+		t.Errorf("HEAD generated %d thumbnails", len(thumbnails))
+	}
+	get = download(http.MethodGet, "image", true, "")
+	compare("thumbnail", get, download(http.MethodHead, "image", true, ""))
+	if get.Header().Get("ETag") == head.Header().Get("ETag") {
+		t.Errorf("the thumbnail has the same ETag as the original, %s", head.Header().Get("ETag"))
+	}
+}
+
+func TestAttachmentFilename(t *testing.T) {
+	for _, tt := range []struct {
+		downloadFilename string
+		uploadName       types.Filename
+		want             string
+	}{
+		{"cat.png", "dog.png", "cat.png"},
+		{"", "dog.png", "dog.png"},
+		{"", "my%20dog.png", "my%20dog.png"},
+		{"%zz", "dog.png", "dog.png"},
+		{"..", "", "abcd1234.png"},
+		{"", "", "abcd1234.png"},
+	} {
+		r := &downloadRequest{
+			MediaMetadata:    &types.MediaMetadata{MediaID: "abcd1234"},
+			DownloadFilename: tt.downloadFilename,
+		}
+		metadata := &types.MediaMetadata{ContentType: "image/png", UploadName: tt.uploadName}
+		if got := r.attachmentFilename(metadata); got != tt.want {
+			t.Errorf("download name %q, upload name %q: got %q, want %q", tt.downloadFilename, tt.uploadName, got, tt.want)
+		}
+	}
+}
+
+func TestGzipDownloads(t *testing.T) {
+	db, basePath, cleanup := newTestDatabase(t)
+	defer cleanup()
+	cfg := &config.MediaAPI{
+		Matrix:      &config.Global{ServerName: "localhost"},
+		AbsBasePath: basePath,
+		GzipDownloads: config.GzipDownloads{
+			Enabled:      true,
+			ContentTypes: []string{"text/*", "image/*"},
+		},
+	}
+	content := strings.Repeat("compressible ", 100)
+	storeTestContent(t, db, basePath, "localhost", "text", "text/plain", content)
+	storeTestContent(t, db, basePath, "localhost", "png", "image/png", content)
+
+	tests := []struct {
+		name           string
+		mediaID        types.MediaID
+		acceptEncoding string
+		ranged         bool
+		wantGzip       bool
+	}{
+		{"text", "text", "gzip, deflate", false, true},
+		{"text without gzip", "text", "deflate", false, false},
+		{"text with a range", "text", "gzip", true, false},
+		{"image", "png", "gzip", false, false},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/download/localhost/"+string(tt.mediaID), nil)
+		req.Header.Set("Accept-Encoding", tt.acceptEncoding)
+		if tt.ranged {
+			req.Header.Set("Range", "bytes=0-9")
+		}
+		w := httptest.NewRecorder()
+		Download(
+			w, req, "localhost", tt.mediaID, cfg, db, nil,
+			&types.ActiveRemoteRequests{MXCToResult: map[string]*types.RemoteRequestResult{}},
+			&types.ActiveThumbnailGeneration{PathToResult: map[string]*types.ThumbnailGenerationResult{}},
+			nil, nil, newMediaAccessTracker(), NewUserTrafficTracker(), false, "",
+		)
+		if w.Code != http.StatusOK {
+			t.Errorf("%s: got status %d, want %d", tt.name, w.Code, http.StatusOK)
+			continue
+		}
+		body := w.Body.Bytes()
+		if tt.wantGzip {
+			if got := w.Header().Get("Content-Encoding"); got != "gzip" {
+				t.Errorf("%s: got Content-Encoding %q, want gzip", tt.name, got)
+			}
+			if got := w.Header().Get("Content-Length"); got != "" {
+				t.Errorf("%s: got Content-Length %s for a gzipped response", tt.name, got)
+			}
+			gzipReader, err := gzip.NewReader(bytes.NewReader(body))
+			if err != nil {
+				t.Errorf("%s: response isn't gzipped: %s", tt.name, err)
+				continue
+			}
+			if body, err = ioutil.ReadAll(gzipReader); err != nil {
+				t.Errorf("%s: failed to decompress response: %s", tt.name, err)
+				continue
+			}
+		} else {
+			if got := w.Header().Get("Content-Encoding"); got != "" {
+				t.Errorf("%s: got Content-Encoding %q, want none", tt.name, got)
+			}
+			if got := w.Header().Get("Content-Length"); got != strconv.Itoa(len(content)) {
+				t.Errorf("%s: got Content-Length %s, want %d", tt.name, got, len(content))
+			}
+		}
+		if string(body) != content {
+			t.Errorf("%s: got content %q, want %q", tt.name, body, content)
+		}
+	}
+}
+
+func TestAcceptsGzip(t *testing.T) {
+	tests := []struct {
+		header string
+		want   bool
+	}{
+		{"", false},
+		{"gzip", true},
+		{"deflate, GZIP;q=0.5", true},
+		{"gzip;q=0", false},
+		{"gzip; q=0.0", false},
+		{"*", true},
+		{"*;q=0", false},
+		{"gzip, *;q=0", true},
+		{"gzip;q=0, *", false},
+		{"identity", false},
+	}
+	for _, tt := range tests {
+		if got := acceptsGzip(tt.header); got != tt.want {
+			t.Errorf("%q: got %v, want %v", tt.header, got, tt.want)
+		}
+	}
+}
+
+func TestPDFThumbnails(t *testing.T) {
+	db, basePath, cleanup := newTestDatabase(t)
+	defer cleanup()
+	// The renderer is kept in the test's directory, next to the media store.
+	dir := filepath.Dir(string(basePath))
+
+	// Stand in for pdftoppm with a script which always renders the same page.
+	pagePath := filepath.Join(dir, "page.png")
+	var page bytes.Buffer
+	if err := png.Encode(&page, image.NewRGBA(image.Rect(0, 0, 60, 80))); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(pagePath, page.Bytes(), 0600); err != nil {
+		t.Fatal(err)
+	}
+	renderer := filepath.Join(dir, "renderer")
+	if err := ioutil.WriteFile(renderer, []byte("#!/bin/sh\ncat > /dev/null\ncat "+pagePath+"\n"), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := &config.MediaAPI{
+		Matrix:                   &config.Global{ServerName: "localhost"},
+		AbsBasePath:              basePath,
+		DynamicThumbnails:        true,
+		MaxThumbnailGenerators:   10,
+		MaxThumbnailsPerMedia:    16,
+		ThumbnailFailureResponse: config.ThumbnailFailureNotFound,
+	}
+	thumbnail := func(mediaID types.MediaID) *httptest.ResponseRecorder {
+		storeTestContent(t, db, basePath, "localhost", mediaID, "application/pdf", "%PDF-1.4")
+		req := httptest.NewRequest(http.MethodGet, "/thumbnail/localhost/"+string(mediaID)+"?width=32&height=32&method=crop", nil)
+		w := httptest.NewRecorder()
+		Download(
+			w, req, "localhost", mediaID, cfg, db, nil,
+			&types.ActiveRemoteRequests{MXCToResult: map[string]*types.RemoteRequestResult{}},
+			&types.ActiveThumbnailGeneration{PathToResult: map[string]*types.ThumbnailGenerationResult{}},
+			nil, nil, newMediaAccessTracker(), NewUserTrafficTracker(), true, "",
+		)
+		return w
+	}
+
+	if w := thumbnail("disabled"); w.Code != http.StatusNotFound {
+		t.Errorf("PDF thumbnails disabled: got status %d, want %d", w.Code, http.StatusNotFound)
+	}
+
+	cfg.PDFThumbnails = config.PDFThumbnails{Enabled: true, Command: filepath.Join(dir, "missing"), Timeout: time.Second * 5, MaxSize: 100}
+	if w := thumbnail("unavailable"); w.Code != http.StatusNotFound {
+		t.Errorf("PDF renderer unavailable: got status %d, want %d", w.Code, http.StatusNotFound)
+	}
+
+	cfg.PDFThumbnails.Command = renderer
+	w := thumbnail("enabled")
+	if w.Code != http.StatusOK {
+		t.Fatalf("PDF thumbnails enabled: got status %d, want %d", w.Code, http.StatusOK)
+	}
+	if got := w.Header().Get("Content-Type"); got != "image/jpeg" {
+		t.Errorf("got Content-Type %q, want image/jpeg", got)
+	}
+	if _, format, decodeErr := image.DecodeConfig(w.Body); decodeErr != nil || format != "jpeg" {
+		t.Errorf("thumbnail isn't a JPEG image: %s %v", format, decodeErr)
+	}
+}
+
+func TestThumbnailContentLength(t *testing.T) {
+	db, basePath, cleanup := newTestDatabase(t)
+	defer cleanup()
+	var original bytes.Buffer
+	if err := png.Encode(&original, image.NewRGBA(image.Rect(0, 0, 200, 100))); err != nil {
+		t.Fatal(err)
+	}
+	storeTestContent(t, db, basePath, "localhost", "image", "image/png", original.String())
+	cfg := &config.MediaAPI{
+		Matrix:                 &config.Global{ServerName: "localhost"},
+		AbsBasePath:            basePath,
+		DynamicThumbnails:      true,
+		MaxThumbnailGenerators: 10,
+		MaxThumbnailsPerMedia:  16,
+		// Thumbnails are images, which are never gzipped as they are already compressed.
+		GzipDownloads: config.GzipDownloads{Enabled: true, ContentTypes: []string{"image/*"}},
+	}
+	activeThumbnailGeneration := &types.ActiveThumbnailGeneration{
+		PathToResult: map[string]*types.ThumbnailGenerationResult{},
+	}
+
+	// Thumbnails are written to the media store as they are generated and served from
+	// there, so the first request for a thumbnail has its length as well as later ones.
+	for _, when := range []string{"generated", "stored"} {
+		req := httptest.NewRequest(http.MethodGet, "/thumbnail/localhost/image?width=32&height=32&method=scale", nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		w := httptest.NewRecorder()
+		Download(
+			w, req, "localhost", "image", cfg, db, nil,
+			&types.ActiveRemoteRequests{MXCToResult: map[string]*types.RemoteRequestResult{}},
+			activeThumbnailGeneration, nil, nil, newMediaAccessTracker(), NewUserTrafficTracker(), true, "",
+		)
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s thumbnail: got status %d, want %d", when, w.Code, http.StatusOK)
+		}
+		if got := w.Header().Get("Content-Length"); got != strconv.Itoa(w.Body.Len()) {
+			t.Errorf("%s thumbnail: got Content-Length %q for a %d byte body", when, got, w.Body.Len())
+		}
+		if got := w.Header().Get("Content-Encoding"); got != "" {
+			t.Errorf("%s thumbnail: got Content-Encoding %q", when, got)
+		}
+		if w.Body.Len() == original.Len() {
+			t.Errorf("%s thumbnail: got the original image", when)
+		}
+	}
+}
+
+func TestThumbnailLargerThanOriginal(t *testing.T) {
+	db, basePath, cleanup := newTestDatabase(t)
+	defer cleanup()
+	var original bytes.Buffer
+	if err := png.Encode(&original, image.NewRGBA(image.Rect(0, 0, 8, 6))); err != nil {
+		t.Fatal(err)
+	}
+	storeTestContent(t, db, basePath, "localhost", "tiny", "image/png", original.String())
+
+	// Whether the thumbnail would be generated for the request or is a pre-generated
+	// size, the original is served rather than being enlarged.
+	for _, dynamic := range []bool{true, false} {
+		cfg := &config.MediaAPI{
+			Matrix:                 &config.Global{ServerName: "localhost"},
+			AbsBasePath:            basePath,
+			DynamicThumbnails:      dynamic,
+			MaxThumbnailGenerators: 10,
+			MaxThumbnailsPerMedia:  16,
+			ThumbnailSizes:         []config.ThumbnailSize{{Width: 640, Height: 480, ResizeMethod: types.Scale}},
+		}
+		for _, method := range []string{types.Scale, types.Crop} {
+			req := httptest.NewRequest(http.MethodGet, "/thumbnail/localhost/tiny?width=800&height=600&method="+method, nil)
+			w := httptest.NewRecorder()
+			Download(
+				w, req, "localhost", "tiny", cfg, db, nil,
+				&types.ActiveRemoteRequests{MXCToResult: map[string]*types.RemoteRequestResult{}},
+				&types.ActiveThumbnailGeneration{PathToResult: map[string]*types.ThumbnailGenerationResult{}},
+				nil, nil, newMediaAccessTracker(), NewUserTrafficTracker(), true, "",
+			)
+			if w.Code != http.StatusOK {
+				t.Errorf("dynamic %t, %s: got status %d, want %d", dynamic, method, w.Code, http.StatusOK)
+				continue
+			}
+			if !bytes.Equal(w.Body.Bytes(), original.Bytes()) {
+				t.Errorf("dynamic %t, %s: got a %d byte thumbnail, want the original image", dynamic, method, w.Body.Len())
+			}
+		}
+	}
+	thumbnails, err := db.GetThumbnails(context.Background(), "tiny", "localhost")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(thumbnails) != 0 {
+		t.Errorf("got %d thumbnails stored, want none", len(thumbnails))
+	}
+}
+
+func TestDownloadAllowRemoteFalse(t *testing.T) {
+	db, basePath, cleanup := newTestDatabase(t)
+	defer cleanup()
+	cfg := &config.MediaAPI{
+		Matrix:      &config.Global{ServerName: "localhost"},
+		AbsBasePath: basePath,
+	}
+	storeTestContent(t, db, basePath, "remote.example", "cached", "text/plain", "cached media")
+
+	// There is no client, so trying to fetch the uncached media would fail the test.
+	tests := []struct {
+		mediaID  types.MediaID
+		wantCode int
+	}{
+		{"cached", http.StatusOK},
+		{"uncached", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/download/remote.example/"+string(tt.mediaID)+"?allow_remote=false", nil)
+		w := httptest.NewRecorder()
+		Download(
+			w, req, "remote.example", tt.mediaID, cfg, db, nil,
+			&types.ActiveRemoteRequests{MXCToResult: map[string]*types.RemoteRequestResult{}},
+			&types.ActiveThumbnailGeneration{PathToResult: map[string]*types.ThumbnailGenerationResult{}},
+			nil, nil, newMediaAccessTracker(), NewUserTrafficTracker(), false, "",
+		)
+		if w.Code != tt.wantCode {
+			t.Errorf("%s: got status %d, want %d", tt.mediaID, w.Code, tt.wantCode)
+		}
+	}
+}
+
+func TestDownloadAllowRedirect(t *testing.T) {
+	db, basePath, cleanup := newTestDatabase(t)
+	defer cleanup()
+	cfg := &config.MediaAPI{
+		Matrix:      &config.Global{ServerName: "localhost"},
+		AbsBasePath: basePath,
+	}
+	storeTestContent(t, db, basePath, "localhost", "abcd1234", "text/plain", "content")
+
+	for _, query := range []string{"", "?allow_redirect=true", "?allow_redirect=false"} {
+		req := httptest.NewRequest(http.MethodGet, "/download/localhost/abcd1234"+query, nil)
+		w := httptest.NewRecorder()
+		Download(
+			w, req, "localhost", "abcd1234", cfg, db, nil,
+			&types.ActiveRemoteRequests{MXCToResult: map[string]*types.RemoteRequestResult{}},
+			&types.ActiveThumbnailGeneration{PathToResult: map[string]*types.ThumbnailGenerationResult{}},
+			nil, nil, newMediaAccessTracker(), NewUserTrafficTracker(), false, "",
+		)
+		if w.Code != http.StatusOK {
+			t.Errorf("%q: got status %d, want %d", query, w.Code, http.StatusOK)
+			continue
+		}
+		if got := w.Body.String(); got != "content" {
+			t.Errorf("%q: got body %q, want the media", query, got)
+		}
+	}
+}
+
+func TestDownloadAllowedRemoteOrigins(t *testing.T) {
+	db, basePath, cleanup := newTestDatabase(t)
+	defer cleanup()
+	cfg := &config.MediaAPI{
+		Matrix:               &config.Global{ServerName: "localhost"},
+		AbsBasePath:          basePath,
+		AllowedRemoteOrigins: []gomatrixserverlib.ServerName{"trusted.example"},
+	}
+	storeTestContent(t, db, basePath, "other.example", "cached", "text/plain", "cached media")
+
+	tests := []struct {
+		mediaID  types.MediaID
+		wantCode int
+	}{
+		{"cached", http.StatusOK},
+		{"uncached", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/download/other.example/"+string(tt.mediaID), nil)
+		w := httptest.NewRecorder()
+		Download(
+			w, req, "other.example", tt.mediaID, cfg, db, nil,
+			&types.ActiveRemoteRequests{MXCToResult: map[string]*types.RemoteRequestResult{}},
+			&types.ActiveThumbnailGeneration{PathToResult: map[string]*types.ThumbnailGenerationResult{}},
+			nil, nil, newMediaAccessTracker(), NewUserTrafficTracker(), false, "",
+		)
+		if w.Code != tt.wantCode {
+			t.Errorf("%s: got status %d, want %d", tt.mediaID, w.Code, tt.wantCode)
+		}
+	}
+}
+
+func TestDownloadBlockedRemoteNetworks(t *testing.T) {
+	db, basePath, cleanup := newTestDatabase(t)
+	defer cleanup()
+	maxFileSizeBytes := config.FileSizeBytes(1024)
+	cfg := &config.MediaAPI{
+		Matrix:           &config.Global{ServerName: "localhost"},
+		AbsBasePath:      basePath,
+		MaxFileSizeBytes: &maxFileSizeBytes,
+		RemoteRetries:    config.RemoteMediaRetries{Count: 2},
+	}
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		requests++
+		w.Write([]byte("internal")) // nolint: errcheck
+	}))
+	defer server.Close()
+	serverURL, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The server name resolves to the loopback address of the test server.
+	_, loopback, err := net.ParseCIDR("127.0.0.0/8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tripper := newTestTripper(testTimeouts)
+	tripper.blockedNetworks = []*net.IPNet{loopback}
+	client := gomatrixserverlib.NewClientWithTransport(true, localTripper{host: serverURL.Host, transport: tripper.getTransport("")})
+
+	req := httptest.NewRequest(http.MethodGet, "/download/internal.example/media", nil)
+	w := httptest.NewRecorder()
+	Download(
+		w, req, "internal.example", "media", cfg, db, client,
+		&types.ActiveRemoteRequests{MXCToResult: map[string]*types.RemoteRequestResult{}},
+		&types.ActiveThumbnailGeneration{PathToResult: map[string]*types.ThumbnailGenerationResult{}},
+		nil, nil, newMediaAccessTracker(), NewUserTrafficTracker(), false, "",
+	)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("got status %d, want %d", w.Code, http.StatusForbidden)
+	}
+	if requests != 0 {
+		t.Errorf("got %d requests to the blocked address, want none", requests)
+	}
+}
+
+// localTripper sends requests for matrix:// URLs to a local HTTP server.
+type localTripper struct {
+	host string
+	// The transport to send the requests with, or http.DefaultTransport if nil.
+	transport http.RoundTripper
+}
+
+func (t localTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.URL.Scheme = "http"
+	req.URL.Host = t.host
+	if t.transport != nil {
+		return t.transport.RoundTrip(req)
+	}
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func TestRemoteFetchRetries(t *testing.T) {
+	db, basePath, cleanup := newTestDatabase(t)
+	defer cleanup()
+	maxFileSizeBytes := config.FileSizeBytes(1024)
+	cfg := &config.MediaAPI{
+		Matrix:            &config.Global{ServerName: "localhost"},
+		AbsBasePath:       basePath,
+		MaxFileSizeBytes:  &maxFileSizeBytes,
+		RemoteRetries:     config.RemoteMediaRetries{Count: 2, Backoff: time.Millisecond},
+		RemoteNotFoundTTL: time.Minute,
+	}
+
+	// The statuses the remote server responds with for each media ID, in turn, with
+	// the last repeated once they run out.
+	statuses := map[string][]int{
+		"flaky":     {http.StatusInternalServerError, http.StatusBadGateway, http.StatusOK},
+		"broken":    {http.StatusServiceUnavailable},
+		"forbidden": {http.StatusForbidden},
+		"missing":   {http.StatusNotFound},
+	}
+	requests := map[string]int{}
+	var requestsMutex sync.Mutex
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		requestsMutex.Lock()
+		defer requestsMutex.Unlock()
+		mediaID := filepath.Base(req.URL.Path)
+		status := statuses[mediaID][len(statuses[mediaID])-1]
+		if requests[mediaID] < len(statuses[mediaID]) {
+			status = statuses[mediaID][requests[mediaID]]
+		}
+		requests[mediaID]++
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(status)
+		w.Write([]byte("remote media")) // nolint: errcheck
+	}))
+	defer server.Close()
+	serverURL, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := gomatrixserverlib.NewClientWithTransport(true, localTripper{host: serverURL.Host})
+	activeRemoteRequests := &types.ActiveRemoteRequests{MXCToResult: map[string]*types.RemoteRequestResult{}}
+
+	tests := []struct {
+		mediaID      types.MediaID
+		wantCode     int
+		wantRequests int
+	}{
+		{"flaky", http.StatusOK, 3},
+		{"broken", http.StatusBadGateway, 3},
+		{"forbidden", http.StatusNotFound, 1},
+		{"missing", http.StatusNotFound, 1},
+		// The remote server isn't asked again so soon after it didn't have the media.
+		{"missing", http.StatusNotFound, 1},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/download/remote.example/"+string(tt.mediaID), nil)
+		w := httptest.NewRecorder()
+		Download(
+			w, req, "remote.example", tt.mediaID, cfg, db, client, activeRemoteRequests,
+			&types.ActiveThumbnailGeneration{PathToResult: map[string]*types.ThumbnailGenerationResult{}},
+			nil, nil, newMediaAccessTracker(), NewUserTrafficTracker(), false, "",
+		)
+		if w.Code != tt.wantCode {
+			t.Errorf("%s: got status %d, want %d", tt.mediaID, w.Code, tt.wantCode)
+		}
+		requestsMutex.Lock()
+		got := requests[string(tt.mediaID)]
+		requestsMutex.Unlock()
+		if got != tt.wantRequests {
+			t.Errorf("%s: got %d requests to the remote server, want %d", tt.mediaID, got, tt.wantRequests)
+		}
+	}
+}
+
+func TestRemoteMediaMetadata(t *testing.T) {
+	db, basePath, cleanup := newTestDatabase(t)
+	defer cleanup()
+	maxFileSizeBytes := config.FileSizeBytes(1024)
+	cfg := &config.MediaAPI{
+		Matrix:                         &config.Global{ServerName: "localhost"},
+		AbsBasePath:                    basePath,
+		MaxFileSizeBytes:               &maxFileSizeBytes,
+		DefaultContentType:             "application/octet-stream",
+		DefaultUploadNames:             true,
+		PreferClientContentDisposition: true,
+	}
+
+	// The headers the remote server sends each media ID with. A nil Content-Type
+	// stops one being sniffed from the content.
+	headers := map[string]http.Header{
+		"named": {
+			"Content-Type":        {"text/plain; charset=UTF-8; format=flowed"},
+			"Content-Disposition": {`inline; filename="notes.txt"`},
+		},
+		"unicode": {
+			"Content-Type":        {"text/plain"},
+			"Content-Disposition": {`attachment; filename*=UTF-8''caf%C3%A9.txt`},
+		},
+		"path": {
+			"Content-Type":        {"image/png"},
+			"Content-Disposition": {`attachment; filename="../../etc/cat.png"`},
+		},
+		"unquoted": {
+			"Content-Type":        {"image/png"},
+			"Content-Disposition": {`attachment; filename*=utf-8''my cat.png`},
+		},
+		"bare": {
+			"Content-Type": nil,
+		},
+		"invalid": {
+			"Content-Type":        {"text/html; charset=utf-7"},
+			"Content-Disposition": {"sideways"},
+		},
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		for key, values := range headers[filepath.Base(req.URL.Path)] {
+			w.Header()[key] = values
+		}
+		w.Write([]byte("remote media")) // nolint: errcheck
+	}))
+	defer server.Close()
+	serverURL, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := gomatrixserverlib.NewClientWithTransport(true, localTripper{host: serverURL.Host})
+
+	tests := []struct {
+		mediaID         types.MediaID
+		wantContentType types.ContentType
+		wantUploadName  types.Filename
+		wantDisposition string
+		wantHeader      string
+	}{
+		{"named", "text/plain; charset=utf-8", "notes.txt", "inline", "inline; filename=notes.txt"},
+		{"unicode", "text/plain", "caf%C3%A9.txt", "attachment", "attachment; filename=caf_.txt; filename*=utf-8''caf%C3%A9.txt"},
+		{"path", "image/png", "cat.png", "attachment", "attachment; filename=cat.png"},
+		{"unquoted", "image/png", "my%20cat.png", "", `attachment; filename="my cat.png"`},
+		{"bare", "application/octet-stream", "bare.bin", "", "attachment; filename=bare.bin"},
+		{"invalid", "application/octet-stream", "invalid.bin", "", "attachment; filename=invalid.bin"},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/download/remote.example/"+string(tt.mediaID), nil)
+		w := httptest.NewRecorder()
+		Download(
+			w, req, "remote.example", tt.mediaID, cfg, db, client,
+			&types.ActiveRemoteRequests{MXCToResult: map[string]*types.RemoteRequestResult{}},
+			&types.ActiveThumbnailGeneration{PathToResult: map[string]*types.ThumbnailGenerationResult{}},
+			nil, nil, newMediaAccessTracker(), NewUserTrafficTracker(), false, "",
+		)
+		if w.Code != http.StatusOK {
+			t.Errorf("%s: got status %d, want %d", tt.mediaID, w.Code, http.StatusOK)
+			continue
+		}
+		mediaMetadata, err := db.GetMediaMetadata(context.Background(), tt.mediaID, "remote.example")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if mediaMetadata.ContentType != tt.wantContentType || mediaMetadata.UploadName != tt.wantUploadName ||
+			mediaMetadata.Disposition != tt.wantDisposition {
+			t.Errorf("%s: got stored %q, %q, %q, want %q, %q, %q", tt.mediaID,
+				mediaMetadata.ContentType, mediaMetadata.UploadName, mediaMetadata.Disposition,
+				tt.wantContentType, tt.wantUploadName, tt.wantDisposition)
+		}
+		if got := w.Header().Get("Content-Disposition"); got != tt.wantHeader {
+			t.Errorf("%s: got Content-Disposition %q, want %q", tt.mediaID, got, tt.wantHeader)
+		}
+	}
+}
+
+func TestDownloadRecordedEncryption(t *testing.T) {
+	db, basePath, cleanup := newTestDatabase(t)
+	defer cleanup()
+	maxFileSizeBytes := config.FileSizeBytes(1024)
+	cfg := &config.MediaAPI{
+		Matrix:           &config.Global{ServerName: "localhost"},
+		AbsBasePath:      basePath,
+		MaxFileSizeBytes: &maxFileSizeBytes,
+	}
+	secret := make([]byte, 32)
+	key, err := fileutils.NewEncryptionKey("aes256:test", secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	upload := func(content string, key *fileutils.EncryptionKey) *types.MediaMetadata {
+		req := httptest.NewRequest(http.MethodPost, "/upload", strings.NewReader(content))
+		req.Header.Set("Content-Type", "application/octet-stream")
+		res := Upload(req, cfg, &userapi.Device{UserID: "@alice:localhost"}, db, &types.ActiveThumbnailGeneration{
+			PathToResult: map[string]*types.ThumbnailGenerationResult{},
+		}, key, nil)
+		if res.Code != http.StatusOK {
+			t.Fatalf("upload: got status %d, want %d", res.Code, http.StatusOK)
+		}
+		mediaID := types.MediaID(strings.TrimPrefix(res.JSON.(uploadResponse).ContentURI, "mxc://localhost/"))
+		mediaMetadata, err := db.GetMediaMetadata(ctx, mediaID, "localhost")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return mediaMetadata
+	}
+	download := func(mediaID types.MediaID) string {
+		w := httptest.NewRecorder()
+		Download(
+			w, httptest.NewRequest(http.MethodGet, "/download/localhost/"+string(mediaID), nil),
+			"localhost", mediaID, cfg, db, nil,
+			&types.ActiveRemoteRequests{MXCToResult: map[string]*types.RemoteRequestResult{}},
+			&types.ActiveThumbnailGeneration{PathToResult: map[string]*types.ThumbnailGenerationResult{}},
+			nil, key, newMediaAccessTracker(), NewUserTrafficTracker(), false, "",
+		)
+		if w.Code != http.StatusOK {
+			t.Fatalf("download of %s: got status %d, want %d", mediaID, w.Code, http.StatusOK)
+		}
+		return w.Body.String()
+	}
+
+	// A file stored before encryption was enabled, which happens to start like an
+	// encrypted one, is still served as it is once encryption is enabled, including for
+	// media uploaded since which share the unencrypted file.
+	plaintext := "DMEDIAE1\x0bnot a header"
+	before := upload(plaintext, nil)
+	after := upload(plaintext, key)
+	for _, mediaMetadata := range []*types.MediaMetadata{before, after} {
+		if mediaMetadata.Encryption != types.NotEncrypted {
+			t.Errorf("%s: got encryption %d, want %d", mediaMetadata.MediaID, mediaMetadata.Encryption, types.NotEncrypted)
+		}
+		if got := download(mediaMetadata.MediaID); got != plaintext {
+			t.Errorf("%s: got %q, want %q", mediaMetadata.MediaID, got, plaintext)
+		}
+	}
+
+	encrypted := upload("encrypted content", key)
+	if encrypted.Encryption != types.Encrypted {
+		t.Errorf("got encryption %d, want %d", encrypted.Encryption, types.Encrypted)
+	}
+	if got := download(encrypted.MediaID); got != "encrypted content" {
+		t.Errorf("got %q, want %q", got, "encrypted content")
+	}
+}
@@ -0,0 +1,84 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"net/http"
+	"sync"
+
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/util"
+)
+
+// ActiveUploads keeps track of the uploads in progress, so that they can be given a
+// chance to finish when the server is shutting down. The zero value is ready to use.
+type ActiveUploads struct {
+	sync.Mutex
+	draining bool
+	uploads  sync.WaitGroup
+}
+
+// start records that an upload is starting. Returns false if the server is shutting
+// down, in which case the upload must not go ahead. Otherwise finish must be called
+// once the upload is done.
+func (a *ActiveUploads) start() bool {
+	a.Lock()
+	defer a.Unlock()
+	if a.draining {
+		return false
+	}
+	a.uploads.Add(1)
+	return true
+}
+
+func (a *ActiveUploads) finish() {
+	a.uploads.Done()
+}
+
+// Drain stops any new uploads from starting, then waits until the uploads in progress
+// have finished or ctx is done. Returns whether they all finished in time.
+func (a *ActiveUploads) Drain(ctx context.Context) bool {
+	a.Lock()
+	a.draining = true
+	a.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		a.uploads.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// trackUpload runs the upload handler f while tracking it in activeUploads, or
+// rejects the upload if the server is shutting down.
+func trackUpload(
+	activeUploads *ActiveUploads, f func() util.JSONResponse,
+) util.JSONResponse {
+	if !activeUploads.start() {
+		return util.JSONResponse{
+			Code: http.StatusServiceUnavailable,
+			JSON: jsonerror.Unavailable("The server is shutting down."),
+		}
+	}
+	defer activeUploads.finish()
+	return f()
+}
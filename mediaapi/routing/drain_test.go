@@ -0,0 +1,57 @@
+package routing
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/util"
+)
+
+func TestActiveUploadsDrain(t *testing.T) {
+	activeUploads := &ActiveUploads{}
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	result := make(chan util.JSONResponse)
+	go func() {
+		result <- trackUpload(activeUploads, func() util.JSONResponse {
+			close(started)
+			<-release
+			return util.JSONResponse{Code: http.StatusOK}
+		})
+	}()
+	<-started
+
+	// The upload in progress doesn't finish within the grace period.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if activeUploads.Drain(ctx) {
+		t.Error("Drain returned true while an upload was in progress")
+	}
+
+	// New uploads are refused once draining has started.
+	res := trackUpload(activeUploads, func() util.JSONResponse {
+		t.Error("upload was allowed to start while draining")
+		return util.JSONResponse{Code: http.StatusOK}
+	})
+	if res.Code != http.StatusServiceUnavailable {
+		t.Errorf("got status %d for upload while draining, want 503", res.Code)
+	}
+	if matrixErr, ok := res.JSON.(*jsonerror.MatrixError); !ok || matrixErr.ErrCode != "M_UNAVAILABLE" {
+		t.Errorf("got %+v for upload while draining, want M_UNAVAILABLE", res.JSON)
+	}
+
+	// The upload in progress is still allowed to finish.
+	close(release)
+	if res = <-result; res.Code != http.StatusOK {
+		t.Errorf("got status %d for upload in progress, want 200", res.Code)
+	}
+	ctx, cancel = context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if !activeUploads.Drain(ctx) {
+		t.Error("Drain returned false once all uploads had finished")
+	}
+}
@@ -0,0 +1,105 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+)
+
+// federationResponseWriter turns a download response into the multipart/mixed response
+// which other homeservers expect from the federation media endpoints. The first part is
+// the media's metadata, which is always an empty JSON object for now, and the second is
+// the media itself, with the Content-Type and Content-Disposition it would otherwise
+// have been sent with. Responses other than 200 OK, e.g. errors, are sent as they are.
+// https://github.com/matrix-org/matrix-spec-proposals/pull/3916
+type federationResponseWriter struct {
+	http.ResponseWriter
+	multipart   *multipart.Writer
+	media       io.Writer
+	wroteHeader bool
+}
+
+func newFederationResponseWriter(w http.ResponseWriter) *federationResponseWriter {
+	return &federationResponseWriter{ResponseWriter: w}
+}
+
+func (w *federationResponseWriter) WriteHeader(code int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	if code != http.StatusOK {
+		w.ResponseWriter.WriteHeader(code)
+		return
+	}
+	header := w.Header()
+	mediaHeader := textproto.MIMEHeader{}
+	for _, name := range []string{"Content-Type", "Content-Disposition"} {
+		if value := header.Get(name); value != "" {
+			mediaHeader.Set(name, value)
+		}
+		header.Del(name)
+	}
+	// The length of the multipart body isn't known up front.
+	header.Del("Content-Length")
+	w.multipart = multipart.NewWriter(w.ResponseWriter)
+	header.Set("Content-Type", "multipart/mixed; boundary="+w.multipart.Boundary())
+	w.ResponseWriter.WriteHeader(code)
+
+	// Errors writing the parts show up again when the media is written.
+	metadata, err := w.multipart.CreatePart(textproto.MIMEHeader{"Content-Type": {"application/json"}})
+	if err == nil {
+		_, err = metadata.Write([]byte("{}"))
+	}
+	if err == nil {
+		w.media, err = w.multipart.CreatePart(mediaHeader)
+	}
+	if err != nil {
+		w.media = errorWriter{err}
+	}
+}
+
+func (w *federationResponseWriter) Write(p []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.media == nil {
+		return w.ResponseWriter.Write(p)
+	}
+	return w.media.Write(p)
+}
+
+// finish writes the end of the multipart body, if the response is a multipart one. A
+// response which nothing was written for, e.g. to a HEAD request, is a 200 OK.
+func (w *federationResponseWriter) finish() error {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.multipart == nil {
+		return nil
+	}
+	return w.multipart.Close()
+}
+
+type errorWriter struct {
+	err error
+}
+
+func (e errorWriter) Write([]byte) (int, error) {
+	return 0, e.err
+}
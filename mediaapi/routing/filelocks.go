@@ -0,0 +1,63 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"sync"
+
+	"github.com/matrix-org/dendrite/mediaapi/types"
+)
+
+// fileLocks is held for a hash while an upload moves the file into place and stores the
+// metadata which refers to it, and while the file is checked for and removed because no
+// media refers to it any more. Otherwise an upload could find the file already stored
+// just before it was removed, leaving the uploaded media without a file.
+var fileLocks = hashLocks{locks: map[types.Base64Hash]*hashLock{}}
+
+type hashLocks struct {
+	sync.Mutex
+	locks map[types.Base64Hash]*hashLock
+}
+
+type hashLock struct {
+	sync.Mutex
+	// The number of callers holding or waiting for the lock, so that it can be
+	// forgotten once there are none.
+	users int
+}
+
+// lock waits until no one else holds the lock for the hash, then takes it. The
+// returned function releases it again.
+func (l *hashLocks) lock(hash types.Base64Hash) func() {
+	l.Lock()
+	hl, ok := l.locks[hash]
+	if !ok {
+		hl = &hashLock{}
+		l.locks[hash] = hl
+	}
+	hl.users++
+	l.Unlock()
+
+	hl.Lock()
+	return func() {
+		hl.Unlock()
+		l.Lock()
+		defer l.Unlock()
+		hl.users--
+		if hl.users == 0 {
+			delete(l.locks, hash)
+		}
+	}
+}
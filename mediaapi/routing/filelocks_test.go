@@ -0,0 +1,45 @@
+package routing
+
+import (
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/mediaapi/types"
+)
+
+func TestHashLocks(t *testing.T) {
+	locks := hashLocks{locks: map[types.Base64Hash]*hashLock{}}
+
+	unlock := locks.lock("abc")
+	// Other hashes can be locked at the same time.
+	locks.lock("def")()
+
+	locked := make(chan struct{})
+	go func() {
+		defer locks.lock("abc")()
+		close(locked)
+	}()
+	select {
+	case <-locked:
+		t.Fatal("the hash was locked twice at once")
+	case <-time.After(50 * time.Millisecond):
+	}
+	unlock()
+	select {
+	case <-locked:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the hash was not locked after it was released")
+	}
+
+	// Locks are forgotten once nothing holds or waits for them.
+	for i := 0; i < 100; i++ {
+		locks.Lock()
+		n := len(locks.locks)
+		locks.Unlock()
+		if n == 0 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Error("locks were not forgotten after they were released")
+}
@@ -0,0 +1,109 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/matrix-org/dendrite/internal/config"
+	"github.com/matrix-org/dendrite/mediaapi/fileutils"
+	"github.com/matrix-org/dendrite/mediaapi/storage"
+	"github.com/matrix-org/util"
+)
+
+// healthCheckTimeout is how long the checks for GET /health may take before they are
+// counted as failed, so that a hung disk or database doesn't hang the load balancers
+// and monitoring which poll it.
+const healthCheckTimeout = 5 * time.Second
+
+// The status of each check in the response to GET /health.
+const (
+	healthOK       = "ok"
+	healthFailed   = "failed"
+	healthTimedOut = "timed_out"
+)
+
+// healthResponse defines the format of the JSON response to GET /health
+type healthResponse struct {
+	Status     string      `json:"status"`
+	Database   healthCheck `json:"database"`
+	MediaStore healthCheck `json:"media_store"`
+}
+
+type healthCheck struct {
+	Status string `json:"status"`
+	// Why the media store can't be written to, one of the fileutils.StorageError
+	// reasons, if it is known.
+	Reason string `json:"reason,omitempty"`
+}
+
+// CheckHealth implements GET /health
+// This checks that the database can be reached and that a file can be written to the
+// media store, read back and removed again, returning 200 only if both work. Each
+// check is counted as timed out if it doesn't finish within timeout, though it is
+// left to finish in the background as file operations can't be cancelled.
+func CheckHealth(
+	req *http.Request, cfg *config.MediaAPI, db storage.Database, timeout time.Duration,
+) util.JSONResponse {
+	ctx, cancel := context.WithTimeout(req.Context(), timeout)
+	defer cancel()
+	logger := util.GetLogger(req.Context())
+
+	dbResult := make(chan error, 1)
+	go func() {
+		dbResult <- db.Ping(ctx)
+	}()
+	storeResult := make(chan error, 1)
+	go func() {
+		storeResult <- fileutils.ProbeStorage(cfg.AbsBasePath)
+	}()
+
+	res := healthResponse{Status: healthOK}
+	select {
+	case err := <-dbResult:
+		res.Database.Status = healthOK
+		if err != nil {
+			logger.WithError(err).Error("Health check failed to reach the database")
+			res.Database.Status = healthFailed
+		}
+	case <-ctx.Done():
+		logger.Error("Health check timed out reaching the database")
+		res.Database.Status = healthTimedOut
+	}
+	select {
+	case err := <-storeResult:
+		res.MediaStore.Status = healthOK
+		if err != nil {
+			logger.WithError(err).Error("Health check failed to write to the media store")
+			res.MediaStore.Status = healthFailed
+			res.MediaStore.Reason = fileutils.StorageErrorReason(err)
+		}
+	case <-ctx.Done():
+		logger.Error("Health check timed out writing to the media store")
+		res.MediaStore.Status = healthTimedOut
+	}
+
+	code := http.StatusOK
+	if res.Database.Status != healthOK || res.MediaStore.Status != healthOK {
+		code = http.StatusServiceUnavailable
+		res.Status = healthFailed
+	}
+	return util.JSONResponse{
+		Code: code,
+		JSON: res,
+	}
+}
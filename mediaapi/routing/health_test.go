@@ -0,0 +1,89 @@
+package routing
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/internal/config"
+	"github.com/matrix-org/dendrite/mediaapi/storage"
+)
+
+// pingTestDatabase is a database whose Ping fails with err, or waits until block is
+// closed if it is set.
+type pingTestDatabase struct {
+	storage.Database
+	err   error
+	block chan struct{}
+}
+
+func (d pingTestDatabase) Ping(ctx context.Context) error {
+	if d.block != nil {
+		<-d.block
+	}
+	return d.err
+}
+
+func TestCheckHealth(t *testing.T) {
+	db, basePath, cleanup := newTestDatabase(t)
+	defer cleanup()
+	cfg := &config.MediaAPI{AbsBasePath: basePath}
+	// A media store which is a file rather than a directory can't be written to.
+	brokenBasePath := config.Path(filepath.Join(filepath.Dir(string(basePath)), "not_a_dir"))
+	if err := ioutil.WriteFile(string(brokenBasePath), nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	block := make(chan struct{})
+	defer close(block)
+
+	for _, tt := range []struct {
+		name           string
+		db             storage.Database
+		basePath       config.Path
+		wantCode       int
+		wantDatabase   string
+		wantMediaStore string
+	}{
+		{"healthy", db, basePath, http.StatusOK, healthOK, healthOK},
+		{"database down", pingTestDatabase{err: errors.New("connection refused")}, basePath, http.StatusServiceUnavailable, healthFailed, healthOK},
+		{"media store broken", db, brokenBasePath, http.StatusServiceUnavailable, healthOK, healthFailed},
+		{"database hung", pingTestDatabase{block: block}, basePath, http.StatusServiceUnavailable, healthTimedOut, ""},
+	} {
+		cfg.AbsBasePath = tt.basePath
+		res := CheckHealth(httptest.NewRequest(http.MethodGet, "/unstable/health", nil), cfg, tt.db, 50*time.Millisecond)
+		if res.Code != tt.wantCode {
+			t.Errorf("%s: got status %d, want %d", tt.name, res.Code, tt.wantCode)
+		}
+		health := res.JSON.(healthResponse)
+		wantStatus := healthOK
+		if tt.wantCode != http.StatusOK {
+			wantStatus = healthFailed
+		}
+		if health.Status != wantStatus {
+			t.Errorf("%s: got status %q, want %q", tt.name, health.Status, wantStatus)
+		}
+		if health.Database.Status != tt.wantDatabase {
+			t.Errorf("%s: got database status %q, want %q", tt.name, health.Database.Status, tt.wantDatabase)
+		}
+		// The media store may or may not have been checked by the time the hung
+		// database check times out.
+		if tt.wantMediaStore != "" && health.MediaStore.Status != tt.wantMediaStore {
+			t.Errorf("%s: got media store status %q, want %q", tt.name, health.MediaStore.Status, tt.wantMediaStore)
+		}
+	}
+
+	// The probe doesn't leave anything behind in the media store.
+	entries, err := ioutil.ReadDir(filepath.Join(string(basePath), "tmp"))
+	if err != nil && !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("got %d entries left in the media store's tmp directory, want none", len(entries))
+	}
+}
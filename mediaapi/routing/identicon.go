@@ -0,0 +1,165 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"net/http"
+	"strconv"
+
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/util"
+)
+
+const (
+	// defaultIdenticonSize is the width and height of identicons if not given in the request
+	defaultIdenticonSize = 96
+	// maxIdenticonSize is the largest width or height which can be requested
+	maxIdenticonSize = 1024
+	// identiconCells is the number of cells along each side of an identicon
+	identiconCells = 5
+)
+
+// identiconBackground is the colour of the cells of an identicon which aren't filled in
+var identiconBackground = color.RGBA{R: 0xf0, G: 0xf0, B: 0xf0, A: 0xff}
+
+// Identicon implements GET /identicon/{name}
+// This generates an image from the name which is always the same for the same name,
+// which clients can use as an avatar for users or rooms which don't have one. The
+// size of the image is given in pixels by the width and height query parameters.
+// This is a legacy, non-standard endpoint which Synapse also provides.
+func Identicon(w http.ResponseWriter, req *http.Request, name string) {
+	util.SetCORSHeaders(w)
+
+	data, resErr := makeIdenticon(req, name)
+	if resErr != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(resErr.Code)
+		_ = json.NewEncoder(w).Encode(resErr.JSON)
+		return
+	}
+
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	// The same name always gives the same image, so it can be cached for a long time
+	w.Header().Set("Cache-Control", "public, max-age=86400")
+	w.Write(data) // nolint: errcheck
+}
+
+// makeIdenticon returns the PNG encoded identicon for the name at the requested size.
+func makeIdenticon(req *http.Request, name string) ([]byte, *util.JSONResponse) {
+	width, resErr := identiconDimension(req, "width")
+	if resErr != nil {
+		return nil, resErr
+	}
+	height, resErr := identiconDimension(req, "height")
+	if resErr != nil {
+		return nil, resErr
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, generateIdenticon(name, width, height)); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("Failed to encode identicon")
+		res := jsonerror.InternalServerError()
+		return nil, &res
+	}
+	return buf.Bytes(), nil
+}
+
+// identiconDimension returns the width or height requested in the named query parameter.
+func identiconDimension(req *http.Request, param string) (int, *util.JSONResponse) {
+	value := req.URL.Query().Get(param)
+	if value == "" {
+		return defaultIdenticonSize, nil
+	}
+	size, err := strconv.Atoi(value)
+	if err != nil || size <= 0 || size > maxIdenticonSize {
+		return 0, &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue(fmt.Sprintf("%s must be between 1 and %d", param, maxIdenticonSize)),
+		}
+	}
+	return size, nil
+}
+
+// generateIdenticon returns a width x height image made up of a grid of cells which is
+// symmetrical about the vertical axis. Which cells are filled in, and their colour, are
+// taken from a hash of the text.
+func generateIdenticon(text string, width, height int) image.Image {
+	digest := sha256.Sum256([]byte(text))
+
+	// The first two bytes of the hash choose the hue, so that the colour is always
+	// fairly saturated and bright enough to stand out from the background.
+	hue := float64(binary.BigEndian.Uint16(digest[0:2])) / 65536
+	foreground := hsvToRGBA(hue, 0.65, 0.8)
+
+	// The rest choose which cells on the left half of the grid, including the middle
+	// column, are filled in. The right half is a mirror of the left.
+	var filled [identiconCells][identiconCells]bool
+	bits := digest[2:]
+	for col, i := 0, 0; col < (identiconCells+1)/2; col++ {
+		for row := 0; row < identiconCells; row, i = row+1, i+1 {
+			on := bits[i/8]&(1<<uint(i%8)) != 0
+			filled[row][col] = on
+			filled[row][identiconCells-1-col] = on
+		}
+	}
+
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		row := y * identiconCells / height
+		for x := 0; x < width; x++ {
+			if filled[row][x*identiconCells/width] {
+				img.SetRGBA(x, y, foreground)
+			} else {
+				img.SetRGBA(x, y, identiconBackground)
+			}
+		}
+	}
+	return img
+}
+
+// hsvToRGBA converts a colour given as hue, saturation and value, each between 0 and 1,
+// to an opaque RGBA colour.
+func hsvToRGBA(h, s, v float64) color.RGBA {
+	h *= 6
+	sector := int(h) % 6
+	f := h - float64(int(h))
+	p, q, t := v*(1-s), v*(1-s*f), v*(1-s*(1-f))
+
+	var r, g, b float64
+	switch sector {
+	case 0:
+		r, g, b = v, t, p
+	case 1:
+		r, g, b = q, v, p
+	case 2:
+		r, g, b = p, v, t
+	case 3:
+		r, g, b = p, q, v
+	case 4:
+		r, g, b = t, p, v
+	default:
+		r, g, b = v, p, q
+	}
+	return color.RGBA{R: uint8(r * 255), G: uint8(g * 255), B: uint8(b * 255), A: 0xff}
+}
@@ -0,0 +1,54 @@
+package routing
+
+import (
+	"bytes"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestIdenticon(t *testing.T) {
+	get := func(name, query string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		Identicon(rec, httptest.NewRequest(http.MethodGet, "/identicon/"+name+query, nil), name)
+		return rec
+	}
+
+	rec := get("@alice:localhost", "?width=64&height=32")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got status %d, want 200", rec.Code)
+	}
+	if contentType := rec.Header().Get("Content-Type"); contentType != "image/png" {
+		t.Errorf("got Content-Type %q, want image/png", contentType)
+	}
+	img, err := png.Decode(bytes.NewReader(rec.Body.Bytes()))
+	if err != nil {
+		t.Fatalf("response is not a PNG: %s", err)
+	}
+	if bounds := img.Bounds(); bounds.Dx() != 64 || bounds.Dy() != 32 {
+		t.Errorf("got %dx%d identicon, want 64x32", bounds.Dx(), bounds.Dy())
+	}
+
+	// The same name must always give the same image, and different names different ones.
+	if again := get("@alice:localhost", "?width=64&height=32"); !bytes.Equal(again.Body.Bytes(), rec.Body.Bytes()) {
+		t.Error("identicon for the same name differs between requests")
+	}
+	if other := get("@bob:localhost", "?width=64&height=32"); bytes.Equal(other.Body.Bytes(), rec.Body.Bytes()) {
+		t.Error("identicons for different names are the same")
+	}
+
+	img, err = png.Decode(bytes.NewReader(get("@alice:localhost", "").Body.Bytes()))
+	if err != nil {
+		t.Fatalf("response is not a PNG: %s", err)
+	}
+	if bounds := img.Bounds(); bounds.Dx() != defaultIdenticonSize || bounds.Dy() != defaultIdenticonSize {
+		t.Errorf("got %dx%d identicon, want default size", bounds.Dx(), bounds.Dy())
+	}
+
+	for _, query := range []string{"?width=0", "?height=-1", "?width=abc", "?width=100000"} {
+		if rec := get("@alice:localhost", query); rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: got status %d, want 400", query, rec.Code)
+		}
+	}
+}
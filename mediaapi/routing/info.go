@@ -0,0 +1,91 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"net/http"
+	"net/url"
+
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/mediaapi/storage"
+	"github.com/matrix-org/dendrite/mediaapi/types"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+// mediaInfoResponse defines the format of the JSON response to GET /info
+type mediaInfoResponse struct {
+	MediaID       types.MediaID                `json:"media_id"`
+	Origin        gomatrixserverlib.ServerName `json:"media_origin"`
+	ContentType   types.ContentType            `json:"content_type"`
+	FileSizeBytes types.FileSizeBytes          `json:"file_size_bytes"`
+	UploadName    string                       `json:"upload_name,omitempty"`
+	CreationTs    types.UnixMs                 `json:"creation_ts"`
+	HasThumbnails bool                         `json:"has_thumbnails"`
+}
+
+// GetMediaInfo implements GET /info/{serverName}/{mediaId}
+// This returns what is known about a media item held by this server without
+// downloading it. Remote media which hasn't been fetched yet is not found, as
+// this never fetches media from other servers.
+func GetMediaInfo(
+	req *http.Request, db storage.Database,
+	origin gomatrixserverlib.ServerName, mediaID types.MediaID,
+) util.JSONResponse {
+	if !mediaIDRegex.MatchString(string(mediaID)) || origin == "" {
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: jsonerror.NotFound("File not found"),
+		}
+	}
+
+	logger := util.GetLogger(req.Context())
+	mediaMetadata, err := db.GetMediaMetadata(req.Context(), mediaID, origin)
+	if err != nil {
+		logger.WithError(err).Error("Failed to query media metadata")
+		return jsonerror.InternalServerError()
+	}
+	if mediaMetadata == nil {
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: jsonerror.NotFound("File not found"),
+		}
+	}
+
+	thumbnails, err := db.GetThumbnails(req.Context(), mediaID, origin)
+	if err != nil {
+		logger.WithError(err).Error("Failed to query thumbnails")
+		return jsonerror.InternalServerError()
+	}
+
+	// Upload names are stored escaped, see parseAndValidateRequest
+	uploadName, err := url.PathUnescape(string(mediaMetadata.UploadName))
+	if err != nil {
+		uploadName = string(mediaMetadata.UploadName)
+	}
+
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: mediaInfoResponse{
+			MediaID:       mediaMetadata.MediaID,
+			Origin:        mediaMetadata.Origin,
+			ContentType:   mediaMetadata.ContentType,
+			FileSizeBytes: mediaMetadata.FileSizeBytes,
+			UploadName:    uploadName,
+			CreationTs:    mediaMetadata.CreationTimestamp,
+			HasThumbnails: len(thumbnails) > 0,
+		},
+	}
+}
@@ -0,0 +1,69 @@
+package routing
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/matrix-org/dendrite/mediaapi/storage"
+	"github.com/matrix-org/dendrite/mediaapi/types"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// infoTestDatabase holds a single media item with a thumbnail.
+type infoTestDatabase struct {
+	storage.Database
+	media *types.MediaMetadata
+}
+
+func (d infoTestDatabase) GetMediaMetadata(
+	ctx context.Context, mediaID types.MediaID, mediaOrigin gomatrixserverlib.ServerName,
+) (*types.MediaMetadata, error) {
+	if mediaID != d.media.MediaID || mediaOrigin != d.media.Origin {
+		return nil, nil
+	}
+	return d.media, nil
+}
+
+func (d infoTestDatabase) GetThumbnails(
+	ctx context.Context, mediaID types.MediaID, mediaOrigin gomatrixserverlib.ServerName,
+) ([]*types.ThumbnailMetadata, error) {
+	return []*types.ThumbnailMetadata{{MediaMetadata: d.media}}, nil
+}
+
+func TestGetMediaInfo(t *testing.T) {
+	db := infoTestDatabase{media: &types.MediaMetadata{
+		MediaID:           "abc",
+		Origin:            "localhost",
+		ContentType:       "image/png",
+		FileSizeBytes:     1234,
+		UploadName:        "my%20cat.png",
+		CreationTimestamp: 1600000000000,
+	}}
+	req := httptest.NewRequest(http.MethodGet, "/info/localhost/abc", nil)
+
+	res := GetMediaInfo(req, db, "localhost", "abc")
+	if res.Code != http.StatusOK {
+		t.Fatalf("got status %d, want 200", res.Code)
+	}
+	info := res.JSON.(mediaInfoResponse)
+	want := mediaInfoResponse{
+		MediaID:       "abc",
+		Origin:        "localhost",
+		ContentType:   "image/png",
+		FileSizeBytes: 1234,
+		UploadName:    "my cat.png",
+		CreationTs:    1600000000000,
+		HasThumbnails: true,
+	}
+	if info != want {
+		t.Errorf("got %+v, want %+v", info, want)
+	}
+
+	for _, mediaID := range []types.MediaID{"unknown", "../abc", ""} {
+		if res = GetMediaInfo(req, db, "localhost", mediaID); res.Code != http.StatusNotFound {
+			t.Errorf("%q: got status %d, want 404", mediaID, res.Code)
+		}
+	}
+}
@@ -0,0 +1,43 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"net/http"
+
+	"github.com/matrix-org/dendrite/internal/config"
+	"github.com/matrix-org/util"
+)
+
+// mediaConfigResponse defines the format of the JSON response to GET /config
+type mediaConfigResponse struct {
+	UploadSize *config.FileSizeBytes `json:"m.upload.size,omitempty"`
+	// The cdn_base_url which media can be downloaded through. It isn't part of the spec.
+	CDNBaseURL string `json:"cdn_base_url,omitempty"`
+}
+
+// GetMediaConfig implements GET /config
+// This tells clients how large their uploads may be, which is left out if there
+// is no limit, and the base URL of the CDN which serves media, if there is one.
+func GetMediaConfig(cfg *config.MediaAPI) util.JSONResponse {
+	res := mediaConfigResponse{CDNBaseURL: cfg.CDNBaseURL}
+	if cfg.MaxFileSizeBytes != nil && *cfg.MaxFileSizeBytes > 0 {
+		res.UploadSize = cfg.MaxFileSizeBytes
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: res,
+	}
+}
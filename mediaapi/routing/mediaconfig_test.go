@@ -0,0 +1,60 @@
+package routing
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/matrix-org/dendrite/internal/config"
+)
+
+func TestGetMediaConfig(t *testing.T) {
+	router := setupTestRouter()
+
+	// Every version of the endpoint gives the maximum upload size.
+	for _, path := range []string{
+		"/_matrix/media/r0/config",
+		"/_matrix/media/v3/config",
+		"/_matrix/media/v3/config/",
+		"/_matrix/client/v1/media/config",
+	} {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.Header.Set("Authorization", "Bearer valid")
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+
+		if rec.Code != http.StatusOK {
+			t.Errorf("GET %s: got status %d, want %d", path, rec.Code, http.StatusOK)
+			continue
+		}
+		var body map[string]interface{}
+		if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+			t.Errorf("GET %s: response is not JSON: %s", path, err)
+			continue
+		}
+		if size, ok := body["m.upload.size"].(float64); !ok || size != 1024 {
+			t.Errorf("GET %s: got m.upload.size %v, want 1024", path, body["m.upload.size"])
+		}
+	}
+
+	// Without a limit there is no size to give.
+	unlimited := config.FileSizeBytes(0)
+	res := GetMediaConfig(&config.MediaAPI{MaxFileSizeBytes: &unlimited})
+	body, err := json.Marshal(res.JSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != "{}" {
+		t.Errorf("without a maximum upload size: got %s, want {}", body)
+	}
+
+	// Clients are told where to download media through the CDN from, if anywhere.
+	res = GetMediaConfig(&config.MediaAPI{MaxFileSizeBytes: &unlimited, CDNBaseURL: "https://cdn.example.com"})
+	if body, err = json.Marshal(res.JSON); err != nil {
+		t.Fatal(err)
+	}
+	if want := `{"cdn_base_url":"https://cdn.example.com"}`; string(body) != want {
+		t.Errorf("with a CDN: got %s, want %s", body, want)
+	}
+}
@@ -0,0 +1,96 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/matrix-org/dendrite/internal/config"
+	"github.com/matrix-org/dendrite/mediaapi/types"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// normalizeOrigin returns the form that media from the origin is stored and looked up
+// under. Server names are hostnames, which are case-insensitive, so this server's own
+// name in any case is its name as configured, and other servers' names are lowercased.
+func normalizeOrigin(cfg *config.MediaAPI, origin gomatrixserverlib.ServerName) gomatrixserverlib.ServerName {
+	if strings.EqualFold(string(origin), string(cfg.Matrix.ServerName)) {
+		return cfg.Matrix.ServerName
+	}
+	return gomatrixserverlib.ServerName(strings.ToLower(string(origin)))
+}
+
+// normalizeMediaID returns the form that the media ID of media from the origin, which
+// has already been normalized, is stored and looked up under. It is only changed for
+// this server's own media if case_insensitive_media_ids is enabled.
+func normalizeMediaID(cfg *config.MediaAPI, origin gomatrixserverlib.ServerName, mediaID types.MediaID) types.MediaID {
+	if cfg.CaseInsensitiveMediaIDs && origin == cfg.Matrix.ServerName {
+		return types.MediaID(strings.ToLower(string(mediaID)))
+	}
+	return mediaID
+}
+
+// MediaIDGenerator makes up the media IDs which uploads and reservations are given
+// when they don't choose their own. Media is looked up by its media ID whatever it
+// looks like, so changing the generator leaves media which already exists alone.
+type MediaIDGenerator interface {
+	// NewMediaID returns a media ID which only uses mediaIDCharacters. It doesn't
+	// have to be unused, as another is asked for if it is already taken.
+	NewMediaID() (types.MediaID, error)
+}
+
+// NewMediaIDGenerator returns the generator for the media_id_format, which has
+// already been checked when the config was verified.
+func NewMediaIDGenerator(format string) MediaIDGenerator {
+	switch format {
+	case config.MediaIDFormatSortable:
+		return sortableMediaIDGenerator{now: time.Now}
+	default:
+		return randomMediaIDGenerator{}
+	}
+}
+
+// randomMediaIDGenerator makes media IDs out of 32 random bytes, hex encoded.
+type randomMediaIDGenerator struct{}
+
+func (randomMediaIDGenerator) NewMediaID() (types.MediaID, error) {
+	mediaIDBytes := make([]byte, 32)
+	if _, err := rand.Read(mediaIDBytes); err != nil {
+		return "", fmt.Errorf("rand.Read: %w", err)
+	}
+	return types.MediaID(hex.EncodeToString(mediaIDBytes)), nil
+}
+
+// sortableMediaIDGenerator makes media IDs which start with the time they were made
+// up, as 12 hex digits of milliseconds since the epoch, followed by 16 random bytes,
+// hex encoded. They sort in the order they were made up, so that new media is added
+// to the end of the media ID indexes rather than all over them, and media uploaded
+// around the same time is stored near each other.
+type sortableMediaIDGenerator struct {
+	now func() time.Time
+}
+
+func (g sortableMediaIDGenerator) NewMediaID() (types.MediaID, error) {
+	randomBytes := make([]byte, 16)
+	if _, err := rand.Read(randomBytes); err != nil {
+		return "", fmt.Errorf("rand.Read: %w", err)
+	}
+	ms := g.now().UnixNano() / int64(time.Millisecond)
+	return types.MediaID(fmt.Sprintf("%012x%s", ms, hex.EncodeToString(randomBytes))), nil
+}
@@ -0,0 +1,140 @@
+package routing
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/internal/config"
+	"github.com/matrix-org/dendrite/mediaapi/types"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+func TestMediaIDGenerators(t *testing.T) {
+	for _, format := range []string{config.MediaIDFormatRandom, config.MediaIDFormatSortable} {
+		generator := NewMediaIDGenerator(format)
+		seen := map[types.MediaID]bool{}
+		for i := 0; i < 1000; i++ {
+			mediaID, err := generator.NewMediaID()
+			if err != nil {
+				t.Fatalf("%s: %s", format, err)
+			}
+			if seen[mediaID] {
+				t.Fatalf("%s: media ID %q was made up twice", format, mediaID)
+			}
+			seen[mediaID] = true
+			// Media IDs go into content URIs and download paths as they are.
+			if !mediaIDRegex.MatchString(string(mediaID)) || url.PathEscape(string(mediaID)) != string(mediaID) {
+				t.Fatalf("%s: media ID %q isn't URL safe", format, mediaID)
+			}
+		}
+	}
+
+	// Sortable media IDs start with the time they were made up, so sort in that order.
+	now := time.Unix(1600000000, 0)
+	generator := sortableMediaIDGenerator{now: func() time.Time { return now }}
+	var previous types.MediaID
+	for i := 0; i < 100; i++ {
+		mediaID, err := generator.NewMediaID()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i == 0 && (len(mediaID) != 44 || mediaID[:12] != "0174876e8000") {
+			t.Errorf("got media ID %q, want 44 characters starting with the time", mediaID)
+		}
+		if mediaID <= previous {
+			t.Errorf("media ID %q made up after %q sorts before it", mediaID, previous)
+		}
+		previous = mediaID
+		now = now.Add(time.Millisecond)
+	}
+}
+
+func TestMediaCaseNormalization(t *testing.T) {
+	db, basePath, cleanup := newTestDatabase(t)
+	defer cleanup()
+	maxFileSizeBytes := config.FileSizeBytes(1024)
+	cfg := &config.MediaAPI{
+		Matrix:           &config.Global{ServerName: "Example.org"},
+		AbsBasePath:      basePath,
+		MaxFileSizeBytes: &maxFileSizeBytes,
+		AdminUsers:       []string{"@admin:Example.org"},
+	}
+	admin := &userapi.Device{UserID: "@admin:Example.org"}
+	upload := func(mediaID string) util.JSONResponse {
+		req := httptest.NewRequest(http.MethodPost, "/upload?media_id="+mediaID, strings.NewReader("content of "+mediaID))
+		req.Header.Set("Content-Type", "text/plain")
+		return Upload(req, cfg, admin, db, &types.ActiveThumbnailGeneration{
+			PathToResult: map[string]*types.ThumbnailGenerationResult{},
+		}, nil, nil)
+	}
+	download := func(origin gomatrixserverlib.ServerName, mediaID types.MediaID) (int, string) {
+		req := httptest.NewRequest(http.MethodGet, "/download/"+string(origin)+"/"+string(mediaID), nil)
+		w := httptest.NewRecorder()
+		// There is no client, so trying to fetch the media from a remote server would
+		// fail the test.
+		Download(
+			w, req, origin, mediaID, cfg, db, nil,
+			&types.ActiveRemoteRequests{MXCToResult: map[string]*types.RemoteRequestResult{}},
+			&types.ActiveThumbnailGeneration{PathToResult: map[string]*types.ThumbnailGenerationResult{}},
+			nil, nil, newMediaAccessTracker(), NewUserTrafficTracker(), false, "",
+		)
+		return w.Code, w.Body.String()
+	}
+
+	// Media IDs are case-sensitive unless case_insensitive_media_ids is enabled, but
+	// this server's name matches in any case.
+	if res := upload("Sensitive"); res.Code != http.StatusOK {
+		t.Fatalf("upload: got status %d, want %d", res.Code, http.StatusOK)
+	}
+	for _, tt := range []struct {
+		origin   gomatrixserverlib.ServerName
+		mediaID  types.MediaID
+		wantCode int
+	}{
+		{"Example.org", "Sensitive", http.StatusOK},
+		{"example.org", "Sensitive", http.StatusOK},
+		{"EXAMPLE.ORG", "Sensitive", http.StatusOK},
+		{"example.org", "sensitive", http.StatusNotFound},
+	} {
+		code, body := download(tt.origin, tt.mediaID)
+		if code != tt.wantCode {
+			t.Errorf("%s/%s: got status %d, want %d", tt.origin, tt.mediaID, code, tt.wantCode)
+		} else if code == http.StatusOK && body != "content of Sensitive" {
+			t.Errorf("%s/%s: got body %q", tt.origin, tt.mediaID, body)
+		}
+	}
+
+	cfg.CaseInsensitiveMediaIDs = true
+	res := upload("Insensitive")
+	if res.Code != http.StatusOK {
+		t.Fatalf("upload: got status %d, want %d", res.Code, http.StatusOK)
+	}
+	if got := res.JSON.(uploadResponse).ContentURI; got != "mxc://Example.org/insensitive" {
+		t.Errorf("got content URI %q, want the media ID lowercased", got)
+	}
+	for _, mediaID := range []types.MediaID{"Insensitive", "insensitive", "INSENSITIVE"} {
+		if code, body := download("example.ORG", mediaID); code != http.StatusOK || body != "content of Insensitive" {
+			t.Errorf("%s: got status %d with body %q, want the media", mediaID, code, body)
+		}
+	}
+	media, err := db.GetMediaMetadata(context.Background(), "insensitive", "Example.org")
+	if err != nil || media == nil {
+		t.Errorf("the media isn't stored under its normalized media ID: %v", err)
+	}
+
+	// Other servers' names are lowercased, but their media IDs are left alone.
+	storeTestContent(t, db, basePath, "remote.example", "Remote", "text/plain", "cached")
+	if code, _ := download("Remote.Example", "Remote"); code != http.StatusOK {
+		t.Errorf("remote media: got status %d, want %d", code, http.StatusOK)
+	}
+	if got := normalizeMediaID(cfg, "remote.example", "Remote"); got != "Remote" {
+		t.Errorf("got remote media ID %q, want it unchanged", got)
+	}
+}
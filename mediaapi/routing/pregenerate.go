@@ -0,0 +1,78 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"sync"
+	"time"
+
+	"github.com/matrix-org/dendrite/internal/config"
+)
+
+// thumbnailPregenerator limits how often thumbnails are pre-generated for remote media,
+// so that a burst of fetches doesn't take up the thumbnail generators needed for
+// thumbnails which clients are waiting for.
+type thumbnailPregenerator struct {
+	maxPerMinute int
+	// Holds a value for each pre-generation which is running.
+	running chan struct{}
+
+	sync.Mutex
+	// When the current minute started, and how many pre-generations were started in it.
+	windowStart time.Time
+	started     int
+}
+
+// newThumbnailPregenerator returns a pregenerator with the limits in the config, or nil
+// if pre-generation is disabled.
+func newThumbnailPregenerator(cfg *config.RemoteThumbnailPregeneration) *thumbnailPregenerator {
+	if !cfg.Enabled {
+		return nil
+	}
+	return &thumbnailPregenerator{
+		maxPerMinute: cfg.MaxPerMinute,
+		running:      make(chan struct{}, cfg.MaxConcurrent),
+	}
+}
+
+// tryStart returns whether thumbnails can be pre-generated now, in which case done must
+// be called once they have been. It is false for a nil pregenerator.
+func (p *thumbnailPregenerator) tryStart(now time.Time) bool {
+	if p == nil {
+		return false
+	}
+	p.Lock()
+	defer p.Unlock()
+	if p.maxPerMinute > 0 {
+		if now.Sub(p.windowStart) >= time.Minute {
+			p.windowStart = now
+			p.started = 0
+		}
+		if p.started >= p.maxPerMinute {
+			return false
+		}
+	}
+	select {
+	case p.running <- struct{}{}:
+	default:
+		return false
+	}
+	p.started++
+	return true
+}
+
+func (p *thumbnailPregenerator) done() {
+	<-p.running
+}
@@ -0,0 +1,117 @@
+package routing
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/internal/config"
+	"github.com/matrix-org/dendrite/mediaapi/types"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+func TestThumbnailPregeneratorLimits(t *testing.T) {
+	if p := newThumbnailPregenerator(&config.RemoteThumbnailPregeneration{}); p != nil || p.tryStart(time.Now()) {
+		t.Fatal("pre-generation started while disabled")
+	}
+
+	p := newThumbnailPregenerator(&config.RemoteThumbnailPregeneration{Enabled: true, MaxConcurrent: 2, MaxPerMinute: 3})
+	now := time.Now()
+	if !p.tryStart(now) || !p.tryStart(now) {
+		t.Fatal("failed to start as many pre-generations as may run at once")
+	}
+	if p.tryStart(now) {
+		t.Error("started more pre-generations than may run at once")
+	}
+	p.done()
+	if !p.tryStart(now) {
+		t.Error("failed to start a pre-generation once another was done")
+	}
+	p.done()
+	p.done()
+	if p.tryStart(now.Add(time.Second * 59)) {
+		t.Error("started more pre-generations than may be started in a minute")
+	}
+	if !p.tryStart(now.Add(time.Minute)) {
+		t.Error("failed to start a pre-generation in the next minute")
+	}
+	p.done()
+
+	unlimited := newThumbnailPregenerator(&config.RemoteThumbnailPregeneration{Enabled: true, MaxConcurrent: 1})
+	for i := 0; i < 100; i++ {
+		if !unlimited.tryStart(now) {
+			t.Fatal("failed to start a pre-generation without a limit per minute")
+		}
+		unlimited.done()
+	}
+}
+
+func TestRemoteThumbnailPregeneration(t *testing.T) {
+	db, basePath, cleanup := newTestDatabase(t)
+	defer cleanup()
+	var original bytes.Buffer
+	if err := png.Encode(&original, image.NewRGBA(image.Rect(0, 0, 200, 100))); err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(original.Bytes()) // nolint: errcheck
+	}))
+	defer server.Close()
+	serverURL, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := gomatrixserverlib.NewClientWithTransport(true, localTripper{host: serverURL.Host})
+	maxFileSizeBytes := config.FileSizeBytes(1024 * 1024)
+	cfg := &config.MediaAPI{
+		Matrix:                 &config.Global{ServerName: "localhost"},
+		AbsBasePath:            basePath,
+		MaxFileSizeBytes:       &maxFileSizeBytes,
+		MaxThumbnailGenerators: 10,
+		ThumbnailSizes:         []config.ThumbnailSize{{Width: 32, Height: 32, ResizeMethod: types.Scale}},
+	}
+	activeThumbnailGeneration := &types.ActiveThumbnailGeneration{
+		PathToResult: map[string]*types.ThumbnailGenerationResult{},
+	}
+	download := func(mediaID types.MediaID, pregenerator *thumbnailPregenerator) {
+		w := httptest.NewRecorder()
+		Download(
+			w, httptest.NewRequest(http.MethodGet, "/download/remote.example/"+string(mediaID), nil),
+			"remote.example", mediaID, cfg, db, client,
+			&types.ActiveRemoteRequests{MXCToResult: map[string]*types.RemoteRequestResult{}},
+			activeThumbnailGeneration, pregenerator, nil, newMediaAccessTracker(), NewUserTrafficTracker(), false, "",
+		)
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: got status %d, want %d", mediaID, w.Code, http.StatusOK)
+		}
+	}
+	thumbnails := func(mediaID types.MediaID) int {
+		thumbnails, err := db.GetThumbnails(context.Background(), mediaID, "remote.example")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(thumbnails)
+	}
+
+	download("disabled", nil)
+	pregenerator := newThumbnailPregenerator(&config.RemoteThumbnailPregeneration{Enabled: true, MaxConcurrent: 1})
+	download("enabled", pregenerator)
+	// Thumbnails are generated in the background, once the download has been served.
+	deadline := time.Now().Add(time.Second * 10)
+	for thumbnails("enabled") == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond * 10)
+	}
+	if got := thumbnails("enabled"); got != 1 {
+		t.Errorf("got %d thumbnails with pre-generation enabled, want 1", got)
+	}
+	if got := thumbnails("disabled"); got != 0 {
+		t.Errorf("got %d thumbnails with pre-generation disabled, want none", got)
+	}
+}
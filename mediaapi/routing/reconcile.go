@@ -0,0 +1,256 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/internal/config"
+	"github.com/matrix-org/dendrite/mediaapi/fileutils"
+	"github.com/matrix-org/dendrite/mediaapi/storage"
+	"github.com/matrix-org/dendrite/mediaapi/types"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+	log "github.com/sirupsen/logrus"
+)
+
+// reconcileBatchSize is how many media are fetched from the database, and how many
+// entries are read from each directory of the media store, at a time.
+const reconcileBatchSize = 100
+
+// reconcileMinFileAge is how long a stored file must have been left alone before it
+// can be treated as orphaned. Files are moved into place just before their metadata
+// is stored, so a newer one probably belongs to an upload which is still going.
+const reconcileMinFileAge = time.Hour
+
+// reconcileReportLimit is the most discrepancies of each kind which are listed in the
+// response to a reconciliation. All of them are counted and logged.
+const reconcileReportLimit = 1000
+
+// reconcileMediaResponse defines the format of the JSON response to POST /admin/reconcile
+type reconcileMediaResponse struct {
+	DryRun bool `json:"dry_run"`
+	// The hashes of stored files which no media refers to. Unless this was a dry run
+	// they have been removed along with their thumbnails, freeing up BytesFreed.
+	OrphanedFiles      []types.Base64Hash `json:"orphaned_files"`
+	OrphanedFilesCount int                `json:"orphaned_files_count"`
+	BytesFreed         int64              `json:"bytes_freed"`
+	// Media whose stored file is missing. These are only reported, as the file may
+	// need restoring from a backup.
+	MissingFiles      []missingMediaFile `json:"missing_files"`
+	MissingFilesCount int                `json:"missing_files_count"`
+}
+
+type missingMediaFile struct {
+	MediaID    types.MediaID                `json:"media_id"`
+	Origin     gomatrixserverlib.ServerName `json:"media_origin"`
+	Base64Hash types.Base64Hash             `json:"base64hash"`
+}
+
+// ReconcileMedia implements POST /admin/reconcile
+// This compares the media store with the media metadata, e.g. after crashes have left
+// them out of step. Stored files which no media refers to are removed, and media
+// whose file is missing are reported. If the dry_run query parameter is "true",
+// nothing is removed and the response says what would have been.
+func ReconcileMedia(
+	req *http.Request, cfg *config.MediaAPI, db storage.Database,
+) util.JSONResponse {
+	dryRun := req.URL.Query().Get("dry_run") == "true"
+
+	logger := util.GetLogger(req.Context()).WithField("DryRun", dryRun)
+	res, err := reconcileMedia(req.Context(), cfg, db, dryRun, reconcileBatchSize, reconcileMinFileAge)
+	if err != nil {
+		logger.WithError(err).Error("Failed to reconcile media")
+		return jsonerror.InternalServerError()
+	}
+	logger.WithFields(log.Fields{
+		"OrphanedFiles": res.OrphanedFilesCount,
+		"BytesFreed":    res.BytesFreed,
+		"MissingFiles":  res.MissingFilesCount,
+	}).Info("Reconciled media")
+
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: res,
+	}
+}
+
+// reconcileMedia goes through the media metadata and then the media store in batches
+// of batchSize, finding media without files and files without media. Files which were
+// modified within minFileAge are left alone.
+func reconcileMedia(
+	ctx context.Context, cfg *config.MediaAPI, db storage.Database,
+	dryRun bool, batchSize int, minFileAge time.Duration,
+) (*reconcileMediaResponse, error) {
+	res := &reconcileMediaResponse{
+		DryRun:        dryRun,
+		OrphanedFiles: []types.Base64Hash{},
+		MissingFiles:  []missingMediaFile{},
+	}
+	if err := findMissingFiles(ctx, cfg, db, batchSize, res); err != nil {
+		return nil, err
+	}
+	if err := removeOrphanedFiles(ctx, cfg, db, dryRun, batchSize, minFileAge, res); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// findMissingFiles adds the media whose file isn't in the media store to res.
+func findMissingFiles(
+	ctx context.Context, cfg *config.MediaAPI, db storage.Database, batchSize int, res *reconcileMediaResponse,
+) error {
+	logger := util.GetLogger(ctx)
+	return forEachMissingFile(ctx, cfg, db, batchSize, func(mediaMetadata *types.MediaMetadata) {
+		logger.WithFields(log.Fields{
+			"MediaID":    mediaMetadata.MediaID,
+			"Origin":     mediaMetadata.Origin,
+			"Base64Hash": mediaMetadata.Base64Hash,
+		}).Warn("Media file is missing")
+		res.MissingFilesCount++
+		if len(res.MissingFiles) < reconcileReportLimit {
+			res.MissingFiles = append(res.MissingFiles, missingMediaFile{
+				MediaID:    mediaMetadata.MediaID,
+				Origin:     mediaMetadata.Origin,
+				Base64Hash: mediaMetadata.Base64Hash,
+			})
+		}
+	})
+}
+
+// forEachMissingFile goes through the media metadata in batches of batchSize, calling f
+// for each media whose file isn't in the media store.
+func forEachMissingFile(
+	ctx context.Context, cfg *config.MediaAPI, db storage.Database, batchSize int, f func(*types.MediaMetadata),
+) error {
+	var afterOrigin gomatrixserverlib.ServerName
+	var afterMediaID types.MediaID
+	for {
+		batch, err := db.GetMediaAfter(ctx, afterOrigin, afterMediaID, batchSize)
+		if err != nil {
+			return err
+		}
+		for _, mediaMetadata := range batch {
+			afterOrigin, afterMediaID = mediaMetadata.Origin, mediaMetadata.MediaID
+			var filePath string
+			filePath, err = fileutils.GetPathFromBase64Hash(mediaMetadata.Base64Hash, cfg.AbsBasePath)
+			if err == nil {
+				_, err = os.Stat(filePath)
+				if err != nil && !os.IsNotExist(err) {
+					return err
+				}
+			}
+			if err != nil {
+				f(mediaMetadata)
+			}
+		}
+		if len(batch) < batchSize {
+			return nil
+		}
+	}
+}
+
+// removeOrphanedFiles walks the media store, where each file is kept in the directory
+// named by its hash (see fileutils.GetPathFromBase64Hash), removing those which no
+// media refers to and adding them to res.
+func removeOrphanedFiles(
+	ctx context.Context, cfg *config.MediaAPI, db storage.Database,
+	dryRun bool, batchSize int, minFileAge time.Duration, res *reconcileMediaResponse,
+) error {
+	basePath := string(cfg.AbsBasePath)
+	// The first two levels are single characters of the hash, which also skips the
+	// directory used for temporary files.
+	return forEachDirEntry(basePath, batchSize, func(first os.FileInfo) error {
+		if !first.IsDir() || len(first.Name()) != 1 {
+			return nil
+		}
+		firstPath := filepath.Join(basePath, first.Name())
+		return forEachDirEntry(firstPath, batchSize, func(second os.FileInfo) error {
+			if !second.IsDir() || len(second.Name()) != 1 {
+				return nil
+			}
+			secondPath := filepath.Join(firstPath, second.Name())
+			return forEachDirEntry(secondPath, batchSize, func(rest os.FileInfo) error {
+				if !rest.IsDir() || time.Since(rest.ModTime()) < minFileAge {
+					return nil
+				}
+				hash := types.Base64Hash(first.Name() + second.Name() + rest.Name())
+				return removeOrphanedFile(ctx, cfg, db, hash, dryRun, res)
+			})
+		})
+	})
+}
+
+// removeOrphanedFile removes the file with the given hash and its thumbnails if no
+// media refers to it.
+func removeOrphanedFile(
+	ctx context.Context, cfg *config.MediaAPI, db storage.Database,
+	hash types.Base64Hash, dryRun bool, res *reconcileMediaResponse,
+) error {
+	defer fileLocks.lock(hash)()
+	count, err := db.CountMediaByHash(ctx, hash)
+	if err != nil || count > 0 {
+		return err
+	}
+	removed, size, err := removeMediaFiles(hash, cfg.AbsBasePath, dryRun)
+	if err != nil || !removed {
+		return err
+	}
+	util.GetLogger(ctx).WithFields(log.Fields{
+		"Base64Hash": hash,
+		"Size":       size,
+		"DryRun":     dryRun,
+	}).Warn("Removing media file which no media refers to")
+	res.OrphanedFilesCount++
+	res.BytesFreed += size
+	if len(res.OrphanedFiles) < reconcileReportLimit {
+		res.OrphanedFiles = append(res.OrphanedFiles, hash)
+	}
+	return nil
+}
+
+// forEachDirEntry calls f for each entry in the directory, reading batchSize entries
+// at a time so that huge directories don't have to be held in memory. A directory
+// which doesn't exist is treated as empty.
+func forEachDirEntry(dir string, batchSize int, f func(os.FileInfo) error) error {
+	d, err := os.Open(dir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer d.Close() // nolint: errcheck
+	for {
+		entries, readErr := d.Readdir(batchSize)
+		for _, entry := range entries {
+			if err = f(entry); err != nil {
+				return err
+			}
+		}
+		if readErr == io.EOF {
+			return nil
+		}
+		if readErr != nil {
+			return readErr
+		}
+	}
+}
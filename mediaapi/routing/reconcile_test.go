@@ -0,0 +1,104 @@
+package routing
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/internal/config"
+	"github.com/matrix-org/dendrite/mediaapi/fileutils"
+	"github.com/matrix-org/dendrite/mediaapi/types"
+)
+
+func TestReconcileMedia(t *testing.T) {
+	db, basePath, cleanup := newTestDatabase(t)
+	defer cleanup()
+	cfg := &config.MediaAPI{
+		Matrix:      &config.Global{ServerName: "localhost"},
+		AbsBasePath: basePath,
+	}
+	ctx := context.Background()
+
+	// Enough media to need several batches, one of which has lost its file.
+	for _, mediaID := range []types.MediaID{"media1", "media2", "media3", "media4", "media5"} {
+		storeTestMedia(t, db, basePath, mediaID, "@alice:localhost", types.Base64Hash(mediaID+"hash"))
+	}
+	lostPath, err := fileutils.GetPathFromBase64Hash("media3hash", basePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.RemoveAll(filepath.Dir(lostPath)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Files which nothing refers to, along with a temporary upload to leave alone.
+	for _, hash := range []types.Base64Hash{"orphan1hash", "orphan2hash"} {
+		var filePath string
+		filePath, err = fileutils.GetPathFromBase64Hash(hash, basePath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = os.MkdirAll(filepath.Dir(filePath), 0770); err != nil {
+			t.Fatal(err)
+		}
+		if err = ioutil.WriteFile(filePath, []byte("orphan"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tmpDir := filepath.Join(string(basePath), "tmp", "upload")
+	if err = os.MkdirAll(tmpDir, 0770); err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(name string, res *reconcileMediaResponse) {
+		if res.OrphanedFilesCount != 2 || len(res.OrphanedFiles) != 2 || res.BytesFreed != 12 {
+			t.Errorf("%s: got orphaned files %v and %d bytes, want orphan1hash and orphan2hash and 12 bytes", name, res.OrphanedFiles, res.BytesFreed)
+		}
+		if res.MissingFilesCount != 1 || len(res.MissingFiles) != 1 || res.MissingFiles[0].MediaID != "media3" {
+			t.Errorf("%s: got missing files %+v, want media3", name, res.MissingFiles)
+		}
+	}
+
+	// The files were only just stored, so aren't old enough to be treated as orphaned.
+	res, err := reconcileMedia(ctx, cfg, db, true, 2, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.OrphanedFilesCount != 0 {
+		t.Errorf("got %d orphaned files which were too new, want 0", res.OrphanedFilesCount)
+	}
+
+	res, err = reconcileMedia(ctx, cfg, db, true, 2, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check("dry run", res)
+	if !fileExists(t, "orphan1hash", basePath) {
+		t.Error("dry run removed a file")
+	}
+
+	res, err = reconcileMedia(ctx, cfg, db, false, 2, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check("reconcile", res)
+	for _, hash := range []types.Base64Hash{"orphan1hash", "orphan2hash"} {
+		if fileExists(t, hash, basePath) {
+			t.Errorf("orphaned file %s was not removed", hash)
+		}
+	}
+	for _, hash := range []types.Base64Hash{"media1hash", "media2hash", "media4hash", "media5hash"} {
+		if !fileExists(t, hash, basePath) {
+			t.Errorf("file %s which media refers to was removed", hash)
+		}
+	}
+	if _, err = os.Stat(tmpDir); err != nil {
+		t.Errorf("temporary upload was removed: %s", err)
+	}
+	if m, _ := db.GetMediaMetadata(ctx, "media3", "localhost"); m == nil {
+		t.Error("media with a missing file was removed")
+	}
+}
@@ -0,0 +1,186 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/matrix-org/dendrite/internal/config"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// errRemoteAddressBlocked is returned when a remote server name resolves to an address
+// in one of the blocked networks.
+var errRemoteAddressBlocked = errors.New("remote server address is blocked")
+
+// The stages of fetching remote media which can time out, named after their config keys.
+const (
+	remoteTimeoutDial           = "dial"
+	remoteTimeoutTLSHandshake   = "tls_handshake"
+	remoteTimeoutResponseHeader = "response_header"
+	remoteTimeoutTransfer       = "transfer"
+)
+
+// NewRemoteClient returns a client for fetching media from remote servers. Unlike the
+// default client, which gives up on any request after 30 seconds, it has separate
+// timeouts for connecting to the remote server and for transferring the file, so
+// that unresponsive servers fail quickly without cutting off large downloads. It also
+// refuses to connect to addresses in the blocked networks.
+func NewRemoteClient(cfg *config.MediaAPI, skipVerify bool) *gomatrixserverlib.Client {
+	// The networks have already been checked when the config was verified.
+	blockedNetworks := make([]*net.IPNet, 0, len(cfg.BlockedRemoteNetworks))
+	for _, cidr := range cfg.BlockedRemoteNetworks {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			log.WithError(err).Panic("Invalid media_api.blocked_remote_networks")
+		}
+		blockedNetworks = append(blockedNetworks, network)
+	}
+	return gomatrixserverlib.NewClientWithTimeout(cfg.RemoteTimeouts.Transfer, &remoteMediaTripper{
+		timeouts:        cfg.RemoteTimeouts,
+		skipVerify:      skipVerify,
+		blockedNetworks: blockedNetworks,
+		transports:      make(map[string]http.RoundTripper),
+	})
+}
+
+// remoteMediaTripper resolves matrix:// URLs to the remote server's federation
+// listener in the same way as the default client, using transports which apply
+// the configured timeouts.
+type remoteMediaTripper struct {
+	timeouts   config.RemoteMediaTimeouts
+	skipVerify bool
+	// Connections to addresses in these networks are refused.
+	blockedNetworks []*net.IPNet
+	// transports maps a TLS server name to an HTTP transport using it for SNI.
+	transports      map[string]http.RoundTripper
+	transportsMutex sync.Mutex
+}
+
+func (t *remoteMediaTripper) getTransport(tlsServerName string) http.RoundTripper {
+	t.transportsMutex.Lock()
+	defer t.transportsMutex.Unlock()
+
+	transport, ok := t.transports[tlsServerName]
+	if !ok {
+		// The address is checked when dialling, after the host name has been resolved,
+		// so that it can't resolve to a different address by the time it is used.
+		dialer := &net.Dialer{Timeout: t.timeouts.Dial}
+		if len(t.blockedNetworks) > 0 {
+			dialer.Control = t.checkAddress
+		}
+		transport = &http.Transport{
+			DialContext: dialer.DialContext,
+			TLSClientConfig: &tls.Config{
+				ServerName:         tlsServerName,
+				InsecureSkipVerify: t.skipVerify,
+			},
+			TLSHandshakeTimeout:   t.timeouts.TLSHandshake,
+			ResponseHeaderTimeout: t.timeouts.ResponseHeader,
+		}
+		t.transports[tlsServerName] = transport
+	}
+	return transport
+}
+
+// checkAddress returns errRemoteAddressBlocked if the address being connected to is in
+// one of the blocked networks.
+func (t *remoteMediaTripper) checkAddress(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return fmt.Errorf("remote server address %q is not an IP address", host)
+	}
+	for _, blocked := range t.blockedNetworks {
+		if blocked.Contains(ip) {
+			return errors.Wrap(errRemoteAddressBlocked, host)
+		}
+	}
+	return nil
+}
+
+func (t *remoteMediaTripper) RoundTrip(r *http.Request) (*http.Response, error) {
+	serverName := gomatrixserverlib.ServerName(r.URL.Host)
+	results, err := gomatrixserverlib.ResolveServer(serverName)
+	if err != nil {
+		return nil, err
+	}
+	if len(results) == 0 {
+		return nil, fmt.Errorf("no address found for matrix host %v", serverName)
+	}
+
+	// Pass on the ID of the request which needed the media, so that the remote server can
+	// log it alongside its own.
+	if id := requestID(r.Context()); id != "" {
+		r = r.Clone(r.Context())
+		r.Header.Set(requestIDHeader, id)
+	}
+
+	// Try each address in turn, returning the error from the last if none work.
+	var resp *http.Response
+	for _, result := range results {
+		u := *r.URL
+		u.Scheme = "https"
+		u.Host = result.Destination
+		r.URL = &u
+		r.Host = string(result.Host)
+		resp, err = t.getTransport(result.TLSServerName).RoundTrip(r)
+		if err == nil {
+			return resp, nil
+		}
+	}
+	return nil, err
+}
+
+// remoteTimeout returns which stage of fetching remote media timed out to cause the
+// error, or an empty string if the error wasn't caused by a timeout.
+func remoteTimeout(err error) string {
+	if err == nil {
+		return ""
+	}
+	// net/http doesn't export its handshake and response header timeout errors, so
+	// these can only be told apart by their messages.
+	switch msg := err.Error(); {
+	case strings.Contains(msg, "TLS handshake timeout"):
+		return remoteTimeoutTLSHandshake
+	case strings.Contains(msg, "timeout awaiting response headers"):
+		return remoteTimeoutResponseHeader
+	}
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "dial" && opErr.Timeout() {
+		return remoteTimeoutDial
+	}
+	// Anything else which timed out ran into the overall limit on the request.
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return remoteTimeoutTransfer
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return remoteTimeoutTransfer
+	}
+	return ""
+}
@@ -0,0 +1,161 @@
+package routing
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/internal/config"
+	"github.com/pkg/errors"
+)
+
+// timeoutError is a net.Error which timed out.
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func newTestTripper(timeouts config.RemoteMediaTimeouts) *remoteMediaTripper {
+	return &remoteMediaTripper{
+		timeouts:   timeouts,
+		skipVerify: true,
+		transports: make(map[string]http.RoundTripper),
+	}
+}
+
+var testTimeouts = config.RemoteMediaTimeouts{
+	Dial:           time.Second * 5,
+	TLSHandshake:   time.Second * 5,
+	ResponseHeader: time.Second * 5,
+	Transfer:       time.Second * 5,
+}
+
+func TestRemoteTimeoutResponseHeader(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+
+	timeouts := testTimeouts
+	timeouts.ResponseHeader = time.Millisecond * 50
+	req, err := http.NewRequest(http.MethodGet, server.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = newTestTripper(timeouts).getTransport("").RoundTrip(req)
+	if got := remoteTimeout(err); got != remoteTimeoutResponseHeader {
+		t.Errorf("got timeout %q for error %v, want %q", got, err, remoteTimeoutResponseHeader)
+	}
+}
+
+func TestRemoteTimeoutTLSHandshake(t *testing.T) {
+	// Accept connections but never take part in the TLS handshake.
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close() // nolint: errcheck
+	go func() {
+		var conns []net.Conn
+		for {
+			conn, acceptErr := listener.Accept()
+			if acceptErr != nil {
+				for _, c := range conns {
+					c.Close() // nolint: errcheck
+				}
+				return
+			}
+			conns = append(conns, conn)
+		}
+	}()
+
+	timeouts := testTimeouts
+	timeouts.TLSHandshake = time.Millisecond * 50
+	req, err := http.NewRequest(http.MethodGet, "https://"+listener.Addr().String(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = newTestTripper(timeouts).getTransport("").RoundTrip(req)
+	if got := remoteTimeout(err); got != remoteTimeoutTLSHandshake {
+		t.Errorf("got timeout %q for error %v, want %q", got, err, remoteTimeoutTLSHandshake)
+	}
+}
+
+func TestRemoteTimeoutTransfer(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		// Send the headers and some of the file, then stall.
+		w.Header().Set("Content-Length", "1000")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("partial")) // nolint: errcheck
+		w.(http.Flusher).Flush()
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+
+	client := &http.Client{
+		Transport: newTestTripper(testTimeouts).getTransport(""),
+		Timeout:   time.Millisecond * 100,
+	}
+	resp, err := client.Get(server.URL)
+	if err != nil {
+		t.Fatalf("expected the response headers before the timeout, got %v", err)
+	}
+	defer resp.Body.Close() // nolint: errcheck
+	_, err = ioutil.ReadAll(resp.Body)
+	if got := remoteTimeout(err); got != remoteTimeoutTransfer {
+		t.Errorf("got timeout %q for error %v, want %q", got, err, remoteTimeoutTransfer)
+	}
+}
+
+func TestRemoteTimeoutDial(t *testing.T) {
+	err := &net.OpError{Op: "dial", Net: "tcp", Err: timeoutError{}}
+	if got := remoteTimeout(err); got != remoteTimeoutDial {
+		t.Errorf("got timeout %q, want %q", got, remoteTimeoutDial)
+	}
+	if got := remoteTimeout(&net.OpError{Op: "dial", Net: "tcp", Err: net.UnknownNetworkError("tcp")}); got != "" {
+		t.Errorf("got timeout %q for an error which isn't a timeout", got)
+	}
+}
+
+func TestRemoteBlockedNetworks(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+	defer server.Close()
+
+	for _, tt := range []struct {
+		cidr        string
+		wantBlocked bool
+	}{
+		{"127.0.0.0/8", true},
+		{"::ffff:127.0.0.0/104", true},
+		{"10.0.0.0/8", false},
+	} {
+		_, network, err := net.ParseCIDR(tt.cidr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tripper := newTestTripper(testTimeouts)
+		tripper.blockedNetworks = []*net.IPNet{network}
+		req, err := http.NewRequest(http.MethodGet, server.URL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := tripper.getTransport("").RoundTrip(req)
+		if err == nil {
+			resp.Body.Close() // nolint: errcheck
+		}
+		if blocked := errors.Is(err, errRemoteAddressBlocked); blocked != tt.wantBlocked {
+			t.Errorf("%s: got error %v, want blocked %v", tt.cidr, err, tt.wantBlocked)
+		}
+		if !tt.wantBlocked && err != nil {
+			t.Errorf("%s: unexpected error %v", tt.cidr, err)
+		}
+	}
+}
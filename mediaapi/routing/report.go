@@ -0,0 +1,194 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+	"unicode/utf8"
+
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/mediaapi/storage"
+	"github.com/matrix-org/dendrite/mediaapi/types"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+// maxReportReasonLength is the most characters the reason for a report can have.
+const maxReportReasonLength = 1000
+
+// The number of reports listed by GET /admin/reports if the request doesn't give a
+// limit, and the most which can be asked for at once.
+const (
+	defaultMediaReportsLimit = 50
+	maxMediaReportsLimit     = 1000
+)
+
+// reportMediaRequest defines the format of the JSON request to POST /report
+type reportMediaRequest struct {
+	Reason string `json:"reason"`
+	// How offensive the media is, from -100 for the most to 0 for not at all,
+	// as for reporting events.
+	Score *int `json:"score"`
+}
+
+// mediaReportsResponse defines the format of the JSON response to GET /admin/reports
+type mediaReportsResponse struct {
+	Reports []mediaReport `json:"reports"`
+	// The from parameter to get the next page with, if there may be more.
+	NextBatch string `json:"next_batch,omitempty"`
+}
+
+type mediaReport struct {
+	ReportID   int64              `json:"report_id"`
+	ContentURI string             `json:"content_uri"`
+	UserID     types.MatrixUserID `json:"user_id"`
+	Reason     string             `json:"reason"`
+	Score      int                `json:"score"`
+	ReportedTs types.UnixMs       `json:"reported_ts"`
+}
+
+// ReportMedia implements POST /report/{serverName}/{mediaId}
+// This lets a user report media held by this server as abusive, to be looked into
+// by admins with GET /admin/reports. A user reporting the same media again updates
+// their report rather than making another. Remote media which hasn't been fetched
+// yet is not found, as this never fetches media from other servers.
+func ReportMedia(
+	req *http.Request, dev *userapi.Device, db storage.Database,
+	origin gomatrixserverlib.ServerName, mediaID types.MediaID,
+) util.JSONResponse {
+	var r reportMediaRequest
+	if err := json.NewDecoder(req.Body).Decode(&r); err != nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.BadJSON("The request body could not be decoded into valid JSON. " + err.Error()),
+		}
+	}
+	score := 0
+	if r.Score != nil {
+		score = *r.Score
+	}
+	if score < -100 || score > 0 {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue("score must be between -100 and 0"),
+		}
+	}
+	if utf8.RuneCountInString(r.Reason) > maxReportReasonLength {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue(fmt.Sprintf("reason must not be longer than %d characters", maxReportReasonLength)),
+		}
+	}
+
+	if !mediaIDRegex.MatchString(string(mediaID)) || origin == "" {
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: jsonerror.NotFound("File not found"),
+		}
+	}
+	logger := util.GetLogger(req.Context())
+	mediaMetadata, err := db.GetMediaMetadata(req.Context(), mediaID, origin)
+	if err != nil {
+		logger.WithError(err).Error("Failed to query media metadata")
+		return jsonerror.InternalServerError()
+	}
+	if mediaMetadata == nil {
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: jsonerror.NotFound("File not found"),
+		}
+	}
+
+	err = db.StoreMediaReport(req.Context(), &types.MediaReport{
+		MediaID:           mediaID,
+		Origin:            origin,
+		UserID:            types.MatrixUserID(dev.UserID),
+		Reason:            r.Reason,
+		Score:             score,
+		ReportedTimestamp: types.UnixMs(time.Now().UnixNano() / 1000000),
+	})
+	if err != nil {
+		logger.WithError(err).Error("Failed to store media report")
+		return jsonerror.InternalServerError()
+	}
+	logger.WithField("MediaID", mediaID).WithField("Origin", origin).Info("Media reported")
+
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: struct{}{},
+	}
+}
+
+// GetMediaReports implements GET /admin/reports
+// This lists the reports users made of media, in the order they were first made.
+// Up to limit reports are returned, starting after the report ID given as from,
+// and next_batch is set to the from to use for the next page if there may be more.
+func GetMediaReports(req *http.Request, db storage.Database) util.JSONResponse {
+	limit := defaultMediaReportsLimit
+	if value := req.URL.Query().Get("limit"); value != "" {
+		var err error
+		limit, err = strconv.Atoi(value)
+		if err != nil || limit < 1 || limit > maxMediaReportsLimit {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.InvalidArgumentValue(fmt.Sprintf("limit must be between 1 and %d", maxMediaReportsLimit)),
+			}
+		}
+	}
+	var from int64
+	if value := req.URL.Query().Get("from"); value != "" {
+		var err error
+		from, err = strconv.ParseInt(value, 10, 64)
+		if err != nil || from < 0 {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.InvalidArgumentValue("from must be a token from next_batch"),
+			}
+		}
+	}
+
+	// One more than the limit is fetched to find out whether there is another page.
+	batch, err := db.GetMediaReports(req.Context(), from, limit+1)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("Failed to query media reports")
+		return jsonerror.InternalServerError()
+	}
+
+	res := mediaReportsResponse{Reports: []mediaReport{}}
+	if len(batch) > limit {
+		batch = batch[:limit]
+		res.NextBatch = strconv.FormatInt(batch[limit-1].ReportID, 10)
+	}
+	for _, report := range batch {
+		res.Reports = append(res.Reports, mediaReport{
+			ReportID:   report.ReportID,
+			ContentURI: fmt.Sprintf("mxc://%s/%s", report.Origin, report.MediaID),
+			UserID:     report.UserID,
+			Reason:     report.Reason,
+			Score:      report.Score,
+			ReportedTs: report.ReportedTimestamp,
+		})
+	}
+
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: res,
+	}
+}
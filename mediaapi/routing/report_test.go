@@ -0,0 +1,121 @@
+package routing
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/mediaapi/types"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+)
+
+func TestReportMedia(t *testing.T) {
+	db, _, cleanup := newTestDatabase(t)
+	defer cleanup()
+	ctx := context.Background()
+	if err := db.StoreMediaMetadata(ctx, &types.MediaMetadata{
+		MediaID: "abc", Origin: "localhost", ContentType: "image/png", FileSizeBytes: 4,
+		Base64Hash: "abc", UserID: "@bob:localhost",
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	report := func(userID, mediaID, body string) int {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodPost, "/unstable/report/localhost/"+mediaID, strings.NewReader(body))
+		res := ReportMedia(req, &userapi.Device{UserID: userID}, db, "localhost", types.MediaID(mediaID))
+		if res.Code != http.StatusOK {
+			if _, ok := res.JSON.(*jsonerror.MatrixError); !ok {
+				t.Errorf("%s: got %+v, want a Matrix error", body, res.JSON)
+			}
+		}
+		return res.Code
+	}
+
+	for _, tt := range []struct {
+		mediaID string
+		body    string
+		code    int
+	}{
+		{"abc", `{"reason": "spam", "score": -100}`, http.StatusOK},
+		{"abc", `{}`, http.StatusOK},
+		{"abc", `{"score": 1}`, http.StatusBadRequest},
+		{"abc", `{"score": -101}`, http.StatusBadRequest},
+		{"abc", `{"reason": "` + strings.Repeat("é", maxReportReasonLength+1) + `"}`, http.StatusBadRequest},
+		{"abc", `{"reason": 1}`, http.StatusBadRequest},
+		{"abc", `not json`, http.StatusBadRequest},
+		{"missing", `{"reason": "spam"}`, http.StatusNotFound},
+		{"not~valid", `{"reason": "spam"}`, http.StatusNotFound},
+	} {
+		if code := report("@alice:localhost", tt.mediaID, tt.body); code != tt.code {
+			t.Errorf("%s %s: got status %d, want %d", tt.mediaID, tt.body, code, tt.code)
+		}
+	}
+
+	// Reporting again updates the user's report rather than adding one.
+	report("@alice:localhost", "abc", `{"reason": "abuse", "score": -50}`)
+	report("@carol:localhost", "abc", `{"reason": "spam"}`)
+	reports, err := db.GetMediaReports(ctx, 0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reports) != 2 {
+		t.Fatalf("got %d reports, want 2", len(reports))
+	}
+	if r := reports[0]; r.UserID != "@alice:localhost" || r.MediaID != "abc" || r.Origin != "localhost" ||
+		r.Reason != "abuse" || r.Score != -50 || r.ReportedTimestamp == 0 {
+		t.Errorf("got %+v, want alice's updated report", r)
+	}
+	if r := reports[1]; r.UserID != "@carol:localhost" || r.Score != 0 {
+		t.Errorf("got %+v, want carol's report", r)
+	}
+}
+
+func TestGetMediaReports(t *testing.T) {
+	db, _, cleanup := newTestDatabase(t)
+	defer cleanup()
+	ctx := context.Background()
+	for _, userID := range []types.MatrixUserID{"@alice:localhost", "@bob:localhost", "@carol:localhost"} {
+		if err := db.StoreMediaReport(ctx, &types.MediaReport{
+			MediaID: "abc", Origin: "localhost", UserID: userID, Reason: "spam", Score: -10, ReportedTimestamp: 1,
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	list := func(query string) mediaReportsResponse {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodGet, "/unstable/admin/reports"+query, nil)
+		res := GetMediaReports(req, db)
+		if res.Code != http.StatusOK {
+			t.Fatalf("%s: got status %d, want %d", query, res.Code, http.StatusOK)
+		}
+		return res.JSON.(mediaReportsResponse)
+	}
+
+	first := list("?limit=2")
+	if len(first.Reports) != 2 || first.Reports[0].UserID != "@alice:localhost" || first.Reports[1].UserID != "@bob:localhost" {
+		t.Errorf("first page: got %+v, want alice's and bob's reports", first.Reports)
+	}
+	if r := first.Reports[0]; r.ContentURI != "mxc://localhost/abc" || r.Reason != "spam" || r.Score != -10 || r.ReportedTs != 1 {
+		t.Errorf("got %+v", r)
+	}
+	if first.NextBatch != strconv.FormatInt(first.Reports[1].ReportID, 10) {
+		t.Errorf("first page: got next_batch %q, want the last report ID", first.NextBatch)
+	}
+	second := list("?limit=2&from=" + first.NextBatch)
+	if len(second.Reports) != 1 || second.Reports[0].UserID != "@carol:localhost" || second.NextBatch != "" {
+		t.Errorf("second page: got %+v, want only carol's report", second)
+	}
+
+	for _, query := range []string{"?limit=0", "?limit=1001", "?limit=x", "?from=x", "?from=-1"} {
+		req := httptest.NewRequest(http.MethodGet, "/unstable/admin/reports"+query, nil)
+		if res := GetMediaReports(req, db); res.Code != http.StatusBadRequest {
+			t.Errorf("%s: got status %d, want %d", query, res.Code, http.StatusBadRequest)
+		}
+	}
+}
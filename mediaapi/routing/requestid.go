@@ -0,0 +1,55 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"net/http"
+	"regexp"
+
+	"github.com/matrix-org/util"
+)
+
+// requestIDHeader holds the ID which ties together the logs for a request, including
+// any requests made to remote servers on its behalf.
+const requestIDHeader = "X-Request-ID"
+
+// requestIDRegex limits the request IDs which are accepted from clients, so that they
+// can't put anything misleading into the logs.
+var requestIDRegex = regexp.MustCompile(`^[A-Za-z0-9._\-]{1,64}$`)
+
+type requestIDContextKey struct{}
+
+// withRequestID uses the request ID sent by the client, e.g. by a reverse proxy, for the
+// request if there is one, or otherwise the one given by util.RequestWithLogging. The ID
+// is added to the logger and the response headers, and can be retrieved with requestID.
+func withRequestID(w http.ResponseWriter, req *http.Request) *http.Request {
+	ctx := req.Context()
+	id := req.Header.Get(requestIDHeader)
+	if !requestIDRegex.MatchString(id) {
+		id = util.GetRequestID(ctx)
+	}
+	ctx = context.WithValue(ctx, requestIDContextKey{}, id)
+	ctx = util.ContextWithLogger(ctx, util.GetLogger(ctx).WithField("req.id", id))
+	w.Header().Set(requestIDHeader, id)
+	return req.WithContext(ctx)
+}
+
+// requestID returns the request ID set by withRequestID, or an empty string if there
+// isn't one.
+func requestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDContextKey{}).(string)
+	return id
+}
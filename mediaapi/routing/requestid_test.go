@@ -0,0 +1,75 @@
+package routing
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/matrix-org/util"
+)
+
+func TestWithRequestID(t *testing.T) {
+	tests := []struct {
+		header    string
+		wantOwnID bool
+	}{
+		{"", false},
+		{"abc-123.def_456", true},
+		{"has spaces", false},
+		{"has\nnewline", false},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/download/localhost/abc", nil)
+		if tt.header != "" {
+			req.Header.Set(requestIDHeader, tt.header)
+		}
+		req = util.RequestWithLogging(req)
+		generated := util.GetRequestID(req.Context())
+		w := httptest.NewRecorder()
+		req = withRequestID(w, req)
+
+		want := generated
+		if tt.wantOwnID {
+			want = tt.header
+		}
+		if got := requestID(req.Context()); got != want {
+			t.Errorf("%q: got request ID %q, want %q", tt.header, got, want)
+		}
+		if got := w.Header().Get(requestIDHeader); got != want {
+			t.Errorf("%q: got %s header %q, want %q", tt.header, requestIDHeader, got, want)
+		}
+		if got := util.GetLogger(req.Context()).Data["req.id"]; got != want {
+			t.Errorf("%q: got logged request ID %v, want %q", tt.header, got, want)
+		}
+	}
+}
+
+func TestRemoteRequestID(t *testing.T) {
+	received := make(chan string, 1)
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		received <- req.Header.Get(requestIDHeader)
+	}))
+	defer server.Close()
+	serverURL, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/download/localhost/abc", nil)
+	req.Header.Set(requestIDHeader, "test-id")
+	req = withRequestID(httptest.NewRecorder(), req)
+
+	remoteReq, err := http.NewRequest(http.MethodGet, "matrix://"+serverURL.Host+"/_matrix/media/v1/download/remote/abc", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := newTestTripper(testTimeouts).RoundTrip(remoteReq.WithContext(req.Context()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close() // nolint: errcheck
+	if got := <-received; got != "test-id" {
+		t.Errorf("got %s header %q, want %q", requestIDHeader, got, "test-id")
+	}
+}
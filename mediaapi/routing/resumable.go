@@ -0,0 +1,492 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/internal/config"
+	"github.com/matrix-org/dendrite/mediaapi/fileutils"
+	"github.com/matrix-org/dendrite/mediaapi/scanner"
+	"github.com/matrix-org/dendrite/mediaapi/storage"
+	"github.com/matrix-org/dendrite/mediaapi/types"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/util"
+	log "github.com/sirupsen/logrus"
+)
+
+// tusVersion is the version of the tus protocol which resumable uploads use.
+// https://tus.io/protocols/resumable-upload
+const tusVersion = "1.0.0"
+
+// resumableUploadCleanupInterval is how often expired resumable uploads are removed.
+const resumableUploadCleanupInterval = time.Minute
+
+// resumableUploads keeps track of resumable uploads which haven't finished yet, and
+// of those which have finished until they expire, so that a client which missed the
+// response to the last part can still find out the content URI.
+type resumableUploads struct {
+	sync.Mutex
+	cfg     *config.ResumableUploads
+	uploads map[string]*resumableUpload
+}
+
+type resumableUpload struct {
+	userID types.MatrixUserID
+	// The temporary directory which the parts are added to, until the upload finishes
+	tmpDir      types.Path
+	length      int64
+	offset      int64
+	contentType types.ContentType
+	uploadName  types.Filename
+	expires     time.Time
+	// Whether a part is being added, during which no other parts are accepted
+	busy bool
+	// The content URI once the upload has finished
+	contentURI string
+}
+
+func newResumableUploads(cfg *config.ResumableUploads) *resumableUploads {
+	return &resumableUploads{cfg: cfg, uploads: map[string]*resumableUpload{}}
+}
+
+// create starts a new resumable upload, returning its ID. Returns an empty ID if the
+// user already has the maximum number of unfinished uploads.
+func (u *resumableUploads) create(upload *resumableUpload) (string, error) {
+	idBytes := make([]byte, 16)
+	if _, err := rand.Read(idBytes); err != nil {
+		return "", fmt.Errorf("rand.Read: %w", err)
+	}
+	u.Lock()
+	defer u.Unlock()
+	if u.cfg.MaxPerUser > 0 {
+		unfinished := 0
+		for _, other := range u.uploads {
+			if other.userID == upload.userID && other.contentURI == "" {
+				unfinished++
+			}
+		}
+		if unfinished >= u.cfg.MaxPerUser {
+			return "", nil
+		}
+	}
+	id := hex.EncodeToString(idBytes)
+	upload.expires = time.Now().Add(u.cfg.Expiry)
+	u.uploads[id] = upload
+	return id, nil
+}
+
+// get returns a copy of the user's upload with the ID, or nil if there isn't one.
+func (u *resumableUploads) get(id string, userID types.MatrixUserID) *resumableUpload {
+	u.Lock()
+	defer u.Unlock()
+	upload, ok := u.uploads[id]
+	if !ok || upload.userID != userID {
+		return nil
+	}
+	copied := *upload
+	return &copied
+}
+
+// startPart marks the user's upload with the ID as busy while a part is added at the
+// offset, returning it. finishPart must be called once the part has been added.
+// If the part can't be added then an error response is returned instead.
+func (u *resumableUploads) startPart(id string, userID types.MatrixUserID, offset int64) (*resumableUpload, *util.JSONResponse) {
+	u.Lock()
+	defer u.Unlock()
+	upload, ok := u.uploads[id]
+	if !ok || upload.userID != userID {
+		return nil, &util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: jsonerror.NotFound("Unknown or expired upload"),
+		}
+	}
+	if upload.busy {
+		return nil, &util.JSONResponse{
+			Code: http.StatusConflict,
+			JSON: jsonerror.UploadInProgress("Another part of the upload is still being received"),
+		}
+	}
+	if offset != upload.offset {
+		return nil, &util.JSONResponse{
+			Code:    http.StatusConflict,
+			JSON:    jsonerror.InvalidArgumentValue(fmt.Sprintf("Upload-Offset must be %d", upload.offset)),
+			Headers: map[string]string{"Upload-Offset": strconv.FormatInt(upload.offset, 10)},
+		}
+	}
+	upload.busy = true
+	return upload, nil
+}
+
+// finishPart records that a part of the upload was added, taking it to the offset,
+// and returns the headers to respond with.
+func (u *resumableUploads) finishPart(upload *resumableUpload, offset int64, contentURI string) map[string]string {
+	u.Lock()
+	defer u.Unlock()
+	upload.busy = false
+	upload.offset = offset
+	upload.expires = time.Now().Add(u.cfg.Expiry)
+	if contentURI != "" {
+		upload.contentURI = contentURI
+		upload.tmpDir = ""
+	}
+	return upload.headers()
+}
+
+// remove forgets about the upload, e.g. because it failed once it was complete.
+func (u *resumableUploads) remove(id string) {
+	u.Lock()
+	defer u.Unlock()
+	delete(u.uploads, id)
+}
+
+// removeExpired removes the uploads which expired before now, along with the parts of
+// them which were received. Returns the number of uploads which were removed.
+func (u *resumableUploads) removeExpired(now time.Time, logger *log.Entry) int {
+	u.Lock()
+	defer u.Unlock()
+	removed := 0
+	for id, upload := range u.uploads {
+		if upload.busy || now.Before(upload.expires) {
+			continue
+		}
+		if upload.tmpDir != "" {
+			fileutils.RemoveDir(upload.tmpDir, logger)
+		}
+		delete(u.uploads, id)
+		removed++
+	}
+	return removed
+}
+
+func (u *resumableUploads) run(interval time.Duration) {
+	logger := log.WithField("component", "resumable_uploads")
+	for range time.Tick(interval) {
+		if removed := u.removeExpired(time.Now(), logger); removed > 0 {
+			logger.Infof("Removed %d expired resumable upload(s)", removed)
+		}
+	}
+}
+
+// withTusHeaders adds the headers which every tus response has, and responds to
+// OPTIONS requests with the parts of the protocol which are supported. Browsers also
+// need to be allowed to send and read the tus headers, which the usual CORS headers
+// don't allow.
+func withTusHeaders(cfg *config.MediaAPI, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Tus-Resumable", tusVersion)
+		w.Header().Set("Access-Control-Expose-Headers", "Location, Tus-Resumable, Tus-Version, Tus-Extension, Tus-Max-Size, Upload-Offset, Upload-Length, Upload-Expires")
+		if req.Method != http.MethodOptions {
+			h.ServeHTTP(w, req)
+			return
+		}
+		util.SetCORSHeaders(w)
+		w.Header().Set("Access-Control-Allow-Methods", "POST, HEAD, PATCH, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Headers", "Origin, X-Requested-With, Content-Type, Accept, Authorization, Tus-Resumable, Upload-Length, Upload-Metadata, Upload-Offset")
+		w.Header().Set("Tus-Version", tusVersion)
+		w.Header().Set("Tus-Extension", "creation,expiration")
+		if *cfg.MaxFileSizeBytes > 0 {
+			w.Header().Set("Tus-Max-Size", strconv.FormatInt(int64(*cfg.MaxFileSizeBytes), 10))
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+// checkTusVersion returns an error response if the request isn't for the supported
+// version of the tus protocol.
+func checkTusVersion(req *http.Request) *util.JSONResponse {
+	if req.Header.Get("Tus-Resumable") == tusVersion {
+		return nil
+	}
+	return &util.JSONResponse{
+		Code:    http.StatusPreconditionFailed,
+		JSON:    jsonerror.InvalidArgumentValue("Tus-Resumable must be " + tusVersion),
+		Headers: map[string]string{"Tus-Version": tusVersion},
+	}
+}
+
+// parseUploadMetadata parses an Upload-Metadata header, which is a comma separated
+// list of keys, each followed by a space and its base64 encoded value if it has one.
+func parseUploadMetadata(header string) (map[string]string, error) {
+	metadata := map[string]string{}
+	if strings.TrimSpace(header) == "" {
+		return metadata, nil
+	}
+	for _, pair := range strings.Split(header, ",") {
+		fields := strings.Fields(pair)
+		if len(fields) == 0 || len(fields) > 2 {
+			return nil, fmt.Errorf("invalid key and value %q", pair)
+		}
+		var value []byte
+		if len(fields) == 2 {
+			var err error
+			if value, err = base64.StdEncoding.DecodeString(fields[1]); err != nil {
+				return nil, fmt.Errorf("invalid value for %q: %w", fields[0], err)
+			}
+		}
+		metadata[fields[0]] = string(value)
+	}
+	return metadata, nil
+}
+
+func (upload *resumableUpload) headers() map[string]string {
+	return map[string]string{
+		"Upload-Offset":  strconv.FormatInt(upload.offset, 10),
+		"Upload-Length":  strconv.FormatInt(upload.length, 10),
+		"Upload-Expires": upload.expires.UTC().Format(http.TimeFormat),
+		"Cache-Control":  "no-store",
+	}
+}
+
+// CreateResumableUpload implements POST /resumable_upload
+// This starts a resumable upload of Upload-Length bytes, which are then sent in parts
+// with PATCH. The file name and content type may be given as filename and
+// content_type in Upload-Metadata.
+func CreateResumableUpload(
+	req *http.Request, cfg *config.MediaAPI, dev *userapi.Device, uploads *resumableUploads,
+) util.JSONResponse {
+	if resErr := checkTusVersion(req); resErr != nil {
+		return *resErr
+	}
+	length, err := strconv.ParseInt(req.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length <= 0 {
+		// Upload-Defer-Length isn't supported either, as the size must be checked now.
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue("Upload-Length must be a positive number of bytes"),
+		}
+	}
+	metadata, err := parseUploadMetadata(req.Header.Get("Upload-Metadata"))
+	if err != nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue("Invalid Upload-Metadata: " + err.Error()),
+		}
+	}
+	r := &uploadRequest{
+		MediaMetadata: &types.MediaMetadata{
+			Origin:        cfg.Matrix.ServerName,
+			FileSizeBytes: types.FileSizeBytes(length),
+			ContentType:   types.ContentType(metadata["content_type"]),
+			UploadName:    sanitizeUploadName(metadata["filename"]),
+			UserID:        types.MatrixUserID(dev.UserID),
+		},
+		Logger: util.GetLogger(req.Context()).WithFields(log.Fields{
+			"Origin":   cfg.Matrix.ServerName,
+			"ClientIP": requestClientIP(req),
+		}),
+	}
+	if resErr := r.validateMetadata(cfg); resErr != nil {
+		return *resErr
+	}
+
+	tmpDir, err := fileutils.CreateEmptyTempFile(cfg.AbsBasePath)
+	if err != nil {
+		if resErr := r.storageErrorResponse(err); resErr != nil {
+			return *resErr
+		}
+		r.Logger.WithError(err).Error("Failed to create temporary file for resumable upload")
+		return jsonerror.InternalServerError()
+	}
+	upload := &resumableUpload{
+		userID:      r.MediaMetadata.UserID,
+		tmpDir:      tmpDir,
+		length:      length,
+		contentType: r.MediaMetadata.ContentType,
+		uploadName:  r.MediaMetadata.UploadName,
+	}
+	id, err := uploads.create(upload)
+	if err != nil || id == "" {
+		fileutils.RemoveDir(tmpDir, r.Logger)
+		if err != nil {
+			r.Logger.WithError(err).Error("Failed to start resumable upload")
+			return jsonerror.InternalServerError()
+		}
+		return util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.QuotaExceeded(fmt.Sprintf("You may not have more than %d unfinished uploads", uploads.cfg.MaxPerUser)),
+		}
+	}
+
+	r.Logger.WithFields(log.Fields{
+		"UploadID":      id,
+		"FileSizeBytes": length,
+		"ContentType":   upload.contentType,
+	}).Info("Started resumable upload")
+	headers := upload.headers()
+	headers["Location"] = strings.TrimSuffix(req.URL.Path, "/") + "/" + id
+	return util.JSONResponse{
+		Code:    http.StatusCreated,
+		JSON:    struct{}{},
+		Headers: headers,
+	}
+}
+
+// GetResumableUpload implements HEAD /resumable_upload/{uploadId}
+// This gives how much of the upload has been received as the Upload-Offset, which is
+// where the client should carry on from.
+func GetResumableUpload(req *http.Request, dev *userapi.Device, uploads *resumableUploads, id string) util.JSONResponse {
+	if resErr := checkTusVersion(req); resErr != nil {
+		return *resErr
+	}
+	upload := uploads.get(id, types.MatrixUserID(dev.UserID))
+	if upload == nil {
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: jsonerror.NotFound("Unknown or expired upload"),
+		}
+	}
+	return util.JSONResponse{
+		Code:    http.StatusOK,
+		JSON:    struct{}{},
+		Headers: upload.headers(),
+	}
+}
+
+// AppendResumableUpload implements PATCH /resumable_upload/{uploadId}
+// This adds the request body to the upload at the Upload-Offset. Once the whole upload
+// has been received it is stored in the same way as any other upload, and the content
+// URI is returned. A part at the end of an upload which has already finished returns
+// the content URI again.
+func AppendResumableUpload(
+	req *http.Request, cfg *config.MediaAPI, dev *userapi.Device, db storage.Database,
+	activeThumbnailGeneration *types.ActiveThumbnailGeneration, encryptionKey *fileutils.EncryptionKey,
+	uploadScanner scanner.Scanner, uploads *resumableUploads, id string,
+) util.JSONResponse {
+	if resErr := checkTusVersion(req); resErr != nil {
+		return *resErr
+	}
+	if req.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		return util.JSONResponse{
+			Code: http.StatusUnsupportedMediaType,
+			JSON: jsonerror.UnsupportedMediaType("Content-Type must be application/offset+octet-stream"),
+		}
+	}
+	offset, err := strconv.ParseInt(req.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue("Upload-Offset must be a number of bytes"),
+		}
+	}
+	upload, resErr := uploads.startPart(id, types.MatrixUserID(dev.UserID), offset)
+	if resErr != nil {
+		return *resErr
+	}
+	if upload.contentURI != "" {
+		return resumableUploadFinished(cfg, upload.contentURI, uploads.finishPart(upload, offset, ""))
+	}
+
+	r := &uploadRequest{
+		MediaMetadata: &types.MediaMetadata{
+			Origin:        cfg.Matrix.ServerName,
+			FileSizeBytes: types.FileSizeBytes(upload.length),
+			ContentType:   upload.contentType,
+			UploadName:    upload.uploadName,
+			UserID:        upload.userID,
+		},
+		Logger: util.GetLogger(req.Context()).WithFields(log.Fields{
+			"Origin":   cfg.Matrix.ServerName,
+			"ClientIP": requestClientIP(req),
+			"UploadID": id,
+		}),
+	}
+	// The parts can't add up to more than the length given when the upload was
+	// started, which was no more than the maximum file size.
+	reader := &uploadSizeLimiter{reader: req.Body, remaining: upload.length - offset}
+	written, err := fileutils.AppendTempFile(upload.tmpDir, reader)
+	if err == errFileTooLarge {
+		if err = fileutils.TruncateTempFile(upload.tmpDir, offset); err != nil {
+			r.Logger.WithError(err).Error("Failed to remove part which was too large from resumable upload")
+			uploads.finishPart(upload, offset+written, "")
+			return jsonerror.InternalServerError()
+		}
+		uploads.finishPart(upload, offset, "")
+		return util.JSONResponse{
+			Code:    http.StatusRequestEntityTooLarge,
+			JSON:    jsonerror.TooLarge(fmt.Sprintf("The parts of the upload must add up to Upload-Length (%d).", upload.length)),
+			Headers: map[string]string{"Upload-Offset": strconv.FormatInt(offset, 10)},
+		}
+	}
+	offset += written
+	if err != nil {
+		// Whatever was received is kept, so the client can carry on from there.
+		uploads.finishPart(upload, offset, "")
+		if resErr = r.storageErrorResponse(err); resErr != nil {
+			return *resErr
+		}
+		r.Logger.WithError(err).Warn("Failed to receive part of resumable upload")
+		return util.JSONResponse{
+			Code:    http.StatusBadRequest,
+			JSON:    jsonerror.Unknown("Failed to upload part"),
+			Headers: map[string]string{"Upload-Offset": strconv.FormatInt(offset, 10)},
+		}
+	}
+	if offset < upload.length {
+		return util.JSONResponse{
+			Code:    http.StatusNoContent,
+			JSON:    struct{}{},
+			Headers: uploads.finishPart(upload, offset, ""),
+		}
+	}
+
+	// The whole upload has been received, so it goes through the same checks as any
+	// other upload before it is stored. If it fails then it has to be started again.
+	resErr = r.finishResumableUpload(req, cfg, db, activeThumbnailGeneration, encryptionKey, uploadScanner, upload.tmpDir)
+	if resErr != nil {
+		uploads.remove(id)
+		return *resErr
+	}
+	contentURI := fmt.Sprintf("mxc://%s/%s", cfg.Matrix.ServerName, r.MediaMetadata.MediaID)
+	return resumableUploadFinished(cfg, contentURI, uploads.finishPart(upload, offset, contentURI))
+}
+
+// finishResumableUpload stores the upload from the file in tmpDir, which is removed.
+func (r *uploadRequest) finishResumableUpload(
+	req *http.Request, cfg *config.MediaAPI, db storage.Database,
+	activeThumbnailGeneration *types.ActiveThumbnailGeneration, encryptionKey *fileutils.EncryptionKey,
+	uploadScanner scanner.Scanner, tmpDir types.Path,
+) *util.JSONResponse {
+	defer fileutils.RemoveDir(tmpDir, r.Logger)
+	file, err := fileutils.OpenTempFile(tmpDir)
+	if err != nil {
+		r.Logger.WithError(err).Error("Failed to open resumable upload")
+		resErr := jsonerror.InternalServerError()
+		return &resErr
+	}
+	defer file.Close() // nolint: errcheck
+	// The client has already sent everything, so storing the upload carries on even if
+	// the connection drops now, which would otherwise lose the whole upload.
+	ctx := util.ContextWithLogger(context.Background(), util.GetLogger(req.Context()))
+	return r.doUpload(ctx, file, cfg, db, activeThumbnailGeneration, encryptionKey, uploadScanner)
+}
+
+func resumableUploadFinished(cfg *config.MediaAPI, contentURI string, headers map[string]string) util.JSONResponse {
+	return util.JSONResponse{
+		Code:    http.StatusOK,
+		JSON:    uploadResponse{ContentURI: contentURI, DownloadURL: cdnDownloadURL(cfg, contentURI)},
+		Headers: headers,
+	}
+}
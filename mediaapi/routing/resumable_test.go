@@ -0,0 +1,254 @@
+package routing
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/internal/config"
+	"github.com/matrix-org/dendrite/mediaapi/types"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/util"
+	"github.com/sirupsen/logrus"
+)
+
+// droppedConnection reads the content and then fails, as if the connection dropped.
+type droppedConnection struct {
+	io.Reader
+}
+
+func (c *droppedConnection) Read(p []byte) (int, error) {
+	n, err := c.Reader.Read(p)
+	if err == io.EOF {
+		err = errors.New("connection reset by peer")
+	}
+	return n, err
+}
+
+func TestResumableUpload(t *testing.T) {
+	db, basePath, cleanup := newTestDatabase(t)
+	defer cleanup()
+	maxFileSizeBytes := config.FileSizeBytes(1024)
+	cfg := &config.MediaAPI{
+		Matrix:             &config.Global{ServerName: "localhost"},
+		AbsBasePath:        basePath,
+		MaxFileSizeBytes:   &maxFileSizeBytes,
+		DefaultContentType: "application/octet-stream",
+		ResumableUploads:   config.ResumableUploads{Enabled: true, Expiry: time.Hour, MaxPerUser: 2},
+	}
+	activeThumbnailGeneration := &types.ActiveThumbnailGeneration{
+		PathToResult: map[string]*types.ThumbnailGenerationResult{},
+	}
+	uploads := newResumableUploads(&cfg.ResumableUploads)
+	alice := &userapi.Device{UserID: "@alice:localhost"}
+	bob := &userapi.Device{UserID: "@bob:localhost"}
+
+	create := func(dev *userapi.Device, length string, metadata string) util.JSONResponse {
+		req := httptest.NewRequest(http.MethodPost, "/_matrix/media/unstable/resumable_upload", nil)
+		req.Header.Set("Tus-Resumable", tusVersion)
+		req.Header.Set("Upload-Length", length)
+		req.Header.Set("Upload-Metadata", metadata)
+		return CreateResumableUpload(req, cfg, dev, uploads)
+	}
+	patch := func(dev *userapi.Device, id string, offset int, body io.Reader) util.JSONResponse {
+		req := httptest.NewRequest(http.MethodPatch, "/_matrix/media/unstable/resumable_upload/"+id, body)
+		req.Header.Set("Tus-Resumable", tusVersion)
+		req.Header.Set("Content-Type", "application/offset+octet-stream")
+		req.Header.Set("Upload-Offset", strconv.Itoa(offset))
+		return AppendResumableUpload(req, cfg, dev, db, activeThumbnailGeneration, nil, nil, uploads, id)
+	}
+	head := func(dev *userapi.Device, id string) util.JSONResponse {
+		req := httptest.NewRequest(http.MethodHead, "/_matrix/media/unstable/resumable_upload/"+id, nil)
+		req.Header.Set("Tus-Resumable", tusVersion)
+		return GetResumableUpload(req, dev, uploads, id)
+	}
+
+	content := "the whole file, sent in parts"
+	metadata := "filename " + base64.StdEncoding.EncodeToString([]byte("parts.txt")) +
+		",content_type " + base64.StdEncoding.EncodeToString([]byte("text/plain"))
+	res := create(alice, strconv.Itoa(len(content)), metadata)
+	if res.Code != http.StatusCreated {
+		t.Fatalf("create: got status %d, want %d", res.Code, http.StatusCreated)
+	}
+	location := res.Headers["Location"]
+	id := strings.TrimPrefix(location, "/_matrix/media/unstable/resumable_upload/")
+	if id == location || id == "" {
+		t.Fatalf("create: got Location %q", location)
+	}
+	if res.Headers["Upload-Offset"] != "0" {
+		t.Errorf("create: got Upload-Offset %q, want 0", res.Headers["Upload-Offset"])
+	}
+	if _, err := http.ParseTime(res.Headers["Upload-Expires"]); err != nil {
+		t.Errorf("create: got Upload-Expires %q: %v", res.Headers["Upload-Expires"], err)
+	}
+	tmpDir := uploads.get(id, "@alice:localhost").tmpDir
+
+	// The connection drops part way through the first part, but what was received is kept.
+	res = patch(alice, id, 0, &droppedConnection{strings.NewReader(content[:5])})
+	if res.Code != http.StatusBadRequest || res.Headers["Upload-Offset"] != "5" {
+		t.Errorf("dropped part: got status %d and Upload-Offset %q, want %d and 5", res.Code, res.Headers["Upload-Offset"], http.StatusBadRequest)
+	}
+	res = head(alice, id)
+	if res.Code != http.StatusOK || res.Headers["Upload-Offset"] != "5" || res.Headers["Upload-Length"] != strconv.Itoa(len(content)) {
+		t.Errorf("offset: got status %d and headers %v, want %d and offset 5", res.Code, res.Headers, http.StatusOK)
+	}
+	if res = head(bob, id); res.Code != http.StatusNotFound {
+		t.Errorf("offset of another user's upload: got status %d, want %d", res.Code, http.StatusNotFound)
+	}
+	if res = patch(bob, id, 5, strings.NewReader(content[5:])); res.Code != http.StatusNotFound {
+		t.Errorf("part of another user's upload: got status %d, want %d", res.Code, http.StatusNotFound)
+	}
+
+	if res = patch(alice, id, 0, strings.NewReader(content)); res.Code != http.StatusConflict || res.Headers["Upload-Offset"] != "5" {
+		t.Errorf("part at the wrong offset: got status %d and Upload-Offset %q, want %d and 5", res.Code, res.Headers["Upload-Offset"], http.StatusConflict)
+	} else if matrixErr, ok := res.JSON.(*jsonerror.MatrixError); !ok || matrixErr.ErrCode != "M_INVALID_ARGUMENT_VALUE" {
+		t.Errorf("part at the wrong offset: got %+v, want M_INVALID_ARGUMENT_VALUE", res.JSON)
+	}
+	busy, resErr := uploads.startPart(id, "@alice:localhost", 5)
+	if resErr != nil {
+		t.Fatalf("startPart: got %+v", resErr)
+	}
+	res = patch(alice, id, 5, strings.NewReader(content[5:10]))
+	if matrixErr, ok := res.JSON.(*jsonerror.MatrixError); res.Code != http.StatusConflict || !ok || matrixErr.ErrCode != "M_UPLOAD_IN_PROGRESS" {
+		t.Errorf("part while another is being received: got status %d %+v, want %d M_UPLOAD_IN_PROGRESS", res.Code, res.JSON, http.StatusConflict)
+	}
+	uploads.finishPart(busy, 5, "")
+	req := httptest.NewRequest(http.MethodPatch, "/_matrix/media/unstable/resumable_upload/"+id, strings.NewReader(content[5:10]))
+	req.Header.Set("Tus-Resumable", tusVersion)
+	req.Header.Set("Content-Type", "text/plain")
+	req.Header.Set("Upload-Offset", "5")
+	res = AppendResumableUpload(req, cfg, alice, db, activeThumbnailGeneration, nil, nil, uploads, id)
+	if matrixErr, ok := res.JSON.(*jsonerror.MatrixError); res.Code != http.StatusUnsupportedMediaType || !ok || matrixErr.ErrCode != "M_UNSUPPORTED_MEDIA_TYPE" {
+		t.Errorf("part with the wrong Content-Type: got status %d %+v, want %d M_UNSUPPORTED_MEDIA_TYPE", res.Code, res.JSON, http.StatusUnsupportedMediaType)
+	}
+	if res = patch(alice, id, 5, strings.NewReader(content[5:]+" and more")); res.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("part past Upload-Length: got status %d, want %d", res.Code, http.StatusRequestEntityTooLarge)
+	}
+	res = patch(alice, id, 5, strings.NewReader(content[5:10]))
+	if res.Code != http.StatusNoContent || res.Headers["Upload-Offset"] != "10" {
+		t.Errorf("second part: got status %d and Upload-Offset %q, want %d and 10", res.Code, res.Headers["Upload-Offset"], http.StatusNoContent)
+	}
+
+	res = patch(alice, id, 10, strings.NewReader(content[10:]))
+	if res.Code != http.StatusOK {
+		t.Fatalf("last part: got status %d, want %d: %+v", res.Code, http.StatusOK, res.JSON)
+	}
+	contentURI := res.JSON.(uploadResponse).ContentURI
+	m, err := db.GetMediaMetadata(context.Background(), types.MediaID(strings.TrimPrefix(contentURI, "mxc://localhost/")), "localhost")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m == nil || m.UploadName != "parts.txt" || m.ContentType != "text/plain" || m.UserID != "@alice:localhost" || int(m.FileSizeBytes) != len(content) {
+		t.Fatalf("got stored media %+v", m)
+	}
+	if !fileExists(t, m.Base64Hash, basePath) {
+		t.Error("the upload wasn't stored")
+	}
+	if _, err = os.Stat(string(tmpDir)); !os.IsNotExist(err) {
+		t.Errorf("the parts of the upload were left behind: %v", err)
+	}
+	// A client which missed the response can send the last part again to get it.
+	if res = patch(alice, id, len(content), strings.NewReader("")); res.Code != http.StatusOK || res.JSON.(uploadResponse).ContentURI != contentURI {
+		t.Errorf("last part again: got status %d and %+v, want %d and %s", res.Code, res.JSON, http.StatusOK, contentURI)
+	}
+
+	// Unfinished uploads are removed once they expire, along with their parts.
+	if res = create(alice, "10", ""); res.Code != http.StatusCreated {
+		t.Fatalf("create: got status %d, want %d", res.Code, http.StatusCreated)
+	}
+	expiring := strings.TrimPrefix(res.Headers["Location"], "/_matrix/media/unstable/resumable_upload/")
+	expiringDir := uploads.get(expiring, "@alice:localhost").tmpDir
+	if res = create(alice, "10", ""); res.Code != http.StatusCreated {
+		t.Fatalf("create: got status %d, want %d", res.Code, http.StatusCreated)
+	}
+	if res = create(alice, "10", ""); res.Code != http.StatusForbidden {
+		t.Errorf("create over max_per_user: got status %d, want %d", res.Code, http.StatusForbidden)
+	}
+	logger := logrus.NewEntry(logrus.StandardLogger())
+	if removed := uploads.removeExpired(time.Now(), logger); removed != 0 {
+		t.Errorf("removed %d uploads before they expired", removed)
+	}
+	if removed := uploads.removeExpired(time.Now().Add(2*time.Hour), logger); removed != 3 {
+		t.Errorf("removed %d expired uploads, want 3", removed)
+	}
+	if _, err = os.Stat(string(expiringDir)); !os.IsNotExist(err) {
+		t.Errorf("the parts of the expired upload were left behind: %v", err)
+	}
+	if res = head(alice, expiring); res.Code != http.StatusNotFound {
+		t.Errorf("offset of expired upload: got status %d, want %d", res.Code, http.StatusNotFound)
+	}
+}
+
+func TestCreateResumableUploadErrors(t *testing.T) {
+	maxFileSizeBytes := config.FileSizeBytes(1024)
+	cfg := &config.MediaAPI{
+		Matrix:           &config.Global{ServerName: "localhost"},
+		MaxFileSizeBytes: &maxFileSizeBytes,
+		ResumableUploads: config.ResumableUploads{Enabled: true, Expiry: time.Hour},
+	}
+	uploads := newResumableUploads(&cfg.ResumableUploads)
+	for _, tt := range []struct {
+		version     string
+		length      string
+		metadata    string
+		wantCode    int
+		wantErrCode string
+	}{
+		{"", "10", "", http.StatusPreconditionFailed, "M_INVALID_ARGUMENT_VALUE"},
+		{"0.2.2", "10", "", http.StatusPreconditionFailed, "M_INVALID_ARGUMENT_VALUE"},
+		{tusVersion, "", "", http.StatusBadRequest, "M_INVALID_ARGUMENT_VALUE"},
+		{tusVersion, "0", "", http.StatusBadRequest, "M_INVALID_ARGUMENT_VALUE"},
+		{tusVersion, "ten", "", http.StatusBadRequest, "M_INVALID_ARGUMENT_VALUE"},
+		{tusVersion, "1025", "", http.StatusRequestEntityTooLarge, "M_TOO_LARGE"},
+		{tusVersion, "10", "filename not-base64!", http.StatusBadRequest, "M_INVALID_ARGUMENT_VALUE"},
+		{tusVersion, "10", "content_type " + base64.StdEncoding.EncodeToString([]byte("text/plain; charset=utf-7")), http.StatusBadRequest, "M_INVALID_ARGUMENT_VALUE"},
+	} {
+		req := httptest.NewRequest(http.MethodPost, "/_matrix/media/unstable/resumable_upload", nil)
+		req.Header.Set("Tus-Resumable", tt.version)
+		req.Header.Set("Upload-Length", tt.length)
+		req.Header.Set("Upload-Metadata", tt.metadata)
+		res := CreateResumableUpload(req, cfg, &userapi.Device{UserID: "@alice:localhost"}, uploads)
+		if res.Code != tt.wantCode {
+			t.Errorf("version %q, length %q, metadata %q: got status %d, want %d", tt.version, tt.length, tt.metadata, res.Code, tt.wantCode)
+		}
+		if matrixErr, ok := res.JSON.(*jsonerror.MatrixError); !ok || matrixErr.ErrCode != tt.wantErrCode {
+			t.Errorf("version %q, length %q, metadata %q: got %+v, want %s", tt.version, tt.length, tt.metadata, res.JSON, tt.wantErrCode)
+		}
+	}
+}
+
+func TestParseUploadMetadata(t *testing.T) {
+	for _, tt := range []struct {
+		header string
+		want   map[string]string
+	}{
+		{"", map[string]string{}},
+		{"filename Y2F0LnBuZw==", map[string]string{"filename": "cat.png"}},
+		{"filename Y2F0LnBuZw==, is_confidential", map[string]string{"filename": "cat.png", "is_confidential": ""}},
+		{"filename", map[string]string{"filename": ""}},
+		{"filename Y2F0LnBuZw== extra", nil},
+		{"filename ???", nil},
+		{",", nil},
+	} {
+		got, err := parseUploadMetadata(tt.header)
+		if tt.want == nil {
+			if err == nil {
+				t.Errorf("%q: expected an error, got %v", tt.header, got)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%q: got %v and error %v, want %v", tt.header, got, err, tt.want)
+		}
+	}
+}
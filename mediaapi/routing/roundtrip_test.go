@@ -0,0 +1,200 @@
+package routing
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"image"
+	"image/png"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/matrix-org/dendrite/internal/config"
+	"github.com/matrix-org/dendrite/internal/httputil"
+	"github.com/matrix-org/dendrite/mediaapi/storage"
+	"github.com/matrix-org/dendrite/mediaapi/types"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/util"
+)
+
+// roundTripServer serves uploads and downloads from a media store in a temporary
+// directory over HTTP, so that media can be uploaded and downloaded again as a
+// client would. Uploads need the access token "valid".
+type roundTripServer struct {
+	*httptest.Server
+	cfg     *config.MediaAPI
+	db      storage.Database
+	cleanup func()
+}
+
+// newRoundTripServer starts a roundTripServer. It can only be used once per test
+// binary, as the metrics for the handlers can only be registered once.
+func newRoundTripServer(t *testing.T) *roundTripServer {
+	t.Helper()
+	db, basePath, cleanup := newTestDatabase(t)
+	cfg := &config.MediaAPI{}
+	cfg.Defaults()
+	cfg.Matrix = &config.Global{ServerName: "localhost"}
+	cfg.AbsBasePath = basePath
+	maxFileSizeBytes := config.FileSizeBytes(1024)
+	cfg.MaxFileSizeBytes = &maxFileSizeBytes
+	activeThumbnailGeneration := &types.ActiveThumbnailGeneration{
+		PathToResult: map[string]*types.ThumbnailGenerationResult{},
+	}
+
+	router := mux.NewRouter().SkipClean(true).UseEncodedPath()
+	router.Handle("/_matrix/media/v3/upload", httputil.MakeAuthAPI(
+		"test_roundtrip_upload", &tokenUserAPI{},
+		func(req *http.Request, dev *userapi.Device) util.JSONResponse {
+			return Upload(req, cfg, dev, db, activeThumbnailGeneration, nil, nil)
+		},
+	))
+	handleMediaRoute(router, "/_matrix/media/v3/download/{serverName}/{mediaId}", makeDownloadAPI(
+		"test_roundtrip_download", cfg, db, nil, nil, nil,
+		&types.ActiveRemoteRequests{MXCToResult: map[string]*types.RemoteRequestResult{}},
+		activeThumbnailGeneration, nil, nil, newMediaAccessTracker(), NewUserTrafficTracker(), false,
+	), true, http.MethodGet, http.MethodHead)
+
+	return &roundTripServer{
+		Server:  httptest.NewServer(router),
+		cfg:     cfg,
+		db:      db,
+		cleanup: cleanup,
+	}
+}
+
+func (s *roundTripServer) Close() {
+	s.Server.Close()
+	s.cleanup()
+}
+
+// upload uploads the content, returning the response and the media ID from the
+// content URI if the upload succeeded.
+func (s *roundTripServer) upload(
+	t *testing.T, contentType, filename string, content []byte,
+) (*http.Response, types.MediaID) {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodPost, s.URL+"/_matrix/media/v3/upload?filename="+filename, bytes.NewReader(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer valid")
+	req.Header.Set("Content-Type", contentType)
+	res, err := s.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close() // nolint: errcheck
+	if res.StatusCode != http.StatusOK {
+		return res, ""
+	}
+	var body uploadResponse
+	if err = json.NewDecoder(res.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(body.ContentURI, "mxc://localhost/") {
+		t.Fatalf("got content URI %q, want one on localhost", body.ContentURI)
+	}
+	return res, types.MediaID(strings.TrimPrefix(body.ContentURI, "mxc://localhost/"))
+}
+
+// download downloads the media, returning the response and its body.
+func (s *roundTripServer) download(t *testing.T, mediaID types.MediaID) (*http.Response, []byte) {
+	t.Helper()
+	res, err := s.Client().Get(s.URL + "/_matrix/media/v3/download/localhost/" + string(mediaID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close() // nolint: errcheck
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res, body
+}
+
+func TestUploadDownloadRoundTrip(t *testing.T) {
+	s := newRoundTripServer(t)
+	defer s.Close()
+
+	var pngData bytes.Buffer
+	if err := png.Encode(&pngData, image.NewGray(image.Rect(0, 0, 4, 4))); err != nil {
+		t.Fatal(err)
+	}
+	binary := make([]byte, 1024)
+	if _, err := rand.Read(binary); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		name            string
+		contentType     string
+		filename        string
+		content         []byte
+		wantDisposition string
+	}{
+		{"text", "text/plain", "notes.txt", []byte("some notes\n"), `attachment; filename=notes.txt`},
+		{"image", "image/png", "cat.png", pngData.Bytes(), `inline; filename=cat.png`},
+		{"binary", "application/octet-stream", "data.bin", binary[:1000], `attachment; filename=data.bin`},
+		{"largest allowed", "application/octet-stream", "", binary, `attachment`},
+		{"unicode name", "text/plain", "caf%C3%A9.txt", []byte("café"), `attachment; filename=caf_.txt; filename*=utf-8''caf%C3%A9.txt`},
+	} {
+		res, mediaID := s.upload(t, tt.contentType, tt.filename, tt.content)
+		if res.StatusCode != http.StatusOK {
+			t.Errorf("%s: upload got status %d, want %d", tt.name, res.StatusCode, http.StatusOK)
+			continue
+		}
+		res, body := s.download(t, mediaID)
+		if res.StatusCode != http.StatusOK {
+			t.Errorf("%s: download got status %d, want %d", tt.name, res.StatusCode, http.StatusOK)
+			continue
+		}
+		if !bytes.Equal(body, tt.content) {
+			t.Errorf("%s: downloaded %d bytes which differ from the %d uploaded", tt.name, len(body), len(tt.content))
+		}
+		if got := res.Header.Get("Content-Type"); got != tt.contentType {
+			t.Errorf("%s: got Content-Type %q, want %q", tt.name, got, tt.contentType)
+		}
+		if got := res.Header.Get("Content-Length"); got != strconv.Itoa(len(tt.content)) {
+			t.Errorf("%s: got Content-Length %q, want %d", tt.name, got, len(tt.content))
+		}
+		if got := res.Header.Get("Content-Disposition"); got != tt.wantDisposition {
+			t.Errorf("%s: got Content-Disposition %q, want %q", tt.name, got, tt.wantDisposition)
+		}
+		if res.Header.Get("Content-Security-Policy") == "" {
+			t.Errorf("%s: got no Content-Security-Policy", tt.name)
+		}
+	}
+
+	// Rejected uploads leave nothing behind to download.
+	for _, tt := range []struct {
+		name        string
+		contentType string
+		content     []byte
+		wantCode    int
+	}{
+		{"too large", "application/octet-stream", make([]byte, 1025), http.StatusRequestEntityTooLarge},
+		{"blocked type", "text/html", []byte("<p>hi</p>"), http.StatusUnsupportedMediaType},
+		{"empty", "text/plain", []byte{}, http.StatusLengthRequired},
+	} {
+		res, _ := s.upload(t, tt.contentType, "", tt.content)
+		if res.StatusCode != tt.wantCode {
+			t.Errorf("%s: upload got status %d, want %d", tt.name, res.StatusCode, tt.wantCode)
+		}
+	}
+	media, err := s.db.GetMediaByUser(
+		context.Background(), "@alice:localhost", "localhost", "", 100,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(media) != 5 {
+		t.Errorf("got %d media stored, want only the 5 accepted", len(media))
+	}
+}
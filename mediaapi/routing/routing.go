@@ -15,14 +15,20 @@
 package routing
 
 import (
+	"encoding/json"
 	"net/http"
 	"strings"
+	"time"
 
 	userapi "github.com/matrix-org/dendrite/userapi/api"
 
 	"github.com/gorilla/mux"
+	"github.com/matrix-org/dendrite/clientapi/auth"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
 	"github.com/matrix-org/dendrite/internal/config"
 	"github.com/matrix-org/dendrite/internal/httputil"
+	"github.com/matrix-org/dendrite/mediaapi/fileutils"
+	"github.com/matrix-org/dendrite/mediaapi/scanner"
 	"github.com/matrix-org/dendrite/mediaapi/storage"
 	"github.com/matrix-org/dendrite/mediaapi/types"
 	"github.com/matrix-org/gomatrixserverlib"
@@ -30,6 +36,7 @@ import (
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	log "github.com/sirupsen/logrus"
 )
 
 // Setup registers the media API HTTP handlers
@@ -39,13 +46,45 @@ import (
 // nolint: gocyclo
 func Setup(
 	publicAPIMux *mux.Router,
+	clientMediaMux *mux.Router,
+	federationMediaMux *mux.Router,
 	cfg *config.MediaAPI,
 	db storage.Database,
 	userAPI userapi.UserInternalAPI,
 	client *gomatrixserverlib.Client,
+	keyRing gomatrixserverlib.JSONVerifier,
+	encryptionKey *fileutils.EncryptionKey,
+	uploadScanner scanner.Scanner,
+	activeUploads *ActiveUploads,
+	trafficTracker *UserTrafficTracker,
 ) {
+	// The media endpoints moved from /r0 to /v3 without changing, so both are served
+	// by the same handlers, as some clients still use /r0. Uploads and downloads are
+	// also served from /v1, where they started out.
+	//
+	// Of the media endpoints, /upload and /config need an access token. So do all of
+	// the authenticated media endpoints under /_matrix/client/v1/media, while the
+	// /download and /thumbnail endpoints here don't, and can be turned off with
+	// unauthenticated_downloads. The federation endpoints need a signed request.
 	r0mux := publicAPIMux.PathPrefix("/r0").Subrouter()
+	v3mux := publicAPIMux.PathPrefix("/v3").Subrouter()
 	v1mux := publicAPIMux.PathPrefix("/v1").Subrouter()
+	msc2246mux := publicAPIMux.PathPrefix("/unstable/fi.mau.msc2246").Subrouter()
+	adminMux := publicAPIMux.PathPrefix("/unstable/admin").Subrouter()
+
+	// Requests using the wrong method for a known route get a Matrix-style JSON
+	// error rather than the plain text response from the router.
+	publicAPIMux.MethodNotAllowedHandler = makeMethodNotAllowedHandler(publicAPIMux)
+	clientMediaMux.MethodNotAllowedHandler = makeMethodNotAllowedHandler(clientMediaMux)
+	federationMediaMux.MethodNotAllowedHandler = makeMethodNotAllowedHandler(federationMediaMux)
+
+	// Work out where each request really came from when behind reverse proxies.
+	// The networks have already been checked when the config was verified.
+	proxies, err := newTrustedProxies(cfg.TrustedProxies)
+	if err != nil {
+		log.WithError(err).Panic("Invalid media_api.trusted_proxies")
+	}
+	publicAPIMux.Use(proxies.withClientIP)
 
 	activeThumbnailGeneration := &types.ActiveThumbnailGeneration{
 		PathToResult: map[string]*types.ThumbnailGenerationResult{},
@@ -54,35 +93,329 @@ func Setup(
 	uploadHandler := httputil.MakeAuthAPI(
 		"upload", userAPI,
 		func(req *http.Request, dev *userapi.Device) util.JSONResponse {
-			return Upload(req, cfg, dev, db, activeThumbnailGeneration)
+			return trackUpload(activeUploads, func() util.JSONResponse {
+				return Upload(req, cfg, dev, db, activeThumbnailGeneration, encryptionKey, uploadScanner)
+			})
 		},
 	)
 
-	r0mux.Handle("/upload", uploadHandler).Methods(http.MethodPost, http.MethodOptions)
-	v1mux.Handle("/upload", uploadHandler).Methods(http.MethodPost, http.MethodOptions)
+	for _, router := range []*mux.Router{r0mux, v3mux, v1mux} {
+		handleMediaRoute(router, "/upload", uploadHandler, false, http.MethodPost, http.MethodOptions)
+	}
+
+	configHandler := httputil.MakeAuthAPI(
+		"media_config", userAPI,
+		func(req *http.Request, dev *userapi.Device) util.JSONResponse {
+			return GetMediaConfig(cfg)
+		},
+	)
+	for _, router := range []*mux.Router{r0mux, v3mux, clientMediaMux} {
+		handleMediaRoute(router, "/config", configHandler, false, http.MethodGet, http.MethodHead, http.MethodOptions)
+	}
+	handleMediaRoute(publicAPIMux, "/unstable/upload_check", httputil.MakeAuthAPI(
+		"upload_check", userAPI,
+		func(req *http.Request, dev *userapi.Device) util.JSONResponse {
+			return CheckUpload(req, cfg, dev, db)
+		},
+	), false, http.MethodGet, http.MethodOptions)
+
+	handleMediaRoute(msc2246mux, "/create", httputil.MakeAuthAPI(
+		"create", userAPI,
+		func(req *http.Request, dev *userapi.Device) util.JSONResponse {
+			return CreateMedia(req, cfg, dev, db)
+		},
+	), false, http.MethodPost, http.MethodOptions)
+	handleMediaRoute(msc2246mux, "/upload/{serverName}/{mediaId}", httputil.MakeAuthAPI(
+		"upload_reserved", userAPI,
+		func(req *http.Request, dev *userapi.Device) util.JSONResponse {
+			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			return trackUpload(activeUploads, func() util.JSONResponse {
+				return UploadReserved(
+					req, cfg, dev, db, activeThumbnailGeneration, encryptionKey, uploadScanner,
+					gomatrixserverlib.ServerName(vars["serverName"]), types.MediaID(vars["mediaId"]),
+				)
+			})
+		},
+	), false, http.MethodPut, http.MethodOptions)
+
+	if cfg.ResumableUploads.Enabled {
+		resumableUploads := newResumableUploads(&cfg.ResumableUploads)
+		go resumableUploads.run(resumableUploadCleanupInterval)
+		handleMediaRoute(publicAPIMux, "/unstable/resumable_upload", withTusHeaders(cfg, httputil.MakeAuthAPI(
+			"resumable_upload_create", userAPI,
+			func(req *http.Request, dev *userapi.Device) util.JSONResponse {
+				return CreateResumableUpload(req, cfg, dev, resumableUploads)
+			},
+		)), false, http.MethodPost, http.MethodOptions)
+		handleMediaRoute(publicAPIMux, "/unstable/resumable_upload/{uploadId}", withTusHeaders(cfg, httputil.MakeAuthAPI(
+			"resumable_upload_offset", userAPI,
+			func(req *http.Request, dev *userapi.Device) util.JSONResponse {
+				return GetResumableUpload(req, dev, resumableUploads, mux.Vars(req)["uploadId"])
+			},
+		)), false, http.MethodHead, http.MethodOptions)
+		handleMediaRoute(publicAPIMux, "/unstable/resumable_upload/{uploadId}", withTusHeaders(cfg, httputil.MakeAuthAPI(
+			"resumable_upload_append", userAPI,
+			func(req *http.Request, dev *userapi.Device) util.JSONResponse {
+				return trackUpload(activeUploads, func() util.JSONResponse {
+					return AppendResumableUpload(
+						req, cfg, dev, db, activeThumbnailGeneration, encryptionKey, uploadScanner,
+						resumableUploads, mux.Vars(req)["uploadId"],
+					)
+				})
+			},
+		)), false, http.MethodPatch)
+	}
 
 	activeRemoteRequests := &types.ActiveRemoteRequests{
 		MXCToResult: map[string]*types.RemoteRequestResult{},
 	}
 
-	downloadHandler := makeDownloadAPI("download", cfg, db, client, activeRemoteRequests, activeThumbnailGeneration)
-	r0mux.Handle("/download/{serverName}/{mediaId}", downloadHandler).Methods(http.MethodGet, http.MethodOptions)
-	r0mux.Handle("/download/{serverName}/{mediaId}/{downloadName}", downloadHandler).Methods(http.MethodGet, http.MethodOptions)
-	v1mux.Handle("/download/{serverName}/{mediaId}", downloadHandler).Methods(http.MethodGet, http.MethodOptions)                // TODO: remove when synapse is fixed
-	v1mux.Handle("/download/{serverName}/{mediaId}/{downloadName}", downloadHandler).Methods(http.MethodGet, http.MethodOptions) // TODO: remove when synapse is fixed
+	accessTracker := newMediaAccessTracker()
+	go accessTracker.run(db, mediaAccessFlushInterval)
+	go trafficTracker.run(db, userTrafficFlushInterval)
+	thumbnailPregenerator := newThumbnailPregenerator(&cfg.RemoteThumbnailPregeneration)
+
+	// The legacy endpoints don't require an access token, so can be turned off once
+	// clients have moved to the authenticated ones.
+	if cfg.UnauthenticatedDownloads {
+		downloadHandler := makeDownloadAPI("download", cfg, db, client, nil, nil, activeRemoteRequests, activeThumbnailGeneration, thumbnailPregenerator, encryptionKey, accessTracker, trafficTracker, false)
+		handleMediaRoute(r0mux, "/download/{serverName}/{mediaId}", downloadHandler, true, http.MethodGet, http.MethodHead, http.MethodOptions)
+		handleMediaRoute(v3mux, "/download/{serverName}/{mediaId}", downloadHandler, true, http.MethodGet, http.MethodHead, http.MethodOptions)
+		handleMediaRoute(v1mux, "/download/{serverName}/{mediaId}", downloadHandler, true, http.MethodGet, http.MethodHead, http.MethodOptions) // TODO: remove when synapse is fixed
+
+		thumbnailHandler := makeDownloadAPI("thumbnail", cfg, db, client, nil, nil, activeRemoteRequests, activeThumbnailGeneration, thumbnailPregenerator, encryptionKey, accessTracker, trafficTracker, true)
+		handleMediaRoute(r0mux, "/thumbnail/{serverName}/{mediaId}", thumbnailHandler, false, http.MethodGet, http.MethodHead, http.MethodOptions)
+		handleMediaRoute(v3mux, "/thumbnail/{serverName}/{mediaId}", thumbnailHandler, false, http.MethodGet, http.MethodHead, http.MethodOptions)
+	}
+
+	// Authenticated media, which is served under the client API instead.
+	// https://github.com/matrix-org/matrix-spec-proposals/pull/3916
+	clientMediaMux.Use(proxies.withClientIP)
+	authedDownloadHandler := makeDownloadAPI("download_authenticated", cfg, db, client, userAPI, nil, activeRemoteRequests, activeThumbnailGeneration, thumbnailPregenerator, encryptionKey, accessTracker, trafficTracker, false)
+	handleMediaRoute(clientMediaMux, "/download/{serverName}/{mediaId}", authedDownloadHandler, true, http.MethodGet, http.MethodHead, http.MethodOptions)
+	handleMediaRoute(clientMediaMux, "/thumbnail/{serverName}/{mediaId}",
+		makeDownloadAPI("thumbnail_authenticated", cfg, db, client, userAPI, nil, activeRemoteRequests, activeThumbnailGeneration, thumbnailPregenerator, encryptionKey, accessTracker, trafficTracker, true),
+		false, http.MethodGet, http.MethodHead, http.MethodOptions,
+	)
+
+	// Other homeservers fetching our own media from us, which must sign their requests.
+	federationMediaMux.Use(proxies.withClientIP)
+	handleMediaRoute(federationMediaMux, "/download/{mediaId}",
+		makeDownloadAPI("download_federation", cfg, db, client, nil, keyRing, activeRemoteRequests, activeThumbnailGeneration, thumbnailPregenerator, encryptionKey, accessTracker, trafficTracker, false),
+		false, http.MethodGet, http.MethodHead,
+	)
+	handleMediaRoute(federationMediaMux, "/thumbnail/{mediaId}",
+		makeDownloadAPI("thumbnail_federation", cfg, db, client, nil, keyRing, activeRemoteRequests, activeThumbnailGeneration, thumbnailPregenerator, encryptionKey, accessTracker, trafficTracker, true),
+		false, http.MethodGet, http.MethodHead,
+	)
+
+	handleMediaRoute(r0mux, "/identicon/{name}", http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		vars, _ := httputil.URLDecodeMapValues(mux.Vars(req))
+		Identicon(w, req, vars["name"])
+	}), false, http.MethodGet, http.MethodHead, http.MethodOptions)
 
-	r0mux.Handle("/thumbnail/{serverName}/{mediaId}",
-		makeDownloadAPI("thumbnail", cfg, db, client, activeRemoteRequests, activeThumbnailGeneration),
-	).Methods(http.MethodGet, http.MethodOptions)
+	handleMediaRoute(publicAPIMux, "/unstable/info/{serverName}/{mediaId}", httputil.MakeAuthAPI(
+		"media_info", userAPI,
+		func(req *http.Request, dev *userapi.Device) util.JSONResponse {
+			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			origin, mediaID := mediaFromPath(cfg, vars)
+			return GetMediaInfo(req, db, origin, mediaID)
+		},
+	), false, http.MethodGet, http.MethodHead, http.MethodOptions)
+
+	handleMediaRoute(publicAPIMux, "/unstable/clone/{serverName}/{mediaId}", httputil.MakeAuthAPI(
+		"media_clone", userAPI,
+		func(req *http.Request, dev *userapi.Device) util.JSONResponse {
+			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			origin, mediaID := mediaFromPath(cfg, vars)
+			return CloneMedia(req, cfg, dev, db, encryptionKey, origin, mediaID)
+		},
+	), false, http.MethodPost, http.MethodOptions)
+
+	// Reports are also taken under /_matrix/client/v1/media, alongside the other
+	// authenticated media endpoints.
+	reportHandler := httputil.MakeAuthAPI(
+		"media_report", userAPI,
+		func(req *http.Request, dev *userapi.Device) util.JSONResponse {
+			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			origin, mediaID := mediaFromPath(cfg, vars)
+			return ReportMedia(req, dev, db, origin, mediaID)
+		},
+	)
+	handleMediaRoute(publicAPIMux, "/unstable/report/{serverName}/{mediaId}", reportHandler, false, http.MethodPost, http.MethodOptions)
+	handleMediaRoute(clientMediaMux, "/report/{serverName}/{mediaId}", reportHandler, false, http.MethodPost, http.MethodOptions)
+
+	// Load balancers and monitoring poll this without an access token.
+	handleMediaRoute(publicAPIMux, "/unstable/health", httputil.MakeExternalAPI(
+		"media_health", func(req *http.Request) util.JSONResponse {
+			return CheckHealth(req, cfg, db, healthCheckTimeout)
+		},
+	), false, http.MethodGet, http.MethodHead, http.MethodOptions)
+
+	handleMediaRoute(publicAPIMux, "/unstable/user_media", httputil.MakeAuthAPI(
+		"user_media", userAPI,
+		func(req *http.Request, dev *userapi.Device) util.JSONResponse {
+			return GetUserMedia(req, cfg, dev, db, accessTracker)
+		},
+	), false, http.MethodGet, http.MethodHead, http.MethodOptions)
+
+	handleMediaRoute(adminMux, "/stats/{serverName}/{mediaId}", makeAdminAPI(
+		"admin_media_stats", cfg, userAPI,
+		func(req *http.Request, dev *userapi.Device) util.JSONResponse {
+			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			origin, mediaID := mediaFromPath(cfg, vars)
+			return GetMediaStats(req, db, accessTracker, origin, mediaID)
+		},
+	), false, http.MethodGet, http.MethodHead, http.MethodOptions)
+
+	handleMediaRoute(adminMux, "/traffic/{userId}", makeAdminAPI(
+		"admin_user_traffic", cfg, userAPI,
+		func(req *http.Request, dev *userapi.Device) util.JSONResponse {
+			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			return GetUserTraffic(req, cfg, db, trafficTracker, vars["userId"])
+		},
+	), false, http.MethodGet, http.MethodHead, http.MethodOptions)
+
+	handleMediaRoute(adminMux, "/reports", makeAdminAPI(
+		"admin_media_reports", cfg, userAPI,
+		func(req *http.Request, dev *userapi.Device) util.JSONResponse {
+			return GetMediaReports(req, db)
+		},
+	), false, http.MethodGet, http.MethodHead, http.MethodOptions)
+
+	handleMediaRoute(adminMux, "/purge_user/{userId}", makeAdminAPI(
+		"admin_purge_user_media", cfg, userAPI,
+		func(req *http.Request, dev *userapi.Device) util.JSONResponse {
+			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			return PurgeUserMedia(req, cfg, db, vars["userId"])
+		},
+	), false, http.MethodPost, http.MethodOptions)
+
+	handleMediaRoute(adminMux, "/delete/{serverName}/{mediaId}", makeAdminAPI(
+		"admin_delete_media", cfg, userAPI,
+		func(req *http.Request, dev *userapi.Device) util.JSONResponse {
+			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			origin, mediaID := mediaFromPath(cfg, vars)
+			return DeleteMedia(req, cfg, db, origin, mediaID)
+		},
+	), false, http.MethodPost, http.MethodOptions)
+
+	handleMediaRoute(adminMux, "/undelete/{serverName}/{mediaId}", makeAdminAPI(
+		"admin_undelete_media", cfg, userAPI,
+		func(req *http.Request, dev *userapi.Device) util.JSONResponse {
+			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			origin, mediaID := mediaFromPath(cfg, vars)
+			return UndeleteMedia(req, db, origin, mediaID)
+		},
+	), false, http.MethodPost, http.MethodOptions)
+
+	handleMediaRoute(adminMux, "/reconcile", makeAdminAPI(
+		"admin_reconcile_media", cfg, userAPI,
+		func(req *http.Request, dev *userapi.Device) util.JSONResponse {
+			return ReconcileMedia(req, cfg, db)
+		},
+	), false, http.MethodPost, http.MethodOptions)
+
+	handleMediaRoute(adminMux, "/recompute_storage", makeAdminAPI(
+		"admin_recompute_storage", cfg, userAPI,
+		func(req *http.Request, dev *userapi.Device) util.JSONResponse {
+			return RecomputeStorage(req, cfg, db)
+		},
+	), false, http.MethodPost, http.MethodOptions)
 }
 
+// mediaFromPath returns the origin and media ID from the serverName and mediaId in a
+// path, normalized in the same way as for downloads.
+func mediaFromPath(cfg *config.MediaAPI, vars map[string]string) (gomatrixserverlib.ServerName, types.MediaID) {
+	origin := normalizeOrigin(cfg, gomatrixserverlib.ServerName(vars["serverName"]))
+	return origin, normalizeMediaID(cfg, origin, types.MediaID(vars["mediaId"]))
+}
+
+// handleMediaRoute registers the handler for the path, accepting only the given
+// methods, and also for the path with a trailing slash, which some clients add.
+// If withFilename is set then the path may also be followed by a filename, as in
+// /download/{serverName}/{mediaId}/{downloadName}, which downloads are served as.
+func handleMediaRoute(router *mux.Router, path string, handler http.Handler, withFilename bool, methods ...string) {
+	router.Handle(path+"{trailingSlash:/?}", handler).Methods(methods...)
+	if withFilename {
+		router.Handle(path+"/{downloadName}{trailingSlash:/?}", handler).Methods(methods...)
+	}
+}
+
+// allowedMethods are the methods which are checked when building the Allow
+// header for a 405 Method Not Allowed response.
+var allowedMethods = []string{
+	http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut,
+	http.MethodPatch, http.MethodDelete, http.MethodOptions,
+}
+
+// makeMethodNotAllowedHandler returns a handler which responds with a 405 and
+// an Allow header listing the methods that router accepts for the request path.
+func makeMethodNotAllowedHandler(router *mux.Router) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var allow []string
+		for _, method := range allowedMethods {
+			candidate := req.Clone(req.Context())
+			candidate.Method = method
+			var match mux.RouteMatch
+			if router.Match(candidate, &match) && match.MatchErr == nil {
+				allow = append(allow, method)
+			}
+		}
+		util.SetCORSHeaders(w)
+		w.Header().Set("Allow", strings.Join(allow, ", "))
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		_ = json.NewEncoder(w).Encode(jsonerror.Unrecognized("Method not allowed"))
+	})
+}
+
+// makeDownloadAPI returns a handler for downloads, or thumbnails if isThumbnailRequest
+// is set. If userAPI is not nil then requests must have a valid access token. If keyRing
+// is not nil then requests must instead be signed by another homeserver. They are only
+// ever served our own media, so that we don't act as an open relay, and are answered
+// with a multipart/mixed response (see federationResponseWriter).
 func makeDownloadAPI(
 	name string,
 	cfg *config.MediaAPI,
 	db storage.Database,
 	client *gomatrixserverlib.Client,
+	userAPI userapi.UserInternalAPI,
+	keyRing gomatrixserverlib.JSONVerifier,
 	activeRemoteRequests *types.ActiveRemoteRequests,
 	activeThumbnailGeneration *types.ActiveThumbnailGeneration,
+	thumbnailPregenerator *thumbnailPregenerator,
+	encryptionKey *fileutils.EncryptionKey,
+	accessTracker *mediaAccessTracker,
+	trafficTracker *UserTrafficTracker,
+	isThumbnailRequest bool,
 ) http.HandlerFunc {
 	counterVec := promauto.NewCounterVec(
 		prometheus.CounterOpts{
@@ -92,26 +425,48 @@ func makeDownloadAPI(
 		[]string{"code"},
 	)
 	httpHandler := func(w http.ResponseWriter, req *http.Request) {
-		req = util.RequestWithLogging(req)
+		req = withRequestID(w, util.RequestWithLogging(req))
 
 		// Set internal headers returned regardless of the outcome of the request
 		util.SetCORSHeaders(w)
 		// Content-Type will be overridden in case of returning file data, else we respond with JSON-formatted errors
 		w.Header().Set("Content-Type", "application/json")
 
-		vars, _ := httputil.URLDecodeMapValues(mux.Vars(req))
-		serverName := gomatrixserverlib.ServerName(vars["serverName"])
+		// CORS preflight requests never include an access token.
+		if userAPI != nil && req.Method != http.MethodOptions {
+			dev, resErr := auth.VerifyUserFromRequest(req, userAPI)
+			if resErr != nil {
+				w.WriteHeader(resErr.Code)
+				_ = json.NewEncoder(w).Encode(resErr.JSON)
+				return
+			}
+			req = withDownloadUser(req, dev.UserID)
+		}
 
-		// For the purposes of loop avoidance, we will return a 404 if allow_remote is set to
-		// false in the query string and the target server name isn't our own.
-		// https://github.com/matrix-org/matrix-doc/pull/1265
-		if allowRemote := req.URL.Query().Get("allow_remote"); strings.ToLower(allowRemote) == "false" {
-			if serverName != cfg.Matrix.ServerName {
-				w.WriteHeader(http.StatusNotFound)
+		if keyRing != nil {
+			if fedReq, resErr := gomatrixserverlib.VerifyHTTPRequest(req, time.Now(), cfg.Matrix.ServerName, keyRing); fedReq == nil {
+				w.WriteHeader(resErr.Code)
+				_ = json.NewEncoder(w).Encode(resErr.JSON)
 				return
 			}
 		}
 
+		vars, _ := httputil.URLDecodeMapValues(mux.Vars(req))
+		serverName := gomatrixserverlib.ServerName(vars["serverName"])
+
+		if keyRing != nil {
+			serverName = cfg.Matrix.ServerName
+			// The media is sent as a part of the response, so it can't be gzipped on its own.
+			req.Header.Del("Accept-Encoding")
+			fedWriter := newFederationResponseWriter(w)
+			defer func() {
+				if err := fedWriter.finish(); err != nil {
+					util.GetLogger(req.Context()).WithError(err).Warn("Failed to finish federation media response")
+				}
+			}()
+			w = fedWriter
+		}
+
 		Download(
 			w,
 			req,
@@ -122,7 +477,11 @@ func makeDownloadAPI(
 			client,
 			activeRemoteRequests,
 			activeThumbnailGeneration,
-			name == "thumbnail",
+			thumbnailPregenerator,
+			encryptionKey,
+			accessTracker,
+			trafficTracker,
+			isThumbnailRequest,
 			vars["downloadName"],
 		)
 	}
@@ -0,0 +1,523 @@
+package routing
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/internal/config"
+	"github.com/matrix-org/dendrite/mediaapi/types"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// testKeyRing verifies signatures made by servers using the given key.
+type testKeyRing struct {
+	keyID     gomatrixserverlib.KeyID
+	publicKey ed25519.PublicKey
+}
+
+func (k *testKeyRing) VerifyJSONs(
+	ctx context.Context, requests []gomatrixserverlib.VerifyJSONRequest,
+) ([]gomatrixserverlib.VerifyJSONResult, error) {
+	results := make([]gomatrixserverlib.VerifyJSONResult, len(requests))
+	for i, req := range requests {
+		results[i].Error = gomatrixserverlib.VerifyJSON(string(req.ServerName), k.keyID, k.publicKey, req.Message)
+	}
+	return results, nil
+}
+
+// tokenUserAPI is a user API which only knows about a single access token.
+type tokenUserAPI struct {
+	userapi.UserInternalAPI
+}
+
+func (a *tokenUserAPI) QueryAccessToken(
+	ctx context.Context, req *userapi.QueryAccessTokenRequest, res *userapi.QueryAccessTokenResponse,
+) error {
+	switch {
+	case req.AccessToken != "valid":
+	case req.AppServiceUserID != "":
+		res.Err = &userapi.ErrorForbidden{Message: "application service has not registered this user"}
+	default:
+		res.Device = &userapi.Device{UserID: "@alice:localhost"}
+	}
+	return nil
+}
+
+var (
+	testRouter     *mux.Router
+	testRouterOnce sync.Once
+)
+
+// setupTestRouter returns a router with all of the media API routes but no database,
+// for requests which never get as far as using it. It is only set up once, as the
+// metrics for the routes can only be registered once.
+func setupTestRouter() *mux.Router {
+	testRouterOnce.Do(func() {
+		testRouter = mux.NewRouter().SkipClean(true).UseEncodedPath()
+		maxFileSizeBytes := config.FileSizeBytes(1024)
+		Setup(
+			testRouter.PathPrefix("/_matrix/media/").Subrouter(),
+			testRouter.PathPrefix("/_matrix/client/v1/media").Subrouter(),
+			testRouter.PathPrefix("/_matrix/federation/v1/media").Subrouter(),
+			&config.MediaAPI{
+				Matrix:                   &config.Global{ServerName: "localhost"},
+				MaxFileSizeBytes:         &maxFileSizeBytes,
+				UnauthenticatedDownloads: true,
+				ResumableUploads:         config.ResumableUploads{Enabled: true, Expiry: time.Hour},
+			},
+			nil, &tokenUserAPI{}, nil, &testKeyRing{}, nil, nil, &ActiveUploads{}, NewUserTrafficTracker(),
+		)
+	})
+	return testRouter
+}
+
+func TestMethodNotAllowed(t *testing.T) {
+	router := setupTestRouter()
+
+	tests := []struct {
+		method string
+		path   string
+		allow  string
+	}{
+		{http.MethodGet, "/_matrix/media/r0/upload", "POST, OPTIONS"},
+		{http.MethodPut, "/_matrix/media/v1/upload", "POST, OPTIONS"},
+		{http.MethodGet, "/_matrix/media/v3/upload", "POST, OPTIONS"},
+		{http.MethodPost, "/_matrix/media/r0/config", "GET, HEAD, OPTIONS"},
+		{http.MethodPost, "/_matrix/media/v3/config", "GET, HEAD, OPTIONS"},
+		{http.MethodPut, "/_matrix/client/v1/media/config", "GET, HEAD, OPTIONS"},
+		{http.MethodGet, "/_matrix/media/unstable/fi.mau.msc2246/create", "POST, OPTIONS"},
+		{http.MethodPost, "/_matrix/media/unstable/fi.mau.msc2246/upload/example.com/abc", "PUT, OPTIONS"},
+		{http.MethodPost, "/_matrix/media/r0/download/example.com/abc", "GET, HEAD, OPTIONS"},
+		{http.MethodDelete, "/_matrix/media/r0/download/example.com/abc/file.png", "GET, HEAD, OPTIONS"},
+		{http.MethodPost, "/_matrix/media/v1/download/example.com/abc", "GET, HEAD, OPTIONS"},
+		{http.MethodPut, "/_matrix/media/v1/download/example.com/abc/file.png", "GET, HEAD, OPTIONS"},
+		{http.MethodPost, "/_matrix/media/r0/thumbnail/example.com/abc", "GET, HEAD, OPTIONS"},
+		{http.MethodPost, "/_matrix/media/v3/download/example.com/abc", "GET, HEAD, OPTIONS"},
+		{http.MethodPut, "/_matrix/media/v3/download/example.com/abc/file.png", "GET, HEAD, OPTIONS"},
+		{http.MethodPost, "/_matrix/media/v3/thumbnail/example.com/abc", "GET, HEAD, OPTIONS"},
+		{http.MethodPost, "/_matrix/media/r0/identicon/@alice:example.com", "GET, HEAD, OPTIONS"},
+		{http.MethodPut, "/_matrix/media/unstable/info/example.com/abc", "GET, HEAD, OPTIONS"},
+		{http.MethodGet, "/_matrix/media/unstable/clone/example.com/abc", "POST, OPTIONS"},
+		{http.MethodGet, "/_matrix/media/unstable/report/example.com/abc", "POST, OPTIONS"},
+		{http.MethodPost, "/_matrix/media/unstable/admin/reports", "GET, HEAD, OPTIONS"},
+		{http.MethodPost, "/_matrix/media/unstable/health", "GET, HEAD, OPTIONS"},
+		{http.MethodGet, "/_matrix/client/v1/media/report/example.com/abc", "POST, OPTIONS"},
+		{http.MethodDelete, "/_matrix/media/unstable/admin/stats/example.com/abc", "GET, HEAD, OPTIONS"},
+		{http.MethodPost, "/_matrix/media/unstable/admin/traffic/@alice:example.com", "GET, HEAD, OPTIONS"},
+		{http.MethodGet, "/_matrix/media/unstable/admin/recompute_storage", "POST, OPTIONS"},
+		{http.MethodPost, "/_matrix/media/unstable/user_media", "GET, HEAD, OPTIONS"},
+		{http.MethodPost, "/_matrix/media/unstable/upload_check", "GET, OPTIONS"},
+		{http.MethodGet, "/_matrix/media/unstable/admin/purge_user/@alice:example.com", "POST, OPTIONS"},
+		{http.MethodGet, "/_matrix/media/unstable/admin/reconcile", "POST, OPTIONS"},
+		{http.MethodGet, "/_matrix/media/unstable/admin/delete/example.com/abc", "POST, OPTIONS"},
+		{http.MethodDelete, "/_matrix/media/unstable/admin/undelete/example.com/abc", "POST, OPTIONS"},
+		{http.MethodGet, "/_matrix/media/unstable/resumable_upload", "POST, OPTIONS"},
+		{http.MethodPost, "/_matrix/media/unstable/resumable_upload/abc", "HEAD, PATCH, OPTIONS"},
+		{http.MethodPost, "/_matrix/client/v1/media/download/example.com/abc", "GET, HEAD, OPTIONS"},
+		{http.MethodPut, "/_matrix/client/v1/media/download/example.com/abc/file.png", "GET, HEAD, OPTIONS"},
+		{http.MethodPost, "/_matrix/client/v1/media/thumbnail/example.com/abc", "GET, HEAD, OPTIONS"},
+		{http.MethodPost, "/_matrix/federation/v1/media/download/abc", "GET, HEAD"},
+		{http.MethodPut, "/_matrix/federation/v1/media/thumbnail/abc", "GET, HEAD"},
+		// A trailing slash makes no difference.
+		{http.MethodGet, "/_matrix/media/r0/upload/", "POST, OPTIONS"},
+		{http.MethodGet, "/_matrix/media/v3/upload/", "POST, OPTIONS"},
+		{http.MethodPost, "/_matrix/media/v3/config/", "GET, HEAD, OPTIONS"},
+		{http.MethodPost, "/_matrix/media/v3/thumbnail/example.com/abc/", "GET, HEAD, OPTIONS"},
+		{http.MethodPost, "/_matrix/media/r0/download/example.com/abc/", "GET, HEAD, OPTIONS"},
+		{http.MethodPost, "/_matrix/client/v1/media/download/example.com/abc/file.png/", "GET, HEAD, OPTIONS"},
+		{http.MethodDelete, "/_matrix/client/v1/media/thumbnail/example.com/abc/", "GET, HEAD, OPTIONS"},
+		{http.MethodPost, "/_matrix/federation/v1/media/download/abc/", "GET, HEAD"},
+		{http.MethodGet, "/_matrix/media/unstable/fi.mau.msc2246/create/", "POST, OPTIONS"},
+		{http.MethodPost, "/_matrix/media/unstable/fi.mau.msc2246/upload/example.com/abc/", "PUT, OPTIONS"},
+		{http.MethodPost, "/_matrix/media/unstable/upload_check/", "GET, OPTIONS"},
+		{http.MethodPost, "/_matrix/media/r0/identicon/@alice:example.com/", "GET, HEAD, OPTIONS"},
+		{http.MethodPost, "/_matrix/media/unstable/info/example.com/abc/", "GET, HEAD, OPTIONS"},
+		{http.MethodPost, "/_matrix/media/unstable/user_media/", "GET, HEAD, OPTIONS"},
+		{http.MethodPost, "/_matrix/media/unstable/admin/stats/example.com/abc/", "GET, HEAD, OPTIONS"},
+		{http.MethodGet, "/_matrix/media/unstable/admin/purge_user/@alice:example.com/", "POST, OPTIONS"},
+		{http.MethodGet, "/_matrix/media/unstable/admin/reconcile/", "POST, OPTIONS"},
+		{http.MethodGet, "/_matrix/media/unstable/clone/example.com/abc/", "POST, OPTIONS"},
+		{http.MethodGet, "/_matrix/media/unstable/resumable_upload/", "POST, OPTIONS"},
+		{http.MethodPost, "/_matrix/media/unstable/resumable_upload/abc/", "HEAD, PATCH, OPTIONS"},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(tt.method, tt.path, nil)
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+
+		if rec.Code != http.StatusMethodNotAllowed {
+			t.Errorf("%s %s: got status %d, want %d", tt.method, tt.path, rec.Code, http.StatusMethodNotAllowed)
+			continue
+		}
+		if allow := rec.Header().Get("Allow"); allow != tt.allow {
+			t.Errorf("%s %s: got Allow %q, want %q", tt.method, tt.path, allow, tt.allow)
+		}
+		var body jsonerror.MatrixError
+		if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+			t.Errorf("%s %s: response is not JSON: %s", tt.method, tt.path, err)
+			continue
+		}
+		if body.ErrCode != "M_UNRECOGNIZED" {
+			t.Errorf("%s %s: got errcode %q, want M_UNRECOGNIZED", tt.method, tt.path, body.ErrCode)
+		}
+	}
+
+	// The authenticated endpoints need an access token before anything is looked up,
+	// including the read-only ones which also accept HEAD.
+	for _, path := range []string{
+		"/_matrix/client/v1/media/download/example.com/abc",
+		"/_matrix/client/v1/media/download/example.com/abc/file.png",
+		"/_matrix/client/v1/media/download/example.com/abc/",
+		"/_matrix/client/v1/media/thumbnail/example.com/abc?width=32&height=32",
+		"/_matrix/client/v1/media/config",
+		"/_matrix/media/r0/config",
+		"/_matrix/media/v3/config/",
+		"/_matrix/media/unstable/info/example.com/abc",
+		"/_matrix/media/unstable/info/example.com/abc/",
+		"/_matrix/media/unstable/user_media",
+		"/_matrix/media/unstable/admin/stats/example.com/abc",
+		"/_matrix/media/unstable/admin/traffic/@alice:example.com/",
+	} {
+		for _, method := range []string{http.MethodGet, http.MethodHead} {
+			req := httptest.NewRequest(method, path, nil)
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, req)
+
+			if rec.Code != http.StatusUnauthorized {
+				t.Errorf("%s %s without an access token: got status %d, want %d", method, path, rec.Code, http.StatusUnauthorized)
+				continue
+			}
+			var body jsonerror.MatrixError
+			if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+				t.Errorf("%s %s: response is not JSON: %s", method, path, err)
+				continue
+			}
+			if body.ErrCode != "M_MISSING_TOKEN" {
+				t.Errorf("%s %s: got errcode %q, want M_MISSING_TOKEN", method, path, body.ErrCode)
+			}
+		}
+	}
+
+	// As do the federation endpoints with a signature.
+	for _, path := range []string{
+		"/_matrix/federation/v1/media/download/abc",
+		"/_matrix/federation/v1/media/thumbnail/abc?width=32&height=32",
+	} {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+
+		if rec.Code != http.StatusUnauthorized {
+			t.Errorf("GET %s without a signature: got status %d, want %d", path, rec.Code, http.StatusUnauthorized)
+		}
+	}
+
+	// Identicons need neither, and can be asked for with HEAD too.
+	for _, method := range []string{http.MethodGet, http.MethodHead} {
+		req := httptest.NewRequest(method, "/_matrix/media/r0/identicon/@alice:example.com/", nil)
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+
+		if rec.Code != http.StatusOK {
+			t.Errorf("%s identicon: got status %d, want %d", method, rec.Code, http.StatusOK)
+		}
+	}
+}
+
+func TestUploadAuthentication(t *testing.T) {
+	router := setupTestRouter()
+
+	tests := []struct {
+		name          string
+		query         string
+		authorization string
+		wantCode      int
+		wantErrCode   string
+	}{
+		{"no access token", "", "", http.StatusUnauthorized, "M_MISSING_TOKEN"},
+		{"not a bearer token", "", "Basic dXNlcjpwYXNz", http.StatusUnauthorized, "M_MISSING_TOKEN"},
+		{"token in both places", "?access_token=valid", "Bearer valid", http.StatusUnauthorized, "M_MISSING_TOKEN"},
+		{"unknown token in the header", "", "Bearer expired", http.StatusUnauthorized, "M_UNKNOWN_TOKEN"},
+		{"unknown token in the query", "?access_token=expired", "", http.StatusUnauthorized, "M_UNKNOWN_TOKEN"},
+		{"unregistered application service user", "?access_token=valid&user_id=@bridge:localhost", "", http.StatusForbidden, "M_FORBIDDEN"},
+		// The upload itself is empty, so it gets as far as being rejected for that.
+		{"valid token", "", "Bearer valid", http.StatusLengthRequired, "M_MISSING_ARGUMENT"},
+	}
+	for _, route := range []struct {
+		method string
+		path   string
+	}{
+		{http.MethodPost, "/_matrix/media/r0/upload"},
+		{http.MethodPost, "/_matrix/media/v1/upload"},
+		{http.MethodPost, "/_matrix/media/v3/upload"},
+		{http.MethodPost, "/_matrix/media/r0/upload/"},
+		{http.MethodPut, "/_matrix/media/unstable/fi.mau.msc2246/upload/localhost/abc"},
+	} {
+		for _, tt := range tests {
+			if route.method == http.MethodPut && tt.wantCode == http.StatusLengthRequired {
+				// Needs the reservation to be looked up in the database.
+				continue
+			}
+			req := httptest.NewRequest(route.method, route.path+tt.query, nil)
+			if tt.authorization != "" {
+				req.Header.Set("Authorization", tt.authorization)
+			}
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, req)
+
+			if rec.Code != tt.wantCode {
+				t.Errorf("%s %s, %s: got status %d, want %d", route.method, route.path, tt.name, rec.Code, tt.wantCode)
+				continue
+			}
+			var body jsonerror.MatrixError
+			if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+				t.Errorf("%s %s, %s: response is not JSON: %s", route.method, route.path, tt.name, err)
+				continue
+			}
+			if body.ErrCode != tt.wantErrCode {
+				t.Errorf("%s %s, %s: got errcode %q, want %s", route.method, route.path, tt.name, body.ErrCode, tt.wantErrCode)
+			}
+		}
+	}
+}
+
+func TestUnknownMediaPaths(t *testing.T) {
+	router := setupTestRouter()
+
+	for _, path := range []string{
+		"/_matrix/media/r0/download/example.com",
+		"/_matrix/media/r0/download/example.com/abc//",
+		"/_matrix/media/r0/download/example.com/abc/file.png/extra",
+		"/_matrix/media/r0/thumbnail/example.com/abc/file.png",
+		"/_matrix/media/v3/thumbnail/example.com/abc/file.png",
+		"/_matrix/media/v3/identicon/@alice:example.com",
+		"/_matrix/media/v3/config/extra",
+		"/_matrix/federation/v1/media/download/example.com/abc",
+		"/_matrix/media/r0/upload/file.png",
+		"/_matrix/media/unstable/info/example.com/abc//",
+		"/_matrix/media/unstable/info/example.com/abc/file.png",
+		"/_matrix/media/r0/identicon/@alice:example.com/extra",
+		"/_matrix/media/unstable/admin/reconcile/extra",
+		"/_matrix/media/unstable/fi.mau.msc2246/create/abc",
+	} {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+
+		if rec.Code != http.StatusNotFound {
+			t.Errorf("GET %s: got status %d, want %d", path, rec.Code, http.StatusNotFound)
+		}
+	}
+}
+
+func TestResumableUploadRoutes(t *testing.T) {
+	router := setupTestRouter()
+
+	req := httptest.NewRequest(http.MethodOptions, "/_matrix/media/unstable/resumable_upload", nil)
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	if rec.Code != http.StatusNoContent {
+		t.Errorf("OPTIONS: got status %d, want %d", rec.Code, http.StatusNoContent)
+	}
+	for header, want := range map[string]string{
+		"Tus-Resumable": tusVersion,
+		"Tus-Version":   tusVersion,
+		"Tus-Extension": "creation,expiration",
+		"Tus-Max-Size":  "1024",
+	} {
+		if got := rec.Header().Get(header); got != want {
+			t.Errorf("OPTIONS: got %s %q, want %q", header, got, want)
+		}
+	}
+	if got := rec.Header().Get("Access-Control-Allow-Headers"); !strings.Contains(got, "Upload-Offset") {
+		t.Errorf("OPTIONS: browsers aren't allowed to send Upload-Offset: %q", got)
+	}
+	if got := rec.Header().Get("Access-Control-Allow-Methods"); !strings.Contains(got, http.MethodPatch) {
+		t.Errorf("OPTIONS: browsers aren't allowed to send PATCH requests: %q", got)
+	}
+
+	for _, tt := range []struct {
+		method        string
+		path          string
+		authorization string
+		wantCode      int
+	}{
+		{http.MethodPost, "/_matrix/media/unstable/resumable_upload", "", http.StatusUnauthorized},
+		{http.MethodPost, "/_matrix/media/unstable/resumable_upload", "Bearer valid", http.StatusPreconditionFailed},
+		{http.MethodHead, "/_matrix/media/unstable/resumable_upload/abc", "", http.StatusUnauthorized},
+		{http.MethodHead, "/_matrix/media/unstable/resumable_upload/abc", "Bearer valid", http.StatusPreconditionFailed},
+		{http.MethodPatch, "/_matrix/media/unstable/resumable_upload/abc", "Bearer valid", http.StatusPreconditionFailed},
+	} {
+		req = httptest.NewRequest(tt.method, tt.path, nil)
+		if tt.authorization != "" {
+			req.Header.Set("Authorization", tt.authorization)
+		}
+		rec = httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		if rec.Code != tt.wantCode {
+			t.Errorf("%s %s: got status %d, want %d", tt.method, tt.path, rec.Code, tt.wantCode)
+		}
+		if got := rec.Header().Get("Tus-Resumable"); got != tusVersion {
+			t.Errorf("%s %s: got Tus-Resumable %q, want %q", tt.method, tt.path, got, tusVersion)
+		}
+	}
+}
+
+func TestFederationDownload(t *testing.T) {
+	db, basePath, cleanup := newTestDatabase(t)
+	defer cleanup()
+	cfg := &config.MediaAPI{
+		Matrix:      &config.Global{ServerName: "a.example"},
+		AbsBasePath: basePath,
+	}
+	// Media from other servers is never served over federation, even if cached.
+	storeTestContent(t, db, basePath, "a.example", "abc", "text/plain", "media from a.example")
+	storeTestContent(t, db, basePath, "b.example", "xyz", "text/plain", "media from b.example")
+
+	publicKey, privateKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyRing := &testKeyRing{keyID: "ed25519:test", publicKey: publicKey}
+	router := mux.NewRouter().SkipClean(true).UseEncodedPath()
+	router.Handle("/_matrix/federation/v1/media/download/{mediaId}", makeDownloadAPI(
+		"test_download_federation", cfg, db, nil, nil, keyRing,
+		&types.ActiveRemoteRequests{MXCToResult: map[string]*types.RemoteRequestResult{}},
+		&types.ActiveThumbnailGeneration{PathToResult: map[string]*types.ThumbnailGenerationResult{}},
+		nil, nil, newMediaAccessTracker(), NewUserTrafficTracker(), false,
+	))
+
+	download := func(path string, sign bool) *httptest.ResponseRecorder {
+		fedReq := gomatrixserverlib.NewFederationRequest(http.MethodGet, cfg.Matrix.ServerName, path)
+		if sign {
+			if signErr := fedReq.Sign("c.example", keyRing.keyID, privateKey); signErr != nil {
+				t.Fatal(signErr)
+			}
+		}
+		req, reqErr := fedReq.HTTPRequest()
+		if reqErr != nil {
+			t.Fatal(reqErr)
+		}
+		// Requests received by a server always have a body, even if it's empty.
+		req.Body = http.NoBody
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		return rec
+	}
+
+	if rec := download("/_matrix/federation/v1/media/download/abc", false); rec.Code != http.StatusUnauthorized {
+		t.Errorf("unsigned request: got status %d, want %d", rec.Code, http.StatusUnauthorized)
+	}
+
+	for _, path := range []string{
+		"/_matrix/federation/v1/media/download/xyz",
+		"/_matrix/federation/v1/media/download/missing",
+	} {
+		rec := download(path, true)
+		if rec.Code != http.StatusNotFound {
+			t.Errorf("%s: got status %d, want %d", path, rec.Code, http.StatusNotFound)
+		}
+		if got := rec.Header().Get("Content-Type"); got != "application/json" {
+			t.Errorf("%s: got Content-Type %q, want application/json", path, got)
+		}
+	}
+
+	// Our own media is sent as a JSON metadata part followed by the media itself.
+	rec := download("/_matrix/federation/v1/media/download/abc", true)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got status %d, want %d", rec.Code, http.StatusOK)
+	}
+	mediaType, params, err := mime.ParseMediaType(rec.Header().Get("Content-Type"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mediaType != "multipart/mixed" {
+		t.Fatalf("got Content-Type %q, want multipart/mixed", mediaType)
+	}
+	reader := multipart.NewReader(rec.Body, params["boundary"])
+	want := []struct {
+		contentType string
+		body        string
+	}{
+		{"application/json", "{}"},
+		{"text/plain", "media from a.example"},
+	}
+	for i, part := range want {
+		p, err := reader.NextPart()
+		if err != nil {
+			t.Fatalf("part %d: %s", i, err)
+		}
+		if got := p.Header.Get("Content-Type"); got != part.contentType {
+			t.Errorf("part %d: got Content-Type %q, want %q", i, got, part.contentType)
+		}
+		body, err := ioutil.ReadAll(p)
+		if err != nil {
+			t.Fatalf("part %d: %s", i, err)
+		}
+		if string(body) != part.body {
+			t.Errorf("part %d: got %q, want %q", i, body, part.body)
+		}
+	}
+	if _, err := reader.NextPart(); err != io.EOF {
+		t.Errorf("got %v after the media part, want the end of the body", err)
+	}
+}
+
+func TestAuthenticatedDownload(t *testing.T) {
+	db, basePath, cleanup := newTestDatabase(t)
+	defer cleanup()
+	cfg := &config.MediaAPI{
+		Matrix:      &config.Global{ServerName: "localhost"},
+		AbsBasePath: basePath,
+	}
+	storeTestContent(t, db, basePath, "localhost", "abc", "text/plain", "media from localhost")
+	router := mux.NewRouter().SkipClean(true).UseEncodedPath()
+	router.Handle("/_matrix/client/v1/media/download/{serverName}/{mediaId}", makeDownloadAPI(
+		"test_download_authenticated", cfg, db, nil, &tokenUserAPI{}, nil,
+		&types.ActiveRemoteRequests{MXCToResult: map[string]*types.RemoteRequestResult{}},
+		&types.ActiveThumbnailGeneration{PathToResult: map[string]*types.ThumbnailGenerationResult{}},
+		nil, nil, newMediaAccessTracker(), NewUserTrafficTracker(), false,
+	))
+
+	for _, tt := range []struct {
+		name          string
+		query         string
+		authorization string
+		wantCode      int
+		wantBody      string
+	}{
+		{"no access token", "", "", http.StatusUnauthorized, ""},
+		{"unknown token", "", "Bearer expired", http.StatusUnauthorized, ""},
+		{"valid token in the header", "", "Bearer valid", http.StatusOK, "media from localhost"},
+		{"valid token in the query", "?access_token=valid", "", http.StatusOK, "media from localhost"},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/_matrix/client/v1/media/download/localhost/abc"+tt.query, nil)
+		if tt.authorization != "" {
+			req.Header.Set("Authorization", tt.authorization)
+		}
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+
+		if rec.Code != tt.wantCode {
+			t.Errorf("%s: got status %d, want %d", tt.name, rec.Code, tt.wantCode)
+			continue
+		}
+		if tt.wantBody != "" && rec.Body.String() != tt.wantBody {
+			t.Errorf("%s: got body %q, want %q", tt.name, rec.Body.String(), tt.wantBody)
+		}
+	}
+}
@@ -0,0 +1,127 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/internal/config"
+	"github.com/matrix-org/dendrite/mediaapi/scanner"
+	"github.com/matrix-org/util"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+)
+
+// The verdicts which scans of uploads are counted by.
+const (
+	scanVerdictClean    = "clean"
+	scanVerdictInfected = "infected"
+	scanVerdictError    = "error"
+)
+
+var uploadScans = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "dendrite_mediaapi_upload_scans_total",
+		Help: "Total number of uploads scanned for viruses, by whether they were clean, infected or couldn't be scanned",
+	},
+	[]string{"verdict"},
+)
+
+func init() {
+	prometheus.MustRegister(uploadScans)
+}
+
+// uploadScan sends an upload to the scanner as it is written to the media store, so
+// that it is scanned without being read again. The upload is teed into the pipe.
+type uploadScan struct {
+	pipe    *io.PipeWriter
+	cancel  context.CancelFunc
+	done    chan struct{}
+	verdict scanner.Verdict
+	err     error
+}
+
+func startUploadScan(ctx context.Context, s scanner.Scanner) *uploadScan {
+	ctx, cancel := context.WithCancel(ctx)
+	pipeReader, pipeWriter := io.Pipe()
+	scan := &uploadScan{pipe: pipeWriter, cancel: cancel, done: make(chan struct{})}
+	go func() {
+		defer close(scan.done)
+		scan.verdict, scan.err = s.Scan(ctx, pipeReader)
+		// Anything which the scanner didn't read, e.g. because it found a virus early
+		// on, is thrown away so that it doesn't hold up the upload.
+		io.Copy(ioutil.Discard, pipeReader) // nolint: errcheck
+	}()
+	return scan
+}
+
+// finish waits for the verdict on the upload, which is only meaningful if the whole
+// upload was written. If it wasn't, uploadErr is passed on to the scanner so that it
+// gives up. The scan fails if there is no verdict within the timeout.
+func (s *uploadScan) finish(uploadErr error, timeout time.Duration) (scanner.Verdict, error) {
+	defer s.cancel()
+	if uploadErr != nil {
+		s.pipe.CloseWithError(uploadErr) // nolint: errcheck
+	} else {
+		s.pipe.Close() // nolint: errcheck
+	}
+	select {
+	case <-s.done:
+		return s.verdict, s.err
+	case <-time.After(timeout):
+		s.cancel()
+		<-s.done
+		return scanner.Verdict{}, fmt.Errorf("scan took longer than %s", timeout)
+	}
+}
+
+// scanVerdictResponse returns the response to give to an upload with the verdict, or
+// nil if it may be stored.
+func (r *uploadRequest) scanVerdictResponse(
+	cfg *config.UploadScanning, verdict scanner.Verdict, scanErr error,
+) *util.JSONResponse {
+	switch {
+	case scanErr != nil:
+		uploadScans.WithLabelValues(scanVerdictError).Inc()
+		if cfg.OnFailure == config.UploadScanFailureAllow {
+			r.Logger.WithError(scanErr).Warn("Failed to scan upload, storing it unscanned")
+			return nil
+		}
+		r.Logger.WithError(scanErr).Error("Failed to scan upload, rejecting it")
+		return &util.JSONResponse{
+			Code: http.StatusServiceUnavailable,
+			JSON: jsonerror.Unavailable("The file could not be scanned for viruses, try again later."),
+		}
+	case verdict.Infected:
+		uploadScans.WithLabelValues(scanVerdictInfected).Inc()
+		r.Logger.WithFields(log.Fields{
+			"Signature": verdict.Signature,
+			"UserID":    r.MediaMetadata.UserID,
+		}).Warn("Rejecting infected upload")
+		return &util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden("The file was rejected by the virus scanner."),
+		}
+	default:
+		uploadScans.WithLabelValues(scanVerdictClean).Inc()
+		return nil
+	}
+}
@@ -0,0 +1,117 @@
+package routing
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/internal/config"
+	"github.com/matrix-org/dendrite/mediaapi/scanner"
+	"github.com/matrix-org/dendrite/mediaapi/types"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+)
+
+// fakeScanner reads the whole file and gives the configured verdict or error.
+type fakeScanner struct {
+	verdict scanner.Verdict
+	err     error
+	scanned []byte
+}
+
+func (s *fakeScanner) Scan(ctx context.Context, src io.Reader) (scanner.Verdict, error) {
+	scanned, err := ioutil.ReadAll(src)
+	if err != nil {
+		return scanner.Verdict{}, err
+	}
+	s.scanned = scanned
+	return s.verdict, s.err
+}
+
+func TestUploadScanning(t *testing.T) {
+	db, basePath, cleanup := newTestDatabase(t)
+	defer cleanup()
+	maxFileSizeBytes := config.FileSizeBytes(1024 * 1024)
+	cfg := &config.MediaAPI{
+		Matrix:           &config.Global{ServerName: "localhost"},
+		AbsBasePath:      basePath,
+		MaxFileSizeBytes: &maxFileSizeBytes,
+		UploadScanning: config.UploadScanning{
+			Enabled:   true,
+			Timeout:   time.Second * 5,
+			OnFailure: config.UploadScanFailureReject,
+		},
+	}
+	activeThumbnailGeneration := &types.ActiveThumbnailGeneration{
+		PathToResult: map[string]*types.ThumbnailGenerationResult{},
+	}
+
+	// Uploads the content, returning the status and whether anything was stored.
+	upload := func(s scanner.Scanner, content string) (int, bool) {
+		req := httptest.NewRequest(http.MethodPost, "/upload", strings.NewReader(content))
+		req.Header.Set("Content-Type", "text/plain")
+		res := Upload(req, cfg, &userapi.Device{UserID: "@alice:localhost"}, db, activeThumbnailGeneration, nil, s)
+		if res.Code != http.StatusOK {
+			return res.Code, false
+		}
+		mediaID := strings.TrimPrefix(res.JSON.(uploadResponse).ContentURI, "mxc://localhost/")
+		m, err := db.GetMediaMetadata(context.Background(), types.MediaID(mediaID), "localhost")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res.Code, m != nil && fileExists(t, m.Base64Hash, basePath)
+	}
+	storedFiles := func() int {
+		count := 0
+		filepath.Walk(string(basePath), func(path string, info os.FileInfo, err error) error { // nolint: errcheck
+			if err == nil && info.Mode().IsRegular() {
+				count++
+			}
+			return nil
+		})
+		return count
+	}
+
+	// Larger than a single read, so that it reaches the scanner in several writes.
+	content := strings.Repeat("clean ", 32*1024)
+	clean := &fakeScanner{}
+	if code, stored := upload(clean, content); code != http.StatusOK || !stored {
+		t.Errorf("clean upload: got status %d, stored %t, want %d and stored", code, stored, http.StatusOK)
+	}
+	if string(clean.scanned) != content {
+		t.Errorf("the scanner was sent %d bytes, want the %d byte upload", len(clean.scanned), len(content))
+	}
+	before := storedFiles()
+
+	infected := &fakeScanner{verdict: scanner.Verdict{Infected: true, Signature: "Eicar-Signature"}}
+	if code, _ := upload(infected, "EICAR test file"); code != http.StatusForbidden {
+		t.Errorf("infected upload: got status %d, want %d", code, http.StatusForbidden)
+	}
+	if after := storedFiles(); after != before {
+		t.Errorf("infected upload: %d files were left in the media store", after-before)
+	}
+
+	failing := &fakeScanner{err: errors.New("clamd went away")}
+	req := httptest.NewRequest(http.MethodPost, "/upload", strings.NewReader("unscanned"))
+	req.Header.Set("Content-Type", "text/plain")
+	res := Upload(req, cfg, &userapi.Device{UserID: "@alice:localhost"}, db, activeThumbnailGeneration, nil, failing)
+	if matrixErr, ok := res.JSON.(*jsonerror.MatrixError); res.Code != http.StatusServiceUnavailable || !ok || matrixErr.ErrCode != "M_UNAVAILABLE" {
+		t.Errorf("upload which couldn't be scanned: got status %d %+v, want %d M_UNAVAILABLE", res.Code, res.JSON, http.StatusServiceUnavailable)
+	}
+	if after := storedFiles(); after != before {
+		t.Errorf("upload which couldn't be scanned: %d files were left in the media store", after-before)
+	}
+
+	cfg.UploadScanning.OnFailure = config.UploadScanFailureAllow
+	if code, stored := upload(failing, "unscanned"); code != http.StatusOK || !stored {
+		t.Errorf("upload which couldn't be scanned, with on_failure allow: got status %d, stored %t, want %d and stored", code, stored, http.StatusOK)
+	}
+}
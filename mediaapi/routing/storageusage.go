@@ -0,0 +1,209 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/internal/config"
+	"github.com/matrix-org/dendrite/mediaapi/storage"
+	"github.com/matrix-org/dendrite/mediaapi/types"
+	"github.com/matrix-org/util"
+	log "github.com/sirupsen/logrus"
+)
+
+// recomputeStorageResponse defines the format of the JSON response to POST /admin/recompute_storage
+type recomputeStorageResponse struct {
+	PreviousTotalBytes   int64 `json:"previous_total_bytes"`
+	TotalBytes           int64 `json:"total_bytes"`
+	MaxTotalStorageBytes int64 `json:"max_total_storage_bytes"`
+	CheckedFiles         bool  `json:"checked_files"`
+	// The files which media refers to but which aren't in the media store, and their
+	// size, which isn't counted. Only looked for if CheckedFiles is set.
+	MissingFilesCount int   `json:"missing_files_count"`
+	MissingBytes      int64 `json:"missing_bytes"`
+}
+
+// RecomputeStorage implements POST /admin/recompute_storage
+// This recomputes the total size of the stored files from the media metadata, which
+// fixes it if it has drifted, e.g. after a crash. If the check_files query parameter
+// is "true", the media store is checked for each file too, and files which are
+// missing, e.g. because they were removed by hand, aren't counted.
+func RecomputeStorage(req *http.Request, cfg *config.MediaAPI, db storage.Database) util.JSONResponse {
+	checkFiles := req.URL.Query().Get("check_files") == "true"
+
+	logger := util.GetLogger(req.Context()).WithField("CheckFiles", checkFiles)
+	res, err := recomputeStorage(req.Context(), cfg, db, checkFiles, reconcileBatchSize)
+	if err != nil {
+		logger.WithError(err).Error("Failed to recompute the total size of stored media")
+		return jsonerror.InternalServerError()
+	}
+	logger = logger.WithFields(log.Fields{
+		"PreviousTotalBytes": res.PreviousTotalBytes,
+		"TotalBytes":         res.TotalBytes,
+		"MissingFiles":       res.MissingFilesCount,
+	})
+	if res.TotalBytes != res.PreviousTotalBytes {
+		logger.Warn("Corrected the total size of stored media")
+	} else {
+		logger.Info("Recomputed the total size of stored media")
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: res,
+	}
+}
+
+// recomputeStorage recomputes the total size of the stored files, leaving out the
+// files which are missing if checkFiles is set. The media is checked in batches of
+// batchSize.
+func recomputeStorage(
+	ctx context.Context, cfg *config.MediaAPI, db storage.Database, checkFiles bool, batchSize int,
+) (*recomputeStorageResponse, error) {
+	res := &recomputeStorageResponse{
+		MaxTotalStorageBytes: int64(cfg.MaxTotalStorageBytes),
+		CheckedFiles:         checkFiles,
+	}
+	var err error
+	if res.PreviousTotalBytes, err = db.GetStoredBytes(ctx); err != nil {
+		return nil, err
+	}
+	// Media with the same hash share a file, which is only counted once.
+	missing := map[types.Base64Hash]types.FileSizeBytes{}
+	if checkFiles {
+		err = forEachMissingFile(ctx, cfg, db, batchSize, func(mediaMetadata *types.MediaMetadata) {
+			if mediaMetadata.FileSizeBytes > missing[mediaMetadata.Base64Hash] {
+				missing[mediaMetadata.Base64Hash] = mediaMetadata.FileSizeBytes
+			}
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, size := range missing {
+		res.MissingFilesCount++
+		res.MissingBytes += int64(size)
+	}
+
+	// The total is recomputed from the metadata in one go, so that uploads which are
+	// stored meanwhile are still counted, and the missing files are taken off after.
+	if res.TotalBytes, err = db.RecomputeStoredBytes(ctx); err != nil {
+		return nil, err
+	}
+	if res.MissingBytes > 0 {
+		if err = db.AddStoredBytes(ctx, -res.MissingBytes); err != nil {
+			return nil, err
+		}
+		if res.TotalBytes -= res.MissingBytes; res.TotalBytes < 0 {
+			res.TotalBytes = 0
+		}
+	}
+	return res, nil
+}
+
+// storageLimitResponse is the response to uploads which would take the stored media
+// over the maximum total size.
+func storageLimitResponse() *util.JSONResponse {
+	return &util.JSONResponse{
+		Code: http.StatusInsufficientStorage,
+		JSON: jsonerror.QuotaExceeded("The server has run out of space to store media."),
+	}
+}
+
+// storageFullResponse is the response to uploads which the disk has no room for.
+func storageFullResponse() *util.JSONResponse {
+	return &util.JSONResponse{
+		Code: http.StatusInsufficientStorage,
+		JSON: jsonerror.InsufficientStorage("The server has run out of space to store media."),
+	}
+}
+
+// checkStorageLimit refuses the upload if the size given for it, or an upload of any
+// size if none was given, would take the stored media over the limit. This lets uploads
+// be refused before they are read, but doesn't keep the space for them. As it isn't
+// known yet whether the file is already stored, uploads of content which is may be
+// refused too when the stored media is close to the limit.
+func (r *uploadRequest) checkStorageLimit(ctx context.Context, db storage.Database, limit config.FileSizeBytes) *util.JSONResponse {
+	if limit == 0 {
+		return nil
+	}
+	stored, err := db.GetStoredBytes(ctx)
+	if err != nil {
+		r.Logger.WithError(err).Error("Failed to get the total size of stored media")
+		resErr := jsonerror.InternalServerError()
+		return &resErr
+	}
+	size := int64(r.MediaMetadata.FileSizeBytes)
+	if size < 1 {
+		size = 1
+	}
+	if stored+size > int64(limit) {
+		r.Logger.WithFields(log.Fields{
+			"StoredBytes":          stored,
+			"MaxTotalStorageBytes": limit,
+		}).Warn("Rejecting upload which would go over the maximum total storage")
+		return storageLimitResponse()
+	}
+	return nil
+}
+
+// reserveStorage adds the size of the upload to the total size of the stored files,
+// refusing it if that would go over the limit. Once the upload is stored it stays
+// counted, otherwise it must be given back with releaseStorage.
+func (r *uploadRequest) reserveStorage(ctx context.Context, db storage.Database, limit config.FileSizeBytes) *util.JSONResponse {
+	size := int64(r.MediaMetadata.FileSizeBytes)
+	if limit == 0 {
+		// Nothing depends on the total being right, so the upload goes ahead even if
+		// it couldn't be added to.
+		if err := db.AddStoredBytes(ctx, size); err != nil {
+			r.Logger.WithError(err).Warn("Failed to add to the total size of stored media")
+			return nil
+		}
+		r.ReservedBytes = size
+		return nil
+	}
+	reserved, err := db.ReserveStoredBytes(ctx, size, int64(limit))
+	if err != nil {
+		r.Logger.WithError(err).Error("Failed to add to the total size of stored media")
+		resErr := jsonerror.InternalServerError()
+		return &resErr
+	}
+	if !reserved {
+		r.Logger.WithField("MaxTotalStorageBytes", limit).Warn("Rejecting upload which would go over the maximum total storage")
+		return storageLimitResponse()
+	}
+	r.ReservedBytes = size
+	return nil
+}
+
+// releaseStorage takes the size which was reserved for the upload back off the total
+// size of the stored files, as the upload didn't add a file after all.
+func (r *uploadRequest) releaseStorage(ctx context.Context, db storage.Database) {
+	if r.ReservedBytes == 0 {
+		return
+	}
+	addStoredBytes(ctx, db, r.Logger, -r.ReservedBytes)
+	r.ReservedBytes = 0
+}
+
+// addStoredBytes adds to the total size of the stored files, or takes away from it if
+// bytes is negative. Failures are only logged, as the total can be recomputed.
+func addStoredBytes(ctx context.Context, db storage.Database, logger *log.Entry, bytes int64) {
+	if err := db.AddStoredBytes(ctx, bytes); err != nil {
+		logger.WithError(err).WithField("Bytes", bytes).Warn("Failed to update the total size of stored media")
+	}
+}
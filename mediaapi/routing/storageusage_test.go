@@ -0,0 +1,231 @@
+package routing
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/internal/config"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/mediaapi/fileutils"
+	"github.com/matrix-org/dendrite/mediaapi/storage"
+	"github.com/matrix-org/dendrite/mediaapi/types"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+)
+
+func TestMaxTotalStorage(t *testing.T) {
+	db, basePath, cleanup := newTestDatabase(t)
+	defer cleanup()
+	maxFileSizeBytes := config.FileSizeBytes(1024)
+	cfg := &config.MediaAPI{
+		Matrix:               &config.Global{ServerName: "localhost"},
+		AbsBasePath:          basePath,
+		MaxFileSizeBytes:     &maxFileSizeBytes,
+		MaxTotalStorageBytes: 30,
+	}
+	activeThumbnailGeneration := &types.ActiveThumbnailGeneration{
+		PathToResult: map[string]*types.ThumbnailGenerationResult{},
+	}
+	ctx := context.Background()
+
+	// Uploads the content, without a Content-Length if chunked is set.
+	upload := func(content string, chunked bool) (int, types.MediaID) {
+		req := httptest.NewRequest(http.MethodPost, "/upload", strings.NewReader(content))
+		req.Header.Set("Content-Type", "text/plain")
+		if chunked {
+			req.ContentLength = -1
+		}
+		res := Upload(req, cfg, &userapi.Device{UserID: "@alice:localhost"}, db, activeThumbnailGeneration, nil, nil)
+		if res.Code != http.StatusOK {
+			return res.Code, ""
+		}
+		return res.Code, types.MediaID(strings.TrimPrefix(res.JSON.(uploadResponse).ContentURI, "mxc://localhost/"))
+	}
+	checkStored := func(name string, want int64) {
+		t.Helper()
+		stored, err := db.GetStoredBytes(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stored != want {
+			t.Errorf("%s: got %d bytes stored, want %d", name, stored, want)
+		}
+	}
+
+	code, mediaID := upload("twelve bytes", false)
+	if code != http.StatusOK {
+		t.Fatalf("upload: got status %d, want %d", code, http.StatusOK)
+	}
+	checkStored("upload", 12)
+	// The same content again is stored in the same file.
+	if code, _ = upload("twelve bytes", false); code != http.StatusOK {
+		t.Errorf("upload of the same content: got status %d, want %d", code, http.StatusOK)
+	}
+	checkStored("upload of the same content", 12)
+
+	if code, _ = upload("nineteen bytes long", false); code != http.StatusInsufficientStorage {
+		t.Errorf("upload over the limit: got status %d, want %d", code, http.StatusInsufficientStorage)
+	}
+	// Without a Content-Length, this is only noticed once it has been read.
+	if code, _ = upload("nineteen bytes long", true); code != http.StatusInsufficientStorage {
+		t.Errorf("chunked upload over the limit: got status %d, want %d", code, http.StatusInsufficientStorage)
+	}
+	checkStored("uploads over the limit", 12)
+	res := CheckUpload(httptest.NewRequest(http.MethodGet, "/upload_check?content_type=text/plain&size=19", nil), cfg, &userapi.Device{UserID: "@alice:localhost"}, db)
+	if res.Code != http.StatusInsufficientStorage {
+		t.Errorf("upload check over the limit: got status %d, want %d", res.Code, http.StatusInsufficientStorage)
+	}
+	if matrixErr, ok := res.JSON.(*jsonerror.MatrixError); !ok || matrixErr.ErrCode != "M_QUOTA_EXCEEDED" {
+		t.Errorf("upload check over the limit: got error %+v, want M_QUOTA_EXCEEDED", res.JSON)
+	}
+
+	// What is stored can still be downloaded.
+	w := httptest.NewRecorder()
+	Download(
+		w, httptest.NewRequest(http.MethodGet, "/download/localhost/"+string(mediaID), nil),
+		"localhost", mediaID, cfg, db, nil,
+		&types.ActiveRemoteRequests{MXCToResult: map[string]*types.RemoteRequestResult{}},
+		activeThumbnailGeneration, nil, nil, newMediaAccessTracker(), NewUserTrafficTracker(), false, "",
+	)
+	if w.Code != http.StatusOK {
+		t.Errorf("download: got status %d, want %d", w.Code, http.StatusOK)
+	}
+
+	if code, _ = upload("eighteen bytes!!!!", true); code != http.StatusOK {
+		t.Errorf("upload up to the limit: got status %d, want %d", code, http.StatusOK)
+	}
+	checkStored("upload up to the limit", 30)
+
+	// Media stored behind the server's back isn't counted until the total is recomputed.
+	storeTestContent(t, db, cfg.AbsBasePath, "remote.example", "abc", "text/plain", "remote media")
+	checkStored("media stored directly", 30)
+	res = RecomputeStorage(httptest.NewRequest(http.MethodPost, "/admin/recompute_storage", nil), cfg, db)
+	if res.Code != http.StatusOK {
+		t.Fatalf("recompute: got status %d, want %d", res.Code, http.StatusOK)
+	}
+	if got := res.JSON.(*recomputeStorageResponse); got.PreviousTotalBytes != 30 || got.TotalBytes != 42 {
+		t.Errorf("recompute: got %+v, want 30 bytes before and 42 after", got)
+	}
+	checkStored("recompute", 42)
+
+	if _, err := purgeUserMedia(ctx, cfg, db, "@alice:localhost", false); err != nil {
+		t.Fatal(err)
+	}
+	checkStored("purge", 12)
+}
+
+func TestRecomputeStorageCheckFiles(t *testing.T) {
+	db, basePath, cleanup := newTestDatabase(t)
+	defer cleanup()
+	cfg := &config.MediaAPI{
+		Matrix:      &config.Global{ServerName: "localhost"},
+		AbsBasePath: basePath,
+	}
+	storeTestContent(t, db, cfg.AbsBasePath, "remote.example", "abc", "text/plain", "remote media")
+	storeTestContent(t, db, cfg.AbsBasePath, "remote.example", "def", "text/plain", "other media")
+	// The second file is removed by hand, but its media is still there.
+	filePath, err := fileutils.GetPathFromBase64Hash("remote.exampledef", cfg.AbsBasePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.RemoveAll(filepath.Dir(filePath)); err != nil {
+		t.Fatal(err)
+	}
+
+	recompute := func(query string) *recomputeStorageResponse {
+		res := RecomputeStorage(httptest.NewRequest(http.MethodPost, "/admin/recompute_storage"+query, nil), cfg, db)
+		if res.Code != http.StatusOK {
+			t.Fatalf("%q: got status %d, want %d", query, res.Code, http.StatusOK)
+		}
+		return res.JSON.(*recomputeStorageResponse)
+	}
+	if got := recompute(""); got.PreviousTotalBytes != 0 || got.TotalBytes != 23 || got.MissingFilesCount != 0 {
+		t.Errorf("from the metadata: got %+v, want 0 bytes before and 23 after", *got)
+	}
+	got := recompute("?check_files=true")
+	if got.PreviousTotalBytes != 23 || got.TotalBytes != 12 || !got.CheckedFiles {
+		t.Errorf("checking files: got %+v, want 23 bytes before and 12 after", *got)
+	}
+	if got.MissingFilesCount != 1 || got.MissingBytes != 11 {
+		t.Errorf("checking files: got %d missing files and %d bytes, want 1 and 11", got.MissingFilesCount, got.MissingBytes)
+	}
+	if stored, _ := db.GetStoredBytes(context.Background()); stored != 12 {
+		t.Errorf("got %d bytes stored after checking files, want 12", stored)
+	}
+}
+
+func TestReserveStoredBytes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mediaapi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir) // nolint: errcheck
+	dbOptions := &config.DatabaseOptions{
+		ConnectionString: config.DataSource("file:" + filepath.Join(dir, "mediaapi.db")),
+	}
+	db, err := storage.Open(dbOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	// Only as many as fit within the limit are reserved, however many try at once.
+	results := make(chan bool)
+	for i := 0; i < 10; i++ {
+		go func() {
+			reserved, err := db.ReserveStoredBytes(ctx, 3, 20)
+			if err != nil {
+				t.Error(err)
+			}
+			results <- reserved
+		}()
+	}
+	reservations := 0
+	for i := 0; i < 10; i++ {
+		if <-results {
+			reservations++
+		}
+	}
+	if reservations != 6 {
+		t.Errorf("got %d reservations, want 6", reservations)
+	}
+	if err = db.AddStoredBytes(ctx, -100); err != nil {
+		t.Fatal(err)
+	}
+	if stored, _ := db.GetStoredBytes(ctx); stored != 0 {
+		t.Errorf("got %d bytes stored after taking away more than there was, want 0", stored)
+	}
+
+	// Media stored before the total was kept is counted once it is.
+	for i, hash := range []types.Base64Hash{"hash1", "hash1", "hash2"} {
+		if err = db.StoreMediaMetadata(ctx, &types.MediaMetadata{
+			MediaID:       types.MediaID("media" + string(rune('a'+i))),
+			Origin:        "localhost",
+			FileSizeBytes: 5,
+			Base64Hash:    hash,
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rawDB, err := sqlutil.Open(dbOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = rawDB.Exec("DROP TABLE mediaapi_storage_usage")
+	rawDB.Close() // nolint: errcheck
+	if err != nil {
+		t.Fatal(err)
+	}
+	if db, err = storage.Open(dbOptions); err != nil {
+		t.Fatal(err)
+	}
+	if stored, _ := db.GetStoredBytes(ctx); stored != 10 {
+		t.Errorf("got %d bytes stored when the total was first kept, want 10", stored)
+	}
+}
@@ -0,0 +1,327 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/matrix-org/dendrite/internal/config"
+	"github.com/matrix-org/dendrite/mediaapi/fileutils"
+	"github.com/matrix-org/dendrite/mediaapi/storage"
+	"github.com/matrix-org/dendrite/mediaapi/types"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+	log "github.com/sirupsen/logrus"
+)
+
+// synapseImportBatchSize is how many media are read from Synapse's database at a time.
+const synapseImportBatchSize = 100
+
+// The media uploaded to Synapse, in media ID order so that each batch can start after
+// the last media of the one before. Media with url_cache set was fetched for URL
+// previews, which aren't media anyone uploaded, and quarantined media isn't served by
+// Synapse either, so neither is imported.
+const selectSynapseLocalMediaSQL = `
+SELECT media_id, media_type, media_length, upload_name, user_id FROM local_media_repository
+    WHERE media_id > $1 AND url_cache IS NULL AND quarantined_by IS NULL
+    ORDER BY media_id LIMIT $2
+`
+
+// The media Synapse cached from other servers, in origin and then media ID order.
+const selectSynapseRemoteMediaSQL = `
+SELECT media_origin, media_id, media_type, media_length, upload_name, filesystem_id FROM remote_media_cache
+    WHERE (media_origin > $1 OR (media_origin = $1 AND media_id > $2)) AND quarantined_by IS NULL
+    ORDER BY media_origin, media_id LIMIT $3
+`
+
+// SynapseImportProgress counts the media which an import from Synapse has gone through.
+type SynapseImportProgress struct {
+	// Media which was imported, and the total of its sizes, which counts a file once
+	// for each media that has it.
+	Imported int
+	Bytes    int64
+	// Media which was imported already, e.g. by an import which was interrupted.
+	Skipped int
+	// Media whose file isn't in Synapse's media store, e.g. because it was only kept
+	// by a storage provider.
+	Missing int
+	// Media which couldn't be imported. Why is logged for each of them.
+	Failed int
+}
+
+// synapseMedia is media as Synapse's database describes it.
+type synapseMedia struct {
+	remote      bool
+	origin      string
+	mediaID     string
+	mediaType   sql.NullString
+	mediaLength sql.NullInt64
+	uploadName  sql.NullString
+	userID      sql.NullString
+	// The name of the media's file in the media store, which for local media is its
+	// media ID.
+	filesystemID string
+}
+
+// ImportSynapseMedia imports the media which a Synapse server stores, reading it from
+// Synapse's database and the media store at mediaStorePath, which may be SQLite or
+// PostgreSQL. The files are stored in the same way as uploads, and the media keeps its
+// media ID, content type and upload name. Local media is imported as this server's.
+//
+// Media which has been imported already is skipped, so an import which was stopped
+// can be run again to carry on where it left off. Each copied file has to be the
+// size that Synapse recorded for it, and the stored file is read back to check that
+// it has the hash it is stored under before the media refers to it. Media which
+// can't be imported is logged and counted, and the import goes on. onProgress, if
+// it isn't nil, is called with the progress so far after each batch of media.
+func ImportSynapseMedia(
+	ctx context.Context, cfg *config.MediaAPI, db storage.Database, encryptionKey *fileutils.EncryptionKey,
+	synapseDB *sql.DB, mediaStorePath string, onProgress func(*SynapseImportProgress),
+) (*SynapseImportProgress, error) {
+	res := &SynapseImportProgress{}
+	report := func() {
+		if onProgress != nil {
+			onProgress(res)
+		}
+	}
+
+	var afterMediaID string
+	for {
+		batch, err := selectSynapseMedia(ctx, synapseDB, false, afterMediaID, synapseImportBatchSize)
+		if err != nil {
+			return res, fmt.Errorf("failed to read Synapse's local media: %w", err)
+		}
+		for _, m := range batch {
+			afterMediaID = m.mediaID
+			if err = importSynapseMedia(ctx, cfg, db, encryptionKey, mediaStorePath, m, res); err != nil {
+				return res, err
+			}
+		}
+		report()
+		if len(batch) < synapseImportBatchSize {
+			break
+		}
+	}
+
+	var afterOrigin string
+	afterMediaID = ""
+	for {
+		batch, err := selectSynapseMedia(ctx, synapseDB, true, afterOrigin, afterMediaID, synapseImportBatchSize)
+		if err != nil {
+			return res, fmt.Errorf("failed to read Synapse's remote media: %w", err)
+		}
+		for _, m := range batch {
+			afterOrigin, afterMediaID = m.origin, m.mediaID
+			if err = importSynapseMedia(ctx, cfg, db, encryptionKey, mediaStorePath, m, res); err != nil {
+				return res, err
+			}
+		}
+		report()
+		if len(batch) < synapseImportBatchSize {
+			return res, nil
+		}
+	}
+}
+
+// selectSynapseMedia reads a batch of Synapse's remote media if remote is true, or of
+// its local media otherwise, with the args of the query for them.
+func selectSynapseMedia(ctx context.Context, synapseDB *sql.DB, remote bool, args ...interface{}) ([]*synapseMedia, error) {
+	query := selectSynapseLocalMediaSQL
+	if remote {
+		query = selectSynapseRemoteMediaSQL
+	}
+	rows, err := synapseDB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close() // nolint: errcheck
+	var batch []*synapseMedia
+	for rows.Next() {
+		m := &synapseMedia{remote: remote}
+		if remote {
+			err = rows.Scan(&m.origin, &m.mediaID, &m.mediaType, &m.mediaLength, &m.uploadName, &m.filesystemID)
+		} else {
+			err = rows.Scan(&m.mediaID, &m.mediaType, &m.mediaLength, &m.uploadName, &m.userID)
+			m.filesystemID = m.mediaID
+		}
+		if err != nil {
+			return nil, err
+		}
+		batch = append(batch, m)
+	}
+	return batch, rows.Err()
+}
+
+// importSynapseMedia imports one media from Synapse, adding how it went to res. Only
+// errors which would stop any other media being imported either are returned.
+func importSynapseMedia(
+	ctx context.Context, cfg *config.MediaAPI, db storage.Database, encryptionKey *fileutils.EncryptionKey,
+	mediaStorePath string, m *synapseMedia, res *SynapseImportProgress,
+) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	origin := cfg.Matrix.ServerName
+	if m.remote {
+		origin = normalizeOrigin(cfg, gomatrixserverlib.ServerName(m.origin))
+	}
+	mediaID := normalizeMediaID(cfg, origin, types.MediaID(m.mediaID))
+	logger := util.GetLogger(ctx).WithFields(log.Fields{
+		"MediaID": mediaID,
+		"Origin":  origin,
+	})
+
+	if !mediaIDRegex.MatchString(string(mediaID)) {
+		logger.Error("Failed to import media, as its media ID can't be downloaded")
+		res.Failed++
+		return nil
+	}
+	existing, err := db.GetMediaMetadata(ctx, mediaID, origin)
+	if err != nil {
+		return fmt.Errorf("failed to look up media %s/%s: %w", origin, mediaID, err)
+	}
+	if existing != nil {
+		res.Skipped++
+		return nil
+	}
+
+	srcPath, err := synapseMediaPath(mediaStorePath, m)
+	if err != nil {
+		logger.WithError(err).Error("Failed to import media")
+		res.Failed++
+		return nil
+	}
+	src, err := os.Open(srcPath)
+	if os.IsNotExist(err) {
+		logger.WithField("Path", srcPath).Warn("Media file is missing from Synapse's media store")
+		res.Missing++
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to open media file: %w", err)
+	}
+	defer src.Close() // nolint: errcheck
+
+	mediaMetadata := &types.MediaMetadata{
+		MediaID:     mediaID,
+		Origin:      origin,
+		ContentType: types.ContentType(m.mediaType.String),
+		UploadName:  sanitizeUploadName(m.uploadName.String),
+		UserID:      types.MatrixUserID(m.userID.String),
+	}
+	if mediaMetadata.ContentType == "" {
+		mediaMetadata.ContentType = "application/octet-stream"
+	}
+	if err = importSynapseFile(ctx, cfg, db, encryptionKey, src, m.mediaLength, mediaMetadata, logger); err != nil {
+		logger.WithError(err).WithField("Path", srcPath).Error("Failed to import media")
+		res.Failed++
+		return nil
+	}
+	logger.WithFields(log.Fields{
+		"Base64Hash":    mediaMetadata.Base64Hash,
+		"FileSizeBytes": mediaMetadata.FileSizeBytes,
+	}).Debug("Imported media")
+	res.Imported++
+	res.Bytes += int64(mediaMetadata.FileSizeBytes)
+	return nil
+}
+
+// synapseMediaPath returns where Synapse keeps the file of the media. Files are split
+// into directories by the first two pairs of characters of their name, and remote
+// media is kept separately for each origin.
+func synapseMediaPath(mediaStorePath string, m *synapseMedia) (string, error) {
+	name := m.filesystemID
+	if len(name) < 5 || !mediaIDRegex.MatchString(name) {
+		return "", fmt.Errorf("invalid media file name %q", name)
+	}
+	dir := filepath.Join(mediaStorePath, "local_content")
+	if m.remote {
+		if m.origin == "" || m.origin == "." || m.origin == ".." || strings.ContainsAny(m.origin, `/\`) {
+			return "", fmt.Errorf("invalid media origin %q", m.origin)
+		}
+		dir = filepath.Join(mediaStorePath, "remote_content", m.origin)
+	}
+	return filepath.Join(dir, name[0:2], name[2:4], name[4:]), nil
+}
+
+// importSynapseFile copies the file of the media into the media store and stores the
+// metadata while holding the lock for the file's hash (see fileLocks), in the same way
+// as uploads are stored. The copy must be wantSize bytes, if Synapse recorded a size,
+// and the stored file must have the hash it is stored under, which also checks a file
+// that was already stored for other media.
+func importSynapseFile(
+	ctx context.Context, cfg *config.MediaAPI, db storage.Database, encryptionKey *fileutils.EncryptionKey,
+	src io.Reader, wantSize sql.NullInt64, mediaMetadata *types.MediaMetadata, logger *log.Entry,
+) error {
+	hash, size, tmpDir, err := fileutils.WriteTempFile(ctx, src, 0, cfg.AbsBasePath, cfg.FileWrites)
+	if err != nil {
+		return fmt.Errorf("failed to copy file: %w", err)
+	}
+	if wantSize.Valid && int64(size) != wantSize.Int64 {
+		fileutils.RemoveDir(tmpDir, logger)
+		return fmt.Errorf("file is %d bytes but Synapse recorded it as %d", size, wantSize.Int64)
+	}
+	mediaMetadata.Base64Hash, mediaMetadata.FileSizeBytes = hash, size
+
+	defer fileLocks.lock(hash)()
+	if mediaMetadata.Encryption, err = db.GetFileEncryption(ctx, hash); err != nil {
+		fileutils.RemoveDir(tmpDir, logger)
+		return fmt.Errorf("failed to look up stored file: %w", err)
+	}
+	finalPath, duplicate, err := fileutils.MoveFileWithHashCheck(tmpDir, mediaMetadata, cfg.AbsBasePath, encryptionKey, logger)
+	if err != nil {
+		return fmt.Errorf("failed to move file: %w", err)
+	}
+	if err = checkStoredFileHash(finalPath, mediaMetadata, encryptionKey); err == nil {
+		err = db.StoreMediaMetadata(ctx, mediaMetadata)
+	}
+	if err != nil {
+		// A duplicate is the file of other media, so is left for them.
+		if !duplicate {
+			fileutils.RemoveDir(types.Path(filepath.Dir(string(finalPath))), logger)
+		}
+		return err
+	}
+	if !duplicate {
+		addStoredBytes(ctx, db, logger, int64(size))
+	}
+	return nil
+}
+
+// checkStoredFileHash reads the stored file of the media back and checks that its
+// content has the media's hash.
+func checkStoredFileHash(path types.Path, mediaMetadata *types.MediaMetadata, encryptionKey *fileutils.EncryptionKey) error {
+	file, _, err := fileutils.OpenFile(path, mediaMetadata.Encryption, encryptionKey)
+	if err != nil {
+		return fmt.Errorf("failed to open stored file: %w", err)
+	}
+	defer file.Close() // nolint: errcheck
+	hasher := sha256.New()
+	if _, err = io.Copy(hasher, file); err != nil {
+		return fmt.Errorf("failed to read stored file: %w", err)
+	}
+	if hash := types.Base64Hash(base64.RawURLEncoding.EncodeToString(hasher.Sum(nil))); hash != mediaMetadata.Base64Hash {
+		return fmt.Errorf("stored file has hash %s, not %s", hash, mediaMetadata.Base64Hash)
+	}
+	return nil
+}
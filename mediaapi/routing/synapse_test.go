@@ -0,0 +1,219 @@
+package routing
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/matrix-org/dendrite/internal/config"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/mediaapi/fileutils"
+	"github.com/matrix-org/dendrite/mediaapi/types"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+const synapseTestSchema = `
+CREATE TABLE local_media_repository (
+    media_id TEXT, media_type TEXT, media_length INTEGER, created_ts BIGINT, upload_name TEXT,
+    user_id TEXT, quarantined_by TEXT, url_cache TEXT, last_access_ts BIGINT
+);
+CREATE TABLE remote_media_cache (
+    media_origin TEXT, media_id TEXT, media_type TEXT, created_ts BIGINT, upload_name TEXT,
+    media_length INTEGER, filesystem_id TEXT, last_access_ts BIGINT, quarantined_by TEXT
+);
+`
+
+type synapseTestStore struct {
+	db   *sql.DB
+	path string
+}
+
+// newSynapseTestStore makes a Synapse database and media store in dir.
+func newSynapseTestStore(t *testing.T, dir string) *synapseTestStore {
+	t.Helper()
+	db, err := sqlutil.Open(&config.DatabaseOptions{
+		ConnectionString: config.DataSource("file:" + filepath.Join(dir, "homeserver.db")),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = db.Exec(synapseTestSchema); err != nil {
+		t.Fatal(err)
+	}
+	return &synapseTestStore{db: db, path: filepath.Join(dir, "media_store")}
+}
+
+func (s *synapseTestStore) writeFile(t *testing.T, dir, name, content string) {
+	t.Helper()
+	path := filepath.Join(s.path, dir, name[0:2], name[2:4], name[4:])
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// addLocal adds local media, with a file unless content is nil.
+func (s *synapseTestStore) addLocal(t *testing.T, mediaID, mediaType, uploadName, userID string, length int, content *string, urlCache, quarantinedBy interface{}) {
+	t.Helper()
+	if _, err := s.db.Exec(
+		"INSERT INTO local_media_repository VALUES ($1, $2, $3, 1600000000000, $4, $5, $6, $7, NULL)",
+		mediaID, mediaType, length, uploadName, userID, quarantinedBy, urlCache,
+	); err != nil {
+		t.Fatal(err)
+	}
+	if content != nil {
+		s.writeFile(t, "local_content", mediaID, *content)
+	}
+}
+
+func (s *synapseTestStore) addRemote(t *testing.T, origin, mediaID, mediaType, filesystemID, content string) {
+	t.Helper()
+	if _, err := s.db.Exec(
+		"INSERT INTO remote_media_cache VALUES ($1, $2, $3, 1600000000000, NULL, $4, $5, NULL, NULL)",
+		origin, mediaID, mediaType, len(content), filesystemID,
+	); err != nil {
+		t.Fatal(err)
+	}
+	s.writeFile(t, filepath.Join("remote_content", origin), filesystemID, content)
+}
+
+func testContentHash(content string) types.Base64Hash {
+	hash := sha256.Sum256([]byte(content))
+	return types.Base64Hash(base64.RawURLEncoding.EncodeToString(hash[:]))
+}
+
+func TestImportSynapseMedia(t *testing.T) {
+	db, basePath, cleanup := newTestDatabase(t)
+	defer cleanup()
+	cfg := &config.MediaAPI{
+		Matrix:      &config.Global{ServerName: "localhost"},
+		AbsBasePath: basePath,
+	}
+	synapse := newSynapseTestStore(t, filepath.Dir(string(basePath)))
+	defer synapse.db.Close() // nolint: errcheck
+
+	hello, cached, short := "hello", "cached", "abc"
+	synapse.addLocal(t, "GerZNDnDZVjsOtar", "text/plain", "héllo.txt", "@alice:localhost", 5, &hello, nil, nil)
+	synapse.addLocal(t, "samecontenttoo", "", "", "@bob:localhost", 5, &hello, nil, nil)
+	synapse.addLocal(t, "notinthestore", "image/png", "", "@alice:localhost", 10, nil, nil, nil)
+	synapse.addLocal(t, "truncatedfile", "image/png", "", "@alice:localhost", 10, &short, nil, nil)
+	synapse.addLocal(t, "urlpreview", "text/html", "", "", 5, &hello, "https://example.com", nil)
+	synapse.addLocal(t, "quarantined", "image/png", "", "@alice:localhost", 5, &hello, nil, "@admin:localhost")
+	synapse.addRemote(t, "remote.example.com", "remote1", "image/gif", "dHcXPeZoZpZUYfHgQkDqFuRi", cached)
+
+	ctx := context.Background()
+	var progressReports int
+	res, err := ImportSynapseMedia(ctx, cfg, db, nil, synapse.db, synapse.path, func(*SynapseImportProgress) {
+		progressReports++
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := SynapseImportProgress{Imported: 3, Bytes: 16, Missing: 1, Failed: 1}
+	if *res != want {
+		t.Errorf("got %+v, want %+v", *res, want)
+	}
+	if progressReports == 0 {
+		t.Error("progress was never reported")
+	}
+
+	for _, tt := range []struct {
+		origin     gomatrixserverlib.ServerName
+		mediaID    types.MediaID
+		want       types.MediaMetadata
+		wantStored bool
+	}{
+		{"localhost", "GerZNDnDZVjsOtar", types.MediaMetadata{
+			ContentType: "text/plain", FileSizeBytes: 5, UploadName: escapeUploadName("héllo.txt"),
+			Base64Hash: testContentHash(hello), UserID: "@alice:localhost",
+		}, true},
+		{"localhost", "samecontenttoo", types.MediaMetadata{
+			ContentType: "application/octet-stream", FileSizeBytes: 5,
+			Base64Hash: testContentHash(hello), UserID: "@bob:localhost",
+		}, true},
+		{"remote.example.com", "remote1", types.MediaMetadata{
+			ContentType: "image/gif", FileSizeBytes: 6, Base64Hash: testContentHash(cached),
+		}, true},
+		{"localhost", "notinthestore", types.MediaMetadata{}, false},
+		{"localhost", "truncatedfile", types.MediaMetadata{}, false},
+		{"localhost", "urlpreview", types.MediaMetadata{}, false},
+		{"localhost", "quarantined", types.MediaMetadata{}, false},
+	} {
+		m, err := db.GetMediaMetadata(ctx, tt.mediaID, tt.origin)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if (m != nil) != tt.wantStored {
+			t.Errorf("%s/%s: got imported %v, want %v", tt.origin, tt.mediaID, m != nil, tt.wantStored)
+			continue
+		}
+		if m == nil {
+			continue
+		}
+		if m.ContentType != tt.want.ContentType || m.FileSizeBytes != tt.want.FileSizeBytes || m.UploadName != tt.want.UploadName ||
+			m.Base64Hash != tt.want.Base64Hash || m.UserID != tt.want.UserID {
+			t.Errorf("%s/%s: got %+v, want %+v", tt.origin, tt.mediaID, *m, tt.want)
+		}
+		if !fileExists(t, m.Base64Hash, basePath) {
+			t.Errorf("%s/%s: the file was not stored", tt.origin, tt.mediaID)
+		}
+	}
+	if stored, _ := db.GetStoredBytes(ctx); stored != 11 {
+		t.Errorf("got %d stored bytes, want 11 as one file is shared", stored)
+	}
+
+	// Importing again only imports what it couldn't before.
+	synapse.writeFile(t, "local_content", "notinthestore", "0123456789")
+	res, err = ImportSynapseMedia(ctx, cfg, db, nil, synapse.db, synapse.path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = SynapseImportProgress{Imported: 1, Bytes: 10, Skipped: 3, Failed: 1}
+	if *res != want {
+		t.Errorf("importing again: got %+v, want %+v", *res, want)
+	}
+}
+
+func TestImportSynapseMediaChecksStoredHash(t *testing.T) {
+	db, basePath, cleanup := newTestDatabase(t)
+	defer cleanup()
+	cfg := &config.MediaAPI{
+		Matrix:      &config.Global{ServerName: "localhost"},
+		AbsBasePath: basePath,
+	}
+	synapse := newSynapseTestStore(t, filepath.Dir(string(basePath)))
+	defer synapse.db.Close() // nolint: errcheck
+	hello := "hello"
+	synapse.addLocal(t, "GerZNDnDZVjsOtar", "text/plain", "", "@alice:localhost", 5, &hello, nil, nil)
+
+	// A corrupted file of the same size is already stored under the hash.
+	filePath, err := fileutils.GetPathFromBase64Hash(testContentHash(hello), basePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.MkdirAll(filepath.Dir(filePath), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(filePath, []byte("HELLO"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	res, err := ImportSynapseMedia(ctx, cfg, db, nil, synapse.db, synapse.path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (SynapseImportProgress{Failed: 1}); *res != want {
+		t.Errorf("got %+v, want %+v", *res, want)
+	}
+	if m, _ := db.GetMediaMetadata(ctx, "GerZNDnDZVjsOtar", "localhost"); m != nil {
+		t.Error("media was imported with a file which doesn't match its hash")
+	}
+}
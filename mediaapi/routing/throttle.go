@@ -0,0 +1,205 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/dendrite/internal/config"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// The limits which held back bytes of downloads are counted by.
+const (
+	throttleLimitDownload = "download"
+	throttleLimitUser     = "user"
+)
+
+// throttleChunksPerSecond is how many reads a second a throttled download is split
+// into at most, so that it is sent steadily rather than in bursts of a whole buffer.
+const throttleChunksPerSecond = 10
+
+var throttledBytes = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "dendrite_mediaapi_download_throttled_bytes_total",
+		Help: "Total number of bytes of downloads which were held back to keep to a bandwidth limit, by which limit",
+	},
+	[]string{"limit"},
+)
+
+func init() {
+	prometheus.MustRegister(throttledBytes)
+}
+
+// downloadUserContextKey is the key in a download request's context of the ID of the
+// user making it.
+type downloadUserContextKey struct{}
+
+// withDownloadUser records that the download is by the user, so that it counts towards
+// the user's max_user_download_bytes_per_second.
+func withDownloadUser(req *http.Request, userID string) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), downloadUserContextKey{}, userID))
+}
+
+// downloadUser returns the user recorded by withDownloadUser, or an empty string if
+// the download isn't known to be by a user.
+func downloadUser(ctx context.Context) string {
+	userID, _ := ctx.Value(downloadUserContextKey{}).(string)
+	return userID
+}
+
+// bandwidthLimiter paces the reads which go through it to an average of bytesPerSecond.
+// Everything reading through the same limiter shares the bandwidth.
+type bandwidthLimiter struct {
+	sync.Mutex
+	name           string
+	bytesPerSecond int64
+	// When the bytes reserved so far will have been sent at the limit.
+	next time.Time
+}
+
+// reserve counts n more bytes against the limit, returning how long to wait before
+// sending them so that everything before them is sent at the limit.
+func (l *bandwidthLimiter) reserve(n int) time.Duration {
+	now := time.Now()
+	l.Lock()
+	defer l.Unlock()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	wait := l.next.Sub(now)
+	l.next = l.next.Add(time.Duration(int64(n) * int64(time.Second) / l.bytesPerSecond))
+	return wait
+}
+
+// userBandwidthLimiters shares a bandwidthLimiter between each user's downloads while
+// they have any in progress.
+type userBandwidthLimiters struct {
+	sync.Mutex
+	users map[string]*userBandwidthLimiter
+}
+
+type userBandwidthLimiter struct {
+	*bandwidthLimiter
+	downloads int
+}
+
+// userDownloadLimiters are the limiters of the users with downloads in progress.
+var userDownloadLimiters = &userBandwidthLimiters{users: map[string]*userBandwidthLimiter{}}
+
+// acquire returns the user's limiter and the function to call once the download is
+// finished with it.
+func (u *userBandwidthLimiters) acquire(userID string, bytesPerSecond int64) (*bandwidthLimiter, func()) {
+	u.Lock()
+	defer u.Unlock()
+	limiter, ok := u.users[userID]
+	if !ok {
+		limiter = &userBandwidthLimiter{bandwidthLimiter: &bandwidthLimiter{name: throttleLimitUser}}
+		u.users[userID] = limiter
+	}
+	limiter.downloads++
+	limiter.bandwidthLimiter.Lock()
+	limiter.bytesPerSecond = bytesPerSecond
+	limiter.bandwidthLimiter.Unlock()
+	return limiter.bandwidthLimiter, func() {
+		u.Lock()
+		defer u.Unlock()
+		if limiter.downloads--; limiter.downloads == 0 {
+			delete(u.users, userID)
+		}
+	}
+}
+
+// throttledReader is a reader which waits between reads to keep to the limiters. The
+// wait ends early, failing the read, if the context is done, e.g. because the client
+// disconnected.
+type throttledReader struct {
+	ctx       context.Context
+	reader    io.Reader
+	limiters  []*bandwidthLimiter
+	chunkSize int
+}
+
+// throttleDownload returns a reader which sends the download no faster than the
+// max_download_bytes_per_second and, if the download is by a user, the user's
+// max_user_download_bytes_per_second, along with the function to call once the
+// download has been sent. The limits apply to the response as it is read, so whatever
+// part of the media is sent is throttled.
+func throttleDownload(ctx context.Context, cfg *config.MediaAPI, reader io.Reader) (io.Reader, func()) {
+	var limiters []*bandwidthLimiter
+	release := func() {}
+	if cfg.MaxDownloadBytesPerSecond > 0 {
+		limiters = append(limiters, &bandwidthLimiter{
+			name: throttleLimitDownload, bytesPerSecond: int64(cfg.MaxDownloadBytesPerSecond),
+		})
+	}
+	if userID := downloadUser(ctx); userID != "" && cfg.MaxUserDownloadBytesPerSecond > 0 {
+		var limiter *bandwidthLimiter
+		limiter, release = userDownloadLimiters.acquire(userID, int64(cfg.MaxUserDownloadBytesPerSecond))
+		limiters = append(limiters, limiter)
+	}
+	if len(limiters) == 0 {
+		return reader, release
+	}
+	return newThrottledReader(ctx, reader, limiters), release
+}
+
+func newThrottledReader(ctx context.Context, reader io.Reader, limiters []*bandwidthLimiter) *throttledReader {
+	t := &throttledReader{ctx: ctx, reader: reader, limiters: limiters}
+	for _, limiter := range limiters {
+		chunkSize := int(limiter.bytesPerSecond / throttleChunksPerSecond)
+		if t.chunkSize == 0 || chunkSize < t.chunkSize {
+			t.chunkSize = chunkSize
+		}
+	}
+	if t.chunkSize < 1 {
+		t.chunkSize = 1
+	}
+	return t
+}
+
+func (t *throttledReader) Read(p []byte) (int, error) {
+	if len(p) > t.chunkSize {
+		p = p[:t.chunkSize]
+	}
+	n, err := t.reader.Read(p)
+	if n == 0 {
+		return n, err
+	}
+	// The bytes are held back for as long as the most limiting of the limits needs.
+	var wait time.Duration
+	limit := ""
+	for _, limiter := range t.limiters {
+		if w := limiter.reserve(n); w > wait {
+			wait = w
+			limit = limiter.name
+		}
+	}
+	if wait > 0 {
+		throttledBytes.WithLabelValues(limit).Add(float64(n))
+		timer := time.NewTimer(wait)
+		select {
+		case <-t.ctx.Done():
+			timer.Stop()
+			return 0, t.ctx.Err()
+		case <-timer.C:
+		}
+	}
+	return n, err
+}
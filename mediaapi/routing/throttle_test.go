@@ -0,0 +1,100 @@
+package routing
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/internal/config"
+)
+
+func TestThrottleDownload(t *testing.T) {
+	cfg := &config.MediaAPI{MaxDownloadBytesPerSecond: 10000}
+	content := bytes.Repeat([]byte("a"), 3000)
+
+	reader, release := throttleDownload(context.Background(), cfg, bytes.NewReader(content))
+	defer release()
+	start := time.Now()
+	got, err := ioutil.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, content) {
+		t.Errorf("got %d bytes, want the %d bytes of the content", len(got), len(content))
+	}
+	// The first chunk is sent straight away, the rest at the limit.
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+		t.Errorf("sent 3000 bytes at 10000 bytes a second in %v", elapsed)
+	}
+}
+
+func TestThrottleDownloadUnlimited(t *testing.T) {
+	reader := bytes.NewReader(nil)
+	got, release := throttleDownload(context.Background(), &config.MediaAPI{}, reader)
+	defer release()
+	if got != reader {
+		t.Errorf("without a limit got a %T, want the reader itself", got)
+	}
+}
+
+func TestThrottleDownloadCancelled(t *testing.T) {
+	cfg := &config.MediaAPI{MaxDownloadBytesPerSecond: 10}
+	ctx, cancel := context.WithCancel(context.Background())
+	reader, release := throttleDownload(ctx, cfg, bytes.NewReader(bytes.Repeat([]byte("a"), 100)))
+	defer release()
+
+	time.AfterFunc(50*time.Millisecond, cancel)
+	start := time.Now()
+	if _, err := ioutil.ReadAll(reader); err != context.Canceled {
+		t.Errorf("got error %v, want %v", err, context.Canceled)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("took %v to stop after the context was cancelled", elapsed)
+	}
+}
+
+func TestThrottleDownloadPerUser(t *testing.T) {
+	cfg := &config.MediaAPI{MaxUserDownloadBytesPerSecond: 10000}
+	req := withDownloadUser(httptest.NewRequest("GET", "/download", nil), "@alice:localhost")
+
+	// Both of the user's downloads share the limit, so between them they take twice
+	// as long as one would on its own.
+	first, releaseFirst := throttleDownload(req.Context(), cfg, bytes.NewReader(make([]byte, 1500)))
+	second, releaseSecond := throttleDownload(req.Context(), cfg, bytes.NewReader(make([]byte, 1500)))
+	start := time.Now()
+	done := make(chan error, 2)
+	for _, reader := range []io.Reader{first, second} {
+		go func(reader io.Reader) {
+			_, err := ioutil.ReadAll(reader)
+			done <- err
+		}(reader)
+	}
+	for i := 0; i < 2; i++ {
+		if err := <-done; err != nil {
+			t.Fatal(err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+		t.Errorf("sent 3000 bytes at 10000 bytes a second in %v", elapsed)
+	}
+	releaseFirst()
+	if len(userDownloadLimiters.users) != 1 {
+		t.Errorf("the user's limiter was released while they still had a download")
+	}
+	releaseSecond()
+	if len(userDownloadLimiters.users) != 0 {
+		t.Errorf("the user's limiter wasn't released once they had no downloads")
+	}
+
+	// Downloads not by a user aren't held to a user's limit.
+	reader := bytes.NewReader(nil)
+	got, release := throttleDownload(context.Background(), cfg, reader)
+	defer release()
+	if got != reader {
+		t.Errorf("without a user got a %T, want the reader itself", got)
+	}
+}
@@ -0,0 +1,147 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/dendrite/mediaapi/storage"
+	"github.com/matrix-org/dendrite/mediaapi/types"
+	log "github.com/sirupsen/logrus"
+)
+
+// userTrafficFlushInterval is how often the traffic of downloads is written to the
+// database. Downloads of the same user's media in between only cost a map update
+// rather than a database write each.
+const userTrafficFlushInterval = time.Minute
+
+// userTrafficHourMs is how long each hour of traffic is, as counted in the database.
+const userTrafficHourMs = 60 * 60 * 1000
+
+type userTrafficKey struct {
+	userID types.MatrixUserID
+	hourTs types.UnixMs
+}
+
+// UserTrafficTracker is a lockable map of the traffic of downloads, by the user who
+// uploaded the media and the hour it was served in, which has not yet been written
+// to the database. It must be flushed when the server shuts down so that none of it
+// is lost.
+type UserTrafficTracker struct {
+	sync.Mutex
+	pending map[userTrafficKey]types.UserTraffic
+}
+
+// NewUserTrafficTracker returns a UserTrafficTracker with no pending traffic.
+func NewUserTrafficTracker() *UserTrafficTracker {
+	return &UserTrafficTracker{
+		pending: map[userTrafficKey]types.UserTraffic{},
+	}
+}
+
+// record adds to the bytes served of the user's media at the given time. It never
+// blocks on the database, so can be called while serving a request.
+func (t *UserTrafficTracker) record(userID types.MatrixUserID, ts types.UnixMs, bytesServed int64) {
+	// Media fetched from other servers wasn't uploaded by anyone here.
+	if userID == "" {
+		return
+	}
+	t.add(userTrafficKey{userID, ts - ts%userTrafficHourMs}, types.UserTraffic{BytesServed: bytesServed})
+}
+
+func (t *UserTrafficTracker) add(key userTrafficKey, traffic types.UserTraffic) {
+	t.Lock()
+	defer t.Unlock()
+	pending := t.pending[key]
+	pending.BytesUploaded += traffic.BytesUploaded
+	pending.BytesServed += traffic.BytesServed
+	t.pending[key] = pending
+}
+
+// withPending adds the traffic recorded for the user since the last flush, in every
+// hour which overlaps the time from fromTs up to toTs, to what is stored in the database.
+func (t *UserTrafficTracker) withPending(
+	userID types.MatrixUserID, fromTs, toTs types.UnixMs, stored *types.UserTraffic,
+) types.UserTraffic {
+	traffic := *stored
+	t.Lock()
+	defer t.Unlock()
+	for key, pending := range t.pending {
+		if key.userID == userID && key.hourTs > fromTs-userTrafficHourMs && key.hourTs < toTs {
+			traffic.BytesUploaded += pending.BytesUploaded
+			traffic.BytesServed += pending.BytesServed
+		}
+	}
+	return traffic
+}
+
+// Flush writes all pending traffic to the database. That which fails to be written
+// is kept so that it is retried on the next flush.
+func (t *UserTrafficTracker) Flush(ctx context.Context, db storage.Database) {
+	t.Lock()
+	pending := t.pending
+	t.pending = map[userTrafficKey]types.UserTraffic{}
+	t.Unlock()
+
+	for key, traffic := range pending {
+		if err := db.AddUserTraffic(ctx, key.userID, key.hourTs, traffic.BytesUploaded, traffic.BytesServed); err != nil {
+			log.WithError(err).WithFields(log.Fields{
+				"UserID":      key.userID,
+				"BytesServed": traffic.BytesServed,
+			}).Warn("Failed to store user traffic")
+			t.add(key, traffic)
+		}
+	}
+}
+
+// run flushes pending traffic to the database every interval, forever.
+func (t *UserTrafficTracker) run(db storage.Database, interval time.Duration) {
+	for range time.Tick(interval) {
+		t.Flush(context.Background(), db)
+	}
+}
+
+// recordUploadTraffic adds the bytes of an upload to the traffic which is counted
+// against the user. Unlike that of downloads it is written to the database straight
+// away, as an upload already writes to it. Failures are only logged, as the upload
+// has already succeeded.
+func recordUploadTraffic(
+	ctx context.Context, db storage.Database, logger *log.Entry,
+	userID types.MatrixUserID, bytesUploaded int64,
+) {
+	now := types.UnixMs(time.Now().UnixNano() / 1000000)
+	if err := db.AddUserTraffic(ctx, userID, now, bytesUploaded, 0); err != nil {
+		logger.WithError(err).WithFields(log.Fields{
+			"UserID":        userID,
+			"BytesUploaded": bytesUploaded,
+		}).Warn("Failed to store user traffic")
+	}
+}
+
+// countingResponseWriter counts the bytes of the response body which are written,
+// after any compression.
+type countingResponseWriter struct {
+	http.ResponseWriter
+	written int64
+}
+
+func (w *countingResponseWriter) Write(p []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(p)
+	w.written += int64(n)
+	return n, err
+}
@@ -0,0 +1,163 @@
+package routing
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/internal/config"
+	"github.com/matrix-org/dendrite/mediaapi/storage"
+	"github.com/matrix-org/dendrite/mediaapi/types"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+)
+
+func TestUserTraffic(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mediaapi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir) // nolint: errcheck
+	dbOptions := &config.DatabaseOptions{
+		ConnectionString: config.DataSource("file:" + filepath.Join(dir, "mediaapi.db")),
+	}
+	db, err := storage.Open(dbOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	maxFileSizeBytes := config.FileSizeBytes(1024)
+	cfg := &config.MediaAPI{
+		Matrix:           &config.Global{ServerName: "localhost"},
+		AbsBasePath:      config.Path(filepath.Join(dir, "media_store")),
+		MaxFileSizeBytes: &maxFileSizeBytes,
+	}
+	activeThumbnailGeneration := &types.ActiveThumbnailGeneration{
+		PathToResult: map[string]*types.ThumbnailGenerationResult{},
+	}
+	start := types.UnixMs(time.Now().UnixNano() / 1000000)
+	trafficTracker := NewUserTrafficTracker()
+
+	req := httptest.NewRequest(http.MethodPost, "/upload", strings.NewReader("twelve bytes"))
+	req.Header.Set("Content-Type", "text/plain")
+	res := Upload(req, cfg, &userapi.Device{UserID: "@alice:localhost"}, db, activeThumbnailGeneration, nil, nil)
+	if res.Code != http.StatusOK {
+		t.Fatalf("upload: got status %d, want %d", res.Code, http.StatusOK)
+	}
+	mediaID := types.MediaID(strings.TrimPrefix(res.JSON.(uploadResponse).ContentURI, "mxc://localhost/"))
+	// An upload which fails isn't counted.
+	req = httptest.NewRequest(http.MethodPost, "/upload", strings.NewReader(strings.Repeat("x", 2048)))
+	req.Header.Set("Content-Type", "text/plain")
+	if res = Upload(req, cfg, &userapi.Device{UserID: "@alice:localhost"}, db, activeThumbnailGeneration, nil, nil); res.Code == http.StatusOK {
+		t.Fatal("upload over the maximum file size succeeded")
+	}
+
+	for i := 0; i < 2; i++ {
+		w := httptest.NewRecorder()
+		Download(
+			w, httptest.NewRequest(http.MethodGet, "/download/localhost/"+string(mediaID), nil),
+			"localhost", mediaID, cfg, db, nil,
+			&types.ActiveRemoteRequests{MXCToResult: map[string]*types.RemoteRequestResult{}},
+			activeThumbnailGeneration, nil, nil, newMediaAccessTracker(), trafficTracker, false, "",
+		)
+		if w.Code != http.StatusOK {
+			t.Fatalf("download: got status %d, want %d", w.Code, http.StatusOK)
+		}
+	}
+	// Nobody here uploaded media from other servers, so it isn't counted.
+	storeTestContent(t, db, cfg.AbsBasePath, "remote.example", "abc", "text/plain", "remote media")
+	Download(
+		httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/download/remote.example/abc", nil),
+		"remote.example", "abc", cfg, db, nil,
+		&types.ActiveRemoteRequests{MXCToResult: map[string]*types.RemoteRequestResult{}},
+		activeThumbnailGeneration, nil, nil, newMediaAccessTracker(), trafficTracker, false, "",
+	)
+
+	getTraffic := func(userID, query string) (int, userTrafficResponse) {
+		req := httptest.NewRequest(http.MethodGet, "/admin/traffic/"+userID+query, nil)
+		res := GetUserTraffic(req, cfg, db, trafficTracker, userID)
+		traffic, _ := res.JSON.(userTrafficResponse)
+		return res.Code, traffic
+	}
+	// The traffic of the downloads is included before it has been written to the database.
+	code, traffic := getTraffic("@alice:localhost", "")
+	if code != http.StatusOK {
+		t.Fatalf("got status %d, want %d", code, http.StatusOK)
+	}
+	if traffic.BytesUploaded != 12 || traffic.BytesServed != 24 {
+		t.Errorf("before flushing: got %d bytes uploaded and %d served, want 12 and 24", traffic.BytesUploaded, traffic.BytesServed)
+	}
+
+	// Once flushed the traffic is still there after the database has been opened
+	// again, as it would be after a restart.
+	trafficTracker.Flush(context.Background(), db)
+	db, err = storage.Open(dbOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	trafficTracker = NewUserTrafficTracker()
+	code, traffic = getTraffic("@alice:localhost", "")
+	if code != http.StatusOK {
+		t.Fatalf("got status %d, want %d", code, http.StatusOK)
+	}
+	if traffic.BytesUploaded != 12 || traffic.BytesServed != 24 {
+		t.Errorf("got %d bytes uploaded and %d served, want 12 and 24", traffic.BytesUploaded, traffic.BytesServed)
+	}
+	code, traffic = getTraffic("@alice:localhost", "?to_ts="+strconv.FormatInt(int64(start)-2*60*60*1000, 10))
+	if code != http.StatusOK || traffic.BytesUploaded != 0 || traffic.BytesServed != 0 {
+		t.Errorf("window before the upload: got status %d and %+v, want %d and no traffic", code, traffic, http.StatusOK)
+	}
+	if code, traffic = getTraffic("@bob:localhost", ""); code != http.StatusOK || traffic.BytesUploaded != 0 {
+		t.Errorf("user without traffic: got status %d and %+v, want %d and no traffic", code, traffic, http.StatusOK)
+	}
+
+	for _, tt := range []struct {
+		userID string
+		query  string
+	}{
+		{"alice", ""},
+		{"@alice:remote.example", ""},
+		{"@alice:localhost", "?from_ts=yesterday"},
+		{"@alice:localhost", "?from_ts=-1"},
+		{"@alice:localhost", "?from_ts=2000&to_ts=1000"},
+	} {
+		if code, _ = getTraffic(tt.userID, tt.query); code != http.StatusBadRequest {
+			t.Errorf("%s%s: got status %d, want %d", tt.userID, tt.query, code, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestAddUserTraffic(t *testing.T) {
+	db, _, cleanup := newTestDatabase(t)
+	defer cleanup()
+	ctx := context.Background()
+	const hour = 60 * 60 * 1000
+	for _, ts := range []types.UnixMs{hour + 1, hour + 2, 2*hour + 1, 3 * hour} {
+		if err := db.AddUserTraffic(ctx, "@alice:localhost", ts, 1, 10); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, tt := range []struct {
+		fromTs, toTs types.UnixMs
+		want         types.UserTraffic
+	}{
+		{0, 4 * hour, types.UserTraffic{BytesUploaded: 4, BytesServed: 40}},
+		{hour + hour/2, hour + hour/2, types.UserTraffic{BytesUploaded: 2, BytesServed: 20}},
+		{2 * hour, 3 * hour, types.UserTraffic{BytesUploaded: 1, BytesServed: 10}},
+		{2 * hour, 3*hour + 1, types.UserTraffic{BytesUploaded: 2, BytesServed: 20}},
+		{4 * hour, 5 * hour, types.UserTraffic{}},
+	} {
+		got, err := db.GetUserTraffic(ctx, "@alice:localhost", tt.fromTs, tt.toTs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if *got != tt.want {
+			t.Errorf("%d to %d: got %+v, want %+v", tt.fromTs, tt.toTs, *got, tt.want)
+		}
+	}
+}
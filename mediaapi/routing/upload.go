@@ -15,97 +15,590 @@
 package routing
 
 import (
+	"compress/flate"
 	"context"
-	"crypto/rand"
-	"encoding/hex"
 	"fmt"
 	"io"
+	"mime"
+	"mime/multipart"
+	"net"
 	"net/http"
 	"net/url"
 	"path"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"sync/atomic"
+	"time"
 
+	appserviceTypes "github.com/matrix-org/dendrite/appservice/types"
 	"github.com/matrix-org/dendrite/clientapi/jsonerror"
 	"github.com/matrix-org/dendrite/internal/config"
+	"github.com/matrix-org/dendrite/internal/httputil"
 	"github.com/matrix-org/dendrite/mediaapi/fileutils"
+	"github.com/matrix-org/dendrite/mediaapi/sanitizer"
+	"github.com/matrix-org/dendrite/mediaapi/scanner"
 	"github.com/matrix-org/dendrite/mediaapi/storage"
 	"github.com/matrix-org/dendrite/mediaapi/thumbnailer"
 	"github.com/matrix-org/dendrite/mediaapi/types"
 	userapi "github.com/matrix-org/dendrite/userapi/api"
 	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/matrix-org/util"
+	"github.com/prometheus/client_golang/prometheus"
 	log "github.com/sirupsen/logrus"
+	"golang.org/x/text/unicode/norm"
 )
 
+var (
+	// Prometheus metrics
+	storageErrors = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "dendrite_mediaapi_storage_errors_total",
+			Help: "Total number of uploads which failed because the media store was full or not writable",
+		},
+		[]string{"reason"},
+	)
+	uploadCompressionRatio = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    "dendrite_mediaapi_upload_compression_ratio",
+			Help:    "How many times smaller uploads are when compressed, if compressible_uploads is enabled",
+			Buckets: []float64{1, 1.1, 1.5, 2, 3, 5, 10, 100, 1000},
+		},
+	)
+)
+
+func init() {
+	// Register prometheus metrics. They must be registered to be exposed.
+	prometheus.MustRegister(storageErrors, uploadCompressionRatio)
+}
+
 // uploadRequest metadata included in or derivable from an upload request
 // https://matrix.org/docs/spec/client_server/r0.2.0.html#post-matrix-media-r0-upload
 // NOTE: The members come from HTTP request metadata such as headers, query parameters or can be derived from such
 type uploadRequest struct {
 	MediaMetadata *types.MediaMetadata
 	Logger        *log.Entry
+	// Whether any existing media with the media ID is replaced by the upload
+	Overwrite bool
+	// Whether media with the same content which the user already uploaded is used
+	// instead of storing the upload under a new media ID, and whether it was.
+	ReuseExisting bool
+	Reused        bool
+	// The bytes which were added to the total size of the stored files for the upload.
+	ReservedBytes int64
 }
 
 // uploadResponse defines the format of the JSON response
 // https://matrix.org/docs/spec/client_server/r0.2.0.html#post-matrix-media-r0-upload
 type uploadResponse struct {
 	ContentURI string `json:"content_uri"`
+	// Existing is set if the content URI is of media which was already uploaded, as
+	// asked for with the reuse_existing query parameter.
+	Existing bool `json:"existing,omitempty"`
+	// DownloadURL is where the media can be downloaded from through the CDN, if there
+	// is a cdn_base_url. It isn't part of the spec.
+	DownloadURL string `json:"download_url,omitempty"`
+}
+
+// cdnDownloadURL returns the URL the media with the content URI can be downloaded
+// from through the CDN, or an empty string if there is no cdn_base_url.
+func cdnDownloadURL(cfg *config.MediaAPI, contentURI string) string {
+	if cfg.CDNBaseURL == "" {
+		return ""
+	}
+	return cfg.CDNBaseURL + "/_matrix/media/v3/download/" + strings.TrimPrefix(contentURI, "mxc://")
 }
 
 // Upload implements POST /upload
 // This endpoint involves uploading potentially significant amounts of data to the homeserver.
 // This implementation supports a configurable maximum file size limit in bytes. If a user tries to upload more than this, they will receive an error that their upload is too large.
 // Uploaded files are processed piece-wise to avoid DoS attacks which would starve the server of memory.
-// TODO: We should time out requests if they have not received any data within a configured timeout period.
-func Upload(req *http.Request, cfg *config.MediaAPI, dev *userapi.Device, db storage.Database, activeThumbnailGeneration *types.ActiveThumbnailGeneration) util.JSONResponse {
-	r, resErr := parseAndValidateRequest(req, cfg, dev)
+// Admins and application services may choose the media ID with the media_id query parameter.
+// If the reuse_existing query parameter is "true" then the upload is given the content URI of
+// media with the same content which the user already uploaded, if there is any, rather than
+// a new one.
+// Uploads which send nothing within the first_byte_timeout are abandoned.
+// TODO: We should also time out requests which stop sending data part way through.
+func Upload(
+	req *http.Request, cfg *config.MediaAPI, dev *userapi.Device, db storage.Database,
+	activeThumbnailGeneration *types.ActiveThumbnailGeneration, encryptionKey *fileutils.EncryptionKey,
+	uploadScanner scanner.Scanner,
+) util.JSONResponse {
+	mediaID := normalizeMediaID(cfg, cfg.Matrix.ServerName, types.MediaID(req.URL.Query().Get("media_id")))
+	var overwrite bool
+	if mediaID != "" {
+		var resErr *util.JSONResponse
+		if overwrite, resErr = checkClientMediaID(req.Context(), cfg, dev, db, mediaID); resErr != nil {
+			return *resErr
+		}
+	}
+
+	req, cancel := withUploadDeadline(req, cfg.MaxUploadDuration)
+	defer cancel()
+	r, reqReader, resErr := parseAndValidateRequest(req, cfg, dev)
 	if resErr != nil {
 		return *resErr
 	}
+	if mediaID != "" {
+		r.MediaMetadata.MediaID = mediaID
+		r.Overwrite = overwrite
+		r.Logger = r.Logger.WithField("media_id", mediaID)
+	} else {
+		r.ReuseExisting = strings.ToLower(req.URL.Query().Get("reuse_existing")) == "true"
+	}
 
-	if resErr = r.doUpload(req.Context(), req.Body, cfg, db, activeThumbnailGeneration); resErr != nil {
+	if resErr = r.doUpload(req.Context(), reqReader, cfg, db, activeThumbnailGeneration, encryptionKey, uploadScanner); resErr != nil {
 		return *resErr
 	}
 
+	contentURI := fmt.Sprintf("mxc://%s/%s", cfg.Matrix.ServerName, r.MediaMetadata.MediaID)
 	return util.JSONResponse{
 		Code: http.StatusOK,
 		JSON: uploadResponse{
-			ContentURI: fmt.Sprintf("mxc://%s/%s", cfg.Matrix.ServerName, r.MediaMetadata.MediaID),
+			ContentURI:  contentURI,
+			Existing:    r.Reused,
+			DownloadURL: cdnDownloadURL(cfg, contentURI),
+		},
+	}
+}
+
+// CheckUpload implements GET /upload_check
+// This checks whether an upload with the content_type, size and filename query parameters
+// would be accepted, without the client having to send the file first. The response is
+// the error which the upload would fail with before the file is read, or 200 if it would
+// be accepted. Nothing is stored. The size can be left out if it isn't known, as for a
+// chunked upload, in which case it isn't checked until the file is uploaded.
+func CheckUpload(req *http.Request, cfg *config.MediaAPI, dev *userapi.Device, db storage.Database) util.JSONResponse {
+	query := req.URL.Query()
+	// A negative size is an unknown one, as for uploads without a Content-Length.
+	size := int64(-1)
+	if value := query.Get("size"); value != "" {
+		var err error
+		if size, err = strconv.ParseInt(value, 10, 64); err != nil || size < 0 {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.InvalidArgumentValue("size must be a number of bytes"),
+			}
+		}
+	}
+	r := &uploadRequest{
+		MediaMetadata: &types.MediaMetadata{
+			Origin:        cfg.Matrix.ServerName,
+			FileSizeBytes: types.FileSizeBytes(size),
+			ContentType:   types.ContentType(query.Get("content_type")),
+			UploadName:    escapeUploadName(query.Get("filename")),
+			UserID:        types.MatrixUserID(dev.UserID),
 		},
+		Logger: util.GetLogger(req.Context()).WithFields(log.Fields{
+			"Origin":   cfg.Matrix.ServerName,
+			"ClientIP": requestClientIP(req),
+		}),
+	}
+	if resErr := r.validateMetadata(cfg); resErr != nil {
+		return *resErr
+	}
+	if resErr := r.checkStorageLimit(req.Context(), db, cfg.MaxTotalStorageBytes); resErr != nil {
+		return *resErr
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: struct{}{},
 	}
 }
 
 // parseAndValidateRequest parses the incoming upload request to validate and extract
 // all the metadata about the media being uploaded.
-// Returns either an uploadRequest or an error formatted as a util.JSONResponse
-func parseAndValidateRequest(req *http.Request, cfg *config.MediaAPI, dev *userapi.Device) (*uploadRequest, *util.JSONResponse) {
+// Returns either an uploadRequest and a reader for the media data, or an error formatted
+// as a util.JSONResponse
+func parseAndValidateRequest(req *http.Request, cfg *config.MediaAPI, dev *userapi.Device) (*uploadRequest, io.Reader, *util.JSONResponse) {
+	// Note: the filename is only read from the query string, as req.FormValue would
+	// consume a multipart/form-data body.
 	r := &uploadRequest{
 		MediaMetadata: &types.MediaMetadata{
 			Origin:        cfg.Matrix.ServerName,
-			FileSizeBytes: types.FileSizeBytes(req.ContentLength),
+			FileSizeBytes: uploadSize(req),
 			ContentType:   types.ContentType(req.Header.Get("Content-Type")),
-			UploadName:    types.Filename(url.PathEscape(req.FormValue("filename"))),
+			UploadName:    escapeUploadName(req.URL.Query().Get("filename")),
 			UserID:        types.MatrixUserID(dev.UserID),
 		},
-		Logger: util.GetLogger(req.Context()).WithField("Origin", cfg.Matrix.ServerName),
+		Logger: util.GetLogger(req.Context()).WithFields(log.Fields{
+			"Origin":   cfg.Matrix.ServerName,
+			"ClientIP": requestClientIP(req),
+		}),
+	}
+
+	// The first byte timeout wraps the upload deadline, so that it can tell which of
+	// the two a read deadline on the connection was for.
+	if deadline, ok := req.Context().Deadline(); ok && cfg.MaxUploadDuration > 0 {
+		req.Body = newUploadDurationReader(req, deadline)
+	}
+	var body *firstByteReader
+	if cfg.FirstByteTimeout > 0 {
+		body = newFirstByteReader(req, cfg.FirstByteTimeout)
+		req.Body = body
+	}
+	var reqReader io.Reader = req.Body
+	if mediaType, _, err := mime.ParseMediaType(string(r.MediaMetadata.ContentType)); err == nil && mediaType == "multipart/form-data" {
+		// The media is the first file in the form rather than the request body.
+		// The Content-Length still covers the whole form, so it is only an upper
+		// bound on the file size until the file has been written out.
+		part, resErr := firstMultipartFile(req)
+		if resErr != nil {
+			// The multipart reader doesn't keep the error it got from the body.
+			if body != nil && body.timedOut() {
+				return nil, nil, r.firstByteTimeoutResponse(cfg.FirstByteTimeout)
+			}
+			return nil, nil, resErr
+		}
+		reqReader = part
+		r.MediaMetadata.ContentType = types.ContentType(part.Header.Get("Content-Type"))
+		if r.MediaMetadata.UploadName == "" {
+			r.MediaMetadata.UploadName = sanitizeUploadName(part.FileName())
+		}
+	} else if header := req.Header.Get("Content-Disposition"); cfg.PreferClientContentDisposition {
+		// The client's header is kept, including its name, rather than the filename
+		// query parameter.
+		r.MediaMetadata.Disposition = contentDispositionType(header)
+		if uploadName := uploadNameFromContentDisposition(header); uploadName != "" {
+			r.MediaMetadata.UploadName = uploadName
+		}
+	} else if r.MediaMetadata.UploadName == "" {
+		// Clients may also name the file in a Content-Disposition header, which is only
+		// used if the filename query parameter wasn't given.
+		r.MediaMetadata.UploadName = uploadNameFromContentDisposition(header)
+	}
+
+	if resErr := r.validateMetadata(cfg); resErr != nil {
+		return nil, nil, resErr
+	}
+
+	return r, reqReader, nil
+}
+
+// uploadSize returns the size of the upload given by the Content-Length, or -1 if it isn't
+// known. The length of a chunked upload is only known once it has been read, even if a
+// Content-Length was sent with it, see RFC 7230 section 3.3.3, so it is always unknown
+// rather than being rejected as empty by Validate.
+func uploadSize(req *http.Request) types.FileSizeBytes {
+	for _, encoding := range req.TransferEncoding {
+		if strings.EqualFold(encoding, "chunked") {
+			return -1
+		}
 	}
+	return types.FileSizeBytes(req.ContentLength)
+}
 
-	if resErr := r.Validate(*cfg.MaxFileSizeBytes); resErr != nil {
-		return nil, resErr
+// validateMetadata normalizes the content type of the upload, or sets the default if it
+// has none, and checks that the upload would be accepted before any of it is read.
+func (r *uploadRequest) validateMetadata(cfg *config.MediaAPI) *util.JSONResponse {
+	if r.MediaMetadata.ContentType == "" {
+		r.MediaMetadata.ContentType = types.ContentType(cfg.DefaultContentType)
+	} else {
+		contentType, err := normalizeContentType(string(r.MediaMetadata.ContentType))
+		if err != nil {
+			r.Logger.WithError(err).WithField("ContentType", r.MediaMetadata.ContentType).Warn("Rejecting upload with invalid Content-Type")
+			return &util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.InvalidArgumentValue("Invalid Content-Type: " + err.Error()),
+			}
+		}
+		r.MediaMetadata.ContentType = contentType
 	}
 
-	return r, nil
+	return r.Validate(*cfg.MaxFileSizeBytes)
+}
+
+// allowedCharsets are the charsets which uploads may declare. Others, such as UTF-7,
+// can be used to trick browsers into interpreting the media as something else.
+var allowedCharsets = map[string]bool{
+	"utf-8":      true,
+	"us-ascii":   true,
+	"iso-8859-1": true,
 }
 
-func (r *uploadRequest) generateMediaID(ctx context.Context, db storage.Database) (types.MediaID, error) {
+// normalizeContentType parses a client supplied Content-Type and returns it in a
+// canonical form containing only the media type and an allowed charset, if any.
+// Any other parameters are dropped, and a charset which isn't allowed or a
+// malformed header is an error.
+func normalizeContentType(contentType string) (types.ContentType, error) {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return "", err
+	}
+	if i := strings.Index(mediaType, "/"); i <= 0 || i == len(mediaType)-1 {
+		return "", fmt.Errorf("media type %q must be of the form type/subtype", mediaType)
+	}
+	normalizedParams := map[string]string{}
+	if charset, ok := params["charset"]; ok {
+		charset = strings.ToLower(charset)
+		if !allowedCharsets[charset] {
+			return "", fmt.Errorf("charset %q is not allowed", charset)
+		}
+		normalizedParams["charset"] = charset
+	}
+	normalized := mime.FormatMediaType(mediaType, normalizedParams)
+	if normalized == "" {
+		return "", fmt.Errorf("media type %q is invalid", mediaType)
+	}
+	return types.ContentType(normalized), nil
+}
+
+// firstMultipartFile returns the first part of a multipart/form-data request body
+// which is a file, skipping over any other form fields.
+func firstMultipartFile(req *http.Request) (*multipart.Part, *util.JSONResponse) {
+	mr, err := req.MultipartReader()
+	if err != nil {
+		return nil, &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue("Invalid multipart/form-data request body."),
+		}
+	}
 	for {
-		// First try generating a meda ID. We'll do this by
-		// generating some random bytes and then hex-encoding.
-		mediaIDBytes := make([]byte, 32)
-		_, err := rand.Read(mediaIDBytes)
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			return nil, &util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.MissingArgument("Multipart upload must contain a file."),
+			}
+		}
 		if err != nil {
-			return "", fmt.Errorf("rand.Read: %w", err)
+			return nil, &util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.InvalidArgumentValue("Invalid multipart/form-data request body."),
+			}
+		}
+		if part.FileName() != "" {
+			return part, nil
+		}
+	}
+}
+
+// uploadNameFromContentDisposition extracts the file name from a Content-Disposition
+// request header, returning an empty name if the header is missing or invalid. Both
+// the plain filename parameter and the RFC 5987 encoded filename* form are handled.
+// Only the file name is taken from the header; any other directives are ignored.
+func uploadNameFromContentDisposition(header string) types.Filename {
+	if header == "" {
+		return ""
+	}
+	disposition, params, err := mime.ParseMediaType(header)
+	if err != nil || (disposition != "inline" && disposition != "attachment") {
+		return ""
+	}
+	// mime.ParseMediaType decodes filename* and stores it as filename, taking
+	// precedence over a plain filename parameter if both were given.
+	return sanitizeUploadName(params["filename"])
+}
+
+// contentDispositionType returns the type of a Content-Disposition header, either
+// "inline" or "attachment", or an empty string if it is neither or can't be parsed.
+func contentDispositionType(header string) string {
+	disposition, _, err := mime.ParseMediaType(header)
+	if err != nil || (disposition != "inline" && disposition != "attachment") {
+		return ""
+	}
+	return disposition
+}
+
+// sanitizeUploadName strips any path from a client supplied file name and escapes
+// it in the same way as the filename query parameter. Names containing control
+// characters are dropped.
+func sanitizeUploadName(filename string) types.Filename {
+	// Never trust a path in the name, only the last element of it.
+	if i := strings.LastIndexAny(filename, `/\`); i >= 0 {
+		filename = filename[i+1:]
+	}
+	for _, c := range filename {
+		if c < 0x20 || c == 0x7f {
+			return ""
+		}
+	}
+	if filename == "." || filename == ".." {
+		return ""
+	}
+	return escapeUploadName(filename)
+}
+
+// escapeUploadName escapes a client supplied file name to be stored as the upload
+// name. It is normalised to NFC first, so that a name is stored the same however
+// the client composed its characters, e.g. é as one code point or as e and an accent.
+func escapeUploadName(filename string) types.Filename {
+	return types.Filename(url.PathEscape(norm.NFC.String(filename)))
+}
+
+// uploadNameExtensions are the extensions used for default upload names of common
+// content types, which mime.ExtensionsByType would otherwise pick for depending on
+// the system's MIME types, e.g. ".jfif" for a JPEG.
+var uploadNameExtensions = map[string]string{
+	"image/jpeg":      ".jpg",
+	"image/png":       ".png",
+	"image/gif":       ".gif",
+	"image/webp":      ".webp",
+	"image/svg+xml":   ".svg",
+	"audio/mpeg":      ".mp3",
+	"audio/ogg":       ".ogg",
+	"video/mp4":       ".mp4",
+	"video/webm":      ".webm",
+	"text/plain":      ".txt",
+	"application/pdf": ".pdf",
+}
+
+// defaultUploadName makes up a name for media which was uploaded without one, from
+// its media ID and an extension for its content type, e.g. "abcd1234.png". The name
+// is escaped like any other upload name, and has no extension if the content type
+// doesn't have a known one. Media IDs can't contain a '~', so the name always passes
+// validation.
+func defaultUploadName(mediaID types.MediaID, contentType types.ContentType) types.Filename {
+	if mediaID == "" {
+		return ""
+	}
+	name := string(mediaID)
+	if mediaType, _, err := mime.ParseMediaType(string(contentType)); err == nil {
+		name += contentTypeExtension(mediaType)
+	}
+	return sanitizeUploadName(name)
+}
+
+// contentTypeExtension returns the extension, including the dot, which files of the
+// media type are usually named with, or an empty string if there isn't a known one.
+func contentTypeExtension(mediaType string) string {
+	if ext, ok := uploadNameExtensions[mediaType]; ok {
+		return ext
+	}
+	if exts, _ := mime.ExtensionsByType(mediaType); len(exts) > 0 {
+		return exts[0]
+	}
+	return ""
+}
+
+// checkClientMediaID checks that the user may upload to the media ID they chose, which
+// only admins and application services can do. Returns whether there is existing media
+// with the ID which should be overwritten.
+func checkClientMediaID(
+	ctx context.Context, cfg *config.MediaAPI, dev *userapi.Device, db storage.Database, mediaID types.MediaID,
+) (bool, *util.JSONResponse) {
+	if !cfg.IsAdmin(dev.UserID) && dev.ID != appserviceTypes.AppServiceDeviceID {
+		return false, &util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden("Only admins and application services may choose a media ID"),
+		}
+	}
+	if !mediaIDRegex.MatchString(string(mediaID)) {
+		return false, &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue(fmt.Sprintf("media_id must use only characters in %v", mediaIDCharacters)),
+		}
+	}
+
+	logger := util.GetLogger(ctx).WithField("media_id", mediaID)
+	reservation, err := db.GetMediaReservation(ctx, mediaID, cfg.Matrix.ServerName)
+	if err != nil {
+		logger.WithError(err).Error("db.GetMediaReservation failed")
+		resErr := jsonerror.InternalServerError()
+		return false, &resErr
+	}
+	if reservation != nil && reservation.ExpiresTimestamp > types.UnixMs(time.Now().UnixNano()/1000000) {
+		return false, &util.JSONResponse{
+			Code: http.StatusConflict,
+			JSON: jsonerror.CannotOverwriteMedia("Media ID is reserved for another upload"),
+		}
+	}
+	existingMetadata, err := db.GetMediaMetadata(ctx, mediaID, cfg.Matrix.ServerName)
+	if err != nil {
+		logger.WithError(err).Error("db.GetMediaMetadata failed")
+		resErr := jsonerror.InternalServerError()
+		return false, &resErr
+	}
+	if existingMetadata == nil {
+		return false, nil
+	}
+	if cfg.ClientMediaIDCollision != config.ClientMediaIDOverwrite {
+		return false, &util.JSONResponse{
+			Code: http.StatusConflict,
+			JSON: jsonerror.CannotOverwriteMedia("Media ID already has content"),
+		}
+	}
+	return true, nil
+}
+
+// UploadReserved implements PUT /upload/{serverName}/{mediaId}
+// This uploads content to a media ID which was previously reserved with POST /create.
+// https://github.com/matrix-org/matrix-doc/pull/2246
+func UploadReserved(
+	req *http.Request, cfg *config.MediaAPI, dev *userapi.Device, db storage.Database,
+	activeThumbnailGeneration *types.ActiveThumbnailGeneration, encryptionKey *fileutils.EncryptionKey,
+	uploadScanner scanner.Scanner, serverName gomatrixserverlib.ServerName, mediaID types.MediaID,
+) util.JSONResponse {
+	serverName = normalizeOrigin(cfg, serverName)
+	mediaID = normalizeMediaID(cfg, serverName, mediaID)
+	if serverName != cfg.Matrix.ServerName {
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: jsonerror.NotFound("Media ID was not reserved on this server"),
+		}
+	}
+	reservation, err := db.GetMediaReservation(req.Context(), mediaID, serverName)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("db.GetMediaReservation failed")
+		return jsonerror.InternalServerError()
+	}
+	if reservation == nil || reservation.ExpiresTimestamp < types.UnixMs(time.Now().UnixNano()/1000000) {
+		existingMetadata, merr := db.GetMediaMetadata(req.Context(), mediaID, serverName)
+		if merr != nil {
+			util.GetLogger(req.Context()).WithError(merr).Error("db.GetMediaMetadata failed")
+			return jsonerror.InternalServerError()
+		}
+		if existingMetadata != nil {
+			return util.JSONResponse{
+				Code: http.StatusConflict,
+				JSON: jsonerror.CannotOverwriteMedia("Media ID already has content"),
+			}
+		}
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: jsonerror.NotFound("Media ID was not reserved or the reservation has expired"),
+		}
+	}
+	if reservation.UserID != types.MatrixUserID(dev.UserID) {
+		return util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden("Media ID was reserved by another user"),
+		}
+	}
+
+	req, cancel := withUploadDeadline(req, cfg.MaxUploadDuration)
+	defer cancel()
+	r, reqReader, resErr := parseAndValidateRequest(req, cfg, dev)
+	if resErr != nil {
+		return *resErr
+	}
+	r.MediaMetadata.MediaID = mediaID
+	r.Logger = r.Logger.WithField("media_id", mediaID)
+
+	if resErr = r.doUpload(req.Context(), reqReader, cfg, db, activeThumbnailGeneration, encryptionKey, uploadScanner); resErr != nil {
+		return *resErr
+	}
+
+	// The content is stored so the reservation is no longer needed. If this fails then
+	// the reservation will expire on its own, and the media row takes precedence anyway.
+	if err = db.DeleteMediaReservation(req.Context(), mediaID, serverName); err != nil {
+		r.Logger.WithError(err).Warn("Failed to delete media reservation")
+	}
+
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: struct{}{},
+	}
+}
+
+func (r *uploadRequest) generateMediaID(ctx context.Context, cfg *config.MediaAPI, db storage.Database) (types.MediaID, error) {
+	generator := NewMediaIDGenerator(cfg.MediaIDFormat)
+	for {
+		// First try generating a media ID with the configured generator.
+		mediaID, err := generator.NewMediaID()
+		if err != nil {
+			return "", err
 		}
-		mediaID := types.MediaID(hex.EncodeToString(mediaIDBytes))
 		// Then we will check if this media ID already exists in
 		// our database. If it does then we had best generate a
 		// new one.
@@ -118,6 +611,15 @@ func (r *uploadRequest) generateMediaID(ctx context.Context, db storage.Database
 			// and generate a new one instead.
 			continue
 		}
+		// The media ID might also have been reserved with /create
+		// but not uploaded to yet.
+		reservation, err := db.GetMediaReservation(ctx, mediaID, r.MediaMetadata.Origin)
+		if err != nil {
+			return "", fmt.Errorf("db.GetMediaReservation: %w", err)
+		}
+		if reservation != nil {
+			continue
+		}
 		// The media ID was not already used - let's return that.
 		return mediaID, nil
 	}
@@ -129,17 +631,23 @@ func (r *uploadRequest) doUpload(
 	cfg *config.MediaAPI,
 	db storage.Database,
 	activeThumbnailGeneration *types.ActiveThumbnailGeneration,
+	encryptionKey *fileutils.EncryptionKey,
+	uploadScanner scanner.Scanner,
 ) *util.JSONResponse {
 	r.Logger.WithFields(log.Fields{
 		"UploadName":    r.MediaMetadata.UploadName,
 		"FileSizeBytes": r.MediaMetadata.FileSizeBytes,
 		"ContentType":   r.MediaMetadata.ContentType,
 	}).Info("Uploading file")
+	if resErr := r.checkStorageLimit(ctx, db, cfg.MaxTotalStorageBytes); resErr != nil {
+		return resErr
+	}
 
 	// The file data is hashed and the hash is used as the MediaID. The hash is useful as a
 	// method of deduplicating files to save storage, as well as a way to conduct
 	// integrity checks on the file data in the repository.
-	// Data is truncated to maxFileSizeBytes. Content-Length was reported as 0 < Content-Length <= maxFileSizeBytes so this is OK.
+	// Uploads over maxFileSizeBytes are rejected as they are read, as the Content-Length
+	// may be missing for chunked uploads, or only an upper bound for multipart ones.
 	//
 	// TODO: This has a bad API shape where you either need to call:
 	//   fileutils.RemoveDir(tmpDir, r.Logger)
@@ -147,8 +655,61 @@ func (r *uploadRequest) doUpload(
 	//   r.storeFileAndMetadata(ctx, tmpDir, ...)
 	// before you return from doUpload else we will leak a temp file. We could make this nicer with a `WithTransaction` style of
 	// nested function to guarantee either storage or cleanup.
-	hash, bytesWritten, tmpDir, err := fileutils.WriteTempFile(ctx, reqReader, *cfg.MaxFileSizeBytes, cfg.AbsBasePath)
+	if *cfg.MaxFileSizeBytes > 0 {
+		reqReader = &uploadSizeLimiter{reader: reqReader, remaining: int64(*cfg.MaxFileSizeBytes)}
+	}
+	var meter *compressionMeter
+	if cfg.CompressibleUploads.Enabled {
+		meter = newCompressionMeter(reqReader, cfg.CompressibleUploads)
+		reqReader = meter
+	}
+	var scan *uploadScan
+	if uploadScanner != nil {
+		scan = startUploadScan(ctx, uploadScanner)
+		reqReader = io.TeeReader(reqReader, scan.pipe)
+	}
+	hash, bytesWritten, tmpDir, err := fileutils.WriteTempFile(ctx, reqReader, *cfg.MaxFileSizeBytes, cfg.AbsBasePath, cfg.FileWrites)
+	if err == nil && meter != nil {
+		if err = meter.finish(); err != nil {
+			fileutils.RemoveDir(tmpDir, r.Logger)
+		}
+	}
+	if scan != nil {
+		verdict, scanErr := scan.finish(err, cfg.UploadScanning.Timeout)
+		if err == nil {
+			if resErr := r.scanVerdictResponse(&cfg.UploadScanning, verdict, scanErr); resErr != nil {
+				fileutils.RemoveDir(tmpDir, r.Logger)
+				return resErr
+			}
+		}
+	}
 	if err != nil {
+		if err == errTooCompressible {
+			r.Logger.WithFields(log.Fields{
+				"CompressionRatio": meter.ratio,
+				"MaxFileSizeBytes": cfg.CompressibleUploads.MaxFileSizeBytes,
+			}).Warn("Rejecting upload which compresses too well for its size")
+			return &util.JSONResponse{
+				Code: http.StatusRequestEntityTooLarge,
+				JSON: jsonerror.TooLarge(fmt.Sprintf("The file compresses so well that it may be no larger than %v.", cfg.CompressibleUploads.MaxFileSizeBytes)),
+			}
+		}
+		if err == errFirstByteTimeout {
+			return r.firstByteTimeoutResponse(cfg.FirstByteTimeout)
+		}
+		if err == errMaxUploadDuration {
+			return r.maxUploadDurationResponse(cfg.MaxUploadDuration)
+		}
+		if err == errFileTooLarge {
+			r.Logger.WithField("MaxFileSizeBytes", *cfg.MaxFileSizeBytes).Warn("Rejecting upload which is larger than the maximum file size")
+			return &util.JSONResponse{
+				Code: http.StatusRequestEntityTooLarge,
+				JSON: jsonerror.TooLarge(fmt.Sprintf("The file is larger than the maximum allowed upload size (%v).", *cfg.MaxFileSizeBytes)),
+			}
+		}
+		if resErr := r.storageErrorResponse(err); resErr != nil {
+			return resErr
+		}
 		r.Logger.WithError(err).WithFields(log.Fields{
 			"MaxFileSizeBytes": *cfg.MaxFileSizeBytes,
 		}).Warn("Error while transferring file")
@@ -157,6 +718,133 @@ func (r *uploadRequest) doUpload(
 			JSON: jsonerror.Unknown("Failed to upload"),
 		}
 	}
+	if bytesWritten == 0 {
+		// Only possible without a Content-Length, otherwise Validate rejects it.
+		fileutils.RemoveDir(tmpDir, r.Logger)
+		return &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue("The uploaded file must not be empty."),
+		}
+	}
+
+	checkType := cfg.UploadTypeCheck == config.UploadTypeCheckCorrect || cfg.UploadTypeCheck == config.UploadTypeCheckReject
+	var head []byte
+	if checkType || len(cfg.BlockedUploadTypes) > 0 {
+		if head, err = readUploadHead(tmpDir); err != nil {
+			fileutils.RemoveDir(tmpDir, r.Logger)
+			r.Logger.WithError(err).Error("Failed to read uploaded file to check its type")
+			resErr := jsonerror.InternalServerError()
+			return &resErr
+		}
+	}
+
+	// Make sure the content type, and the extension of the name, say what the file
+	// really is, before anything else relies on them.
+	if checkType {
+		if mismatch := reconcileUploadType(r.MediaMetadata.ContentType, r.MediaMetadata.UploadName, head); mismatch != nil {
+			logger := r.Logger.WithFields(log.Fields{
+				"ContentType": r.MediaMetadata.ContentType,
+				"UploadName":  r.MediaMetadata.UploadName,
+				"SniffedType": mismatch.sniffedType,
+			})
+			if cfg.UploadTypeCheck == config.UploadTypeCheckReject {
+				fileutils.RemoveDir(tmpDir, r.Logger)
+				logger.Warn("Rejecting upload whose contents don't match its content type or name")
+				return &util.JSONResponse{
+					Code: http.StatusUnsupportedMediaType,
+					JSON: jsonerror.UnsupportedMediaType(fmt.Sprintf(
+						"Failed to upload: the file is %s, which doesn't match its content type or name", mismatch.sniffedType,
+					)),
+				}
+			}
+			logger.WithFields(log.Fields{
+				"CorrectedContentType": mismatch.contentType,
+				"CorrectedUploadName":  mismatch.uploadName,
+			}).Info("Corrected the content type and name of upload to match its contents")
+			r.MediaMetadata.ContentType = mismatch.contentType
+			r.MediaMetadata.UploadName = mismatch.uploadName
+		}
+	}
+
+	// Whatever the upload claims to be, some kinds of file are never served from here.
+	if dangerousType := sniffDangerousType(head); dangerousType != "" && cfg.IsBlockedUploadType(dangerousType) {
+		fileutils.RemoveDir(tmpDir, r.Logger)
+		r.Logger.WithFields(log.Fields{
+			"ContentType": r.MediaMetadata.ContentType,
+			"SniffedType": dangerousType,
+		}).Warn("Rejecting upload of a blocked type")
+		return &util.JSONResponse{
+			Code: http.StatusUnsupportedMediaType,
+			JSON: jsonerror.UnsupportedMediaType(fmt.Sprintf("Failed to upload: files of type %s may not be uploaded", dangerousType)),
+		}
+	}
+
+	// Images which can't be decoded would only fail later, when thumbnails are generated.
+	if cfg.ValidateImageUploads && thumbnailer.CanValidateImage(r.MediaMetadata.ContentType) {
+		if err = thumbnailer.ValidateImage(types.Path(filepath.Join(string(tmpDir), "content")), cfg.MaxImagePixels); err != nil {
+			fileutils.RemoveDir(tmpDir, r.Logger)
+			r.Logger.WithError(err).WithField("ContentType", r.MediaMetadata.ContentType).Warn("Rejecting image upload which can't be decoded")
+			return &util.JSONResponse{
+				Code: http.StatusUnsupportedMediaType,
+				JSON: jsonerror.UnsupportedMediaType(fmt.Sprintf("Failed to upload: the file isn't a valid %s image", r.MediaMetadata.ContentType)),
+			}
+		}
+	}
+
+	// SVG images can contain scripts, so sanitize them before they are stored.
+	// The hash and size are recomputed from the sanitized file.
+	if cfg.SanitizeSVGs && sanitizer.IsSVG(string(r.MediaMetadata.ContentType)) {
+		hash, bytesWritten, tmpDir, err = fileutils.ReplaceTempFile(
+			ctx, tmpDir, sanitizer.SanitizeSVG, *cfg.MaxFileSizeBytes, cfg.AbsBasePath, cfg.FileWrites,
+		)
+		if err != nil {
+			if resErr := r.storageErrorResponse(err); resErr != nil {
+				return resErr
+			}
+			r.Logger.WithError(err).Warn("Failed to sanitize SVG image")
+			return &util.JSONResponse{
+				Code: http.StatusUnsupportedMediaType,
+				JSON: jsonerror.UnsupportedMediaType("Failed to upload: invalid SVG image"),
+			}
+		}
+	}
+
+	// Strip EXIF and other metadata from photos, which can say where they were taken.
+	// This is done a segment at a time, so large images aren't read into memory.
+	if strip := sanitizer.MetadataStripper(string(r.MediaMetadata.ContentType)); cfg.StripImageMetadata && strip != nil {
+		hash, bytesWritten, tmpDir, err = fileutils.ReplaceTempFile(
+			ctx, tmpDir, strip, *cfg.MaxFileSizeBytes, cfg.AbsBasePath, cfg.FileWrites,
+		)
+		if err != nil {
+			if resErr := r.storageErrorResponse(err); resErr != nil {
+				return resErr
+			}
+			r.Logger.WithError(err).Warn("Failed to strip metadata from image")
+			return &util.JSONResponse{
+				Code: http.StatusUnsupportedMediaType,
+				JSON: jsonerror.UnsupportedMediaType("Failed to upload: invalid image"),
+			}
+		}
+	}
+
+	// Only the user's own media is reused, so that uploads don't give away what
+	// anyone else has uploaded.
+	if r.ReuseExisting {
+		ownMetadata, err := db.GetMediaMetadataByHashAndUser(ctx, hash, r.MediaMetadata.Origin, r.MediaMetadata.UserID)
+		if err != nil {
+			fileutils.RemoveDir(tmpDir, r.Logger)
+			r.Logger.WithError(err).Error("Error querying the database for the user's media by hash.")
+			resErr := jsonerror.InternalServerError()
+			return &resErr
+		}
+		if ownMetadata != nil {
+			fileutils.RemoveDir(tmpDir, r.Logger)
+			r.MediaMetadata = ownMetadata
+			r.Reused = true
+			r.Logger.WithField("media_id", ownMetadata.MediaID).Info("Reusing existing media with the same content")
+			return nil
+		}
+	}
 
 	// Look up the media by the file hash. If we already have the file but under a
 	// different media ID then we won't upload the file again - instead we'll just
@@ -173,12 +861,17 @@ func (r *uploadRequest) doUpload(
 	if existingMetadata != nil {
 		// The file already exists, delete the uploaded temporary file.
 		defer fileutils.RemoveDir(tmpDir, r.Logger)
-		// The file already exists. Make a new media ID up for it.
-		mediaID, merr := r.generateMediaID(ctx, db)
-		if merr != nil {
-			r.Logger.WithError(merr).Error("Failed to generate media ID for existing file")
-			resErr := jsonerror.InternalServerError()
-			return &resErr
+		// The file already exists. Make a new media ID up for it, unless
+		// we are uploading to a media ID which was reserved in advance.
+		mediaID := r.MediaMetadata.MediaID
+		if mediaID == "" {
+			var merr error
+			mediaID, merr = r.generateMediaID(ctx, cfg, db)
+			if merr != nil {
+				r.Logger.WithError(merr).Error("Failed to generate media ID for existing file")
+				resErr := jsonerror.InternalServerError()
+				return &resErr
+			}
 		}
 
 		// Then amend the upload metadata.
@@ -186,7 +879,7 @@ func (r *uploadRequest) doUpload(
 			MediaID:           mediaID,
 			Origin:            r.MediaMetadata.Origin,
 			ContentType:       r.MediaMetadata.ContentType,
-			FileSizeBytes:     r.MediaMetadata.FileSizeBytes,
+			FileSizeBytes:     bytesWritten,
 			CreationTimestamp: r.MediaMetadata.CreationTimestamp,
 			UploadName:        r.MediaMetadata.UploadName,
 			Base64Hash:        hash,
@@ -196,15 +889,21 @@ func (r *uploadRequest) doUpload(
 		// The file doesn't exist. Update the request metadata.
 		r.MediaMetadata.FileSizeBytes = bytesWritten
 		r.MediaMetadata.Base64Hash = hash
-		r.MediaMetadata.MediaID, err = r.generateMediaID(ctx, db)
-		if err != nil {
-			fileutils.RemoveDir(tmpDir, r.Logger)
-			r.Logger.WithError(err).Error("Failed to generate media ID for new upload")
-			resErr := jsonerror.InternalServerError()
-			return &resErr
+		if r.MediaMetadata.MediaID == "" {
+			r.MediaMetadata.MediaID, err = r.generateMediaID(ctx, cfg, db)
+			if err != nil {
+				fileutils.RemoveDir(tmpDir, r.Logger)
+				r.Logger.WithError(err).Error("Failed to generate media ID for new upload")
+				resErr := jsonerror.InternalServerError()
+				return &resErr
+			}
 		}
 	}
 
+	if cfg.DefaultUploadNames && r.MediaMetadata.UploadName == "" {
+		r.MediaMetadata.UploadName = defaultUploadName(r.MediaMetadata.MediaID, r.MediaMetadata.ContentType)
+	}
+
 	r.Logger = r.Logger.WithField("media_id", r.MediaMetadata.MediaID)
 	r.Logger.WithFields(log.Fields{
 		"Base64Hash":    r.MediaMetadata.Base64Hash,
@@ -213,37 +912,328 @@ func (r *uploadRequest) doUpload(
 		"ContentType":   r.MediaMetadata.ContentType,
 	}).Info("File uploaded")
 
-	return r.storeFileAndMetadata(
+	// Only a new file takes up more space.
+	if existingMetadata == nil {
+		if resErr := r.reserveStorage(ctx, db, cfg.MaxTotalStorageBytes); resErr != nil {
+			fileutils.RemoveDir(tmpDir, r.Logger)
+			return resErr
+		}
+	}
+	if resErr := r.storeFileAndMetadata(
 		ctx, tmpDir, cfg.AbsBasePath, db, cfg.ThumbnailSizes,
-		activeThumbnailGeneration, cfg.MaxThumbnailGenerators,
-	)
+		activeThumbnailGeneration, cfg.MaxThumbnailGenerators, cfg.MaxImagePixels, cfg.ThumbnailJPEGQuality, encryptionKey,
+	); resErr != nil {
+		return resErr
+	}
+	recordUploadTraffic(ctx, db, r.Logger, r.MediaMetadata.UserID, int64(r.MediaMetadata.FileSizeBytes))
+	return nil
+}
+
+// errFileTooLarge is returned by uploadSizeLimiter when there is more to read than the
+// maximum file size.
+var errFileTooLarge = fmt.Errorf("file is larger than the maximum allowed upload size")
+
+// uploadSizeLimiter reads an upload, failing with errFileTooLarge if it goes over the
+// maximum file size. Unlike io.LimitReader, which would quietly truncate the file, this
+// doesn't rely on the Content-Length having been checked before reading.
+type uploadSizeLimiter struct {
+	reader    io.Reader
+	remaining int64
+}
+
+func (l *uploadSizeLimiter) Read(p []byte) (n int, err error) {
+	if int64(len(p)) > l.remaining {
+		p = p[:l.remaining]
+	}
+	if len(p) > 0 {
+		n, err = l.reader.Read(p)
+		l.remaining -= int64(n)
+	}
+	if l.remaining == 0 && err == nil {
+		// Check for anything more straight away, which means that going over the
+		// limit is noticed even if the caller stops reading at the maximum size.
+		var extra [1]byte
+		var extraRead int
+		extraRead, err = io.ReadFull(l.reader, extra[:])
+		if extraRead > 0 {
+			err = errFileTooLarge
+		}
+	}
+	return n, err
+}
+
+// errFirstByteTimeout is returned by firstByteReader when nothing was read from the
+// upload before the first_byte_timeout.
+var errFirstByteTimeout = fmt.Errorf("no part of the upload arrived in time")
+
+// firstByteReader fails with errFirstByteTimeout if nothing can be read from an
+// upload before the timeout, so that a client can't hold the request open without
+// sending anything. Over HTTP/1 the timeout is a read deadline on the connection,
+// which is only known if the server recorded it with httputil.ConnContext, so there
+// is no timeout otherwise. Over HTTP/2 the body is closed instead, which ends the
+// read waiting on it. Once something has been read the timeout is removed and reads
+// go straight to the upload.
+type firstByteReader struct {
+	io.ReadCloser
+	conn net.Conn
+	// The read deadline to go back to once something has been read, which is the
+	// deadline of the request's context if it has one.
+	deadline time.Time
+	timer    *time.Timer
+	started  bool
+	// Set to 1 by the timer once it has closed the body.
+	closed int32
+	err    error
+}
+
+func newFirstByteReader(req *http.Request, timeout time.Duration) *firstByteReader {
+	f := &firstByteReader{ReadCloser: req.Body}
+	if req.ProtoMajor >= 2 {
+		f.timer = time.AfterFunc(timeout, func() {
+			atomic.StoreInt32(&f.closed, 1)
+			f.ReadCloser.Close() // nolint: errcheck
+		})
+	} else if conn := httputil.ConnFromContext(req.Context()); conn != nil {
+		readDeadline := time.Now().Add(timeout)
+		f.deadline, _ = req.Context().Deadline()
+		if !f.deadline.IsZero() && f.deadline.Before(readDeadline) {
+			readDeadline = f.deadline
+		}
+		if err := conn.SetReadDeadline(readDeadline); err == nil {
+			f.conn = conn
+		}
+	}
+	return f
+}
+
+func (f *firstByteReader) Read(p []byte) (int, error) {
+	if f.started {
+		return f.ReadCloser.Read(p)
+	}
+	if f.err != nil {
+		return 0, f.err
+	}
+	n, err := f.ReadCloser.Read(p)
+	if n == 0 && err != nil && f.expired(err) {
+		f.err = errFirstByteTimeout
+		return 0, f.err
+	}
+	if n > 0 || err != nil {
+		f.started = true
+		f.stop()
+	}
+	return n, err
+}
+
+// expired reports whether the read failed with err because of the timeout.
+func (f *firstByteReader) expired(err error) bool {
+	if f.timer != nil {
+		return atomic.LoadInt32(&f.closed) == 1
+	}
+	netErr, ok := err.(net.Error)
+	return ok && netErr.Timeout()
+}
+
+// stop removes the timeout. The server sets its own deadline when it reads the next
+// request on the connection, so the deadline isn't cleared once it has passed.
+func (f *firstByteReader) stop() {
+	if f.timer != nil {
+		f.timer.Stop()
+	}
+	if f.conn != nil && f.err == nil {
+		f.conn.SetReadDeadline(f.deadline) // nolint: errcheck
+	}
+	f.conn = nil
+}
+
+func (f *firstByteReader) Close() error {
+	f.stop()
+	return f.ReadCloser.Close()
+}
+
+func (f *firstByteReader) timedOut() bool {
+	return f.err == errFirstByteTimeout
+}
+
+func (r *uploadRequest) firstByteTimeoutResponse(timeout time.Duration) *util.JSONResponse {
+	r.Logger.WithField("FirstByteTimeout", timeout).Warn("Abandoning upload which sent nothing in time")
+	return &util.JSONResponse{
+		Code: http.StatusRequestTimeout,
+		JSON: jsonerror.UploadTimedOut(fmt.Sprintf("Failed to upload: no part of the file arrived within %v.", timeout)),
+	}
+}
+
+// errMaxUploadDuration is returned by uploadDurationReader when the upload hadn't
+// finished by the max_upload_duration.
+var errMaxUploadDuration = fmt.Errorf("the upload didn't finish in time")
+
+// withUploadDeadline returns the request with a context which is done once the upload
+// has taken maxDuration, unless it is 0, along with the function to release it.
+func withUploadDeadline(req *http.Request, maxDuration time.Duration) (*http.Request, context.CancelFunc) {
+	if maxDuration <= 0 {
+		return req, func() {}
+	}
+	ctx, cancel := context.WithTimeout(req.Context(), maxDuration)
+	return req.WithContext(ctx), cancel
+}
+
+// uploadDurationReader fails with errMaxUploadDuration once the deadline has passed,
+// however steadily the upload is arriving, so that a huge upload can't take as long as
+// it likes. A read waiting on the body is ended in the same way as by firstByteReader,
+// with a read deadline on the connection over HTTP/1 or by closing the body over HTTP/2,
+// but for the whole upload rather than only until something has been read.
+type uploadDurationReader struct {
+	io.ReadCloser
+	deadline time.Time
+	timer    *time.Timer
+}
+
+func newUploadDurationReader(req *http.Request, deadline time.Time) *uploadDurationReader {
+	u := &uploadDurationReader{ReadCloser: req.Body, deadline: deadline}
+	if req.ProtoMajor >= 2 {
+		body := req.Body
+		u.timer = time.AfterFunc(time.Until(deadline), func() {
+			body.Close() // nolint: errcheck
+		})
+	} else if conn := httputil.ConnFromContext(req.Context()); conn != nil {
+		conn.SetReadDeadline(deadline) // nolint: errcheck
+	}
+	return u
+}
+
+func (u *uploadDurationReader) Read(p []byte) (int, error) {
+	if !time.Now().Before(u.deadline) {
+		return 0, errMaxUploadDuration
+	}
+	n, err := u.ReadCloser.Read(p)
+	// The clock is checked rather than the error, which differs between HTTP/1 and 2.
+	if err != nil && err != io.EOF && !time.Now().Before(u.deadline) {
+		return n, errMaxUploadDuration
+	}
+	return n, err
+}
+
+func (u *uploadDurationReader) Close() error {
+	if u.timer != nil {
+		u.timer.Stop()
+	}
+	return u.ReadCloser.Close()
+}
+
+func (r *uploadRequest) maxUploadDurationResponse(maxDuration time.Duration) *util.JSONResponse {
+	r.Logger.WithField("MaxUploadDuration", maxDuration).Warn("Abandoning upload which took too long")
+	return &util.JSONResponse{
+		Code: http.StatusRequestTimeout,
+		JSON: jsonerror.UploadTimedOut(fmt.Sprintf("Failed to upload: the file didn't finish uploading within %v.", maxDuration)),
+	}
+}
+
+// errTooCompressible is returned by compressionMeter when an upload compresses too well
+// for its size.
+var errTooCompressible = fmt.Errorf("file compresses too well for its size")
+
+// compressionMeter compresses an upload as it is read, only to measure how well it
+// compresses, failing with errTooCompressible if it is larger than the limit for uploads
+// which compress at least as well as the minimum ratio. The compressed data is thrown
+// away, so the upload is stored and hashed as it was sent.
+type compressionMeter struct {
+	reader     io.Reader
+	limits     config.CompressibleUploads
+	compressor *flate.Writer
+	compressed byteCounter
+	read       int64
+	nextCheck  int64
+	// ratio is the size of the upload divided by its compressed size when it was last
+	// measured.
+	ratio float64
+}
+
+func newCompressionMeter(reader io.Reader, limits config.CompressibleUploads) *compressionMeter {
+	m := &compressionMeter{
+		reader:    reader,
+		limits:    limits,
+		nextCheck: int64(limits.MaxFileSizeBytes) + 1,
+	}
+	// The fastest level is plenty to notice content which compresses extremely well,
+	// and NewWriter only fails for an invalid level.
+	m.compressor, _ = flate.NewWriter(&m.compressed, flate.BestSpeed)
+	return m
+}
+
+func (m *compressionMeter) Read(p []byte) (n int, err error) {
+	n, err = m.reader.Read(p)
+	if n > 0 {
+		m.compressor.Write(p[:n]) // nolint: errcheck
+		m.read += int64(n)
+		// The compressor has to be flushed to see how far it has got, which makes it
+		// compress less well, so it is only checked each time another limit's worth
+		// of the upload has been read.
+		if m.read >= m.nextCheck {
+			m.nextCheck += int64(m.limits.MaxFileSizeBytes)
+			m.compressor.Flush() // nolint: errcheck
+			if m.tooCompressible() {
+				uploadCompressionRatio.Observe(m.ratio)
+				return n, errTooCompressible
+			}
+		}
+	}
+	return n, err
+}
+
+// finish measures how well the whole upload compressed once it has all been read,
+// returning errTooCompressible if it is over the limit.
+func (m *compressionMeter) finish() error {
+	m.compressor.Close() // nolint: errcheck
+	tooCompressible := m.tooCompressible()
+	uploadCompressionRatio.Observe(m.ratio)
+	if tooCompressible {
+		return errTooCompressible
+	}
+	return nil
+}
+
+func (m *compressionMeter) tooCompressible() bool {
+	if m.compressed > 0 {
+		m.ratio = float64(m.read) / float64(m.compressed)
+	}
+	return m.read > int64(m.limits.MaxFileSizeBytes) && m.ratio >= m.limits.MinRatio
+}
+
+// byteCounter is a writer which only counts how much is written to it.
+type byteCounter int64
+
+func (c *byteCounter) Write(p []byte) (int, error) {
+	*c += byteCounter(len(p))
+	return len(p), nil
 }
 
-// Validate validates the uploadRequest fields
+// Validate validates the uploadRequest fields. A negative FileSizeBytes means that the
+// Content-Length wasn't given, as for chunked uploads, in which case the size is only
+// checked as the file is read.
 func (r *uploadRequest) Validate(maxFileSizeBytes config.FileSizeBytes) *util.JSONResponse {
-	if r.MediaMetadata.FileSizeBytes < 1 {
+	if r.MediaMetadata.FileSizeBytes == 0 {
 		return &util.JSONResponse{
 			Code: http.StatusLengthRequired,
-			JSON: jsonerror.Unknown("HTTP Content-Length request header must be greater than zero."),
+			JSON: jsonerror.MissingArgument("HTTP Content-Length request header must be greater than zero."),
 		}
 	}
 	if maxFileSizeBytes > 0 && r.MediaMetadata.FileSizeBytes > types.FileSizeBytes(maxFileSizeBytes) {
 		return &util.JSONResponse{
 			Code: http.StatusRequestEntityTooLarge,
-			JSON: jsonerror.Unknown(fmt.Sprintf("HTTP Content-Length is greater than the maximum allowed upload size (%v).", maxFileSizeBytes)),
+			JSON: jsonerror.TooLarge(fmt.Sprintf("HTTP Content-Length is greater than the maximum allowed upload size (%v).", maxFileSizeBytes)),
 		}
 	}
 	// TODO: Check if the Content-Type is a valid type?
 	if r.MediaMetadata.ContentType == "" {
 		return &util.JSONResponse{
 			Code: http.StatusBadRequest,
-			JSON: jsonerror.Unknown("HTTP Content-Type request header must be set."),
+			JSON: jsonerror.MissingArgument("HTTP Content-Type request header must be set."),
 		}
 	}
 	if strings.HasPrefix(string(r.MediaMetadata.UploadName), "~") {
 		return &util.JSONResponse{
 			Code: http.StatusBadRequest,
-			JSON: jsonerror.Unknown("File name must not begin with '~'."),
+			JSON: jsonerror.InvalidArgumentValue("File name must not begin with '~'."),
 		}
 	}
 	// TODO: Validate filename - what are the valid characters?
@@ -263,6 +1253,25 @@ func (r *uploadRequest) Validate(maxFileSizeBytes config.FileSizeBytes) *util.JS
 	return nil
 }
 
+// storageErrorResponse returns an error response if err was caused by the media store
+// being full or not writable, so that this isn't reported as the client's fault.
+// Returns nil for any other error.
+func (r *uploadRequest) storageErrorResponse(err error) *util.JSONResponse {
+	reason := fileutils.StorageErrorReason(err)
+	if reason == "" {
+		return nil
+	}
+	storageErrors.WithLabelValues(reason).Inc()
+	r.Logger.WithError(err).WithField("reason", reason).Error("Media store is not writable")
+	if reason == fileutils.StorageErrorNoSpace {
+		return storageFullResponse()
+	}
+	return &util.JSONResponse{
+		Code: http.StatusServiceUnavailable,
+		JSON: jsonerror.Unavailable("The server is unable to store media at the moment."),
+	}
+}
+
 // storeFileAndMetadata moves the temporary file to its final path based on metadata and stores the metadata in the database
 // See getPathFromMediaMetadata in fileutils for details of the final path.
 // The order of operations is important as it avoids metadata entering the database before the file
@@ -276,45 +1285,122 @@ func (r *uploadRequest) storeFileAndMetadata(
 	thumbnailSizes []config.ThumbnailSize,
 	activeThumbnailGeneration *types.ActiveThumbnailGeneration,
 	maxThumbnailGenerators int,
+	maxImagePixels int64,
+	jpegQuality int,
+	encryptionKey *fileutils.EncryptionKey,
 ) *util.JSONResponse {
-	finalPath, duplicate, err := fileutils.MoveFileWithHashCheck(tmpDir, r.MediaMetadata, absBasePath, r.Logger)
+	finalPath, replaced, resErr := r.storeFileAndMetadataLocked(ctx, tmpDir, absBasePath, db, encryptionKey)
+	if resErr != nil {
+		return resErr
+	}
+	// This is only done once the new metadata is stored, so the old file is never
+	// removed for an upload which then fails.
+	if replaced != nil && replaced.Base64Hash != r.MediaMetadata.Base64Hash {
+		r.removeReplacedFile(ctx, db, replaced, absBasePath)
+	}
+
+	go func() {
+		busy, err := thumbnailer.GenerateThumbnails(
+			context.Background(), finalPath, thumbnailSizes, r.MediaMetadata,
+			activeThumbnailGeneration, maxThumbnailGenerators, maxImagePixels, jpegQuality, db, encryptionKey, r.Logger,
+		)
+		if err != nil {
+			r.Logger.WithError(err).Warn("Error generating thumbnails")
+		}
+		if busy {
+			r.Logger.Warn("Maximum number of active thumbnail generators reached. Skipping pre-generation.")
+		}
+	}()
+
+	return nil
+}
+
+// storeFileAndMetadataLocked moves the temporary file into place and stores the metadata
+// while holding the lock for the file's hash (see fileLocks). If the upload overwrites
+// existing media then the metadata is replaced in one transaction, and the metadata of
+// what it replaced is returned so that its file can be removed.
+func (r *uploadRequest) storeFileAndMetadataLocked(
+	ctx context.Context,
+	tmpDir types.Path,
+	absBasePath config.Path,
+	db storage.Database,
+	encryptionKey *fileutils.EncryptionKey,
+) (types.Path, *types.MediaMetadata, *util.JSONResponse) {
+	defer fileLocks.lock(r.MediaMetadata.Base64Hash)()
+
+	// The file may already be stored for other media, in which case how it is stored
+	// was recorded for them.
+	encryption, err := db.GetFileEncryption(ctx, r.MediaMetadata.Base64Hash)
+	if err != nil {
+		r.releaseStorage(ctx, db)
+		r.Logger.WithError(err).Error("Failed to look up stored file.")
+		return "", nil, &util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: jsonerror.Unknown("Failed to upload"),
+		}
+	}
+	r.MediaMetadata.Encryption = encryption
+	finalPath, duplicate, err := fileutils.MoveFileWithHashCheck(tmpDir, r.MediaMetadata, absBasePath, encryptionKey, r.Logger)
 	if err != nil {
+		r.releaseStorage(ctx, db)
+		if resErr := r.storageErrorResponse(err); resErr != nil {
+			return "", nil, resErr
+		}
 		r.Logger.WithError(err).Error("Failed to move file.")
-		return &util.JSONResponse{
+		return "", nil, &util.JSONResponse{
 			Code: http.StatusBadRequest,
 			JSON: jsonerror.Unknown("Failed to upload"),
 		}
 	}
 	if duplicate {
 		r.Logger.WithField("dst", finalPath).Info("File was stored previously - discarding duplicate")
+		r.releaseStorage(ctx, db)
 	}
 
-	if err = db.StoreMediaMetadata(ctx, r.MediaMetadata); err != nil {
+	var replaced *types.MediaMetadata
+	if r.Overwrite {
+		replaced, err = db.ReplaceMediaMetadata(ctx, r.MediaMetadata)
+	} else {
+		err = db.StoreMediaMetadata(ctx, r.MediaMetadata)
+	}
+	if err != nil {
 		r.Logger.WithError(err).Warn("Failed to store metadata")
+		r.releaseStorage(ctx, db)
 		// If the file is a duplicate (has the same hash as an existing file) then
 		// there is valid metadata in the database for that file. As such we only
 		// remove the file if it is not a duplicate.
 		if !duplicate {
 			fileutils.RemoveDir(types.Path(path.Dir(string(finalPath))), r.Logger)
 		}
-		return &util.JSONResponse{
+		return "", nil, &util.JSONResponse{
 			Code: http.StatusBadRequest,
 			JSON: jsonerror.Unknown("Failed to upload"),
 		}
 	}
 
-	go func() {
-		busy, err := thumbnailer.GenerateThumbnails(
-			context.Background(), finalPath, thumbnailSizes, r.MediaMetadata,
-			activeThumbnailGeneration, maxThumbnailGenerators, db, r.Logger,
-		)
-		if err != nil {
-			r.Logger.WithError(err).Warn("Error generating thumbnails")
-		}
-		if busy {
-			r.Logger.Warn("Maximum number of active thumbnail generators reached. Skipping pre-generation.")
-		}
-	}()
+	if replaced != nil {
+		r.Logger.WithField("Base64Hash", replaced.Base64Hash).Info("Overwrote existing media")
+	}
+	return finalPath, replaced, nil
+}
 
-	return nil
+// removeReplacedFile removes the file of media which was overwritten, along with its
+// thumbnails, unless other media uses the same file. Failures are only logged, as the
+// upload itself has succeeded and the file can be cleaned up later by reconciling.
+func (r *uploadRequest) removeReplacedFile(
+	ctx context.Context, db storage.Database, replaced *types.MediaMetadata, absBasePath config.Path,
+) {
+	logger := r.Logger.WithField("Base64Hash", replaced.Base64Hash)
+	defer fileLocks.lock(replaced.Base64Hash)()
+	count, err := db.CountMediaByHash(ctx, replaced.Base64Hash)
+	if err == nil && count == 0 {
+		var removed bool
+		removed, _, err = removeMediaFiles(replaced.Base64Hash, absBasePath, false)
+		if err == nil && removed {
+			addStoredBytes(ctx, db, logger, -int64(replaced.FileSizeBytes))
+		}
+	}
+	if err != nil {
+		logger.WithError(err).Warn("Failed to remove the file of overwritten media")
+	}
 }
@@ -0,0 +1,1226 @@
+package routing
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/internal/config"
+	"github.com/matrix-org/dendrite/internal/httputil"
+	"github.com/matrix-org/dendrite/mediaapi/fileutils"
+	"github.com/matrix-org/dendrite/mediaapi/types"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/util"
+)
+
+func TestUploadNameFromContentDisposition(t *testing.T) {
+	tests := []struct {
+		header string
+		want   types.Filename
+	}{
+		{``, ""},
+		{`attachment; filename="cat.png"`, "cat.png"},
+		{`inline; filename=cat.png`, "cat.png"},
+		{`attachment; filename*=utf-8''%E2%82%AC%20rates.txt`, "%E2%82%AC%20rates.txt"},
+		{`attachment; filename*=UTF-8''na%C3%AFve.txt; filename="naive.txt"`, "na%C3%AFve.txt"},
+		{`attachment; filename="../../etc/passwd"`, "passwd"},
+		{`attachment; filename="C:\\temp\\cat.png"`, "cat.png"},
+		{"attachment; filename=\"cat\x01.png\"", ""},
+		{`attachment`, ""},
+		{`form-data; name="file"; filename="cat.png"`, ""},
+		{`attachment; filename="unterminated`, ""},
+		{`; filename=cat.png`, ""},
+	}
+	for _, tt := range tests {
+		if got := uploadNameFromContentDisposition(tt.header); got != tt.want {
+			t.Errorf("uploadNameFromContentDisposition(%q) = %q, want %q", tt.header, got, tt.want)
+		}
+	}
+}
+
+func TestParseAndValidateRequestUploadName(t *testing.T) {
+	maxFileSizeBytes := config.FileSizeBytes(1024)
+	cfg := &config.MediaAPI{
+		Matrix:           &config.Global{ServerName: "localhost"},
+		MaxFileSizeBytes: &maxFileSizeBytes,
+	}
+	dev := &userapi.Device{UserID: "@alice:localhost"}
+
+	tests := []struct {
+		url         string
+		disposition string
+		want        types.Filename
+	}{
+		{"/upload", `attachment; filename*=utf-8''%F0%9F%90%88.png`, "%F0%9F%90%88.png"},
+		{"/upload?filename=query.png", `attachment; filename="header.png"`, "query.png"},
+		{"/upload", `attachment; filename="bad`, ""},
+		// é composed as one code point and decomposed into e and an accent are
+		// stored the same.
+		{"/upload?filename=caf%C3%A9.png", "", "caf%C3%A9.png"},
+		{"/upload?filename=cafe%CC%81.png", "", "caf%C3%A9.png"},
+		{"/upload", `attachment; filename*=utf-8''cafe%CC%81.png`, "caf%C3%A9.png"},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("POST", tt.url, strings.NewReader("data"))
+		req.Header.Set("Content-Type", "image/png")
+		req.Header.Set("Content-Disposition", tt.disposition)
+		r, _, resErr := parseAndValidateRequest(req, cfg, dev)
+		if resErr != nil {
+			t.Errorf("%s with %q: unexpected error response %+v", tt.url, tt.disposition, resErr)
+			continue
+		}
+		if r.MediaMetadata.UploadName != tt.want {
+			t.Errorf("%s with %q: got upload name %q, want %q", tt.url, tt.disposition, r.MediaMetadata.UploadName, tt.want)
+		}
+	}
+}
+
+func TestParseAndValidateRequestMultipart(t *testing.T) {
+	maxFileSizeBytes := config.FileSizeBytes(1024)
+	cfg := &config.MediaAPI{
+		Matrix:           &config.Global{ServerName: "localhost"},
+		MaxFileSizeBytes: &maxFileSizeBytes,
+	}
+	dev := &userapi.Device{UserID: "@alice:localhost"}
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	if err := mw.WriteField("description", "a cat"); err != nil {
+		t.Fatal(err)
+	}
+	header := textproto.MIMEHeader{}
+	header.Set("Content-Disposition", `form-data; name="file"; filename="cat.png"`)
+	header.Set("Content-Type", "image/png")
+	part, err := mw.CreatePart(header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = part.Write([]byte("meow")); err != nil {
+		t.Fatal(err)
+	}
+	if err = mw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest("POST", "/upload", bytes.NewReader(body.Bytes()))
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	r, reqReader, resErr := parseAndValidateRequest(req, cfg, dev)
+	if resErr != nil {
+		t.Fatalf("unexpected error response %+v", resErr)
+	}
+	if r.MediaMetadata.ContentType != "image/png" {
+		t.Errorf("got content type %q, want image/png", r.MediaMetadata.ContentType)
+	}
+	if r.MediaMetadata.UploadName != "cat.png" {
+		t.Errorf("got upload name %q, want cat.png", r.MediaMetadata.UploadName)
+	}
+	data, err := ioutil.ReadAll(reqReader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "meow" {
+		t.Errorf("got file data %q, want meow", data)
+	}
+
+	// A form without any file in it should be rejected.
+	body.Reset()
+	mw = multipart.NewWriter(&body)
+	if err = mw.WriteField("description", "no cat"); err != nil {
+		t.Fatal(err)
+	}
+	if err = mw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	req = httptest.NewRequest("POST", "/upload", bytes.NewReader(body.Bytes()))
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	if _, _, resErr = parseAndValidateRequest(req, cfg, dev); resErr == nil || resErr.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for multipart upload without a file, got %+v", resErr)
+	} else if matrixErr, ok := resErr.JSON.(*jsonerror.MatrixError); !ok || matrixErr.ErrCode != "M_MISSING_ARGUMENT" {
+		t.Errorf("multipart upload without a file: got %+v, want M_MISSING_ARGUMENT", resErr.JSON)
+	}
+
+	// As should a body which isn't actually multipart.
+	req = httptest.NewRequest("POST", "/upload", strings.NewReader("meow"))
+	req.Header.Set("Content-Type", "multipart/form-data")
+	if _, _, resErr = parseAndValidateRequest(req, cfg, dev); resErr == nil || resErr.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for invalid multipart upload, got %+v", resErr)
+	} else if matrixErr, ok := resErr.JSON.(*jsonerror.MatrixError); !ok || matrixErr.ErrCode != "M_INVALID_ARGUMENT_VALUE" {
+		t.Errorf("invalid multipart upload: got %+v, want M_INVALID_ARGUMENT_VALUE", resErr.JSON)
+	}
+}
+
+func TestParseAndValidateRequestDefaultContentType(t *testing.T) {
+	maxFileSizeBytes := config.FileSizeBytes(1024)
+	cfg := &config.MediaAPI{
+		Matrix:           &config.Global{ServerName: "localhost"},
+		MaxFileSizeBytes: &maxFileSizeBytes,
+	}
+	dev := &userapi.Device{UserID: "@alice:localhost"}
+
+	req := httptest.NewRequest("POST", "/upload", strings.NewReader("data"))
+	if _, _, resErr := parseAndValidateRequest(req, cfg, dev); resErr == nil || resErr.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for upload without a content type, got %+v", resErr)
+	}
+
+	cfg.DefaultContentType = "application/octet-stream"
+	req = httptest.NewRequest("POST", "/upload", strings.NewReader("data"))
+	r, _, resErr := parseAndValidateRequest(req, cfg, dev)
+	if resErr != nil {
+		t.Fatalf("unexpected error response %+v", resErr)
+	}
+	if r.MediaMetadata.ContentType != "application/octet-stream" {
+		t.Errorf("got content type %q, want application/octet-stream", r.MediaMetadata.ContentType)
+	}
+
+	req = httptest.NewRequest("POST", "/upload", strings.NewReader("data"))
+	req.Header.Set("Content-Type", "image/png")
+	if r, _, resErr = parseAndValidateRequest(req, cfg, dev); resErr != nil {
+		t.Fatalf("unexpected error response %+v", resErr)
+	}
+	if r.MediaMetadata.ContentType != "image/png" {
+		t.Errorf("got content type %q, want image/png", r.MediaMetadata.ContentType)
+	}
+}
+
+// diskFullReader returns some data and then fails as if the disk filled up.
+type diskFullReader struct {
+	sent bool
+}
+
+func (d *diskFullReader) Read(p []byte) (int, error) {
+	if !d.sent {
+		d.sent = true
+		return copy(p, "partial"), nil
+	}
+	return 0, &os.PathError{Op: "write", Path: "content", Err: syscall.ENOSPC}
+}
+
+func TestDoUploadDiskFull(t *testing.T) {
+	basePath, err := ioutil.TempDir("", "mediaapi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(basePath) // nolint: errcheck
+	maxFileSizeBytes := config.FileSizeBytes(1024)
+	cfg := &config.MediaAPI{
+		Matrix:           &config.Global{ServerName: "localhost"},
+		MaxFileSizeBytes: &maxFileSizeBytes,
+		AbsBasePath:      config.Path(basePath),
+	}
+	r := &uploadRequest{
+		MediaMetadata: &types.MediaMetadata{
+			Origin:        "localhost",
+			FileSizeBytes: 100,
+			ContentType:   "text/plain",
+		},
+		Logger: util.GetLogger(context.Background()),
+	}
+
+	resErr := r.doUpload(context.Background(), &diskFullReader{}, cfg, nil, nil, nil, nil)
+	if resErr == nil || resErr.Code != http.StatusInsufficientStorage {
+		t.Fatalf("expected 507 response, got %+v", resErr)
+	}
+	if matrixErr, ok := resErr.JSON.(*jsonerror.MatrixError); !ok || matrixErr.ErrCode != "M_INSUFFICIENT_STORAGE" {
+		t.Errorf("got %+v, want M_INSUFFICIENT_STORAGE", resErr.JSON)
+	}
+	entries, err := ioutil.ReadDir(filepath.Join(string(cfg.AbsBasePath), "tmp"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("expected partial upload to be removed, found %d temporary directories", len(entries))
+	}
+}
+
+func TestStorageErrorResponse(t *testing.T) {
+	r := &uploadRequest{Logger: util.GetLogger(context.Background())}
+	for _, tt := range []struct {
+		err         error
+		wantCode    int
+		wantErrCode string
+	}{
+		{&os.PathError{Op: "write", Path: "content", Err: syscall.ENOSPC}, http.StatusInsufficientStorage, "M_INSUFFICIENT_STORAGE"},
+		{&os.PathError{Op: "open", Path: "content", Err: syscall.EROFS}, http.StatusServiceUnavailable, "M_UNAVAILABLE"},
+		{&os.PathError{Op: "mkdir", Path: "tmp", Err: syscall.EACCES}, http.StatusServiceUnavailable, "M_UNAVAILABLE"},
+	} {
+		resErr := r.storageErrorResponse(tt.err)
+		if resErr == nil || resErr.Code != tt.wantCode {
+			t.Errorf("%v: got %+v, want status %d", tt.err, resErr, tt.wantCode)
+			continue
+		}
+		if matrixErr, ok := resErr.JSON.(*jsonerror.MatrixError); !ok || matrixErr.ErrCode != tt.wantErrCode {
+			t.Errorf("%v: got %+v, want %s", tt.err, resErr.JSON, tt.wantErrCode)
+		}
+	}
+	if resErr := r.storageErrorResponse(errors.New("connection reset")); resErr != nil {
+		t.Errorf("error not caused by the media store: got %+v, want nil", resErr)
+	}
+}
+
+func TestNormalizeContentType(t *testing.T) {
+	tests := []struct {
+		contentType string
+		want        types.ContentType
+		wantErr     bool
+	}{
+		{"image/png", "image/png", false},
+		{"IMAGE/PNG", "image/png", false},
+		{"text/plain; charset=UTF-8", "text/plain; charset=utf-8", false},
+		{"text/plain;charset=\"us-ascii\"", "text/plain; charset=us-ascii", false},
+		{"image/png; name=evil.html", "image/png", false},
+		{"text/plain; boundary=something; foo=bar", "text/plain", false},
+		{"application/octet-stream; Charset=utf-8; x=y", "application/octet-stream; charset=utf-8", false},
+		{"text/html; charset=utf-7", "", true},
+		{"text/html; charset=UTF-7", "", true},
+		{"text/plain; charset=", "", true},
+		{"text/plain; charset=utf-8; charset=utf-7", "", true},
+		{"text/plain; charset", "", true},
+		{"text/plain;;", "", true},
+		{"text", "", true},
+		{"text/", "", true},
+		{"/plain", "", true},
+		{"text/plain<script>", "", true},
+		{"text/plain\r\nX-Evil: yes", "", true},
+	}
+	for _, tt := range tests {
+		got, err := normalizeContentType(tt.contentType)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("%q: expected an error, got %q", tt.contentType, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: unexpected error %v", tt.contentType, err)
+		} else if got != tt.want {
+			t.Errorf("%q: got %q, want %q", tt.contentType, got, tt.want)
+		}
+	}
+}
+
+func TestParseAndValidateRequestContentType(t *testing.T) {
+	maxFileSizeBytes := config.FileSizeBytes(1024)
+	cfg := &config.MediaAPI{
+		Matrix:           &config.Global{ServerName: "localhost"},
+		MaxFileSizeBytes: &maxFileSizeBytes,
+	}
+	dev := &userapi.Device{UserID: "@alice:localhost"}
+
+	req := httptest.NewRequest("POST", "/upload", strings.NewReader("data"))
+	req.Header.Set("Content-Type", "text/plain; charset=UTF-8; name=x.html")
+	r, _, resErr := parseAndValidateRequest(req, cfg, dev)
+	if resErr != nil {
+		t.Fatalf("unexpected error response %+v", resErr)
+	}
+	if r.MediaMetadata.ContentType != "text/plain; charset=utf-8" {
+		t.Errorf("got content type %q, want %q", r.MediaMetadata.ContentType, "text/plain; charset=utf-8")
+	}
+
+	for _, contentType := range []string{"text/html; charset=utf-7", "text/plain; ===", "not a content type"} {
+		req = httptest.NewRequest("POST", "/upload", strings.NewReader("data"))
+		req.Header.Set("Content-Type", contentType)
+		if _, _, resErr = parseAndValidateRequest(req, cfg, dev); resErr == nil || resErr.Code != http.StatusBadRequest {
+			t.Errorf("%q: expected 400, got %+v", contentType, resErr)
+		}
+	}
+}
+
+func TestUploadChunkedTooLarge(t *testing.T) {
+	basePath, err := ioutil.TempDir("", "mediaapi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(basePath) // nolint: errcheck
+	maxFileSizeBytes := config.FileSizeBytes(1024)
+	cfg := &config.MediaAPI{
+		Matrix:           &config.Global{ServerName: "localhost"},
+		MaxFileSizeBytes: &maxFileSizeBytes,
+		AbsBasePath:      config.Path(basePath),
+	}
+	dev := &userapi.Device{UserID: "@alice:localhost"}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		r, reqReader, resErr := parseAndValidateRequest(req, cfg, dev)
+		if resErr == nil {
+			resErr = r.doUpload(req.Context(), reqReader, cfg, nil, nil, nil, nil)
+		}
+		if resErr == nil {
+			t.Error("expected the upload to fail")
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		w.WriteHeader(resErr.Code)
+		_ = json.NewEncoder(w).Encode(resErr.JSON)
+	}))
+	defer server.Close()
+
+	// Send more than the maximum file size without a Content-Length.
+	req, err := http.NewRequest(http.MethodPost, server.URL, ioutil.NopCloser(bytes.NewReader(make([]byte, 4096))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.TransferEncoding = []string{"chunked"}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close() // nolint: errcheck
+
+	if resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Fatalf("got status %d, want %d", resp.StatusCode, http.StatusRequestEntityTooLarge)
+	}
+	var body jsonerror.MatrixError
+	if err = json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	if body.ErrCode != "M_TOO_LARGE" {
+		t.Errorf("got errcode %q, want M_TOO_LARGE", body.ErrCode)
+	}
+	entries, err := ioutil.ReadDir(filepath.Join(basePath, "tmp"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("expected the partial upload to be removed, found %d temporary directories", len(entries))
+	}
+}
+
+func TestUploadConcurrentIdentical(t *testing.T) {
+	db, basePath, cleanup := newTestDatabase(t)
+	defer cleanup()
+	maxFileSizeBytes := config.FileSizeBytes(1024 * 1024)
+	cfg := &config.MediaAPI{
+		Matrix:             &config.Global{ServerName: "localhost"},
+		MaxFileSizeBytes:   &maxFileSizeBytes,
+		AbsBasePath:        basePath,
+		DefaultContentType: "application/octet-stream",
+	}
+	dev := &userapi.Device{UserID: "@alice:localhost"}
+	content := make([]byte, 64*1024)
+	if _, err := rand.Read(content); err != nil {
+		t.Fatal(err)
+	}
+
+	const uploads = 20
+	results := make(chan *types.MediaMetadata, uploads)
+	errs := make(chan error, uploads)
+	for i := 0; i < uploads; i++ {
+		go func() {
+			req := httptest.NewRequest(http.MethodPost, "/upload", bytes.NewReader(content))
+			req.Header.Set("Content-Type", "application/octet-stream")
+			r, reqReader, resErr := parseAndValidateRequest(req, cfg, dev)
+			if resErr == nil {
+				resErr = r.doUpload(req.Context(), reqReader, cfg, db, nil, nil, nil)
+			}
+			if resErr != nil {
+				errs <- fmt.Errorf("got status %d: %+v", resErr.Code, resErr.JSON)
+				return
+			}
+			results <- r.MediaMetadata
+		}()
+	}
+	var hash types.Base64Hash
+	for i := 0; i < uploads; i++ {
+		select {
+		case err := <-errs:
+			t.Fatal(err)
+		case mediaMetadata := <-results:
+			if hash != "" && mediaMetadata.Base64Hash != hash {
+				t.Fatalf("got hash %q, want %q like the other uploads", mediaMetadata.Base64Hash, hash)
+			}
+			hash = mediaMetadata.Base64Hash
+		}
+	}
+
+	media, err := db.GetMediaByUser(context.Background(), "@alice:localhost", "localhost", "", uploads+1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(media) != uploads {
+		t.Errorf("got %d media stored, want %d", len(media), uploads)
+	}
+	filePath, err := fileutils.GetPathFromBase64Hash(hash, cfg.AbsBasePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(stored, content) {
+		t.Errorf("stored file of %d bytes isn't the %d bytes uploaded", len(stored), len(content))
+	}
+	if total, err := db.GetStoredBytes(context.Background()); err != nil {
+		t.Fatal(err)
+	} else if total != int64(len(content)) {
+		t.Errorf("got %d bytes stored in total, want the file counted once (%d)", total, len(content))
+	}
+	entries, err := ioutil.ReadDir(filepath.Join(string(basePath), "tmp"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("found %d temporary directories left behind", len(entries))
+	}
+}
+
+func TestUploadChunked(t *testing.T) {
+	db, basePath, cleanup := newTestDatabase(t)
+	defer cleanup()
+	maxFileSizeBytes := config.FileSizeBytes(1024)
+	cfg := &config.MediaAPI{
+		Matrix:             &config.Global{ServerName: "localhost"},
+		MaxFileSizeBytes:   &maxFileSizeBytes,
+		AbsBasePath:        basePath,
+		DefaultContentType: "application/octet-stream",
+	}
+	dev := &userapi.Device{UserID: "@alice:localhost"}
+
+	uploaded := make(chan *types.MediaMetadata, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		r, reqReader, resErr := parseAndValidateRequest(req, cfg, dev)
+		if resErr == nil {
+			resErr = r.doUpload(req.Context(), reqReader, cfg, db, nil, nil, nil)
+		}
+		if resErr != nil {
+			w.WriteHeader(resErr.Code)
+			_ = json.NewEncoder(w).Encode(resErr.JSON)
+			return
+		}
+		uploaded <- r.MediaMetadata
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	for _, tt := range []struct {
+		name     string
+		size     int
+		wantCode int
+	}{
+		{"one byte", 1, http.StatusOK},
+		{"several chunks", 1000, http.StatusOK},
+		{"largest allowed", 1024, http.StatusOK},
+		{"too large", 1025, http.StatusRequestEntityTooLarge},
+		{"empty", 0, http.StatusBadRequest},
+	} {
+		// The body is wrapped so that its length can't be found and sent as a
+		// Content-Length, and it is sent in chunks.
+		content := make([]byte, tt.size)
+		if _, err := rand.Read(content); err != nil {
+			t.Fatal(err)
+		}
+		req, err := http.NewRequest(http.MethodPost, server.URL, ioutil.NopCloser(bytes.NewReader(content)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.TransferEncoding = []string{"chunked"}
+		req.Header.Set("Content-Type", "application/octet-stream")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close() // nolint: errcheck
+		if resp.StatusCode != tt.wantCode {
+			t.Errorf("%s: got status %d, want %d", tt.name, resp.StatusCode, tt.wantCode)
+			continue
+		}
+		if tt.wantCode != http.StatusOK {
+			continue
+		}
+
+		// The size is the number of bytes actually uploaded.
+		metadata := <-uploaded
+		if metadata.FileSizeBytes != types.FileSizeBytes(tt.size) {
+			t.Errorf("%s: upload has size %d, want %d", tt.name, metadata.FileSizeBytes, tt.size)
+		}
+		stored, err := db.GetMediaMetadata(context.Background(), metadata.MediaID, "localhost")
+		if err != nil || stored == nil {
+			t.Fatalf("%s: upload wasn't stored: %v", tt.name, err)
+		}
+		if stored.FileSizeBytes != types.FileSizeBytes(tt.size) {
+			t.Errorf("%s: stored size is %d, want %d", tt.name, stored.FileSizeBytes, tt.size)
+		}
+	}
+
+	// A chunked upload isn't taken to be empty because it has no Content-Length,
+	// or even one of 0.
+	for _, contentLength := range []int64{-1, 0} {
+		req := httptest.NewRequest(http.MethodPost, "/upload", strings.NewReader("data"))
+		req.ContentLength = contentLength
+		req.TransferEncoding = []string{"chunked"}
+		r, _, resErr := parseAndValidateRequest(req, cfg, dev)
+		if resErr != nil {
+			t.Errorf("Content-Length %d: unexpected error response %+v", contentLength, resErr)
+		} else if r.MediaMetadata.FileSizeBytes != -1 {
+			t.Errorf("Content-Length %d: got size %d, want -1 for unknown", contentLength, r.MediaMetadata.FileSizeBytes)
+		}
+	}
+	// Without chunked encoding a missing body is still rejected up front.
+	req := httptest.NewRequest(http.MethodPost, "/upload", nil)
+	req.ContentLength = 0
+	if _, _, resErr := parseAndValidateRequest(req, cfg, dev); resErr == nil || resErr.Code != http.StatusLengthRequired {
+		t.Errorf("empty request: got %+v, want status %d", resErr, http.StatusLengthRequired)
+	}
+}
+
+func TestUploadFirstByteTimeout(t *testing.T) {
+	basePath, err := ioutil.TempDir("", "mediaapi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(basePath) // nolint: errcheck
+	maxFileSizeBytes := config.FileSizeBytes(1024)
+	cfg := &config.MediaAPI{
+		Matrix:           &config.Global{ServerName: "localhost"},
+		MaxFileSizeBytes: &maxFileSizeBytes,
+		AbsBasePath:      config.Path(basePath),
+		FirstByteTimeout: time.Millisecond * 100,
+	}
+	dev := &userapi.Device{UserID: "@alice:localhost"}
+	goroutines := runtime.NumGoroutine()
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		r, reqReader, resErr := parseAndValidateRequest(req, cfg, dev)
+		if resErr == nil {
+			resErr = r.doUpload(req.Context(), reqReader, cfg, nil, nil, nil, nil)
+		}
+		if resErr == nil {
+			t.Error("expected the upload to fail")
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		w.WriteHeader(resErr.Code)
+		_ = json.NewEncoder(w).Encode(resErr.JSON)
+	}))
+	server.Config.ConnContext = httputil.ConnContext
+	server.Start()
+	client := &http.Client{Transport: &http.Transport{}}
+
+	for _, contentType := range []string{"application/octet-stream", "multipart/form-data; boundary=cat"} {
+		// The upload never sends anything until the response has come back.
+		bodyReader, bodyWriter := io.Pipe()
+		req, err := http.NewRequest(http.MethodPost, server.URL, bodyReader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", contentType)
+		resp, err := client.Do(req)
+		bodyWriter.Close() // nolint: errcheck
+		if err != nil {
+			t.Fatal(err)
+		}
+		var body jsonerror.MatrixError
+		_ = json.NewDecoder(resp.Body).Decode(&body)
+		resp.Body.Close() // nolint: errcheck
+		if resp.StatusCode != http.StatusRequestTimeout || body.ErrCode != "M_UPLOAD_TIMED_OUT" {
+			t.Errorf("%s: got status %d %q, want %d M_UPLOAD_TIMED_OUT", contentType, resp.StatusCode, body.ErrCode, http.StatusRequestTimeout)
+		}
+	}
+	entries, err := ioutil.ReadDir(filepath.Join(basePath, "tmp"))
+	if err != nil && !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("expected the abandoned upload to be removed, found %d temporary directories", len(entries))
+	}
+
+	// Nothing should be left reading the abandoned uploads.
+	server.Close()
+	client.CloseIdleConnections()
+	deadline := time.Now().Add(time.Second * 5)
+	for runtime.NumGoroutine() > goroutines && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond * 10)
+	}
+	if got := runtime.NumGoroutine(); got > goroutines {
+		t.Errorf("%d goroutines were left over after the uploads timed out", got-goroutines)
+	}
+}
+
+func TestFirstByteReader(t *testing.T) {
+	// Only the first byte has to arrive in time, after which the deadline is removed.
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body := newFirstByteReader(req, time.Millisecond*50)
+		got, err := ioutil.ReadAll(body)
+		body.Close() // nolint: errcheck
+		if err != nil || string(got) != "first and second" {
+			t.Errorf("slow upload: got %q and error %v, want the whole upload", got, err)
+		}
+	}))
+	server.Config.ConnContext = httputil.ConnContext
+	server.Start()
+	defer server.Close()
+	bodyReader, bodyWriter := io.Pipe()
+	go func() {
+		bodyWriter.Write([]byte("first")) // nolint: errcheck
+		time.Sleep(time.Millisecond * 100)
+		bodyWriter.Write([]byte(" and second")) // nolint: errcheck
+		bodyWriter.Close()                      // nolint: errcheck
+	}()
+	resp, err := http.Post(server.URL, "text/plain", bodyReader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close() // nolint: errcheck
+
+	// HTTP/2 bodies are closed instead, which has to end the read waiting on them.
+	silentReader, silentWriter := io.Pipe()
+	defer silentWriter.Close() // nolint: errcheck
+	req := httptest.NewRequest(http.MethodPost, "/upload", silentReader)
+	req.ProtoMajor = 2
+	reader := newFirstByteReader(req, time.Millisecond*50)
+	for i := 0; i < 2; i++ {
+		if _, err = reader.Read(make([]byte, 8)); err != errFirstByteTimeout {
+			t.Errorf("read %d of a silent upload: got error %v, want %v", i, err, errFirstByteTimeout)
+		}
+	}
+	if !reader.timedOut() {
+		t.Error("the silent upload didn't time out")
+	}
+	if err = reader.Close(); err != nil {
+		t.Errorf("closing a silent upload: got error %v", err)
+	}
+}
+
+func TestUploadMaxDuration(t *testing.T) {
+	db, basePath, cleanup := newTestDatabase(t)
+	defer cleanup()
+	maxFileSizeBytes := config.FileSizeBytes(1024 * 1024)
+	cfg := &config.MediaAPI{
+		Matrix:             &config.Global{ServerName: "localhost"},
+		MaxFileSizeBytes:   &maxFileSizeBytes,
+		AbsBasePath:        basePath,
+		DefaultContentType: "application/octet-stream",
+		FirstByteTimeout:   time.Millisecond * 100,
+		MaxUploadDuration:  time.Millisecond * 300,
+	}
+	dev := &userapi.Device{UserID: "@alice:localhost"}
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		req, cancel := withUploadDeadline(req, cfg.MaxUploadDuration)
+		defer cancel()
+		r, reqReader, resErr := parseAndValidateRequest(req, cfg, dev)
+		if resErr == nil {
+			resErr = r.doUpload(req.Context(), reqReader, cfg, db, nil, nil, nil)
+		}
+		if resErr != nil {
+			w.WriteHeader(resErr.Code)
+			_ = json.NewEncoder(w).Encode(resErr.JSON)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	server.Config.ConnContext = httputil.ConnContext
+	server.Start()
+	defer server.Close()
+	client := &http.Client{Transport: &http.Transport{}}
+	defer client.CloseIdleConnections()
+
+	// upload sends a byte every interval until the response comes back, or count
+	// bytes if count isn't 0.
+	upload := func(interval time.Duration, count int) (int, jsonerror.MatrixError) {
+		bodyReader, bodyWriter := io.Pipe()
+		done := make(chan struct{})
+		go func() {
+			defer bodyWriter.Close() // nolint: errcheck
+			for i := 0; count == 0 || i < count; i++ {
+				select {
+				case <-done:
+					return
+				case <-time.After(interval):
+				}
+				if _, err := bodyWriter.Write([]byte("a")); err != nil {
+					return
+				}
+			}
+		}()
+		defer close(done)
+		req, err := http.NewRequest(http.MethodPost, server.URL, bodyReader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/octet-stream")
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close() // nolint: errcheck
+		var body jsonerror.MatrixError
+		_ = json.NewDecoder(resp.Body).Decode(&body)
+		return resp.StatusCode, body
+	}
+
+	// A steady upload which never pauses for as long as the first byte timeout is
+	// still abandoned once it has taken too long.
+	if code, body := upload(time.Millisecond*20, 0); code != http.StatusRequestTimeout || body.ErrCode != "M_UPLOAD_TIMED_OUT" || !strings.Contains(body.Err, "didn't finish uploading") {
+		t.Errorf("steady upload: got status %d %+v, want %d M_UPLOAD_TIMED_OUT for taking too long", code, body, http.StatusRequestTimeout)
+	}
+	// The two timeouts are told apart.
+	if code, body := upload(time.Second, 1); code != http.StatusRequestTimeout || body.ErrCode != "M_UPLOAD_TIMED_OUT" || !strings.Contains(body.Err, "no part of the file arrived") {
+		t.Errorf("silent upload: got status %d %+v, want %d M_UPLOAD_TIMED_OUT for sending nothing", code, body, http.StatusRequestTimeout)
+	}
+	// An upload which finishes in time is unaffected, even once it has started.
+	if code, body := upload(time.Millisecond*20, 5); code != http.StatusOK {
+		t.Errorf("quick upload: got status %d %+v, want %d", code, body, http.StatusOK)
+	}
+
+	entries, err := ioutil.ReadDir(filepath.Join(string(basePath), "tmp"))
+	if err != nil && !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("expected the abandoned uploads to be removed, found %d temporary directories", len(entries))
+	}
+
+	// HTTP/2 bodies are closed instead, which has to end the read waiting on them.
+	silentReader, silentWriter := io.Pipe()
+	defer silentWriter.Close() // nolint: errcheck
+	req := httptest.NewRequest(http.MethodPost, "/upload", silentReader)
+	req.ProtoMajor = 2
+	reader := newUploadDurationReader(req, time.Now().Add(time.Millisecond*50))
+	for i := 0; i < 2; i++ {
+		if _, err = reader.Read(make([]byte, 8)); err != errMaxUploadDuration {
+			t.Errorf("read %d of a slow upload: got error %v, want %v", i, err, errMaxUploadDuration)
+		}
+	}
+	if err = reader.Close(); err != nil {
+		t.Errorf("closing a slow upload: got error %v", err)
+	}
+}
+
+func TestUploadSizeLimiter(t *testing.T) {
+	for _, tt := range []struct {
+		size    int
+		wantErr error
+	}{
+		{1023, nil},
+		{1024, nil},
+		{1025, errFileTooLarge},
+	} {
+		limiter := &uploadSizeLimiter{reader: bytes.NewReader(make([]byte, tt.size)), remaining: 1024}
+		// Read in the same way as WriteTempFile, which stops at the maximum size.
+		got, err := ioutil.ReadAll(io.LimitReader(limiter, 1024))
+		if err != tt.wantErr {
+			t.Errorf("%d bytes: got error %v, want %v", tt.size, err, tt.wantErr)
+		}
+		if tt.wantErr == nil && len(got) != tt.size {
+			t.Errorf("%d bytes: read %d bytes", tt.size, len(got))
+		}
+	}
+}
+
+func TestCompressionMeter(t *testing.T) {
+	random := make([]byte, 4096)
+	if _, err := rand.Read(random); err != nil {
+		t.Fatal(err)
+	}
+	limits := config.CompressibleUploads{Enabled: true, MinRatio: 100, MaxFileSizeBytes: 1024}
+	for _, tt := range []struct {
+		name    string
+		content []byte
+		wantErr error
+	}{
+		{"small zeros", make([]byte, 1024), nil},
+		{"large zeros", make([]byte, 1024*1024), errTooCompressible},
+		{"random", random, nil},
+		{"zeros after random", append(random[:2048:2048], make([]byte, 1024*1024)...), errTooCompressible},
+	} {
+		meter := newCompressionMeter(bytes.NewReader(tt.content), limits)
+		got, err := ioutil.ReadAll(meter)
+		if err == nil {
+			err = meter.finish()
+		}
+		if err != tt.wantErr {
+			t.Errorf("%s: got error %v, want %v (ratio %v)", tt.name, err, tt.wantErr, meter.ratio)
+		}
+		if tt.wantErr == nil && !bytes.Equal(got, tt.content) {
+			t.Errorf("%s: read %d bytes which don't match the upload", tt.name, len(got))
+		}
+	}
+}
+
+func TestParseAndValidateRequestTooLarge(t *testing.T) {
+	maxFileSizeBytes := config.FileSizeBytes(1024)
+	cfg := &config.MediaAPI{
+		Matrix:             &config.Global{ServerName: "localhost"},
+		MaxFileSizeBytes:   &maxFileSizeBytes,
+		DefaultContentType: "application/octet-stream",
+	}
+	dev := &userapi.Device{UserID: "@alice:localhost"}
+
+	req := httptest.NewRequest("POST", "/upload", bytes.NewReader(make([]byte, 1025)))
+	_, _, resErr := parseAndValidateRequest(req, cfg, dev)
+	if resErr == nil || resErr.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("expected 413 for an upload over the maximum size, got %+v", resErr)
+	}
+	if matrixErr, ok := resErr.JSON.(*jsonerror.MatrixError); !ok || matrixErr.ErrCode != "M_TOO_LARGE" {
+		t.Errorf("got error %+v, want M_TOO_LARGE", resErr.JSON)
+	}
+
+	req = httptest.NewRequest("POST", "/upload", bytes.NewReader(make([]byte, 1024)))
+	if _, _, resErr = parseAndValidateRequest(req, cfg, dev); resErr != nil {
+		t.Errorf("unexpected error response %+v for an upload of the maximum size", resErr)
+	}
+}
+
+func TestUploadClientMediaID(t *testing.T) {
+	db, basePath, cleanup := newTestDatabase(t)
+	defer cleanup()
+	maxFileSizeBytes := config.FileSizeBytes(1024)
+	cfg := &config.MediaAPI{
+		Matrix:                 &config.Global{ServerName: "localhost"},
+		AbsBasePath:            basePath,
+		MaxFileSizeBytes:       &maxFileSizeBytes,
+		ClientMediaIDCollision: config.ClientMediaIDReject,
+		AdminUsers:             []string{"@admin:localhost"},
+	}
+	alice := &userapi.Device{UserID: "@alice:localhost"}
+	admin := &userapi.Device{UserID: "@admin:localhost"}
+	bridge := &userapi.Device{ID: "AS_Device", UserID: "@bridge:localhost"}
+	activeThumbnailGeneration := &types.ActiveThumbnailGeneration{
+		PathToResult: map[string]*types.ThumbnailGenerationResult{},
+	}
+	ctx := context.Background()
+	if err := db.StoreMediaReservation(ctx, &types.MediaReservation{
+		MediaID:          "reserved",
+		Origin:           "localhost",
+		UserID:           types.MatrixUserID(alice.UserID),
+		ExpiresTimestamp: types.UnixMs(time.Now().Add(time.Hour).UnixNano() / 1000000),
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	upload := func(dev *userapi.Device, mediaID, content string) util.JSONResponse {
+		req := httptest.NewRequest(http.MethodPost, "/upload?media_id="+mediaID, strings.NewReader(content))
+		req.Header.Set("Content-Type", "text/plain")
+		return Upload(req, cfg, dev, db, activeThumbnailGeneration, nil, nil)
+	}
+	if res := upload(alice, "chosen", "first"); res.Code != http.StatusForbidden {
+		t.Errorf("upload by a user who isn't allowed to choose the media ID: got status %d, want %d", res.Code, http.StatusForbidden)
+	}
+	if res := upload(admin, "not%20valid", "first"); res.Code != http.StatusBadRequest {
+		t.Errorf("upload to an invalid media ID: got status %d, want %d", res.Code, http.StatusBadRequest)
+	}
+	if res := upload(admin, "reserved", "first"); res.Code != http.StatusConflict {
+		t.Errorf("upload to a reserved media ID: got status %d, want %d", res.Code, http.StatusConflict)
+	}
+	res := upload(admin, "chosen", "first")
+	if res.Code != http.StatusOK {
+		t.Fatalf("upload to a chosen media ID: got status %d, want %d", res.Code, http.StatusOK)
+	}
+	if got := res.JSON.(uploadResponse).ContentURI; got != "mxc://localhost/chosen" {
+		t.Errorf("got content URI %q, want mxc://localhost/chosen", got)
+	}
+	first, err := db.GetMediaMetadata(ctx, "chosen", "localhost")
+	if err != nil || first == nil {
+		t.Fatalf("failed to get the uploaded media: %v", err)
+	}
+	if res = upload(bridge, "chosen", "second"); res.Code != http.StatusConflict {
+		t.Errorf("upload to a media ID which already has content: got status %d, want %d", res.Code, http.StatusConflict)
+	}
+
+	cfg.ClientMediaIDCollision = config.ClientMediaIDOverwrite
+	if res = upload(bridge, "chosen", "second"); res.Code != http.StatusOK {
+		t.Fatalf("overwriting upload by an application service: got status %d, want %d", res.Code, http.StatusOK)
+	}
+	second, err := db.GetMediaMetadata(ctx, "chosen", "localhost")
+	if err != nil || second == nil {
+		t.Fatalf("failed to get the overwritten media: %v", err)
+	}
+	if second.Base64Hash == first.Base64Hash || second.UserID != types.MatrixUserID(bridge.UserID) {
+		t.Errorf("media was not overwritten, got %+v", second)
+	}
+	if fileExists(t, first.Base64Hash, basePath) {
+		t.Error("the file of the overwritten media was not removed")
+	}
+	if !fileExists(t, second.Base64Hash, basePath) {
+		t.Error("the file of the new media is missing")
+	}
+}
+
+func TestDefaultUploadNames(t *testing.T) {
+	for _, tt := range []struct {
+		contentType types.ContentType
+		want        types.Filename
+	}{
+		{"image/png", "abcd1234.png"},
+		{"image/jpeg", "abcd1234.jpg"},
+		{"text/plain; charset=utf-8", "abcd1234.txt"},
+		{"application/x-unknown", "abcd1234"},
+		{"", "abcd1234"},
+	} {
+		if got := defaultUploadName("abcd1234", tt.contentType); got != tt.want {
+			t.Errorf("%q: got default upload name %q, want %q", tt.contentType, got, tt.want)
+		}
+	}
+
+	db, basePath, cleanup := newTestDatabase(t)
+	defer cleanup()
+	maxFileSizeBytes := config.FileSizeBytes(1024)
+	cfg := &config.MediaAPI{
+		Matrix:           &config.Global{ServerName: "localhost"},
+		AbsBasePath:      basePath,
+		MaxFileSizeBytes: &maxFileSizeBytes,
+	}
+	activeThumbnailGeneration := &types.ActiveThumbnailGeneration{
+		PathToResult: map[string]*types.ThumbnailGenerationResult{},
+	}
+
+	// Uploads the content, returning the name it was stored with and the name it would
+	// have been given by default.
+	uploadName := func(query, content string) (types.Filename, types.Filename) {
+		req := httptest.NewRequest(http.MethodPost, "/upload"+query, strings.NewReader(content))
+		req.Header.Set("Content-Type", "text/plain")
+		res := Upload(req, cfg, &userapi.Device{UserID: "@alice:localhost"}, db, activeThumbnailGeneration, nil, nil)
+		if res.Code != http.StatusOK {
+			t.Fatalf("upload%s: got status %d, want %d", query, res.Code, http.StatusOK)
+		}
+		mediaID := strings.TrimPrefix(res.JSON.(uploadResponse).ContentURI, "mxc://localhost/")
+		m, err := db.GetMediaMetadata(context.Background(), types.MediaID(mediaID), "localhost")
+		if err != nil || m == nil {
+			t.Fatalf("upload%s: failed to get the uploaded media: %v", query, err)
+		}
+		return m.UploadName, types.Filename(mediaID + ".txt")
+	}
+	if got, _ := uploadName("", "unnamed"); got != "" {
+		t.Errorf("got upload name %q with default names disabled, want none", got)
+	}
+	cfg.DefaultUploadNames = true
+	if got, want := uploadName("", "default name"); got != want {
+		t.Errorf("got upload name %q, want %q", got, want)
+	}
+	// The same file again, which is stored under a new media ID.
+	if got, want := uploadName("", "default name"); got != want {
+		t.Errorf("file which was already uploaded: got upload name %q, want %q", got, want)
+	}
+	if got, _ := uploadName("?filename=notes.txt", "named"); got != "notes.txt" {
+		t.Errorf("got upload name %q, want the client's name notes.txt", got)
+	}
+}
+
+func TestCheckUpload(t *testing.T) {
+	maxFileSizeBytes := config.FileSizeBytes(1024)
+	cfg := &config.MediaAPI{
+		Matrix:             &config.Global{ServerName: "localhost"},
+		MaxFileSizeBytes:   &maxFileSizeBytes,
+		DefaultContentType: "application/octet-stream",
+	}
+	dev := &userapi.Device{UserID: "@alice:localhost"}
+
+	tests := []struct {
+		query    string
+		wantCode int
+	}{
+		{"?content_type=image/png&size=1024&filename=cat.png", http.StatusOK},
+		{"?size=10", http.StatusOK},
+		{"?content_type=image/png&size=1025", http.StatusRequestEntityTooLarge},
+		{"?content_type=image/png", http.StatusOK},
+		{"?content_type=image/png&size=0", http.StatusLengthRequired},
+		{"?content_type=image/png&size=lots", http.StatusBadRequest},
+		{"?content_type=text/html%3Bcharset=utf-7&size=10", http.StatusBadRequest},
+		{"?content_type=image/png&size=10&filename=~cat.png", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/upload_check"+tt.query, nil)
+		res := CheckUpload(req, cfg, dev, nil)
+		if res.Code != tt.wantCode {
+			t.Errorf("%s: got status %d, want %d", tt.query, res.Code, tt.wantCode)
+			continue
+		}
+		if tt.wantCode == http.StatusOK {
+			continue
+		}
+		// The same error as the upload itself would fail with.
+		upload := httptest.NewRequest(http.MethodPost, "/upload"+tt.query, nil)
+		upload.Header.Set("Content-Type", upload.URL.Query().Get("content_type"))
+		size, err := strconv.ParseInt(upload.URL.Query().Get("size"), 10, 64)
+		if err != nil {
+			continue
+		}
+		upload.ContentLength = size
+		_, _, resErr := parseAndValidateRequest(upload, cfg, dev)
+		if resErr == nil || !reflect.DeepEqual(*resErr, res) {
+			t.Errorf("%s: got %+v, but the upload gives %+v", tt.query, res, resErr)
+		}
+	}
+}
+
+func TestUploadReuseExisting(t *testing.T) {
+	db, basePath, cleanup := newTestDatabase(t)
+	defer cleanup()
+	maxFileSizeBytes := config.FileSizeBytes(1024)
+	cfg := &config.MediaAPI{
+		Matrix:           &config.Global{ServerName: "localhost"},
+		AbsBasePath:      basePath,
+		MaxFileSizeBytes: &maxFileSizeBytes,
+	}
+	activeThumbnailGeneration := &types.ActiveThumbnailGeneration{
+		PathToResult: map[string]*types.ThumbnailGenerationResult{},
+	}
+
+	upload := func(userID, query, content string) uploadResponse {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodPost, "/upload"+query, strings.NewReader(content))
+		req.Header.Set("Content-Type", "text/plain")
+		res := Upload(req, cfg, &userapi.Device{UserID: userID}, db, activeThumbnailGeneration, nil, nil)
+		if res.Code != http.StatusOK {
+			t.Fatalf("%s upload%s: got status %d, want %d", userID, query, res.Code, http.StatusOK)
+		}
+		return res.JSON.(uploadResponse)
+	}
+
+	first := upload("@alice:localhost", "", "same content")
+	if first.Existing {
+		t.Error("first upload: got existing media")
+	}
+	// Without asking, identical content is still given a new media ID, although the
+	// file is only stored once.
+	second := upload("@alice:localhost", "", "same content")
+	if second.ContentURI == first.ContentURI || second.Existing {
+		t.Errorf("second upload: got %+v, want a new content URI", second)
+	}
+	sum := sha256.Sum256([]byte("same content"))
+	m, err := db.GetMediaMetadataByHash(context.Background(), types.Base64Hash(base64.RawURLEncoding.EncodeToString(sum[:])), "localhost")
+	if err != nil || m == nil {
+		t.Fatalf("failed to find the media by its hash: %v", err)
+	}
+
+	reused := upload("@alice:localhost", "?reuse_existing=true", "same content")
+	if !reused.Existing || (reused.ContentURI != first.ContentURI && reused.ContentURI != second.ContentURI) {
+		t.Errorf("reused upload: got %+v, want one of the existing content URIs", reused)
+	}
+	if got := upload("@alice:localhost", "?reuse_existing=true", "new content"); got.Existing {
+		t.Errorf("new content: got %+v, want a new content URI", got)
+	}
+	// Other users' media is never given out.
+	if got := upload("@bob:localhost", "?reuse_existing=true", "same content"); got.Existing || got.ContentURI == first.ContentURI || got.ContentURI == second.ContentURI {
+		t.Errorf("another user's content: got %+v, want a new content URI", got)
+	}
+}
+
+func TestUploadValidateImage(t *testing.T) {
+	db, basePath, cleanup := newTestDatabase(t)
+	defer cleanup()
+	maxFileSizeBytes := config.FileSizeBytes(1024 * 1024)
+	cfg := &config.MediaAPI{
+		Matrix:               &config.Global{ServerName: "localhost"},
+		AbsBasePath:          basePath,
+		MaxFileSizeBytes:     &maxFileSizeBytes,
+		MaxImagePixels:       32000000,
+		ValidateImageUploads: true,
+	}
+	dev := &userapi.Device{UserID: "@alice:localhost"}
+	activeThumbnailGeneration := &types.ActiveThumbnailGeneration{
+		PathToResult: map[string]*types.ThumbnailGenerationResult{},
+	}
+	var buf bytes.Buffer
+	img := image.NewRGBA(image.Rect(0, 0, 64, 64))
+	if _, err := rand.Read(img.Pix); err != nil {
+		t.Fatal(err)
+	}
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	valid := buf.String()
+	truncated := valid[:len(valid)/2]
+
+	for _, tt := range []struct {
+		name        string
+		contentType string
+		content     string
+		validate    bool
+		wantCode    int
+	}{
+		{"valid image", "image/png", valid, true, http.StatusOK},
+		{"truncated image", "image/png", truncated, true, http.StatusUnsupportedMediaType},
+		{"truncated image without validation", "image/png", truncated, false, http.StatusOK},
+		{"image type which isn't validated", "image/webp", truncated, true, http.StatusOK},
+		{"not an image", "application/octet-stream", truncated, true, http.StatusOK},
+	} {
+		cfg.ValidateImageUploads = tt.validate
+		req := httptest.NewRequest(http.MethodPost, "/upload", strings.NewReader(tt.content))
+		req.Header.Set("Content-Type", tt.contentType)
+		res := Upload(req, cfg, dev, db, activeThumbnailGeneration, nil, nil)
+		if res.Code != tt.wantCode {
+			t.Errorf("%s: got status %d, want %d", tt.name, res.Code, tt.wantCode)
+		}
+	}
+	entries, err := ioutil.ReadDir(filepath.Join(string(basePath), "tmp"))
+	if err != nil && !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("expected the refused upload to be removed, found %d temporary directories", len(entries))
+	}
+}
+
+func TestUploadCDNDownloadURL(t *testing.T) {
+	db, basePath, cleanup := newTestDatabase(t)
+	defer cleanup()
+	maxFileSizeBytes := config.FileSizeBytes(1024)
+	cfg := &config.MediaAPI{
+		Matrix:           &config.Global{ServerName: "localhost"},
+		AbsBasePath:      basePath,
+		MaxFileSizeBytes: &maxFileSizeBytes,
+	}
+	upload := func() uploadResponse {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodPost, "/upload", strings.NewReader("content"))
+		req.Header.Set("Content-Type", "text/plain")
+		res := Upload(req, cfg, &userapi.Device{UserID: "@alice:localhost"}, db, &types.ActiveThumbnailGeneration{
+			PathToResult: map[string]*types.ThumbnailGenerationResult{},
+		}, nil, nil)
+		if res.Code != http.StatusOK {
+			t.Fatalf("upload: got status %d, want %d", res.Code, http.StatusOK)
+		}
+		return res.JSON.(uploadResponse)
+	}
+
+	if res := upload(); res.DownloadURL != "" {
+		t.Errorf("without a CDN: got download URL %q, want none", res.DownloadURL)
+	}
+
+	// The content URI is the same with a CDN, and the download URL is of the same media.
+	cfg.CDNBaseURL = "https://cdn.example.com"
+	res := upload()
+	if !strings.HasPrefix(res.ContentURI, "mxc://localhost/") {
+		t.Fatalf("got content URI %q", res.ContentURI)
+	}
+	mediaID := strings.TrimPrefix(res.ContentURI, "mxc://localhost/")
+	if want := "https://cdn.example.com/_matrix/media/v3/download/localhost/" + mediaID; res.DownloadURL != want {
+		t.Errorf("got download URL %q, want %q", res.DownloadURL, want)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/clone/localhost/"+mediaID, nil)
+	cloned := CloneMedia(req, cfg, &userapi.Device{UserID: "@bob:localhost"}, db, nil, "localhost", types.MediaID(mediaID))
+	if cloned.Code != http.StatusOK {
+		t.Fatalf("clone: got status %d, want %d", cloned.Code, http.StatusOK)
+	}
+	clone := cloned.JSON.(uploadResponse)
+	if want := "https://cdn.example.com/_matrix/media/v3/download/" + strings.TrimPrefix(clone.ContentURI, "mxc://"); clone.DownloadURL != want {
+		t.Errorf("clone: got download URL %q, want %q", clone.DownloadURL, want)
+	}
+}
@@ -0,0 +1,201 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/matrix-org/dendrite/internal/config"
+	"github.com/matrix-org/dendrite/mediaapi/fileutils"
+	"github.com/matrix-org/dendrite/mediaapi/types"
+)
+
+// sniffLength is how much of a file http.DetectContentType looks at.
+const sniffLength = 512
+
+// contentTypeAliases maps other names which clients and systems use for some content
+// types to the ones http.DetectContentType gives, so that they aren't mismatches.
+var contentTypeAliases = map[string]string{
+	"image/jpg":                "image/jpeg",
+	"image/pjpeg":              "image/jpeg",
+	"image/x-png":              "image/png",
+	"image/x-ms-bmp":           "image/bmp",
+	"image/vnd.microsoft.icon": "image/x-icon",
+	"audio/wav":                "audio/wave",
+	"audio/x-wav":              "audio/wave",
+	"audio/vnd.wave":           "audio/wave",
+	"audio/x-aiff":             "audio/aiff",
+	"audio/mp3":                "audio/mpeg",
+	"audio/x-midi":             "audio/midi",
+	"application/x-pdf":        "application/pdf",
+}
+
+// canonicalContentType returns the media type of a content type without its
+// parameters, or an empty string if it can't be parsed.
+func canonicalContentType(contentType string) string {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return ""
+	}
+	if alias, ok := contentTypeAliases[mediaType]; ok {
+		return alias
+	}
+	return mediaType
+}
+
+// isReliablySniffed reports whether a type found by http.DetectContentType can be
+// trusted over what the client said. Images, audio and PDFs are recognised by their
+// signatures. Containers such as MP4, WebM and Ogg are not, as the same signature is
+// used for audio and video, nor is text, which is only a guess.
+func isReliablySniffed(mediaType string) bool {
+	return strings.HasPrefix(mediaType, "image/") ||
+		strings.HasPrefix(mediaType, "audio/") ||
+		mediaType == "application/pdf"
+}
+
+// uploadTypeMismatch is what reconcileUploadType found wrong with an upload, and the
+// content type and name it should have instead.
+type uploadTypeMismatch struct {
+	sniffedType types.ContentType
+	contentType types.ContentType
+	uploadName  types.Filename
+}
+
+// readUploadHead returns the first bytes of the upload in tmpDir, which its type is
+// sniffed from.
+func readUploadHead(tmpDir types.Path) ([]byte, error) {
+	file, err := fileutils.OpenTempFile(tmpDir)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close() // nolint: errcheck
+	return readHead(file)
+}
+
+// readStoredHead returns the first bytes of the stored file of the media, decrypted if
+// it is encrypted at rest, so that its type can be sniffed.
+func readStoredHead(
+	mediaMetadata *types.MediaMetadata, absBasePath config.Path, encryptionKey *fileutils.EncryptionKey,
+) ([]byte, error) {
+	filePath, err := fileutils.GetPathFromBase64Hash(mediaMetadata.Base64Hash, absBasePath)
+	if err != nil {
+		return nil, err
+	}
+	file, _, err := fileutils.OpenFile(types.Path(filePath), mediaMetadata.Encryption, encryptionKey)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close() // nolint: errcheck
+	return readHead(file)
+}
+
+func readHead(file io.Reader) ([]byte, error) {
+	head := make([]byte, sniffLength)
+	n, err := io.ReadFull(file, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return nil, err
+	}
+	return head[:n], nil
+}
+
+// htmlTags are the tags which make sniffDangerousType take a file for HTML wherever
+// they are in its first bytes, as some browsers look further than the start of a
+// file. This catches HTML hidden after the signature of an image, for instance.
+var htmlTags = []string{"<!doctype html", "<html", "<head", "<body", "<script", "<iframe"}
+
+// sniffDangerousType returns the type of the file, given its first bytes, if it is
+// an executable, a script or HTML, which could do harm if it were served from the
+// media domain. Otherwise it returns an empty string.
+func sniffDangerousType(head []byte) string {
+	switch {
+	case bytes.HasPrefix(head, []byte("\x7fELF")):
+		return "application/x-executable"
+	case isPortableExecutable(head):
+		return "application/x-msdownload"
+	case bytes.HasPrefix(head, []byte("\xfe\xed\xfa\xce")), bytes.HasPrefix(head, []byte("\xfe\xed\xfa\xcf")),
+		bytes.HasPrefix(head, []byte("\xce\xfa\xed\xfe")), bytes.HasPrefix(head, []byte("\xcf\xfa\xed\xfe")):
+		return "application/x-mach-binary"
+	case bytes.HasPrefix(head, []byte("#!")):
+		return "application/x-sh"
+	case canonicalContentType(http.DetectContentType(head)) == "text/html", containsHTMLTag(head):
+		return "text/html"
+	}
+	return ""
+}
+
+// isPortableExecutable reports whether the file is a Windows executable or DLL. Plain
+// text can start with "MZ" too, so the offset to the PE header after the DOS header
+// must point to its signature.
+func isPortableExecutable(head []byte) bool {
+	if len(head) < 0x40 || !bytes.HasPrefix(head, []byte("MZ")) {
+		return false
+	}
+	offset := uint64(binary.LittleEndian.Uint32(head[0x3c:]))
+	return offset+4 <= uint64(len(head)) && bytes.Equal(head[offset:offset+4], []byte("PE\x00\x00"))
+}
+
+// containsHTMLTag reports whether any of htmlTags is anywhere in the file's first bytes.
+func containsHTMLTag(head []byte) bool {
+	head = bytes.ToLower(head)
+	for _, tag := range htmlTags {
+		for rest := head; ; {
+			i := bytes.Index(rest, []byte(tag))
+			if i < 0 {
+				break
+			}
+			rest = rest[i+len(tag):]
+			// The tag must end there, so that e.g. "<header" isn't taken for "<head".
+			if len(rest) == 0 || rest[0] == '>' || rest[0] == ' ' || rest[0] == '\t' || rest[0] == '\n' || rest[0] == '\r' || rest[0] == '/' {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// reconcileUploadType returns the content type and name which the upload should have
+// for its contents to match, given their first bytes, or nil if nothing needs changing.
+func reconcileUploadType(
+	contentType types.ContentType, uploadName types.Filename, head []byte,
+) *uploadTypeMismatch {
+	sniffed := canonicalContentType(http.DetectContentType(head))
+	if !isReliablySniffed(sniffed) {
+		return nil
+	}
+	mismatch := uploadTypeMismatch{
+		sniffedType: types.ContentType(sniffed),
+		contentType: contentType,
+		uploadName:  uploadName,
+	}
+	if canonicalContentType(string(contentType)) != sniffed {
+		mismatch.contentType = types.ContentType(sniffed)
+	}
+	// Upload names are stored escaped, which leaves the extension alone. Extensions
+	// which aren't known to be for any type are left as they are.
+	ext := path.Ext(string(uploadName))
+	if extType := canonicalContentType(mime.TypeByExtension(strings.ToLower(ext))); extType != "" && extType != sniffed {
+		mismatch.uploadName = types.Filename(strings.TrimSuffix(string(uploadName), ext) + contentTypeExtension(sniffed))
+	}
+	if mismatch.contentType == contentType && mismatch.uploadName == uploadName {
+		return nil
+	}
+	return &mismatch
+}
@@ -0,0 +1,194 @@
+package routing
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/internal/config"
+	"github.com/matrix-org/dendrite/mediaapi/types"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+)
+
+// The first bytes of files of some types, which is all that sniffing looks at.
+const (
+	jpegHead = "\xff\xd8\xff\xe0\x00\x10JFIF\x00"
+	pngHead  = "\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR"
+	pdfHead  = "%PDF-1.4\n"
+	elfHead  = "\x7fELF\x02\x01\x01\x00"
+	gifHead  = "GIF89a\x01\x00\x01\x00\x00\x00\x00"
+)
+
+// peHead is the start of a Windows executable, with the offset to the PE header at
+// 0x3c pointing just after the DOS header.
+var peHead = "MZ" + strings.Repeat("\x00", 0x3a) + "\x40\x00\x00\x00" + "PE\x00\x00"
+
+func TestReconcileUploadType(t *testing.T) {
+	for _, tt := range []struct {
+		head        string
+		contentType types.ContentType
+		uploadName  types.Filename
+		// Empty if nothing should be changed.
+		wantContentType types.ContentType
+		wantUploadName  types.Filename
+	}{
+		{jpegHead, "image/png", "cat.png", "image/jpeg", "cat.jpg"},
+		{jpegHead, "image/png", "my%20cat.png", "image/jpeg", "my%20cat.jpg"},
+		{jpegHead, "application/octet-stream", "", "image/jpeg", ""},
+		{pngHead, "image/png", "cat.jpg", "image/png", "cat.png"},
+		{pdfHead, "application/pdf", "report.html", "application/pdf", "report.pdf"},
+		// Other names for the same type aren't mismatches.
+		{jpegHead, "image/jpg", "cat.jpeg", "", ""},
+		{pngHead, "image/png; charset=binary", "CAT.PNG", "", ""},
+		// Extensions which aren't known are left alone.
+		{pngHead, "image/png", "cat.unknown-extension", "", ""},
+		{pngHead, "image/png", "cat", "", ""},
+		// Only types which can be told from the first bytes are trusted.
+		{"just some text", "image/png", "cat.png", "", ""},
+		{"\x1aE\xdf\xa3", "audio/webm", "voice.webm", "", ""},
+	} {
+		mismatch := reconcileUploadType(tt.contentType, tt.uploadName, []byte(tt.head))
+		if tt.wantContentType == "" {
+			if mismatch != nil {
+				t.Errorf("%q %q: got %+v, want no mismatch", tt.contentType, tt.uploadName, *mismatch)
+			}
+			continue
+		}
+		if mismatch == nil {
+			t.Errorf("%q %q: got no mismatch, want %q %q", tt.contentType, tt.uploadName, tt.wantContentType, tt.wantUploadName)
+			continue
+		}
+		if mismatch.contentType != tt.wantContentType || mismatch.uploadName != tt.wantUploadName {
+			t.Errorf("%q %q: got %q %q, want %q %q", tt.contentType, tt.uploadName,
+				mismatch.contentType, mismatch.uploadName, tt.wantContentType, tt.wantUploadName)
+		}
+	}
+}
+
+func TestUploadTypeCheck(t *testing.T) {
+	db, basePath, cleanup := newTestDatabase(t)
+	defer cleanup()
+	maxFileSizeBytes := config.FileSizeBytes(1024)
+	cfg := &config.MediaAPI{
+		Matrix:           &config.Global{ServerName: "localhost"},
+		AbsBasePath:      basePath,
+		MaxFileSizeBytes: &maxFileSizeBytes,
+		UploadTypeCheck:  config.UploadTypeCheckIgnore,
+	}
+	activeThumbnailGeneration := &types.ActiveThumbnailGeneration{
+		PathToResult: map[string]*types.ThumbnailGenerationResult{},
+	}
+
+	// Uploads a JPEG as cat.png, returning the status and what was stored.
+	upload := func(content string) (int, *types.MediaMetadata) {
+		req := httptest.NewRequest(http.MethodPost, "/upload?filename=cat.png", strings.NewReader(content))
+		req.Header.Set("Content-Type", "image/png")
+		res := Upload(req, cfg, &userapi.Device{UserID: "@alice:localhost"}, db, activeThumbnailGeneration, nil, nil)
+		if res.Code != http.StatusOK {
+			return res.Code, nil
+		}
+		mediaID := strings.TrimPrefix(res.JSON.(uploadResponse).ContentURI, "mxc://localhost/")
+		m, err := db.GetMediaMetadata(context.Background(), types.MediaID(mediaID), "localhost")
+		if err != nil || m == nil {
+			t.Fatalf("failed to get the uploaded media: %v", err)
+		}
+		return res.Code, m
+	}
+
+	code, m := upload(jpegHead + "ignored")
+	if code != http.StatusOK || m.ContentType != "image/png" || m.UploadName != "cat.png" {
+		t.Errorf("ignoring: got status %d and %+v, want %d and the upload as it was given", code, m, http.StatusOK)
+	}
+
+	cfg.UploadTypeCheck = config.UploadTypeCheckCorrect
+	code, m = upload(jpegHead + "corrected")
+	if code != http.StatusOK || m.ContentType != "image/jpeg" || m.UploadName != "cat.jpg" {
+		t.Errorf("correcting: got status %d and %+v, want %d, image/jpeg and cat.jpg", code, m, http.StatusOK)
+	}
+	code, m = upload(pngHead + "a real PNG")
+	if code != http.StatusOK || m.ContentType != "image/png" || m.UploadName != "cat.png" {
+		t.Errorf("correcting a PNG: got status %d and %+v, want %d and the upload as it was given", code, m, http.StatusOK)
+	}
+
+	cfg.UploadTypeCheck = config.UploadTypeCheckReject
+	if code, _ = upload(jpegHead + "rejected"); code != http.StatusUnsupportedMediaType {
+		t.Errorf("rejecting: got status %d, want %d", code, http.StatusUnsupportedMediaType)
+	}
+	if code, _ = upload(pngHead + "another real PNG"); code != http.StatusOK {
+		t.Errorf("rejecting a PNG: got status %d, want %d", code, http.StatusOK)
+	}
+}
+
+func TestSniffDangerousType(t *testing.T) {
+	for _, tt := range []struct {
+		head string
+		want string
+	}{
+		{elfHead, "application/x-executable"},
+		{peHead, "application/x-msdownload"},
+		{"\xcf\xfa\xed\xfe\x07\x00\x00\x01", "application/x-mach-binary"},
+		{"#!/bin/sh\nrm -rf ~\n", "application/x-sh"},
+		{"<!DOCTYPE html><p>hi</p>", "text/html"},
+		{"  <HTML>", "text/html"},
+		// HTML which is hidden after an image signature, which some browsers still find.
+		{gifHead + "<script>alert(1)</script>", "text/html"},
+		{pngHead + "\x00<IFRAME src=x>", "text/html"},
+		{jpegHead, ""},
+		{pngHead, ""},
+		{"MZ is where the text starts", ""},
+		{"notes about <header> tags", ""},
+		{"just some text", ""},
+		{"", ""},
+	} {
+		if got := sniffDangerousType([]byte(tt.head)); got != tt.want {
+			t.Errorf("%q: got %q, want %q", tt.head, got, tt.want)
+		}
+	}
+}
+
+func TestBlockedUploadTypes(t *testing.T) {
+	db, basePath, cleanup := newTestDatabase(t)
+	defer cleanup()
+	maxFileSizeBytes := config.FileSizeBytes(1024)
+	cfg := &config.MediaAPI{
+		Matrix:             &config.Global{ServerName: "localhost"},
+		AbsBasePath:        basePath,
+		MaxFileSizeBytes:   &maxFileSizeBytes,
+		UploadTypeCheck:    config.UploadTypeCheckIgnore,
+		BlockedUploadTypes: []string{"application/x-executable", "text/html"},
+	}
+	activeThumbnailGeneration := &types.ActiveThumbnailGeneration{
+		PathToResult: map[string]*types.ThumbnailGenerationResult{},
+	}
+	upload := func(contentType, content string) int {
+		req := httptest.NewRequest(http.MethodPost, "/upload?filename=cat.png", strings.NewReader(content))
+		req.Header.Set("Content-Type", contentType)
+		res := Upload(req, cfg, &userapi.Device{UserID: "@alice:localhost"}, db, activeThumbnailGeneration, nil, nil)
+		if matrixErr, ok := res.JSON.(*jsonerror.MatrixError); ok && matrixErr.ErrCode != "M_UNSUPPORTED_MEDIA_TYPE" {
+			t.Errorf("got errcode %q, want M_UNSUPPORTED_MEDIA_TYPE", matrixErr.ErrCode)
+		}
+		return res.Code
+	}
+
+	// The content type which the upload was given makes no difference.
+	if code := upload("image/png", elfHead+"a fake ELF executable"); code != http.StatusUnsupportedMediaType {
+		t.Errorf("ELF executable: got status %d, want %d", code, http.StatusUnsupportedMediaType)
+	}
+	if code := upload("image/gif", gifHead+"<script>alert(document.cookie)</script>"); code != http.StatusUnsupportedMediaType {
+		t.Errorf("GIF which is also HTML: got status %d, want %d", code, http.StatusUnsupportedMediaType)
+	}
+	if code := upload("image/png", pngHead+"a real PNG"); code != http.StatusOK {
+		t.Errorf("PNG: got status %d, want %d", code, http.StatusOK)
+	}
+	// Types which aren't in the list are allowed.
+	if code := upload("application/octet-stream", peHead); code != http.StatusOK {
+		t.Errorf("Windows executable which isn't blocked: got status %d, want %d", code, http.StatusOK)
+	}
+	cfg.BlockedUploadTypes = nil
+	if code := upload("image/png", elfHead+"another fake ELF executable"); code != http.StatusOK {
+		t.Errorf("ELF executable with nothing blocked: got status %d, want %d", code, http.StatusOK)
+	}
+}
@@ -0,0 +1,124 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/internal/config"
+	"github.com/matrix-org/dendrite/mediaapi/storage"
+	"github.com/matrix-org/dendrite/mediaapi/types"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/util"
+)
+
+// The number of media listed by GET /user_media if the request doesn't give a limit,
+// and the most which can be asked for at once.
+const (
+	defaultUserMediaLimit = 50
+	maxUserMediaLimit     = 1000
+)
+
+// userMediaResponse defines the format of the JSON response to GET /user_media
+type userMediaResponse struct {
+	Media []userMedia `json:"media"`
+	// The from parameter to get the next page with, if there may be more.
+	NextBatch types.MediaID `json:"next_batch,omitempty"`
+}
+
+type userMedia struct {
+	MediaID       types.MediaID       `json:"media_id"`
+	ContentURI    string              `json:"content_uri"`
+	ContentType   types.ContentType   `json:"content_type"`
+	FileSizeBytes types.FileSizeBytes `json:"file_size_bytes"`
+	UploadName    string              `json:"upload_name,omitempty"`
+	CreationTs    types.UnixMs        `json:"creation_ts"`
+	DownloadCount int64               `json:"download_count"`
+}
+
+// GetUserMedia implements GET /user_media
+// This lists the media which the user making the request uploaded, in order of media
+// ID. Up to limit media are returned, starting after the media ID given as from, and
+// next_batch is set to the from to use for the next page if there may be more.
+// Each is listed with how many times it was downloaded.
+func GetUserMedia(
+	req *http.Request, cfg *config.MediaAPI, dev *userapi.Device, db storage.Database,
+	accessTracker *mediaAccessTracker,
+) util.JSONResponse {
+	limit := defaultUserMediaLimit
+	if value := req.URL.Query().Get("limit"); value != "" {
+		var err error
+		limit, err = strconv.Atoi(value)
+		if err != nil || limit < 1 || limit > maxUserMediaLimit {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.InvalidArgumentValue(fmt.Sprintf("limit must be between 1 and %d", maxUserMediaLimit)),
+			}
+		}
+	}
+	from := types.MediaID(req.URL.Query().Get("from"))
+	if from != "" && !mediaIDRegex.MatchString(string(from)) {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue("from must be a token from next_batch"),
+		}
+	}
+
+	// One more than the limit is fetched to find out whether there is another page.
+	batch, err := db.GetMediaByUser(
+		req.Context(), types.MatrixUserID(dev.UserID), cfg.Matrix.ServerName, from, limit+1,
+	)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("Failed to query media uploaded by user")
+		return jsonerror.InternalServerError()
+	}
+
+	res := userMediaResponse{Media: []userMedia{}}
+	if len(batch) > limit {
+		batch = batch[:limit]
+		res.NextBatch = batch[limit-1].MediaID
+	}
+	for _, mediaMetadata := range batch {
+		// Upload names are stored escaped, see parseAndValidateRequest
+		uploadName, unescapeErr := url.PathUnescape(string(mediaMetadata.UploadName))
+		if unescapeErr != nil {
+			uploadName = string(mediaMetadata.UploadName)
+		}
+		stored, err := db.GetMediaAccess(req.Context(), mediaMetadata.MediaID, mediaMetadata.Origin)
+		if err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("Failed to query media download count")
+			return jsonerror.InternalServerError()
+		}
+		access := accessTracker.withPending(mediaMetadata.MediaID, mediaMetadata.Origin, stored)
+		res.Media = append(res.Media, userMedia{
+			MediaID:       mediaMetadata.MediaID,
+			ContentURI:    fmt.Sprintf("mxc://%s/%s", mediaMetadata.Origin, mediaMetadata.MediaID),
+			ContentType:   mediaMetadata.ContentType,
+			FileSizeBytes: mediaMetadata.FileSizeBytes,
+			UploadName:    uploadName,
+			CreationTs:    mediaMetadata.CreationTimestamp,
+			DownloadCount: access.DownloadCount,
+		})
+	}
+
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: res,
+	}
+}
@@ -0,0 +1,88 @@
+package routing
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/matrix-org/dendrite/internal/config"
+	"github.com/matrix-org/dendrite/mediaapi/types"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+)
+
+func TestGetUserMedia(t *testing.T) {
+	db, _, cleanup := newTestDatabase(t)
+	defer cleanup()
+	cfg := &config.MediaAPI{Matrix: &config.Global{ServerName: "localhost"}}
+	ctx := context.Background()
+	for _, mediaMetadata := range []*types.MediaMetadata{
+		{MediaID: "alice1", UserID: "@alice:localhost", UploadName: "my%20photo.png"},
+		{MediaID: "alice2", UserID: "@alice:localhost"},
+		{MediaID: "alice3", UserID: "@alice:localhost"},
+		{MediaID: "bob1", UserID: "@bob:localhost"},
+	} {
+		mediaMetadata.Origin = "localhost"
+		mediaMetadata.ContentType = "image/png"
+		mediaMetadata.FileSizeBytes = 4
+		mediaMetadata.Base64Hash = types.Base64Hash(mediaMetadata.MediaID)
+		if err := db.StoreMediaMetadata(ctx, mediaMetadata); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	list := func(userID, query string) userMediaResponse {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodGet, "/unstable/user_media"+query, nil)
+		res := GetUserMedia(req, cfg, &userapi.Device{UserID: userID}, db, newMediaAccessTracker())
+		if res.Code != http.StatusOK {
+			t.Fatalf("%s %s: got status %d, want %d", userID, query, res.Code, http.StatusOK)
+		}
+		return res.JSON.(userMediaResponse)
+	}
+	mediaIDs := func(res userMediaResponse) []types.MediaID {
+		ids := []types.MediaID{}
+		for _, media := range res.Media {
+			ids = append(ids, media.MediaID)
+		}
+		return ids
+	}
+
+	first := list("@alice:localhost", "?limit=2")
+	if got := mediaIDs(first); len(got) != 2 || got[0] != "alice1" || got[1] != "alice2" {
+		t.Errorf("first page: got %v, want [alice1 alice2]", got)
+	}
+	if first.NextBatch != "alice2" {
+		t.Errorf("first page: got next_batch %q, want alice2", first.NextBatch)
+	}
+	if media := first.Media[0]; media.ContentURI != "mxc://localhost/alice1" || media.UploadName != "my photo.png" ||
+		media.ContentType != "image/png" || media.FileSizeBytes != 4 || media.CreationTs == 0 {
+		t.Errorf("got %+v", media)
+	}
+
+	second := list("@alice:localhost", "?limit=2&from="+string(first.NextBatch))
+	if got := mediaIDs(second); len(got) != 1 || got[0] != "alice3" {
+		t.Errorf("second page: got %v, want [alice3]", got)
+	}
+	if second.NextBatch != "" {
+		t.Errorf("last page: got next_batch %q, want none", second.NextBatch)
+	}
+
+	if got := mediaIDs(list("@alice:localhost", "?limit=3")); len(got) != 3 {
+		t.Errorf("exactly a page: got %v, want all three", got)
+	}
+	if got := mediaIDs(list("@bob:localhost", "")); len(got) != 1 || got[0] != "bob1" {
+		t.Errorf("bob: got %v, want only [bob1]", got)
+	}
+	empty := list("@carol:localhost", "")
+	if empty.Media == nil || len(empty.Media) != 0 || empty.NextBatch != "" {
+		t.Errorf("user without media: got %+v, want an empty list", empty)
+	}
+
+	for _, query := range []string{"?limit=0", "?limit=abc", "?limit=1001", "?from=not%20valid"} {
+		req := httptest.NewRequest(http.MethodGet, "/unstable/user_media"+query, nil)
+		if res := GetUserMedia(req, cfg, &userapi.Device{UserID: "@alice:localhost"}, db, newMediaAccessTracker()); res.Code != http.StatusBadRequest {
+			t.Errorf("%s: got status %d, want %d", query, res.Code, http.StatusBadRequest)
+		}
+	}
+}
@@ -0,0 +1,265 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sanitizer
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"mime"
+)
+
+// JPEG markers, see https://www.w3.org/Graphics/JPEG/itu-t81.pdf table B.1
+const (
+	jpegSOI   = 0xd8 // Start of image
+	jpegEOI   = 0xd9 // End of image
+	jpegSOS   = 0xda // Start of scan, which is followed by the compressed image data
+	jpegAPP1  = 0xe1 // EXIF and XMP metadata
+	jpegAPP13 = 0xed // Photoshop and IPTC metadata
+	jpegCOM   = 0xfe // Comment
+)
+
+// pngSignature starts every PNG file.
+const pngSignature = "\x89PNG\r\n\x1a\n"
+
+// pngMetadataChunks are the chunks which are dropped from PNG images. Others, such as
+// colour profiles, change how the image looks so are kept.
+var pngMetadataChunks = map[string]bool{
+	"tEXt": true, "zTXt": true, "iTXt": true, "tIME": true, "eXIf": true,
+}
+
+// maxEXIFSize is the most of a PNG eXIf chunk which is read to find the orientation.
+// JPEG segments can't be larger than this anyway.
+const maxEXIFSize = 64 * 1024
+
+// exifOrientationTag is the EXIF tag saying which way up the image should be shown.
+const exifOrientationTag = 0x0112
+
+var errInvalidJPEG = errors.New("invalid JPEG image")
+var errInvalidPNG = errors.New("invalid PNG image")
+
+// MetadataStripper returns the function which strips metadata from images with the
+// given Content-Type header value, or nil if metadata isn't stripped from them.
+func MetadataStripper(contentType string) func(io.Reader, io.Writer) error {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return nil
+	}
+	switch mediaType {
+	case "image/jpeg":
+		return StripJPEGMetadata
+	case "image/png":
+		return StripPNGMetadata
+	default:
+		return nil
+	}
+}
+
+// StripJPEGMetadata reads a JPEG image from src and writes a copy to dst without
+// EXIF, XMP and IPTC metadata or comments, which can give away where and when a
+// photo was taken and with what. Only the segments before the image data are looked
+// at, and the image data itself is copied as it is, so the image is never decoded and
+// the pixels are unchanged. If the EXIF metadata says that the image is rotated then
+// a minimal EXIF segment with only the orientation is kept, so that it is still shown
+// the right way up.
+func StripJPEGMetadata(src io.Reader, dst io.Writer) error {
+	r := bufio.NewReader(src)
+	w := bufio.NewWriter(dst)
+	if marker, err := readJPEGMarker(r); err != nil || marker != jpegSOI {
+		return errInvalidJPEG
+	}
+	w.Write([]byte{0xff, jpegSOI}) // nolint: errcheck
+	for {
+		marker, err := readJPEGMarker(r)
+		if err != nil {
+			return err
+		}
+		switch {
+		case marker == jpegSOS:
+			// Everything from here on is image data.
+			w.Write([]byte{0xff, marker}) // nolint: errcheck
+			if _, err = io.Copy(w, r); err != nil {
+				return err
+			}
+			return w.Flush()
+		case marker == jpegEOI:
+			w.Write([]byte{0xff, marker}) // nolint: errcheck
+			return w.Flush()
+		case marker == 0x01 || (marker >= 0xd0 && marker <= 0xd7):
+			// TEM and RSTn markers have no segment after them.
+			w.Write([]byte{0xff, marker}) // nolint: errcheck
+			continue
+		}
+
+		var length uint16
+		if err = binary.Read(r, binary.BigEndian, &length); err != nil || length < 2 {
+			return errInvalidJPEG
+		}
+		size := int64(length) - 2
+		switch marker {
+		case jpegAPP1:
+			segment := make([]byte, size)
+			if _, err = io.ReadFull(r, segment); err != nil {
+				return errInvalidJPEG
+			}
+			if bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+				if orientation := exifOrientation(segment[6:]); orientation > 1 {
+					exif := append([]byte("Exif\x00\x00"), orientationEXIF(orientation)...)
+					w.Write([]byte{0xff, jpegAPP1})                        // nolint: errcheck
+					binary.Write(w, binary.BigEndian, uint16(len(exif)+2)) // nolint: errcheck
+					w.Write(exif)                                          // nolint: errcheck
+				}
+			}
+		case jpegAPP13, jpegCOM:
+			if _, err = io.CopyN(ioutil.Discard, r, size); err != nil {
+				return errInvalidJPEG
+			}
+		default:
+			w.Write([]byte{0xff, marker})             // nolint: errcheck
+			binary.Write(w, binary.BigEndian, length) // nolint: errcheck
+			if _, err = io.CopyN(w, r, size); err != nil {
+				return errInvalidJPEG
+			}
+		}
+	}
+}
+
+// readJPEGMarker reads the next marker, skipping any fill bytes before it.
+func readJPEGMarker(r *bufio.Reader) (byte, error) {
+	b, err := r.ReadByte()
+	if err != nil || b != 0xff {
+		return 0, errInvalidJPEG
+	}
+	for b == 0xff {
+		if b, err = r.ReadByte(); err != nil {
+			return 0, errInvalidJPEG
+		}
+	}
+	return b, nil
+}
+
+// StripPNGMetadata reads a PNG image from src and writes a copy to dst without the
+// text, time and EXIF chunks, other than the orientation as for StripJPEGMetadata.
+// Each chunk is copied or dropped as a whole, so the image is never decoded and the
+// pixels are unchanged. Anything after the end of the image is dropped too.
+func StripPNGMetadata(src io.Reader, dst io.Writer) error {
+	r := bufio.NewReader(src)
+	w := bufio.NewWriter(dst)
+	signature := make([]byte, len(pngSignature))
+	if _, err := io.ReadFull(r, signature); err != nil || string(signature) != pngSignature {
+		return errInvalidPNG
+	}
+	w.Write(signature) // nolint: errcheck
+	header := make([]byte, 8)
+	for {
+		if _, err := io.ReadFull(r, header); err != nil {
+			return errInvalidPNG
+		}
+		length := binary.BigEndian.Uint32(header[:4])
+		chunkType := string(header[4:])
+		if length > 1<<31-1 {
+			return errInvalidPNG
+		}
+		// The chunk data is followed by a 4 byte CRC.
+		size := int64(length) + 4
+		switch {
+		case chunkType == "eXIf" && length <= maxEXIFSize:
+			chunk := make([]byte, size)
+			if _, err := io.ReadFull(r, chunk); err != nil {
+				return errInvalidPNG
+			}
+			if orientation := exifOrientation(chunk[:length]); orientation > 1 {
+				writePNGChunk(w, "eXIf", orientationEXIF(orientation))
+			}
+		case pngMetadataChunks[chunkType]:
+			if _, err := io.CopyN(ioutil.Discard, r, size); err != nil {
+				return errInvalidPNG
+			}
+		default:
+			w.Write(header) // nolint: errcheck
+			if _, err := io.CopyN(w, r, size); err != nil {
+				return errInvalidPNG
+			}
+		}
+		if chunkType == "IEND" {
+			return w.Flush()
+		}
+	}
+}
+
+func writePNGChunk(w io.Writer, chunkType string, data []byte) {
+	crc := crc32.NewIEEE()
+	crc.Write([]byte(chunkType))                         // nolint: errcheck
+	crc.Write(data)                                      // nolint: errcheck
+	binary.Write(w, binary.BigEndian, uint32(len(data))) // nolint: errcheck
+	w.Write([]byte(chunkType))                           // nolint: errcheck
+	w.Write(data)                                        // nolint: errcheck
+	binary.Write(w, binary.BigEndian, crc.Sum32())       // nolint: errcheck
+}
+
+// exifOrientation returns the orientation from EXIF metadata, which is a TIFF
+// header followed by the first IFD, or 0 if there isn't one.
+// https://www.cipa.jp/std/documents/e/DC-X008-Translation-2019-E.pdf
+func exifOrientation(tiff []byte) uint16 {
+	if len(tiff) < 8 {
+		return 0
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 0
+	}
+	offset := int64(order.Uint32(tiff[4:8]))
+	if offset+2 > int64(len(tiff)) {
+		return 0
+	}
+	count := int64(order.Uint16(tiff[offset:]))
+	for i := int64(0); i < count; i++ {
+		entry := offset + 2 + i*12
+		if entry+12 > int64(len(tiff)) {
+			return 0
+		}
+		// Each entry is the tag, the type, the count and then the value itself, as
+		// the orientation is small enough to fit.
+		if order.Uint16(tiff[entry:]) == exifOrientationTag {
+			if orientation := order.Uint16(tiff[entry+8:]); orientation <= 8 {
+				return orientation
+			}
+			return 0
+		}
+	}
+	return 0
+}
+
+// orientationEXIF returns EXIF metadata with only the given orientation in it.
+func orientationEXIF(orientation uint16) []byte {
+	var tiff bytes.Buffer
+	tiff.WriteString("MM\x00\x2a")
+	binary.Write(&tiff, binary.BigEndian, uint32(8)) // nolint: errcheck
+	// An IFD with one SHORT entry, and no IFD after it.
+	binary.Write(&tiff, binary.BigEndian, []uint16{1, exifOrientationTag, 3}) // nolint: errcheck
+	binary.Write(&tiff, binary.BigEndian, uint32(1))                          // nolint: errcheck
+	binary.Write(&tiff, binary.BigEndian, []uint16{orientation, 0})           // nolint: errcheck
+	binary.Write(&tiff, binary.BigEndian, uint32(0))                          // nolint: errcheck
+	return tiff.Bytes()
+}
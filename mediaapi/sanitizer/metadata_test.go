@@ -0,0 +1,196 @@
+package sanitizer
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func testImage(width, height int) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			img.Set(x, y, color.RGBA{uint8(x), uint8(y), uint8(x + y), 255})
+		}
+	}
+	return img
+}
+
+// jpegSegment returns a JPEG segment with the marker and payload.
+func jpegSegment(marker byte, payload []byte) []byte {
+	segment := []byte{0xff, marker, 0, 0}
+	binary.BigEndian.PutUint16(segment[2:], uint16(len(payload)+2))
+	return append(segment, payload...)
+}
+
+// littleEndianEXIF returns EXIF metadata with a GPS tag and the orientation.
+func littleEndianEXIF(orientation uint16) []byte {
+	var tiff bytes.Buffer
+	tiff.WriteString("II\x2a\x00")
+	binary.Write(&tiff, binary.LittleEndian, uint32(8))                             // nolint: errcheck
+	binary.Write(&tiff, binary.LittleEndian, uint16(2))                             // nolint: errcheck
+	binary.Write(&tiff, binary.LittleEndian, []uint16{0x8825, 4, 1, 0, 38, 0})      // nolint: errcheck
+	binary.Write(&tiff, binary.LittleEndian, []uint16{exifOrientationTag, 3, 1, 0}) // nolint: errcheck
+	binary.Write(&tiff, binary.LittleEndian, []uint16{orientation, 0, 0, 0})        // nolint: errcheck
+	tiff.WriteString("GPS 51.5007N 0.1246W")
+	return append([]byte("Exif\x00\x00"), tiff.Bytes()...)
+}
+
+func TestStripJPEGMetadata(t *testing.T) {
+	// Large enough that it can't be read in one go.
+	var encoded bytes.Buffer
+	if err := jpeg.Encode(&encoded, testImage(2000, 1500), &jpeg.Options{Quality: 90}); err != nil {
+		t.Fatal(err)
+	}
+	original := encoded.Bytes()
+	var input bytes.Buffer
+	input.Write(original[:2])
+	input.Write(jpegSegment(jpegAPP1, littleEndianEXIF(1)))
+	input.Write(jpegSegment(jpegAPP1, []byte("http://ns.adobe.com/xap/1.0/\x00<x:xmpmeta>Secret Camera</x:xmpmeta>")))
+	input.Write(jpegSegment(jpegAPP13, []byte("Photoshop 3.0\x008BIM Secret Author")))
+	input.Write(jpegSegment(jpegCOM, []byte("Secret comment")))
+	input.Write(original[2:])
+
+	var out bytes.Buffer
+	if err := StripJPEGMetadata(&input, &out); err != nil {
+		t.Fatalf("StripJPEGMetadata failed: %s", err)
+	}
+	for _, secret := range []string{"Exif", "GPS", "Secret"} {
+		if bytes.Contains(out.Bytes(), []byte(secret)) {
+			t.Errorf("stripped image still contains %q", secret)
+		}
+	}
+	// The encoder doesn't write any metadata, so all that was added is removed.
+	if !bytes.Equal(out.Bytes(), original) {
+		t.Errorf("stripped image is %d bytes, want the %d byte original", out.Len(), len(original))
+	}
+	if _, err := jpeg.Decode(&out); err != nil {
+		t.Errorf("stripped image can't be decoded: %s", err)
+	}
+}
+
+func TestStripJPEGMetadataKeepsOrientation(t *testing.T) {
+	var encoded bytes.Buffer
+	if err := jpeg.Encode(&encoded, testImage(16, 8), nil); err != nil {
+		t.Fatal(err)
+	}
+	original := encoded.Bytes()
+	input := append(append(append([]byte{}, original[:2]...), jpegSegment(jpegAPP1, littleEndianEXIF(6))...), original[2:]...)
+
+	var out bytes.Buffer
+	if err := StripJPEGMetadata(bytes.NewReader(input), &out); err != nil {
+		t.Fatalf("StripJPEGMetadata failed: %s", err)
+	}
+	if bytes.Contains(out.Bytes(), []byte("GPS")) {
+		t.Error("stripped image still contains the GPS tag")
+	}
+	want := append(append(append([]byte{}, original[:2]...), jpegSegment(jpegAPP1, append([]byte("Exif\x00\x00"), orientationEXIF(6)...))...), original[2:]...)
+	if !bytes.Equal(out.Bytes(), want) {
+		t.Error("stripped image doesn't have only the orientation before the original image")
+	}
+	if orientation := exifOrientation(out.Bytes()[4+2+6:]); orientation != 6 {
+		t.Errorf("got orientation %d, want 6", orientation)
+	}
+}
+
+// pngChunk returns a PNG chunk with the type and data.
+func pngChunk(chunkType string, data []byte) []byte {
+	var chunk bytes.Buffer
+	writePNGChunk(&chunk, chunkType, data)
+	return chunk.Bytes()
+}
+
+func TestStripPNGMetadata(t *testing.T) {
+	var encoded bytes.Buffer
+	if err := png.Encode(&encoded, testImage(300, 200)); err != nil {
+		t.Fatal(err)
+	}
+	original := encoded.Bytes()
+	// The IHDR chunk comes first, and is 25 bytes long.
+	headerEnd := len(pngSignature) + 25
+	var input bytes.Buffer
+	input.Write(original[:headerEnd])
+	input.Write(pngChunk("tEXt", []byte("Author\x00Secret Author")))
+	input.Write(pngChunk("eXIf", littleEndianEXIF(3)[6:]))
+	input.Write(original[headerEnd:])
+	input.WriteString("Secret trailing data")
+
+	var out bytes.Buffer
+	if err := StripPNGMetadata(&input, &out); err != nil {
+		t.Fatalf("StripPNGMetadata failed: %s", err)
+	}
+	for _, secret := range []string{"tEXt", "GPS", "Secret"} {
+		if bytes.Contains(out.Bytes(), []byte(secret)) {
+			t.Errorf("stripped image still contains %q", secret)
+		}
+	}
+	orientation := pngChunk("eXIf", orientationEXIF(3))
+	if !bytes.Contains(out.Bytes(), orientation) {
+		t.Error("stripped image doesn't have the orientation")
+	}
+	if crc := binary.BigEndian.Uint32(orientation[len(orientation)-4:]); crc != crc32.ChecksumIEEE(orientation[4:len(orientation)-4]) {
+		t.Error("orientation chunk has the wrong CRC")
+	}
+	decoded, err := png.Decode(&out)
+	if err != nil {
+		t.Fatalf("stripped image can't be decoded: %s", err)
+	}
+	want, err := png.Decode(bytes.NewReader(original))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(decoded, want) {
+		t.Error("stripped image has different pixels to the original")
+	}
+}
+
+func TestStripMetadataRejectsInvalid(t *testing.T) {
+	var encoded bytes.Buffer
+	if err := jpeg.Encode(&encoded, testImage(8, 8), nil); err != nil {
+		t.Fatal(err)
+	}
+	for _, input := range []string{
+		"",
+		"not an image",
+		"\xff\xd8",
+		"\xff\xd8\xff\xe1\x00",
+		"\xff\xd8\xff\xe1\x00\x10Exif",
+		string(encoded.Bytes()[:20]),
+	} {
+		if err := StripJPEGMetadata(strings.NewReader(input), &bytes.Buffer{}); err == nil {
+			t.Errorf("StripJPEGMetadata(%q): expected an error", input)
+		}
+	}
+	for _, input := range []string{
+		"",
+		"not an image",
+		pngSignature,
+		pngSignature + "\x00\x00\x00\x0dIHDR",
+	} {
+		if err := StripPNGMetadata(strings.NewReader(input), &bytes.Buffer{}); err == nil {
+			t.Errorf("StripPNGMetadata(%q): expected an error", input)
+		}
+	}
+}
+
+func TestMetadataStripper(t *testing.T) {
+	for contentType, want := range map[string]bool{
+		"image/jpeg":               true,
+		"image/png":                true,
+		"IMAGE/PNG; charset=utf-8": true,
+		"image/gif":                false,
+		"image/svg+xml":            false,
+		"not a content type;":      false,
+	} {
+		if got := MetadataStripper(contentType) != nil; got != want {
+			t.Errorf("%q: got %t, want %t", contentType, got, want)
+		}
+	}
+}
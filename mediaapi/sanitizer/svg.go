@@ -0,0 +1,183 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sanitizer
+
+import (
+	"bufio"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"mime"
+	"strings"
+)
+
+// SVGContentType is the MIME type of SVG images
+const SVGContentType = "image/svg+xml"
+
+// svgElements is the allowlist of SVG elements which survive sanitization.
+// Anything not in this list (e.g. script, foreignObject, style) is removed
+// along with all of its children.
+var svgElements = map[string]bool{
+	"svg": true, "g": true, "defs": true, "symbol": true, "use": true,
+	"title": true, "desc": true, "switch": true, "view": true,
+	"path": true, "rect": true, "circle": true, "ellipse": true,
+	"line": true, "polyline": true, "polygon": true,
+	"text": true, "tspan": true, "textpath": true,
+	"image": true, "marker": true, "pattern": true, "clippath": true, "mask": true,
+	"lineargradient": true, "radialgradient": true, "stop": true,
+	"filter": true, "feblend": true, "fecolormatrix": true, "fecomponenttransfer": true,
+	"fecomposite": true, "feconvolvematrix": true, "fediffuselighting": true,
+	"fedisplacementmap": true, "fedistantlight": true, "feflood": true,
+	"fefunca": true, "fefuncb": true, "fefuncg": true, "fefuncr": true,
+	"fegaussianblur": true, "femerge": true, "femergenode": true,
+	"femorphology": true, "feoffset": true, "fepointlight": true,
+	"fespecularlighting": true, "fespotlight": true, "fetile": true,
+	"feturbulence": true,
+}
+
+// IsSVG returns true if the given Content-Type header value is for an SVG image
+func IsSVG(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	return mediaType == SVGContentType
+}
+
+// SanitizeSVG reads an SVG document from src and writes a sanitized copy to dst.
+// Only allowlisted elements are kept. Event handler attributes, references to
+// anything other than fragments within the same document and script URIs are
+// stripped. Comments, processing instructions and directives (including any
+// DOCTYPE, which could otherwise be used to declare entities) are dropped.
+// Returns an error if the input is not well-formed XML.
+func SanitizeSVG(src io.Reader, dst io.Writer) error {
+	decoder := xml.NewDecoder(src)
+	decoder.Strict = true
+	writer := bufio.NewWriter(dst)
+
+	// RawToken doesn't check that start and end elements match, so keep
+	// track of open elements ourselves. skipDepth is greater than zero while
+	// we are inside an element that has been removed, so that all of its
+	// children are removed too.
+	var open []string
+	skipDepth := 0
+	seenRoot := false
+	for {
+		token, err := decoder.RawToken()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("decoder.RawToken: %w", err)
+		}
+		switch t := token.(type) {
+		case xml.StartElement:
+			if len(open) == 0 && seenRoot {
+				return fmt.Errorf("document has more than one root element")
+			}
+			if len(open) == 0 && strings.ToLower(t.Name.Local) != "svg" {
+				return fmt.Errorf("root element is %q, not svg", t.Name.Local)
+			}
+			seenRoot = true
+			open = append(open, qualifiedName(t.Name))
+			if skipDepth > 0 || !svgElements[strings.ToLower(t.Name.Local)] {
+				skipDepth++
+				continue
+			}
+			writeStartElement(writer, t)
+		case xml.EndElement:
+			name := qualifiedName(t.Name)
+			if len(open) == 0 || open[len(open)-1] != name {
+				return fmt.Errorf("unexpected end element %q", name)
+			}
+			open = open[:len(open)-1]
+			if skipDepth > 0 {
+				skipDepth--
+				continue
+			}
+			_, _ = writer.WriteString("</" + name + ">")
+		case xml.CharData:
+			if skipDepth > 0 || len(open) == 0 {
+				continue
+			}
+			if err = xml.EscapeText(writer, t); err != nil {
+				return fmt.Errorf("xml.EscapeText: %w", err)
+			}
+		case xml.ProcInst:
+			if t.Target == "xml" && !seenRoot {
+				_, _ = writer.WriteString("<?xml " + string(t.Inst) + "?>")
+			}
+		}
+	}
+	if !seenRoot || len(open) > 0 {
+		return fmt.Errorf("document does not contain a complete svg element")
+	}
+	return writer.Flush()
+}
+
+func writeStartElement(writer *bufio.Writer, t xml.StartElement) {
+	_, _ = writer.WriteString("<" + qualifiedName(t.Name))
+	for _, attr := range t.Attr {
+		if !isSafeAttribute(attr) {
+			continue
+		}
+		_, _ = writer.WriteString(" " + qualifiedName(attr.Name) + `="`)
+		_ = xml.EscapeText(writer, []byte(attr.Value))
+		_, _ = writer.WriteString(`"`)
+	}
+	_, _ = writer.WriteString(">")
+}
+
+func isSafeAttribute(attr xml.Attr) bool {
+	name := strings.ToLower(attr.Name.Local)
+	value := strings.ToLower(strings.TrimSpace(attr.Value))
+	switch {
+	case strings.HasPrefix(name, "on"):
+		// Event handlers such as onload or onclick
+		return false
+	case name == "href" || name == "src":
+		// Only allow references to fragments within the same document
+		return strings.HasPrefix(value, "#")
+	case strings.Contains(value, "javascript:") || strings.Contains(value, "vbscript:"):
+		return false
+	case strings.Contains(value, "url(") && !isLocalURLReference(value):
+		return false
+	case strings.Contains(value, "expression(") || strings.Contains(value, "@import"):
+		return false
+	}
+	return true
+}
+
+// isLocalURLReference returns true if every url(...) in the value refers to
+// a fragment within the same document, e.g. fill="url(#gradient)".
+func isLocalURLReference(value string) bool {
+	for {
+		i := strings.Index(value, "url(")
+		if i < 0 {
+			return true
+		}
+		value = strings.TrimLeft(value[i+len("url("):], ` '"`)
+		if !strings.HasPrefix(value, "#") {
+			return false
+		}
+	}
+}
+
+func qualifiedName(name xml.Name) string {
+	if name.Space == "" {
+		return name.Local
+	}
+	return name.Space + ":" + name.Local
+}
@@ -0,0 +1,49 @@
+package sanitizer
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestSanitizeSVG(t *testing.T) {
+	input := `<?xml version="1.0"?>
+<!DOCTYPE svg [<!ENTITY x "boom">]>
+<svg xmlns="http://www.w3.org/2000/svg" xmlns:xlink="http://www.w3.org/1999/xlink" onload="alert(1)">
+<script>alert(2)</script>
+<foreignObject><div>hi</div></foreignObject>
+<a href="javascript:alert(3)"><rect width="10" height="10"/></a>
+<use xlink:href="https://evil.example/sprite.svg#icon"/>
+<use xlink:href="#local"/>
+<rect fill="url(#gradient)" style="fill:url(https://evil.example/x)"/>
+<circle r="5" onclick="alert(4)"/>
+</svg>`
+	var out bytes.Buffer
+	if err := SanitizeSVG(strings.NewReader(input), &out); err != nil {
+		t.Fatalf("SanitizeSVG failed: %s", err)
+	}
+	result := out.String()
+	for _, bad := range []string{"script", "alert", "foreignObject", "evil.example", "ENTITY", "onload", "onclick"} {
+		if strings.Contains(result, bad) {
+			t.Errorf("sanitized SVG still contains %q: %s", bad, result)
+		}
+	}
+	for _, good := range []string{`<svg xmlns="http://www.w3.org/2000/svg"`, `xlink:href="#local"`, `fill="url(#gradient)"`, `<circle r="5">`} {
+		if !strings.Contains(result, good) {
+			t.Errorf("sanitized SVG is missing %q: %s", good, result)
+		}
+	}
+}
+
+func TestSanitizeSVGRejectsInvalid(t *testing.T) {
+	for _, input := range []string{
+		`<svg><rect></svg>`,
+		`<html><body></body></html>`,
+		`not xml at all`,
+	} {
+		var out bytes.Buffer
+		if err := SanitizeSVG(strings.NewReader(input), &out); err == nil {
+			t.Errorf("expected error sanitizing %q, got %q", input, out.String())
+		}
+	}
+}
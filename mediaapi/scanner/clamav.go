@@ -0,0 +1,165 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package scanner
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// clamAVChunkSize is the most which is sent to clamd in each INSTREAM chunk.
+const clamAVChunkSize = 64 * 1024
+
+// ClamAV scans files with clamd, streaming them to it with the INSTREAM command.
+// https://docs.clamav.net/manual/Usage/Scanning.html#clamd
+type ClamAV struct {
+	network string
+	address string
+	timeout time.Duration
+}
+
+// NewClamAV returns a scanner which connects to clamd at the address, given as
+// tcp://host:port or unix:///path/to/socket. Connecting, sending each part of a file
+// and waiting for the reply may each take up to the timeout, so that a stuck clamd
+// doesn't hold up uploads. A timeout of 0 disables this.
+func NewClamAV(address string, timeout time.Duration) (*ClamAV, error) {
+	u, err := url.Parse(address)
+	if err != nil {
+		return nil, fmt.Errorf("invalid clamd address %q: %w", address, err)
+	}
+	switch u.Scheme {
+	case "tcp":
+		if u.Host == "" {
+			return nil, fmt.Errorf("invalid clamd address %q: missing host", address)
+		}
+		return &ClamAV{network: "tcp", address: u.Host, timeout: timeout}, nil
+	case "unix":
+		if u.Path == "" {
+			return nil, fmt.Errorf("invalid clamd address %q: missing socket path", address)
+		}
+		return &ClamAV{network: "unix", address: u.Path, timeout: timeout}, nil
+	default:
+		return nil, fmt.Errorf("invalid clamd address %q: must start with tcp:// or unix://", address)
+	}
+}
+
+// Scan implements Scanner
+func (c *ClamAV) Scan(ctx context.Context, src io.Reader) (Verdict, error) {
+	dialer := net.Dialer{Timeout: c.timeout}
+	conn, err := dialer.DialContext(ctx, c.network, c.address)
+	if err != nil {
+		return Verdict{}, fmt.Errorf("failed to connect to clamd: %w", err)
+	}
+	defer conn.Close() // nolint: errcheck
+
+	// Closing the connection is the only way to interrupt a read or write on it.
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close() // nolint: errcheck
+		case <-stop:
+		}
+	}()
+
+	sendErr := c.send(conn, src)
+	// clamd replies, and closes the connection, as soon as it finds something or the
+	// file goes over its StreamMaxLength, so the reply is read even if sending failed.
+	if err = c.setDeadline(conn.SetReadDeadline); err != nil {
+		return Verdict{}, err
+	}
+	reply, err := bufio.NewReader(conn).ReadString(0)
+	if ctx.Err() != nil {
+		return Verdict{}, ctx.Err()
+	}
+	if err != nil {
+		if sendErr != nil {
+			return Verdict{}, sendErr
+		}
+		return Verdict{}, fmt.Errorf("failed to read reply from clamd: %w", err)
+	}
+	verdict, err := parseClamAVReply(strings.TrimSuffix(reply, "\x00"))
+	if err == nil && !verdict.Infected && sendErr != nil {
+		// clamd can only vouch for the part of the file which it was sent.
+		return Verdict{}, sendErr
+	}
+	return verdict, err
+}
+
+func (c *ClamAV) send(conn net.Conn, src io.Reader) error {
+	// The "z" prefix means that the command and its reply are terminated by a NUL.
+	if err := c.write(conn, []byte("zINSTREAM\x00")); err != nil {
+		return err
+	}
+	// Each chunk is sent with its length first. A chunk with a length of 0 marks the
+	// end of the file.
+	buf := make([]byte, 4+clamAVChunkSize)
+	for {
+		n, readErr := io.ReadFull(src, buf[4:])
+		if readErr != nil && readErr != io.EOF && readErr != io.ErrUnexpectedEOF {
+			return readErr
+		}
+		binary.BigEndian.PutUint32(buf, uint32(n))
+		if n > 0 {
+			if err := c.write(conn, buf[:4+n]); err != nil {
+				return err
+			}
+		}
+		if readErr != nil {
+			break
+		}
+	}
+	return c.write(conn, []byte{0, 0, 0, 0})
+}
+
+func (c *ClamAV) write(conn net.Conn, p []byte) error {
+	if err := c.setDeadline(conn.SetWriteDeadline); err != nil {
+		return err
+	}
+	if _, err := conn.Write(p); err != nil {
+		return fmt.Errorf("failed to send to clamd: %w", err)
+	}
+	return nil
+}
+
+func (c *ClamAV) setDeadline(set func(time.Time) error) error {
+	if c.timeout == 0 {
+		return nil
+	}
+	return set(time.Now().Add(c.timeout))
+}
+
+// parseClamAVReply parses the reply to INSTREAM, which is "stream: OK" for a clean
+// file, "stream: <signature> FOUND" for an infected one, or ends with "ERROR" if the
+// file couldn't be scanned.
+func parseClamAVReply(reply string) (Verdict, error) {
+	switch {
+	case reply == "stream: OK":
+		return Verdict{}, nil
+	case strings.HasPrefix(reply, "stream: ") && strings.HasSuffix(reply, " FOUND"):
+		signature := strings.TrimSuffix(strings.TrimPrefix(reply, "stream: "), " FOUND")
+		return Verdict{Infected: true, Signature: signature}, nil
+	default:
+		return Verdict{}, fmt.Errorf("clamd failed to scan the file: %s", reply)
+	}
+}
@@ -0,0 +1,173 @@
+package scanner
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeClamd accepts INSTREAM commands, replying that files containing "EICAR" are
+// infected. It returns the listener, which must be closed, and the files it was sent.
+func fakeClamd(t *testing.T, reply func(file []byte) string) (net.Listener, <-chan []byte) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := make(chan []byte, 10)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close() // nolint: errcheck
+				r := bufio.NewReader(conn)
+				if command, err := r.ReadString(0); err != nil || command != "zINSTREAM\x00" {
+					return
+				}
+				var file bytes.Buffer
+				for {
+					var length uint32
+					if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+						return
+					}
+					if length == 0 {
+						break
+					}
+					if _, err := io.CopyN(&file, r, int64(length)); err != nil {
+						return
+					}
+				}
+				files <- file.Bytes()
+				conn.Write([]byte(reply(file.Bytes()) + "\x00")) // nolint: errcheck
+			}()
+		}
+	}()
+	return listener, files
+}
+
+func eicarReply(file []byte) string {
+	if bytes.Contains(file, []byte("EICAR")) {
+		return "stream: Eicar-Signature FOUND"
+	}
+	return "stream: OK"
+}
+
+func TestClamAVScan(t *testing.T) {
+	listener, files := fakeClamd(t, eicarReply)
+	defer listener.Close() // nolint: errcheck
+	clamAV, err := NewClamAV("tcp://"+listener.Addr().String(), time.Second*5)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Larger than a chunk, so that it is sent in several.
+	clean := strings.Repeat("clean ", clamAVChunkSize/3)
+	verdict, err := clamAV.Scan(context.Background(), strings.NewReader(clean))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if verdict.Infected {
+		t.Errorf("clean file: got verdict %+v", verdict)
+	}
+	if sent := <-files; string(sent) != clean {
+		t.Errorf("clamd was sent %d bytes, want the %d byte file", len(sent), len(clean))
+	}
+
+	verdict, err = clamAV.Scan(context.Background(), strings.NewReader("EICAR test file"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !verdict.Infected || verdict.Signature != "Eicar-Signature" {
+		t.Errorf("infected file: got verdict %+v", verdict)
+	}
+}
+
+func TestClamAVScanFailure(t *testing.T) {
+	listener, _ := fakeClamd(t, func([]byte) string {
+		return "INSTREAM size limit exceeded. ERROR"
+	})
+	defer listener.Close() // nolint: errcheck
+	clamAV, err := NewClamAV("tcp://"+listener.Addr().String(), time.Second*5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = clamAV.Scan(context.Background(), strings.NewReader("too large")); err == nil {
+		t.Error("expected an error when clamd couldn't scan the file")
+	}
+
+	// Nothing is listening on the address any more.
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	unreachable, err := NewClamAV("tcp://"+closed.Addr().String(), time.Second*5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed.Close() // nolint: errcheck
+	if _, err = unreachable.Scan(context.Background(), strings.NewReader("file")); err == nil {
+		t.Error("expected an error when clamd is unreachable")
+	}
+
+	// A scanner which never replies, which is given up on when the context is done.
+	silent, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close() // nolint: errcheck
+	go func() {
+		conn, acceptErr := silent.Accept()
+		if acceptErr == nil {
+			defer conn.Close()            // nolint: errcheck
+			io.Copy(ioutil.Discard, conn) // nolint: errcheck
+		}
+	}()
+	slow, err := NewClamAV("tcp://"+silent.Addr().String(), time.Second*5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*100)
+	defer cancel()
+	if _, err = slow.Scan(ctx, strings.NewReader("file")); err != context.DeadlineExceeded {
+		t.Errorf("got error %v when the context is done, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+func TestNewClamAV(t *testing.T) {
+	tests := []struct {
+		address     string
+		wantNetwork string
+		wantAddress string
+	}{
+		{"tcp://localhost:3310", "tcp", "localhost:3310"},
+		{"unix:///var/run/clamav/clamd.ctl", "unix", "/var/run/clamav/clamd.ctl"},
+		{"localhost:3310", "", ""},
+		{"tcp://", "", ""},
+		{"unix://", "", ""},
+	}
+	for _, tt := range tests {
+		clamAV, err := NewClamAV(tt.address, 0)
+		if tt.wantNetwork == "" {
+			if err == nil {
+				t.Errorf("%q: expected an error", tt.address)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: unexpected error %v", tt.address, err)
+			continue
+		}
+		if clamAV.network != tt.wantNetwork || clamAV.address != tt.wantAddress {
+			t.Errorf("%q: got %s %s, want %s %s", tt.address, clamAV.network, clamAV.address, tt.wantNetwork, tt.wantAddress)
+		}
+	}
+}
@@ -0,0 +1,49 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package scanner
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/matrix-org/dendrite/internal/config"
+)
+
+// Scanner scans files for viruses and other malware.
+type Scanner interface {
+	// Scan reads the whole file from src and returns whether it is infected. An error
+	// is returned if the file couldn't be scanned, e.g. because the scanner couldn't be
+	// reached or src failed, in which case the verdict says nothing about the file.
+	// Waiting for the scanner stops with an error when the context is done.
+	Scan(ctx context.Context, src io.Reader) (Verdict, error)
+}
+
+// Verdict is the result of scanning a file.
+type Verdict struct {
+	Infected bool
+	// The name of what was found in an infected file, if the scanner gives one.
+	Signature string
+}
+
+// New returns the scanner to scan uploads with.
+func New(cfg *config.UploadScanning) (Scanner, error) {
+	switch cfg.Scanner {
+	case config.UploadScannerClamAV:
+		return NewClamAV(cfg.ClamAVAddress, cfg.Timeout)
+	default:
+		return nil, fmt.Errorf("unknown scanner %q", cfg.Scanner)
+	}
+}
@@ -23,9 +23,36 @@ import (
 
 type Database interface {
 	StoreMediaMetadata(ctx context.Context, mediaMetadata *types.MediaMetadata) error
+	ReplaceMediaMetadata(ctx context.Context, mediaMetadata *types.MediaMetadata) (*types.MediaMetadata, error)
 	GetMediaMetadata(ctx context.Context, mediaID types.MediaID, mediaOrigin gomatrixserverlib.ServerName) (*types.MediaMetadata, error)
 	GetMediaMetadataByHash(ctx context.Context, mediaHash types.Base64Hash, mediaOrigin gomatrixserverlib.ServerName) (*types.MediaMetadata, error)
+	GetMediaMetadataByHashAndUser(ctx context.Context, mediaHash types.Base64Hash, mediaOrigin gomatrixserverlib.ServerName, userID types.MatrixUserID) (*types.MediaMetadata, error)
 	StoreThumbnail(ctx context.Context, thumbnailMetadata *types.ThumbnailMetadata) error
-	GetThumbnail(ctx context.Context, mediaID types.MediaID, mediaOrigin gomatrixserverlib.ServerName, width, height int, resizeMethod string) (*types.ThumbnailMetadata, error)
+	GetThumbnail(ctx context.Context, mediaID types.MediaID, mediaOrigin gomatrixserverlib.ServerName, width, height int, resizeMethod, background string) (*types.ThumbnailMetadata, error)
 	GetThumbnails(ctx context.Context, mediaID types.MediaID, mediaOrigin gomatrixserverlib.ServerName) ([]*types.ThumbnailMetadata, error)
+	StoreMediaReservation(ctx context.Context, reservation *types.MediaReservation) error
+	GetMediaReservation(ctx context.Context, mediaID types.MediaID, mediaOrigin gomatrixserverlib.ServerName) (*types.MediaReservation, error)
+	DeleteMediaReservation(ctx context.Context, mediaID types.MediaID, mediaOrigin gomatrixserverlib.ServerName) error
+	DeleteExpiredMediaReservations(ctx context.Context, expiredBefore types.UnixMs) (int64, error)
+	UpdateMediaAccess(ctx context.Context, mediaID types.MediaID, mediaOrigin gomatrixserverlib.ServerName, lastAccess types.UnixMs, downloads int64) error
+	GetMediaAccess(ctx context.Context, mediaID types.MediaID, mediaOrigin gomatrixserverlib.ServerName) (*types.MediaAccess, error)
+	GetMediaByUser(ctx context.Context, userID types.MatrixUserID, mediaOrigin gomatrixserverlib.ServerName, afterMediaID types.MediaID, limit int) ([]*types.MediaMetadata, error)
+	GetMediaAfter(ctx context.Context, afterOrigin gomatrixserverlib.ServerName, afterMediaID types.MediaID, limit int) ([]*types.MediaMetadata, error)
+	GetFileEncryption(ctx context.Context, mediaHash types.Base64Hash) (types.Encryption, error)
+	CountMediaByHash(ctx context.Context, mediaHash types.Base64Hash) (int64, error)
+	CountMediaByHashExcludingUser(ctx context.Context, mediaHash types.Base64Hash, userID types.MatrixUserID) (int64, error)
+	DeleteMedia(ctx context.Context, mediaID types.MediaID, mediaOrigin gomatrixserverlib.ServerName) error
+	SoftDeleteMedia(ctx context.Context, mediaID types.MediaID, mediaOrigin gomatrixserverlib.ServerName, deletedTs types.UnixMs) error
+	UndeleteMedia(ctx context.Context, mediaID types.MediaID, mediaOrigin gomatrixserverlib.ServerName) (bool, error)
+	GetMediaDeletedBefore(ctx context.Context, deletedBefore types.UnixMs, limit int) ([]*types.MediaMetadata, error)
+	DeleteDeletedMedia(ctx context.Context, mediaID types.MediaID, mediaOrigin gomatrixserverlib.ServerName, deletedBefore types.UnixMs) (bool, error)
+	AddUserTraffic(ctx context.Context, userID types.MatrixUserID, ts types.UnixMs, bytesUploaded, bytesServed int64) error
+	GetUserTraffic(ctx context.Context, userID types.MatrixUserID, fromTs, toTs types.UnixMs) (*types.UserTraffic, error)
+	AddStoredBytes(ctx context.Context, bytes int64) error
+	ReserveStoredBytes(ctx context.Context, bytes, limit int64) (bool, error)
+	GetStoredBytes(ctx context.Context) (int64, error)
+	RecomputeStoredBytes(ctx context.Context) (int64, error)
+	StoreMediaReport(ctx context.Context, report *types.MediaReport) error
+	GetMediaReports(ctx context.Context, afterReportID int64, limit int) ([]*types.MediaReport, error)
+	Ping(ctx context.Context) error
 }
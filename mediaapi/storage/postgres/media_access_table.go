@@ -0,0 +1,102 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package postgres
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/mediaapi/types"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+const mediaAccessSchema = `
+-- The mediaapi_media_access table records when media was last downloaded or
+-- had a thumbnail of it downloaded, and how many times it was downloaded.
+CREATE TABLE IF NOT EXISTS mediaapi_media_access (
+    -- The media ID, as in the mediaapi_media_repository table.
+    media_id TEXT NOT NULL,
+    -- The origin of the media.
+    media_origin TEXT NOT NULL,
+    -- When the media was last accessed in UNIX epoch ms.
+    last_access_ts BIGINT NOT NULL,
+    -- How many times the media itself, rather than a thumbnail of it, was downloaded.
+    download_count BIGINT NOT NULL DEFAULT 0
+);
+CREATE UNIQUE INDEX IF NOT EXISTS mediaapi_media_access_index ON mediaapi_media_access (media_id, media_origin);
+-- Tables created before downloads were counted don't have download_count yet.
+ALTER TABLE mediaapi_media_access ADD COLUMN IF NOT EXISTS download_count BIGINT NOT NULL DEFAULT 0;
+`
+
+const upsertMediaAccessSQL = `
+INSERT INTO mediaapi_media_access (media_id, media_origin, last_access_ts, download_count)
+    VALUES ($1, $2, $3, $4)
+    ON CONFLICT (media_id, media_origin)
+    DO UPDATE SET last_access_ts = GREATEST(mediaapi_media_access.last_access_ts, EXCLUDED.last_access_ts),
+        download_count = mediaapi_media_access.download_count + EXCLUDED.download_count
+`
+
+const selectMediaAccessSQL = `
+SELECT last_access_ts, download_count FROM mediaapi_media_access WHERE media_id = $1 AND media_origin = $2
+`
+
+const deleteMediaLastAccessSQL = `
+DELETE FROM mediaapi_media_access WHERE media_id = $1 AND media_origin = $2
+`
+
+type mediaAccessStatements struct {
+	upsertMediaAccessStmt     *sql.Stmt
+	selectMediaAccessStmt     *sql.Stmt
+	deleteMediaLastAccessStmt *sql.Stmt
+}
+
+func (s *mediaAccessStatements) prepare(db *sql.DB) (err error) {
+	_, err = db.Exec(mediaAccessSchema)
+	if err != nil {
+		return
+	}
+
+	return statementList{
+		{&s.upsertMediaAccessStmt, upsertMediaAccessSQL},
+		{&s.selectMediaAccessStmt, selectMediaAccessSQL},
+		{&s.deleteMediaLastAccessStmt, deleteMediaLastAccessSQL},
+	}.prepare(db)
+}
+
+func (s *mediaAccessStatements) upsertMediaAccess(
+	ctx context.Context, mediaID types.MediaID, mediaOrigin gomatrixserverlib.ServerName,
+	lastAccess types.UnixMs, downloads int64,
+) error {
+	_, err := s.upsertMediaAccessStmt.ExecContext(ctx, mediaID, mediaOrigin, lastAccess, downloads)
+	return err
+}
+
+func (s *mediaAccessStatements) selectMediaAccess(
+	ctx context.Context, mediaID types.MediaID, mediaOrigin gomatrixserverlib.ServerName,
+) (*types.MediaAccess, error) {
+	access := types.MediaAccess{}
+	err := s.selectMediaAccessStmt.QueryRowContext(ctx, mediaID, mediaOrigin).Scan(
+		&access.LastAccess, &access.DownloadCount,
+	)
+	return &access, err
+}
+
+func (s *mediaAccessStatements) deleteMediaLastAccess(
+	ctx context.Context, txn *sql.Tx, mediaID types.MediaID, mediaOrigin gomatrixserverlib.ServerName,
+) error {
+	_, err := sqlutil.TxStmt(txn, s.deleteMediaLastAccessStmt).ExecContext(ctx, mediaID, mediaOrigin)
+	return err
+}
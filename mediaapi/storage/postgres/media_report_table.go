@@ -0,0 +1,105 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package postgres
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/mediaapi/types"
+)
+
+const mediaReportSchema = `
+-- The mediaapi_media_reports table records users reporting media as abusive, so
+-- that admins can look into it. Each user has one report of each media.
+CREATE TABLE IF NOT EXISTS mediaapi_media_reports (
+    -- The ID of the report, which reports are listed in the order of.
+    report_id BIGSERIAL PRIMARY KEY,
+    -- The media ID, as in the mediaapi_media_repository table.
+    media_id TEXT NOT NULL,
+    -- The origin of the media.
+    media_origin TEXT NOT NULL,
+    -- The user who reported the media.
+    user_id TEXT NOT NULL,
+    -- Why the user reported the media, which may be empty.
+    reason TEXT NOT NULL,
+    -- How offensive the user found the media, from -100 for the most to 0.
+    score INTEGER NOT NULL,
+    -- When the media was reported in UNIX epoch ms.
+    report_ts BIGINT NOT NULL
+);
+CREATE UNIQUE INDEX IF NOT EXISTS mediaapi_media_reports_index ON mediaapi_media_reports (media_id, media_origin, user_id);
+`
+
+// Reporting the same media again updates the user's report, keeping its ID.
+const upsertMediaReportSQL = `
+INSERT INTO mediaapi_media_reports (media_id, media_origin, user_id, reason, score, report_ts)
+    VALUES ($1, $2, $3, $4, $5, $6)
+    ON CONFLICT (media_id, media_origin, user_id)
+    DO UPDATE SET reason = EXCLUDED.reason, score = EXCLUDED.score, report_ts = EXCLUDED.report_ts
+`
+
+const selectMediaReportsSQL = `
+SELECT report_id, media_id, media_origin, user_id, reason, score, report_ts FROM mediaapi_media_reports
+    WHERE report_id > $1 ORDER BY report_id LIMIT $2
+`
+
+type mediaReportStatements struct {
+	upsertMediaReportStmt  *sql.Stmt
+	selectMediaReportsStmt *sql.Stmt
+}
+
+func (s *mediaReportStatements) prepare(db *sql.DB) (err error) {
+	_, err = db.Exec(mediaReportSchema)
+	if err != nil {
+		return
+	}
+
+	return statementList{
+		{&s.upsertMediaReportStmt, upsertMediaReportSQL},
+		{&s.selectMediaReportsStmt, selectMediaReportsSQL},
+	}.prepare(db)
+}
+
+func (s *mediaReportStatements) upsertMediaReport(ctx context.Context, report *types.MediaReport) error {
+	_, err := s.upsertMediaReportStmt.ExecContext(
+		ctx, report.MediaID, report.Origin, report.UserID, report.Reason, report.Score, report.ReportedTimestamp,
+	)
+	return err
+}
+
+func (s *mediaReportStatements) selectMediaReports(
+	ctx context.Context, afterReportID int64, limit int,
+) ([]*types.MediaReport, error) {
+	rows, err := s.selectMediaReportsStmt.QueryContext(ctx, afterReportID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectMediaReports: rows.close() failed")
+
+	var reports []*types.MediaReport
+	for rows.Next() {
+		var report types.MediaReport
+		if err = rows.Scan(
+			&report.ReportID, &report.MediaID, &report.Origin, &report.UserID,
+			&report.Reason, &report.Score, &report.ReportedTimestamp,
+		); err != nil {
+			return nil, err
+		}
+		reports = append(reports, &report)
+	}
+	return reports, rows.Err()
+}
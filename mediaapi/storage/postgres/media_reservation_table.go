@@ -0,0 +1,129 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/matrix-org/dendrite/mediaapi/types"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+const mediaReservationSchema = `
+-- The mediaapi_media_reservation table holds media IDs which have been reserved
+-- with /create but have not had any content uploaded to them yet.
+CREATE TABLE IF NOT EXISTS mediaapi_media_reservation (
+    -- The reserved media ID.
+    media_id TEXT NOT NULL,
+    -- The origin of the media. This is always the local server name.
+    media_origin TEXT NOT NULL,
+    -- The user who reserved the media ID and who is allowed to upload to it.
+    user_id TEXT NOT NULL,
+    -- When the media ID was reserved in UNIX epoch ms.
+    creation_ts BIGINT NOT NULL,
+    -- When the reservation expires if nothing has been uploaded in UNIX epoch ms.
+    expires_ts BIGINT NOT NULL
+);
+CREATE UNIQUE INDEX IF NOT EXISTS mediaapi_media_reservation_index ON mediaapi_media_reservation (media_id, media_origin);
+`
+
+const insertMediaReservationSQL = `
+INSERT INTO mediaapi_media_reservation (media_id, media_origin, user_id, creation_ts, expires_ts)
+    VALUES ($1, $2, $3, $4, $5)
+`
+
+const selectMediaReservationSQL = `
+SELECT user_id, creation_ts, expires_ts FROM mediaapi_media_reservation WHERE media_id = $1 AND media_origin = $2
+`
+
+const deleteMediaReservationSQL = `
+DELETE FROM mediaapi_media_reservation WHERE media_id = $1 AND media_origin = $2
+`
+
+const deleteExpiredMediaReservationsSQL = `
+DELETE FROM mediaapi_media_reservation WHERE expires_ts < $1
+`
+
+type mediaReservationStatements struct {
+	insertMediaReservationStmt         *sql.Stmt
+	selectMediaReservationStmt         *sql.Stmt
+	deleteMediaReservationStmt         *sql.Stmt
+	deleteExpiredMediaReservationsStmt *sql.Stmt
+}
+
+func (s *mediaReservationStatements) prepare(db *sql.DB) (err error) {
+	_, err = db.Exec(mediaReservationSchema)
+	if err != nil {
+		return
+	}
+
+	return statementList{
+		{&s.insertMediaReservationStmt, insertMediaReservationSQL},
+		{&s.selectMediaReservationStmt, selectMediaReservationSQL},
+		{&s.deleteMediaReservationStmt, deleteMediaReservationSQL},
+		{&s.deleteExpiredMediaReservationsStmt, deleteExpiredMediaReservationsSQL},
+	}.prepare(db)
+}
+
+func (s *mediaReservationStatements) insertMediaReservation(
+	ctx context.Context, reservation *types.MediaReservation,
+) error {
+	reservation.CreationTimestamp = types.UnixMs(time.Now().UnixNano() / 1000000)
+	_, err := s.insertMediaReservationStmt.ExecContext(
+		ctx,
+		reservation.MediaID,
+		reservation.Origin,
+		reservation.UserID,
+		reservation.CreationTimestamp,
+		reservation.ExpiresTimestamp,
+	)
+	return err
+}
+
+func (s *mediaReservationStatements) selectMediaReservation(
+	ctx context.Context, mediaID types.MediaID, mediaOrigin gomatrixserverlib.ServerName,
+) (*types.MediaReservation, error) {
+	reservation := types.MediaReservation{
+		MediaID: mediaID,
+		Origin:  mediaOrigin,
+	}
+	err := s.selectMediaReservationStmt.QueryRowContext(
+		ctx, reservation.MediaID, reservation.Origin,
+	).Scan(
+		&reservation.UserID,
+		&reservation.CreationTimestamp,
+		&reservation.ExpiresTimestamp,
+	)
+	return &reservation, err
+}
+
+func (s *mediaReservationStatements) deleteMediaReservation(
+	ctx context.Context, mediaID types.MediaID, mediaOrigin gomatrixserverlib.ServerName,
+) error {
+	_, err := s.deleteMediaReservationStmt.ExecContext(ctx, mediaID, mediaOrigin)
+	return err
+}
+
+func (s *mediaReservationStatements) deleteExpiredMediaReservations(
+	ctx context.Context, expiredBefore types.UnixMs,
+) (int64, error) {
+	res, err := s.deleteExpiredMediaReservationsStmt.ExecContext(ctx, expiredBefore)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
@@ -20,8 +20,13 @@ import (
 )
 
 type statements struct {
-	media     mediaStatements
-	thumbnail thumbnailStatements
+	media       mediaStatements
+	thumbnail   thumbnailStatements
+	reservation mediaReservationStatements
+	access      mediaAccessStatements
+	traffic     userTrafficStatements
+	usage       storageUsageStatements
+	report      mediaReportStatements
 }
 
 func (s *statements) prepare(db *sql.DB) (err error) {
@@ -31,6 +36,21 @@ func (s *statements) prepare(db *sql.DB) (err error) {
 	if err = s.thumbnail.prepare(db); err != nil {
 		return
 	}
+	if err = s.reservation.prepare(db); err != nil {
+		return
+	}
+	if err = s.access.prepare(db); err != nil {
+		return
+	}
+	if err = s.traffic.prepare(db); err != nil {
+		return
+	}
+	if err = s.usage.prepare(db); err != nil {
+		return
+	}
+	if err = s.report.prepare(db); err != nil {
+		return
+	}
 
 	return
 }
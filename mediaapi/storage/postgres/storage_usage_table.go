@@ -0,0 +1,116 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package postgres
+
+import (
+	"context"
+	"database/sql"
+)
+
+const storageUsageSchema = `
+-- The mediaapi_storage_usage table has a single row, with the total size of the
+-- stored files which media refers to. Thumbnails aren't counted.
+CREATE TABLE IF NOT EXISTS mediaapi_storage_usage (
+    -- Always 1, so that there is only ever one row.
+    id SMALLINT PRIMARY KEY CHECK (id = 1),
+    -- The total size of the files in bytes.
+    total_bytes BIGINT NOT NULL
+);
+`
+
+const insertStorageUsageSQL = `
+INSERT INTO mediaapi_storage_usage (id, total_bytes) VALUES (1, 0) ON CONFLICT (id) DO NOTHING
+`
+
+const addStorageUsageSQL = `
+UPDATE mediaapi_storage_usage SET total_bytes = GREATEST(total_bytes + $1, 0) WHERE id = 1
+`
+
+// Note: the total is only added to if it stays within the limit, so that concurrent
+// uploads can't go over it between checking it and adding to it.
+const reserveStorageUsageSQL = `
+UPDATE mediaapi_storage_usage SET total_bytes = total_bytes + $1 WHERE id = 1 AND total_bytes + $1 <= $2
+`
+
+const selectStorageUsageSQL = `
+SELECT total_bytes FROM mediaapi_storage_usage WHERE id = 1
+`
+
+// Note: media with the same hash share a file, so each hash is only counted once.
+const recomputeStorageUsageSQL = `
+UPDATE mediaapi_storage_usage SET total_bytes = (
+    SELECT COALESCE(SUM(file_size_bytes), 0) FROM (
+        SELECT MAX(file_size_bytes) AS file_size_bytes FROM mediaapi_media_repository GROUP BY base64hash
+    ) AS files
+) WHERE id = 1 RETURNING total_bytes
+`
+
+type storageUsageStatements struct {
+	addStorageUsageStmt       *sql.Stmt
+	reserveStorageUsageStmt   *sql.Stmt
+	selectStorageUsageStmt    *sql.Stmt
+	recomputeStorageUsageStmt *sql.Stmt
+}
+
+func (s *storageUsageStatements) prepare(db *sql.DB) (err error) {
+	_, err = db.Exec(storageUsageSchema)
+	if err != nil {
+		return
+	}
+
+	err = statementList{
+		{&s.addStorageUsageStmt, addStorageUsageSQL},
+		{&s.reserveStorageUsageStmt, reserveStorageUsageSQL},
+		{&s.selectStorageUsageStmt, selectStorageUsageSQL},
+		{&s.recomputeStorageUsageStmt, recomputeStorageUsageSQL},
+	}.prepare(db)
+	if err != nil {
+		return
+	}
+
+	// Media stored before the total was kept is counted when the row is created.
+	res, err := db.Exec(insertStorageUsageSQL)
+	if err != nil {
+		return
+	}
+	if inserted, _ := res.RowsAffected(); inserted > 0 {
+		_, err = s.recomputeStorageUsage(context.Background())
+	}
+	return
+}
+
+func (s *storageUsageStatements) addStorageUsage(ctx context.Context, bytes int64) error {
+	_, err := s.addStorageUsageStmt.ExecContext(ctx, bytes)
+	return err
+}
+
+func (s *storageUsageStatements) reserveStorageUsage(ctx context.Context, bytes, limit int64) (bool, error) {
+	res, err := s.reserveStorageUsageStmt.ExecContext(ctx, bytes, limit)
+	if err != nil {
+		return false, err
+	}
+	updated, err := res.RowsAffected()
+	return updated > 0, err
+}
+
+func (s *storageUsageStatements) selectStorageUsage(ctx context.Context) (totalBytes int64, err error) {
+	err = s.selectStorageUsageStmt.QueryRowContext(ctx).Scan(&totalBytes)
+	return
+}
+
+func (s *storageUsageStatements) recomputeStorageUsage(ctx context.Context) (totalBytes int64, err error) {
+	err = s.recomputeStorageUsageStmt.QueryRowContext(ctx).Scan(&totalBytes)
+	return
+}
@@ -21,6 +21,7 @@ import (
 	"time"
 
 	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
 	"github.com/matrix-org/dendrite/mediaapi/types"
 	"github.com/matrix-org/gomatrixserverlib"
 )
@@ -45,31 +46,47 @@ CREATE TABLE IF NOT EXISTS mediaapi_thumbnail (
     width INTEGER NOT NULL,
     -- The height of the thumbnail
     height INTEGER NOT NULL,
-    -- The resize method used to generate the thumbnail. Can be crop or scale.
-    resize_method TEXT NOT NULL
+    -- The resize method used to generate the thumbnail. Can be crop, scale or pad.
+    resize_method TEXT NOT NULL,
+    -- Whether the thumbnail is encrypted in the media store. NULL for thumbnails generated before this was recorded.
+    encrypted BOOLEAN,
+    -- The colour a padded thumbnail is padded with, as rrggbbaa. Empty for other resize methods.
+    background TEXT NOT NULL DEFAULT ''
 );
-CREATE UNIQUE INDEX IF NOT EXISTS mediaapi_thumbnail_index ON mediaapi_thumbnail (media_id, media_origin, width, height, resize_method);
+-- Tables created before whether thumbnails are encrypted was recorded don't have encrypted yet.
+ALTER TABLE mediaapi_thumbnail ADD COLUMN IF NOT EXISTS encrypted BOOLEAN;
+-- Tables created before thumbnails could be padded don't have background yet.
+ALTER TABLE mediaapi_thumbnail ADD COLUMN IF NOT EXISTS background TEXT NOT NULL DEFAULT '';
+-- Padded thumbnails of the same size with different backgrounds are different thumbnails,
+-- so the index over the size replaces the one created before they could be padded.
+DROP INDEX IF EXISTS mediaapi_thumbnail_index;
+CREATE UNIQUE INDEX IF NOT EXISTS mediaapi_thumbnail_size_index ON mediaapi_thumbnail (media_id, media_origin, width, height, resize_method, background);
 `
 
 const insertThumbnailSQL = `
-INSERT INTO mediaapi_thumbnail (media_id, media_origin, content_type, file_size_bytes, creation_ts, width, height, resize_method)
-    VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+INSERT INTO mediaapi_thumbnail (media_id, media_origin, content_type, file_size_bytes, creation_ts, width, height, resize_method, encrypted, background)
+    VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
 `
 
 // Note: this selects one specific thumbnail
 const selectThumbnailSQL = `
-SELECT content_type, file_size_bytes, creation_ts FROM mediaapi_thumbnail WHERE media_id = $1 AND media_origin = $2 AND width = $3 AND height = $4 AND resize_method = $5
+SELECT content_type, file_size_bytes, creation_ts, encrypted FROM mediaapi_thumbnail WHERE media_id = $1 AND media_origin = $2 AND width = $3 AND height = $4 AND resize_method = $5 AND background = $6
 `
 
 // Note: this selects all thumbnails for a media_origin and media_id
 const selectThumbnailsSQL = `
-SELECT content_type, file_size_bytes, creation_ts, width, height, resize_method FROM mediaapi_thumbnail WHERE media_id = $1 AND media_origin = $2
+SELECT content_type, file_size_bytes, creation_ts, width, height, resize_method, encrypted, background FROM mediaapi_thumbnail WHERE media_id = $1 AND media_origin = $2
+`
+
+const deleteThumbnailsSQL = `
+DELETE FROM mediaapi_thumbnail WHERE media_id = $1 AND media_origin = $2
 `
 
 type thumbnailStatements struct {
 	insertThumbnailStmt  *sql.Stmt
 	selectThumbnailStmt  *sql.Stmt
 	selectThumbnailsStmt *sql.Stmt
+	deleteThumbnailsStmt *sql.Stmt
 }
 
 func (s *thumbnailStatements) prepare(db *sql.DB) (err error) {
@@ -82,6 +99,7 @@ func (s *thumbnailStatements) prepare(db *sql.DB) (err error) {
 		{&s.insertThumbnailStmt, insertThumbnailSQL},
 		{&s.selectThumbnailStmt, selectThumbnailSQL},
 		{&s.selectThumbnailsStmt, selectThumbnailsSQL},
+		{&s.deleteThumbnailsStmt, deleteThumbnailsSQL},
 	}.prepare(db)
 }
 
@@ -99,6 +117,8 @@ func (s *thumbnailStatements) insertThumbnail(
 		thumbnailMetadata.ThumbnailSize.Width,
 		thumbnailMetadata.ThumbnailSize.Height,
 		thumbnailMetadata.ThumbnailSize.ResizeMethod,
+		thumbnailMetadata.MediaMetadata.Encryption,
+		thumbnailMetadata.ThumbnailSize.Background,
 	)
 	return err
 }
@@ -108,7 +128,7 @@ func (s *thumbnailStatements) selectThumbnail(
 	mediaID types.MediaID,
 	mediaOrigin gomatrixserverlib.ServerName,
 	width, height int,
-	resizeMethod string,
+	resizeMethod, background string,
 ) (*types.ThumbnailMetadata, error) {
 	thumbnailMetadata := types.ThumbnailMetadata{
 		MediaMetadata: &types.MediaMetadata{
@@ -119,6 +139,7 @@ func (s *thumbnailStatements) selectThumbnail(
 			Width:        width,
 			Height:       height,
 			ResizeMethod: resizeMethod,
+			Background:   background,
 		},
 	}
 	err := s.selectThumbnailStmt.QueryRowContext(
@@ -128,10 +149,12 @@ func (s *thumbnailStatements) selectThumbnail(
 		thumbnailMetadata.ThumbnailSize.Width,
 		thumbnailMetadata.ThumbnailSize.Height,
 		thumbnailMetadata.ThumbnailSize.ResizeMethod,
+		thumbnailMetadata.ThumbnailSize.Background,
 	).Scan(
 		&thumbnailMetadata.MediaMetadata.ContentType,
 		&thumbnailMetadata.MediaMetadata.FileSizeBytes,
 		&thumbnailMetadata.MediaMetadata.CreationTimestamp,
+		&thumbnailMetadata.MediaMetadata.Encryption,
 	)
 	return &thumbnailMetadata, err
 }
@@ -162,6 +185,8 @@ func (s *thumbnailStatements) selectThumbnails(
 			&thumbnailMetadata.ThumbnailSize.Width,
 			&thumbnailMetadata.ThumbnailSize.Height,
 			&thumbnailMetadata.ThumbnailSize.ResizeMethod,
+			&thumbnailMetadata.MediaMetadata.Encryption,
+			&thumbnailMetadata.ThumbnailSize.Background,
 		)
 		if err != nil {
 			return nil, err
@@ -171,3 +196,10 @@ func (s *thumbnailStatements) selectThumbnails(
 
 	return thumbnails, rows.Err()
 }
+
+func (s *thumbnailStatements) deleteThumbnails(
+	ctx context.Context, txn *sql.Tx, mediaID types.MediaID, mediaOrigin gomatrixserverlib.ServerName,
+) error {
+	_, err := sqlutil.TxStmt(txn, s.deleteThumbnailsStmt).ExecContext(ctx, mediaID, mediaOrigin)
+	return err
+}
@@ -20,6 +20,7 @@ import (
 	"database/sql"
 	"time"
 
+	"github.com/matrix-org/dendrite/internal"
 	"github.com/matrix-org/dendrite/internal/sqlutil"
 	"github.com/matrix-org/dendrite/mediaapi/types"
 	"github.com/matrix-org/gomatrixserverlib"
@@ -46,30 +47,116 @@ CREATE TABLE IF NOT EXISTS mediaapi_media_repository (
     -- Alternate RFC 4648 unpadded base64 encoding string representation of a SHA-256 hash sum of the file data.
     base64hash TEXT NOT NULL,
     -- The user who uploaded the file. Should be a Matrix user ID.
-    user_id TEXT NOT NULL
+    user_id TEXT NOT NULL,
+    -- Whether the file is encrypted in the media store. NULL for media stored before this was recorded.
+    encrypted BOOLEAN,
+    -- How the uploader asked for the file to be shown when downloaded, either inline
+    -- or attachment, or empty if they didn't.
+    disposition TEXT NOT NULL DEFAULT '',
+    -- When the media was soft deleted in UNIX epoch ms, or NULL if it hasn't been.
+    -- Soft deleted media isn't served, but its file is kept until the grace period is over.
+    deleted_ts INTEGER
 );
 CREATE UNIQUE INDEX IF NOT EXISTS mediaapi_media_repository_index ON mediaapi_media_repository (media_id, media_origin);
+-- For listing the media each user uploaded, a page at a time in order of media ID.
+CREATE INDEX IF NOT EXISTS mediaapi_media_repository_user_index ON mediaapi_media_repository (user_id, media_origin, media_id);
+`
+
+// This is created once deleted_ts has been added to tables which were created before it.
+const mediaDeletedIndexSQL = `
+-- For finding the soft deleted media whose grace period is over.
+CREATE INDEX IF NOT EXISTS mediaapi_media_repository_deleted_index ON mediaapi_media_repository (deleted_ts) WHERE deleted_ts IS NOT NULL;
 `
 
 const insertMediaSQL = `
-INSERT INTO mediaapi_media_repository (media_id, media_origin, content_type, file_size_bytes, creation_ts, upload_name, base64hash, user_id)
-    VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+INSERT INTO mediaapi_media_repository (media_id, media_origin, content_type, file_size_bytes, creation_ts, upload_name, base64hash, user_id, encrypted, disposition)
+    VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
 `
 
 const selectMediaSQL = `
-SELECT content_type, file_size_bytes, creation_ts, upload_name, base64hash, user_id FROM mediaapi_media_repository WHERE media_id = $1 AND media_origin = $2
+SELECT content_type, file_size_bytes, creation_ts, upload_name, base64hash, user_id, encrypted, disposition FROM mediaapi_media_repository
+    WHERE media_id = $1 AND media_origin = $2 AND deleted_ts IS NULL
 `
 
 const selectMediaByHashSQL = `
-SELECT content_type, file_size_bytes, creation_ts, upload_name, media_id, user_id FROM mediaapi_media_repository WHERE base64hash = $1 AND media_origin = $2
+SELECT content_type, file_size_bytes, creation_ts, upload_name, media_id, user_id, encrypted, disposition FROM mediaapi_media_repository
+    WHERE base64hash = $1 AND media_origin = $2 AND deleted_ts IS NULL
+`
+
+const selectMediaByHashAndUserSQL = `
+SELECT content_type, file_size_bytes, creation_ts, upload_name, media_id, encrypted, disposition FROM mediaapi_media_repository
+    WHERE base64hash = $1 AND media_origin = $2 AND user_id = $3 AND deleted_ts IS NULL ORDER BY media_id LIMIT 1
+`
+
+// Note: this selects media in order of media ID, starting after the given one, so
+// that all of a user's media can be gone through in batches.
+const selectMediaByUserSQL = `
+SELECT media_id, content_type, file_size_bytes, creation_ts, upload_name, base64hash, encrypted, disposition FROM mediaapi_media_repository
+    WHERE user_id = $1 AND media_origin = $2 AND media_id > $3 AND deleted_ts IS NULL ORDER BY media_id LIMIT $4
+`
+
+// Note: this selects media in order of origin and then media ID, starting after the
+// given ones, so that all of the media can be gone through in batches.
+const selectMediaAfterSQL = `
+SELECT media_id, media_origin, content_type, file_size_bytes, creation_ts, upload_name, base64hash, user_id, encrypted, disposition FROM mediaapi_media_repository
+    WHERE media_origin > $1 OR (media_origin = $1 AND media_id > $2) ORDER BY media_origin, media_id LIMIT $3
+`
+
+// Note: this selects the media which was soft deleted longest ago first, so that it
+// can be gone through in batches as it is removed.
+const selectMediaDeletedBeforeSQL = `
+SELECT media_id, media_origin, content_type, file_size_bytes, creation_ts, upload_name, base64hash, user_id, encrypted, disposition FROM mediaapi_media_repository
+    WHERE deleted_ts < $1 ORDER BY deleted_ts LIMIT $2
+`
+
+// Note: any media with the hash will do, as they all share the same file.
+const selectFileEncryptionSQL = `
+SELECT encrypted FROM mediaapi_media_repository WHERE base64hash = $1 AND encrypted IS NOT NULL LIMIT 1
+`
+
+const countMediaByHashSQL = `
+SELECT COUNT(*) FROM mediaapi_media_repository WHERE base64hash = $1
+`
+
+const countMediaByHashExcludingUserSQL = `
+SELECT COUNT(*) FROM mediaapi_media_repository WHERE base64hash = $1 AND user_id != $2
+`
+
+const deleteMediaSQL = `
+DELETE FROM mediaapi_media_repository WHERE media_id = $1 AND media_origin = $2
+`
+
+const softDeleteMediaSQL = `
+UPDATE mediaapi_media_repository SET deleted_ts = $1 WHERE media_id = $2 AND media_origin = $3 AND deleted_ts IS NULL
+`
+
+const undeleteMediaSQL = `
+UPDATE mediaapi_media_repository SET deleted_ts = NULL WHERE media_id = $1 AND media_origin = $2 AND deleted_ts IS NOT NULL
+`
+
+// Note: this only deletes the media if it is still soft deleted, so that it isn't lost
+// if it was undeleted in the meantime.
+const deleteDeletedMediaSQL = `
+DELETE FROM mediaapi_media_repository WHERE media_id = $1 AND media_origin = $2 AND deleted_ts < $3
 `
 
 type mediaStatements struct {
-	db                    *sql.DB
-	writer                sqlutil.Writer
-	insertMediaStmt       *sql.Stmt
-	selectMediaStmt       *sql.Stmt
-	selectMediaByHashStmt *sql.Stmt
+	db                                *sql.DB
+	writer                            sqlutil.Writer
+	insertMediaStmt                   *sql.Stmt
+	selectMediaStmt                   *sql.Stmt
+	selectMediaByHashStmt             *sql.Stmt
+	selectMediaByHashAndUserStmt      *sql.Stmt
+	selectMediaByUserStmt             *sql.Stmt
+	selectMediaAfterStmt              *sql.Stmt
+	selectMediaDeletedBeforeStmt      *sql.Stmt
+	selectFileEncryptionStmt          *sql.Stmt
+	countMediaByHashStmt              *sql.Stmt
+	countMediaByHashExcludingUserStmt *sql.Stmt
+	deleteMediaStmt                   *sql.Stmt
+	softDeleteMediaStmt               *sql.Stmt
+	undeleteMediaStmt                 *sql.Stmt
+	deleteDeletedMediaStmt            *sql.Stmt
 }
 
 func (s *mediaStatements) prepare(db *sql.DB, writer sqlutil.Writer) (err error) {
@@ -80,43 +167,69 @@ func (s *mediaStatements) prepare(db *sql.DB, writer sqlutil.Writer) (err error)
 	if err != nil {
 		return
 	}
+	// Tables created before whether files are encrypted was recorded don't have encrypted yet.
+	if err = addColumn(db, "mediaapi_media_repository", "encrypted", "BOOLEAN"); err != nil {
+		return
+	}
+	// Nor do tables created before dispositions were recorded have disposition.
+	if err = addColumn(db, "mediaapi_media_repository", "disposition", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		return
+	}
+	// Nor do tables created before media could be soft deleted have deleted_ts.
+	if err = addColumn(db, "mediaapi_media_repository", "deleted_ts", "INTEGER"); err != nil {
+		return
+	}
+	if _, err = db.Exec(mediaDeletedIndexSQL); err != nil {
+		return
+	}
 
 	return statementList{
 		{&s.insertMediaStmt, insertMediaSQL},
 		{&s.selectMediaStmt, selectMediaSQL},
 		{&s.selectMediaByHashStmt, selectMediaByHashSQL},
+		{&s.selectMediaByHashAndUserStmt, selectMediaByHashAndUserSQL},
+		{&s.selectMediaByUserStmt, selectMediaByUserSQL},
+		{&s.selectMediaAfterStmt, selectMediaAfterSQL},
+		{&s.selectMediaDeletedBeforeStmt, selectMediaDeletedBeforeSQL},
+		{&s.selectFileEncryptionStmt, selectFileEncryptionSQL},
+		{&s.countMediaByHashStmt, countMediaByHashSQL},
+		{&s.countMediaByHashExcludingUserStmt, countMediaByHashExcludingUserSQL},
+		{&s.deleteMediaStmt, deleteMediaSQL},
+		{&s.softDeleteMediaStmt, softDeleteMediaSQL},
+		{&s.undeleteMediaStmt, undeleteMediaSQL},
+		{&s.deleteDeletedMediaStmt, deleteDeletedMediaSQL},
 	}.prepare(db)
 }
 
 func (s *mediaStatements) insertMedia(
-	ctx context.Context, mediaMetadata *types.MediaMetadata,
+	ctx context.Context, txn *sql.Tx, mediaMetadata *types.MediaMetadata,
 ) error {
 	mediaMetadata.CreationTimestamp = types.UnixMs(time.Now().UnixNano() / 1000000)
-	return s.writer.Do(s.db, nil, func(txn *sql.Tx) error {
-		stmt := sqlutil.TxStmt(txn, s.insertMediaStmt)
-		_, err := stmt.ExecContext(
-			ctx,
-			mediaMetadata.MediaID,
-			mediaMetadata.Origin,
-			mediaMetadata.ContentType,
-			mediaMetadata.FileSizeBytes,
-			mediaMetadata.CreationTimestamp,
-			mediaMetadata.UploadName,
-			mediaMetadata.Base64Hash,
-			mediaMetadata.UserID,
-		)
-		return err
-	})
+	stmt := sqlutil.TxStmt(txn, s.insertMediaStmt)
+	_, err := stmt.ExecContext(
+		ctx,
+		mediaMetadata.MediaID,
+		mediaMetadata.Origin,
+		mediaMetadata.ContentType,
+		mediaMetadata.FileSizeBytes,
+		mediaMetadata.CreationTimestamp,
+		mediaMetadata.UploadName,
+		mediaMetadata.Base64Hash,
+		mediaMetadata.UserID,
+		mediaMetadata.Encryption,
+		mediaMetadata.Disposition,
+	)
+	return err
 }
 
 func (s *mediaStatements) selectMedia(
-	ctx context.Context, mediaID types.MediaID, mediaOrigin gomatrixserverlib.ServerName,
+	ctx context.Context, txn *sql.Tx, mediaID types.MediaID, mediaOrigin gomatrixserverlib.ServerName,
 ) (*types.MediaMetadata, error) {
 	mediaMetadata := types.MediaMetadata{
 		MediaID: mediaID,
 		Origin:  mediaOrigin,
 	}
-	err := s.selectMediaStmt.QueryRowContext(
+	err := sqlutil.TxStmt(txn, s.selectMediaStmt).QueryRowContext(
 		ctx, mediaMetadata.MediaID, mediaMetadata.Origin,
 	).Scan(
 		&mediaMetadata.ContentType,
@@ -125,6 +238,8 @@ func (s *mediaStatements) selectMedia(
 		&mediaMetadata.UploadName,
 		&mediaMetadata.Base64Hash,
 		&mediaMetadata.UserID,
+		&mediaMetadata.Encryption,
+		&mediaMetadata.Disposition,
 	)
 	return &mediaMetadata, err
 }
@@ -136,7 +251,7 @@ func (s *mediaStatements) selectMediaByHash(
 		Base64Hash: mediaHash,
 		Origin:     mediaOrigin,
 	}
-	err := s.selectMediaStmt.QueryRowContext(
+	err := s.selectMediaByHashStmt.QueryRowContext(
 		ctx, mediaMetadata.Base64Hash, mediaMetadata.Origin,
 	).Scan(
 		&mediaMetadata.ContentType,
@@ -145,6 +260,189 @@ func (s *mediaStatements) selectMediaByHash(
 		&mediaMetadata.UploadName,
 		&mediaMetadata.MediaID,
 		&mediaMetadata.UserID,
+		&mediaMetadata.Encryption,
+		&mediaMetadata.Disposition,
 	)
 	return &mediaMetadata, err
 }
+
+func (s *mediaStatements) selectMediaByHashAndUser(
+	ctx context.Context, mediaHash types.Base64Hash, mediaOrigin gomatrixserverlib.ServerName, userID types.MatrixUserID,
+) (*types.MediaMetadata, error) {
+	mediaMetadata := types.MediaMetadata{
+		Base64Hash: mediaHash,
+		Origin:     mediaOrigin,
+		UserID:     userID,
+	}
+	err := s.selectMediaByHashAndUserStmt.QueryRowContext(
+		ctx, mediaMetadata.Base64Hash, mediaMetadata.Origin, mediaMetadata.UserID,
+	).Scan(
+		&mediaMetadata.ContentType,
+		&mediaMetadata.FileSizeBytes,
+		&mediaMetadata.CreationTimestamp,
+		&mediaMetadata.UploadName,
+		&mediaMetadata.MediaID,
+		&mediaMetadata.Encryption,
+		&mediaMetadata.Disposition,
+	)
+	return &mediaMetadata, err
+}
+
+func (s *mediaStatements) selectMediaByUser(
+	ctx context.Context, userID types.MatrixUserID, mediaOrigin gomatrixserverlib.ServerName,
+	afterMediaID types.MediaID, limit int,
+) ([]*types.MediaMetadata, error) {
+	rows, err := s.selectMediaByUserStmt.QueryContext(ctx, userID, mediaOrigin, afterMediaID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectMediaByUser: rows.close() failed")
+
+	var media []*types.MediaMetadata
+	for rows.Next() {
+		mediaMetadata := types.MediaMetadata{
+			Origin: mediaOrigin,
+			UserID: userID,
+		}
+		err = rows.Scan(
+			&mediaMetadata.MediaID,
+			&mediaMetadata.ContentType,
+			&mediaMetadata.FileSizeBytes,
+			&mediaMetadata.CreationTimestamp,
+			&mediaMetadata.UploadName,
+			&mediaMetadata.Base64Hash,
+			&mediaMetadata.Encryption,
+			&mediaMetadata.Disposition,
+		)
+		if err != nil {
+			return nil, err
+		}
+		media = append(media, &mediaMetadata)
+	}
+	return media, rows.Err()
+}
+
+func (s *mediaStatements) selectMediaAfter(
+	ctx context.Context, afterOrigin gomatrixserverlib.ServerName, afterMediaID types.MediaID, limit int,
+) ([]*types.MediaMetadata, error) {
+	rows, err := s.selectMediaAfterStmt.QueryContext(ctx, afterOrigin, afterMediaID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectMediaAfter: rows.close() failed")
+
+	var media []*types.MediaMetadata
+	for rows.Next() {
+		var mediaMetadata types.MediaMetadata
+		err = rows.Scan(
+			&mediaMetadata.MediaID,
+			&mediaMetadata.Origin,
+			&mediaMetadata.ContentType,
+			&mediaMetadata.FileSizeBytes,
+			&mediaMetadata.CreationTimestamp,
+			&mediaMetadata.UploadName,
+			&mediaMetadata.Base64Hash,
+			&mediaMetadata.UserID,
+			&mediaMetadata.Encryption,
+			&mediaMetadata.Disposition,
+		)
+		if err != nil {
+			return nil, err
+		}
+		media = append(media, &mediaMetadata)
+	}
+	return media, rows.Err()
+}
+
+func (s *mediaStatements) selectMediaDeletedBefore(
+	ctx context.Context, deletedBefore types.UnixMs, limit int,
+) ([]*types.MediaMetadata, error) {
+	rows, err := s.selectMediaDeletedBeforeStmt.QueryContext(ctx, deletedBefore, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectMediaDeletedBefore: rows.close() failed")
+
+	var media []*types.MediaMetadata
+	for rows.Next() {
+		var mediaMetadata types.MediaMetadata
+		err = rows.Scan(
+			&mediaMetadata.MediaID,
+			&mediaMetadata.Origin,
+			&mediaMetadata.ContentType,
+			&mediaMetadata.FileSizeBytes,
+			&mediaMetadata.CreationTimestamp,
+			&mediaMetadata.UploadName,
+			&mediaMetadata.Base64Hash,
+			&mediaMetadata.UserID,
+			&mediaMetadata.Encryption,
+			&mediaMetadata.Disposition,
+		)
+		if err != nil {
+			return nil, err
+		}
+		media = append(media, &mediaMetadata)
+	}
+	return media, rows.Err()
+}
+
+func (s *mediaStatements) selectFileEncryption(
+	ctx context.Context, mediaHash types.Base64Hash,
+) (encryption types.Encryption, err error) {
+	err = s.selectFileEncryptionStmt.QueryRowContext(ctx, mediaHash).Scan(&encryption)
+	if err == sql.ErrNoRows {
+		return types.EncryptionUnknown, nil
+	}
+	return
+}
+
+func (s *mediaStatements) countMediaByHash(
+	ctx context.Context, mediaHash types.Base64Hash,
+) (count int64, err error) {
+	err = s.countMediaByHashStmt.QueryRowContext(ctx, mediaHash).Scan(&count)
+	return
+}
+
+func (s *mediaStatements) countMediaByHashExcludingUser(
+	ctx context.Context, mediaHash types.Base64Hash, userID types.MatrixUserID,
+) (count int64, err error) {
+	err = s.countMediaByHashExcludingUserStmt.QueryRowContext(ctx, mediaHash, userID).Scan(&count)
+	return
+}
+
+func (s *mediaStatements) deleteMedia(
+	ctx context.Context, txn *sql.Tx, mediaID types.MediaID, mediaOrigin gomatrixserverlib.ServerName,
+) error {
+	stmt := sqlutil.TxStmt(txn, s.deleteMediaStmt)
+	_, err := stmt.ExecContext(ctx, mediaID, mediaOrigin)
+	return err
+}
+
+func (s *mediaStatements) softDeleteMedia(
+	ctx context.Context, txn *sql.Tx, mediaID types.MediaID, mediaOrigin gomatrixserverlib.ServerName, deletedTs types.UnixMs,
+) error {
+	_, err := sqlutil.TxStmt(txn, s.softDeleteMediaStmt).ExecContext(ctx, deletedTs, mediaID, mediaOrigin)
+	return err
+}
+
+func (s *mediaStatements) undeleteMedia(
+	ctx context.Context, txn *sql.Tx, mediaID types.MediaID, mediaOrigin gomatrixserverlib.ServerName,
+) (bool, error) {
+	res, err := sqlutil.TxStmt(txn, s.undeleteMediaStmt).ExecContext(ctx, mediaID, mediaOrigin)
+	if err != nil {
+		return false, err
+	}
+	updated, err := res.RowsAffected()
+	return updated > 0, err
+}
+
+func (s *mediaStatements) deleteDeletedMedia(
+	ctx context.Context, txn *sql.Tx, mediaID types.MediaID, mediaOrigin gomatrixserverlib.ServerName, deletedBefore types.UnixMs,
+) (bool, error) {
+	res, err := sqlutil.TxStmt(txn, s.deleteDeletedMediaStmt).ExecContext(ctx, mediaID, mediaOrigin, deletedBefore)
+	if err != nil {
+		return false, err
+	}
+	deleted, err := res.RowsAffected()
+	return deleted > 0, err
+}
@@ -36,3 +36,27 @@ func (s statementList) prepare(db *sql.DB) (err error) {
 	}
 	return
 }
+
+// addColumn adds the column to the table, which may have been created before the
+// column was, if the table doesn't have it yet. SQLite has no ADD COLUMN IF NOT EXISTS.
+func addColumn(db *sql.DB, table, column, definition string) error {
+	rows, err := db.Query("SELECT name FROM pragma_table_info($1)", table)
+	if err != nil {
+		return err
+	}
+	defer rows.Close() // nolint: errcheck
+	for rows.Next() {
+		var name string
+		if err = rows.Scan(&name); err != nil {
+			return err
+		}
+		if name == column {
+			return nil
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	_, err = db.Exec("ALTER TABLE " + table + " ADD COLUMN " + column + " " + definition)
+	return err
+}
@@ -22,8 +22,13 @@ import (
 )
 
 type statements struct {
-	media     mediaStatements
-	thumbnail thumbnailStatements
+	media       mediaStatements
+	thumbnail   thumbnailStatements
+	reservation mediaReservationStatements
+	access      mediaAccessStatements
+	traffic     userTrafficStatements
+	usage       storageUsageStatements
+	report      mediaReportStatements
 }
 
 func (s *statements) prepare(db *sql.DB, writer sqlutil.Writer) (err error) {
@@ -33,6 +38,21 @@ func (s *statements) prepare(db *sql.DB, writer sqlutil.Writer) (err error) {
 	if err = s.thumbnail.prepare(db, writer); err != nil {
 		return
 	}
+	if err = s.reservation.prepare(db, writer); err != nil {
+		return
+	}
+	if err = s.access.prepare(db, writer); err != nil {
+		return
+	}
+	if err = s.traffic.prepare(db, writer); err != nil {
+		return
+	}
+	if err = s.usage.prepare(db, writer); err != nil {
+		return
+	}
+	if err = s.report.prepare(db, writer); err != nil {
+		return
+	}
 
 	return
 }
@@ -54,7 +54,36 @@ func Open(dbProperties *config.DatabaseOptions) (*Database, error) {
 func (d *Database) StoreMediaMetadata(
 	ctx context.Context, mediaMetadata *types.MediaMetadata,
 ) error {
-	return d.statements.media.insertMedia(ctx, mediaMetadata)
+	return d.writer.Do(d.db, nil, func(txn *sql.Tx) error {
+		return d.statements.media.insertMedia(ctx, txn, mediaMetadata)
+	})
+}
+
+// ReplaceMediaMetadata stores the metadata about the uploaded media in place of any
+// which is already stored for its MediaID and Origin, removing the thumbnails and the
+// last access of what was there before in the same transaction. Returns the metadata
+// which was replaced, or nil if there was none.
+func (d *Database) ReplaceMediaMetadata(
+	ctx context.Context, mediaMetadata *types.MediaMetadata,
+) (*types.MediaMetadata, error) {
+	var replaced *types.MediaMetadata
+	err := d.writer.Do(d.db, nil, func(txn *sql.Tx) error {
+		old, err := d.statements.media.selectMedia(ctx, txn, mediaMetadata.MediaID, mediaMetadata.Origin)
+		if err != nil && err != sql.ErrNoRows {
+			return err
+		}
+		if err == nil {
+			if err = d.deleteMedia(ctx, txn, old.MediaID, old.Origin); err != nil {
+				return err
+			}
+			replaced = old
+		}
+		return d.statements.media.insertMedia(ctx, txn, mediaMetadata)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return replaced, nil
 }
 
 // GetMediaMetadata returns metadata about media stored on this server.
@@ -63,7 +92,7 @@ func (d *Database) StoreMediaMetadata(
 func (d *Database) GetMediaMetadata(
 	ctx context.Context, mediaID types.MediaID, mediaOrigin gomatrixserverlib.ServerName,
 ) (*types.MediaMetadata, error) {
-	mediaMetadata, err := d.statements.media.selectMedia(ctx, mediaID, mediaOrigin)
+	mediaMetadata, err := d.statements.media.selectMedia(ctx, nil, mediaID, mediaOrigin)
 	if err != nil && err == sql.ErrNoRows {
 		return nil, nil
 	}
@@ -83,6 +112,18 @@ func (d *Database) GetMediaMetadataByHash(
 	return mediaMetadata, err
 }
 
+// GetMediaMetadataByHashAndUser returns metadata about media with the hash which the
+// user uploaded to the origin. Returns nil metadata if they haven't uploaded any.
+func (d *Database) GetMediaMetadataByHashAndUser(
+	ctx context.Context, mediaHash types.Base64Hash, mediaOrigin gomatrixserverlib.ServerName, userID types.MatrixUserID,
+) (*types.MediaMetadata, error) {
+	mediaMetadata, err := d.statements.media.selectMediaByHashAndUser(ctx, mediaHash, mediaOrigin, userID)
+	if err != nil && err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return mediaMetadata, err
+}
+
 // StoreThumbnail inserts the metadata about the thumbnail into the database.
 // Returns an error if the combination of MediaID and Origin are not unique in the table.
 func (d *Database) StoreThumbnail(
@@ -99,10 +140,10 @@ func (d *Database) GetThumbnail(
 	mediaID types.MediaID,
 	mediaOrigin gomatrixserverlib.ServerName,
 	width, height int,
-	resizeMethod string,
+	resizeMethod, background string,
 ) (*types.ThumbnailMetadata, error) {
 	thumbnailMetadata, err := d.statements.thumbnail.selectThumbnail(
-		ctx, mediaID, mediaOrigin, width, height, resizeMethod,
+		ctx, mediaID, mediaOrigin, width, height, resizeMethod, background,
 	)
 	if err != nil && err == sql.ErrNoRows {
 		return nil, nil
@@ -122,3 +163,229 @@ func (d *Database) GetThumbnails(
 	}
 	return thumbnails, err
 }
+
+// StoreMediaReservation records that a media ID has been reserved by a user.
+// Returns an error if the combination of MediaID and Origin are not unique in the table.
+func (d *Database) StoreMediaReservation(
+	ctx context.Context, reservation *types.MediaReservation,
+) error {
+	return d.statements.reservation.insertMediaReservation(ctx, reservation)
+}
+
+// GetMediaReservation returns the reservation for a media ID which has not been uploaded to yet.
+// Returns nil if there is no such reservation.
+func (d *Database) GetMediaReservation(
+	ctx context.Context, mediaID types.MediaID, mediaOrigin gomatrixserverlib.ServerName,
+) (*types.MediaReservation, error) {
+	reservation, err := d.statements.reservation.selectMediaReservation(ctx, mediaID, mediaOrigin)
+	if err != nil && err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return reservation, err
+}
+
+// DeleteMediaReservation removes the reservation for a media ID, e.g. once it has been uploaded to.
+func (d *Database) DeleteMediaReservation(
+	ctx context.Context, mediaID types.MediaID, mediaOrigin gomatrixserverlib.ServerName,
+) error {
+	return d.statements.reservation.deleteMediaReservation(ctx, mediaID, mediaOrigin)
+}
+
+// DeleteExpiredMediaReservations removes all reservations which expired before the given time.
+// Returns the number of reservations which were removed.
+func (d *Database) DeleteExpiredMediaReservations(
+	ctx context.Context, expiredBefore types.UnixMs,
+) (int64, error) {
+	return d.statements.reservation.deleteExpiredMediaReservations(ctx, expiredBefore)
+}
+
+// UpdateMediaAccess records that the media was accessed at the given time and adds
+// to the number of times it was downloaded. The stored time is never moved backwards.
+func (d *Database) UpdateMediaAccess(
+	ctx context.Context, mediaID types.MediaID, mediaOrigin gomatrixserverlib.ServerName,
+	lastAccess types.UnixMs, downloads int64,
+) error {
+	return d.statements.access.upsertMediaAccess(ctx, mediaID, mediaOrigin, lastAccess, downloads)
+}
+
+// GetMediaAccess returns when the media was last accessed and how many times it was
+// downloaded. Both are 0 if the media has never been accessed.
+func (d *Database) GetMediaAccess(
+	ctx context.Context, mediaID types.MediaID, mediaOrigin gomatrixserverlib.ServerName,
+) (*types.MediaAccess, error) {
+	access, err := d.statements.access.selectMediaAccess(ctx, mediaID, mediaOrigin)
+	if err != nil && err == sql.ErrNoRows {
+		return &types.MediaAccess{}, nil
+	}
+	return access, err
+}
+
+// GetMediaByUser returns up to limit media uploaded by the user to the origin, in
+// order of media ID and starting after afterMediaID, which may be empty.
+func (d *Database) GetMediaByUser(
+	ctx context.Context, userID types.MatrixUserID, mediaOrigin gomatrixserverlib.ServerName,
+	afterMediaID types.MediaID, limit int,
+) ([]*types.MediaMetadata, error) {
+	return d.statements.media.selectMediaByUser(ctx, userID, mediaOrigin, afterMediaID, limit)
+}
+
+// GetMediaAfter returns up to limit media from any origin, in order of origin and
+// then media ID, starting after afterOrigin and afterMediaID, which may be empty.
+// Unlike the other lookups, this includes media which was soft deleted.
+func (d *Database) GetMediaAfter(
+	ctx context.Context, afterOrigin gomatrixserverlib.ServerName, afterMediaID types.MediaID, limit int,
+) ([]*types.MediaMetadata, error) {
+	return d.statements.media.selectMediaAfter(ctx, afterOrigin, afterMediaID, limit)
+}
+
+// GetFileEncryption returns whether the file with the hash, which is shared by all
+// media with that hash, is encrypted in the media store. It is EncryptionUnknown if
+// no media with the hash recorded it.
+func (d *Database) GetFileEncryption(
+	ctx context.Context, mediaHash types.Base64Hash,
+) (types.Encryption, error) {
+	return d.statements.media.selectFileEncryption(ctx, mediaHash)
+}
+
+// CountMediaByHash returns how many media from any origin use the file with the hash.
+func (d *Database) CountMediaByHash(
+	ctx context.Context, mediaHash types.Base64Hash,
+) (int64, error) {
+	return d.statements.media.countMediaByHash(ctx, mediaHash)
+}
+
+// CountMediaByHashExcludingUser returns how many media with the hash were not uploaded
+// by the user, i.e. whether anything else still needs the file with that hash.
+func (d *Database) CountMediaByHashExcludingUser(
+	ctx context.Context, mediaHash types.Base64Hash, userID types.MatrixUserID,
+) (int64, error) {
+	return d.statements.media.countMediaByHashExcludingUser(ctx, mediaHash, userID)
+}
+
+// DeleteMedia removes the metadata about the media along with its thumbnails and
+// when it was last accessed. The files themselves are not removed.
+func (d *Database) DeleteMedia(
+	ctx context.Context, mediaID types.MediaID, mediaOrigin gomatrixserverlib.ServerName,
+) error {
+	return d.writer.Do(d.db, nil, func(txn *sql.Tx) error {
+		return d.deleteMedia(ctx, txn, mediaID, mediaOrigin)
+	})
+}
+
+func (d *Database) deleteMedia(
+	ctx context.Context, txn *sql.Tx, mediaID types.MediaID, mediaOrigin gomatrixserverlib.ServerName,
+) error {
+	if err := d.statements.thumbnail.deleteThumbnails(ctx, txn, mediaID, mediaOrigin); err != nil {
+		return err
+	}
+	if err := d.statements.access.deleteMediaLastAccess(ctx, txn, mediaID, mediaOrigin); err != nil {
+		return err
+	}
+	return d.statements.media.deleteMedia(ctx, txn, mediaID, mediaOrigin)
+}
+
+// SoftDeleteMedia marks the media deleted at deletedTs, so that it is no longer returned
+// by GetMediaMetadata and the other lookups but can still be undeleted. Media which is
+// already deleted keeps the time it was first deleted.
+func (d *Database) SoftDeleteMedia(
+	ctx context.Context, mediaID types.MediaID, mediaOrigin gomatrixserverlib.ServerName, deletedTs types.UnixMs,
+) error {
+	return d.writer.Do(d.db, nil, func(txn *sql.Tx) error {
+		return d.statements.media.softDeleteMedia(ctx, txn, mediaID, mediaOrigin, deletedTs)
+	})
+}
+
+// UndeleteMedia restores media which was soft deleted. Returns false if there is no
+// soft deleted media with the MediaID and Origin.
+func (d *Database) UndeleteMedia(
+	ctx context.Context, mediaID types.MediaID, mediaOrigin gomatrixserverlib.ServerName,
+) (undeleted bool, err error) {
+	err = d.writer.Do(d.db, nil, func(txn *sql.Tx) error {
+		undeleted, err = d.statements.media.undeleteMedia(ctx, txn, mediaID, mediaOrigin)
+		return err
+	})
+	return
+}
+
+// GetMediaDeletedBefore returns up to limit media which was soft deleted before the
+// given time, starting with what was deleted longest ago.
+func (d *Database) GetMediaDeletedBefore(
+	ctx context.Context, deletedBefore types.UnixMs, limit int,
+) ([]*types.MediaMetadata, error) {
+	return d.statements.media.selectMediaDeletedBefore(ctx, deletedBefore, limit)
+}
+
+// DeleteDeletedMedia removes the metadata about the media along with its thumbnails and
+// when it was last accessed, as DeleteMedia does, but only if it is soft deleted and was
+// deleted before the given time. Returns whether it was removed.
+func (d *Database) DeleteDeletedMedia(
+	ctx context.Context, mediaID types.MediaID, mediaOrigin gomatrixserverlib.ServerName, deletedBefore types.UnixMs,
+) (deleted bool, err error) {
+	err = d.writer.Do(d.db, nil, func(txn *sql.Tx) error {
+		deleted, err = d.statements.media.deleteDeletedMedia(ctx, txn, mediaID, mediaOrigin, deletedBefore)
+		if err != nil || !deleted {
+			return err
+		}
+		return d.deleteMedia(ctx, txn, mediaID, mediaOrigin)
+	})
+	return
+}
+
+// AddUserTraffic adds to the bytes uploaded by the user, and the bytes of their media
+// which were served, in the hour containing ts.
+func (d *Database) AddUserTraffic(
+	ctx context.Context, userID types.MatrixUserID, ts types.UnixMs, bytesUploaded, bytesServed int64,
+) error {
+	return d.statements.traffic.upsertUserTraffic(ctx, userID, ts, bytesUploaded, bytesServed)
+}
+
+// GetUserTraffic returns the total traffic of the user in every hour which overlaps
+// the time from fromTs up to toTs, as traffic is only counted by the hour.
+func (d *Database) GetUserTraffic(
+	ctx context.Context, userID types.MatrixUserID, fromTs, toTs types.UnixMs,
+) (*types.UserTraffic, error) {
+	return d.statements.traffic.selectUserTraffic(ctx, userID, fromTs, toTs)
+}
+
+// AddStoredBytes adds to the total size of the stored files, or takes away from it if
+// bytes is negative. The total never goes below 0.
+func (d *Database) AddStoredBytes(ctx context.Context, bytes int64) error {
+	return d.statements.usage.addStorageUsage(ctx, bytes)
+}
+
+// ReserveStoredBytes adds to the total size of the stored files, unless that would
+// take it over limit. Returns whether it was added to.
+func (d *Database) ReserveStoredBytes(ctx context.Context, bytes, limit int64) (bool, error) {
+	return d.statements.usage.reserveStorageUsage(ctx, bytes, limit)
+}
+
+// GetStoredBytes returns the total size of the stored files which media refers to.
+func (d *Database) GetStoredBytes(ctx context.Context) (int64, error) {
+	return d.statements.usage.selectStorageUsage(ctx)
+}
+
+// RecomputeStoredBytes sets the total size of the stored files to the sum of the sizes
+// of the files which media refers to, e.g. if files were changed outside the server.
+// Returns the new total.
+func (d *Database) RecomputeStoredBytes(ctx context.Context) (int64, error) {
+	return d.statements.usage.recomputeStorageUsage(ctx)
+}
+
+// StoreMediaReport stores a user's report of media, replacing any report they
+// made of it before.
+func (d *Database) StoreMediaReport(ctx context.Context, report *types.MediaReport) error {
+	return d.statements.report.upsertMediaReport(ctx, report)
+}
+
+// GetMediaReports returns up to limit reports with IDs after afterReportID, in the
+// order of their IDs.
+func (d *Database) GetMediaReports(
+	ctx context.Context, afterReportID int64, limit int,
+) ([]*types.MediaReport, error) {
+	return d.statements.report.selectMediaReports(ctx, afterReportID, limit)
+}
+
+// Ping checks that the database can still be reached.
+func (d *Database) Ping(ctx context.Context) error {
+	return d.db.PingContext(ctx)
+}
@@ -37,24 +37,36 @@ CREATE TABLE IF NOT EXISTS mediaapi_thumbnail (
     creation_ts INTEGER NOT NULL,
     width INTEGER NOT NULL,
     height INTEGER NOT NULL,
-    resize_method TEXT NOT NULL
+    resize_method TEXT NOT NULL,
+    encrypted BOOLEAN,
+    background TEXT NOT NULL DEFAULT ''
 );
-CREATE UNIQUE INDEX IF NOT EXISTS mediaapi_thumbnail_index ON mediaapi_thumbnail (media_id, media_origin, width, height, resize_method);
+`
+
+// Padded thumbnails of the same size with different backgrounds are different thumbnails,
+// so the index over the size replaces the one created before they could be padded.
+const thumbnailIndexSchema = `
+DROP INDEX IF EXISTS mediaapi_thumbnail_index;
+CREATE UNIQUE INDEX IF NOT EXISTS mediaapi_thumbnail_size_index ON mediaapi_thumbnail (media_id, media_origin, width, height, resize_method, background);
 `
 
 const insertThumbnailSQL = `
-INSERT INTO mediaapi_thumbnail (media_id, media_origin, content_type, file_size_bytes, creation_ts, width, height, resize_method)
-    VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+INSERT INTO mediaapi_thumbnail (media_id, media_origin, content_type, file_size_bytes, creation_ts, width, height, resize_method, encrypted, background)
+    VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
 `
 
 // Note: this selects one specific thumbnail
 const selectThumbnailSQL = `
-SELECT content_type, file_size_bytes, creation_ts FROM mediaapi_thumbnail WHERE media_id = $1 AND media_origin = $2 AND width = $3 AND height = $4 AND resize_method = $5
+SELECT content_type, file_size_bytes, creation_ts, encrypted FROM mediaapi_thumbnail WHERE media_id = $1 AND media_origin = $2 AND width = $3 AND height = $4 AND resize_method = $5 AND background = $6
 `
 
 // Note: this selects all thumbnails for a media_origin and media_id
 const selectThumbnailsSQL = `
-SELECT content_type, file_size_bytes, creation_ts, width, height, resize_method FROM mediaapi_thumbnail WHERE media_id = $1 AND media_origin = $2
+SELECT content_type, file_size_bytes, creation_ts, width, height, resize_method, encrypted, background FROM mediaapi_thumbnail WHERE media_id = $1 AND media_origin = $2
+`
+
+const deleteThumbnailsSQL = `
+DELETE FROM mediaapi_thumbnail WHERE media_id = $1 AND media_origin = $2
 `
 
 type thumbnailStatements struct {
@@ -63,6 +75,7 @@ type thumbnailStatements struct {
 	insertThumbnailStmt  *sql.Stmt
 	selectThumbnailStmt  *sql.Stmt
 	selectThumbnailsStmt *sql.Stmt
+	deleteThumbnailsStmt *sql.Stmt
 }
 
 func (s *thumbnailStatements) prepare(db *sql.DB, writer sqlutil.Writer) (err error) {
@@ -70,6 +83,17 @@ func (s *thumbnailStatements) prepare(db *sql.DB, writer sqlutil.Writer) (err er
 	if err != nil {
 		return
 	}
+	// Tables created before whether thumbnails are encrypted was recorded don't have encrypted yet.
+	if err = addColumn(db, "mediaapi_thumbnail", "encrypted", "BOOLEAN"); err != nil {
+		return
+	}
+	// Tables created before thumbnails could be padded don't have background yet.
+	if err = addColumn(db, "mediaapi_thumbnail", "background", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		return
+	}
+	if _, err = db.Exec(thumbnailIndexSchema); err != nil {
+		return
+	}
 	s.db = db
 	s.writer = writer
 
@@ -77,6 +101,7 @@ func (s *thumbnailStatements) prepare(db *sql.DB, writer sqlutil.Writer) (err er
 		{&s.insertThumbnailStmt, insertThumbnailSQL},
 		{&s.selectThumbnailStmt, selectThumbnailSQL},
 		{&s.selectThumbnailsStmt, selectThumbnailsSQL},
+		{&s.deleteThumbnailsStmt, deleteThumbnailsSQL},
 	}.prepare(db)
 }
 
@@ -96,6 +121,8 @@ func (s *thumbnailStatements) insertThumbnail(
 			thumbnailMetadata.ThumbnailSize.Width,
 			thumbnailMetadata.ThumbnailSize.Height,
 			thumbnailMetadata.ThumbnailSize.ResizeMethod,
+			thumbnailMetadata.MediaMetadata.Encryption,
+			thumbnailMetadata.ThumbnailSize.Background,
 		)
 		return err
 	})
@@ -106,7 +133,7 @@ func (s *thumbnailStatements) selectThumbnail(
 	mediaID types.MediaID,
 	mediaOrigin gomatrixserverlib.ServerName,
 	width, height int,
-	resizeMethod string,
+	resizeMethod, background string,
 ) (*types.ThumbnailMetadata, error) {
 	thumbnailMetadata := types.ThumbnailMetadata{
 		MediaMetadata: &types.MediaMetadata{
@@ -117,6 +144,7 @@ func (s *thumbnailStatements) selectThumbnail(
 			Width:        width,
 			Height:       height,
 			ResizeMethod: resizeMethod,
+			Background:   background,
 		},
 	}
 	err := s.selectThumbnailStmt.QueryRowContext(
@@ -126,10 +154,12 @@ func (s *thumbnailStatements) selectThumbnail(
 		thumbnailMetadata.ThumbnailSize.Width,
 		thumbnailMetadata.ThumbnailSize.Height,
 		thumbnailMetadata.ThumbnailSize.ResizeMethod,
+		thumbnailMetadata.ThumbnailSize.Background,
 	).Scan(
 		&thumbnailMetadata.MediaMetadata.ContentType,
 		&thumbnailMetadata.MediaMetadata.FileSizeBytes,
 		&thumbnailMetadata.MediaMetadata.CreationTimestamp,
+		&thumbnailMetadata.MediaMetadata.Encryption,
 	)
 	return &thumbnailMetadata, err
 }
@@ -160,6 +190,8 @@ func (s *thumbnailStatements) selectThumbnails(
 			&thumbnailMetadata.ThumbnailSize.Width,
 			&thumbnailMetadata.ThumbnailSize.Height,
 			&thumbnailMetadata.ThumbnailSize.ResizeMethod,
+			&thumbnailMetadata.MediaMetadata.Encryption,
+			&thumbnailMetadata.ThumbnailSize.Background,
 		)
 		if err != nil {
 			return nil, err
@@ -169,3 +201,11 @@ func (s *thumbnailStatements) selectThumbnails(
 
 	return thumbnails, rows.Err()
 }
+
+func (s *thumbnailStatements) deleteThumbnails(
+	ctx context.Context, txn *sql.Tx, mediaID types.MediaID, mediaOrigin gomatrixserverlib.ServerName,
+) error {
+	stmt := sqlutil.TxStmt(txn, s.deleteThumbnailsStmt)
+	_, err := stmt.ExecContext(ctx, mediaID, mediaOrigin)
+	return err
+}
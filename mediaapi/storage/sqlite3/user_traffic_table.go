@@ -0,0 +1,100 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite3
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/mediaapi/types"
+)
+
+// userTrafficBucketMs is how long each row of the mediaapi_user_traffic table
+// counts traffic for.
+const userTrafficBucketMs = 60 * 60 * 1000
+
+const userTrafficSchema = `
+-- The mediaapi_user_traffic table records how much each user uploaded, and how
+-- much of the media they uploaded was served, by the hour.
+CREATE TABLE IF NOT EXISTS mediaapi_user_traffic (
+    -- The user who uploaded the media, as in the mediaapi_media_repository table.
+    user_id TEXT NOT NULL,
+    -- The start of the hour in UNIX epoch ms.
+    hour_ts INTEGER NOT NULL,
+    -- The total size of the files uploaded by the user in the hour.
+    bytes_uploaded INTEGER NOT NULL,
+    -- The total size of the responses to downloads of the user's media in the hour.
+    bytes_served INTEGER NOT NULL
+);
+CREATE UNIQUE INDEX IF NOT EXISTS mediaapi_user_traffic_index ON mediaapi_user_traffic (user_id, hour_ts);
+`
+
+const upsertUserTrafficSQL = `
+INSERT INTO mediaapi_user_traffic (user_id, hour_ts, bytes_uploaded, bytes_served)
+    VALUES ($1, $2, $3, $4)
+    ON CONFLICT (user_id, hour_ts)
+    DO UPDATE SET bytes_uploaded = bytes_uploaded + excluded.bytes_uploaded,
+        bytes_served = bytes_served + excluded.bytes_served
+`
+
+const selectUserTrafficSQL = `
+SELECT COALESCE(SUM(bytes_uploaded), 0), COALESCE(SUM(bytes_served), 0) FROM mediaapi_user_traffic
+    WHERE user_id = $1 AND hour_ts > $2 AND hour_ts < $3
+`
+
+type userTrafficStatements struct {
+	db                    *sql.DB
+	writer                sqlutil.Writer
+	upsertUserTrafficStmt *sql.Stmt
+	selectUserTrafficStmt *sql.Stmt
+}
+
+func (s *userTrafficStatements) prepare(db *sql.DB, writer sqlutil.Writer) (err error) {
+	s.db = db
+	s.writer = writer
+
+	_, err = db.Exec(userTrafficSchema)
+	if err != nil {
+		return
+	}
+
+	return statementList{
+		{&s.upsertUserTrafficStmt, upsertUserTrafficSQL},
+		{&s.selectUserTrafficStmt, selectUserTrafficSQL},
+	}.prepare(db)
+}
+
+func (s *userTrafficStatements) upsertUserTraffic(
+	ctx context.Context, userID types.MatrixUserID, ts types.UnixMs, bytesUploaded, bytesServed int64,
+) error {
+	hourTs := ts - ts%userTrafficBucketMs
+	return s.writer.Do(s.db, nil, func(txn *sql.Tx) error {
+		stmt := sqlutil.TxStmt(txn, s.upsertUserTrafficStmt)
+		_, err := stmt.ExecContext(ctx, userID, hourTs, bytesUploaded, bytesServed)
+		return err
+	})
+}
+
+func (s *userTrafficStatements) selectUserTraffic(
+	ctx context.Context, userID types.MatrixUserID, fromTs, toTs types.UnixMs,
+) (*types.UserTraffic, error) {
+	// Hours which start after fromTs-1h and before toTs overlap the time between them.
+	var traffic types.UserTraffic
+	err := s.selectUserTrafficStmt.QueryRowContext(
+		ctx, userID, fromTs-userTrafficBucketMs, toTs,
+	).Scan(&traffic.BytesUploaded, &traffic.BytesServed)
+	return &traffic, err
+}
@@ -0,0 +1,201 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package thumbnailer
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	// Imported for png codec, which the page is rendered as
+	_ "image/png"
+
+	"github.com/matrix-org/dendrite/internal/config"
+	"github.com/matrix-org/dendrite/mediaapi/fileutils"
+	"github.com/matrix-org/dendrite/mediaapi/types"
+	log "github.com/sirupsen/logrus"
+)
+
+// pdfPageFilename is the name of the file, next to the PDF in the media store, which
+// the rendered first page is kept in so that each thumbnail size doesn't render it again.
+const pdfPageFilename = "pdf-page-1"
+
+// ErrPDFRendererUnavailable is returned by RenderPDFPage when the renderer command can't
+// be found, in which case the PDF should be treated like any other file which isn't an image.
+var ErrPDFRendererUnavailable = errors.New("PDF renderer is not available")
+
+// IsPDF returns whether media with the content type is a PDF.
+func IsPDF(contentType types.ContentType) bool {
+	return strings.ToLower(strings.TrimSpace(strings.Split(string(contentType), ";")[0])) == "application/pdf"
+}
+
+// RenderPDFPage renders the first page of the PDF at src as a PNG image, stored next to
+// it, and returns the path to the image so that thumbnails can be generated from it.
+// Thumbnails generated from the image are stored in the same directory as they would
+// be for the PDF itself. Rendering counts towards the maximum number of thumbnail
+// generators, and busy is returned if there are already too many. The page is rendered
+// with the configured pdftoppm compatible command, which is killed if it takes longer
+// than the timeout, and no larger than the maximum size so that decoding it is bounded
+// too.
+func RenderPDFPage(
+	ctx context.Context,
+	src types.Path,
+	cfg config.PDFThumbnails,
+	mediaMetadata *types.MediaMetadata,
+	activeThumbnailGeneration *types.ActiveThumbnailGeneration,
+	maxThumbnailGenerators int,
+	encryptionKey *fileutils.EncryptionKey,
+	logger *log.Entry,
+) (page types.Path, busy bool, errorReturn error) {
+	dir := filepath.Dir(string(src))
+	dst := types.Path(filepath.Join(dir, pdfPageFilename))
+	if _, err := os.Stat(string(dst)); err == nil {
+		return dst, false, nil
+	}
+	command, err := exec.LookPath(cfg.Command)
+	if err != nil {
+		return "", false, ErrPDFRendererUnavailable
+	}
+
+	// Requests for different thumbnail sizes of the same PDF wait for it to be rendered once.
+	key := fmt.Sprintf("%s/%s", mediaMetadata.Base64Hash, pdfPageFilename)
+	isActive, busy, err := getActiveThumbnailGeneration(key, types.ThumbnailSize{}, activeThumbnailGeneration, maxThumbnailGenerators, logger)
+	if err != nil || busy {
+		return "", busy, err
+	}
+	if !isActive {
+		// Another goroutine has just rendered it.
+		return dst, false, nil
+	}
+	defer func() {
+		broadcastGeneration(key, activeThumbnailGeneration, types.ThumbnailSize{}, errorReturn, logger)
+	}()
+
+	start := time.Now()
+	if err = renderPDFPage(ctx, command, src, mediaMetadata.Encryption, dst, cfg, encryptionKey); err != nil {
+		return "", false, err
+	}
+	logger.WithField("processTime", time.Since(start)).Info("Rendered first page of PDF")
+	return dst, false, nil
+}
+
+func renderPDFPage(
+	ctx context.Context, command string, src types.Path, srcEncryption types.Encryption, dst types.Path,
+	cfg config.PDFThumbnails, encryptionKey *fileutils.EncryptionKey,
+) error {
+	in, _, err := fileutils.OpenFile(src, srcEncryption, encryptionKey)
+	if err != nil {
+		return err
+	}
+	defer in.Close() // nolint: errcheck
+
+	ctx, cancel := context.WithTimeout(ctx, cfg.Timeout)
+	defer cancel()
+	// The PDF is given on stdin, as it may be encrypted at rest, and with a single page
+	// and no output file name the image is written to stdout.
+	cmd := exec.CommandContext(
+		ctx, command, "-png", "-singlefile", "-f", "1", "-l", "1",
+		"-scale-to", strconv.Itoa(cfg.MaxSize), "-",
+	)
+	// A PNG of the maximum size can't be larger than its raw pixels plus some overhead.
+	stdout := &limitedBuffer{remaining: 4*cfg.MaxSize*cfg.MaxSize + 1024*1024}
+	stderr := &limitedBuffer{remaining: 4096}
+	cmd.Stdin = in
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	if err = cmd.Run(); err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			return fmt.Errorf("rendering PDF took longer than %s", cfg.Timeout)
+		}
+		return fmt.Errorf("failed to render PDF: %w: %s", err, strings.TrimSpace(stderr.buffer.String()))
+	}
+
+	page, format, err := image.DecodeConfig(bytes.NewReader(stdout.buffer.Bytes()))
+	if err != nil {
+		return fmt.Errorf("PDF renderer gave an invalid image: %w", err)
+	}
+	if format != "png" || page.Width > cfg.MaxSize || page.Height > cfg.MaxSize {
+		return fmt.Errorf("PDF renderer gave a %dx%d %s image, not a PNG within %d pixels", page.Width, page.Height, format, cfg.MaxSize)
+	}
+
+	// The image is written to a file of its own first and then moved into place, so
+	// that a partly written one is never taken to be the rendered page.
+	return writePDFPage(dst, stdout.buffer.Bytes(), encryptionKey)
+}
+
+func writePDFPage(dst types.Path, page []byte, encryptionKey *fileutils.EncryptionKey) (err error) {
+	tmpFile, err := ioutil.TempFile(filepath.Dir(string(dst)), pdfPageFilename+".tmp-")
+	if err != nil {
+		return err
+	}
+	tmpPath := tmpFile.Name()
+	defer func() {
+		if err != nil {
+			os.Remove(tmpPath) // nolint: errcheck
+		}
+	}()
+	if err = tmpFile.Close(); err != nil {
+		return err
+	}
+	out, err := fileutils.CreateFile(types.Path(tmpPath), encryptionKey)
+	if err != nil {
+		return err
+	}
+	if _, err = out.Write(page); err != nil {
+		out.Close() // nolint: errcheck
+		return err
+	}
+	if err = out.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, string(dst))
+}
+
+// sourceEncryption is the encryption of the file at src which thumbnails of the media
+// are generated from. The rendered first page of a PDF is not recorded in the database,
+// but it is a PNG, which starts with the PNG signature rather than the header of an
+// encrypted file, so it is safely told apart by its header.
+func sourceEncryption(src types.Path, mediaMetadata *types.MediaMetadata) types.Encryption {
+	if filepath.Base(string(src)) == pdfPageFilename {
+		return types.EncryptionUnknown
+	}
+	return mediaMetadata.Encryption
+}
+
+// limitedBuffer is a buffer which fails writes once more than its limit has been written
+// to it, which stops a command from writing more output than is expected.
+// The buffer isn't embedded, as its ReadFrom would otherwise be used to copy into it
+// without going through Write.
+type limitedBuffer struct {
+	buffer    bytes.Buffer
+	remaining int
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if len(p) > b.remaining {
+		return 0, errors.New("too much output")
+	}
+	b.remaining -= len(p)
+	return b.buffer.Write(p)
+}
@@ -0,0 +1,133 @@
+package thumbnailer
+
+import (
+	"context"
+	"image"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/internal/config"
+	"github.com/matrix-org/dendrite/mediaapi/types"
+	"github.com/sirupsen/logrus"
+)
+
+// writeTestRenderer writes a shell script which stands in for pdftoppm, running script
+// after reading the PDF from stdin.
+func writeTestRenderer(t *testing.T, dir, name, script string) string {
+	path := filepath.Join(dir, "renderer-"+name)
+	content := "#!/bin/sh\ncat > /dev/null\necho run >> " + path + ".runs\n" + script + "\n"
+	if err := ioutil.WriteFile(path, []byte(content), 0700); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func rendererRuns(t *testing.T, renderer string) int {
+	runs, err := ioutil.ReadFile(renderer + ".runs")
+	if os.IsNotExist(err) {
+		return 0
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.Count(string(runs), "run")
+}
+
+func TestRenderPDFPage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mediaapi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir) // nolint: errcheck
+
+	pagePath := filepath.Join(dir, "page.png")
+	pageFile, err := os.Create(pagePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = png.Encode(pageFile, image.NewRGBA(image.Rect(0, 0, 60, 80))); err != nil {
+		t.Fatal(err)
+	}
+	if err = pageFile.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := config.PDFThumbnails{Enabled: true, Timeout: time.Second * 5, MaxSize: 100}
+	activeThumbnailGeneration := &types.ActiveThumbnailGeneration{
+		PathToResult: map[string]*types.ThumbnailGenerationResult{},
+	}
+	logger := logrus.NewEntry(logrus.New())
+	render := func(name string, cfg config.PDFThumbnails) (types.Path, types.Path, error) {
+		mediaDir := filepath.Join(dir, name)
+		if err = os.MkdirAll(mediaDir, 0770); err != nil {
+			t.Fatal(err)
+		}
+		src := types.Path(filepath.Join(mediaDir, "file"))
+		if err = ioutil.WriteFile(string(src), []byte("%PDF-1.4"), 0600); err != nil {
+			t.Fatal(err)
+		}
+		mediaMetadata := &types.MediaMetadata{Base64Hash: types.Base64Hash(name), ContentType: "application/pdf"}
+		page, busy, renderErr := RenderPDFPage(
+			context.Background(), src, cfg, mediaMetadata, activeThumbnailGeneration, 10, nil, logger,
+		)
+		if busy {
+			t.Fatalf("%s: got busy rendering one page", name)
+		}
+		return src, page, renderErr
+	}
+
+	cfg.Command = writeTestRenderer(t, dir, "renderer", "cat "+pagePath)
+	src, page, err := render("working", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if filepath.Dir(string(page)) != filepath.Dir(string(src)) {
+		t.Errorf("page %s was not stored next to the PDF %s", page, src)
+	}
+	if _, err = os.Stat(string(page)); err != nil {
+		t.Errorf("rendered page was not stored: %s", err)
+	}
+	if _, _, err = RenderPDFPage(
+		context.Background(), src, cfg, &types.MediaMetadata{Base64Hash: "working"},
+		activeThumbnailGeneration, 10, nil, logger,
+	); err != nil {
+		t.Fatal(err)
+	}
+	if runs := rendererRuns(t, cfg.Command); runs != 1 {
+		t.Errorf("renderer ran %d times, want it only run once before the page is kept", runs)
+	}
+
+	missing := cfg
+	missing.Command = filepath.Join(dir, "missing")
+	if _, _, err = render("missing", missing); err != ErrPDFRendererUnavailable {
+		t.Errorf("missing renderer: got error %v, want %v", err, ErrPDFRendererUnavailable)
+	}
+
+	for _, tt := range []struct {
+		name   string
+		script string
+	}{
+		{"failing", "echo broken PDF >&2; exit 1"},
+		{"invalid", "echo not an image"},
+		{"slow", "exec sleep 5"},
+		{"too large", "cat " + pagePath + "; head -c 20000000 /dev/zero"},
+	} {
+		failing := cfg
+		failing.Command = writeTestRenderer(t, dir, strings.Replace(tt.name, " ", "-", -1), tt.script)
+		failing.Timeout = time.Millisecond * 500
+		if _, _, err = render(tt.name, failing); err == nil {
+			t.Errorf("%s renderer: expected an error", tt.name)
+		}
+		if _, statErr := os.Stat(filepath.Join(dir, tt.name, pdfPageFilename)); !os.IsNotExist(statErr) {
+			t.Errorf("%s renderer: page was stored", tt.name)
+		}
+	}
+	if len(activeThumbnailGeneration.PathToResult) != 0 {
+		t.Errorf("renders were left active: %v", activeThumbnailGeneration.PathToResult)
+	}
+}
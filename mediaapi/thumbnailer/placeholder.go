@@ -0,0 +1,47 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package thumbnailer
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+)
+
+// PlaceholderContentType is the content type of the image returned by Placeholder.
+const PlaceholderContentType = "image/png"
+
+// placeholderSize is the width and height of the placeholder image in pixels.
+const placeholderSize = 32
+
+var placeholder = makePlaceholder()
+
+// Placeholder returns a small generic image which can be served in place of a
+// thumbnail which couldn't be generated. The returned slice must not be modified.
+func Placeholder() []byte {
+	return placeholder
+}
+
+func makePlaceholder() []byte {
+	img := image.NewGray(image.Rect(0, 0, placeholderSize, placeholderSize))
+	draw.Draw(img, img.Bounds(), image.NewUniform(color.Gray{Y: 0xcc}), image.Point{}, draw.Src)
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		panic(err)
+	}
+	return buf.Bytes()
+}
@@ -16,10 +16,20 @@ package thumbnailer
 
 import (
 	"context"
+	"encoding/hex"
 	"fmt"
+	"image"
+	"image/color"
+
+	// Imported for the gif, jpeg and png codecs used by ValidateImage
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
 	"math"
 	"os"
 	"path/filepath"
+	"strings"
 	"sync"
 
 	"github.com/matrix-org/dendrite/internal/config"
@@ -39,22 +49,128 @@ type thumbnailFitness struct {
 // thumbnailTemplate is the filename template for thumbnails
 const thumbnailTemplate = "thumbnail-%vx%v-%v"
 
+// thumbnailContentType is the content type of generated thumbnails
+// Note: the code currently always creates a JPEG thumbnail, unless it is padded
+const thumbnailContentType = types.ContentType("image/jpeg")
+
+// paddedThumbnailContentType is the content type of padded thumbnails, which are PNGs
+// so that they can be padded with a transparent background.
+const paddedThumbnailContentType = types.ContentType("image/png")
+
+// contentTypeFor returns the content type of the thumbnail generated for the size.
+func contentTypeFor(config types.ThumbnailSize) types.ContentType {
+	if config.ResizeMethod == types.Pad {
+		return paddedThumbnailContentType
+	}
+	return thumbnailContentType
+}
+
+// backgroundColor returns the colour that a padded thumbnail of the size is padded with.
+func backgroundColor(config types.ThumbnailSize) color.NRGBA {
+	rgba, err := hex.DecodeString(config.Background)
+	if err != nil || len(rgba) != 4 {
+		return color.NRGBA{}
+	}
+	return color.NRGBA{R: rgba[0], G: rgba[1], B: rgba[2], A: rgba[3]}
+}
+
+// generationKey identifies a thumbnail in activeThumbnailGeneration by the hash of the
+// content it is generated from, its size and its format, so that concurrent requests for
+// the same thumbnail wait for a single generation rather than each generating it.
+func generationKey(mediaMetadata *types.MediaMetadata, config types.ThumbnailSize) string {
+	return fmt.Sprintf(
+		"%s/%dx%d/%s/%s/%s", mediaMetadata.Base64Hash,
+		config.Width, config.Height, config.ResizeMethod, config.Background, contentTypeFor(config),
+	)
+}
+
+// checkImagePixels reads the dimensions of an image from its header and returns an error
+// if it has more than maxPixels pixels, or if maxPixels is 0 then any number. A small file
+// can claim to be a huge image, so this must be checked before decoding it, which would
+// allocate the whole bitmap.
+func checkImagePixels(header io.Reader, maxPixels int64) error {
+	imgConfig, _, err := image.DecodeConfig(header)
+	if err != nil {
+		return err
+	}
+	if pixels := int64(imgConfig.Width) * int64(imgConfig.Height); maxPixels > 0 && pixels > maxPixels {
+		return fmt.Errorf(
+			"image is %dx%d, which is more than the maximum of %d pixels",
+			imgConfig.Width, imgConfig.Height, maxPixels,
+		)
+	}
+	return nil
+}
+
+// validatedImageTypes are the content types of images which ValidateImage can decode.
+var validatedImageTypes = map[string]bool{
+	"image/jpeg": true,
+	"image/png":  true,
+	"image/gif":  true,
+}
+
+// CanValidateImage returns whether ValidateImage can decode images with the content type.
+func CanValidateImage(contentType types.ContentType) bool {
+	return validatedImageTypes[strings.ToLower(strings.TrimSpace(strings.Split(string(contentType), ";")[0]))]
+}
+
+// ValidateImage decodes the whole of the image at src, returning an error if it can't
+// be, such as when the file was cut short. As when generating thumbnails, the size of
+// the image is checked from its header first, so that huge images aren't decoded.
+func ValidateImage(src types.Path, maxPixels int64) error {
+	header, err := os.Open(string(src))
+	if err != nil {
+		return err
+	}
+	err = checkImagePixels(header, maxPixels)
+	header.Close() // nolint: errcheck
+	if err != nil {
+		return err
+	}
+
+	file, err := os.Open(string(src))
+	if err != nil {
+		return err
+	}
+	defer file.Close() // nolint: errcheck
+	_, _, err = image.Decode(file)
+	return err
+}
+
 // GetThumbnailPath returns the path to a thumbnail given the absolute src path and thumbnail size configuration
+// Padded thumbnails of the same size with different backgrounds have the background appended.
 func GetThumbnailPath(src types.Path, config types.ThumbnailSize) types.Path {
 	srcDir := filepath.Dir(string(src))
-	return types.Path(filepath.Join(
-		srcDir,
-		fmt.Sprintf(thumbnailTemplate, config.Width, config.Height, config.ResizeMethod),
-	))
+	name := fmt.Sprintf(thumbnailTemplate, config.Width, config.Height, config.ResizeMethod)
+	if config.ResizeMethod == types.Pad {
+		name += "-" + config.Background
+	}
+	return types.Path(filepath.Join(srcDir, name))
+}
+
+// cropSize returns the dimensions of a cropped thumbnail of width x height for an
+// image of srcWidth x srcHeight. Thumbnails are never enlarged beyond the original
+// image, so if the image is smaller than requested in either dimension then the
+// thumbnail is cropped from the image at its original size and that dimension is
+// limited to the size of the image.
+func cropSize(srcWidth, srcHeight, width, height int) (int, int) {
+	if width > srcWidth {
+		width = srcWidth
+	}
+	if height > srcHeight {
+		height = srcHeight
+	}
+	return width, height
 }
 
 // SelectThumbnail compares the (potentially) available thumbnails with the desired thumbnail and returns the best match
 // The algorithm is very similar to what was implemented in Synapse
 // In order of priority unless absolute, the following metrics are compared; the image is:
 // * the same size or larger than requested
-// * if a cropped image is desired, has an aspect ratio close to requested
+// * if a cropped or padded image is desired, has an aspect ratio close to requested
 // * has a size close to requested
 // * if a cropped image is desired, prefer the same method, if scaled is desired, absolutely require scaled
+// * if a padded image is desired, absolutely require padded with the same background, otherwise never padded
 // * has a small file size
 // If a pre-generated thumbnail size is the best match, but it has not been generated yet, the caller can use the returned size to generate it.
 // Returns nil if no thumbnail matches the criteria
@@ -64,22 +180,22 @@ func SelectThumbnail(desired types.ThumbnailSize, thumbnails []*types.ThumbnailM
 	bestFit := newThumbnailFitness()
 
 	for _, thumbnail := range thumbnails {
-		if desired.ResizeMethod == types.Scale && thumbnail.ThumbnailSize.ResizeMethod != types.Scale {
+		if !canSubstitute(desired, thumbnail.ThumbnailSize) {
 			continue
 		}
 		fitness := calcThumbnailFitness(thumbnail.ThumbnailSize, thumbnail.MediaMetadata, desired)
-		if isBetter := fitness.betterThan(bestFit, desired.ResizeMethod == types.Crop); isBetter {
+		if isBetter := fitness.betterThan(bestFit, desired.ResizeMethod != types.Scale); isBetter {
 			bestFit = fitness
 			chosenThumbnail = thumbnail
 		}
 	}
 
 	for _, thumbnailSize := range thumbnailSizes {
-		if desired.ResizeMethod == types.Scale && thumbnailSize.ResizeMethod != types.Scale {
+		if !canSubstitute(desired, types.ThumbnailSize(thumbnailSize)) {
 			continue
 		}
 		fitness := calcThumbnailFitness(types.ThumbnailSize(thumbnailSize), nil, desired)
-		if isBetter := fitness.betterThan(bestFit, desired.ResizeMethod == types.Crop); isBetter {
+		if isBetter := fitness.betterThan(bestFit, desired.ResizeMethod != types.Scale); isBetter {
 			bestFit = fitness
 			chosenThumbnailSize = (*types.ThumbnailSize)(&thumbnailSize)
 		}
@@ -88,12 +204,54 @@ func SelectThumbnail(desired types.ThumbnailSize, thumbnails []*types.ThumbnailM
 	return chosenThumbnail, chosenThumbnailSize
 }
 
+// canSubstitute returns whether a thumbnail of size can be served for the desired one.
+// A scaled thumbnail must not be substituted with a cropped one, and the padding of a
+// padded thumbnail would show if a different method or background was asked for.
+func canSubstitute(desired, size types.ThumbnailSize) bool {
+	switch {
+	case desired.ResizeMethod == types.Pad || size.ResizeMethod == types.Pad:
+		return desired.ResizeMethod == size.ResizeMethod && desired.Background == size.Background
+	case desired.ResizeMethod == types.Scale:
+		return size.ResizeMethod == types.Scale
+	default:
+		return true
+	}
+}
+
+// SelectExistingThumbnail chooses which of the existing thumbnails to serve instead of
+// generating the desired one, according to the thumbnail_overflow_response config.
+// Returns nil if the original should be served instead.
+func SelectExistingThumbnail(desired types.ThumbnailSize, thumbnails []*types.ThumbnailMetadata, response string) *types.ThumbnailMetadata {
+	switch response {
+	case config.ThumbnailOverflowNearest:
+		thumbnail, _ := SelectThumbnail(desired, thumbnails, nil)
+		return thumbnail
+	case config.ThumbnailOverflowLargest:
+		var largest *types.ThumbnailMetadata
+		for _, thumbnail := range thumbnails {
+			if !canSubstitute(desired, thumbnail.ThumbnailSize) {
+				continue
+			}
+			size := thumbnail.ThumbnailSize
+			if largest == nil || size.Width*size.Height > largest.ThumbnailSize.Width*largest.ThumbnailSize.Height {
+				largest = thumbnail
+			}
+		}
+		return largest
+	default:
+		return nil
+	}
+}
+
 // getActiveThumbnailGeneration checks for active thumbnail generation
-func getActiveThumbnailGeneration(dst types.Path, _ types.ThumbnailSize, activeThumbnailGeneration *types.ActiveThumbnailGeneration, maxThumbnailGenerators int, logger *log.Entry) (isActive bool, busy bool, errorReturn error) {
+// If the thumbnail is already being generated then this waits for it to finish and returns
+// the result, otherwise the caller becomes responsible for generating it unless too many
+// thumbnails are already being generated, in which case busy is returned.
+func getActiveThumbnailGeneration(key string, _ types.ThumbnailSize, activeThumbnailGeneration *types.ActiveThumbnailGeneration, maxThumbnailGenerators int, logger *log.Entry) (isActive bool, busy bool, errorReturn error) {
 	// Check if there is active thumbnail generation.
 	activeThumbnailGeneration.Lock()
 	defer activeThumbnailGeneration.Unlock()
-	if activeThumbnailGenerationResult, ok := activeThumbnailGeneration.PathToResult[string(dst)]; ok {
+	if activeThumbnailGenerationResult, ok := activeThumbnailGeneration.PathToResult[key]; ok {
 		logger.Info("Waiting for another goroutine to generate the thumbnail.")
 
 		// NOTE: Wait unlocks and locks again internally. There is still a deferred Unlock() that will unlock this.
@@ -110,7 +268,7 @@ func getActiveThumbnailGeneration(dst types.Path, _ types.ThumbnailSize, activeT
 	}
 
 	// No active thumbnail generation so create one
-	activeThumbnailGeneration.PathToResult[string(dst)] = &types.ThumbnailGenerationResult{
+	activeThumbnailGeneration.PathToResult[key] = &types.ThumbnailGenerationResult{
 		Cond: &sync.Cond{L: activeThumbnailGeneration},
 	}
 
@@ -119,16 +277,16 @@ func getActiveThumbnailGeneration(dst types.Path, _ types.ThumbnailSize, activeT
 
 // broadcastGeneration broadcasts that thumbnail generation completed and the error to all waiting goroutines
 // Note: This should only be called by the owner of the activeThumbnailGenerationResult
-func broadcastGeneration(dst types.Path, activeThumbnailGeneration *types.ActiveThumbnailGeneration, _ types.ThumbnailSize, errorReturn error, logger *log.Entry) {
+func broadcastGeneration(key string, activeThumbnailGeneration *types.ActiveThumbnailGeneration, _ types.ThumbnailSize, errorReturn error, logger *log.Entry) {
 	activeThumbnailGeneration.Lock()
 	defer activeThumbnailGeneration.Unlock()
-	if activeThumbnailGenerationResult, ok := activeThumbnailGeneration.PathToResult[string(dst)]; ok {
+	if activeThumbnailGenerationResult, ok := activeThumbnailGeneration.PathToResult[key]; ok {
 		logger.Info("Signalling other goroutines waiting for this goroutine to generate the thumbnail.")
 		// Note: errorReturn is a named return value error that is signalled from here to waiting goroutines
 		activeThumbnailGenerationResult.Err = errorReturn
 		activeThumbnailGenerationResult.Cond.Broadcast()
 	}
-	delete(activeThumbnailGeneration.PathToResult, string(dst))
+	delete(activeThumbnailGeneration.PathToResult, key)
 }
 
 func isThumbnailExists(
@@ -141,7 +299,7 @@ func isThumbnailExists(
 ) (bool, error) {
 	thumbnailMetadata, err := db.GetThumbnail(
 		ctx, mediaMetadata.MediaID, mediaMetadata.Origin,
-		config.Width, config.Height, config.ResizeMethod,
+		config.Width, config.Height, config.ResizeMethod, config.Background,
 	)
 	if err != nil {
 		logger.Error("Failed to query database for thumbnail.")
@@ -180,7 +338,7 @@ func calcThumbnailFitness(size types.ThumbnailSize, metadata *types.MediaMetadat
 	// In all cases, a larger metric value is a worse fit.
 	// compare size: thumbnail smaller is true and gives 1, larger is false and gives 0
 	fitness.isSmaller = boolToInt(tW < dW || tH < dH)
-	// comparison of aspect ratios only makes sense for a request for desired cropped
+	// comparison of aspect ratios only makes sense for a request for desired cropped or padded
 	fitness.aspect = math.Abs(float64(dW*tH - dH*tW))
 	// compare sizes
 	fitness.size = math.Abs(float64((dW - tW) * (dH - tH)))
@@ -201,7 +359,7 @@ func boolToInt(b bool) int {
 	return 0
 }
 
-func (a thumbnailFitness) betterThan(b thumbnailFitness, desiredCrop bool) bool {
+func (a thumbnailFitness) betterThan(b thumbnailFitness, desiredAspect bool) bool {
 	// preference means returning -1
 
 	// prefer images that are not smaller
@@ -212,10 +370,10 @@ func (a thumbnailFitness) betterThan(b thumbnailFitness, desiredCrop bool) bool
 		return true
 	}
 
-	// prefer aspect ratios closer to desired only if desired cropped
-	// only cropped images have differing aspect ratios
+	// prefer aspect ratios closer to desired only if desired cropped or padded
+	// only cropped and padded images have differing aspect ratios
 	// desired scaled only accepts scaled images
-	if desiredCrop {
+	if desiredAspect {
 		if a.aspect > b.aspect {
 			return false
 		} else if a.aspect < b.aspect {
@@ -18,10 +18,12 @@ package thumbnailer
 
 import (
 	"context"
-	"os"
+	"fmt"
+	"io/ioutil"
 	"time"
 
 	"github.com/matrix-org/dendrite/internal/config"
+	"github.com/matrix-org/dendrite/mediaapi/fileutils"
 	"github.com/matrix-org/dendrite/mediaapi/storage"
 	"github.com/matrix-org/dendrite/mediaapi/types"
 	log "github.com/sirupsen/logrus"
@@ -36,20 +38,27 @@ func GenerateThumbnails(
 	mediaMetadata *types.MediaMetadata,
 	activeThumbnailGeneration *types.ActiveThumbnailGeneration,
 	maxThumbnailGenerators int,
+	maxImagePixels int64,
+	jpegQuality int,
 	db *storage.Database,
+	encryptionKey *fileutils.EncryptionKey,
 	logger *log.Entry,
 ) (busy bool, errorReturn error) {
-	buffer, err := bimg.Read(string(src))
+	buffer, err := readFile(src, sourceEncryption(src, mediaMetadata), encryptionKey)
 	if err != nil {
 		logger.WithError(err).WithField("src", src).Error("Failed to read src file")
 		return false, err
 	}
 	img := bimg.NewImage(buffer)
+	if err = checkImageSize(img, maxImagePixels); err != nil {
+		logger.WithError(err).WithField("src", src).Error("Refusing to thumbnail src file")
+		return false, err
+	}
 	for _, config := range configs {
 		// Note: createThumbnail does locking based on activeThumbnailGeneration
 		busy, err = createThumbnail(
 			ctx, src, img, config, mediaMetadata, activeThumbnailGeneration,
-			maxThumbnailGenerators, db, logger,
+			maxThumbnailGenerators, jpegQuality, db, encryptionKey, logger,
 		)
 		if err != nil {
 			logger.WithError(err).WithField("src", src).Error("Failed to generate thumbnails")
@@ -70,10 +79,13 @@ func GenerateThumbnail(
 	mediaMetadata *types.MediaMetadata,
 	activeThumbnailGeneration *types.ActiveThumbnailGeneration,
 	maxThumbnailGenerators int,
+	maxImagePixels int64,
+	jpegQuality int,
 	db *storage.Database,
+	encryptionKey *fileutils.EncryptionKey,
 	logger *log.Entry,
 ) (busy bool, errorReturn error) {
-	buffer, err := bimg.Read(string(src))
+	buffer, err := readFile(src, sourceEncryption(src, mediaMetadata), encryptionKey)
 	if err != nil {
 		logger.WithError(err).WithFields(log.Fields{
 			"src": src,
@@ -81,10 +93,14 @@ func GenerateThumbnail(
 		return false, err
 	}
 	img := bimg.NewImage(buffer)
+	if err = checkImageSize(img, maxImagePixels); err != nil {
+		logger.WithError(err).WithField("src", src).Error("Refusing to thumbnail src file")
+		return false, err
+	}
 	// Note: createThumbnail does locking based on activeThumbnailGeneration
 	busy, err = createThumbnail(
 		ctx, src, img, config, mediaMetadata, activeThumbnailGeneration,
-		maxThumbnailGenerators, db, logger,
+		maxThumbnailGenerators, jpegQuality, db, encryptionKey, logger,
 	)
 	if err != nil {
 		logger.WithError(err).WithFields(log.Fields{
@@ -108,7 +124,9 @@ func createThumbnail(
 	mediaMetadata *types.MediaMetadata,
 	activeThumbnailGeneration *types.ActiveThumbnailGeneration,
 	maxThumbnailGenerators int,
+	jpegQuality int,
 	db *storage.Database,
+	encryptionKey *fileutils.EncryptionKey,
 	logger *log.Entry,
 ) (busy bool, errorReturn error) {
 	logger = logger.WithFields(log.Fields{
@@ -118,14 +136,16 @@ func createThumbnail(
 	})
 
 	// Check if request is larger than original
-	if isLargerThanOriginal(config, img) {
+	// Padded thumbnails are always exactly the requested size, so are padded around the original.
+	if config.ResizeMethod != types.Pad && isLargerThanOriginal(config, img) {
 		return false, nil
 	}
 
 	dst := GetThumbnailPath(src, config)
+	key := generationKey(mediaMetadata, config)
 
 	// Note: getActiveThumbnailGeneration uses mutexes and conditions from activeThumbnailGeneration
-	isActive, busy, err := getActiveThumbnailGeneration(dst, config, activeThumbnailGeneration, maxThumbnailGenerators, logger)
+	isActive, busy, err := getActiveThumbnailGeneration(key, config, activeThumbnailGeneration, maxThumbnailGenerators, logger)
 	if err != nil {
 		return false, err
 	}
@@ -139,10 +159,10 @@ func createThumbnail(
 		defer func() {
 			// Note: errorReturn is the named return variable so we wrap this in a closure to re-evaluate the arguments at defer-time
 			if err := recover(); err != nil {
-				broadcastGeneration(dst, activeThumbnailGeneration, config, err.(error), logger)
+				broadcastGeneration(key, activeThumbnailGeneration, config, err.(error), logger)
 				panic(err)
 			}
-			broadcastGeneration(dst, activeThumbnailGeneration, config, errorReturn, logger)
+			broadcastGeneration(key, activeThumbnailGeneration, config, errorReturn, logger)
 		}()
 	}
 
@@ -152,7 +172,7 @@ func createThumbnail(
 	}
 
 	start := time.Now()
-	width, height, err := resize(dst, img, config.Width, config.Height, config.ResizeMethod == "crop", logger)
+	width, height, err := resize(dst, img, config, jpegQuality, encryptionKey, logger)
 	if err != nil {
 		return false, err
 	}
@@ -162,23 +182,26 @@ func createThumbnail(
 		"processTime":  time.Now().Sub(start),
 	}).Info("Generated thumbnail")
 
-	stat, err := os.Stat(string(dst))
+	// Note: the thumbnail may be encrypted so fileutils.FileSize is used rather than os.Stat
+	encryption := types.EncryptionFor(encryptionKey != nil)
+	size, err := fileutils.FileSize(dst, encryption)
 	if err != nil {
 		return false, err
 	}
 
 	thumbnailMetadata := &types.ThumbnailMetadata{
 		MediaMetadata: &types.MediaMetadata{
-			MediaID: mediaMetadata.MediaID,
-			Origin:  mediaMetadata.Origin,
-			// Note: the code currently always creates a JPEG thumbnail
-			ContentType:   types.ContentType("image/jpeg"),
-			FileSizeBytes: types.FileSizeBytes(stat.Size()),
+			MediaID:       mediaMetadata.MediaID,
+			Origin:        mediaMetadata.Origin,
+			ContentType:   contentTypeFor(config),
+			FileSizeBytes: size,
+			Encryption:    encryption,
 		},
 		ThumbnailSize: types.ThumbnailSize{
 			Width:        config.Width,
 			Height:       config.Height,
 			ResizeMethod: config.ResizeMethod,
+			Background:   config.Background,
 		},
 	}
 
@@ -194,6 +217,46 @@ func createThumbnail(
 	return false, nil
 }
 
+func readFile(src types.Path, encryption types.Encryption, encryptionKey *fileutils.EncryptionKey) ([]byte, error) {
+	file, _, err := fileutils.OpenFile(src, encryption, encryptionKey)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close() // nolint: errcheck
+	return ioutil.ReadAll(file)
+}
+
+func writeFile(buffer []byte, dst types.Path, encryptionKey *fileutils.EncryptionKey) (err error) {
+	out, err := fileutils.CreateFile(dst, encryptionKey)
+	if err != nil {
+		return err
+	}
+	defer (func() {
+		if closeErr := out.Close(); err == nil {
+			err = closeErr
+		}
+	})()
+	_, err = out.Write(buffer)
+	return err
+}
+
+// checkImageSize returns an error if the image has more than maxPixels pixels, or if
+// maxPixels is 0 then any number. libvips only reads the header to get the size, so this
+// is checked before the whole bitmap is allocated by decoding it.
+func checkImageSize(img *bimg.Image, maxPixels int64) error {
+	imgSize, err := img.Size()
+	if err != nil {
+		return err
+	}
+	if pixels := int64(imgSize.Width) * int64(imgSize.Height); maxPixels > 0 && pixels > maxPixels {
+		return fmt.Errorf(
+			"image is %dx%d, which is more than the maximum of %d pixels",
+			imgSize.Width, imgSize.Height, maxPixels,
+		)
+	}
+	return nil
+}
+
 func isLargerThanOriginal(config types.ThumbnailSize, img *bimg.Image) bool {
 	imgSize, err := img.Size()
 	if err == nil && config.Width >= imgSize.Width && config.Height >= imgSize.Height {
@@ -204,22 +267,33 @@ func isLargerThanOriginal(config types.ThumbnailSize, img *bimg.Image) bool {
 
 // resize scales an image to fit within the provided width and height
 // If the source aspect ratio is different to the target dimensions, one edge will be smaller than requested
-// If crop is set to true, the image will be scaled to fill the width and height with any excess being cropped off
-func resize(dst types.Path, inImage *bimg.Image, w, h int, crop bool, logger *log.Entry) (int, int, error) {
+// If the method is crop, the image will be scaled to fill the width and height with any excess being cropped off
+// If the method is pad, the image will be scaled to fit and the rest filled with the background
+func resize(dst types.Path, inImage *bimg.Image, config types.ThumbnailSize, jpegQuality int, encryptionKey *fileutils.EncryptionKey, logger *log.Entry) (int, int, error) {
 	inSize, err := inImage.Size()
 	if err != nil {
 		return -1, -1, err
 	}
 
+	w, h := config.Width, config.Height
 	options := bimg.Options{
 		Type:    bimg.JPEG,
-		Quality: 85,
+		Quality: jpegQuality,
 	}
-	if crop {
-		options.Width = w
-		options.Height = h
+	switch config.ResizeMethod {
+	case types.Crop:
+		options.Width, options.Height = cropSize(inSize.Width, inSize.Height, w, h)
 		options.Crop = true
-	} else {
+	case types.Pad:
+		// Note: libvips extends the image with an opaque colour, so the alpha of the
+		// background is ignored.
+		background := backgroundColor(config)
+		options.Type = bimg.PNG
+		options.Width, options.Height = w, h
+		options.Embed = true
+		options.Extend = bimg.ExtendBackground
+		options.Background = bimg.Color{R: background.R, G: background.G, B: background.B}
+	default:
 		inAR := float64(inSize.Width) / float64(inSize.Height)
 		outAR := float64(w) / float64(h)
 
@@ -239,7 +313,7 @@ func resize(dst types.Path, inImage *bimg.Image, w, h int, crop bool, logger *lo
 		return -1, -1, err
 	}
 
-	if err = bimg.Write(string(dst), newImage); err != nil {
+	if err = writeFile(newImage, dst, encryptionKey); err != nil {
 		logger.WithError(err).Error("Failed to resize image")
 		return -1, -1, err
 	}
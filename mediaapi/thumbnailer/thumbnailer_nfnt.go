@@ -19,18 +19,18 @@ package thumbnailer
 import (
 	"context"
 	"image"
+	"image/color"
 	"image/draw"
 
 	// Imported for gif codec
 	_ "image/gif"
 	"image/jpeg"
 
-	// Imported for png codec
-	_ "image/png"
-	"os"
+	"image/png"
 	"time"
 
 	"github.com/matrix-org/dendrite/internal/config"
+	"github.com/matrix-org/dendrite/mediaapi/fileutils"
 	"github.com/matrix-org/dendrite/mediaapi/storage"
 	"github.com/matrix-org/dendrite/mediaapi/types"
 	"github.com/nfnt/resize"
@@ -45,19 +45,19 @@ func GenerateThumbnails(
 	mediaMetadata *types.MediaMetadata,
 	activeThumbnailGeneration *types.ActiveThumbnailGeneration,
 	maxThumbnailGenerators int,
+	maxImagePixels int64,
+	jpegQuality int,
 	db storage.Database,
+	encryptionKey *fileutils.EncryptionKey,
 	logger *log.Entry,
 ) (busy bool, errorReturn error) {
-	img, err := readFile(string(src))
-	if err != nil {
-		logger.WithError(err).WithField("src", src).Error("Failed to read src file")
-		return false, err
-	}
+	var err error
+	img := &sourceImage{path: src, encryption: sourceEncryption(src, mediaMetadata), encryptionKey: encryptionKey, maxPixels: maxImagePixels}
 	for _, singleConfig := range configs {
 		// Note: createThumbnail does locking based on activeThumbnailGeneration
 		busy, err = createThumbnail(
 			ctx, src, img, types.ThumbnailSize(singleConfig), mediaMetadata,
-			activeThumbnailGeneration, maxThumbnailGenerators, db, logger,
+			activeThumbnailGeneration, maxThumbnailGenerators, jpegQuality, db, encryptionKey, logger,
 		)
 		if err != nil {
 			logger.WithError(err).WithField("src", src).Error("Failed to generate thumbnails")
@@ -78,20 +78,17 @@ func GenerateThumbnail(
 	mediaMetadata *types.MediaMetadata,
 	activeThumbnailGeneration *types.ActiveThumbnailGeneration,
 	maxThumbnailGenerators int,
+	maxImagePixels int64,
+	jpegQuality int,
 	db storage.Database,
+	encryptionKey *fileutils.EncryptionKey,
 	logger *log.Entry,
 ) (busy bool, errorReturn error) {
-	img, err := readFile(string(src))
-	if err != nil {
-		logger.WithError(err).WithFields(log.Fields{
-			"src": src,
-		}).Error("Failed to read src file")
-		return false, err
-	}
+	img := &sourceImage{path: src, encryption: sourceEncryption(src, mediaMetadata), encryptionKey: encryptionKey, maxPixels: maxImagePixels}
 	// Note: createThumbnail does locking based on activeThumbnailGeneration
-	busy, err = createThumbnail(
+	busy, err := createThumbnail(
 		ctx, src, img, config, mediaMetadata, activeThumbnailGeneration,
-		maxThumbnailGenerators, db, logger,
+		maxThumbnailGenerators, jpegQuality, db, encryptionKey, logger,
 	)
 	if err != nil {
 		logger.WithError(err).WithFields(log.Fields{
@@ -105,8 +102,68 @@ func GenerateThumbnail(
 	return false, nil
 }
 
-func readFile(src string) (image.Image, error) {
-	file, err := os.Open(src)
+// sourceImage is the image that thumbnails are generated from. It is only read and
+// decoded once a thumbnail actually needs generating, so that requests which wait for
+// another goroutine to generate the thumbnail, or which are turned away because too
+// many thumbnails are being generated, don't each decode the whole image.
+type sourceImage struct {
+	path          types.Path
+	encryption    types.Encryption
+	encryptionKey *fileutils.EncryptionKey
+	maxPixels     int64
+	img           image.Image
+	err           error
+	// The dimensions of the image from its header, see size.
+	config    *image.Config
+	configErr error
+}
+
+// size returns the dimensions of the image from its header, without decoding the rest
+// of it, so that thumbnails which would be larger than it aren't decoded for nothing.
+func (s *sourceImage) size() (int, int, error) {
+	if s.config == nil && s.configErr == nil {
+		s.config, s.configErr = readConfig(s.path, s.encryption, s.encryptionKey)
+	}
+	if s.configErr != nil {
+		return 0, 0, s.configErr
+	}
+	return s.config.Width, s.config.Height, nil
+}
+
+func (s *sourceImage) decode() (image.Image, error) {
+	if s.img == nil && s.err == nil {
+		s.img, s.err = readFile(s.path, s.encryption, s.encryptionKey, s.maxPixels)
+	}
+	return s.img, s.err
+}
+
+func readConfig(src types.Path, encryption types.Encryption, encryptionKey *fileutils.EncryptionKey) (*image.Config, error) {
+	header, _, err := fileutils.OpenFile(src, encryption, encryptionKey)
+	if err != nil {
+		return nil, err
+	}
+	defer header.Close() // nolint: errcheck
+	config, _, err := image.DecodeConfig(header)
+	if err != nil {
+		return nil, err
+	}
+	return &config, nil
+}
+
+func readFile(src types.Path, encryption types.Encryption, encryptionKey *fileutils.EncryptionKey, maxPixels int64) (image.Image, error) {
+	// The file is opened once to check the size of the image from its header, and
+	// again to decode it, as the header can be anywhere up to the whole file.
+	header, _, err := fileutils.OpenFile(src, encryption, encryptionKey)
+	if err != nil {
+		return nil, err
+	}
+	err = checkImagePixels(header, maxPixels)
+	header.Close() // nolint: errcheck
+	if err != nil {
+		return nil, err
+	}
+
+	file, _, err := fileutils.OpenFile(src, encryption, encryptionKey)
 	if err != nil {
 		return nil, err
 	}
@@ -120,15 +177,22 @@ func readFile(src string) (image.Image, error) {
 	return img, nil
 }
 
-func writeFile(img image.Image, dst string) (err error) {
-	out, err := os.Create(dst)
+func writeFile(img image.Image, dst types.Path, contentType types.ContentType, jpegQuality int, encryptionKey *fileutils.EncryptionKey) (err error) {
+	out, err := fileutils.CreateFile(dst, encryptionKey)
 	if err != nil {
 		return err
 	}
-	defer (func() { err = out.Close() })()
+	defer (func() {
+		if closeErr := out.Close(); err == nil {
+			err = closeErr
+		}
+	})()
 
+	if contentType == paddedThumbnailContentType {
+		return png.Encode(out, img)
+	}
 	return jpeg.Encode(out, img, &jpeg.Options{
-		Quality: 85,
+		Quality: jpegQuality,
 	})
 }
 
@@ -137,12 +201,14 @@ func writeFile(img image.Image, dst string) (err error) {
 func createThumbnail(
 	ctx context.Context,
 	src types.Path,
-	img image.Image,
+	srcImage *sourceImage,
 	config types.ThumbnailSize,
 	mediaMetadata *types.MediaMetadata,
 	activeThumbnailGeneration *types.ActiveThumbnailGeneration,
 	maxThumbnailGenerators int,
+	jpegQuality int,
 	db storage.Database,
+	encryptionKey *fileutils.EncryptionKey,
 	logger *log.Entry,
 ) (busy bool, errorReturn error) {
 	logger = logger.WithFields(log.Fields{
@@ -151,15 +217,11 @@ func createThumbnail(
 		"ResizeMethod": config.ResizeMethod,
 	})
 
-	// Check if request is larger than original
-	if config.Width >= img.Bounds().Dx() && config.Height >= img.Bounds().Dy() {
-		return false, nil
-	}
-
 	dst := GetThumbnailPath(src, config)
+	key := generationKey(mediaMetadata, config)
 
 	// Note: getActiveThumbnailGeneration uses mutexes and conditions from activeThumbnailGeneration
-	isActive, busy, err := getActiveThumbnailGeneration(dst, config, activeThumbnailGeneration, maxThumbnailGenerators, logger)
+	isActive, busy, err := getActiveThumbnailGeneration(key, config, activeThumbnailGeneration, maxThumbnailGenerators, logger)
 	if err != nil {
 		return false, err
 	}
@@ -176,7 +238,7 @@ func createThumbnail(
 			// 	broadcastGeneration(dst, activeThumbnailGeneration, config, err.(error), logger)
 			// 	panic(err)
 			// }
-			broadcastGeneration(dst, activeThumbnailGeneration, config, errorReturn, logger)
+			broadcastGeneration(key, activeThumbnailGeneration, config, errorReturn, logger)
 		}()
 	}
 
@@ -185,8 +247,28 @@ func createThumbnail(
 		return false, err
 	}
 
+	// Check if request is larger than original, in which case the original is served
+	// instead, as thumbnails are never enlarged.
+	// Padded thumbnails are always exactly the requested size, so are padded around the original.
+	if config.ResizeMethod != types.Pad {
+		width, height, sizeErr := srcImage.size()
+		if sizeErr != nil {
+			logger.WithError(sizeErr).WithField("src", src).Error("Failed to read src file")
+			return false, sizeErr
+		}
+		if config.Width >= width && config.Height >= height {
+			return false, nil
+		}
+	}
+
+	img, err := srcImage.decode()
+	if err != nil {
+		logger.WithError(err).WithField("src", src).Error("Failed to read src file")
+		return false, err
+	}
+
 	start := time.Now()
-	width, height, err := adjustSize(dst, img, config.Width, config.Height, config.ResizeMethod == types.Crop, logger)
+	width, height, err := adjustSize(dst, img, config, jpegQuality, encryptionKey, logger)
 	if err != nil {
 		return false, err
 	}
@@ -196,23 +278,26 @@ func createThumbnail(
 		"processTime":  time.Since(start),
 	}).Info("Generated thumbnail")
 
-	stat, err := os.Stat(string(dst))
+	// Note: the thumbnail may be encrypted so fileutils.FileSize is used rather than os.Stat
+	encryption := types.EncryptionFor(encryptionKey != nil)
+	size, err := fileutils.FileSize(dst, encryption)
 	if err != nil {
 		return false, err
 	}
 
 	thumbnailMetadata := &types.ThumbnailMetadata{
 		MediaMetadata: &types.MediaMetadata{
-			MediaID: mediaMetadata.MediaID,
-			Origin:  mediaMetadata.Origin,
-			// Note: the code currently always creates a JPEG thumbnail
-			ContentType:   types.ContentType("image/jpeg"),
-			FileSizeBytes: types.FileSizeBytes(stat.Size()),
+			MediaID:       mediaMetadata.MediaID,
+			Origin:        mediaMetadata.Origin,
+			ContentType:   contentTypeFor(config),
+			FileSizeBytes: size,
+			Encryption:    encryption,
 		},
 		ThumbnailSize: types.ThumbnailSize{
 			Width:        config.Width,
 			Height:       config.Height,
 			ResizeMethod: config.ResizeMethod,
+			Background:   config.Background,
 		},
 	}
 
@@ -228,44 +313,73 @@ func createThumbnail(
 	return false, nil
 }
 
-// adjustSize scales an image to fit within the provided width and height
+// adjustSize scales an image to fit within the provided width and height and writes it to dst
 // If the source aspect ratio is different to the target dimensions, one edge will be smaller than requested
-// If crop is set to true, the image will be scaled to fill the width and height with any excess being cropped off
-func adjustSize(dst types.Path, img image.Image, w, h int, crop bool, logger *log.Entry) (int, int, error) {
+// If the method is crop, the image will be scaled to fill the width and height with any excess being cropped off
+// If the method is pad, the image will be scaled to fit and the rest filled with the background
+func adjustSize(dst types.Path, img image.Image, config types.ThumbnailSize, jpegQuality int, encryptionKey *fileutils.EncryptionKey, logger *log.Entry) (int, int, error) {
 	var out image.Image
-	var err error
-	if crop {
-		inAR := float64(img.Bounds().Dx()) / float64(img.Bounds().Dy())
-		outAR := float64(w) / float64(h)
-
-		var scaleW, scaleH uint
-		if inAR > outAR {
-			// input has shorter AR than requested output so use requested height and calculate width to match input AR
-			scaleW = uint(float64(h) * inAR)
-			scaleH = uint(h)
+	if config.ResizeMethod == types.Pad {
+		out = padImage(img, config.Width, config.Height, backgroundColor(config))
+	} else {
+		out = thumbnailImage(img, config.Width, config.Height, config.ResizeMethod == types.Crop)
+	}
+	if err := writeFile(out, dst, contentTypeFor(config), jpegQuality, encryptionKey); err != nil {
+		logger.WithError(err).Error("Failed to encode and write image")
+		return -1, -1, err
+	}
+
+	return out.Bounds().Dx(), out.Bounds().Dy(), nil
+}
+
+// thumbnailImage returns a thumbnail of img of at most w x h. The image is never enlarged.
+// If crop is set to true, the thumbnail is exactly w x h unless the image is smaller than that,
+// see cropSize. Otherwise the thumbnail keeps the aspect ratio of the image and fits within w x h.
+func thumbnailImage(img image.Image, w, h int, crop bool) image.Image {
+	if !crop {
+		// Note: resize.Thumbnail returns the original image if it already fits
+		return resize.Thumbnail(uint(w), uint(h), img, resize.Lanczos3)
+	}
+
+	srcW, srcH := img.Bounds().Dx(), img.Bounds().Dy()
+	w, h = cropSize(srcW, srcH, w, h)
+
+	// Scale the image down so that it covers w x h, rounding so that it is never
+	// left smaller than w x h, then crop off any excess from the edges.
+	scaled := img
+	if w < srcW && h < srcH {
+		scaleW, scaleH := w, h
+		if srcW*h > srcH*w {
+			// input has wider AR than requested output so use requested height and calculate width to match input AR
+			scaleW = (h*srcW + srcH - 1) / srcH
 		} else {
 			// input has taller AR than requested output so use requested width and calculate height to match input AR
-			scaleW = uint(w)
-			scaleH = uint(float64(w) / inAR)
+			scaleH = (w*srcH + srcW - 1) / srcW
 		}
+		scaled = resize.Resize(uint(scaleW), uint(scaleH), img, resize.Lanczos3)
+	}
 
-		scaled := resize.Resize(scaleW, scaleH, img, resize.Lanczos3)
-
-		xoff := (scaled.Bounds().Dx() - w) / 2
-		yoff := (scaled.Bounds().Dy() - h) / 2
+	bounds := scaled.Bounds()
+	xoff := bounds.Min.X + (bounds.Dx()-w)/2
+	yoff := bounds.Min.Y + (bounds.Dy()-h)/2
 
-		tr := image.Rect(0, 0, w, h)
-		target := image.NewRGBA(tr)
-		draw.Draw(target, tr, scaled, image.Pt(xoff, yoff), draw.Src)
-		out = target
-	} else {
-		out = resize.Thumbnail(uint(w), uint(h), img, resize.Lanczos3)
-	}
+	tr := image.Rect(0, 0, w, h)
+	target := image.NewRGBA(tr)
+	draw.Draw(target, tr, scaled, image.Pt(xoff, yoff), draw.Src)
+	return target
+}
 
-	if err = writeFile(out, string(dst)); err != nil {
-		logger.WithError(err).Error("Failed to encode and write image")
-		return -1, -1, err
-	}
+// padImage returns a thumbnail of img of exactly w x h. The image is scaled to fit within
+// w x h, but never enlarged, and centred on a background of the colour.
+func padImage(img image.Image, w, h int, background color.Color) image.Image {
+	// Note: resize.Thumbnail returns the original image if it already fits
+	scaled := resize.Thumbnail(uint(w), uint(h), img, resize.Lanczos3)
+	bounds := scaled.Bounds()
 
-	return out.Bounds().Max.X, out.Bounds().Max.Y, nil
+	tr := image.Rect(0, 0, w, h)
+	target := image.NewNRGBA(tr)
+	draw.Draw(target, tr, image.NewUniform(background), image.Point{}, draw.Src)
+	offset := image.Pt((w-bounds.Dx())/2, (h-bounds.Dy())/2)
+	draw.Draw(target, bounds.Sub(bounds.Min).Add(offset), scaled, bounds.Min, draw.Over)
+	return target
 }
@@ -0,0 +1,463 @@
+// +build !bimg
+
+package thumbnailer
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/matrix-org/dendrite/mediaapi/storage"
+	"github.com/matrix-org/dendrite/mediaapi/types"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/sirupsen/logrus"
+)
+
+var errBusy = errors.New("too many thumbnails being generated")
+
+func TestThumbnailImageDimensions(t *testing.T) {
+	tests := []struct {
+		name         string
+		srcW, srcH   int
+		w, h         int
+		crop         bool
+		wantW, wantH int
+	}{
+		{"portrait crop square", 300, 600, 32, 32, true, 32, 32},
+		{"portrait crop landscape", 300, 600, 100, 50, true, 100, 50},
+		{"portrait crop too big", 300, 600, 640, 480, true, 300, 480},
+		{"portrait scale square", 300, 600, 32, 32, false, 16, 32},
+		{"portrait scale landscape", 300, 600, 640, 480, false, 240, 480},
+		{"portrait scale too big", 300, 600, 1000, 1000, false, 300, 600},
+		{"landscape crop square", 600, 300, 32, 32, true, 32, 32},
+		{"landscape crop portrait", 600, 300, 96, 200, true, 96, 200},
+		{"landscape crop too wide", 600, 300, 640, 100, true, 600, 100},
+		{"landscape scale square", 600, 300, 32, 32, false, 32, 16},
+		{"landscape scale portrait", 600, 300, 200, 400, false, 200, 100},
+		{"landscape scale too big", 600, 300, 640, 480, false, 600, 300},
+		{"square crop square", 400, 400, 96, 96, true, 96, 96},
+		{"square crop landscape", 400, 400, 100, 50, true, 100, 50},
+		{"square crop too big", 400, 400, 500, 300, true, 400, 300},
+		{"square scale landscape", 400, 400, 100, 50, false, 50, 50},
+		{"square scale too big", 400, 400, 800, 800, false, 400, 400},
+	}
+	for _, tt := range tests {
+		src := image.NewRGBA(image.Rect(0, 0, tt.srcW, tt.srcH))
+		draw.Draw(src, src.Bounds(), image.NewUniform(color.RGBA{R: 0xff, A: 0xff}), image.Point{}, draw.Src)
+
+		out := thumbnailImage(src, tt.w, tt.h, tt.crop)
+		bounds := out.Bounds()
+		if bounds.Dx() != tt.wantW || bounds.Dy() != tt.wantH {
+			t.Errorf("%s: %dx%d thumbnail of %dx%d image is %dx%d, want %dx%d",
+				tt.name, tt.w, tt.h, tt.srcW, tt.srcH, bounds.Dx(), bounds.Dy(), tt.wantW, tt.wantH)
+			continue
+		}
+		// The thumbnail should be filled by the image, without any empty borders.
+		for _, pt := range []image.Point{
+			bounds.Min, {bounds.Max.X - 1, bounds.Min.Y}, {bounds.Min.X, bounds.Max.Y - 1}, bounds.Max.Sub(image.Pt(1, 1)),
+		} {
+			if _, _, _, a := out.At(pt.X, pt.Y).RGBA(); a == 0 {
+				t.Errorf("%s: thumbnail is empty at %v", tt.name, pt)
+			}
+		}
+	}
+}
+
+// thumbnailTestDatabase stores thumbnail metadata in memory and counts how many
+// thumbnails have been stored.
+type thumbnailTestDatabase struct {
+	storage.Database
+	sync.Mutex
+	thumbnails map[types.ThumbnailSize]*types.ThumbnailMetadata
+	stored     int
+}
+
+func (d *thumbnailTestDatabase) StoreThumbnail(ctx context.Context, thumbnailMetadata *types.ThumbnailMetadata) error {
+	d.Lock()
+	defer d.Unlock()
+	d.thumbnails[thumbnailMetadata.ThumbnailSize] = thumbnailMetadata
+	d.stored++
+	return nil
+}
+
+func (d *thumbnailTestDatabase) GetThumbnail(
+	ctx context.Context, mediaID types.MediaID, mediaOrigin gomatrixserverlib.ServerName,
+	width, height int, resizeMethod, background string,
+) (*types.ThumbnailMetadata, error) {
+	d.Lock()
+	defer d.Unlock()
+	return d.thumbnails[types.ThumbnailSize{Width: width, Height: height, ResizeMethod: resizeMethod, Background: background}], nil
+}
+
+func TestGenerateThumbnailConcurrent(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mediaapi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir) // nolint: errcheck
+
+	src := types.Path(filepath.Join(dir, "file"))
+	file, err := os.Create(string(src))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = png.Encode(file, image.NewRGBA(image.Rect(0, 0, 800, 600))); err != nil {
+		t.Fatal(err)
+	}
+	if err = file.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db := &thumbnailTestDatabase{thumbnails: map[types.ThumbnailSize]*types.ThumbnailMetadata{}}
+	mediaMetadata := &types.MediaMetadata{
+		MediaID:    "abc",
+		Origin:     "localhost",
+		Base64Hash: "somehash",
+	}
+	activeThumbnailGeneration := &types.ActiveThumbnailGeneration{
+		PathToResult: map[string]*types.ThumbnailGenerationResult{},
+	}
+	size := types.ThumbnailSize{Width: 96, Height: 96, ResizeMethod: types.Crop}
+	logger := logrus.NewEntry(logrus.New())
+
+	const requests = 50
+	var wg sync.WaitGroup
+	errs := make(chan error, requests)
+	for i := 0; i < requests; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// Only one generator is allowed, so any request which tried to generate the
+			// thumbnail itself rather than waiting for the active one would be busy.
+			busy, err := GenerateThumbnail(
+				context.Background(), src, size, mediaMetadata,
+				activeThumbnailGeneration, 1, 0, 85, db, nil, logger,
+			)
+			if err == nil && busy {
+				err = errBusy
+			}
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Errorf("GenerateThumbnail failed: %s", err)
+		}
+	}
+	if db.stored != 1 {
+		t.Errorf("thumbnail was generated %d times, want 1", db.stored)
+	}
+	if len(activeThumbnailGeneration.PathToResult) != 0 {
+		t.Errorf("thumbnail generation was left active")
+	}
+}
+
+// pngDeclaring returns a tiny PNG whose header claims that it is width x height, though
+// it only has the pixel data of a 1x1 image.
+func pngDeclaring(t *testing.T, width, height uint32) []byte {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewGray(image.Rect(0, 0, 1, 1))); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+	// The IHDR chunk comes straight after the 8 byte signature: a 4 byte length and
+	// type, then the width and height, with a CRC of the type and data at the end.
+	ihdr := data[8 : 8+8+13+4]
+	binary.BigEndian.PutUint32(ihdr[8:12], width)
+	binary.BigEndian.PutUint32(ihdr[12:16], height)
+	binary.BigEndian.PutUint32(ihdr[21:25], crc32.ChecksumIEEE(ihdr[4:21]))
+	return data
+}
+
+func TestGenerateThumbnailMaxImagePixels(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mediaapi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir) // nolint: errcheck
+
+	bomb := pngDeclaring(t, 100000, 100000)
+	if cfg, _, decodeErr := image.DecodeConfig(bytes.NewReader(bomb)); decodeErr != nil || cfg.Width != 100000 {
+		t.Fatalf("test image doesn't declare its dimensions: %+v %v", cfg, decodeErr)
+	}
+	var normal bytes.Buffer
+	if err = png.Encode(&normal, image.NewRGBA(image.Rect(0, 0, 800, 600))); err != nil {
+		t.Fatal(err)
+	}
+
+	size := types.ThumbnailSize{Width: 96, Height: 96, ResizeMethod: types.Crop}
+	logger := logrus.NewEntry(logrus.New())
+	for _, tt := range []struct {
+		name    string
+		content []byte
+		wantErr bool
+	}{
+		{"bomb", bomb, true},
+		{"normal", normal.Bytes(), false},
+	} {
+		src := types.Path(filepath.Join(dir, tt.name))
+		if err = ioutil.WriteFile(string(src), tt.content, 0600); err != nil {
+			t.Fatal(err)
+		}
+		db := &thumbnailTestDatabase{thumbnails: map[types.ThumbnailSize]*types.ThumbnailMetadata{}}
+		mediaMetadata := &types.MediaMetadata{MediaID: types.MediaID(tt.name), Origin: "localhost", Base64Hash: types.Base64Hash(tt.name)}
+		activeThumbnailGeneration := &types.ActiveThumbnailGeneration{
+			PathToResult: map[string]*types.ThumbnailGenerationResult{},
+		}
+		_, err = GenerateThumbnail(
+			context.Background(), src, size, mediaMetadata,
+			activeThumbnailGeneration, 1, 1000000, 85, db, nil, logger,
+		)
+		if tt.wantErr && (err == nil || !strings.Contains(err.Error(), "maximum of 1000000 pixels")) {
+			t.Errorf("%s: got error %v, want the image to be refused for its size", tt.name, err)
+		}
+		if !tt.wantErr && err != nil {
+			t.Errorf("%s: unexpected error %v", tt.name, err)
+		}
+		wantStored := 1
+		if tt.wantErr {
+			wantStored = 0
+		}
+		if db.stored != wantStored {
+			t.Errorf("%s: %d thumbnails stored, want %d", tt.name, db.stored, wantStored)
+		}
+	}
+}
+
+func TestWriteFileJPEGQuality(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mediaapi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir) // nolint: errcheck
+
+	// A gradient has enough detail for the quality to make a difference.
+	img := image.NewRGBA(image.Rect(0, 0, 96, 96))
+	for x := 0; x < 96; x++ {
+		for y := 0; y < 96; y++ {
+			img.Set(x, y, color.RGBA{R: uint8(x * 2), G: uint8(y * 2), B: uint8(x * y), A: 0xff})
+		}
+	}
+	sizes := map[int]int64{}
+	for _, quality := range []int{10, 95} {
+		dst := types.Path(filepath.Join(dir, fmt.Sprintf("thumbnail-%d", quality)))
+		if err = writeFile(img, dst, thumbnailContentType, quality, nil); err != nil {
+			t.Fatal(err)
+		}
+		info, statErr := os.Stat(string(dst))
+		if statErr != nil {
+			t.Fatal(statErr)
+		}
+		sizes[quality] = info.Size()
+	}
+	if sizes[10] >= sizes[95] {
+		t.Errorf("thumbnail at quality 10 is %d bytes, which isn't smaller than %d bytes at quality 95", sizes[10], sizes[95])
+	}
+}
+
+func TestPadImage(t *testing.T) {
+	red := color.NRGBA{R: 0xff, A: 0xff}
+	white := color.NRGBA{R: 0xff, G: 0xff, B: 0xff, A: 0xff}
+	tests := []struct {
+		name       string
+		srcW, srcH int
+		w, h       int
+		background color.NRGBA
+		// The image is drawn within inner and the rest is padding.
+		inner image.Rectangle
+	}{
+		{"portrait in square", 300, 600, 32, 32, white, image.Rect(8, 0, 24, 32)},
+		{"landscape in square", 600, 300, 32, 32, white, image.Rect(0, 8, 32, 24)},
+		{"square in landscape", 400, 400, 100, 50, color.NRGBA{}, image.Rect(25, 0, 75, 50)},
+		{"same aspect", 600, 300, 64, 32, white, image.Rect(0, 0, 64, 32)},
+		{"smaller than requested", 20, 10, 40, 40, white, image.Rect(10, 15, 30, 25)},
+	}
+	for _, tt := range tests {
+		src := image.NewRGBA(image.Rect(0, 0, tt.srcW, tt.srcH))
+		draw.Draw(src, src.Bounds(), image.NewUniform(red), image.Point{}, draw.Src)
+
+		out := padImage(src, tt.w, tt.h, tt.background)
+		bounds := out.Bounds()
+		if bounds.Dx() != tt.w || bounds.Dy() != tt.h {
+			t.Errorf("%s: padded thumbnail is %dx%d, want %dx%d", tt.name, bounds.Dx(), bounds.Dy(), tt.w, tt.h)
+			continue
+		}
+		for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+			for x := bounds.Min.X; x < bounds.Max.X; x++ {
+				// Pixels on the edge of the image are blended with the padding when scaling.
+				if x == tt.inner.Min.X || x == tt.inner.Max.X-1 || y == tt.inner.Min.Y || y == tt.inner.Max.Y-1 {
+					continue
+				}
+				want := tt.background
+				if image.Pt(x, y).In(tt.inner) {
+					want = red
+				}
+				if got := color.NRGBAModel.Convert(out.At(x, y)).(color.NRGBA); got != want {
+					t.Errorf("%s: pixel at %d,%d is %v, want %v", tt.name, x, y, got, want)
+					break
+				}
+			}
+		}
+	}
+}
+
+func TestGeneratePaddedThumbnail(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mediaapi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir) // nolint: errcheck
+
+	src := types.Path(filepath.Join(dir, "file"))
+	file, err := os.Create(string(src))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = png.Encode(file, image.NewRGBA(image.Rect(0, 0, 64, 32))); err != nil {
+		t.Fatal(err)
+	}
+	if err = file.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db := &thumbnailTestDatabase{thumbnails: map[types.ThumbnailSize]*types.ThumbnailMetadata{}}
+	mediaMetadata := &types.MediaMetadata{
+		MediaID:    "abc",
+		Origin:     "localhost",
+		Base64Hash: "somehash",
+	}
+	activeThumbnailGeneration := &types.ActiveThumbnailGeneration{
+		PathToResult: map[string]*types.ThumbnailGenerationResult{},
+	}
+	logger := logrus.NewEntry(logrus.New())
+
+	// Both sizes are padded around the image rather than enlarging it, and the same
+	// size with a different background is a different thumbnail.
+	for _, size := range []types.ThumbnailSize{
+		{Width: 96, Height: 96, ResizeMethod: types.Pad, Background: "00000000"},
+		{Width: 96, Height: 96, ResizeMethod: types.Pad, Background: "ff0000ff"},
+		{Width: 32, Height: 32, ResizeMethod: types.Pad, Background: "00000000"},
+	} {
+		busy, genErr := GenerateThumbnail(
+			context.Background(), src, size, mediaMetadata,
+			activeThumbnailGeneration, 1, 0, 85, db, nil, logger,
+		)
+		if genErr != nil || busy {
+			t.Fatalf("%+v: GenerateThumbnail returned busy %v, error %v", size, busy, genErr)
+		}
+		thumbnail := db.thumbnails[size]
+		if thumbnail == nil {
+			t.Fatalf("%+v: thumbnail wasn't stored", size)
+		}
+		if thumbnail.MediaMetadata.ContentType != "image/png" {
+			t.Errorf("%+v: thumbnail content type is %q, want image/png", size, thumbnail.MediaMetadata.ContentType)
+		}
+
+		out, openErr := os.Open(string(GetThumbnailPath(src, size)))
+		if openErr != nil {
+			t.Fatal(openErr)
+		}
+		img, decodeErr := png.Decode(out)
+		out.Close() // nolint: errcheck
+		if decodeErr != nil {
+			t.Fatalf("%+v: thumbnail isn't a PNG: %s", size, decodeErr)
+		}
+		if img.Bounds().Dx() != size.Width || img.Bounds().Dy() != size.Height {
+			t.Errorf("%+v: thumbnail is %dx%d", size, img.Bounds().Dx(), img.Bounds().Dy())
+		}
+		want := backgroundColor(size)
+		if got := color.NRGBAModel.Convert(img.At(0, 0)).(color.NRGBA); got != want {
+			t.Errorf("%+v: thumbnail is padded with %v, want %v", size, got, want)
+		}
+	}
+	if db.stored != 3 {
+		t.Errorf("%d thumbnails were stored, want 3", db.stored)
+	}
+}
+
+func TestGenerateThumbnailLargerThanOriginal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mediaapi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir) // nolint: errcheck
+
+	var tiny bytes.Buffer
+	if err = png.Encode(&tiny, image.NewRGBA(image.Rect(0, 0, 8, 6))); err != nil {
+		t.Fatal(err)
+	}
+	logger := logrus.NewEntry(logrus.New())
+	for _, tt := range []struct {
+		name    string
+		content []byte
+		size    types.ThumbnailSize
+		// The dimensions of the stored thumbnail, or zero if none should be.
+		wantWidth, wantHeight int
+	}{
+		{"scale", tiny.Bytes(), types.ThumbnailSize{Width: 800, Height: 600, ResizeMethod: types.Scale}, 0, 0},
+		{"crop", tiny.Bytes(), types.ThumbnailSize{Width: 800, Height: 600, ResizeMethod: types.Crop}, 0, 0},
+		{"same size", tiny.Bytes(), types.ThumbnailSize{Width: 8, Height: 6, ResizeMethod: types.Crop}, 0, 0},
+		// Only the height is cropped, the width is kept at the size of the original.
+		{"crop one dimension", tiny.Bytes(), types.ThumbnailSize{Width: 800, Height: 4, ResizeMethod: types.Crop}, 8, 4},
+		// The original is padded to the requested size without being enlarged.
+		{"pad", tiny.Bytes(), types.ThumbnailSize{Width: 800, Height: 600, ResizeMethod: types.Pad, Background: "00000000"}, 800, 600},
+		// The size is known from the header, so the image isn't decoded, which would fail.
+		{"undecodable", pngDeclaring(t, 8, 6), types.ThumbnailSize{Width: 800, Height: 600, ResizeMethod: types.Scale}, 0, 0},
+	} {
+		src := types.Path(filepath.Join(dir, tt.name))
+		if err = ioutil.WriteFile(string(src), tt.content, 0600); err != nil {
+			t.Fatal(err)
+		}
+		db := &thumbnailTestDatabase{thumbnails: map[types.ThumbnailSize]*types.ThumbnailMetadata{}}
+		mediaMetadata := &types.MediaMetadata{MediaID: types.MediaID(tt.name), Origin: "localhost", Base64Hash: types.Base64Hash(tt.name)}
+		activeThumbnailGeneration := &types.ActiveThumbnailGeneration{
+			PathToResult: map[string]*types.ThumbnailGenerationResult{},
+		}
+		busy, genErr := GenerateThumbnail(
+			context.Background(), src, tt.size, mediaMetadata,
+			activeThumbnailGeneration, 1, 0, 85, db, nil, logger,
+		)
+		if genErr != nil || busy {
+			t.Errorf("%s: GenerateThumbnail returned busy %v, error %v", tt.name, busy, genErr)
+			continue
+		}
+		if tt.wantWidth == 0 {
+			if db.stored != 0 {
+				t.Errorf("%s: %d thumbnails stored, want the original to be served instead", tt.name, db.stored)
+			}
+			continue
+		}
+		if db.stored != 1 {
+			t.Errorf("%s: %d thumbnails stored, want 1", tt.name, db.stored)
+			continue
+		}
+		out, openErr := os.Open(string(GetThumbnailPath(src, tt.size)))
+		if openErr != nil {
+			t.Fatal(openErr)
+		}
+		img, _, decodeErr := image.Decode(out)
+		out.Close() // nolint: errcheck
+		if decodeErr != nil {
+			t.Fatalf("%s: %v", tt.name, decodeErr)
+		}
+		if img.Bounds().Dx() != tt.wantWidth || img.Bounds().Dy() != tt.wantHeight {
+			t.Errorf("%s: thumbnail is %dx%d, want %dx%d", tt.name, img.Bounds().Dx(), img.Bounds().Dy(), tt.wantWidth, tt.wantHeight)
+		}
+	}
+}
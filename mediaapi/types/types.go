@@ -15,7 +15,10 @@
 package types
 
 import (
+	"database/sql/driver"
+	"fmt"
 	"sync"
+	"time"
 
 	"github.com/matrix-org/dendrite/internal/config"
 	"github.com/matrix-org/gomatrixserverlib"
@@ -36,6 +39,56 @@ type Base64Hash string
 // Path is an absolute or relative UNIX filesystem path
 type Path string
 
+// Encryption is whether a file is encrypted in the media store.
+type Encryption int
+
+const (
+	// EncryptionUnknown is for files which were stored before whether each file is
+	// encrypted was recorded. Whether they are is told from their header instead.
+	EncryptionUnknown Encryption = iota
+	// NotEncrypted files are stored as they are.
+	NotEncrypted
+	// Encrypted files are stored encrypted with one of the media encryption keys.
+	Encrypted
+)
+
+// EncryptionFor is the Encryption of a file which is known to be, or not to be,
+// encrypted.
+func EncryptionFor(encrypted bool) Encryption {
+	if encrypted {
+		return Encrypted
+	}
+	return NotEncrypted
+}
+
+// Scan implements sql.Scanner. The encryption is stored as a nullable boolean,
+// which is NULL for files which were stored before it was recorded.
+func (e *Encryption) Scan(src interface{}) error {
+	switch v := src.(type) {
+	case nil:
+		*e = EncryptionUnknown
+	case bool:
+		*e = EncryptionFor(v)
+	case int64:
+		*e = EncryptionFor(v != 0)
+	default:
+		return fmt.Errorf("cannot scan %T into Encryption", src)
+	}
+	return nil
+}
+
+// Value implements driver.Valuer.
+func (e Encryption) Value() (driver.Value, error) {
+	switch e {
+	case Encrypted:
+		return true, nil
+	case NotEncrypted:
+		return false, nil
+	default:
+		return nil, nil
+	}
+}
+
 // MediaID is a string representing the unique identifier for a file (could be a hash but does not have to be)
 type MediaID string
 
@@ -58,6 +111,47 @@ type MediaMetadata struct {
 	UploadName        Filename
 	Base64Hash        Base64Hash
 	UserID            MatrixUserID
+	// Whether the file, which may be shared with other media with the same hash,
+	// is encrypted in the media store.
+	Encryption Encryption
+	// How the uploader asked for the media to be shown when downloaded, either
+	// "inline" or "attachment", or empty if they didn't.
+	Disposition string
+}
+
+// MediaReservation is a media ID which has been reserved by a user with /create
+// but which has not been uploaded to yet. https://github.com/matrix-org/matrix-doc/pull/2246
+type MediaReservation struct {
+	MediaID           MediaID
+	Origin            gomatrixserverlib.ServerName
+	UserID            MatrixUserID
+	CreationTimestamp UnixMs
+	ExpiresTimestamp  UnixMs
+}
+
+// MediaAccess is when media was last downloaded or had a thumbnail of it downloaded,
+// and how many times the media itself was downloaded.
+type MediaAccess struct {
+	LastAccess    UnixMs
+	DownloadCount int64
+}
+
+// MediaReport is a user reporting media as abusive.
+type MediaReport struct {
+	ReportID          int64
+	MediaID           MediaID
+	Origin            gomatrixserverlib.ServerName
+	UserID            MatrixUserID
+	Reason            string
+	Score             int
+	ReportedTimestamp UnixMs
+}
+
+// UserTraffic is how much a user uploaded, and how much of the media they uploaded
+// was served, over some time.
+type UserTraffic struct {
+	BytesUploaded int64
+	BytesServed   int64
 }
 
 // RemoteRequestResult is used for broadcasting the result of a request for a remote file to routines waiting on the condition
@@ -76,6 +170,9 @@ type ActiveRemoteRequests struct {
 	sync.Mutex
 	// The string key is an mxc:// URL
 	MXCToResult map[string]*RemoteRequestResult
+	// When the remote media at each mxc:// URL, which the remote server said it
+	// didn't have, should next be asked for again. Created when first needed.
+	MXCToNotFoundExpiry map[string]time.Time
 }
 
 // ThumbnailSize contains a single thumbnail size configuration
@@ -95,11 +192,11 @@ type ThumbnailGenerationResult struct {
 	Err error
 }
 
-// ActiveThumbnailGeneration is a lockable map of file paths being thumbnailed
+// ActiveThumbnailGeneration is a lockable map of thumbnails being generated
 // It is used to ensure thumbnails are only generated once.
 type ActiveThumbnailGeneration struct {
 	sync.Mutex
-	// The string key is a thumbnail file path
+	// The string key identifies the content hash, size, resize method and format of a thumbnail
 	PathToResult map[string]*ThumbnailGenerationResult
 }
 
@@ -108,3 +205,6 @@ const Crop = "crop"
 
 // Scale indicates we should scale the thumbnail on resize
 const Scale = "scale"
+
+// Pad indicates we should scale the thumbnail on resize and pad it to the requested size
+const Pad = "pad"